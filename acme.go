@@ -0,0 +1,37 @@
+package main
+
+import (
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const acmeCacheDirDefault = "acme-cache"
+
+// Returns the certificate manager of ACME_DOMAINS, or nil without it. Certificates are issued on
+// the first TLS handshake of a domain, cached in ACME_CACHE_DIR and renewed before they expire.
+func newACMEManager() *autocert.Manager {
+	domains := os.Getenv("ACME_DOMAINS")
+	if domains == "" {
+		return nil
+	}
+
+	cacheDir := os.Getenv("ACME_CACHE_DIR")
+	if cacheDir == "" {
+		cacheDir = acmeCacheDirDefault
+	}
+
+	manager := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(strings.Split(domains, "|")...),
+		Cache:      autocert.DirCache(cacheDir),
+		Email:      os.Getenv("ACME_EMAIL"),
+	}
+	if directoryURL := os.Getenv("ACME_DIRECTORY_URL"); directoryURL != "" {
+		manager.Client = &acme.Client{DirectoryURL: directoryURL}
+	}
+
+	return manager
+}
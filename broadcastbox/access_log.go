@@ -0,0 +1,184 @@
+package broadcastbox
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/glimesh/broadcast-box/internal/logging"
+)
+
+type (
+	// accessLog writes a line for each HTTP request, set with ACCESS_LOG
+	accessLog struct {
+		json bool
+
+		// Paths that aren't logged, ones ending with `/` exclude the paths under them
+		excludePaths []string
+
+		lock sync.Mutex
+		out  io.Writer
+	}
+
+	// accessLogEntry is what is known of a request once it was served. Handlers fill in the
+	// stream key with setAccessLogStreamKey.
+	accessLogEntry struct {
+		streamKey string
+	}
+
+	accessLogContextKey struct{}
+
+	// accessLogRecorder keeps the status code and size of a response
+	accessLogRecorder struct {
+		http.ResponseWriter
+		status int
+		bytes  int64
+	}
+
+	accessLogJSON struct {
+		Time      time.Time `json:"time"`
+		Method    string    `json:"method"`
+		Path      string    `json:"path"`
+		Protocol  string    `json:"protocol"`
+		Status    int       `json:"status"`
+		Bytes     int64     `json:"bytes"`
+		LatencyMs float64   `json:"latencyMs"`
+		StreamKey string    `json:"streamKey,omitempty"`
+		ClientIP  string    `json:"clientIp"`
+		UserAgent string    `json:"userAgent,omitempty"`
+	}
+)
+
+// newAccessLog returns the access log of format, see ACCESS_LOG, or nil without one
+func newAccessLog(format, path string, excludePaths []string) (*accessLog, error) {
+	l := &accessLog{out: os.Stdout, excludePaths: excludePaths}
+
+	switch format {
+	case "":
+		return nil, nil
+	case "common":
+	case "json":
+		l.json = true
+	default:
+		return nil, fmt.Errorf("ACCESS_LOG must be `common` or `json`, got `%s`", format)
+	}
+
+	if path != "" {
+		f, err := logging.OpenFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("ACCESS_LOG_FILE: %w", err)
+		}
+		l.out = f
+	}
+
+	return l, nil
+}
+
+// AccessLogHandler logs the requests next serves if ACCESS_LOG is set, with the stream key of
+// the ones to this Server's endpoints
+func (s *Server) AccessLogHandler(next http.Handler) http.Handler {
+	if s.accessLog == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if s.accessLog.excludes(req.URL.Path) {
+			next.ServeHTTP(res, req)
+			return
+		}
+
+		start := time.Now()
+		entry := &accessLogEntry{}
+		recorder := &accessLogRecorder{ResponseWriter: res}
+		next.ServeHTTP(recorder, req.WithContext(context.WithValue(req.Context(), accessLogContextKey{}, entry)))
+
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+		s.accessLog.write(req, s.clientIP(req), entry, recorder, start)
+	})
+}
+
+// setAccessLogStreamKey records the stream key req was for in its access log line
+func setAccessLogStreamKey(req *http.Request, streamKey string) {
+	if entry, ok := req.Context().Value(accessLogContextKey{}).(*accessLogEntry); ok {
+		entry.streamKey = streamKey
+	}
+}
+
+func (l *accessLog) excludes(path string) bool {
+	for _, excluded := range l.excludePaths {
+		if path == excluded || (strings.HasSuffix(excluded, "/") && strings.HasPrefix(path, excluded)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (l *accessLog) write(req *http.Request, clientIP string, entry *accessLogEntry, recorder *accessLogRecorder, start time.Time) {
+	latency := time.Since(start)
+
+	var line []byte
+	if l.json {
+		var err error
+		line, err = json.Marshal(accessLogJSON{
+			Time:      start.UTC(),
+			Method:    req.Method,
+			Path:      req.URL.Path,
+			Protocol:  req.Proto,
+			Status:    recorder.status,
+			Bytes:     recorder.bytes,
+			LatencyMs: float64(latency.Microseconds()) / 1000,
+			StreamKey: entry.streamKey,
+			ClientIP:  clientIP,
+			UserAgent: req.UserAgent(),
+		})
+		if err != nil {
+			logger.Warn("Failed to encode access log line", "err", err)
+			return
+		}
+	} else {
+		// Common Log Format, followed by the latency in seconds and the stream key. The query
+		// is left out like in JSON, it may have the signature of a signed URL.
+		streamKey := entry.streamKey
+		if streamKey == "" {
+			streamKey = "-"
+		}
+		line = fmt.Appendf(nil, "%s - - [%s] %q %d %d %.3f %s",
+			clientIP, start.Format("02/Jan/2006:15:04:05 -0700"), req.Method+" "+req.URL.Path+" "+req.Proto,
+			recorder.status, recorder.bytes, latency.Seconds(), streamKey)
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if _, err := l.out.Write(append(line, '\n')); err != nil {
+		logger.Warn("Failed to write access log", "err", err)
+	}
+}
+
+func (r *accessLogRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *accessLogRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+func (r *accessLogRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
@@ -0,0 +1,187 @@
+package broadcastbox
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/glimesh/broadcast-box/internal/oidc"
+)
+
+const (
+	adminSessionCookie   = "broadcast_box_session"
+	adminSessionDuration = 12 * time.Hour
+
+	// Holds the state and nonce between redirecting to the provider and its callback
+	adminLoginCookie   = "broadcast_box_login"
+	adminLoginDuration = 10 * time.Minute
+)
+
+type (
+	// adminLogin signs operators in to the admin API with OpenID Connect, sessions are kept in
+	// memory so a restart signs everyone out
+	adminLogin struct {
+		provider *oidc.Provider
+
+		// Verified emails that may sign in
+		allowedEmails map[string]bool
+
+		secureCookies bool
+
+		sessionsLock sync.Mutex
+		sessions     map[string]adminSession
+	}
+
+	adminSession struct {
+		identity oidc.Identity
+		expires  time.Time
+	}
+)
+
+func newAdminLogin(opts oidc.Options, allowedEmails []string) (*adminLogin, error) {
+	a := &adminLogin{
+		allowedEmails: map[string]bool{},
+		secureCookies: strings.HasPrefix(opts.RedirectURL, "https://"),
+		sessions:      map[string]adminSession{},
+	}
+	for _, email := range allowedEmails {
+		if email = strings.TrimSpace(email); email != "" {
+			a.allowedEmails[strings.ToLower(email)] = true
+		}
+	}
+
+	// Anyone with an account at a public provider could sign in otherwise
+	if len(a.allowedEmails) == 0 {
+		return nil, errors.New("OIDC_ALLOWED_EMAILS must list the emails of the operators")
+	}
+
+	provider, err := oidc.New(opts)
+	if err != nil {
+		return nil, err
+	}
+	a.provider = provider
+
+	return a, nil
+}
+
+// allowed returns if identity may sign in, which needs one of allowedEmails that the provider
+// verified
+func (a *adminLogin) allowed(identity oidc.Identity) bool {
+	return identity.EmailVerified && a.allowedEmails[strings.ToLower(identity.Email)]
+}
+
+func randomHex() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+
+	return hex.EncodeToString(b)
+}
+
+func (a *adminLogin) setCookie(res http.ResponseWriter, name, value string, maxAge time.Duration) {
+	http.SetCookie(res, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   int(maxAge.Seconds()),
+		HttpOnly: true,
+		Secure:   a.secureCookies,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// loginHandler redirects to the provider's login page, afterwards the callback redirects to
+// the local path in the `redirect` query parameter
+func (a *adminLogin) loginHandler(res http.ResponseWriter, req *http.Request) {
+	redirect := req.URL.Query().Get("redirect")
+	if !strings.HasPrefix(redirect, "/") || strings.HasPrefix(redirect, "//") || strings.HasPrefix(redirect, "/\\") {
+		redirect = "/"
+	}
+
+	state, nonce := randomHex(), randomHex()
+	a.setCookie(res, adminLoginCookie, state+"."+nonce+"."+redirect, adminLoginDuration)
+	http.Redirect(res, req, a.provider.AuthCodeURL(state, nonce), http.StatusFound)
+}
+
+func (a *adminLogin) callbackHandler(res http.ResponseWriter, req *http.Request) {
+	cookie, err := req.Cookie(adminLoginCookie)
+	if err != nil {
+		logHTTPError(res, "Login expired, sign in again", http.StatusBadRequest)
+		return
+	}
+	a.setCookie(res, adminLoginCookie, "", -1)
+
+	state, rest, _ := strings.Cut(cookie.Value, ".")
+	nonce, redirect, _ := strings.Cut(rest, ".")
+	if errParam := req.URL.Query().Get("error"); errParam != "" {
+		logHTTPError(res, "Login failed: "+errParam, http.StatusUnauthorized)
+		return
+	} else if subtle.ConstantTimeCompare([]byte(state), []byte(req.URL.Query().Get("state"))) != 1 {
+		logHTTPError(res, "Login state doesn't match", http.StatusBadRequest)
+		return
+	}
+
+	identity, err := a.provider.Exchange(req.Context(), req.URL.Query().Get("code"), nonce)
+	if err != nil {
+		logHTTPError(res, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if !a.allowed(*identity) {
+		logHTTPError(res, "`"+identity.Email+"` may not sign in", http.StatusForbidden)
+		return
+	}
+
+	sessionID := randomHex()
+	a.sessionsLock.Lock()
+	for id, session := range a.sessions {
+		if time.Now().After(session.expires) {
+			delete(a.sessions, id)
+		}
+	}
+	a.sessions[sessionID] = adminSession{identity: *identity, expires: time.Now().Add(adminSessionDuration)}
+	a.sessionsLock.Unlock()
+
+	logger.Info("Operator signed in", "email", identity.Email, "subject", identity.Subject)
+	a.setCookie(res, adminSessionCookie, sessionID, adminSessionDuration)
+	http.Redirect(res, req, redirect, http.StatusFound)
+}
+
+func (a *adminLogin) logoutHandler(res http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		logHTTPError(res, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if cookie, err := req.Cookie(adminSessionCookie); err == nil {
+		a.sessionsLock.Lock()
+		delete(a.sessions, cookie.Value)
+		a.sessionsLock.Unlock()
+	}
+
+	a.setCookie(res, adminSessionCookie, "", -1)
+}
+
+// signedIn returns who is signed in with the session cookie of req, if it hasn't expired
+func (a *adminLogin) signedIn(req *http.Request) (oidc.Identity, bool) {
+	cookie, err := req.Cookie(adminSessionCookie)
+	if err != nil {
+		return oidc.Identity{}, false
+	}
+
+	a.sessionsLock.Lock()
+	defer a.sessionsLock.Unlock()
+
+	session, ok := a.sessions[cookie.Value]
+	if !ok || time.Now().After(session.expires) {
+		return oidc.Identity{}, false
+	}
+
+	return session.identity, true
+}
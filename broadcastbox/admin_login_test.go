@@ -0,0 +1,34 @@
+package broadcastbox
+
+import (
+	"testing"
+
+	"github.com/glimesh/broadcast-box/internal/oidc"
+)
+
+func TestAdminLoginNeedsAllowedEmails(t *testing.T) {
+	for _, allowedEmails := range [][]string{nil, {""}, {" "}} {
+		if _, err := newAdminLogin(oidc.Options{Issuer: "https://issuer.invalid"}, allowedEmails); err == nil {
+			t.Errorf("newAdminLogin accepted the allowed emails %q", allowedEmails)
+		}
+	}
+}
+
+func TestAdminLoginAllowed(t *testing.T) {
+	a := &adminLogin{allowedEmails: map[string]bool{"operator@example.com": true}}
+
+	for _, c := range []struct {
+		identity oidc.Identity
+		allowed  bool
+	}{
+		{oidc.Identity{Email: "operator@example.com", EmailVerified: true}, true},
+		{oidc.Identity{Email: "Operator@Example.com", EmailVerified: true}, true},
+		{oidc.Identity{Email: "operator@example.com"}, false},
+		{oidc.Identity{Email: "other@example.com", EmailVerified: true}, false},
+		{oidc.Identity{EmailVerified: true}, false},
+	} {
+		if allowed := a.allowed(c.identity); allowed != c.allowed {
+			t.Errorf("%+v allowed: %v, want %v", c.identity, allowed, c.allowed)
+		}
+	}
+}
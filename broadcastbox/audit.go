@@ -0,0 +1,60 @@
+package broadcastbox
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+
+	"github.com/glimesh/broadcast-box/internal/audit"
+	"github.com/glimesh/broadcast-box/internal/events"
+)
+
+// auditEvents records the publishers that stop to AUDIT_LOG_FILE, whichever protocol they used
+type auditEvents struct {
+	log *audit.Log
+}
+
+func (a auditEvents) Publish(e events.Event) error {
+	if e.Type == events.TypePublishStop {
+		a.log.Record(audit.Entry{Action: audit.ActionUnpublish, StreamKey: e.StreamKey})
+	}
+
+	return nil
+}
+
+// credentialActor identifies the credential a publisher used in the audit log without
+// revealing it, by the start of its SHA-256
+func credentialActor(credential string) string {
+	sum := sha256.Sum256([]byte(credential))
+	return "credential:" + hex.EncodeToString(sum[:6])
+}
+
+// clientIP is the address of req for the audit log, see clientAddr
+func (s *Server) clientIP(req *http.Request) string {
+	if addr, err := s.clientAddr(req); err == nil {
+		return addr.String()
+	}
+
+	return req.RemoteAddr
+}
+
+// auditAdminRequest records a request to the operator API by actor that changes something
+func (s *Server) auditAdminRequest(req *http.Request, actor string, status int) {
+	if req.Method == http.MethodGet || req.Method == http.MethodHead {
+		return
+	} else if status == 0 {
+		status = http.StatusOK
+	}
+
+	s.auditLog.Record(audit.Entry{
+		Action: audit.ActionAdminRequest,
+		Actor:  actor,
+		IP:     s.clientIP(req),
+		Details: map[string]string{
+			"method": req.Method,
+			"path":   req.URL.Path,
+			"status": strconv.Itoa(status),
+		},
+	})
+}
@@ -0,0 +1,316 @@
+package broadcastbox
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/glimesh/broadcast-box/internal/jwt"
+)
+
+// tokenList are Bearer tokens and the stream key each one is for, like from WHIP_TOKENS and
+// WHIP_TOKEN_FILE
+type tokenList struct {
+	tokens map[string]string
+
+	// Read on every request, so tokens can be changed without a restart
+	file string
+}
+
+func newTokenList(envKey string, tokens []string, file string) (*tokenList, error) {
+	t := &tokenList{tokens: map[string]string{}, file: file}
+	for _, pair := range tokens {
+		if err := addToken(t.tokens, pair); err != nil {
+			return nil, fmt.Errorf("%s: %w", envKey, err)
+		}
+	}
+
+	return t, nil
+}
+
+// addToken adds a `<stream key>:<token>` pair to tokens
+func addToken(tokens map[string]string, pair string) error {
+	streamKey, token, ok := strings.Cut(pair, ":")
+	if !ok || token == "" {
+		return fmt.Errorf("%q isn't a `<stream key>:<token>` pair", pair)
+	} else if !validateStreamKey(streamKey) {
+		return fmt.Errorf("invalid stream key %q", streamKey)
+	}
+
+	tokens[token] = streamKey
+	return nil
+}
+
+func (t *tokenList) enabled() bool {
+	return len(t.tokens) != 0 || t.file != ""
+}
+
+// all returns every token, keyed by token
+func (t *tokenList) all() (map[string]string, error) {
+	tokens := map[string]string{}
+	if t.file != "" {
+		fileTokens, err := t.readFile()
+		if err != nil {
+			return nil, err
+		}
+		tokens = fileTokens
+	}
+
+	for token, streamKey := range t.tokens {
+		tokens[token] = streamKey
+	}
+
+	return tokens, nil
+}
+
+// readFile reads the token file, a `<stream key>:<token>` pair per line. Empty lines and lines
+// starting with # are skipped.
+func (t *tokenList) readFile() (map[string]string, error) {
+	data, err := os.ReadFile(t.file)
+	if err != nil {
+		return nil, err
+	}
+
+	tokens := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		pair := strings.TrimSpace(scanner.Text())
+		if pair == "" || strings.HasPrefix(pair, "#") {
+			continue
+		}
+
+		if err := addToken(tokens, pair); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", t.file, line, err)
+		}
+	}
+
+	return tokens, scanner.Err()
+}
+
+// lookupToken returns the stream key of token in tokens. Every token is compared so the time
+// taken doesn't tell how much of one matched.
+func lookupToken(tokens map[string]string, token string) (string, bool) {
+	streamKey, found := "", false
+	for t, k := range tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			streamKey, found = k, true
+		}
+	}
+
+	return streamKey, found
+}
+
+// publisherStreamKey returns the stream key of the publisher that authenticated req with its
+// Bearer token, otherwise it responds with an error
+func (s *Server) publisherStreamKey(res http.ResponseWriter, req *http.Request) (string, bool) {
+	authHeader := req.Header.Get("Authorization")
+	if authHeader == "" {
+		logHTTPError(res, "Authorization was not set", http.StatusBadRequest)
+		return "", false
+	}
+
+	token, ok := extractBearerToken(authHeader)
+	if ok && s.jwtVerifier != nil && jwt.IsJWT(token) {
+		return s.jwtStreamKey(res, req, token, jwt.RolePublish)
+	}
+
+	if !s.whipTokens.enabled() && s.jwtVerifier == nil && s.keyStore == nil {
+		if !ok || !validateStreamKey(token) {
+			logHTTPError(res, "Invalid stream key format", http.StatusBadRequest)
+			return "", false
+		}
+
+		return token, true
+	}
+
+	tokens, err := s.whipTokens.all()
+	if err != nil {
+		logHTTPError(res, err.Error(), http.StatusInternalServerError)
+		return "", false
+	}
+
+	if streamKey, found := lookupToken(tokens, token); ok && found {
+		return streamKey, true
+	}
+
+	// With a key store the token is an enabled stream key, or a generated key of one
+	if s.keyStore != nil && ok {
+		streamKey, allowed, err := s.keyStore.Authenticate(token)
+		if err != nil {
+			logHTTPError(res, err.Error(), http.StatusInternalServerError)
+			return "", false
+		} else if allowed {
+			return streamKey, true
+		}
+	}
+
+	res.Header().Set("WWW-Authenticate", "Bearer")
+	logHTTPError(res, "Invalid publisher token", http.StatusUnauthorized)
+	return "", false
+}
+
+// publisherAPIStreamKey is publisherStreamKey for the publisher APIs like `/api/pause`, which
+// also need a credential other than the stream key. Viewers play with the stream key, so with
+// it alone they could control someone else's stream.
+func (s *Server) publisherAPIStreamKey(res http.ResponseWriter, req *http.Request) (string, bool) {
+	streamKey, ok := s.publisherStreamKey(res, req)
+	if !ok {
+		return streamKey, false
+	}
+
+	if token, _ := extractBearerToken(req.Header.Get("Authorization")); token == streamKey {
+		logHTTPError(res, "Publisher APIs need a token from WHIP_TOKENS, a JWT or a generated key, not the stream key", http.StatusForbidden)
+		return streamKey, false
+	}
+
+	return streamKey, true
+}
+
+// viewerTokens returns the tokens of WHEP_TOKENS and WHEP_TOKEN_FILE, with the ones of streams
+// that have viewerTokens in their configuration replaced by those
+func (s *Server) viewerTokens() (map[string]string, error) {
+	tokens, err := s.whepTokens.all()
+	if err != nil {
+		return nil, err
+	}
+
+	for streamKey, streamTokens := range s.ViewerTokens() {
+		for token, k := range tokens {
+			if k == streamKey {
+				delete(tokens, token)
+			}
+		}
+
+		for _, token := range streamTokens {
+			tokens[token] = streamKey
+		}
+	}
+
+	return tokens, nil
+}
+
+// isPrivate returns if tokens has any for streamKey, then it can only be watched with one
+func isPrivate(tokens map[string]string, streamKey string) bool {
+	for _, k := range tokens {
+		if k == streamKey {
+			return true
+		}
+	}
+
+	return false
+}
+
+// viewerStreamKey returns the stream key a WHEP viewer plays. Either the URL is signed, or the
+// Bearer token is a viewer token or the stream key of a stream that doesn't have any. Otherwise
+// it responds with an error. One-time tokens are reserved until oneTimeTokens.release.
+func (s *Server) viewerStreamKey(res http.ResponseWriter, req *http.Request) (string, viewerCredential, bool) {
+	if s.whepURLSecret != nil && req.URL.Query().Has("signature") {
+		streamKey, ok := s.signedURLStreamKey(res, req)
+		return streamKey, viewerCredential{kind: "signedUrl", value: req.URL.Query().Get("signature")}, ok
+	}
+
+	authHeader := req.Header.Get("Authorization")
+	if authHeader == "" {
+		logHTTPError(res, "Authorization was not set", http.StatusBadRequest)
+		return "", viewerCredential{}, false
+	}
+
+	token, ok := extractBearerToken(authHeader)
+	if !ok {
+		logHTTPError(res, "Invalid stream key format", http.StatusBadRequest)
+		return "", viewerCredential{}, false
+	} else if s.jwtVerifier != nil && jwt.IsJWT(token) {
+		streamKey, ok := s.jwtStreamKey(res, req, token, jwt.RoleView)
+		return streamKey, viewerCredential{kind: "jwt", value: token}, ok
+	} else if streamKey, reserved := s.oneTimeTokens.reserve(token); reserved {
+		return streamKey, viewerCredential{}, true
+	}
+
+	tokens, err := s.viewerTokens()
+	if err != nil {
+		logHTTPError(res, err.Error(), http.StatusInternalServerError)
+		return "", viewerCredential{}, false
+	}
+
+	if streamKey, found := lookupToken(tokens, token); found {
+		return streamKey, viewerCredential{kind: "viewerToken", value: token}, true
+	} else if !validateStreamKey(token) {
+		logHTTPError(res, "Invalid stream key format", http.StatusBadRequest)
+		return "", viewerCredential{}, false
+	} else if isPrivate(tokens, token) {
+		res.Header().Set("WWW-Authenticate", "Bearer")
+		logHTTPError(res, "Stream requires a viewer token", http.StatusUnauthorized)
+		return "", viewerCredential{}, false
+	}
+
+	return token, viewerCredential{}, true
+}
+
+// authorizeViewer checks that req may watch streamKey over HLS or DASH, or get its thumbnail and
+// recordings, like whepHandler does for WHEP. Private streams need a viewer token for it as the
+// Bearer token of every request.
+func (s *Server) authorizeViewer(res http.ResponseWriter, req *http.Request, streamKey string) bool {
+	if !s.checkClientIP(res, req, false, streamKey) || !s.checkViewerCountry(res, req, streamKey, false) {
+		return false
+	}
+
+	return s.checkViewerToken(res, req, streamKey) && s.authorizeViewerWithWebhook(res, req, streamKey)
+}
+
+// checkViewerToken responds with an error if streamKey is private and req doesn't have a viewer
+// token for it
+func (s *Server) checkViewerToken(res http.ResponseWriter, req *http.Request, streamKey string) bool {
+	tokens, err := s.viewerTokens()
+	if err != nil {
+		logHTTPError(res, err.Error(), http.StatusInternalServerError)
+		return false
+	} else if !isPrivate(tokens, streamKey) {
+		return true
+	}
+
+	token, ok := extractBearerToken(req.Header.Get("Authorization"))
+	if ok && s.jwtVerifier != nil && jwt.IsJWT(token) {
+		if claims, err := s.jwtVerifier.Verify(token); err == nil && claims.Allows(jwt.RoleView, streamKey) {
+			return true
+		}
+	}
+
+	if k, found := lookupToken(tokens, token); !ok || !found || k != streamKey {
+		res.Header().Set("WWW-Authenticate", "Bearer")
+		logHTTPError(res, "Stream requires a viewer token", http.StatusUnauthorized)
+		return false
+	}
+
+	return true
+}
+
+// jwtStreamKey returns the stream key a JWT is used for with role, the `streamKey` query
+// parameter or the only stream the token has. Otherwise it responds with an error.
+func (s *Server) jwtStreamKey(res http.ResponseWriter, req *http.Request, token, role string) (string, bool) {
+	claims, err := s.jwtVerifier.Verify(token)
+	if err != nil {
+		res.Header().Set("WWW-Authenticate", "Bearer")
+		logHTTPError(res, err.Error(), http.StatusUnauthorized)
+		return "", false
+	}
+
+	streamKey := req.URL.Query().Get("streamKey")
+	if streamKey == "" && len(claims.Streams) == 1 && claims.Streams[0] != "*" {
+		streamKey = claims.Streams[0]
+	}
+
+	if !validateStreamKey(streamKey) {
+		logHTTPError(res, "Invalid stream key format", http.StatusBadRequest)
+		return "", false
+	} else if !claims.Allows(role, streamKey) {
+		res.Header().Set("WWW-Authenticate", "Bearer")
+		logHTTPError(res, "Token doesn't allow to "+role+" stream `"+streamKey+"`", http.StatusForbidden)
+		return "", false
+	}
+
+	return streamKey, true
+}
@@ -0,0 +1,183 @@
+package broadcastbox
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	authWebhookTimeout = 5 * time.Second
+
+	// Header with the HMAC-SHA256 of the body, keyed with AUTH_WEBHOOK_SECRET
+	authWebhookSignatureHeader = "X-Broadcast-Box-Signature"
+
+	// Longest response body that is read for `allow`
+	authWebhookMaxResponse = 64 << 10
+
+	// How long an allowed HLS or DASH viewer isn't asked about again
+	authWebhookCacheDuration = 30 * time.Second
+)
+
+var errAuthWebhookDenied = errors.New("denied by auth webhook")
+
+type (
+	// authWebhook asks an external service if a WHIP or WHEP offer may be accepted
+	authWebhook struct {
+		url    string
+		secret []byte
+		client *http.Client
+
+		// When the viewers allowed by cacheKey have to be asked about again
+		allowed     map[string]time.Time
+		allowedLock sync.Mutex
+	}
+
+	authWebhookRequestJSON struct {
+		Action    string      `json:"action"` // `publish` or `view`
+		StreamKey string      `json:"streamKey"`
+		ClientIP  string      `json:"clientIp"`
+		Headers   http.Header `json:"headers"`
+	}
+
+	authWebhookResponseJSON struct {
+		Allow  *bool  `json:"allow"`
+		Reason string `json:"reason"`
+	}
+)
+
+func newAuthWebhook(rawURL, secret string) (*authWebhook, error) {
+	if u, err := url.Parse(rawURL); err != nil {
+		return nil, err
+	} else if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("AUTH_WEBHOOK_URL %q must be an http or https URL", rawURL)
+	}
+
+	return &authWebhook{
+		url:     rawURL,
+		secret:  []byte(secret),
+		client:  &http.Client{Timeout: authWebhookTimeout},
+		allowed: map[string]time.Time{},
+	}, nil
+}
+
+// authorize returns nil if the webhook allows action on streamKey for req from clientIP. A 2xx
+// response allows it unless its JSON body has `"allow": false`, anything else denies it.
+func (a *authWebhook) authorize(req *http.Request, clientIP, action, streamKey string) error {
+	payload, err := json.Marshal(authWebhookRequestJSON{
+		Action:    action,
+		StreamKey: streamKey,
+		ClientIP:  clientIP,
+		Headers:   req.Header,
+	})
+	if err != nil {
+		return err
+	}
+
+	webhookReq, err := http.NewRequestWithContext(req.Context(), http.MethodPost, a.url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	webhookReq.Header.Set("Content-Type", "application/json")
+
+	if len(a.secret) != 0 {
+		mac := hmac.New(sha256.New, a.secret)
+		mac.Write(payload)
+		webhookReq.Header.Set(authWebhookSignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := a.client.Do(webhookReq)
+	if err != nil {
+		return fmt.Errorf("auth webhook failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, authWebhookMaxResponse))
+	if err != nil {
+		return fmt.Errorf("auth webhook failed: %w", err)
+	}
+
+	var r authWebhookResponseJSON
+	_ = json.Unmarshal(body, &r)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 || (r.Allow != nil && !*r.Allow) {
+		if r.Reason == "" {
+			r.Reason = resp.Status
+		}
+		return fmt.Errorf("%w: %s", errAuthWebhookDenied, r.Reason)
+	}
+
+	return nil
+}
+
+// authorizeCached is authorize for viewers that request the same stream over and over, like the
+// playlists of HLS. A viewer is recognized by its address and credentials.
+func (a *authWebhook) authorizeCached(req *http.Request, clientIP, action, streamKey string) error {
+	cacheKey := strings.Join([]string{action, streamKey, clientIP, req.Header.Get("Authorization"), req.URL.Query().Get("signature")}, "\x00")
+	now := time.Now()
+
+	a.allowedLock.Lock()
+	expires, ok := a.allowed[cacheKey]
+	a.allowedLock.Unlock()
+	if ok && now.Before(expires) {
+		return nil
+	}
+
+	if err := a.authorize(req, clientIP, action, streamKey); err != nil {
+		return err
+	}
+
+	a.allowedLock.Lock()
+	defer a.allowedLock.Unlock()
+
+	for k, expires := range a.allowed {
+		if !now.Before(expires) {
+			delete(a.allowed, k)
+		}
+	}
+	a.allowed[cacheKey] = now.Add(authWebhookCacheDuration)
+	return nil
+}
+
+// authorizeWithWebhook asks AUTH_WEBHOOK_URL, if set, if req may do action on streamKey,
+// otherwise it responds with an error. Offers are rejected while the webhook is unreachable.
+func (s *Server) authorizeWithWebhook(res http.ResponseWriter, req *http.Request, action, streamKey string) bool {
+	if s.authWebhook == nil {
+		return true
+	}
+
+	return webhookAllowed(res, s.authWebhook.authorize(req, s.clientIP(req), action, streamKey))
+}
+
+// authorizeViewerWithWebhook is authorizeWithWebhook for HLS, DASH, thumbnails and recordings,
+// which the same viewer requests over and over. Allowed viewers are remembered for a while.
+func (s *Server) authorizeViewerWithWebhook(res http.ResponseWriter, req *http.Request, streamKey string) bool {
+	if s.authWebhook == nil {
+		return true
+	}
+
+	return webhookAllowed(res, s.authWebhook.authorizeCached(req, s.clientIP(req), "view", streamKey))
+}
+
+// webhookAllowed returns if err of the webhook is nil, otherwise it responds with it
+func webhookAllowed(res http.ResponseWriter, err error) bool {
+	if errors.Is(err, errAuthWebhookDenied) {
+		logHTTPError(res, err.Error(), http.StatusForbidden)
+		return false
+	} else if err != nil {
+		logHTTPError(res, err.Error(), http.StatusServiceUnavailable)
+		return false
+	}
+
+	return true
+}
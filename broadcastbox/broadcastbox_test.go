@@ -0,0 +1,56 @@
+package broadcastbox
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/glimesh/broadcast-box/internal/webrtc"
+)
+
+func TestCloseStopsSources(t *testing.T) {
+	streamConfigFile := filepath.Join(t.TempDir(), "streams.json")
+	if err := os.WriteFile(streamConfigFile, []byte(`{"pattern": {"testPattern": true}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewServer(Options{Options: webrtc.Options{
+		StreamConfigFile:   streamConfigFile,
+		RecordingDirectory: t.TempDir(),
+		DisableHLS:         true,
+		DisableDASH:        true,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for deadline := time.Now().Add(5 * time.Second); len(s.GetStreamStatuses()) == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("test pattern wasn't published")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	closed := make(chan error)
+	go func() {
+		closed <- s.Close()
+	}()
+
+	select {
+	case err = <-closed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close didn't return")
+	}
+
+	if statuses := s.GetStreamStatuses(); len(statuses) != 0 {
+		t.Fatalf("streams exist after Close: %+v", statuses)
+	}
+	if err = s.PlayTestPattern("pattern"); !errors.Is(err, webrtc.ErrServerClosed) {
+		t.Fatalf("source started after Close with %v", err)
+	}
+}
@@ -0,0 +1,97 @@
+package broadcastbox
+
+import (
+	"net/http"
+	"strings"
+)
+
+type (
+	// CORSOptions are what browsers on other sites may do with a group of endpoints, configured
+	// with CORS_<group>_* or else CORS_*. Anything that is unset is allowed.
+	CORSOptions struct {
+		AllowedOrigins   []string
+		AllowedMethods   string
+		AllowedHeaders   string
+		AllowCredentials bool
+	}
+
+	corsPolicy struct {
+		origins     []string
+		methods     string
+		headers     string
+		credentials bool
+	}
+)
+
+func newCORSPolicy(opts CORSOptions) corsPolicy {
+	p := corsPolicy{
+		origins:     []string{"*"},
+		methods:     "*",
+		headers:     "*",
+		credentials: opts.AllowCredentials,
+	}
+	if len(opts.AllowedOrigins) != 0 {
+		p.origins = opts.AllowedOrigins
+	}
+	if opts.AllowedMethods != "" {
+		p.methods = opts.AllowedMethods
+	}
+	if opts.AllowedHeaders != "" {
+		p.headers = opts.AllowedHeaders
+	}
+
+	return p
+}
+
+// allowOrigin returns the Access-Control-Allow-Origin for a request from origin, which is empty
+// if the origin isn't allowed
+func (p corsPolicy) allowOrigin(origin string) string {
+	for _, o := range p.origins {
+		if o == "*" && !p.credentials {
+			return "*"
+		} else if origin != "" && (o == "*" || originAllowed(strings.ToLower(origin), []string{o})) {
+			return origin
+		}
+	}
+
+	return ""
+}
+
+func corsHandler(p corsPolicy, next func(w http.ResponseWriter, r *http.Request)) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		allowOrigin := p.allowOrigin(req.Header.Get("Origin"))
+		if allowOrigin != "*" {
+			res.Header().Add("Vary", "Origin")
+		}
+
+		if allowOrigin != "" {
+			res.Header().Set("Access-Control-Allow-Origin", allowOrigin)
+
+			// With credentials `*` is taken literally, so the requested ones are allowed instead
+			methods, headers, expose := p.methods, p.headers, "*"
+			if p.credentials {
+				res.Header().Set("Access-Control-Allow-Credentials", "true")
+
+				if methods == "*" {
+					methods = req.Header.Get("Access-Control-Request-Method")
+				}
+				if headers == "*" {
+					headers = req.Header.Get("Access-Control-Request-Headers")
+				}
+				expose = "Location, Link, Content-Type, ETag, Accept-Patch"
+			}
+
+			if methods != "" {
+				res.Header().Set("Access-Control-Allow-Methods", methods)
+			}
+			if headers != "" {
+				res.Header().Set("Access-Control-Allow-Headers", headers)
+			}
+			res.Header().Set("Access-Control-Expose-Headers", expose)
+		}
+
+		if req.Method != http.MethodOptions {
+			next(res, req)
+		}
+	}
+}
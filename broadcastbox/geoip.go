@@ -0,0 +1,56 @@
+package broadcastbox
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// checkViewerCountry responds with an error if the allowCountries or blockCountries of streamKey
+// don't let the country req comes from watch it. Refused viewers are logged, allowed ones with
+// logAllowed, so HLS and DASH don't log every segment.
+func (s *Server) checkViewerCountry(res http.ResponseWriter, req *http.Request, streamKey string, logAllowed bool) bool {
+	allow, block := s.StreamCountries(streamKey)
+	if len(allow) == 0 && len(block) == 0 {
+		return true
+	} else if s.geoIP == nil {
+		logHTTPError(res, fmt.Sprintf("Stream `%s` has country lists without GEOIP_DATABASE", streamKey), http.StatusInternalServerError)
+		return false
+	}
+
+	addr, err := s.clientAddr(req)
+	if err != nil {
+		logHTTPError(res, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+
+	country, err := s.geoIP.Country(addr)
+	if err != nil {
+		logHTTPError(res, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+
+	hasCountry := func(countries []string) bool {
+		return slices.ContainsFunc(countries, func(c string) bool { return strings.EqualFold(c, country) })
+	}
+
+	// Addresses without a country are only refused by an allow list
+	if (country != "" && hasCountry(block)) || (len(allow) != 0 && (country == "" || !hasCountry(allow))) {
+		logHTTPError(res, fmt.Sprintf("GeoIP: refused %s (%s) for stream `%s`", addr, countryOrUnknown(country), streamKey), http.StatusForbidden)
+		return false
+	}
+
+	if logAllowed {
+		logger.Info("GeoIP: allowed", "addr", addr, "country", countryOrUnknown(country), "streamKey", streamKey)
+	}
+	return true
+}
+
+func countryOrUnknown(country string) string {
+	if country == "" {
+		return "unknown"
+	}
+
+	return country
+}
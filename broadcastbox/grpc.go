@@ -0,0 +1,252 @@
+package broadcastbox
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/glimesh/broadcast-box/internal/audit"
+	"github.com/glimesh/broadcast-box/internal/grpc"
+	"github.com/glimesh/broadcast-box/internal/webrtc"
+)
+
+// The service of control.proto
+const grpcService = "broadcastbox.v1.Control"
+
+// Methods of grpcService that change something, which are recorded in AUDIT_LOG_FILE
+var grpcAuditedMethods = map[string]bool{
+	"DisconnectSession":   true,
+	"DisconnectPublisher": true,
+	"RequestKeyframe":     true,
+	"SetRecording":        true,
+}
+
+// ListenAndServeGRPC serves the Control service of control.proto on addr over TLS with certFile
+// and keyFile, for other services to control streams with typed clients. Calls need adminToken
+// as the Bearer token. Without a certificate addr has to be a loopback address.
+func (s *Server) ListenAndServeGRPC(addr, adminToken, certFile, keyFile string) error {
+	handler, err := s.grpcHandler(adminToken)
+	if err != nil {
+		return err
+	}
+
+	return grpc.ListenAndServe(addr, certFile, keyFile, handler)
+}
+
+func (s *Server) grpcHandler(adminToken string) (http.Handler, error) {
+	if adminToken == "" {
+		return nil, errors.New("the gRPC API requires an admin token")
+	}
+
+	methods := map[string]grpc.Method{
+		"ListStreams":         {Unary: s.grpcListStreams},
+		"ListSessions":        {Unary: s.grpcListSessions},
+		"DisconnectSession":   {Unary: s.grpcDisconnectSession},
+		"DisconnectPublisher": {Unary: s.grpcDisconnectPublisher},
+		"RequestKeyframe":     {Unary: s.grpcRequestKeyframe},
+		"SetRecording":        {Unary: s.grpcSetRecording},
+		"WatchStats":          {Streaming: s.grpcWatchStats},
+	}
+
+	authorize := func(req *http.Request) error {
+		token, ok := extractBearerToken(req.Header.Get("Authorization"))
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+			s.auditLog.Record(audit.Entry{Action: audit.ActionAdminDenied, IP: s.clientIP(req), Details: map[string]string{"method": req.Method, "path": req.URL.Path}})
+			return grpc.Errorf(grpc.CodeUnauthenticated, "invalid admin token")
+		}
+
+		return nil
+	}
+
+	handler := grpc.Handler(grpcService, methods, authorize)
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		handler.ServeHTTP(res, req)
+
+		code := res.Header().Get(http.TrailerPrefix + "Grpc-Status")
+		if grpcAuditedMethods[strings.TrimPrefix(req.URL.Path, "/"+grpcService+"/")] && code != strconv.Itoa(grpc.CodeUnauthenticated) {
+			s.auditLog.Record(audit.Entry{
+				Action:  audit.ActionAdminRequest,
+				Actor:   "admin_token",
+				IP:      s.clientIP(req),
+				Details: map[string]string{"method": req.Method, "path": req.URL.Path, "grpcStatus": code},
+			})
+		}
+	}), nil
+}
+
+// grpcStreamKey returns the stream key in field 1 of request, which all calls of a stream have
+func grpcStreamKey(request []byte) (grpc.Fields, string, error) {
+	fields, err := grpc.Decode(request)
+	if err != nil {
+		return nil, "", grpc.Errorf(grpc.CodeInvalidArgument, "%v", err)
+	}
+
+	streamKey := fields.String(1)
+	if !validateStreamKey(streamKey) {
+		return nil, "", grpc.Errorf(grpc.CodeInvalidArgument, "invalid stream key format")
+	}
+
+	return fields, streamKey, nil
+}
+
+// grpcError returns err with the status code of the webrtc errors
+func grpcError(err error) error {
+	switch {
+	case errors.Is(err, webrtc.ErrStreamNotFound), errors.Is(err, webrtc.ErrWHEPSessionNotFound):
+		return grpc.Errorf(grpc.CodeNotFound, "%v", err)
+	case errors.Is(err, webrtc.ErrKeyframeRequestLimited):
+		return grpc.Errorf(grpc.CodeResourceExhausted, "%v", err)
+	}
+
+	return err
+}
+
+func (s *Server) grpcListStreams(_ context.Context, _ []byte) ([]byte, error) {
+	var response []byte
+	for _, status := range s.GetStreamStatuses() {
+		stream := grpc.AppendString(nil, 1, status.StreamKey)
+		stream = grpc.AppendString(stream, 2, status.Title)
+		stream = grpc.AppendBool(stream, 3, status.PublisherConnectedAt != nil)
+		stream = grpc.AppendBool(stream, 4, status.Paused)
+		stream = grpc.AppendBool(stream, 5, status.AudioOnly)
+		stream = grpc.AppendBool(stream, 6, status.Recording)
+		stream = grpc.AppendDouble(stream, 7, status.PublisherConnectedSeconds)
+		stream = grpc.AppendString(stream, 8, status.AudioCodec)
+		stream = grpc.AppendUint64(stream, 9, status.AudioBitrate)
+		for _, video := range status.VideoStreams {
+			videoStream := grpc.AppendString(nil, 1, video.RID)
+			videoStream = grpc.AppendString(videoStream, 2, video.Codec)
+			videoStream = grpc.AppendUint64(videoStream, 3, video.Bitrate)
+			videoStream = grpc.AppendUint64(videoStream, 4, video.BytesReceived)
+			stream = grpc.AppendMessage(stream, 10, videoStream)
+		}
+		stream = grpc.AppendUint64(stream, 11, uint64(len(status.WHEPSessions)))
+		stream = grpc.AppendString(stream, 12, status.Description)
+		stream = grpc.AppendString(stream, 13, status.Category)
+		stream = grpc.AppendString(stream, 14, status.ThumbnailURL)
+
+		response = grpc.AppendMessage(response, 1, stream)
+	}
+
+	return response, nil
+}
+
+func (s *Server) grpcListSessions(_ context.Context, request []byte) ([]byte, error) {
+	_, streamKey, err := grpcStreamKey(request)
+	if err != nil {
+		return nil, err
+	}
+
+	sessions, err := s.GetWHEPSessionStats(streamKey)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	var response []byte
+	for _, stats := range sessions {
+		session := grpc.AppendString(nil, 1, stats.ID)
+		session = grpc.AppendString(session, 2, stats.CurrentLayer)
+		session = grpc.AppendInt64(session, 3, stats.ConnectedAt.Unix())
+		session = grpc.AppendString(session, 4, stats.ConnectionState)
+		session = grpc.AppendString(session, 5, stats.ICEConnectionState)
+		session = grpc.AppendDouble(session, 6, stats.RoundTripTime)
+		session = grpc.AppendDouble(session, 7, stats.FractionLost)
+		session = grpc.AppendUint64(session, 8, uint64(stats.PacketsLost))
+		session = grpc.AppendUint64(session, 9, stats.BytesSent)
+		session = grpc.AppendUint64(session, 10, stats.VideoPacketsSent)
+
+		response = grpc.AppendMessage(response, 1, session)
+	}
+
+	return response, nil
+}
+
+func (s *Server) grpcDisconnectSession(_ context.Context, request []byte) ([]byte, error) {
+	fields, streamKey, err := grpcStreamKey(request)
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, grpcError(s.DisconnectWHEPSession(streamKey, fields.String(2)))
+}
+
+func (s *Server) grpcDisconnectPublisher(_ context.Context, request []byte) ([]byte, error) {
+	_, streamKey, err := grpcStreamKey(request)
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, grpcError(s.DisconnectPublisher(streamKey))
+}
+
+func (s *Server) grpcRequestKeyframe(_ context.Context, request []byte) ([]byte, error) {
+	_, streamKey, err := grpcStreamKey(request)
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, grpcError(s.RequestKeyframe(streamKey))
+}
+
+func (s *Server) grpcSetRecording(_ context.Context, request []byte) ([]byte, error) {
+	fields, streamKey, err := grpcStreamKey(request)
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, grpcError(s.SetStreamRecording(streamKey, fields.Bool(2)))
+}
+
+func (s *Server) grpcWatchStats(ctx context.Context, request []byte, send func([]byte) error) error {
+	fields, err := grpc.Decode(request)
+	if err != nil {
+		return grpc.Errorf(grpc.CodeInvalidArgument, "%v", err)
+	}
+
+	streamKey := fields.String(1)
+	if streamKey != "" && !validateStreamKey(streamKey) {
+		return grpc.Errorf(grpc.CodeInvalidArgument, "invalid stream key format")
+	}
+
+	interval := time.Duration(fields.Uint64(2)) * time.Second
+	if interval <= 0 {
+		interval = time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		now := time.Now()
+		for _, status := range s.GetStreamStatuses() {
+			if status.PublisherConnectedAt == nil || (streamKey != "" && status.StreamKey != streamKey) {
+				continue
+			}
+
+			var videoBitrate uint64
+			for _, video := range status.VideoStreams {
+				videoBitrate += video.Bitrate
+			}
+
+			stats := grpc.AppendString(nil, 1, status.StreamKey)
+			stats = grpc.AppendInt64(stats, 2, now.Unix())
+			stats = grpc.AppendUint64(stats, 3, uint64(len(status.WHEPSessions)))
+			stats = grpc.AppendUint64(stats, 4, videoBitrate)
+			stats = grpc.AppendUint64(stats, 5, status.AudioBitrate)
+			stats = grpc.AppendDouble(stats, 6, status.PublisherConnectedSeconds)
+			if err = send(stats); err != nil {
+				return err
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package broadcastbox
+
+import (
+	"context"
+	"crypto/x509"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/glimesh/broadcast-box/internal/webrtc"
+	grpcgo "google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// rawCodec lets grpc-go send and receive messages encoded by the test
+type rawCodec struct{}
+
+func (rawCodec) Marshal(v any) ([]byte, error) {
+	return *v.(*[]byte), nil
+}
+
+func (rawCodec) Unmarshal(data []byte, v any) error {
+	*v.(*[]byte) = append([]byte(nil), data...)
+	return nil
+}
+
+func (rawCodec) Name() string {
+	return "proto"
+}
+
+func TestGRPCControl(t *testing.T) {
+	s, err := NewServer(Options{Options: webrtc.Options{RecordingDirectory: t.TempDir(), DisableHLS: true, DisableDASH: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if _, err = s.grpcHandler(""); err == nil {
+		t.Fatal("gRPC API started without an admin token")
+	}
+
+	handler, err := s.grpcHandler("admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewUnstartedServer(handler)
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+	conn, err := grpcgo.NewClient(server.Listener.Addr().String(), grpcgo.WithTransportCredentials(credentials.NewClientTLSFromCert(roots, "example.com")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	call := func(ctx context.Context, method string, request []byte) ([]byte, error) {
+		var response []byte
+		err := conn.Invoke(ctx, "/broadcastbox.v1.Control/"+method, &request, &response, grpcgo.ForceCodec(rawCodec{}))
+		return response, err
+	}
+
+	if _, err = call(metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer wrong"), "ListStreams", nil); status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("ListStreams with a wrong token returned %v", err)
+	}
+
+	ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer admin")
+	if response, err := call(ctx, "ListStreams", nil); err != nil || len(response) != 0 {
+		t.Fatalf("ListStreams without streams returned %x, %v", response, err)
+	}
+
+	streamKey := protowire.AppendString(protowire.AppendTag(nil, 1, protowire.BytesType), "missing")
+	if _, err = call(ctx, "DisconnectPublisher", streamKey); status.Code(err) != codes.NotFound {
+		t.Fatalf("DisconnectPublisher of a missing stream returned %v", err)
+	}
+
+	invalidStreamKey := protowire.AppendString(protowire.AppendTag(nil, 1, protowire.BytesType), "../x")
+	if _, err = call(ctx, "RequestKeyframe", invalidStreamKey); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("RequestKeyframe of an invalid stream key returned %v", err)
+	}
+}
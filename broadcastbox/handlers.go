@@ -0,0 +1,438 @@
+package broadcastbox
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/glimesh/broadcast-box/internal/audit"
+	"github.com/glimesh/broadcast-box/internal/events"
+	"github.com/glimesh/broadcast-box/internal/webrtc"
+)
+
+const (
+	// Seconds clients are asked to wait when MAX_STREAMS or MAX_VIEWERS_PER_STREAM is reached
+	capacityRetryAfter = 30
+
+	// PeerConnections `/api/negotiate` creates at once, further offers get 503
+	maxConcurrentNegotiations = 8
+)
+
+type (
+	whepLayerRequestJSON struct {
+		MediaId    string `json:"mediaId"`
+		EncodingId string `json:"encodingId"`
+	}
+
+	pauseRequestJSON struct {
+		Paused bool `json:"paused"`
+	}
+
+	recordRequestJSON struct {
+		Recording bool `json:"recording"`
+	}
+)
+
+func logHTTPError(w http.ResponseWriter, err string, code int) {
+	logger.Warn(err, "status", code)
+	http.Error(w, err, code)
+}
+
+// logOfferError responds to a WHIP or WHEP offer that failed, with 503 if the server is full
+// and 409 if the stream has another publisher
+func logOfferError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, webrtc.ErrTooManyStreams), errors.Is(err, webrtc.ErrTooManyViewers):
+		w.Header().Set("Retry-After", strconv.Itoa(capacityRetryAfter))
+		logHTTPError(w, err.Error(), http.StatusServiceUnavailable)
+	case errors.Is(err, webrtc.ErrStreamPublished):
+		logHTTPError(w, err.Error(), http.StatusConflict)
+	default:
+		logHTTPError(w, err.Error(), http.StatusBadRequest)
+	}
+}
+
+func (s *Server) maybeLogSDP(req *http.Request, kind, streamKey, offer, answer string) {
+	if !s.debugLogSDP {
+		return
+	}
+
+	logger.Info(kind+" negotiation", "addr", req.RemoteAddr, "streamKey", streamKey, "offer", offer, "answer", answer)
+}
+
+func validateStreamKey(streamKey string) bool {
+	return regexp.MustCompile(`^[a-zA-Z0-9_\-\.~]+$`).MatchString(streamKey)
+}
+
+func extractBearerToken(authHeader string) (string, bool) {
+	const bearerPrefix = "Bearer "
+	if strings.HasPrefix(authHeader, bearerPrefix) {
+		return strings.TrimPrefix(authHeader, bearerPrefix), true
+	}
+	return "", false
+}
+
+func (s *Server) whipHandler(res http.ResponseWriter, r *http.Request) {
+	if r.Method == "DELETE" || !s.checkRateLimit(res, r) {
+		return
+	}
+
+	streamKey, ok := s.publisherStreamKey(res, r)
+	setAccessLogStreamKey(r, streamKey)
+	if !ok || !s.checkClientIP(res, r, true, streamKey) || !s.authorizeWithWebhook(res, r, "publish", streamKey) {
+		return
+	}
+
+	offer, err := io.ReadAll(r.Body)
+	if err != nil {
+		logHTTPError(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// A publisher reconnecting with the same token may take over its stream
+	credential, _ := extractBearerToken(r.Header.Get("Authorization"))
+	answer, err := s.WHIPWithCredential(r.Context(), string(offer), streamKey, credential)
+	if err != nil {
+		logOfferError(res, err)
+		return
+	}
+	s.auditLog.Record(audit.Entry{
+		Action:    audit.ActionPublish,
+		Actor:     credentialActor(credential),
+		IP:        s.clientIP(r),
+		StreamKey: streamKey,
+		Details:   map[string]string{"protocol": "whip"},
+	})
+	s.maybeLogSDP(r, "WHIP", streamKey, string(offer), answer)
+
+	res.Header().Add("Location", "/api/whip")
+	res.Header().Add("Content-Type", "application/sdp")
+	res.WriteHeader(http.StatusCreated)
+	fmt.Fprint(res, answer)
+}
+
+func (s *Server) whepHandler(res http.ResponseWriter, req *http.Request) {
+	if !s.checkRateLimit(res, req) {
+		return
+	}
+
+	// A one-time token is only used up once its session was created
+	token, _ := extractBearerToken(req.Header.Get("Authorization"))
+	sessionCreated := false
+	defer func() { s.oneTimeTokens.release(token, sessionCreated) }()
+
+	streamKey, credential, ok := s.viewerStreamKey(res, req)
+	setAccessLogStreamKey(req, streamKey)
+	if !ok || !s.checkClientIP(res, req, false, streamKey) || !s.checkOrigin(res, req, streamKey) {
+		return
+	} else if !s.checkViewerCountry(res, req, streamKey, true) || !s.authorizeWithWebhook(res, req, "view", streamKey) {
+		return
+	}
+
+	if !s.sessionLimiter.acquire(credential) {
+		s.Events().Emit(events.Event{
+			Type:      events.TypeSessionLimitReached,
+			StreamKey: streamKey,
+			Metadata:  map[string]string{"credential": credential.kind},
+		})
+		logHTTPError(res, "Too many sessions with this credential", http.StatusTooManyRequests)
+		return
+	}
+	whepSessionId := ""
+	defer func() { s.sessionLimiter.done(credential, streamKey, whepSessionId) }()
+
+	offer, err := io.ReadAll(req.Body)
+	if err != nil {
+		logHTTPError(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	answer, sessionId, err := s.WHEPContext(req.Context(), string(offer), streamKey)
+	if err != nil {
+		logOfferError(res, err)
+		return
+	}
+	sessionCreated, whepSessionId = true, sessionId
+	s.maybeLogSDP(req, "WHEP", streamKey, string(offer), answer)
+
+	apiPath := req.Host + strings.TrimSuffix(req.URL.Path, "whep")
+	res.Header().Add("Link", `<`+apiPath+"sse/"+whepSessionId+`>; rel="urn:ietf:params:whep:ext:core:server-sent-events"; events="layers"`)
+	res.Header().Add("Link", `<`+apiPath+"layer/"+whepSessionId+`>; rel="urn:ietf:params:whep:ext:core:layer"`)
+	res.Header().Add("Link", `<`+apiPath+"refresh/"+whepSessionId+`>; rel="refresh"`)
+	res.Header().Add("Location", "/api/whep")
+	res.Header().Add("Content-Type", "application/sdp")
+	res.WriteHeader(http.StatusCreated)
+	fmt.Fprint(res, answer)
+}
+
+func (s *Server) whepServerSentEventsHandler(res http.ResponseWriter, req *http.Request) {
+	res.Header().Set("Content-Type", "text/event-stream")
+	res.Header().Set("Cache-Control", "no-cache")
+	res.Header().Set("Connection", "keep-alive")
+
+	vals := strings.Split(req.URL.RequestURI(), "/")
+	whepSessionId := vals[len(vals)-1]
+
+	layers, err := s.WHEPLayers(whepSessionId)
+	if err != nil {
+		logHTTPError(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	fmt.Fprint(res, "event: layers\n")
+	fmt.Fprintf(res, "data: %s\n", string(layers))
+	fmt.Fprint(res, "\n\n")
+}
+
+func (s *Server) whepLayerHandler(res http.ResponseWriter, req *http.Request) {
+	var r whepLayerRequestJSON
+	if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+		logHTTPError(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	vals := strings.Split(req.URL.RequestURI(), "/")
+	whepSessionId := vals[len(vals)-1]
+
+	if err := s.WHEPChangeLayer(whepSessionId, r.EncodingId); err != nil {
+		logHTTPError(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+}
+
+// keyframeHandler requests a keyframe from the publisher of `/api/keyframe?streamKey=<stream key>`,
+// see adminHandler
+func (s *Server) keyframeHandler(res http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		logHTTPError(res, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	streamKey := req.URL.Query().Get("streamKey")
+	if !validateStreamKey(streamKey) {
+		logHTTPError(res, "Invalid stream key format", http.StatusBadRequest)
+		return
+	}
+	setAccessLogStreamKey(req, streamKey)
+
+	switch err := s.RequestKeyframe(streamKey); {
+	case errors.Is(err, webrtc.ErrStreamNotFound):
+		logHTTPError(res, err.Error(), http.StatusNotFound)
+	case errors.Is(err, webrtc.ErrKeyframeRequestLimited):
+		logHTTPError(res, err.Error(), http.StatusTooManyRequests)
+	case err != nil:
+		logHTTPError(res, err.Error(), http.StatusBadRequest)
+	}
+}
+
+// hlsHandler serves `/hls/<stream key>/index.m3u8` and the media it references
+func (s *Server) hlsHandler(res http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		logHTTPError(res, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	streamKey, _, ok := strings.Cut(strings.TrimPrefix(req.URL.Path, "/hls/"), "/")
+	if !ok || !validateStreamKey(streamKey) {
+		logHTTPError(res, "Invalid stream key format", http.StatusBadRequest)
+		return
+	}
+	setAccessLogStreamKey(req, streamKey)
+
+	// Players embedded on other sites are refused the playlist, the media it references doesn't
+	// help without it
+	if !s.authorizeViewer(res, req, streamKey) || (strings.HasSuffix(req.URL.Path, ".m3u8") && !s.checkOrigin(res, req, streamKey)) {
+		return
+	}
+
+	seg, err := s.HLS(streamKey)
+	if err != nil {
+		logHTTPError(res, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	seg.ServeHLS(res, req)
+}
+
+// dashHandler serves `/dash/<stream key>/manifest.mpd` and the media it references
+func (s *Server) dashHandler(res http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		logHTTPError(res, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	streamKey, _, ok := strings.Cut(strings.TrimPrefix(req.URL.Path, "/dash/"), "/")
+	if !ok || !validateStreamKey(streamKey) {
+		logHTTPError(res, "Invalid stream key format", http.StatusBadRequest)
+		return
+	}
+	setAccessLogStreamKey(req, streamKey)
+
+	// Players embedded on other sites are refused the manifest, the media it references doesn't
+	// help without it
+	if !s.authorizeViewer(res, req, streamKey) || (strings.HasSuffix(req.URL.Path, ".mpd") && !s.checkOrigin(res, req, streamKey)) {
+		return
+	}
+
+	seg, err := s.DASH(streamKey)
+	if err != nil {
+		logHTTPError(res, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	seg.ServeDASH(res, req)
+}
+
+func (s *Server) whepRefreshHandler(res http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		logHTTPError(res, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	vals := strings.Split(req.URL.RequestURI(), "/")
+	whepSessionId := vals[len(vals)-1]
+
+	if err := s.WHEPRequestKeyframe(whepSessionId); err != nil {
+		logHTTPError(res, err.Error(), http.StatusNotFound)
+		return
+	}
+}
+
+func (s *Server) pauseHandler(res http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		logHTTPError(res, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	streamKey, ok := s.publisherAPIStreamKey(res, req)
+	setAccessLogStreamKey(req, streamKey)
+	if !ok {
+		return
+	}
+
+	var r pauseRequestJSON
+	if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+		logHTTPError(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := s.SetStreamPaused(streamKey, r.Paused); errors.Is(err, webrtc.ErrStreamNotFound) {
+		logHTTPError(res, err.Error(), http.StatusNotFound)
+	} else if err != nil {
+		logHTTPError(res, err.Error(), http.StatusBadRequest)
+	}
+}
+
+func (s *Server) recordHandler(res http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		logHTTPError(res, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	streamKey, ok := s.publisherAPIStreamKey(res, req)
+	setAccessLogStreamKey(req, streamKey)
+	if !ok {
+		return
+	}
+
+	var r recordRequestJSON
+	if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+		logHTTPError(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := s.SetStreamRecording(streamKey, r.Recording); errors.Is(err, webrtc.ErrStreamNotFound) {
+		logHTTPError(res, err.Error(), http.StatusNotFound)
+	} else if err != nil {
+		logHTTPError(res, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// metadataHandler serves the StreamMetadata of the publisher on `/api/metadata`, see
+// publisherAPIStreamKey
+func (s *Server) metadataHandler(res http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodPost {
+		logHTTPError(res, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	streamKey, ok := s.publisherAPIStreamKey(res, req)
+	setAccessLogStreamKey(req, streamKey)
+	if !ok {
+		return
+	}
+
+	s.streamMetadataHandler(res, req, streamKey)
+}
+
+// streamMetadataHandler responds with the StreamMetadata of streamKey, after applying the
+// StreamMetadataUpdate in the body of a POST
+func (s *Server) streamMetadataHandler(res http.ResponseWriter, req *http.Request, streamKey string) {
+	metadata := s.GetStreamMetadata(streamKey)
+	if req.Method == http.MethodPost {
+		var u webrtc.StreamMetadataUpdate
+		if err := json.NewDecoder(req.Body).Decode(&u); err != nil {
+			logHTTPError(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var err error
+		if metadata, err = s.UpdateStreamMetadata(streamKey, u); err != nil {
+			logHTTPError(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	res.Header().Add("Content-Type", "application/json")
+	if err := json.NewEncoder(res).Encode(metadata); err != nil {
+		logger.Warn("Failed to write response", "err", err)
+	}
+}
+
+func (s *Server) negotiateHandler(res http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		logHTTPError(res, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	} else if !s.checkRateLimit(res, req) {
+		return
+	}
+
+	select {
+	case s.negotiations <- struct{}{}:
+		defer func() { <-s.negotiations }()
+	default:
+		res.Header().Set("Retry-After", "1")
+		logHTTPError(res, "Too many negotiations", http.StatusServiceUnavailable)
+		return
+	}
+
+	offer, err := io.ReadAll(req.Body)
+	if err != nil {
+		logHTTPError(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result, err := s.Negotiate(string(offer), req.URL.Query().Get("mode") != "whep")
+	if err != nil {
+		logHTTPError(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	res.Header().Add("Content-Type", "application/json")
+	if err := json.NewEncoder(res).Encode(result); err != nil {
+		logHTTPError(res, err.Error(), http.StatusBadRequest)
+	}
+}
+
+func (s *Server) statusHandler(res http.ResponseWriter, req *http.Request) {
+	res.Header().Add("Content-Type", "application/json")
+
+	if err := json.NewEncoder(res).Encode(s.GetStreamStatuses()); err != nil {
+		logHTTPError(res, err.Error(), http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,179 @@
+package broadcastbox
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/glimesh/broadcast-box/internal/logging"
+	"github.com/glimesh/broadcast-box/internal/webrtc"
+)
+
+// captureLogs sends the logs of the test to a file and returns a function that reads it
+func captureLogs(t *testing.T) func() string {
+	path := filepath.Join(t.TempDir(), "test.log")
+	t.Setenv("LOG_FILE", path)
+	if err := logging.Configure(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.Unsetenv("LOG_FILE")
+		if err := logging.Configure(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	return func() string {
+		logs, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(logs)
+	}
+}
+
+func TestMaybeLogSDP(t *testing.T) {
+	logs := captureLogs(t)
+	req := httptest.NewRequest("POST", "/api/whip", nil)
+
+	(&Server{}).maybeLogSDP(req, "WHIP", "quiet", "v=0 offer", "v=0 answer")
+	if strings.Contains(logs(), "quiet") {
+		t.Fatalf("SDP was logged without DEBUG_LOG_SDP:\n%s", logs())
+	}
+
+	(&Server{debugLogSDP: true}).maybeLogSDP(req, "WHEP", "loud", "v=0 offer", "v=0 answer")
+	for _, want := range []string{"WHEP negotiation", "streamKey=loud", "v=0 offer", "v=0 answer"} {
+		if !strings.Contains(logs(), want) {
+			t.Fatalf("SDP log with DEBUG_LOG_SDP doesn't contain %q:\n%s", want, logs())
+		}
+	}
+}
+
+func TestNegotiateLimits(t *testing.T) {
+	s, err := NewServer(Options{
+		Options: webrtc.Options{
+			RecordingDirectory: t.TempDir(),
+			DisableHLS:         true,
+			DisableDASH:        true,
+		},
+		SignalingRateLimitPerIP: "3/1h",
+		BanAfterFailures:        2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = s.Close() })
+
+	mux := http.NewServeMux()
+	s.RegisterHandlers(mux)
+	negotiate := func(remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/negotiate", strings.NewReader("not an offer"))
+		req.RemoteAddr = remoteAddr
+
+		res := httptest.NewRecorder()
+		mux.ServeHTTP(res, req)
+		return res
+	}
+
+	// Once all negotiations are running, others have to wait
+	for i := 0; i < maxConcurrentNegotiations; i++ {
+		s.negotiations <- struct{}{}
+	}
+	if res := negotiate("192.0.2.1:1234"); res.Code != http.StatusServiceUnavailable || res.Header().Get("Retry-After") == "" {
+		t.Fatalf("negotiation beyond the limit returned %d", res.Code)
+	}
+	for i := 0; i < maxConcurrentNegotiations; i++ {
+		<-s.negotiations
+	}
+
+	// Malformed offers count towards a ban
+	for i := 0; i < 2; i++ {
+		if res := negotiate("192.0.2.1:1234"); res.Code != http.StatusBadRequest {
+			t.Fatalf("malformed offer returned %d", res.Code)
+		}
+	}
+	if res := negotiate("192.0.2.1:1234"); res.Code != http.StatusForbidden {
+		t.Fatalf("banned client got %d", res.Code)
+	}
+
+	// And every offer towards the rate limit
+	negotiate("192.0.2.2:1234")
+	s.ipBans.clear(netip.Addr{})
+	if res := negotiate("192.0.2.2:1234"); res.Code != http.StatusBadRequest {
+		t.Fatalf("second offer returned %d", res.Code)
+	}
+	s.ipBans.clear(netip.Addr{})
+	if res := negotiate("192.0.2.2:1234"); res.Code != http.StatusBadRequest {
+		t.Fatalf("third offer returned %d", res.Code)
+	}
+	if res := negotiate("192.0.2.2:1234"); res.Code != http.StatusTooManyRequests {
+		t.Fatalf("offer beyond the rate limit returned %d", res.Code)
+	}
+
+	// Negotiations that ended make room for others
+	if len(s.negotiations) != 0 {
+		t.Fatalf("%d negotiations are still running", len(s.negotiations))
+	}
+}
+
+func TestLiveEventsAuthorization(t *testing.T) {
+	s, err := NewServer(Options{
+		Options: webrtc.Options{
+			RecordingDirectory: t.TempDir(),
+			DisableHLS:         true,
+			DisableDASH:        true,
+		},
+		AdminToken: "admin",
+		WHEPTokens: []string{"private:viewer"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = s.Close() })
+
+	mux := http.NewServeMux()
+	s.RegisterHandlers(mux)
+
+	for _, test := range []struct {
+		name   string
+		url    string
+		token  string
+		status int
+	}{
+		{"all streams", "/api/status/events", "", http.StatusUnauthorized},
+		{"all streams as operator", "/api/status/events", "admin", http.StatusOK},
+		{"public stream", "/api/status/events?streamKey=public", "", http.StatusOK},
+		{"private stream", "/api/status/events?streamKey=private", "", http.StatusUnauthorized},
+		{"private stream with viewer token", "/api/status/events?streamKey=private", "viewer", http.StatusOK},
+		{"private stream as operator", "/api/status/events?streamKey=private", "admin", http.StatusOK},
+		{"invalid stream key", "/api/status/events?streamKey=%20", "", http.StatusBadRequest},
+		{"WebSocket of all streams", "/api/ws", "", http.StatusUnauthorized},
+		{"WebSocket of all streams with viewer token", "/api/ws", "viewer", http.StatusUnauthorized},
+		{"WebSocket of private stream", "/api/ws?streamKey=private", "", http.StatusUnauthorized},
+		{"WebSocket of invalid stream key", "/api/ws?streamKey=%20", "", http.StatusBadRequest},
+
+		// Requests that are let through aren't WebSocket upgrades
+		{"WebSocket of all streams as operator", "/api/ws", "admin", http.StatusBadRequest},
+		{"WebSocket of public stream", "/api/ws?streamKey=public", "", http.StatusBadRequest},
+		{"WebSocket of private stream with viewer token", "/api/ws?streamKey=private", "viewer", http.StatusBadRequest},
+	} {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		req := httptest.NewRequest("GET", test.url, nil).WithContext(ctx)
+		if test.token != "" {
+			req.Header.Set("Authorization", "Bearer "+test.token)
+		}
+
+		res := httptest.NewRecorder()
+		mux.ServeHTTP(res, req)
+		if res.Code != test.status {
+			t.Errorf("%s: got %d, want %d", test.name, res.Code, test.status)
+		}
+	}
+}
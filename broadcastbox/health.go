@@ -0,0 +1,97 @@
+package broadcastbox
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+type (
+	// readinessChecks are what /readyz checks, by name
+	readinessChecks struct {
+		lock   sync.Mutex
+		names  []string
+		checks map[string]func() error
+	}
+
+	readinessJSON struct {
+		Status string            `json:"status"`
+		Checks map[string]string `json:"checks"`
+	}
+)
+
+// AddReadinessCheck adds check to the ones `/readyz` runs, the Server isn't ready while it
+// returns an error. Checks of the same name are replaced.
+func (s *Server) AddReadinessCheck(name string, check func() error) {
+	s.readinessChecks.lock.Lock()
+	defer s.readinessChecks.lock.Unlock()
+
+	if s.readinessChecks.checks == nil {
+		s.readinessChecks.checks = map[string]func() error{}
+	}
+	if _, ok := s.readinessChecks.checks[name]; !ok {
+		s.readinessChecks.names = append(s.readinessChecks.names, name)
+	}
+	s.readinessChecks.checks[name] = check
+}
+
+// addDefaultReadinessChecks checks the UDP mux sockets and the configuration that is read
+// while serving
+func (s *Server) addDefaultReadinessChecks() {
+	s.AddReadinessCheck("udpMux", s.CheckUDPMuxes)
+
+	if s.whipTokens.file != "" {
+		s.AddReadinessCheck("whipTokenFile", func() error {
+			_, err := s.whipTokens.readFile()
+			return err
+		})
+	}
+	if s.whepTokens.file != "" {
+		s.AddReadinessCheck("whepTokenFile", func() error {
+			_, err := s.whepTokens.readFile()
+			return err
+		})
+	}
+	if s.keyStore != nil {
+		s.AddReadinessCheck("keyStore", s.keyStore.Check)
+	}
+	if s.usageStore != nil {
+		s.AddReadinessCheck("usageStore", s.usageStore.Check)
+	}
+}
+
+// livenessHandler serves `/healthz`, the process is alive if it answers
+func (s *Server) livenessHandler(res http.ResponseWriter, req *http.Request) {
+	res.Header().Set("Content-Type", "text/plain")
+	fmt.Fprint(res, "ok\n")
+}
+
+// readinessHandler serves `/readyz` with the result of each check, with a 503 if one failed
+func (s *Server) readinessHandler(res http.ResponseWriter, req *http.Request) {
+	s.readinessChecks.lock.Lock()
+	names := append([]string{}, s.readinessChecks.names...)
+	checks := make([]func() error, len(names))
+	for i, name := range names {
+		checks[i] = s.readinessChecks.checks[name]
+	}
+	s.readinessChecks.lock.Unlock()
+
+	status, readiness := http.StatusOK, readinessJSON{Status: "ok", Checks: map[string]string{}}
+	for i, check := range checks {
+		if err := check(); err != nil {
+			logger.Warn("Readiness check failed", "check", names[i], "err", err)
+			status, readiness.Status = http.StatusServiceUnavailable, "fail"
+			readiness.Checks[names[i]] = err.Error()
+		} else {
+			readiness.Checks[names[i]] = "ok"
+		}
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	res.Header().Set("Cache-Control", "no-store")
+	res.WriteHeader(status)
+	if err := json.NewEncoder(res).Encode(readiness); err != nil {
+		logger.Warn("Failed to write response", "err", err)
+	}
+}
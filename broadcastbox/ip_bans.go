@@ -0,0 +1,233 @@
+package broadcastbox
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	banFindTimeDefault = 10 * time.Minute
+	banDurationDefault = time.Hour
+)
+
+type (
+	// ipBans bans addresses with BAN_AFTER_FAILURES failed requests within BAN_FIND_TIME for
+	// BAN_DURATION, like fail2ban. Bans are kept in memory.
+	ipBans struct {
+		maxFailures int
+		findTime    time.Duration
+		banDuration time.Duration
+
+		lock     sync.Mutex
+		failures map[netip.Addr][]time.Time
+		bans     map[netip.Addr]time.Time
+	}
+
+	ipBanJSON struct {
+		IP    string    `json:"ip"`
+		Until time.Time `json:"until"`
+	}
+
+	// statusRecorder keeps the status code a handler responded with
+	statusRecorder struct {
+		http.ResponseWriter
+		status int
+	}
+)
+
+// newIPBans returns the bans of maxFailures within findTime, a zero findTime or banDuration is
+// the default
+func newIPBans(maxFailures int, findTime, banDuration time.Duration) *ipBans {
+	b := &ipBans{
+		maxFailures: maxFailures,
+		findTime:    findTime,
+		banDuration: banDuration,
+		failures:    map[netip.Addr][]time.Time{},
+		bans:        map[netip.Addr]time.Time{},
+	}
+	if b.findTime == 0 {
+		b.findTime = banFindTimeDefault
+	}
+	if b.banDuration == 0 {
+		b.banDuration = banDurationDefault
+	}
+
+	return b
+}
+
+func (b *ipBans) enabled() bool {
+	return b.maxFailures > 0
+}
+
+// bannedUntil returns when the ban of addr ends, the zero time if it isn't banned
+func (b *ipBans) bannedUntil(addr netip.Addr) time.Time {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	addr = clientKey(addr)
+
+	until, ok := b.bans[addr]
+	if ok && time.Now().After(until) {
+		delete(b.bans, addr)
+		return time.Time{}
+	}
+
+	return until
+}
+
+// fail counts a failed request of addr and bans it once it failed too often
+func (b *ipBans) fail(addr netip.Addr) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	addr = clientKey(addr)
+
+	now := time.Now()
+	recent := []time.Time{}
+	for _, t := range b.failures[addr] {
+		if now.Sub(t) < b.findTime {
+			recent = append(recent, t)
+		}
+	}
+	recent = append(recent, now)
+
+	if len(recent) < b.maxFailures {
+		b.failures[addr] = recent
+		return
+	}
+
+	delete(b.failures, addr)
+	b.bans[addr] = now.Add(b.banDuration)
+	logger.Warn("Banned address", "addr", addr, "duration", b.banDuration, "failures", len(recent))
+
+	// Addresses that stopped failing would otherwise be kept forever
+	for a, failures := range b.failures {
+		if now.Sub(failures[len(failures)-1]) >= b.findTime {
+			delete(b.failures, a)
+		}
+	}
+}
+
+func (b *ipBans) list() []ipBanJSON {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	now := time.Now()
+	bans := []ipBanJSON{}
+	for addr, until := range b.bans {
+		if now.After(until) {
+			delete(b.bans, addr)
+			continue
+		}
+		ip := addr.String()
+		if addr.Is6() {
+			ip = netip.PrefixFrom(addr, 64).String()
+		}
+		bans = append(bans, ipBanJSON{IP: ip, Until: until})
+	}
+
+	sort.Slice(bans, func(i, j int) bool { return bans[i].Until.Before(bans[j].Until) })
+	return bans
+}
+
+// clear lifts the ban of addr, or every ban if addr is invalid, and forgets its failures
+func (b *ipBans) clear(addr netip.Addr) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if !addr.IsValid() {
+		b.bans = map[netip.Addr]time.Time{}
+		b.failures = map[netip.Addr][]time.Time{}
+		return true
+	}
+
+	addr = clientKey(addr)
+	_, ok := b.bans[addr]
+	delete(b.bans, addr)
+	delete(b.failures, addr)
+	return ok
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// banHandler refuses banned addresses, and counts malformed and unauthorized requests to next
+// towards a ban
+func (s *Server) banHandler(next func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	if !s.ipBans.enabled() {
+		return next
+	}
+
+	return func(res http.ResponseWriter, req *http.Request) {
+		addr, err := s.clientAddr(req)
+		if err != nil {
+			logHTTPError(res, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if until := s.ipBans.bannedUntil(addr); !until.IsZero() {
+			res.Header().Set("Retry-After", strconv.Itoa(int(time.Until(until).Seconds())+1))
+			logHTTPError(res, fmt.Sprintf("%s is banned", addr), http.StatusForbidden)
+			return
+		}
+
+		recorder := &statusRecorder{ResponseWriter: res}
+		next(recorder, req)
+
+		switch recorder.status {
+		case http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden:
+			s.ipBans.fail(addr)
+		}
+	}
+}
+
+// bansHandler lists the banned addresses on `/api/bans`, `DELETE /api/bans/<ip>` lifts a ban
+// and `DELETE /api/bans` all of them
+func (s *Server) bansHandler(res http.ResponseWriter, req *http.Request) {
+	ip := strings.Trim(strings.TrimPrefix(req.URL.Path, "/api/bans"), "/")
+
+	switch {
+	case req.Method == http.MethodGet && ip == "":
+		res.Header().Add("Content-Type", "application/json")
+		if err := json.NewEncoder(res).Encode(s.ipBans.list()); err != nil {
+			logger.Warn("Failed to write response", "err", err)
+		}
+	case req.Method == http.MethodDelete && ip == "":
+		s.ipBans.clear(netip.Addr{})
+		res.WriteHeader(http.StatusNoContent)
+	case req.Method == http.MethodDelete:
+		addr, err := netip.ParseAddr(ip)
+		if err != nil {
+			logHTTPError(res, "Invalid IP", http.StatusBadRequest)
+			return
+		}
+
+		if !s.ipBans.clear(addr.Unmap()) {
+			logHTTPError(res, fmt.Sprintf("%s isn't banned", addr), http.StatusNotFound)
+			return
+		}
+		res.WriteHeader(http.StatusNoContent)
+	default:
+		logHTTPError(res, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,202 @@
+package broadcastbox
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/glimesh/broadcast-box/internal/webrtc"
+)
+
+func TestIPBans(t *testing.T) {
+	b := newIPBans(3, time.Hour, time.Hour)
+	addr := netip.MustParseAddr("192.0.2.1")
+
+	// Banned with exactly maxFailures
+	for i := 0; i < 2; i++ {
+		if b.fail(addr); !b.bannedUntil(addr).IsZero() {
+			t.Fatalf("banned after %d failures", i+1)
+		}
+	}
+	b.fail(addr)
+	if until := b.bannedUntil(addr); time.Until(until) < 59*time.Minute {
+		t.Fatalf("banned until %s", until)
+	}
+
+	// Only the address itself
+	for _, other := range []string{"192.0.2.0", "192.0.2.2", "2001:db8::1"} {
+		if !b.bannedUntil(netip.MustParseAddr(other)).IsZero() {
+			t.Errorf("%s is banned", other)
+		}
+	}
+
+	if !b.clear(addr) || !b.bannedUntil(addr).IsZero() {
+		t.Fatal("ban wasn't lifted")
+	}
+	if b.clear(addr) {
+		t.Fatal("lifted a ban that didn't exist")
+	}
+
+	// Failures are forgotten with the ban
+	if b.fail(addr); !b.bannedUntil(addr).IsZero() {
+		t.Fatal("failures before the ban counted again")
+	}
+}
+
+func TestIPBansIPv6(t *testing.T) {
+	b := newIPBans(3, time.Hour, time.Hour)
+
+	// An IPv6 client can't spread its failures over the addresses of its /64
+	for _, addr := range []string{"2001:db8::1", "2001:db8::2", "2001:db8::ffff:ffff:ffff:ffff"} {
+		b.fail(netip.MustParseAddr(addr))
+	}
+	if b.bannedUntil(netip.MustParseAddr("2001:db8::1234")).IsZero() {
+		t.Fatal("/64 wasn't banned")
+	}
+	if !b.bannedUntil(netip.MustParseAddr("2001:db8:0:1::1")).IsZero() {
+		t.Fatal("other /64 was banned")
+	}
+
+	if bans := b.list(); len(bans) != 1 || bans[0].IP != "2001:db8::/64" {
+		t.Fatalf("listed %+v", bans)
+	}
+
+	if !b.clear(netip.MustParseAddr("2001:db8::5")) || len(b.list()) != 0 {
+		t.Fatal("ban of the /64 wasn't lifted")
+	}
+}
+
+func TestIPBansExpire(t *testing.T) {
+	b := newIPBans(2, 50*time.Millisecond, 50*time.Millisecond)
+	addr := netip.MustParseAddr("192.0.2.1")
+
+	// Failures further apart than findTime don't add up
+	b.fail(addr)
+	time.Sleep(60 * time.Millisecond)
+	if b.fail(addr); !b.bannedUntil(addr).IsZero() {
+		t.Fatal("banned for failures outside of findTime")
+	}
+
+	b.fail(addr)
+	if b.bannedUntil(addr).IsZero() {
+		t.Fatal("not banned")
+	}
+	if len(b.list()) != 1 {
+		t.Fatal("ban isn't listed")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if !b.bannedUntil(addr).IsZero() || len(b.list()) != 0 {
+		t.Fatal("ban didn't end")
+	}
+}
+
+func TestBanHandler(t *testing.T) {
+	s, err := NewServer(Options{
+		Options: webrtc.Options{
+			RecordingDirectory: t.TempDir(),
+			DisableHLS:         true,
+			DisableDASH:        true,
+		},
+		AdminToken:       "admin",
+		BanAfterFailures: 2,
+		TrustedProxies:   []string{"10.0.0.0/8"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = s.Close() })
+
+	status := http.StatusUnauthorized
+	handler := s.banHandler(func(res http.ResponseWriter, req *http.Request) {
+		res.WriteHeader(status)
+	})
+	request := func(remoteAddr string, forwardedFor ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/whep", nil)
+		req.RemoteAddr = remoteAddr
+		for _, f := range forwardedFor {
+			req.Header.Add("X-Forwarded-For", f)
+		}
+
+		res := httptest.NewRecorder()
+		handler(res, req)
+		return res
+	}
+
+	// Successful and failed requests that aren't the client's fault don't count
+	for _, status = range []int{http.StatusOK, http.StatusCreated, http.StatusNotFound, http.StatusTooManyRequests, http.StatusInternalServerError} {
+		request("192.0.2.1:1234")
+		request("192.0.2.1:1234")
+	}
+	if res := request("192.0.2.1:1234"); res.Code != http.StatusInternalServerError {
+		t.Fatalf("banned after requests that didn't fail, %d", res.Code)
+	}
+
+	// A client behind a proxy is banned, not the proxy, even with its IPv4-mapped address
+	status = http.StatusBadRequest
+	request("10.0.0.1:1234", "192.0.2.2")
+	request("10.0.0.2:1234", "::ffff:192.0.2.2")
+
+	status = http.StatusOK
+	for _, c := range []struct {
+		name         string
+		remoteAddr   string
+		forwardedFor []string
+		banned       bool
+	}{
+		{"client", "192.0.2.2:1234", nil, true},
+		{"IPv4-mapped client", "[::ffff:192.0.2.2]:1234", nil, true},
+		{"proxy", "10.0.0.1:1234", nil, false},
+		{"other client of the proxy", "10.0.0.1:1234", []string{"192.0.2.3"}, false},
+		{"client behind a proxy", "10.0.0.1:1234", []string{"192.0.2.2"}, true},
+		{"client behind two proxies", "10.0.0.1:1234", []string{"192.0.2.2, 10.0.0.2"}, true},
+		{"client spoofing another", "10.0.0.1:1234", []string{"192.0.2.3, 192.0.2.2"}, true},
+		{"client spoofing a proxy", "10.0.0.1:1234", []string{"10.0.0.3, 192.0.2.2"}, true},
+		{"client with garbage", "10.0.0.1:1234", []string{"192.0.2.2, garbage"}, false},
+		{"spoofed X-Forwarded-For", "192.0.2.2:1234", []string{"192.0.2.3"}, true},
+		{"other client spoofing it", "192.0.2.3:1234", []string{"192.0.2.2"}, false},
+	} {
+		res := request(c.remoteAddr, c.forwardedFor...)
+		if banned := res.Code == http.StatusForbidden; banned != c.banned {
+			t.Errorf("%s banned: %v", c.name, banned)
+		} else if banned && res.Header().Get("Retry-After") != "3600" {
+			t.Errorf("%s got Retry-After %q", c.name, res.Header().Get("Retry-After"))
+		}
+	}
+
+	// Listed and lifted by operators
+	mux := http.NewServeMux()
+	s.RegisterHandlers(mux)
+	admin := func(method, target string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		req.RemoteAddr = "198.51.100.1:1234"
+		req.Header.Set("Authorization", "Bearer admin")
+
+		res := httptest.NewRecorder()
+		mux.ServeHTTP(res, req)
+		return res
+	}
+
+	bans := []ipBanJSON{}
+	if res := admin("GET", "/api/bans"); res.Code != http.StatusOK {
+		t.Fatalf("listing bans returned %d", res.Code)
+	} else if err = json.Unmarshal(res.Body.Bytes(), &bans); err != nil || len(bans) != 1 || bans[0].IP != "192.0.2.2" {
+		t.Fatalf("listed %s", res.Body)
+	}
+
+	if res := admin("DELETE", "/api/bans/::ffff:192.0.2.2"); res.Code != http.StatusNoContent {
+		t.Fatalf("lifting the ban returned %d", res.Code)
+	}
+	if res := admin("DELETE", "/api/bans/192.0.2.2"); res.Code != http.StatusNotFound {
+		t.Fatalf("lifting a lifted ban returned %d", res.Code)
+	}
+	if res := admin("DELETE", "/api/bans/garbage"); res.Code != http.StatusBadRequest {
+		t.Fatalf("lifting the ban of garbage returned %d", res.Code)
+	}
+	if res := request("192.0.2.2:1234"); res.Code != http.StatusOK {
+		t.Fatalf("lifted ban returned %d", res.Code)
+	}
+}
@@ -0,0 +1,173 @@
+package broadcastbox
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+var errClientIPRefused = errors.New("address refused")
+
+// ipFilter is an allow and deny list of client addresses. A denied address is rejected, and
+// with an allow list only the addresses on it are accepted.
+type ipFilter struct {
+	allow, deny []netip.Prefix
+}
+
+// parsePrefixes parses CIDRs like `10.0.0.0/8`, single addresses are a prefix of their own
+func parsePrefixes(list []string) ([]netip.Prefix, error) {
+	prefixes := []netip.Prefix{}
+	for _, entry := range list {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+
+		if addr, err := netip.ParseAddr(entry); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return nil, fmt.Errorf("%q isn't a CIDR or address", entry)
+		}
+
+		// Client addresses are unmapped, so IPv4-mapped prefixes like `::ffff:10.0.0.0/104`
+		// have to be IPv4 ones to match them
+		if prefix.Addr().Is4In6() && prefix.Bits() >= 96 {
+			prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+
+	return prefixes, nil
+}
+
+// newIPFilter parses the allow and deny lists of the allowEnv and denyEnv variables
+func newIPFilter(allowEnv string, allowList []string, denyEnv string, denyList []string) (ipFilter, error) {
+	allow, err := parsePrefixes(allowList)
+	if err != nil {
+		return ipFilter{}, fmt.Errorf("%s: %w", allowEnv, err)
+	}
+
+	deny, err := parsePrefixes(denyList)
+	if err != nil {
+		return ipFilter{}, fmt.Errorf("%s: %w", denyEnv, err)
+	}
+
+	return ipFilter{allow: allow, deny: deny}, nil
+}
+
+// override returns the filter with the lists of a stream that are set replacing its own
+func (f ipFilter) override(allow, deny []string) (ipFilter, error) {
+	var err error
+	if len(allow) != 0 {
+		if f.allow, err = parsePrefixes(allow); err != nil {
+			return ipFilter{}, err
+		}
+	}
+
+	if len(deny) != 0 {
+		if f.deny, err = parsePrefixes(deny); err != nil {
+			return ipFilter{}, err
+		}
+	}
+
+	return f, nil
+}
+
+func (f ipFilter) allows(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range f.deny {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+
+	if len(f.allow) == 0 {
+		return true
+	}
+
+	for _, prefix := range f.allow {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// clientAddr is the address of the client req comes from. That is the address of the connection,
+// unless it is in TRUSTED_PROXIES, then the last address of X-Forwarded-For that isn't.
+func (s *Server) clientAddr(req *http.Request) (netip.Addr, error) {
+	addrPort, err := netip.ParseAddrPort(req.RemoteAddr)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+
+	addr := addrPort.Addr().Unmap()
+	forwarded := strings.Split(strings.Join(req.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0 && s.trustedProxy(addr); i-- {
+		forwardedAddr, err := netip.ParseAddr(strings.TrimSpace(forwarded[i]))
+		if err != nil {
+			break
+		}
+		addr = forwardedAddr.Unmap()
+	}
+
+	return addr, nil
+}
+
+func (s *Server) trustedProxy(addr netip.Addr) bool {
+	for _, prefix := range s.trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkClientIP responds with an error if the address req comes from isn't allowed to publish
+// (whip) or watch streamKey, before any PeerConnection is created
+func (s *Server) checkClientIP(res http.ResponseWriter, req *http.Request, whip bool, streamKey string) bool {
+	addr, err := s.clientAddr(req)
+	if err != nil {
+		logHTTPError(res, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+
+	if err := s.clientIPAllowed(addr, whip, streamKey); errors.Is(err, errClientIPRefused) {
+		logHTTPError(res, err.Error(), http.StatusForbidden)
+		return false
+	} else if err != nil {
+		logHTTPError(res, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+
+	return true
+}
+
+// clientIPAllowed returns errClientIPRefused if addr isn't allowed to publish (whip) or watch
+// streamKey, also for the protocols that aren't HTTP
+func (s *Server) clientIPAllowed(addr netip.Addr, whip bool, streamKey string) error {
+	lists := s.StreamIPLists(streamKey)
+
+	filter, allow, deny := s.whepIPFilter, lists.WHEPAllow, lists.WHEPDeny
+	if whip {
+		filter, allow, deny = s.whipIPFilter, lists.WHIPAllow, lists.WHIPDeny
+	}
+
+	filter, err := filter.override(allow, deny)
+	if err != nil {
+		return fmt.Errorf("invalid IP list of stream `%s`: %w", streamKey, err)
+	}
+
+	if !filter.allows(addr) {
+		return fmt.Errorf("%s may not connect to stream `%s`: %w", addr, streamKey, errClientIPRefused)
+	}
+
+	return nil
+}
@@ -0,0 +1,178 @@
+package broadcastbox
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/glimesh/broadcast-box/internal/webrtc"
+)
+
+func TestIPFilterBoundaries(t *testing.T) {
+	f, err := newIPFilter("ALLOW", []string{"10.0.0.0/8", "192.0.2.7", "2001:db8::/32"}, "DENY", []string{"10.1.0.0/16", "2001:db8:1::/48"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for addr, allowed := range map[string]bool{
+		"10.0.0.0":        true,
+		"10.255.255.255":  true,
+		"9.255.255.255":   false,
+		"11.0.0.0":        false,
+		"10.0.255.255":    true,
+		"10.1.0.0":        false,
+		"10.1.255.255":    false,
+		"10.2.0.0":        true,
+		"192.0.2.7":       true,
+		"192.0.2.6":       false,
+		"192.0.2.8":       false,
+		"2001:db8::":      true,
+		"2001:db8:ffff::": true,
+		"2001:db9::":      false,
+		"2001:db7:ffff::": false,
+		"2001:db8:1::1":   false,
+		"2001:db8:2::":    true,
+		// IPv4-mapped IPv6 addresses are their IPv4 address, also for the deny list
+		"::ffff:10.0.0.1": true,
+		"::ffff:10.1.0.1": false,
+		"::ffff:11.0.0.1": false,
+		// Which aren't IPv4-compatible or NAT64 addresses
+		"::10.0.0.1":        false,
+		"64:ff9b::10.0.0.1": false,
+		"::ffff:192.0.2.7":  true,
+		"::ffff:c000:0207":  true,
+		"fe80::1%eth0":      false,
+		"::1":               false,
+		"127.0.0.1":         false,
+	} {
+		if got := f.allows(netip.MustParseAddr(addr)); got != allowed {
+			t.Errorf("%s allowed: %v, want %v", addr, got, allowed)
+		}
+	}
+}
+
+func TestIPFilterMappedPrefixes(t *testing.T) {
+	f, err := newIPFilter("ALLOW", nil, "DENY", []string{"::ffff:10.0.0.0/104", "::ffff:192.0.2.7", "::ffff:198.51.100.0/120"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for addr, allowed := range map[string]bool{
+		"10.0.0.1":            false,
+		"::ffff:10.0.0.1":     false,
+		"192.0.2.7":           false,
+		"198.51.100.255":      false,
+		"::ffff:198.51.100.1": false,
+		"11.0.0.1":            true,
+		"198.51.101.0":        true,
+	} {
+		if got := f.allows(netip.MustParseAddr(addr)); got != allowed {
+			t.Errorf("%s allowed: %v, want %v", addr, got, allowed)
+		}
+	}
+}
+
+func TestParsePrefixes(t *testing.T) {
+	prefixes, err := parsePrefixes([]string{" 10.1.2.3/8 ", "", "192.0.2.1", "2001:db8::1", "::ffff:10.0.0.0/104", "0.0.0.0/0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"10.0.0.0/8", "192.0.2.1/32", "2001:db8::1/128", "10.0.0.0/8", "0.0.0.0/0"}
+	if len(prefixes) != len(want) {
+		t.Fatalf("parsed %v", prefixes)
+	}
+	for i := range want {
+		if prefixes[i].String() != want[i] {
+			t.Errorf("parsed %s instead of %s", prefixes[i], want[i])
+		}
+	}
+
+	for _, invalid := range []string{"10.0.0.0/33", "10.0.0", "10.0.0.0/8/8", "example.com", "2001:db8::/129"} {
+		if _, err = parsePrefixes([]string{invalid}); err == nil {
+			t.Errorf("%q was parsed", invalid)
+		}
+	}
+}
+
+// newIPFilterServer returns a Server that only lets 198.51.100.0/24 publish, but not
+// 198.51.100.66, behind the proxies 10.0.0.0/8. The stream `private` may only be published from
+// 203.0.113.1.
+func newIPFilterServer(t *testing.T) *Server {
+	streamConfigFile := filepath.Join(t.TempDir(), "streams.json")
+	if err := os.WriteFile(streamConfigFile, []byte(`{"private": {"whipAllow": ["203.0.113.1"]}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewServer(Options{
+		Options: webrtc.Options{
+			StreamConfigFile:   streamConfigFile,
+			RecordingDirectory: t.TempDir(),
+			DisableHLS:         true,
+			DisableDASH:        true,
+		},
+		WHIPAllowCIDRs: []string{"198.51.100.0/24"},
+		WHIPDenyCIDRs:  []string{"198.51.100.66"},
+		TrustedProxies: []string{"10.0.0.0/8"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = s.Close() })
+
+	return s
+}
+
+func TestCheckClientIP(t *testing.T) {
+	s := newIPFilterServer(t)
+
+	for name, c := range map[string]struct {
+		remoteAddr   string
+		forwardedFor []string
+		streamKey    string
+		allowed      bool
+	}{
+		"allowed":                           {"198.51.100.1:1234", nil, "live", true},
+		"allowed IPv4-mapped":               {"[::ffff:198.51.100.1]:1234", nil, "live", true},
+		"denied":                            {"198.51.100.66:1234", nil, "live", false},
+		"denied IPv4-mapped":                {"[::ffff:198.51.100.66]:1234", nil, "live", false},
+		"not allowed":                       {"192.0.2.1:1234", nil, "live", false},
+		"spoofed X-Forwarded-For":           {"192.0.2.1:1234", []string{"198.51.100.1"}, "live", false},
+		"spoofed by an allowed client":      {"198.51.100.66:1234", []string{"198.51.100.1"}, "live", false},
+		"hidden behind a spoofed one":       {"198.51.100.1:1234", []string{"198.51.100.66"}, "live", true},
+		"behind a proxy":                    {"10.0.0.1:1234", []string{"198.51.100.1"}, "live", true},
+		"denied behind a proxy":             {"10.0.0.1:1234", []string{"198.51.100.66"}, "live", false},
+		"denied IPv4-mapped behind a proxy": {"10.0.0.1:1234", []string{"::ffff:198.51.100.66"}, "live", false},
+		"behind two proxies":                {"10.0.0.1:1234", []string{"198.51.100.1, 10.0.0.2"}, "live", true},
+		"headers of two proxies":            {"10.0.0.1:1234", []string{"198.51.100.1", "10.0.0.2"}, "live", true},
+		"spoofed before a proxy":            {"10.0.0.1:1234", []string{"198.51.100.1, 192.0.2.1"}, "live", false},
+		"spoofed denied before a proxy":     {"10.0.0.1:1234", []string{"198.51.100.1, 198.51.100.66"}, "live", false},
+		"garbage before a proxy":            {"10.0.0.1:1234", []string{"198.51.100.1, garbage"}, "live", false},
+		"proxy without a header":            {"10.0.0.1:1234", nil, "live", false},
+		"list of the stream":                {"203.0.113.1:1234", nil, "private", true},
+		"not on the list of the stream":     {"198.51.100.1:1234", nil, "private", false},
+	} {
+		req := httptest.NewRequest("POST", "/api/whip", nil)
+		req.RemoteAddr = c.remoteAddr
+		for _, forwardedFor := range c.forwardedFor {
+			req.Header.Add("X-Forwarded-For", forwardedFor)
+		}
+
+		res := httptest.NewRecorder()
+		if allowed := s.checkClientIP(res, req, true, c.streamKey); allowed != c.allowed {
+			t.Errorf("%s allowed: %v, want %v", name, allowed, c.allowed)
+		} else if !allowed && res.Code != http.StatusForbidden {
+			t.Errorf("%s returned %d", name, res.Code)
+		}
+	}
+
+	// Viewers aren't filtered
+	req := httptest.NewRequest("POST", "/api/whep", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	if !s.checkClientIP(httptest.NewRecorder(), req, false, "live") {
+		t.Error("viewer was refused without a WHEP list")
+	}
+}
@@ -0,0 +1,95 @@
+package broadcastbox
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/glimesh/broadcast-box/internal/keystore"
+)
+
+type createKeyRequestJSON struct {
+	Key         string            `json:"key"`
+	Description string            `json:"description"`
+	Metadata    map[string]string `json:"metadata"`
+}
+
+// keysHandler lists and creates the stream keys of KEY_STORE_PATH on `/api/keys`, and gets,
+// updates and deletes one on `/api/keys/<stream key>`
+func (s *Server) keysHandler(res http.ResponseWriter, req *http.Request) {
+	key := strings.Trim(strings.TrimPrefix(req.URL.Path, "/api/keys"), "/")
+	if key != "" && !validateStreamKey(key) {
+		logHTTPError(res, "Invalid stream key format", http.StatusBadRequest)
+		return
+	}
+
+	var (
+		result any
+		status = http.StatusOK
+		err    error
+	)
+	switch {
+	case req.Method == http.MethodGet && key == "":
+		result, err = s.keyStore.List()
+	case req.Method == http.MethodPost && key == "":
+		var r createKeyRequestJSON
+		if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+			logHTTPError(res, err.Error(), http.StatusBadRequest)
+			return
+		} else if r.Key != "" && !validateStreamKey(r.Key) {
+			logHTTPError(res, "Invalid stream key format", http.StatusBadRequest)
+			return
+		}
+
+		result, err = s.keyStore.Create(keystore.Key{Key: r.Key, Description: r.Description, Metadata: r.Metadata})
+		status = http.StatusCreated
+	case req.Method == http.MethodGet:
+		result, err = s.keyStore.Get(key)
+	case req.Method == http.MethodPatch:
+		var u keystore.Update
+		if err := json.NewDecoder(req.Body).Decode(&u); err != nil {
+			logHTTPError(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		result, err = s.keyStore.Update(key, u)
+	case req.Method == http.MethodDelete:
+		err = s.keyStore.Delete(key)
+		status = http.StatusNoContent
+	default:
+		logHTTPError(res, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch {
+	case errors.Is(err, keystore.ErrKeyNotFound):
+		logHTTPError(res, err.Error(), http.StatusNotFound)
+		return
+	case errors.Is(err, keystore.ErrKeyExists):
+		logHTTPError(res, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		logHTTPError(res, err.Error(), http.StatusInternalServerError)
+		return
+	case result == nil:
+		res.WriteHeader(status)
+		return
+	}
+
+	res.Header().Add("Content-Type", "application/json")
+	res.WriteHeader(status)
+	if err := json.NewEncoder(res).Encode(result); err != nil {
+		logger.Warn("Failed to write response", "err", err)
+	}
+}
+
+// publisherKey returns the stream key that key publishes and if it may, any valid stream key
+// publishes itself without KEY_STORE_PATH
+func (s *Server) publisherKey(key string) (string, bool, error) {
+	if s.keyStore == nil {
+		return key, true, nil
+	}
+
+	return s.keyStore.Authenticate(key)
+}
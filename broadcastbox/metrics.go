@@ -0,0 +1,47 @@
+package broadcastbox
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"time"
+
+	"github.com/glimesh/broadcast-box/internal/metrics"
+)
+
+// handle registers handler for pattern on mux, timing its requests if metrics are enabled
+func (s *Server) handle(mux *http.ServeMux, pattern string, handler func(http.ResponseWriter, *http.Request)) {
+	if s.handlerDurations == nil {
+		mux.HandleFunc(pattern, handler)
+		return
+	}
+
+	mux.HandleFunc(pattern, func(res http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		handler(res, req)
+		s.handlerDurations.Observe(pattern, time.Since(start).Seconds())
+	})
+}
+
+// metricsHandler serves `/metrics` for Prometheus, with metricsToken as the Bearer token if it
+// is set
+func (s *Server) metricsHandler(metricsToken string) func(http.ResponseWriter, *http.Request) {
+	return func(res http.ResponseWriter, req *http.Request) {
+		if metricsToken != "" {
+			token, ok := extractBearerToken(req.Header.Get("Authorization"))
+			if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(metricsToken)) != 1 {
+				res.Header().Set("WWW-Authenticate", "Bearer")
+				logHTTPError(res, "Invalid metrics token", http.StatusUnauthorized)
+				return
+			}
+		}
+
+		set := &metrics.Set{}
+		s.CollectMetrics(set)
+		s.handlerDurations.Collect(set, "broadcast_box_http_request_duration_seconds", "Time taken to serve requests", "handler")
+
+		res.Header().Set("Content-Type", metrics.ContentType)
+		if _, err := set.WriteTo(res); err != nil {
+			logger.Warn("Failed to write response", "err", err)
+		}
+	}
+}
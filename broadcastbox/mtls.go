@@ -0,0 +1,62 @@
+package broadcastbox
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"os"
+)
+
+// registerWHIPHandlers adds the endpoints of publishers to mux
+func (s *Server) registerWHIPHandlers(mux *http.ServeMux) {
+	s.handle(mux, "/api/whip", corsHandler(s.whipCORS, tracedHandler("WHIP offer", s.banHandler(s.clientCertHandler(s.whipHandler)))))
+	s.handle(mux, "/api/pause", corsHandler(s.whipCORS, s.clientCertHandler(s.pauseHandler)))
+	s.handle(mux, "/api/record", corsHandler(s.whipCORS, s.clientCertHandler(s.recordHandler)))
+	s.handle(mux, "/api/metadata", corsHandler(s.whipCORS, s.clientCertHandler(s.metadataHandler)))
+}
+
+// clientCertHandler only calls next for requests with a verified client certificate when
+// WHIP_REQUIRE_CLIENT_CERT is set, which only the listener of ListenAndServeWHIPMutualTLS has
+func (s *Server) clientCertHandler(next func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	if !s.whipRequiresClientCert {
+		return next
+	}
+
+	return func(res http.ResponseWriter, req *http.Request) {
+		if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 {
+			logHTTPError(res, "Publishing requires a client certificate", http.StatusForbidden)
+			return
+		}
+
+		next(res, req)
+	}
+}
+
+// ListenAndServeWHIPMutualTLS serves the WHIP endpoints over HTTPS on addr to publishers with a
+// client certificate issued by a CA in the PEM file clientCAFile, like encoders in the field
+func (s *Server) ListenAndServeWHIPMutualTLS(addr, certFile, keyFile, clientCAFile string) error {
+	caPEM, err := os.ReadFile(clientCAFile)
+	if err != nil {
+		return err
+	}
+
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(caPEM) {
+		return errors.New("no certificates found in " + clientCAFile)
+	}
+
+	mux := http.NewServeMux()
+	s.registerWHIPHandlers(mux)
+
+	server := &http.Server{
+		Addr:    addr,
+		Handler: s.AccessLogHandler(mux),
+		TLSConfig: &tls.Config{
+			ClientAuth: tls.RequireAndVerifyClientCert,
+			ClientCAs:  clientCAs,
+		},
+	}
+
+	return server.ListenAndServeTLS(certFile, keyFile)
+}
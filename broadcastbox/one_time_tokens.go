@@ -0,0 +1,120 @@
+package broadcastbox
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	oneTimeTokenDefaultLifetime = 24 * time.Hour
+	oneTimeTokenMaxLifetime     = 30 * 24 * time.Hour
+)
+
+type (
+	// oneTimeTokens are WHEP Bearer tokens that play a stream once. They are kept in memory, so
+	// a restart invalidates them.
+	oneTimeTokens struct {
+		lock   sync.Mutex
+		tokens map[string]*oneTimeToken
+	}
+
+	oneTimeToken struct {
+		streamKey string
+		expires   time.Time
+
+		// Set while a WHEP request with the token is negotiating, so it can't be used twice at once
+		reserved bool
+	}
+
+	oneTimeTokenRequestJSON struct {
+		// Seconds the token can be used for, a day by default
+		ExpiresIn int `json:"expiresIn"`
+	}
+
+	oneTimeTokenResponseJSON struct {
+		Token   string    `json:"token"`
+		Expires time.Time `json:"expires"`
+	}
+)
+
+func newOneTimeTokens() *oneTimeTokens {
+	return &oneTimeTokens{tokens: map[string]*oneTimeToken{}}
+}
+
+func (o *oneTimeTokens) mint(streamKey string, lifetime time.Duration) (string, time.Time) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	now := time.Now()
+	for token, t := range o.tokens {
+		if now.After(t.expires) {
+			delete(o.tokens, token)
+		}
+	}
+
+	token, expires := randomHex(), now.Add(lifetime)
+	o.tokens[token] = &oneTimeToken{streamKey: streamKey, expires: expires}
+	return token, expires
+}
+
+// reserve returns the stream key of token if it can be used, until release is called
+func (o *oneTimeTokens) reserve(token string) (string, bool) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	t, ok := o.tokens[token]
+	if !ok || t.reserved || time.Now().After(t.expires) {
+		return "", false
+	}
+
+	t.reserved = true
+	return t.streamKey, true
+}
+
+// release invalidates a reserved token once its session was created, otherwise it can be used
+// again
+func (o *oneTimeTokens) release(token string, used bool) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	t, ok := o.tokens[token]
+	if !ok || !t.reserved {
+		return
+	}
+
+	if used {
+		delete(o.tokens, token)
+	} else {
+		t.reserved = false
+	}
+}
+
+// oneTimeTokenHandler mints a one-time viewer token for streamKey
+func (s *Server) oneTimeTokenHandler(res http.ResponseWriter, req *http.Request, streamKey string) {
+	var r oneTimeTokenRequestJSON
+	if err := json.NewDecoder(req.Body).Decode(&r); err != nil && !errors.Is(err, io.EOF) {
+		logHTTPError(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Checked before it is converted, a Duration of a large expiresIn overflows
+	lifetime := oneTimeTokenDefaultLifetime
+	if r.ExpiresIn < 0 || r.ExpiresIn > int(oneTimeTokenMaxLifetime/time.Second) {
+		logHTTPError(res, "expiresIn must be between 1 second and 30 days", http.StatusBadRequest)
+		return
+	} else if r.ExpiresIn != 0 {
+		lifetime = time.Duration(r.ExpiresIn) * time.Second
+	}
+
+	token, expires := s.oneTimeTokens.mint(streamKey, lifetime)
+
+	res.Header().Add("Content-Type", "application/json")
+	res.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(res).Encode(oneTimeTokenResponseJSON{Token: token, Expires: expires}); err != nil {
+		logger.Warn("Failed to write response", "err", err)
+	}
+}
@@ -0,0 +1,140 @@
+package broadcastbox
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestOneTimeTokenReplay(t *testing.T) {
+	o := newOneTimeTokens()
+	token, _ := o.mint("live", time.Minute)
+
+	if _, ok := o.reserve("unknown"); ok {
+		t.Fatal("unknown token was reserved")
+	}
+
+	streamKey, ok := o.reserve(token)
+	if !ok || streamKey != "live" {
+		t.Fatalf("reserve returned %q, %v", streamKey, ok)
+	}
+
+	// Not while it is negotiating
+	if _, ok = o.reserve(token); ok {
+		t.Fatal("reserved token was reserved again")
+	}
+
+	// A failed negotiation leaves it usable
+	o.release(token, false)
+	if _, ok = o.reserve(token); !ok {
+		t.Fatal("token of a failed negotiation can't be used again")
+	}
+
+	o.release(token, true)
+	if _, ok = o.reserve(token); ok {
+		t.Fatal("used token was reserved again")
+	}
+
+	// Releasing a token that isn't reserved doesn't make it usable
+	o.release(token, false)
+	if _, ok = o.reserve(token); ok {
+		t.Fatal("used token was reserved after release")
+	}
+}
+
+func TestOneTimeTokenConcurrentUse(t *testing.T) {
+	o := newOneTimeTokens()
+	token, _ := o.mint("live", time.Minute)
+
+	var (
+		wg       sync.WaitGroup
+		lock     sync.Mutex
+		reserved int
+	)
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			if _, ok := o.reserve(token); ok {
+				lock.Lock()
+				reserved++
+				lock.Unlock()
+				o.release(token, true)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if reserved != 1 {
+		t.Fatalf("token was used %d times", reserved)
+	}
+}
+
+func TestOneTimeTokenExpiry(t *testing.T) {
+	o := newOneTimeTokens()
+
+	expired, expires := o.mint("live", -time.Second)
+	if !expires.Before(time.Now()) {
+		t.Fatalf("token expires at %v", expires)
+	} else if _, ok := o.reserve(expired); ok {
+		t.Fatal("expired token was reserved")
+	}
+
+	short, _ := o.mint("live", 20*time.Millisecond)
+	time.Sleep(40 * time.Millisecond)
+	if _, ok := o.reserve(short); ok {
+		t.Fatal("token was reserved after it expired")
+	}
+
+	// Expired tokens are removed when the next one is minted
+	o.mint("live", time.Minute)
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if len(o.tokens) != 1 {
+		t.Fatalf("%d tokens are kept", len(o.tokens))
+	}
+}
+
+func TestOneTimeTokenHandler(t *testing.T) {
+	s := &Server{oneTimeTokens: newOneTimeTokens()}
+
+	for body, lifetime := range map[string]time.Duration{
+		``:                       oneTimeTokenDefaultLifetime,
+		`{}`:                     oneTimeTokenDefaultLifetime,
+		`{"expiresIn": 60}`:      time.Minute,
+		`{"expiresIn": 2592000}`: oneTimeTokenMaxLifetime,
+		`{"expiresIn": 2592001}`: 0,
+		`{"expiresIn": -1}`:      0,
+		// Overflows a Duration to 48 hours
+		`{"expiresIn": 18446916874}`:         0,
+		`{"expiresIn": 9223372036854775807}`: 0,
+		`{"expiresIn": "60"}`:                0,
+	} {
+		res := httptest.NewRecorder()
+		before := time.Now()
+		s.oneTimeTokenHandler(res, httptest.NewRequest("POST", "/api/streams/live/tokens", strings.NewReader(body)), "live")
+
+		if lifetime == 0 {
+			if res.Code != http.StatusBadRequest {
+				t.Errorf("%s returned %d", body, res.Code)
+			}
+			continue
+		}
+
+		var minted oneTimeTokenResponseJSON
+		if res.Code != http.StatusCreated {
+			t.Errorf("%s returned %d", body, res.Code)
+		} else if err := json.NewDecoder(res.Body).Decode(&minted); err != nil {
+			t.Fatal(err)
+		} else if minted.Expires.Before(before.Add(lifetime)) || minted.Expires.After(time.Now().Add(lifetime)) {
+			t.Errorf("%s expires at %v", body, minted.Expires)
+		} else if streamKey, ok := s.oneTimeTokens.reserve(minted.Token); !ok || streamKey != "live" {
+			t.Errorf("token of %s can't be used", body)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package broadcastbox
+
+import (
+	"time"
+
+	"github.com/glimesh/broadcast-box/internal/webrtc"
+)
+
+// Options configure a Server, the standalone server fills them in from the environment
+// variables that are mentioned. The zero value is a Server without authentication.
+type Options struct {
+	webrtc.Options
+
+	// `<stream key>:<token>` pairs publishers and viewers may use, see WHIP_TOKENS and WHEP_TOKENS.
+	// The files have more of them and are read on every request, see WHIP_TOKEN_FILE.
+	WHIPTokens, WHEPTokens       []string
+	WHIPTokenFile, WHEPTokenFile string
+
+	// Secret or JWKS the JWTs of publishers and viewers are verified with, see JWT_SECRET and JWT_JWKS_URL
+	JWTSecret, JWTJWKSURL string
+
+	// Endpoint asked if publishers and viewers may connect, see AUTH_WEBHOOK_URL
+	AuthWebhookURL, AuthWebhookSecret string
+
+	// OpenID Connect provider operators log in with and who may, see OIDC_ISSUER
+	OIDCIssuer, OIDCClientID, OIDCClientSecret, OIDCRedirectURL string
+	OIDCAllowedEmails                                           []string
+
+	// Bearer token of the operator APIs, see ADMIN_TOKEN
+	AdminToken string
+
+	// Serve `/metrics` and the bearer token it needs, see ENABLE_METRICS and METRICS_TOKEN
+	EnableMetrics bool
+	MetricsToken  string
+
+	// Don't serve the status, restream or recordings APIs, see DISABLE_STATUS, DISABLE_RESTREAM
+	// and DISABLE_RECORDINGS_API
+	DisableStatus, DisableRestream, DisableRecordingsAPI bool
+
+	// Most WHEP sessions of one credential, see MAX_SESSIONS_PER_CREDENTIAL
+	MaxSessionsPerCredential int
+
+	// Offers of each address and of all clients like `10/1m`, see SIGNALING_RATE_LIMIT_PER_IP
+	// and SIGNALING_RATE_LIMIT
+	SignalingRateLimitPerIP, SignalingRateLimit string
+
+	// Failed requests an address is banned after, see BAN_AFTER_FAILURES, BAN_FIND_TIME and BAN_DURATION
+	BanAfterFailures         int
+	BanFindTime, BanDuration time.Duration
+
+	// Addresses publishers and viewers may connect from, see WHIP_ALLOW_CIDRS and WHEP_ALLOW_CIDRS
+	WHIPAllowCIDRs, WHIPDenyCIDRs []string
+	WHEPAllowCIDRs, WHEPDenyCIDRs []string
+
+	// Proxies whose X-Forwarded-For is used as the client address, see TRUSTED_PROXIES
+	TrustedProxies []string
+
+	// File publishers, kicks and other changes are recorded in, see AUDIT_LOG_FILE
+	AuditLogFile string
+
+	// MaxMind database of the countries of viewers, see GEOIP_DATABASE
+	GeoIPDatabase string
+
+	// `common` or `json` and where requests are logged, see ACCESS_LOG
+	AccessLog, AccessLogFile string
+	AccessLogExcludePaths    []string
+
+	// Secret of signed WHEP URLs, see WHEP_URL_SECRET
+	WHEPURLSecret string
+
+	// Databases of generated stream keys and of usage, see KEY_STORE_PATH and USAGE_DB_PATH
+	KeyStorePath, UsageDBPath string
+
+	// Publishers have to use the mutual TLS listener, see WHIP_REQUIRE_CLIENT_CERT
+	WHIPRequireClientCert bool
+
+	// Log the offer and answer of every WHIP and WHEP request, see DEBUG_LOG_SDP
+	DebugLogSDP bool
+
+	// CORS policies of the WHIP, WHEP and API endpoints, see CORS_ALLOWED_ORIGINS
+	WHIPCORS, WHEPCORS, APICORS CORSOptions
+}
@@ -0,0 +1,66 @@
+package broadcastbox
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// requestOrigin returns the origin of the page req was made from, by the Origin header or else
+// the Referer
+func requestOrigin(req *http.Request) string {
+	if origin := req.Header.Get("Origin"); origin != "" && origin != "null" {
+		return strings.ToLower(origin)
+	}
+
+	referer, err := url.Parse(req.Header.Get("Referer"))
+	if err != nil || referer.Scheme == "" || referer.Host == "" {
+		return ""
+	}
+
+	return strings.ToLower(referer.Scheme + "://" + referer.Host)
+}
+
+// originAllowed returns if origin is in allowed, where `https://*.example.com` allows any
+// subdomain of example.com
+func originAllowed(origin string, allowed []string) bool {
+	for _, a := range allowed {
+		a = strings.ToLower(strings.TrimSuffix(a, "/"))
+		if a == origin {
+			return true
+		}
+
+		if scheme, host, ok := strings.Cut(a, "://*."); ok && strings.HasPrefix(origin, scheme+"://") && strings.HasSuffix(origin, "."+host) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkOrigin responds with an error if the allowedOrigins of streamKey don't include the page
+// a WHEP offer, HLS playlist or DASH manifest request comes from. Broadcast Box's own player is always allowed.
+func (s *Server) checkOrigin(res http.ResponseWriter, req *http.Request, streamKey string) bool {
+	allowed := s.StreamAllowedOrigins(streamKey)
+	if len(allowed) == 0 {
+		return true
+	}
+
+	origin := requestOrigin(req)
+	if origin == "" {
+		logHTTPError(res, fmt.Sprintf("Stream `%s` can only be played from allowed sites", streamKey), http.StatusForbidden)
+		return false
+	}
+
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, req.Host) {
+		return true
+	}
+
+	if !originAllowed(origin, allowed) {
+		logHTTPError(res, fmt.Sprintf("Stream `%s` can't be played from %s", streamKey, origin), http.StatusForbidden)
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,168 @@
+package broadcastbox
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	// rate is a token bucket of burst tokens that refills completely every interval
+	rate struct {
+		burst    float64
+		interval time.Duration
+	}
+
+	tokenBucket struct {
+		tokens float64
+		last   time.Time
+	}
+
+	// rateLimiter bounds the WHIP and WHEP offers of each address with SIGNALING_RATE_LIMIT_PER_IP
+	// and of all clients together with SIGNALING_RATE_LIMIT
+	rateLimiter struct {
+		perIP, global rate
+
+		lock         sync.Mutex
+		buckets      map[netip.Addr]*tokenBucket
+		globalBucket *tokenBucket
+		lastSweep    time.Time
+	}
+)
+
+// parseRate parses the `<requests>/<interval>` value of envKey like `10/1m`, empty is no limit
+func parseRate(envKey, value string) (rate, error) {
+	if value == "" {
+		return rate{}, nil
+	}
+
+	requests, interval, ok := strings.Cut(value, "/")
+	burst, err := strconv.Atoi(requests)
+	if !ok || err != nil || burst <= 0 {
+		return rate{}, fmt.Errorf("%s: %q isn't like `10/1m`", envKey, value)
+	}
+
+	r := rate{burst: float64(burst)}
+	if r.interval, err = time.ParseDuration(interval); err != nil || r.interval <= 0 {
+		return rate{}, fmt.Errorf("%s: %q isn't like `10/1m`", envKey, value)
+	}
+
+	return r, nil
+}
+
+func (r rate) enabled() bool {
+	return r.burst > 0
+}
+
+// refill adds the tokens since the last request and returns how long until one is available
+func (r rate) refill(b *tokenBucket, now time.Time) time.Duration {
+	if now.Before(b.last) {
+		now = b.last
+	}
+	b.tokens = math.Min(r.burst, b.tokens+now.Sub(b.last).Seconds()*r.burst/r.interval.Seconds())
+	b.last = now
+
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) * float64(r.interval) / r.burst)
+}
+
+// clientKey returns the address that the limits of addr are kept by, the /64 of IPv6 addresses
+// because a client usually has all of them
+func clientKey(addr netip.Addr) netip.Addr {
+	if addr.Is6() {
+		return netip.PrefixFrom(addr.WithZone(""), 64).Masked().Addr()
+	}
+	return addr
+}
+
+func newRateLimiter(perIPRate, globalRate string) (*rateLimiter, error) {
+	perIP, err := parseRate("SIGNALING_RATE_LIMIT_PER_IP", perIPRate)
+	if err != nil {
+		return nil, err
+	}
+
+	global, err := parseRate("SIGNALING_RATE_LIMIT", globalRate)
+	if err != nil {
+		return nil, err
+	}
+
+	return &rateLimiter{
+		perIP:        perIP,
+		global:       global,
+		buckets:      map[netip.Addr]*tokenBucket{},
+		globalBucket: &tokenBucket{tokens: global.burst, last: time.Now()},
+	}, nil
+}
+
+// allow takes a token for addr, otherwise it returns how long to wait for one
+func (l *rateLimiter) allow(addr netip.Addr) (bool, time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := time.Now()
+	var bucket *tokenBucket
+	wait := time.Duration(0)
+
+	if l.perIP.enabled() {
+		// Buckets that refilled completely are the same as new ones
+		if now.Sub(l.lastSweep) > l.perIP.interval {
+			for a, b := range l.buckets {
+				if l.perIP.refill(b, now); b.tokens >= l.perIP.burst {
+					delete(l.buckets, a)
+				}
+			}
+			l.lastSweep = now
+		}
+
+		key := clientKey(addr)
+		if bucket = l.buckets[key]; bucket == nil {
+			bucket = &tokenBucket{tokens: l.perIP.burst, last: now}
+			l.buckets[key] = bucket
+		}
+		wait = l.perIP.refill(bucket, now)
+	}
+
+	if l.global.enabled() {
+		wait = max(wait, l.global.refill(l.globalBucket, now))
+	}
+
+	if wait > 0 {
+		return false, wait
+	}
+
+	if bucket != nil {
+		bucket.tokens--
+	}
+	if l.global.enabled() {
+		l.globalBucket.tokens--
+	}
+	return true, 0
+}
+
+// checkRateLimit responds with 429 if the client of req made too many WHIP or WHEP offers
+func (s *Server) checkRateLimit(res http.ResponseWriter, req *http.Request) bool {
+	if !s.rateLimiter.perIP.enabled() && !s.rateLimiter.global.enabled() {
+		return true
+	}
+
+	addr, err := s.clientAddr(req)
+	if err != nil {
+		logHTTPError(res, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+
+	if ok, wait := s.rateLimiter.allow(addr); !ok {
+		res.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		logHTTPError(res, fmt.Sprintf("Too many offers from %s", addr), http.StatusTooManyRequests)
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,187 @@
+package broadcastbox
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/glimesh/broadcast-box/internal/webrtc"
+)
+
+func TestParseRate(t *testing.T) {
+	r, err := parseRate("RATE", "10/1m")
+	if err != nil || r.burst != 10 || r.interval != time.Minute {
+		t.Fatalf("parsed %+v, %v", r, err)
+	}
+
+	if r, err = parseRate("RATE", ""); err != nil || r.enabled() {
+		t.Fatalf("empty rate is %+v, %v", r, err)
+	}
+
+	for _, invalid := range []string{"10", "10/", "/1m", "0/1m", "-1/1m", "10/0s", "10/-1m", "1.5/1m", "10/1"} {
+		if _, err = parseRate("RATE", invalid); err == nil {
+			t.Errorf("%q was parsed", invalid)
+		}
+	}
+}
+
+func TestRateRefill(t *testing.T) {
+	r := rate{burst: 10, interval: 10 * time.Second}
+	start := time.Now()
+	b := &tokenBucket{tokens: 0, last: start}
+
+	// A token every second, available exactly when it is refilled
+	if wait := r.refill(b, start); wait != time.Second {
+		t.Fatalf("waiting %s for an empty bucket", wait)
+	}
+	if wait := r.refill(b, start.Add(999*time.Millisecond)); wait <= 0 {
+		t.Fatal("token available before it was refilled")
+	}
+	if wait := r.refill(b, start.Add(time.Second)); wait != 0 {
+		t.Fatalf("waiting %s after a second", wait)
+	}
+
+	// Never more than the burst
+	if r.refill(b, start.Add(time.Hour)); b.tokens != 10 {
+		t.Fatalf("%f tokens after an hour", b.tokens)
+	}
+
+	// Time going backwards doesn't take more than the tokens in the bucket
+	if r.refill(b, start); b.tokens < 0 {
+		t.Fatalf("%f tokens after time went backwards", b.tokens)
+	}
+}
+
+func TestRateLimiterPerIP(t *testing.T) {
+	l, err := newRateLimiter("3/1h", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	allow := func(addr string) bool {
+		ok, _ := l.allow(netip.MustParseAddr(addr))
+		return ok
+	}
+
+	for i := 0; i < 3; i++ {
+		if !allow("192.0.2.1") {
+			t.Fatalf("offer %d of the burst was refused", i+1)
+		}
+	}
+	if ok, wait := l.allow(netip.MustParseAddr("192.0.2.1")); ok || wait < 19*time.Minute || wait > 20*time.Minute {
+		t.Fatalf("offer after the burst: %v, waiting %s", ok, wait)
+	}
+
+	// Neighbouring IPv4 addresses have their own limit
+	if !allow("192.0.2.2") || !allow("192.0.2.0") {
+		t.Fatal("neighbour of a limited address was refused")
+	}
+
+	// But an IPv6 client can't get around it with the other addresses of its /64
+	for i := 0; i < 3; i++ {
+		if !allow("2001:db8::1") {
+			t.Fatalf("offer %d of the burst was refused", i+1)
+		}
+	}
+	for _, addr := range []string{"2001:db8::2", "2001:db8::ffff:ffff:ffff:ffff", "2001:db8::1%eth0"} {
+		if allow(addr) {
+			t.Errorf("%s got around the limit of its /64", addr)
+		}
+	}
+	if !allow("2001:db8:0:1::1") {
+		t.Fatal("other /64 was refused")
+	}
+}
+
+func TestRateLimiterGlobal(t *testing.T) {
+	l, err := newRateLimiter("", "2/1h")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, addr := range []string{"192.0.2.1", "192.0.2.2"} {
+		if ok, _ := l.allow(netip.MustParseAddr(addr)); !ok {
+			t.Fatalf("offer %d was refused", i+1)
+		}
+	}
+	if ok, _ := l.allow(netip.MustParseAddr("2001:db8::1")); ok {
+		t.Fatal("offer after the global burst was allowed")
+	}
+}
+
+func TestRateLimiterRefusedDoesNotTakeTokens(t *testing.T) {
+	l, err := newRateLimiter("1/1h", "2/1h")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Offers refused by the limit of their address don't count for the global one
+	for i := 0; i < 5; i++ {
+		l.allow(netip.MustParseAddr("192.0.2.1"))
+	}
+	if ok, _ := l.allow(netip.MustParseAddr("192.0.2.2")); !ok {
+		t.Fatal("refused offers took global tokens")
+	}
+}
+
+func TestCheckRateLimit(t *testing.T) {
+	s, err := NewServer(Options{
+		Options: webrtc.Options{
+			RecordingDirectory: t.TempDir(),
+			DisableHLS:         true,
+			DisableDASH:        true,
+		},
+		SignalingRateLimitPerIP: "1/1h",
+		TrustedProxies:          []string{"10.0.0.0/8"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = s.Close() })
+
+	check := func(remoteAddr string, forwardedFor ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/whep", nil)
+		req.RemoteAddr = remoteAddr
+		for _, f := range forwardedFor {
+			req.Header.Add("X-Forwarded-For", f)
+		}
+
+		res := httptest.NewRecorder()
+		if ok := s.checkRateLimit(res, req); ok != (res.Code == http.StatusOK) {
+			t.Fatalf("allowed %v with %d", ok, res.Code)
+		}
+		return res
+	}
+
+	if res := check("192.0.2.1:1234"); res.Code != http.StatusOK {
+		t.Fatalf("first offer returned %d", res.Code)
+	}
+	res := check("192.0.2.1:1234")
+	if res.Code != http.StatusTooManyRequests || res.Header().Get("Retry-After") != "3600" {
+		t.Fatalf("second offer returned %d with Retry-After %q", res.Code, res.Header().Get("Retry-After"))
+	}
+
+	for _, c := range []struct {
+		name         string
+		remoteAddr   string
+		forwardedFor []string
+		allowed      bool
+	}{
+		{"IPv4-mapped", "[::ffff:192.0.2.1]:1234", nil, false},
+		{"spoofed X-Forwarded-For", "192.0.2.1:1234", []string{"198.51.100.1"}, false},
+		{"behind a proxy", "10.0.0.1:1234", []string{"192.0.2.1"}, false},
+		{"IPv4-mapped behind a proxy", "10.0.0.1:1234", []string{"::ffff:192.0.2.1"}, false},
+		{"spoofed before a proxy", "10.0.0.1:1234", []string{"198.51.100.1, 192.0.2.1"}, false},
+		{"spoofed in another header", "10.0.0.1:1234", []string{"198.51.100.2", "192.0.2.1"}, false},
+		{"garbage before a proxy", "10.0.0.1:1234", []string{"192.0.2.1, garbage"}, true},
+		{"other client behind a proxy", "10.0.0.2:1234", []string{"198.51.100.3"}, true},
+		{"other client behind two proxies", "10.0.0.1:1234", []string{"198.51.100.4, 10.0.0.2"}, true},
+		{"same client behind two proxies", "10.0.0.1:1234", []string{"198.51.100.4, 10.0.0.3"}, false},
+	} {
+		if res := check(c.remoteAddr, c.forwardedFor...); (res.Code == http.StatusOK) != c.allowed {
+			t.Errorf("%s returned %d", c.name, res.Code)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package broadcastbox
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/glimesh/broadcast-box/internal/webrtc"
+)
+
+// Content types of the recording files, http.ServeContent would sniff some of them wrong
+var recordingContentTypes = map[string]string{
+	".webm": "video/webm",
+	".mp4":  "video/mp4",
+	".ivf":  "video/x-ivf",
+	".ogg":  "audio/ogg",
+}
+
+// recordingsHandler lists the finished recordings of a stream key and its layers on
+// `/api/recordings/<stream key>` and serves them on `/api/recordings/<stream key>/<name>`, to
+// the viewers that may watch the stream
+func (s *Server) recordingsHandler(res http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		logHTTPError(res, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	streamKey, name, _ := strings.Cut(strings.TrimPrefix(req.URL.Path, "/api/recordings/"), "/")
+	if !validateStreamKey(streamKey) {
+		logHTTPError(res, "Invalid stream key format", http.StatusBadRequest)
+		return
+	}
+	setAccessLogStreamKey(req, streamKey)
+
+	if !s.authorizeViewer(res, req, streamKey) {
+		return
+	}
+
+	if name == "" {
+		recordings, err := s.Recordings(streamKey)
+		if err != nil {
+			logHTTPError(res, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		res.Header().Add("Content-Type", "application/json")
+		if err := json.NewEncoder(res).Encode(recordings); err != nil {
+			logHTTPError(res, err.Error(), http.StatusBadRequest)
+		}
+		return
+	}
+
+	file, err := s.OpenRecording(streamKey, name)
+	if errors.Is(err, webrtc.ErrRecordingNotFound) {
+		logHTTPError(res, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		logHTTPError(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		logHTTPError(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	res.Header().Set("Content-Type", recordingContentTypes[filepath.Ext(name)])
+	http.ServeContent(res, req, name, info.ModTime(), file)
+}
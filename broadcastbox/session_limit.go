@@ -0,0 +1,96 @@
+package broadcastbox
+
+import (
+	"sync"
+)
+
+type (
+	// viewerCredential is what a WHEP viewer authenticated with. value is empty for a stream key
+	// and one-time tokens, which aren't limited.
+	viewerCredential struct {
+		kind  string // `viewerToken`, `jwt` or `signedUrl`
+		value string
+	}
+
+	// sessionLimiter bounds the WHEP sessions of each credential to MAX_SESSIONS_PER_CREDENTIAL
+	sessionLimiter struct {
+		max int
+
+		// Returns if a session is still connected, sessions that aren't anymore are forgotten
+		sessionExists func(streamKey, whepSessionId string) bool
+
+		lock     sync.Mutex
+		sessions map[viewerCredential][]limitedSession
+
+		// Offers that are being negotiated, so concurrent ones can't exceed the limit
+		pending map[viewerCredential]int
+	}
+
+	limitedSession struct {
+		streamKey     string
+		whepSessionId string
+	}
+)
+
+func newSessionLimiter(max int, sessionExists func(streamKey, whepSessionId string) bool) *sessionLimiter {
+	return &sessionLimiter{
+		max:           max,
+		sessionExists: sessionExists,
+		sessions:      map[viewerCredential][]limitedSession{},
+		pending:       map[viewerCredential]int{},
+	}
+}
+
+func (l *sessionLimiter) limits(credential viewerCredential) bool {
+	return l.max > 0 && credential.value != ""
+}
+
+// acquire returns if credential may start another session, then done has to be called once
+// it was created or failed
+func (l *sessionLimiter) acquire(credential viewerCredential) bool {
+	if !l.limits(credential) {
+		return true
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	connected := []limitedSession{}
+	for _, session := range l.sessions[credential] {
+		if l.sessionExists(session.streamKey, session.whepSessionId) {
+			connected = append(connected, session)
+		}
+	}
+	if len(connected) == 0 {
+		delete(l.sessions, credential)
+	} else {
+		l.sessions[credential] = connected
+	}
+
+	if len(connected)+l.pending[credential] >= l.max {
+		return false
+	}
+
+	l.pending[credential]++
+	return true
+}
+
+// done counts the session of an acquire, whepSessionId is empty if it failed
+func (l *sessionLimiter) done(credential viewerCredential, streamKey, whepSessionId string) {
+	if !l.limits(credential) {
+		return
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.pending[credential]--; l.pending[credential] <= 0 {
+		delete(l.pending, credential)
+	}
+
+	if whepSessionId != "" {
+		l.sessions[credential] = append(l.sessions[credential], limitedSession{streamKey: streamKey, whepSessionId: whepSessionId})
+	} else if len(l.sessions[credential]) == 0 {
+		delete(l.sessions, credential)
+	}
+}
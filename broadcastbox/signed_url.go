@@ -0,0 +1,81 @@
+package broadcastbox
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// SignWHEPQuery returns the query parameters that let a WHEP viewer play streamKey until
+// expires without other credentials, signed with WHEP_URL_SECRET. With ip only that client
+// address may use them.
+func SignWHEPQuery(secret, streamKey string, expires time.Time, ip string) url.Values {
+	query := url.Values{
+		"streamKey": {streamKey},
+		"expires":   {strconv.FormatInt(expires.Unix(), 10)},
+		"signature": {whepURLSignature([]byte(secret), streamKey, expires.Unix(), ip)},
+	}
+	if ip != "" {
+		query.Set("ip", ip)
+	}
+
+	return query
+}
+
+// whepURLSignature is the HMAC-SHA256 of `<stream key>\n<expires>\n<ip>` in hex
+func whepURLSignature(secret []byte, streamKey string, expires int64, ip string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(streamKey + "\n" + strconv.FormatInt(expires, 10) + "\n" + ip))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signedURLStreamKey returns the stream key of a WHEP request with a signed query, otherwise it
+// responds with an error. The stream key is the `streamKey` parameter or the Bearer token.
+func (s *Server) signedURLStreamKey(res http.ResponseWriter, req *http.Request) (string, bool) {
+	query := req.URL.Query()
+
+	streamKey := query.Get("streamKey")
+	if streamKey == "" {
+		streamKey, _ = extractBearerToken(req.Header.Get("Authorization"))
+	}
+	if !validateStreamKey(streamKey) {
+		logHTTPError(res, "Invalid stream key format", http.StatusBadRequest)
+		return "", false
+	}
+
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil {
+		logHTTPError(res, "Invalid expires", http.StatusBadRequest)
+		return "", false
+	}
+
+	ip := query.Get("ip")
+	expected := whepURLSignature(s.whepURLSecret, streamKey, expires, ip)
+	if !hmac.Equal([]byte(expected), []byte(query.Get("signature"))) {
+		logHTTPError(res, "Invalid signature", http.StatusForbidden)
+		return "", false
+	} else if time.Now().After(time.Unix(expires, 0)) {
+		logHTTPError(res, "URL has expired", http.StatusForbidden)
+		return "", false
+	}
+
+	if ip != "" {
+		addr, err := s.clientAddr(req)
+		if err != nil {
+			logHTTPError(res, err.Error(), http.StatusInternalServerError)
+			return "", false
+		}
+
+		if parsed, err := netip.ParseAddr(ip); err != nil || parsed.Unmap() != addr {
+			logHTTPError(res, "URL is signed for another address", http.StatusForbidden)
+			return "", false
+		}
+	}
+
+	return streamKey, true
+}
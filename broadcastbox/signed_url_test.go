@@ -0,0 +1,130 @@
+package broadcastbox
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"testing"
+	"time"
+)
+
+const testWHEPURLSecret = "whep-url-secret"
+
+// whepRequest is a WHEP request with query from remoteAddr, and X-Forwarded-For if it is set
+func whepRequest(query url.Values, remoteAddr, forwardedFor, bearer string) *http.Request {
+	req := httptest.NewRequest("POST", "/api/whep?"+query.Encode(), nil)
+	req.RemoteAddr = remoteAddr
+	if forwardedFor != "" {
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+	}
+	if bearer != "" {
+		req.Header.Set("Authorization", "Bearer "+bearer)
+	}
+
+	return req
+}
+
+func TestSignedURL(t *testing.T) {
+	s := &Server{whepURLSecret: []byte(testWHEPURLSecret), trustedProxies: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}}
+	expires := time.Now().Add(time.Minute)
+
+	valid := SignWHEPQuery(testWHEPURLSecret, "live", expires, "")
+	pinned := SignWHEPQuery(testWHEPURLSecret, "live", expires, "192.0.2.1")
+
+	// The stream key can be the Bearer token instead of a parameter
+	bearerOnly := SignWHEPQuery(testWHEPURLSecret, "live", expires, "")
+	bearerOnly.Del("streamKey")
+
+	for name, c := range map[string]struct {
+		req  *http.Request
+		code int
+	}{
+		"valid":                        {whepRequest(valid, "198.51.100.1:1234", "", ""), 0},
+		"valid again":                  {whepRequest(valid, "198.51.100.2:1234", "", ""), 0},
+		"stream key as Bearer token":   {whepRequest(bearerOnly, "198.51.100.1:1234", "", "live"), 0},
+		"pinned address":               {whepRequest(pinned, "192.0.2.1:1234", "", ""), 0},
+		"pinned IPv4-mapped address":   {whepRequest(pinned, "[::ffff:192.0.2.1]:1234", "", ""), 0},
+		"pinned behind a proxy":        {whepRequest(pinned, "10.0.0.1:1234", "192.0.2.1", ""), 0},
+		"other address":                {whepRequest(pinned, "192.0.2.2:1234", "", ""), http.StatusForbidden},
+		"spoofed X-Forwarded-For":      {whepRequest(pinned, "192.0.2.2:1234", "192.0.2.1", ""), http.StatusForbidden},
+		"spoofed behind a proxy":       {whepRequest(pinned, "10.0.0.1:1234", "192.0.2.1, 192.0.2.2", ""), http.StatusForbidden},
+		"missing signature stream key": {whepRequest(url.Values{"expires": valid["expires"], "signature": valid["signature"]}, "198.51.100.1:1234", "", ""), http.StatusBadRequest},
+		"missing expires":              {whepRequest(url.Values{"streamKey": {"live"}, "signature": valid["signature"]}, "198.51.100.1:1234", "", ""), http.StatusBadRequest},
+	} {
+		res := httptest.NewRecorder()
+		streamKey, ok := s.signedURLStreamKey(res, c.req)
+		if c.code == 0 && (!ok || streamKey != "live") {
+			t.Errorf("%s was refused with %d: %s", name, res.Code, res.Body)
+		} else if c.code != 0 && (ok || res.Code != c.code) {
+			t.Errorf("%s returned %d instead of %d", name, res.Code, c.code)
+		}
+	}
+}
+
+func TestSignedURLExpiry(t *testing.T) {
+	s := &Server{whepURLSecret: []byte(testWHEPURLSecret)}
+
+	for name, expires := range map[string]time.Time{
+		"expired":             time.Now().Add(-time.Second),
+		"expired long ago":    time.Unix(0, 0),
+		"expired before 1970": time.Unix(-1, 0),
+	} {
+		res := httptest.NewRecorder()
+		if _, ok := s.signedURLStreamKey(res, whepRequest(SignWHEPQuery(testWHEPURLSecret, "live", expires, ""), "198.51.100.1:1234", "", "")); ok || res.Code != http.StatusForbidden {
+			t.Errorf("%s URL returned %d", name, res.Code)
+		}
+	}
+}
+
+// A signature only allows what it was made for, changing any parameter of the URL invalidates it
+func TestSignedURLReplay(t *testing.T) {
+	s := &Server{whepURLSecret: []byte(testWHEPURLSecret)}
+	expires := time.Now().Add(time.Minute)
+
+	replays := map[string]func(url.Values) (url.Values, string){
+		"other stream key": func(q url.Values) (url.Values, string) {
+			q.Set("streamKey", "other")
+			return q, ""
+		},
+		"other stream key as Bearer token": func(q url.Values) (url.Values, string) {
+			q.Del("streamKey")
+			return q, "other"
+		},
+		"extended expiry": func(q url.Values) (url.Values, string) {
+			q.Set("expires", "99999999999")
+			return q, ""
+		},
+		"address added": func(q url.Values) (url.Values, string) {
+			q.Set("ip", "198.51.100.1")
+			return q, ""
+		},
+		"signature of another secret": func(q url.Values) (url.Values, string) {
+			q.Set("signature", SignWHEPQuery("other secret", "live", expires, "").Get("signature"))
+			return q, ""
+		},
+		"uppercase signature": func(q url.Values) (url.Values, string) {
+			q.Set("signature", "A"+q.Get("signature")[1:])
+			return q, ""
+		},
+		"truncated signature": func(q url.Values) (url.Values, string) {
+			q.Set("signature", q.Get("signature")[:32])
+			return q, ""
+		},
+	}
+
+	for name, replay := range replays {
+		query, bearer := replay(SignWHEPQuery(testWHEPURLSecret, "live", expires, ""))
+		res := httptest.NewRecorder()
+		if streamKey, ok := s.signedURLStreamKey(res, whepRequest(query, "198.51.100.1:1234", "", bearer)); ok || res.Code != http.StatusForbidden {
+			t.Errorf("%s was accepted for %q with %d", name, streamKey, res.Code)
+		}
+	}
+
+	pinned := SignWHEPQuery(testWHEPURLSecret, "live", expires, "198.51.100.1")
+	pinned.Del("ip")
+	res := httptest.NewRecorder()
+	if _, ok := s.signedURLStreamKey(res, whepRequest(pinned, "192.0.2.1:1234", "", "")); ok || res.Code != http.StatusForbidden {
+		t.Errorf("URL without its address was accepted with %d", res.Code)
+	}
+}
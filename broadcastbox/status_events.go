@@ -0,0 +1,115 @@
+package broadcastbox
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	// How often the status is checked for changes, events update it right away
+	statusEventsInterval = time.Second
+
+	// A comment is sent this often without changes, so proxies don't close the connection
+	statusEventsKeepAlive = 15 * time.Second
+)
+
+// statusEventsHandler serves `/api/status/events`, the status API as Server-Sent Events. Every
+// stream is sent as a `stream` event on connect and again whenever its status changed,
+// `stream_removed` is sent once it is gone. `?streamKey=` only sends that stream.
+func (s *Server) statusEventsHandler(res http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		logHTTPError(res, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	streamKey := req.URL.Query().Get("streamKey")
+	if streamKey != "" && !validateStreamKey(streamKey) {
+		logHTTPError(res, "Invalid stream key format", http.StatusBadRequest)
+		return
+	}
+	setAccessLogStreamKey(req, streamKey)
+
+	res.Header().Set("Content-Type", "text/event-stream")
+	res.Header().Set("Cache-Control", "no-cache")
+	res.Header().Set("X-Accel-Buffering", "no")
+	res.WriteHeader(http.StatusOK)
+
+	controller := http.NewResponseController(res)
+	subscriber := s.liveEvents.subscribe(streamKey)
+	defer s.liveEvents.unsubscribe(subscriber)
+
+	ticker := time.NewTicker(statusEventsInterval)
+	defer ticker.Stop()
+
+	// The JSON of every stream as it was last sent
+	sent := map[string][]byte{}
+	lastWrite := time.Time{}
+	update := func() error {
+		streams := map[string][]byte{}
+		for _, status := range s.GetStreamStatuses() {
+			if streamKey != "" && status.StreamKey != streamKey {
+				continue
+			}
+
+			data, err := json.Marshal(status)
+			if err != nil {
+				return err
+			}
+			streams[status.StreamKey] = data
+		}
+
+		wrote := false
+		for key, data := range streams {
+			if bytes.Equal(sent[key], data) {
+				continue
+			}
+
+			if _, err := fmt.Fprintf(res, "event: stream\ndata: %s\n\n", data); err != nil {
+				return err
+			}
+			wrote = true
+		}
+		for key := range sent {
+			if _, ok := streams[key]; ok {
+				continue
+			}
+
+			data, err := json.Marshal(map[string]string{"streamKey": key})
+			if err != nil {
+				return err
+			}
+			if _, err = fmt.Fprintf(res, "event: stream_removed\ndata: %s\n\n", data); err != nil {
+				return err
+			}
+			wrote = true
+		}
+		sent = streams
+
+		if !wrote && time.Since(lastWrite) < statusEventsKeepAlive {
+			return nil
+		} else if !wrote {
+			if _, err := fmt.Fprint(res, ":\n\n"); err != nil {
+				return err
+			}
+		}
+
+		lastWrite = time.Now()
+		return controller.Flush()
+	}
+
+	for err := update(); err == nil; err = update() {
+		select {
+		case <-req.Context().Done():
+			return
+		case <-ticker.C:
+		case _, ok := <-subscriber.events:
+			// Closed once this fell behind, the client reconnects
+			if !ok {
+				return
+			}
+		}
+	}
+}
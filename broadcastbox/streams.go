@@ -0,0 +1,364 @@
+package broadcastbox
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/glimesh/broadcast-box/internal/audit"
+	"github.com/glimesh/broadcast-box/internal/capture"
+	"github.com/glimesh/broadcast-box/internal/webrtc"
+)
+
+// adminHandler only calls next for requests with adminToken as the Bearer token, or of an
+// operator signed in with OpenID Connect
+func (s *Server) adminHandler(adminToken string, next func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	return func(res http.ResponseWriter, req *http.Request) {
+		actor, ok := s.adminActor(req, adminToken)
+		if !ok {
+			s.auditLog.Record(audit.Entry{Action: audit.ActionAdminDenied, IP: s.clientIP(req), Details: map[string]string{"method": req.Method, "path": req.URL.Path}})
+			res.Header().Set("WWW-Authenticate", "Bearer")
+			logHTTPError(res, "Invalid admin token", http.StatusUnauthorized)
+			return
+		}
+
+		recorder := &statusRecorder{ResponseWriter: res}
+		next(recorder, req)
+		s.auditAdminRequest(req, actor, recorder.status)
+	}
+}
+
+// adminActor returns the operator req is from for the audit log, false if it has neither
+// adminToken as the Bearer token nor an OpenID Connect login
+func (s *Server) adminActor(req *http.Request, adminToken string) (string, bool) {
+	if s.adminLogin != nil {
+		if identity, ok := s.adminLogin.signedIn(req); ok {
+			return "oidc:" + identity.Email, true
+		}
+	}
+
+	token, ok := extractBearerToken(req.Header.Get("Authorization"))
+	if adminToken == "" || !ok || subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+		return "", false
+	}
+	return "admin_token", true
+}
+
+// streamsHandler serves `/api/streams/<stream key>/<action>`. The thumbnail is public unless
+// the stream is private, the operator actions require adminToken or an OpenID Connect login and are disabled without
+// either.
+func (s *Server) streamsHandler(adminToken string) func(w http.ResponseWriter, r *http.Request) {
+	admin := s.adminHandler(adminToken, s.streamsAdminHandler)
+
+	return func(res http.ResponseWriter, req *http.Request) {
+		streamKey, action, _ := strings.Cut(strings.TrimPrefix(req.URL.Path, "/api/streams/"), "/")
+		if !validateStreamKey(streamKey) {
+			logHTTPError(res, "Invalid stream key format", http.StatusBadRequest)
+			return
+		}
+		setAccessLogStreamKey(req, streamKey)
+
+		switch {
+		case action == "thumbnail":
+			if req.Method != http.MethodGet && req.Method != http.MethodHead {
+				logHTTPError(res, "Method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+
+			if s.authorizeViewer(res, req, streamKey) {
+				s.thumbnailHandler(res, req, streamKey)
+			}
+		case adminToken == "" && s.adminLogin == nil:
+			logHTTPError(res, "Not found", http.StatusNotFound)
+		default:
+			admin(res, req)
+		}
+	}
+}
+
+// streamsAdminHandler is the operator API, see adminHandler
+func (s *Server) streamsAdminHandler(res http.ResponseWriter, req *http.Request) {
+	streamKey, action, _ := strings.Cut(strings.TrimPrefix(req.URL.Path, "/api/streams/"), "/")
+
+	if action == "restream" || strings.HasPrefix(action, "restream/") {
+		if s.restreamDisabled {
+			logHTTPError(res, "Not found", http.StatusNotFound)
+			return
+		}
+
+		s.restreamHandler(res, req, streamKey, strings.TrimPrefix(strings.TrimPrefix(action, "restream"), "/"))
+		return
+	}
+
+	if whepSessionId, ok := strings.CutPrefix(action, "sessions/"); ok {
+		if req.Method != http.MethodDelete {
+			logHTTPError(res, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if err := s.DisconnectWHEPSession(streamKey, whepSessionId); errors.Is(err, webrtc.ErrWHEPSessionNotFound) {
+			logHTTPError(res, err.Error(), http.StatusNotFound)
+		} else if err != nil {
+			logHTTPError(res, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	switch action {
+	case "sessions":
+		if req.Method != http.MethodGet {
+			logHTTPError(res, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		sessions, err := s.GetWHEPSessionStats(streamKey)
+		if errors.Is(err, webrtc.ErrStreamNotFound) {
+			logHTTPError(res, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		res.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(res).Encode(sessions); err != nil {
+			logger.Warn("Failed to write response", "err", err)
+		}
+	case "viewers":
+		if req.Method != http.MethodGet {
+			logHTTPError(res, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		history, err := s.GetViewerHistory(streamKey)
+		if errors.Is(err, webrtc.ErrNoViewerHistory) {
+			logHTTPError(res, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		res.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(res).Encode(history); err != nil {
+			logger.Warn("Failed to write response", "err", err)
+		}
+	case "metadata":
+		if req.Method != http.MethodGet && req.Method != http.MethodPost {
+			logHTTPError(res, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		s.streamMetadataHandler(res, req, streamKey)
+	case "disconnect":
+		if req.Method != http.MethodPost {
+			logHTTPError(res, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if err := s.DisconnectPublisher(streamKey); errors.Is(err, webrtc.ErrStreamNotFound) {
+			logHTTPError(res, err.Error(), http.StatusNotFound)
+		} else if err != nil {
+			logHTTPError(res, err.Error(), http.StatusInternalServerError)
+		}
+	case "keyframe":
+		if req.Method != http.MethodPost {
+			logHTTPError(res, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		switch err := s.RequestKeyframe(streamKey); {
+		case errors.Is(err, webrtc.ErrStreamNotFound):
+			logHTTPError(res, err.Error(), http.StatusNotFound)
+		case errors.Is(err, webrtc.ErrKeyframeRequestLimited):
+			logHTTPError(res, err.Error(), http.StatusTooManyRequests)
+		case err != nil:
+			logHTTPError(res, err.Error(), http.StatusInternalServerError)
+		}
+	case "record/start", "record/stop":
+		if req.Method != http.MethodPost {
+			logHTTPError(res, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if err := s.SetStreamRecording(streamKey, action == "record/start"); errors.Is(err, webrtc.ErrStreamNotFound) {
+			logHTTPError(res, err.Error(), http.StatusNotFound)
+		} else if err != nil {
+			logHTTPError(res, err.Error(), http.StatusInternalServerError)
+		}
+	case "clip":
+		if req.Method != http.MethodPost {
+			logHTTPError(res, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		s.clipHandler(res, req, streamKey)
+	case "capture/start":
+		if req.Method != http.MethodPost {
+			logHTTPError(res, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		s.captureHandler(res, req, streamKey)
+	case "viewer-token":
+		if req.Method != http.MethodPost {
+			logHTTPError(res, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		s.oneTimeTokenHandler(res, req, streamKey)
+	case "capture/stop":
+		if req.Method != http.MethodPost {
+			logHTTPError(res, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if err := s.StopCapture(streamKey); errors.Is(err, webrtc.ErrNoCapture) {
+			logHTTPError(res, err.Error(), http.StatusNotFound)
+		} else if err != nil {
+			logHTTPError(res, err.Error(), http.StatusInternalServerError)
+		}
+	default:
+		logHTTPError(res, "Not found", http.StatusNotFound)
+	}
+}
+
+type clipRequestJSON struct {
+	// Seconds since the publisher started, negative ones are relative to now
+	Start float64 `json:"start"`
+	End   float64 `json:"end"`
+}
+
+// clipHandler responds with a clip of the buffered media of streamKey as a download
+func (s *Server) clipHandler(res http.ResponseWriter, req *http.Request, streamKey string) {
+	var r clipRequestJSON
+	if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+		logHTTPError(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	seconds := func(v float64) time.Duration { return time.Duration(v * float64(time.Second)) }
+	path, err := s.Clip(streamKey, seconds(r.Start), seconds(r.End))
+	if errors.Is(err, webrtc.ErrStreamNotFound) || errors.Is(err, webrtc.ErrClipUnavailable) {
+		logHTTPError(res, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		logHTTPError(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer func() {
+		if err := os.RemoveAll(filepath.Dir(path)); err != nil {
+			logger.Warn("Failed to remove clip", "path", path, "err", err)
+		}
+	}()
+
+	file, err := os.Open(path)
+	if err != nil {
+		logHTTPError(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		logHTTPError(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	name := filepath.Base(path)
+	res.Header().Set("Content-Type", recordingContentTypes[filepath.Ext(name)])
+	res.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	http.ServeContent(res, req, name, info.ModTime(), file)
+}
+
+type captureRequestJSON struct {
+	// Seconds to capture for, defaults to a minute
+	Duration float64        `json:"duration"`
+	Format   capture.Format `json:"format"`
+}
+
+type captureResponseJSON struct {
+	Path string `json:"path"`
+}
+
+// captureHandler starts a packet capture of streamKey and responds with the path of its file
+func (s *Server) captureHandler(res http.ResponseWriter, req *http.Request, streamKey string) {
+	r := captureRequestJSON{Format: capture.FormatPcap}
+	if err := json.NewDecoder(req.Body).Decode(&r); err != nil && !errors.Is(err, io.EOF) {
+		logHTTPError(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	path, err := s.StartCapture(streamKey, r.Format, time.Duration(r.Duration*float64(time.Second)))
+	if errors.Is(err, webrtc.ErrCaptureRunning) {
+		logHTTPError(res, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		logHTTPError(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	res.Header().Add("Content-Type", "application/json")
+	if err := json.NewEncoder(res).Encode(captureResponseJSON{Path: path}); err != nil {
+		logHTTPError(res, err.Error(), http.StatusBadRequest)
+	}
+}
+
+// thumbnailHandler responds with the latest keyframe of streamKey as a one frame video
+func (s *Server) thumbnailHandler(res http.ResponseWriter, req *http.Request, streamKey string) {
+	thumbnail, err := s.GetThumbnail(streamKey)
+	if errors.Is(err, webrtc.ErrStreamNotFound) || errors.Is(err, webrtc.ErrNoThumbnail) {
+		logHTTPError(res, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		logHTTPError(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	res.Header().Set("Content-Type", thumbnail.ContentType)
+	res.Header().Set("Cache-Control", "no-cache")
+	http.ServeContent(res, req, "", thumbnail.Captured, bytes.NewReader(thumbnail.Data))
+}
+
+type restreamRequestJSON struct {
+	URL  string `json:"url"`
+	Opus bool   `json:"opus"`
+}
+
+// restreamHandler lists and adds the restream targets of streamKey, and removes the one with id
+func (s *Server) restreamHandler(res http.ResponseWriter, req *http.Request, streamKey, id string) {
+	switch {
+	case req.Method == http.MethodGet && id == "":
+		res.Header().Add("Content-Type", "application/json")
+		if err := json.NewEncoder(res).Encode(s.RestreamTargets(streamKey)); err != nil {
+			logHTTPError(res, err.Error(), http.StatusBadRequest)
+		}
+	case req.Method == http.MethodPost && id == "":
+		var r restreamRequestJSON
+		if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+			logHTTPError(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		target, err := s.AddRestreamTarget(streamKey, r.URL, r.Opus)
+		if err != nil {
+			logHTTPError(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		res.Header().Add("Content-Type", "application/json")
+		res.WriteHeader(http.StatusCreated)
+		if err := json.NewEncoder(res).Encode(target); err != nil {
+			logger.Warn("Failed to write response", "err", err)
+		}
+	case req.Method == http.MethodDelete && id != "":
+		if err := s.RemoveRestreamTarget(streamKey, id); errors.Is(err, webrtc.ErrRestreamTargetNotFound) {
+			logHTTPError(res, err.Error(), http.StatusNotFound)
+		} else if err != nil {
+			logHTTPError(res, err.Error(), http.StatusBadRequest)
+		}
+	default:
+		logHTTPError(res, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
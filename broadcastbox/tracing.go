@@ -0,0 +1,36 @@
+package broadcastbox
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/glimesh/broadcast-box/internal/tracing"
+)
+
+// tracedHandler traces requests to next as name, which continues the trace of their
+// `traceparent` header. The span is in the request's context for next.
+func tracedHandler(name string, next func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	return func(res http.ResponseWriter, req *http.Request) {
+		ctx, span := tracing.StartServer(req, name)
+		if span == nil {
+			next(res, req)
+			return
+		}
+
+		recorder := &statusRecorder{ResponseWriter: res}
+		next(recorder, req.WithContext(ctx))
+
+		status := recorder.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		span.SetAttribute("http.response.status_code", strconv.Itoa(status))
+
+		if status >= http.StatusBadRequest {
+			span.End(errors.New(http.StatusText(status)))
+		} else {
+			span.End(nil)
+		}
+	}
+}
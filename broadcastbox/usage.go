@@ -0,0 +1,130 @@
+package broadcastbox
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/glimesh/broadcast-box/internal/usage"
+	"github.com/glimesh/broadcast-box/internal/webrtc"
+)
+
+// How often the usage of the streams is added to USAGE_DB_PATH, at most this much is lost on exit
+const usageMeterInterval = time.Minute
+
+// runUsageMeter adds the usage of the streams to usageStore every usageMeterInterval. Usage that
+// couldn't be written is tried again the next time.
+func (s *Server) runUsageMeter() {
+	ticker := time.NewTicker(usageMeterInterval)
+	defer ticker.Stop()
+
+	defer s.background.Done()
+
+	pending := map[string]webrtc.Usage{}
+	for {
+		var now time.Time
+		select {
+		case now = <-ticker.C:
+		case <-s.closed:
+			// The usage of streams the Server closed is written before the store is
+			now = time.Now()
+		}
+
+		for streamKey, u := range s.TakeUsage() {
+			p := pending[streamKey]
+			p.BytesIn += u.BytesIn
+			p.BytesOut += u.BytesOut
+			p.PublishSeconds += u.PublishSeconds
+			pending[streamKey] = p
+		}
+
+		for streamKey, u := range pending {
+			if err := s.usageStore.Add(streamKey, now, u.BytesIn, u.BytesOut, u.PublishSeconds); err != nil {
+				logger.Warn("Failed to write usage", "streamKey", streamKey, "err", err)
+				continue
+			}
+			delete(pending, streamKey)
+		}
+
+		select {
+		case <-s.closed:
+			return
+		default:
+		}
+	}
+}
+
+// usageHandler serves `/api/usage`, the usage of USAGE_DB_PATH from `?from=` to `?to=`. Stream
+// keys have their total unless `?daily=true`, `?streamKey=` only returns that one and
+// `?format=csv` downloads it as CSV.
+func (s *Server) usageHandler(res http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		logHTTPError(res, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := req.URL.Query()
+	now := time.Now().UTC()
+	from, to := query.Get("from"), query.Get("to")
+	if from == "" {
+		from = time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC).Format(usage.DateLayout)
+	}
+	if to == "" {
+		to = now.Format(usage.DateLayout)
+	}
+	for _, date := range []string{from, to} {
+		if _, err := time.Parse(usage.DateLayout, date); err != nil {
+			logHTTPError(res, "Dates must be YYYY-MM-DD", http.StatusBadRequest)
+			return
+		}
+	}
+
+	streamKey := query.Get("streamKey")
+	if streamKey != "" && !validateStreamKey(streamKey) {
+		logHTTPError(res, "Invalid stream key format", http.StatusBadRequest)
+		return
+	}
+	setAccessLogStreamKey(req, streamKey)
+
+	daily, _ := strconv.ParseBool(query.Get("daily"))
+	records, err := s.usageStore.Query(from, to, streamKey, daily)
+	if err != nil {
+		logHTTPError(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	switch query.Get("format") {
+	case "", "json":
+		res.Header().Set("Content-Type", "application/json")
+		if err = json.NewEncoder(res).Encode(records); err != nil {
+			logger.Warn("Failed to write response", "err", err)
+		}
+	case "csv":
+		res.Header().Set("Content-Type", "text/csv")
+		res.Header().Set("Content-Disposition", `attachment; filename="usage-`+from+`-`+to+`.csv"`)
+
+		w := csv.NewWriter(res)
+		w.Write([]string{"stream_key", "date", "bytes_in", "bytes_out", "publish_minutes"})
+		for _, r := range records {
+			date := r.Date
+			if date == "" {
+				date = from + "/" + to
+			}
+
+			w.Write([]string{
+				r.StreamKey,
+				date,
+				strconv.FormatUint(r.BytesIn, 10),
+				strconv.FormatUint(r.BytesOut, 10),
+				strconv.FormatFloat(r.PublishMinutes, 'f', 2, 64),
+			})
+		}
+		if w.Flush(); w.Error() != nil {
+			logger.Warn("Failed to write response", "err", w.Error())
+		}
+	default:
+		logHTTPError(res, "Format must be json or csv", http.StatusBadRequest)
+	}
+}
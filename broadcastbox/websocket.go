@@ -0,0 +1,324 @@
+package broadcastbox
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/glimesh/broadcast-box/internal/events"
+)
+
+const (
+	webSocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	webSocketOpcodeText  = 0x1
+	webSocketOpcodeClose = 0x8
+	webSocketOpcodePing  = 0x9
+	webSocketOpcodePong  = 0xA
+
+	// Clients aren't expected to send anything but control frames, larger ones close the socket
+	webSocketMaxFrameSize = 64 * 1024
+
+	webSocketPingInterval = 30 * time.Second
+	webSocketWriteTimeout = 10 * time.Second
+
+	// Events a subscriber may fall behind by before it is closed
+	liveEventsBufferSize = 64
+)
+
+type (
+	// liveEvents is the events.Publisher of `/api/ws` and `/api/status/events`, it hands every
+	// event to the connected clients
+	liveEvents struct {
+		lock        sync.Mutex
+		subscribers map[*liveEventsSubscriber]struct{}
+	}
+
+	// liveEventsSubscriber gets the events of streamKey, or all if it is empty. events is
+	// closed when it fell behind.
+	liveEventsSubscriber struct {
+		streamKey string
+		events    chan []byte
+	}
+)
+
+func (l *liveEvents) Publish(e events.Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	for subscriber := range l.subscribers {
+		if subscriber.streamKey != "" && subscriber.streamKey != e.StreamKey {
+			continue
+		}
+
+		select {
+		case subscriber.events <- data:
+		default:
+			close(subscriber.events)
+			delete(l.subscribers, subscriber)
+		}
+	}
+
+	return nil
+}
+
+func (l *liveEvents) subscribe(streamKey string) *liveEventsSubscriber {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.subscribers == nil {
+		l.subscribers = map[*liveEventsSubscriber]struct{}{}
+	}
+
+	subscriber := &liveEventsSubscriber{streamKey: streamKey, events: make(chan []byte, liveEventsBufferSize)}
+	l.subscribers[subscriber] = struct{}{}
+	return subscriber
+}
+
+func (l *liveEvents) unsubscribe(subscriber *liveEventsSubscriber) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if _, ok := l.subscribers[subscriber]; ok {
+		close(subscriber.events)
+		delete(l.subscribers, subscriber)
+	}
+}
+
+// liveEventsHandler guards `/api/ws` and `/api/status/events`. Operators get the events of every
+// stream, anyone else has to name a stream they may watch with `?streamKey=`, so they don't learn
+// the stream keys of others.
+func (s *Server) liveEventsHandler(next func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	admin := s.adminHandler(s.adminToken, next)
+
+	return func(res http.ResponseWriter, req *http.Request) {
+		streamKey := req.URL.Query().Get("streamKey")
+		if _, ok := s.adminActor(req, s.adminToken); ok || streamKey == "" {
+			admin(res, req)
+			return
+		} else if !validateStreamKey(streamKey) {
+			logHTTPError(res, "Invalid stream key format", http.StatusBadRequest)
+			return
+		}
+
+		if s.authorizeViewer(res, req, streamKey) {
+			next(res, req)
+		}
+	}
+}
+
+// webSocketEventsHandler serves `/api/ws`, a WebSocket that every event is sent to as a JSON
+// text message. `?streamKey=` only sends the events of that stream.
+func (s *Server) webSocketEventsHandler(res http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		logHTTPError(res, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	streamKey := req.URL.Query().Get("streamKey")
+	if streamKey != "" && !validateStreamKey(streamKey) {
+		logHTTPError(res, "Invalid stream key format", http.StatusBadRequest)
+		return
+	}
+	setAccessLogStreamKey(req, streamKey)
+
+	key := req.Header.Get("Sec-WebSocket-Key")
+	if !headerContainsToken(req.Header, "Connection", "upgrade") || !headerContainsToken(req.Header, "Upgrade", "websocket") || key == "" {
+		logHTTPError(res, "Expected a WebSocket upgrade", http.StatusBadRequest)
+		return
+	} else if req.Header.Get("Sec-WebSocket-Version") != "13" {
+		res.Header().Set("Sec-WebSocket-Version", "13")
+		logHTTPError(res, "Unsupported WebSocket version", http.StatusUpgradeRequired)
+		return
+	}
+
+	// Browsers don't apply CORS to WebSockets, so the origins of the API are checked here
+	if origin := req.Header.Get("Origin"); origin != "" && !sameOrigin(origin, req) && s.apiCORS.allowOrigin(origin) == "" {
+		logHTTPError(res, "Origin not allowed", http.StatusForbidden)
+		return
+	}
+
+	conn, rw, err := http.NewResponseController(res).Hijack()
+	if err != nil {
+		logHTTPError(res, "WebSockets need HTTP/1.1", http.StatusInternalServerError)
+		return
+	}
+	defer conn.Close()
+
+	if err = conn.SetDeadline(time.Time{}); err != nil {
+		return
+	}
+
+	accept := sha1.Sum([]byte(key + webSocketGUID))
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n", base64.StdEncoding.EncodeToString(accept[:]))
+	if err = rw.Flush(); err != nil {
+		return
+	}
+
+	subscriber := s.liveEvents.subscribe(streamKey)
+	defer s.liveEvents.unsubscribe(subscriber)
+
+	pongs, closed := make(chan []byte, 1), make(chan struct{})
+	go func() {
+		defer close(closed)
+		readWebSocket(rw.Reader, pongs)
+	}()
+
+	ticker := time.NewTicker(webSocketPingInterval)
+	defer ticker.Stop()
+
+	write := func(opcode byte, payload []byte) bool {
+		if err := conn.SetWriteDeadline(time.Now().Add(webSocketWriteTimeout)); err != nil {
+			return false
+		}
+
+		err := writeWebSocketFrame(conn, opcode, payload)
+		if err != nil && !errors.Is(err, net.ErrClosed) {
+			logger.Debug("Failed to write to WebSocket", "addr", conn.RemoteAddr(), "err", err)
+		}
+		return err == nil
+	}
+
+	for {
+		select {
+		case data, ok := <-subscriber.events:
+			if !ok {
+				// 1008, Policy Violation, for falling behind
+				write(webSocketOpcodeClose, append(binary.BigEndian.AppendUint16(nil, 1008), "too slow"...))
+				return
+			} else if !write(webSocketOpcodeText, data) {
+				return
+			}
+		case payload := <-pongs:
+			if !write(webSocketOpcodePong, payload) {
+				return
+			}
+		case <-ticker.C:
+			if !write(webSocketOpcodePing, nil) {
+				return
+			}
+		case <-closed:
+			write(webSocketOpcodeClose, nil)
+			return
+		}
+	}
+}
+
+// readWebSocket reads frames from the client until it closes the socket or an error, and
+// hands the payload of pings to pongs. Other messages are ignored.
+func readWebSocket(r *bufio.Reader, pongs chan<- []byte) {
+	for {
+		opcode, payload, err := readWebSocketFrame(r)
+		if err != nil {
+			return
+		}
+
+		switch opcode {
+		case webSocketOpcodeClose:
+			return
+		case webSocketOpcodePing:
+			select {
+			case pongs <- payload:
+			default:
+			}
+		}
+	}
+}
+
+// readWebSocketFrame reads one masked frame of a client
+func readWebSocketFrame(r *bufio.Reader) (byte, []byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+
+	opcode, masked, length := header[0]&0x0F, header[1]&0x80 != 0, uint64(header[1]&0x7F)
+	if !masked {
+		return 0, nil, errors.New("unmasked frame from client")
+	}
+
+	switch length {
+	case 126:
+		extended := make([]byte, 2)
+		if _, err := io.ReadFull(r, extended); err != nil {
+			return 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(extended))
+	case 127:
+		extended := make([]byte, 8)
+		if _, err := io.ReadFull(r, extended); err != nil {
+			return 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(extended)
+	}
+	if length > webSocketMaxFrameSize {
+		return 0, nil, fmt.Errorf("frame of %d bytes is too large", length)
+	}
+
+	mask := make([]byte, 4)
+	if _, err := io.ReadFull(r, mask); err != nil {
+		return 0, nil, err
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+
+	return opcode, payload, nil
+}
+
+// writeWebSocketFrame writes payload as a single unmasked frame, as servers send them
+func writeWebSocketFrame(w io.Writer, opcode byte, payload []byte) error {
+	frame := []byte{0x80 | opcode}
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, byte(len(payload)))
+	case len(payload) <= 0xFFFF:
+		frame = binary.BigEndian.AppendUint16(append(frame, 126), uint16(len(payload)))
+	default:
+		frame = binary.BigEndian.AppendUint64(append(frame, 127), uint64(len(payload)))
+	}
+
+	_, err := w.Write(append(frame, payload...))
+	return err
+}
+
+// sameOrigin returns if origin is the host req was sent to, like for a page Broadcast Box serves
+func sameOrigin(origin string, req *http.Request) bool {
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, req.Host)
+}
+
+// headerContainsToken returns if the comma separated values of header name contain token,
+// compared case insensitively
+func headerContainsToken(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, v := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(v), token) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/glimesh/broadcast-box/broadcastbox"
+	"github.com/glimesh/broadcast-box/internal/logging"
+	"github.com/glimesh/broadcast-box/internal/webrtc"
+)
+
+const ctlUsage = `Usage: broadcast-box ctl [-base url] [-token token] <command>, or bbctl <command>
+
+Commands:
+  streams                           List the streams with their publisher and viewers
+  sessions <stream key>             List the WHEP sessions of a stream
+  watch [-interval 2s] [stream key] Print the stats of the published streams until interrupted
+  kick <stream key> <session id>    Disconnect a WHEP session
+  disconnect <stream key>           Disconnect the publisher
+  keyframe <stream key>             Request a keyframe from the publisher
+  record start|stop <stream key>    Start or stop recording a stream
+`
+
+// ctlClient calls the operator API of a running Broadcast Box
+type ctlClient struct {
+	base   string
+	token  string
+	client *http.Client
+}
+
+// runCtl is `broadcast-box ctl [-base url] [-token token] <command>`, also run as `bbctl` when
+// the binary is linked under that name. It calls the operator API with ADMIN_TOKEN, so
+// operators don't have to put together curl commands.
+func runCtl(args []string) {
+	loadSubcommandEnv()
+
+	flags := flag.NewFlagSet("ctl", flag.ExitOnError)
+	base := flags.String("base", "http://localhost:8080", "URL of Broadcast Box")
+	token := flags.String("token", os.Getenv("ADMIN_TOKEN"), "Admin token, ADMIN_TOKEN by default")
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), ctlUsage, "\nFlags:\n")
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+
+	c := &ctlClient{base: strings.TrimSuffix(*base, "/"), token: *token, client: &http.Client{Timeout: 10 * time.Second}}
+	command, args := flags.Arg(0), flags.Args()
+	if len(args) > 0 {
+		args = args[1:]
+	}
+
+	var err error
+	switch {
+	case command == "streams" && len(args) == 0:
+		err = c.streams()
+	case command == "sessions" && len(args) == 1:
+		err = c.sessions(ctlStreamKey(args[0]))
+	case command == "watch":
+		err = c.watch(args)
+	case command == "kick" && len(args) == 2:
+		err = c.request(http.MethodDelete, "/api/streams/"+ctlStreamKey(args[0])+"/sessions/"+url.PathEscape(args[1]), nil)
+	case command == "disconnect" && len(args) == 1:
+		err = c.request(http.MethodPost, "/api/streams/"+ctlStreamKey(args[0])+"/disconnect", nil)
+	case command == "keyframe" && len(args) == 1:
+		err = c.request(http.MethodPost, "/api/streams/"+ctlStreamKey(args[0])+"/keyframe", nil)
+	case command == "record" && len(args) == 2 && (args[0] == "start" || args[0] == "stop"):
+		err = c.request(http.MethodPost, "/api/streams/"+ctlStreamKey(args[1])+"/record/"+args[0], nil)
+	default:
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	if err != nil {
+		logging.Fatal(logger, "Command failed", "command", command, "err", err)
+	}
+}
+
+// ctlStreamKey returns streamKey, and exits if it isn't valid
+func ctlStreamKey(streamKey string) string {
+	if !broadcastbox.ValidateStreamKey(streamKey) {
+		logging.Fatal(logger, "Invalid stream key", "streamKey", streamKey)
+	}
+
+	return streamKey
+}
+
+// request calls path and decodes the JSON response into result, unless it is nil
+func (c *ctlClient) request(method, path string, result any) error {
+	req, err := http.NewRequest(method, c.base+path, nil)
+	if err != nil {
+		return err
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("%s: %s", res.Status, strings.TrimSpace(string(body)))
+	} else if result == nil {
+		return nil
+	}
+
+	return json.NewDecoder(res.Body).Decode(result)
+}
+
+func (c *ctlClient) streams() error {
+	var statuses []webrtc.StreamStatus
+	if err := c.request(http.MethodGet, "/api/status", &statuses); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "STREAM KEY\tPUBLISHED\tVIEWERS\tVIDEO\tAUDIO\tRECORDING")
+	for _, status := range statuses {
+		published := "-"
+		if status.PublisherConnectedAt != nil {
+			published = (time.Duration(status.PublisherConnectedSeconds) * time.Second).String()
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%t\n", status.StreamKey, published, len(status.WHEPSessions), formatBitrate(videoBitrate(status)), formatBitrate(status.AudioBitrate), status.Recording)
+	}
+
+	return w.Flush()
+}
+
+func (c *ctlClient) sessions(streamKey string) error {
+	var sessions []webrtc.WHEPSessionStats
+	if err := c.request(http.MethodGet, "/api/streams/"+streamKey+"/sessions", &sessions); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tLAYER\tCONNECTED\tSTATE\tRTT\tLOSS\tSENT")
+	for _, session := range sessions {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%.1f%%\t%d MB\n",
+			session.ID,
+			session.CurrentLayer,
+			time.Since(session.ConnectedAt).Round(time.Second),
+			session.ConnectionState,
+			time.Duration(session.RoundTripTime*float64(time.Second)).Round(time.Millisecond/10),
+			session.FractionLost*100,
+			session.BytesSent/1000/1000,
+		)
+	}
+
+	return w.Flush()
+}
+
+// watch prints a line for every published stream, or the one in args, each interval
+func (c *ctlClient) watch(args []string) error {
+	flags := flag.NewFlagSet("watch", flag.ExitOnError)
+	interval := flags.Duration("interval", 2*time.Second, "How often the stats are printed")
+	_ = flags.Parse(args)
+
+	streamKey := flags.Arg(0)
+	if flags.NArg() > 1 {
+		fmt.Fprint(os.Stderr, ctlUsage)
+		os.Exit(2)
+	} else if streamKey != "" {
+		ctlStreamKey(streamKey)
+	}
+
+	for ; ; time.Sleep(*interval) {
+		var statuses []webrtc.StreamStatus
+		if err := c.request(http.MethodGet, "/api/status", &statuses); err != nil {
+			return err
+		}
+
+		now := time.Now().Format(time.TimeOnly)
+		for _, status := range statuses {
+			if status.PublisherConnectedAt == nil || (streamKey != "" && status.StreamKey != streamKey) {
+				continue
+			}
+
+			fmt.Printf("%s %s viewers=%d video=%s audio=%s\n", now, status.StreamKey, len(status.WHEPSessions), formatBitrate(videoBitrate(status)), formatBitrate(status.AudioBitrate))
+		}
+	}
+}
+
+func videoBitrate(status webrtc.StreamStatus) uint64 {
+	var bitrate uint64
+	for _, video := range status.VideoStreams {
+		bitrate += video.Bitrate
+	}
+
+	return bitrate
+}
+
+func formatBitrate(bitsPerSecond uint64) string {
+	return fmt.Sprintf("%d kbps", bitsPerSecond/1000)
+}
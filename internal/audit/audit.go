@@ -0,0 +1,80 @@
+// Package audit appends what publishers and operators did to a file of JSON lines, one Entry
+// each, which is only ever appended to.
+package audit
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/glimesh/broadcast-box/internal/logging"
+)
+
+var logger = logging.Logger("audit")
+
+const (
+	ActionPublish   = "publish"
+	ActionUnpublish = "unpublish"
+
+	// A request to the operator API that changes something, Details has its method, path and status
+	ActionAdminRequest = "admin_request"
+
+	// A request to the operator API without a valid ADMIN_TOKEN or login
+	ActionAdminDenied = "admin_denied"
+
+	// A publisher key was generated with `broadcast-box keygen`
+	ActionKeyGenerate = "key_generate"
+)
+
+type (
+	Entry struct {
+		Time      time.Time         `json:"time"`
+		Action    string            `json:"action"`
+		Actor     string            `json:"actor,omitempty"`
+		IP        string            `json:"ip,omitempty"`
+		StreamKey string            `json:"streamKey,omitempty"`
+		Details   map[string]string `json:"details,omitempty"`
+	}
+
+	Log struct {
+		lock sync.Mutex
+		file *os.File
+	}
+)
+
+// Open opens the log at path for appending, it is created if it doesn't exist
+func Open(path string) (*Log, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Log{file: file}, nil
+}
+
+// Record appends e with the current time, a nil Log records nothing
+func (l *Log) Record(e Entry) {
+	if l == nil {
+		return
+	}
+
+	e.Time = time.Now().UTC()
+	line, err := json.Marshal(e)
+	if err != nil {
+		logger.Error("Failed to encode audit log entry", "action", e.Action, "err", err)
+		return
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	// A single write of the whole line, so concurrent writers can't interleave
+	if _, err = l.file.Write(append(line, '\n')); err != nil {
+		logger.Error("Failed to write audit log", "err", err)
+	}
+}
+
+func (l *Log) Close() error {
+	return l.file.Close()
+}
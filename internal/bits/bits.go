@@ -0,0 +1,76 @@
+// Package bits reads the bit fields of codec headers, like the H264 SPS and the VP9
+// uncompressed header.
+package bits
+
+import "errors"
+
+// ErrExhausted is the error of a Reader that was read past the end of its data
+var ErrExhausted = errors.New("read past the end of the data")
+
+var errExpGolombTooLong = errors.New("Exp-Golomb code longer than 32 bits")
+
+// Reader reads big endian bit fields. Once a read fails every read after it returns 0, so a
+// header can be read field by field and Err checked at the end.
+type Reader struct {
+	data []byte
+	bit  int
+	err  error
+}
+
+func NewReader(data []byte) *Reader {
+	return &Reader{data: data}
+}
+
+// Err returns the first error of a read, nil if all of them succeeded
+func (r *Reader) Err() error {
+	return r.err
+}
+
+func (r *Reader) ReadBit() uint {
+	if r.err != nil {
+		return 0
+	} else if r.bit >= len(r.data)*8 {
+		r.err = ErrExhausted
+		return 0
+	}
+
+	bit := r.data[r.bit/8] >> (7 - r.bit%8) & 1
+	r.bit++
+	return uint(bit)
+}
+
+func (r *Reader) ReadBits(n int) uint {
+	v := uint(0)
+	for ; n > 0; n-- {
+		v = v<<1 | r.ReadBit()
+	}
+	return v
+}
+
+// ReadUE reads an Exp-Golomb coded unsigned integer, see ITU-T H.264 section 9.1
+func (r *Reader) ReadUE() uint {
+	leadingZeros := 0
+	for r.ReadBit() == 0 {
+		if r.err != nil {
+			return 0
+		} else if leadingZeros++; leadingZeros > 31 {
+			r.err = errExpGolombTooLong
+			return 0
+		}
+	}
+
+	v := 1<<leadingZeros - 1 + r.ReadBits(leadingZeros)
+	if r.err != nil {
+		return 0
+	}
+	return v
+}
+
+// ReadSE reads an Exp-Golomb coded signed integer
+func (r *Reader) ReadSE() int {
+	v := r.ReadUE()
+	if v%2 == 0 {
+		return -int(v / 2)
+	}
+	return int(v+1) / 2
+}
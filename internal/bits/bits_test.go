@@ -0,0 +1,53 @@
+package bits
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestReader(t *testing.T) {
+	// 1, 010, 011, 00100 and 00101 are 0, 1, 2, 3 and 4, followed by the bits 101
+	r := NewReader([]byte{0xa6, 0x42, 0xd0})
+	for expect := uint(0); expect <= 4; expect++ {
+		if v := r.ReadUE(); v != expect {
+			t.Fatalf("read %d instead of %d", v, expect)
+		}
+	}
+	if v := r.ReadBits(3); v != 0b101 {
+		t.Fatalf("read %03b instead of 101", v)
+	} else if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if v := r.ReadBits(5); v != 0 {
+		t.Fatalf("read %d past the end of the data", v)
+	} else if !errors.Is(r.Err(), ErrExhausted) {
+		t.Fatalf("reading past the end returned %v", r.Err())
+	}
+}
+
+func TestReadSE(t *testing.T) {
+	// 1, 010, 011, 00100 and 00101 are 0, 1, -1, 2 and -2
+	r := NewReader([]byte{0xa6, 0x42, 0x80})
+	for _, expect := range []int{0, 1, -1, 2, -2} {
+		if v := r.ReadSE(); v != expect {
+			t.Fatalf("read %d instead of %d", v, expect)
+		}
+	}
+}
+
+func TestReadUEExhausted(t *testing.T) {
+	for _, data := range [][]byte{
+		// Leading zeros run past the end
+		{0x00},
+		// Value bits run past the end
+		{0x01},
+		// More than 31 leading zeros
+		{0x00, 0x00, 0x00, 0x00, 0x80, 0xff, 0xff, 0xff, 0xff},
+	} {
+		r := NewReader(data)
+		if v := r.ReadUE(); v != 0 || r.Err() == nil {
+			t.Fatalf("%x was read as %d with error %v", data, v, r.Err())
+		}
+	}
+}
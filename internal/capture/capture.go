@@ -0,0 +1,196 @@
+// Package capture writes RTP and RTCP packets to pcap or rtpdump files, so what a PeerConnection
+// sent and received can be looked at in Wireshark or replayed with rtpplay.
+package capture
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"os"
+	"time"
+)
+
+// Format of a capture file
+type Format string
+
+const (
+	// FormatPcap has every packet as IPv4 UDP with its source and destination
+	FormatPcap Format = "pcap"
+
+	// FormatRTPDump is the rtptools format, it has no addresses so it should only get the packets
+	// of one sender
+	FormatRTPDump Format = "rtpdump"
+)
+
+const (
+	pcapMagic      = 0xA1B2C3D4
+	pcapLinkRaw    = 101
+	pcapSnapLength = 65535
+
+	ipv4HeaderSize = 20
+	udpHeaderSize  = 8
+	ipProtocolUDP  = 17
+	ipDefaultTTL   = 64
+
+	rtpdumpPacketHeaderSize = 8
+)
+
+// Packet is an RTP or RTCP packet and where it went
+type Packet struct {
+	Time     time.Time
+	Src, Dst netip.AddrPort
+	RTCP     bool
+	Data     []byte
+}
+
+// Writer writes Packets to a file in a Format
+type Writer struct {
+	file   *os.File
+	w      *bufio.Writer
+	format Format
+
+	// Time of the first packet, rtpdump offsets are relative to it
+	start time.Time
+}
+
+// Create creates the capture file at path, the pcap header is written right away and the
+// rtpdump one with the first packet
+func Create(path string, format Format) (*Writer, error) {
+	if format != FormatPcap && format != FormatRTPDump {
+		return nil, fmt.Errorf("unknown capture format %q", format)
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &Writer{file: file, w: bufio.NewWriter(file), format: format}
+	if format == FormatPcap {
+		header := make([]byte, 24)
+		binary.LittleEndian.PutUint32(header[0:], pcapMagic)
+		binary.LittleEndian.PutUint16(header[4:], 2)
+		binary.LittleEndian.PutUint16(header[6:], 4)
+		binary.LittleEndian.PutUint32(header[16:], pcapSnapLength)
+		binary.LittleEndian.PutUint32(header[20:], pcapLinkRaw)
+		if _, err := w.w.Write(header); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+
+	return w, nil
+}
+
+// Format returns the Format of the file
+func (w *Writer) Format() Format {
+	return w.format
+}
+
+// Write appends p to the file
+func (w *Writer) Write(p Packet) error {
+	if w.format == FormatPcap {
+		return w.writePcap(p)
+	}
+	return w.writeRTPDump(p)
+}
+
+func (w *Writer) writePcap(p Packet) error {
+	if !p.Src.Addr().Is4() || !p.Dst.Addr().Is4() {
+		return fmt.Errorf("pcap captures only have IPv4 addresses, got %s and %s", p.Src, p.Dst)
+	}
+
+	length := ipv4HeaderSize + udpHeaderSize + len(p.Data)
+	if length > pcapSnapLength {
+		return fmt.Errorf("packet of %d bytes is too large to capture", len(p.Data))
+	}
+
+	b := make([]byte, 16+ipv4HeaderSize+udpHeaderSize)
+	binary.LittleEndian.PutUint32(b[0:], uint32(p.Time.Unix()))
+	binary.LittleEndian.PutUint32(b[4:], uint32(p.Time.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(b[8:], uint32(length))
+	binary.LittleEndian.PutUint32(b[12:], uint32(length))
+
+	ip := b[16:]
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:], uint16(length))
+	ip[8] = ipDefaultTTL
+	ip[9] = ipProtocolUDP
+	src, dst := p.Src.Addr().As4(), p.Dst.Addr().As4()
+	copy(ip[12:], src[:])
+	copy(ip[16:], dst[:])
+	binary.BigEndian.PutUint16(ip[10:], ipv4Checksum(ip[:ipv4HeaderSize]))
+
+	// The UDP checksum is optional over IPv4 and left out
+	udp := ip[ipv4HeaderSize:]
+	binary.BigEndian.PutUint16(udp[0:], p.Src.Port())
+	binary.BigEndian.PutUint16(udp[2:], p.Dst.Port())
+	binary.BigEndian.PutUint16(udp[4:], uint16(udpHeaderSize+len(p.Data)))
+
+	if _, err := w.w.Write(b); err != nil {
+		return err
+	}
+	_, err := w.w.Write(p.Data)
+	return err
+}
+
+func ipv4Checksum(header []byte) uint16 {
+	sum := uint32(0)
+	for i := 0; i < len(header); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(header[i:]))
+	}
+	for sum > 0xFFFF {
+		sum = sum>>16 + sum&0xFFFF
+	}
+	return ^uint16(sum)
+}
+
+func (w *Writer) writeRTPDump(p Packet) error {
+	if w.start.IsZero() {
+		w.start = p.Time
+		if _, err := fmt.Fprintf(w.w, "#!rtpplay1.0 %s/%d\n", p.Src.Addr(), p.Src.Port()); err != nil {
+			return err
+		}
+
+		header := make([]byte, 16)
+		binary.BigEndian.PutUint32(header[0:], uint32(p.Time.Unix()))
+		binary.BigEndian.PutUint32(header[4:], uint32(p.Time.Nanosecond()/1000))
+		if p.Src.Addr().Is4() {
+			src := p.Src.Addr().As4()
+			copy(header[8:], src[:])
+		}
+		binary.BigEndian.PutUint16(header[12:], p.Src.Port())
+		if _, err := w.w.Write(header); err != nil {
+			return err
+		}
+	}
+
+	length := rtpdumpPacketHeaderSize + len(p.Data)
+	if length > 0xFFFF {
+		return fmt.Errorf("packet of %d bytes is too large to capture", len(p.Data))
+	}
+
+	// The length of the RTP packet is 0 for RTCP
+	header := make([]byte, rtpdumpPacketHeaderSize)
+	binary.BigEndian.PutUint16(header[0:], uint16(length))
+	if !p.RTCP {
+		binary.BigEndian.PutUint16(header[2:], uint16(len(p.Data)))
+	}
+	binary.BigEndian.PutUint32(header[4:], uint32(p.Time.Sub(w.start).Milliseconds()))
+
+	if _, err := w.w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.w.Write(p.Data)
+	return err
+}
+
+// Close flushes and closes the file
+func (w *Writer) Close() error {
+	err := w.w.Flush()
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
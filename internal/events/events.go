@@ -0,0 +1,229 @@
+package events
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/glimesh/broadcast-box/internal/logging"
+)
+
+var logger = logging.Logger("events")
+
+const (
+	TypePublishStart = "publish_start"
+	TypePublishStop  = "publish_stop"
+	TypeViewerJoin   = "viewer_join"
+	TypeViewerLeave  = "viewer_leave"
+
+	// A stream got its first WHEP session, or its last one left
+	TypeFirstViewer = "first_viewer"
+	TypeNoViewers   = "no_viewers"
+
+	// Sent for every published stream each EVENTS_STATS_INTERVAL, Stats is set for it
+	TypeStreamStats = "stream_stats"
+
+	// A viewer switched to another simulcast layer, Layer is set to its encoding ID
+	TypeLayerChange = "layer_change"
+
+	// A WHEP offer was rejected because its credential has MAX_SESSIONS_PER_CREDENTIAL sessions
+	TypeSessionLimitReached = "session_limit_reached"
+
+	// A recording file was started, finalized because the next one was started, or finalized
+	// because the recording ended. Recording is set for them.
+	TypeRecordingStart    = "recording_start"
+	TypeRecordingRotate   = "recording_rotate"
+	TypeRecordingComplete = "recording_complete"
+
+	publisherBufferSize = 256
+)
+
+type (
+	Event struct {
+		Type          string            `json:"type"`
+		Time          time.Time         `json:"time"`
+		StreamKey     string            `json:"streamKey"`
+		WHEPSessionID string            `json:"whepSessionId,omitempty"`
+		Layer         string            `json:"layer,omitempty"`
+		Metadata      map[string]string `json:"metadata,omitempty"`
+		Recording     *Recording        `json:"recording,omitempty"`
+		Stats         *Stats            `json:"stats,omitempty"`
+	}
+
+	// Stats is what a stream is sending and to how many viewers, bitrates are in bits per second
+	Stats struct {
+		Viewers          int     `json:"viewers"`
+		VideoBitrate     uint64  `json:"videoBitrate"`
+		AudioBitrate     uint64  `json:"audioBitrate"`
+		PublishedSeconds float64 `json:"publishedSeconds"`
+	}
+
+	// Recording is the file of a recording event, Duration and Size are set once it is finalized
+	Recording struct {
+		Path     string  `json:"path"`
+		Duration float64 `json:"duration,omitempty"` // Seconds
+		Size     int64   `json:"size,omitempty"`
+	}
+
+	// Publisher delivers events to an external system. Publish is never called
+	// concurrently for the same Publisher.
+	Publisher interface {
+		Publish(Event) error
+	}
+
+	bufferedPublisher struct {
+		publisher Publisher
+		events    chan Event
+	}
+
+	// Bus delivers the events of one Server to its Publishers
+	Bus struct {
+		lock       sync.RWMutex
+		publishers []*bufferedPublisher
+		closed     bool
+		delivering sync.WaitGroup
+		dropped    atomic.Uint64
+	}
+)
+
+// PublishersFromEnv returns the Publishers enabled via environment variables
+func PublishersFromEnv() ([]Publisher, error) {
+	publishers := []Publisher{}
+
+	if natsURL := os.Getenv("EVENTS_NATS_URL"); natsURL != "" {
+		subject := os.Getenv("EVENTS_NATS_SUBJECT")
+		if subject == "" {
+			subject = "broadcast-box.events"
+		}
+
+		n, err := newNATSPublisher(natsURL, subject)
+		if err != nil {
+			return nil, err
+		}
+
+		publishers = append(publishers, n)
+	}
+
+	if mqttURL := os.Getenv("EVENTS_MQTT_URL"); mqttURL != "" {
+		topic := os.Getenv("EVENTS_MQTT_TOPIC")
+		if topic == "" {
+			topic = "broadcast-box/events"
+		}
+
+		m, err := newMQTTPublisher(mqttURL, topic)
+		if err != nil {
+			return nil, err
+		}
+
+		publishers = append(publishers, m)
+	}
+
+	if webhookURL := os.Getenv("EVENTS_WEBHOOK_URL"); webhookURL != "" {
+		var types []string
+		if webhookEvents := os.Getenv("EVENTS_WEBHOOK_EVENTS"); webhookEvents != "" {
+			types = strings.Split(webhookEvents, "|")
+		}
+
+		retries := defaultWebhookRetries
+		if webhookRetries := os.Getenv("EVENTS_WEBHOOK_RETRIES"); webhookRetries != "" {
+			var err error
+			if retries, err = strconv.Atoi(webhookRetries); err != nil {
+				return nil, fmt.Errorf("EVENTS_WEBHOOK_RETRIES: %w", err)
+			} else if retries < 0 {
+				return nil, fmt.Errorf("EVENTS_WEBHOOK_RETRIES: must not be negative")
+			}
+		}
+
+		w, err := newWebhookPublisher(webhookURL, os.Getenv("EVENTS_WEBHOOK_SECRET"), types, retries)
+		if err != nil {
+			return nil, err
+		}
+
+		publishers = append(publishers, w)
+	}
+
+	return publishers, nil
+}
+
+// NewBus returns a Bus delivering to publishers, more can be added with Register
+func NewBus(publishers ...Publisher) *Bus {
+	b := &Bus{}
+	for _, p := range publishers {
+		b.Register(p)
+	}
+
+	return b
+}
+
+// Register starts delivering events to p, from the next one that is emitted
+func (b *Bus) Register(p Publisher) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.closed {
+		return
+	}
+
+	bp := &bufferedPublisher{publisher: p, events: make(chan Event, publisherBufferSize)}
+	b.publishers = append(b.publishers, bp)
+
+	b.delivering.Add(1)
+	go func() {
+		defer b.delivering.Done()
+
+		for e := range bp.events {
+			if err := bp.publisher.Publish(e); err != nil {
+				logger.Warn("Failed to publish event", "type", e.Type, "streamKey", e.StreamKey, "err", err)
+			}
+		}
+	}()
+}
+
+// Emit queues e for every Publisher. If a Publisher is falling behind the event
+// is dropped instead of blocking the caller.
+func (b *Bus) Emit(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	if b.closed {
+		return
+	}
+
+	for _, bp := range b.publishers {
+		select {
+		case bp.events <- e:
+		default:
+			if count := b.dropped.Add(1); count%100 == 1 {
+				logger.Warn("Event publisher is falling behind, events dropped", "dropped", count)
+			}
+		}
+	}
+}
+
+// Close delivers the events that are queued and stops the Publishers from getting more, events
+// emitted afterwards are dropped
+func (b *Bus) Close() {
+	b.lock.Lock()
+	if !b.closed {
+		b.closed = true
+		for _, bp := range b.publishers {
+			close(bp.events)
+		}
+	}
+	b.lock.Unlock()
+
+	b.delivering.Wait()
+}
+
+// Dropped returns how many events were not delivered because a Publisher was full
+func (b *Bus) Dropped() uint64 {
+	return b.dropped.Load()
+}
@@ -0,0 +1,58 @@
+package events
+
+import (
+	"testing"
+	"time"
+)
+
+type testPublisher chan Event
+
+func (p testPublisher) Publish(e Event) error {
+	p <- e
+	return nil
+}
+
+func TestBus(t *testing.T) {
+	first, second := make(testPublisher, 8), make(testPublisher, 8)
+	b := NewBus(first)
+	b.Register(second)
+
+	b.Emit(Event{Type: TypePublishStart, StreamKey: "live"})
+	for _, p := range []testPublisher{first, second} {
+		select {
+		case e := <-p:
+			if e.Type != TypePublishStart || e.StreamKey != "live" || e.Time.IsZero() {
+				t.Fatalf("got event %+v", e)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("event wasn't delivered")
+		}
+	}
+
+	// Close delivers what was queued before it returns
+	b.Emit(Event{Type: TypePublishStop, StreamKey: "live"})
+	b.Close()
+	if len(first) != 1 || len(second) != 1 {
+		t.Fatalf("Close returned with %d and %d events delivered", len(first), len(second))
+	}
+
+	b.Emit(Event{Type: TypePublishStart, StreamKey: "live"})
+	b.Register(make(testPublisher))
+	b.Close()
+	if len(first) != 1 || len(second) != 1 {
+		t.Fatal("event emitted after Close was delivered")
+	}
+}
+
+func TestBusesAreSeparate(t *testing.T) {
+	first, second := make(testPublisher, 8), make(testPublisher, 8)
+	firstBus, secondBus := NewBus(first), NewBus(second)
+
+	firstBus.Emit(Event{Type: TypePublishStart, StreamKey: "first"})
+	firstBus.Close()
+	secondBus.Close()
+
+	if len(first) != 1 || len(second) != 0 {
+		t.Fatalf("buses delivered %d and %d events", len(first), len(second))
+	}
+}
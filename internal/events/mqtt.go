@@ -0,0 +1,258 @@
+package events
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	mqttDialTimeout = 5 * time.Second
+
+	// The broker drops the connection after one and a half of these without a packet
+	mqttKeepAlive = 60 * time.Second
+
+	mqttPacketConnect = 0x10
+	mqttPacketConnAck = 0x20
+	mqttPacketPublish = 0x30
+	mqttPacketPingReq = 0xC0
+
+	mqttProtocolLevel = 4 // MQTT 3.1.1
+
+	mqttFlagCleanSession = 0x02
+	mqttFlagPassword     = 0x40
+	mqttFlagUsername     = 0x80
+)
+
+var mqttConnectReturnCodes = map[byte]string{
+	1: "unacceptable protocol version",
+	2: "client identifier rejected",
+	3: "server unavailable",
+	4: "bad user name or password",
+	5: "not authorized",
+}
+
+// mqttPublisher speaks just enough of MQTT 3.1.1 to publish events with QoS 0, over TLS for
+// `mqtts://` URLs. It reconnects on the next event after a failure.
+type mqttPublisher struct {
+	url      *url.URL
+	topic    string
+	clientID string
+
+	connLock sync.Mutex
+	conn     net.Conn
+}
+
+func newMQTTPublisher(rawURL, topic string) (*mqttPublisher, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "mqtt", "tcp":
+		if u.Port() == "" {
+			u.Host = net.JoinHostPort(u.Hostname(), "1883")
+		}
+	case "mqtts", "ssl":
+		if u.Port() == "" {
+			u.Host = net.JoinHostPort(u.Hostname(), "8883")
+		}
+	default:
+		return nil, fmt.Errorf("MQTT URL %q must be an mqtt or mqtts URL", rawURL)
+	}
+
+	return &mqttPublisher{url: u, topic: topic, clientID: "broadcast-box-" + uuid.New().String()[:8]}, nil
+}
+
+func (m *mqttPublisher) connect() error {
+	dialer := &net.Dialer{Timeout: mqttDialTimeout}
+	var (
+		conn net.Conn
+		err  error
+	)
+	if m.url.Scheme == "mqtts" || m.url.Scheme == "ssl" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", m.url.Host, &tls.Config{ServerName: m.url.Hostname()})
+	} else {
+		conn, err = dialer.Dial("tcp", m.url.Host)
+	}
+	if err != nil {
+		return err
+	}
+
+	flags := byte(mqttFlagCleanSession)
+	payload := mqttString(nil, m.clientID)
+	if m.url.User != nil {
+		flags |= mqttFlagUsername
+		payload = mqttString(payload, m.url.User.Username())
+		if password, ok := m.url.User.Password(); ok {
+			flags |= mqttFlagPassword
+			payload = mqttString(payload, password)
+		}
+	}
+
+	variableHeader := append(mqttString(nil, "MQTT"), mqttProtocolLevel, flags)
+	variableHeader = binary.BigEndian.AppendUint16(variableHeader, uint16(mqttKeepAlive/time.Second))
+	if _, err = conn.Write(mqttPacket(mqttPacketConnect, append(variableHeader, payload...))); err != nil {
+		conn.Close()
+		return err
+	}
+
+	reader := bufio.NewReader(conn)
+	if err = conn.SetReadDeadline(time.Now().Add(mqttDialTimeout)); err != nil {
+		conn.Close()
+		return err
+	}
+
+	packetType, body, err := readMQTTPacket(reader)
+	if err != nil {
+		conn.Close()
+		return err
+	} else if packetType != mqttPacketConnAck || len(body) != 2 {
+		conn.Close()
+		return fmt.Errorf("unexpected MQTT packet 0x%02x instead of CONNACK", packetType)
+	} else if body[1] != 0 {
+		conn.Close()
+		return fmt.Errorf("MQTT broker refused connection: %s", mqttConnectReturnCodes[body[1]])
+	}
+
+	if err = conn.SetReadDeadline(time.Time{}); err != nil {
+		conn.Close()
+		return err
+	}
+
+	m.conn = conn
+	go m.readLoop(conn, reader)
+	go m.keepAlive(conn)
+	return nil
+}
+
+// readLoop reads the PINGRESPs, the connection is closed once the broker closes it
+func (m *mqttPublisher) readLoop(conn net.Conn, reader *bufio.Reader) {
+	for {
+		if _, _, err := readMQTTPacket(reader); err != nil {
+			m.closeConn(conn)
+			return
+		}
+	}
+}
+
+// keepAlive sends a PINGREQ within every mqttKeepAlive until conn is closed
+func (m *mqttPublisher) keepAlive(conn net.Conn) {
+	ticker := time.NewTicker(mqttKeepAlive / 2)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		m.connLock.Lock()
+		if m.conn != conn {
+			m.connLock.Unlock()
+			return
+		}
+
+		_, err := conn.Write(mqttPacket(mqttPacketPingReq, nil))
+		m.connLock.Unlock()
+		if err != nil {
+			m.closeConn(conn)
+			return
+		}
+	}
+}
+
+func (m *mqttPublisher) closeConn(conn net.Conn) {
+	m.connLock.Lock()
+	defer m.connLock.Unlock()
+
+	conn.Close()
+	if m.conn == conn {
+		m.conn = nil
+	}
+}
+
+func (m *mqttPublisher) Publish(e Event) error {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	m.connLock.Lock()
+	defer m.connLock.Unlock()
+
+	if m.conn == nil {
+		if err = m.connect(); err != nil {
+			return err
+		}
+	}
+
+	if _, err = m.conn.Write(mqttPacket(mqttPacketPublish, append(mqttString(nil, m.topic), payload...))); err != nil {
+		m.conn.Close()
+		m.conn = nil
+	}
+
+	return err
+}
+
+// mqttPacket returns a packet of packetType with body, prefixed by its remaining length
+func mqttPacket(packetType byte, body []byte) []byte {
+	packet := []byte{packetType}
+	length := len(body)
+	for {
+		b := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			b |= 0x80
+		}
+		packet = append(packet, b)
+
+		if length == 0 {
+			break
+		}
+	}
+
+	return append(packet, body...)
+}
+
+// readMQTTPacket returns the type of the next packet, without its flags, and its body
+func readMQTTPacket(reader *bufio.Reader) (byte, []byte, error) {
+	packetType, err := reader.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	length, multiplier := 0, 1
+	for i := 0; ; i++ {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		} else if i == 4 {
+			return 0, nil, errors.New("malformed MQTT remaining length")
+		}
+
+		length += int(b&0x7F) * multiplier
+		multiplier *= 128
+		if b&0x80 == 0 {
+			break
+		}
+	}
+
+	body := make([]byte, length)
+	if _, err = io.ReadFull(reader, body); err != nil {
+		return 0, nil, err
+	}
+
+	return packetType & 0xF0, body, nil
+}
+
+// mqttString appends s with its length, as strings are encoded in MQTT
+func mqttString(b []byte, s string) []byte {
+	return append(binary.BigEndian.AppendUint16(b, uint16(len(s))), s...)
+}
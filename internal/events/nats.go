@@ -0,0 +1,142 @@
+package events
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const natsDialTimeout = 5 * time.Second
+
+// natsPublisher speaks just enough of the NATS client protocol to publish
+// events. It reconnects on the next event after a failure.
+type natsPublisher struct {
+	url     *url.URL
+	subject string
+
+	connLock sync.Mutex
+	conn     net.Conn
+}
+
+func newNATSPublisher(rawURL, subject string) (*natsPublisher, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Port() == "" {
+		u.Host = net.JoinHostPort(u.Hostname(), "4222")
+	}
+
+	return &natsPublisher{url: u, subject: subject}, nil
+}
+
+func (n *natsPublisher) connect() error {
+	conn, err := net.DialTimeout("tcp", n.url.Host, natsDialTimeout)
+	if err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(conn)
+	if err = conn.SetReadDeadline(time.Now().Add(natsDialTimeout)); err != nil {
+		conn.Close()
+		return err
+	}
+
+	info, err := reader.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return err
+	} else if !strings.HasPrefix(info, "INFO") {
+		conn.Close()
+		return fmt.Errorf("unexpected NATS greeting `%s`", strings.TrimSpace(info))
+	}
+
+	if err = conn.SetReadDeadline(time.Time{}); err != nil {
+		conn.Close()
+		return err
+	}
+
+	connectOptions := map[string]any{"verbose": false, "pedantic": false, "name": "broadcast-box"}
+	if n.url.User != nil {
+		connectOptions["user"] = n.url.User.Username()
+		connectOptions["pass"], _ = n.url.User.Password()
+	}
+
+	connectJSON, err := json.Marshal(connectOptions)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	if _, err = fmt.Fprintf(conn, "CONNECT %s\r\n", connectJSON); err != nil {
+		conn.Close()
+		return err
+	}
+
+	n.conn = conn
+	go n.readLoop(conn, reader)
+	return nil
+}
+
+// readLoop answers server PINGs so the connection isn't considered stale
+func (n *natsPublisher) readLoop(conn net.Conn, reader *bufio.Reader) {
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			n.closeConn(conn)
+			return
+		}
+
+		if strings.HasPrefix(line, "PING") {
+			n.connLock.Lock()
+			_, err = conn.Write([]byte("PONG\r\n"))
+			n.connLock.Unlock()
+		} else if strings.HasPrefix(line, "-ERR") {
+			err = fmt.Errorf("NATS error %s", strings.TrimSpace(line))
+		}
+
+		if err != nil {
+			n.closeConn(conn)
+			return
+		}
+	}
+}
+
+func (n *natsPublisher) closeConn(conn net.Conn) {
+	n.connLock.Lock()
+	defer n.connLock.Unlock()
+
+	conn.Close()
+	if n.conn == conn {
+		n.conn = nil
+	}
+}
+
+func (n *natsPublisher) Publish(e Event) error {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	n.connLock.Lock()
+	defer n.connLock.Unlock()
+
+	if n.conn == nil {
+		if err = n.connect(); err != nil {
+			return err
+		}
+	}
+
+	if _, err = fmt.Fprintf(n.conn, "PUB %s %d\r\n%s\r\n", n.subject, len(payload), payload); err != nil {
+		n.conn.Close()
+		n.conn = nil
+	}
+
+	return err
+}
@@ -0,0 +1,117 @@
+package events
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	webhookTimeout = 10 * time.Second
+
+	// Header with the HMAC-SHA256 of the body, keyed with EVENTS_WEBHOOK_SECRET
+	webhookSignatureHeader = "X-Broadcast-Box-Signature"
+
+	// Headers with the type of the event, and an ID that is the same for every attempt at
+	// delivering it so receivers can ignore retries they already handled
+	webhookEventHeader    = "X-Broadcast-Box-Event"
+	webhookDeliveryHeader = "X-Broadcast-Box-Delivery"
+
+	defaultWebhookRetries = 3
+	webhookRetryBackoff   = time.Second
+)
+
+// webhookPublisher POSTs events as JSON to a URL. Failed requests are retried with a doubling
+// delay, events that still fail are dropped.
+type webhookPublisher struct {
+	url    string
+	secret []byte
+	client *http.Client
+
+	// Types of the events that are sent, all if empty
+	types   map[string]bool
+	retries int
+}
+
+func newWebhookPublisher(rawURL, secret string, types []string, retries int) (*webhookPublisher, error) {
+	if u, err := url.Parse(rawURL); err != nil {
+		return nil, err
+	} else if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("webhook URL %q must be an http or https URL", rawURL)
+	}
+
+	w := &webhookPublisher{url: rawURL, secret: []byte(secret), client: &http.Client{Timeout: webhookTimeout}, retries: retries}
+	if len(types) != 0 {
+		w.types = map[string]bool{}
+		for _, t := range types {
+			w.types[t] = true
+		}
+	}
+
+	return w, nil
+}
+
+func (w *webhookPublisher) Publish(e Event) error {
+	if w.types != nil && !w.types[e.Type] {
+		return nil
+	}
+
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	deliveryID := uuid.New().String()
+	backoff := webhookRetryBackoff
+	for attempt := 0; ; attempt++ {
+		retry, err := w.post(e.Type, deliveryID, payload)
+		if err == nil || !retry || attempt >= w.retries {
+			return err
+		}
+
+		logger.Debug("Retrying webhook", "type", e.Type, "streamKey", e.StreamKey, "attempt", attempt+1, "err", err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// post sends payload once, retry is set if the request may succeed when it is sent again
+func (w *webhookPublisher) post(eventType, deliveryID string, payload []byte) (retry bool, err error) {
+	req, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(payload))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookEventHeader, eventType)
+	req.Header.Set(webhookDeliveryHeader, deliveryID)
+
+	if len(w.secret) != 0 {
+		mac := hmac.New(sha256.New, w.secret)
+		mac.Write(payload)
+		req.Header.Set(webhookSignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		// Other client errors would fail the same way again
+		retry = resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusRequestTimeout
+		return retry, fmt.Errorf("webhook %s failed with %s for %s event", w.url, resp.Status, eventType)
+	}
+
+	return false, nil
+}
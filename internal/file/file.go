@@ -0,0 +1,258 @@
+// Package file plays IVF, Ogg and WebM files in real time and writes them to an Ingest, so a
+// recording can be published like a live stream, for placeholder channels or demos.
+package file
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Ingest receives the media of the files
+type Ingest interface {
+	WriteVP8(frame []byte, pts time.Duration) error
+	WriteVP9(frame []byte, pts time.Duration) error
+	WriteAV1(temporalUnit []byte, pts time.Duration) error
+	WriteOpus(packet []byte, pts time.Duration) error
+	Close()
+	Done() <-chan struct{}
+}
+
+// PublishFunc starts the Ingest media is written to, it is called once the files are opened
+type PublishFunc func() (Ingest, error)
+
+type codec int
+
+const (
+	codecVP8 codec = iota + 1
+	codecVP9
+	codecAV1
+	codecOpus
+)
+
+// frame is one frame or packet of a file, presented at pts from the start of the file
+type frame struct {
+	codec codec
+	data  []byte
+	pts   time.Duration
+}
+
+// reader returns the frames of a file in presentation order, io.EOF after the last
+type reader interface {
+	next() (frame, error)
+}
+
+var errUnsupportedFile = errors.New("unsupported file, only .ivf, .ogg, .opus and .webm are played")
+
+// Play writes the files at paths to the Ingest of publish at their own pace, like a video in
+// one file and its audio in another. With loop they are replayed from the start once all of
+// them ended, otherwise the Ingest is closed after the last frame.
+func Play(paths []string, loop bool, publish PublishFunc) error {
+	if len(paths) == 0 {
+		return errors.New("no files to play")
+	}
+
+	// Files are opened upfront so a missing file doesn't publish an empty stream
+	for _, path := range paths {
+		if err := checkFile(path); err != nil {
+			return err
+		}
+	}
+
+	ingest, err := publish()
+	if err != nil {
+		return err
+	}
+	defer ingest.Close()
+
+	start := time.Now()
+	offset := time.Duration(0)
+	for {
+		duration, err := playOnce(paths, ingest, start, offset)
+		if err != nil || !loop {
+			return err
+		}
+
+		select {
+		case <-ingest.Done():
+			return nil
+		default:
+		}
+
+		// An empty file would loop without ever sleeping
+		if duration <= 0 {
+			return fmt.Errorf("nothing to play in %s", strings.Join(paths, ", "))
+		}
+		offset += duration
+	}
+}
+
+// PlayPlaylist writes the files at paths one after another to the Ingest of publish, starting
+// with the one at index next and looping back to the first after the last, until the Ingest is
+// closed. It returns the index of the file after the one that was playing then.
+func PlayPlaylist(paths []string, next int, publish PublishFunc) (int, error) {
+	if len(paths) == 0 {
+		return next, errors.New("no files to play")
+	}
+
+	for _, path := range paths {
+		if err := checkFile(path); err != nil {
+			return next, err
+		}
+	}
+
+	ingest, err := publish()
+	if err != nil {
+		return next, err
+	}
+	defer ingest.Close()
+
+	start := time.Now()
+	offset := time.Duration(0)
+	for {
+		path := paths[next%len(paths)]
+		next = (next + 1) % len(paths)
+
+		duration, err := playOnce([]string{path}, ingest, start, offset)
+		select {
+		case <-ingest.Done():
+			// Writes can fail with the Ingest closed in between
+			return next, nil
+		default:
+		}
+
+		if err != nil {
+			return next, err
+		} else if duration <= 0 {
+			return next, fmt.Errorf("nothing to play in %s", path)
+		}
+		offset += duration
+	}
+}
+
+// playOnce plays every file in parallel, presenting their first frames at start+offset. It
+// returns the duration of the longest file.
+func playOnce(paths []string, ingest Ingest, start time.Time, offset time.Duration) (time.Duration, error) {
+	var (
+		wg       sync.WaitGroup
+		lock     sync.Mutex
+		duration time.Duration
+		firstErr error
+	)
+
+	for _, path := range paths {
+		wg.Add(1)
+		go func(path string) {
+			defer wg.Done()
+
+			d, err := playFile(path, ingest, start, offset)
+
+			lock.Lock()
+			defer lock.Unlock()
+			if d > duration {
+				duration = d
+			}
+			if err != nil && firstErr == nil {
+				firstErr = fmt.Errorf("%s: %w", path, err)
+			}
+		}(path)
+	}
+	wg.Wait()
+
+	return duration, firstErr
+}
+
+// playFile writes the frames of the file at path in real time and returns its duration
+func playFile(path string, ingest Ingest, start time.Time, offset time.Duration) (time.Duration, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	r, err := newReader(path, f)
+	if err != nil {
+		return 0, err
+	}
+
+	// Tracked per codec, as the audio and video of a WebM file are interleaved
+	lastPTS := map[codec]time.Duration{}
+	frameDuration := map[codec]time.Duration{}
+	duration := func() (d time.Duration) {
+		// The last frame is shown as long as the one before it
+		for c, pts := range lastPTS {
+			if end := pts + frameDuration[c]; end > d {
+				d = end
+			}
+		}
+		return d
+	}
+
+	for {
+		frame, err := r.next()
+		if errors.Is(err, io.EOF) {
+			return duration(), nil
+		} else if err != nil {
+			return duration(), err
+		}
+
+		if last, ok := lastPTS[frame.codec]; ok && frame.pts > last {
+			frameDuration[frame.codec] = frame.pts - last
+		}
+		lastPTS[frame.codec] = frame.pts
+
+		pts := offset + frame.pts
+		select {
+		case <-ingest.Done():
+			return duration(), nil
+		case <-time.After(time.Until(start.Add(pts))):
+		}
+
+		if err = writeFrame(ingest, frame.codec, frame.data, pts); err != nil {
+			return duration(), err
+		}
+	}
+}
+
+func writeFrame(ingest Ingest, c codec, data []byte, pts time.Duration) error {
+	switch c {
+	case codecVP8:
+		return ingest.WriteVP8(data, pts)
+	case codecVP9:
+		return ingest.WriteVP9(data, pts)
+	case codecAV1:
+		return ingest.WriteAV1(data, pts)
+	default:
+		return ingest.WriteOpus(data, pts)
+	}
+}
+
+func checkFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = newReader(path, f)
+	return err
+}
+
+// newReader returns the reader of the file at path by its extension
+func newReader(path string, r io.Reader) (reader, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".ivf":
+		return newIVFReader(r)
+	case ".ogg", ".opus":
+		return newOggReader(r)
+	case ".webm":
+		return newWebMReader(r)
+	default:
+		return nil, errUnsupportedFile
+	}
+}
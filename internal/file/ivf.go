@@ -0,0 +1,57 @@
+package file
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/pion/webrtc/v4/pkg/media/ivfreader"
+)
+
+type ivfReader struct {
+	reader *ivfreader.IVFReader
+	codec  codec
+
+	// Frame timestamps are in units of numerator/denominator seconds
+	numerator, denominator uint64
+}
+
+func newIVFReader(r io.Reader) (*ivfReader, error) {
+	reader, header, err := ivfreader.NewWith(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var c codec
+	switch header.FourCC {
+	case "VP80":
+		c = codecVP8
+	case "VP90":
+		c = codecVP9
+	case "AV01":
+		c = codecAV1
+	default:
+		return nil, fmt.Errorf("unsupported IVF codec `%s`", header.FourCC)
+	}
+
+	if header.TimebaseDenominator == 0 {
+		return nil, fmt.Errorf("invalid IVF timebase %d/%d", header.TimebaseNumerator, header.TimebaseDenominator)
+	}
+
+	return &ivfReader{
+		reader:      reader,
+		codec:       c,
+		numerator:   uint64(header.TimebaseNumerator),
+		denominator: uint64(header.TimebaseDenominator),
+	}, nil
+}
+
+func (r *ivfReader) next() (frame, error) {
+	data, header, err := r.reader.ParseNextFrame()
+	if err != nil {
+		return frame{}, err
+	}
+
+	pts := time.Duration(header.Timestamp * r.numerator * uint64(time.Second) / r.denominator)
+	return frame{codec: r.codec, data: data, pts: pts}, nil
+}
@@ -0,0 +1,144 @@
+package file
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/glimesh/broadcast-box/internal/opus"
+)
+
+const oggPageHeaderSize = 27
+
+var errNotOpus = errors.New("Ogg file does not contain Opus")
+
+// oggReader returns the Opus packets of an Ogg file, see RFC 7845. Only the first logical
+// stream is played. Packets are timed by the durations of the packets before them.
+type oggReader struct {
+	reader *bufio.Reader
+	serial uint32
+
+	// Packets of the current page, the last may continue on the next page
+	packets  [][]byte
+	complete bool
+
+	pts time.Duration
+}
+
+func newOggReader(r io.Reader) (*oggReader, error) {
+	o := &oggReader{reader: bufio.NewReader(r), complete: true}
+
+	// The ID header and comment header come before the first audio packet
+	head, err := o.nextPacket(true)
+	if err != nil {
+		return nil, err
+	} else if !bytes.HasPrefix(head, []byte("OpusHead")) {
+		return nil, errNotOpus
+	}
+
+	if _, err = o.nextPacket(false); err != nil {
+		return nil, err
+	}
+
+	return o, nil
+}
+
+func (o *oggReader) next() (frame, error) {
+	for {
+		packet, err := o.nextPacket(false)
+		if err != nil {
+			return frame{}, err
+		}
+
+		// Empty packets are allowed, but have nothing to play
+		if len(packet) == 0 {
+			continue
+		}
+
+		pts := o.pts
+		o.pts += opus.PacketDuration(packet)
+		return frame{codec: codecOpus, data: packet, pts: pts}, nil
+	}
+}
+
+// nextPacket returns the next complete packet of the stream, joining packets that continue
+// across pages. first takes the stream of the first page.
+func (o *oggReader) nextPacket(first bool) ([]byte, error) {
+	var packet []byte
+	for {
+		if len(o.packets) > 1 || (len(o.packets) == 1 && o.complete) {
+			packet = append(packet, o.packets[0]...)
+			o.packets = o.packets[1:]
+			return packet, nil
+		} else if len(o.packets) == 1 {
+			packet = append(packet, o.packets[0]...)
+			o.packets = nil
+		}
+
+		if err := o.readPage(first); err != nil {
+			return nil, err
+		}
+		first = false
+	}
+}
+
+// readPage reads the packets of the next page of the stream, pages of other streams are skipped
+func (o *oggReader) readPage(first bool) error {
+	for {
+		header := make([]byte, oggPageHeaderSize)
+		if _, err := io.ReadFull(o.reader, header); err != nil {
+			return err
+		} else if !bytes.HasPrefix(header, []byte("OggS")) {
+			return errors.New("invalid Ogg page")
+		}
+
+		segments := make([]byte, header[26])
+		if _, err := io.ReadFull(o.reader, segments); err != nil {
+			return unexpectedEOF(err)
+		}
+
+		size := 0
+		for _, s := range segments {
+			size += int(s)
+		}
+
+		body := make([]byte, size)
+		if _, err := io.ReadFull(o.reader, body); err != nil {
+			return unexpectedEOF(err)
+		}
+
+		serial := binary.LittleEndian.Uint32(header[14:18])
+		if first {
+			o.serial = serial
+		} else if serial != o.serial {
+			continue
+		}
+
+		// A packet ends with a segment shorter than 255 bytes
+		start, end := 0, 0
+		o.complete = true
+		for _, s := range segments {
+			end += int(s)
+			if s < 255 {
+				o.packets = append(o.packets, body[start:end])
+				start = end
+			}
+		}
+		if start != end {
+			o.packets = append(o.packets, body[start:end])
+			o.complete = false
+		}
+
+		return nil
+	}
+}
+
+func unexpectedEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
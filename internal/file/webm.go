@@ -0,0 +1,303 @@
+package file
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// EBML IDs of the WebM elements that are read, others are skipped
+const (
+	ebmlIDHeader        = 0x1A45DFA3
+	ebmlIDSegment       = 0x18538067
+	ebmlIDInfo          = 0x1549A966
+	ebmlIDTimecodeScale = 0x2AD7B1
+	ebmlIDTracks        = 0x1654AE6B
+	ebmlIDTrackEntry    = 0xAE
+	ebmlIDTrackNumber   = 0xD7
+	ebmlIDCodecID       = 0x86
+	ebmlIDCluster       = 0x1F43B675
+	ebmlIDTimecode      = 0xE7
+	ebmlIDSimpleBlock   = 0xA3
+	ebmlIDBlockGroup    = 0xA0
+	ebmlIDBlock         = 0xA1
+
+	defaultTimecodeScale = 1000000
+
+	// Larger elements are assumed to be a broken file instead of allocated
+	maxElementSize = 64 << 20
+)
+
+var errNoWebMTracks = errors.New("WebM file has no VP8, VP9, AV1 or Opus track")
+
+// webmReader returns the frames of the first video and audio track of a WebM file. Elements
+// are read in order without seeking, so files that are still being written can be played.
+type webmReader struct {
+	reader *bufio.Reader
+
+	// Nanoseconds of one unit of block timecodes
+	timecodeScale   uint64
+	clusterTimecode uint64
+
+	tracks           map[uint64]codec
+	entryTrackNumber uint64
+	entryCodec       codec
+	hasVideo         bool
+	hasAudio         bool
+}
+
+func newWebMReader(r io.Reader) (*webmReader, error) {
+	w := &webmReader{reader: bufio.NewReader(r), timecodeScale: defaultTimecodeScale, tracks: map[uint64]codec{}}
+
+	id, size, err := w.readElementHeader()
+	if err != nil {
+		return nil, err
+	} else if id != ebmlIDHeader {
+		return nil, errors.New("invalid WebM file")
+	} else if err = w.skip(size); err != nil {
+		return nil, err
+	}
+
+	// Everything before the first cluster describes the tracks
+	for {
+		id, size, err := w.readElementHeader()
+		if err != nil {
+			return nil, unexpectedEOF(err)
+		}
+
+		switch id {
+		case ebmlIDSegment, ebmlIDInfo, ebmlIDTracks:
+		case ebmlIDCluster:
+			if len(w.tracks) == 0 {
+				return nil, errNoWebMTracks
+			}
+			return w, nil
+		case ebmlIDTimecodeScale:
+			if w.timecodeScale, err = w.readUint(size); err != nil {
+				return nil, err
+			}
+		case ebmlIDTrackEntry:
+			w.entryTrackNumber, w.entryCodec = 0, 0
+		case ebmlIDTrackNumber:
+			if w.entryTrackNumber, err = w.readUint(size); err != nil {
+				return nil, err
+			}
+			w.addTrack()
+		case ebmlIDCodecID:
+			data, err := w.readData(size)
+			if err != nil {
+				return nil, err
+			}
+			w.entryCodec = webmCodec(string(data))
+			w.addTrack()
+		default:
+			if err = w.skip(size); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// addTrack plays the track entry being read once its number and codec are known
+func (w *webmReader) addTrack() {
+	if w.entryTrackNumber == 0 || w.entryCodec == 0 {
+		return
+	}
+
+	if w.entryCodec == codecOpus {
+		if w.hasAudio {
+			return
+		}
+		w.hasAudio = true
+	} else {
+		if w.hasVideo {
+			return
+		}
+		w.hasVideo = true
+	}
+
+	w.tracks[w.entryTrackNumber] = w.entryCodec
+}
+
+func webmCodec(codecID string) codec {
+	switch codecID {
+	case "V_VP8":
+		return codecVP8
+	case "V_VP9":
+		return codecVP9
+	case "V_AV1":
+		return codecAV1
+	case "A_OPUS":
+		return codecOpus
+	default:
+		return 0
+	}
+}
+
+func (w *webmReader) next() (frame, error) {
+	for {
+		id, size, err := w.readElementHeader()
+		if err != nil {
+			return frame{}, err
+		}
+
+		switch id {
+		case ebmlIDSegment, ebmlIDCluster, ebmlIDBlockGroup:
+		case ebmlIDTimecode:
+			if w.clusterTimecode, err = w.readUint(size); err != nil {
+				return frame{}, err
+			}
+		case ebmlIDSimpleBlock, ebmlIDBlock:
+			data, err := w.readData(size)
+			if err != nil {
+				return frame{}, err
+			}
+
+			if f, ok := w.parseBlock(data); ok {
+				return f, nil
+			}
+		default:
+			if err = w.skip(size); err != nil {
+				return frame{}, err
+			}
+		}
+	}
+}
+
+// parseBlock returns the frame of a block, ok is false for blocks of other tracks and laced
+// blocks, which hold more than one frame
+func (w *webmReader) parseBlock(data []byte) (f frame, ok bool) {
+	trackNumber, n := readVint(data)
+	if n == 0 || len(data) < n+3 {
+		return frame{}, false
+	}
+
+	c, ok := w.tracks[trackNumber]
+	if !ok || data[n+2]&0x06 != 0 {
+		return frame{}, false
+	}
+
+	timecode := int64(w.clusterTimecode) + int64(int16(binary.BigEndian.Uint16(data[n:])))
+	if timecode < 0 {
+		timecode = 0
+	}
+
+	return frame{codec: c, data: data[n+3:], pts: time.Duration(uint64(timecode) * w.timecodeScale)}, true
+}
+
+// readElementHeader returns the ID and size of the next element, size is -1 if it is unknown
+func (w *webmReader) readElementHeader() (id uint64, size int64, err error) {
+	first, err := w.reader.Peek(1)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	length := vintLength(first[0])
+	if length == 0 || length > 4 {
+		return 0, 0, errors.New("invalid WebM element ID")
+	}
+
+	idBytes := make([]byte, length)
+	if _, err = io.ReadFull(w.reader, idBytes); err != nil {
+		return 0, 0, unexpectedEOF(err)
+	}
+	for _, b := range idBytes {
+		id = id<<8 | uint64(b)
+	}
+
+	first, err = w.reader.Peek(1)
+	if err != nil {
+		return 0, 0, unexpectedEOF(err)
+	}
+
+	length = vintLength(first[0])
+	if length == 0 {
+		return 0, 0, errors.New("invalid WebM element size")
+	}
+
+	sizeBytes := make([]byte, length)
+	if _, err = io.ReadFull(w.reader, sizeBytes); err != nil {
+		return 0, 0, unexpectedEOF(err)
+	}
+
+	value, _ := readVint(sizeBytes)
+	if value == 1<<(7*length)-1 {
+		return id, -1, nil
+	}
+
+	return id, int64(value), nil
+}
+
+func (w *webmReader) readData(size int64) ([]byte, error) {
+	if size < 0 || size > maxElementSize {
+		return nil, fmt.Errorf("invalid WebM element size %d", size)
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(w.reader, data); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+
+	return data, nil
+}
+
+func (w *webmReader) readUint(size int64) (uint64, error) {
+	if size > 8 {
+		return 0, fmt.Errorf("invalid WebM integer size %d", size)
+	}
+
+	data, err := w.readData(size)
+	if err != nil {
+		return 0, err
+	}
+
+	value := uint64(0)
+	for _, b := range data {
+		value = value<<8 | uint64(b)
+	}
+
+	return value, nil
+}
+
+func (w *webmReader) skip(size int64) error {
+	if size < 0 {
+		return errors.New("WebM element of unknown size can't be skipped")
+	}
+
+	_, err := w.reader.Discard(int(size))
+	return unexpectedEOF(err)
+}
+
+// vintLength returns the length of the EBML variable size integer starting with first, 0 if it is invalid
+func vintLength(first byte) int {
+	for length := 1; length <= 8; length++ {
+		if first&(0x80>>(length-1)) != 0 {
+			return length
+		}
+	}
+
+	return 0
+}
+
+// readVint returns the value of the EBML variable size integer at the start of data without
+// its length marker, and its length
+func readVint(data []byte) (uint64, int) {
+	if len(data) == 0 {
+		return 0, 0
+	}
+
+	length := vintLength(data[0])
+	if length == 0 || len(data) < length {
+		return 0, 0
+	}
+
+	value := uint64(data[0] & (0xFF >> length))
+	for _, b := range data[1:length] {
+		value = value<<8 | uint64(b)
+	}
+
+	return value, length
+}
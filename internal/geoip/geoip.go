@@ -0,0 +1,47 @@
+// Package geoip looks up the country of addresses in a MaxMind DB file, like GeoLite2 Country
+// or City.
+package geoip
+
+import (
+	"net"
+	"net/netip"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+type (
+	DB struct {
+		reader *maxminddb.Reader
+	}
+
+	countryRecord struct {
+		Country struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"country"`
+	}
+)
+
+// Open reads the database at path into memory
+func Open(path string) (*DB, error) {
+	reader, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DB{reader: reader}, nil
+}
+
+func (d *DB) Close() error {
+	return d.reader.Close()
+}
+
+// Country returns the ISO 3166-1 alpha-2 code of the country addr is in, like `DE`. It is empty
+// for addresses the database doesn't have, like private ones.
+func (d *DB) Country(addr netip.Addr) (string, error) {
+	var record countryRecord
+	if err := d.reader.Lookup(net.IP(addr.Unmap().AsSlice()), &record); err != nil {
+		return "", err
+	}
+
+	return record.Country.ISOCode, nil
+}
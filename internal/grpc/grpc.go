@@ -0,0 +1,201 @@
+// Package grpc serves unary and server streaming gRPC methods over HTTP/2, with the messages
+// encoded by the caller using the protobuf helpers of this package.
+// Compression and client streaming aren't supported.
+package grpc
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// Status codes of gRPC, see https://grpc.github.io/grpc/core/md_doc_statuscodes.html
+const (
+	CodeOK                = 0
+	CodeInvalidArgument   = 3
+	CodeNotFound          = 5
+	CodeResourceExhausted = 8
+	CodeUnimplemented     = 12
+	CodeInternal          = 13
+	CodeUnauthenticated   = 16
+)
+
+// Requests are small, larger messages are refused
+const maxRequestSize = 64 * 1024
+
+type (
+	// Error is returned by methods to end the call with Code instead of CodeInternal
+	Error struct {
+		Code    int
+		Message string
+	}
+
+	// Method handles a call with the encoded request. Unary methods return the response,
+	// server streaming ones call send for every message until ctx is done and return nil.
+	Method struct {
+		Unary     func(ctx context.Context, request []byte) ([]byte, error)
+		Streaming func(ctx context.Context, request []byte, send func([]byte) error) error
+	}
+)
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Errorf returns an Error with code and the formatted message
+func Errorf(code int, format string, a ...any) error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, a...)}
+}
+
+// Handler serves the methods of service, like `package.Service`, on `/<service>/<method>`.
+// authorize is called before every call, a returned error ends it.
+func Handler(service string, methods map[string]Method, authorize func(*http.Request) error) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost || req.ProtoMajor != 2 || !strings.HasPrefix(req.Header.Get("Content-Type"), "application/grpc") {
+			http.Error(res, "Expected a gRPC request", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		res.Header().Set("Content-Type", "application/grpc")
+		res.WriteHeader(http.StatusOK)
+
+		err := serve(res, req, service, methods, authorize)
+
+		code, message := CodeOK, ""
+		var grpcErr *Error
+		if errors.As(err, &grpcErr) {
+			code, message = grpcErr.Code, grpcErr.Message
+		} else if err != nil {
+			code, message = CodeInternal, err.Error()
+		}
+
+		res.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(code))
+		if message != "" {
+			res.Header().Set(http.TrailerPrefix+"Grpc-Message", encodeMessage(message))
+		}
+	})
+}
+
+func serve(res http.ResponseWriter, req *http.Request, service string, methods map[string]Method, authorize func(*http.Request) error) error {
+	name, ok := strings.CutPrefix(req.URL.Path, "/"+service+"/")
+	method, found := methods[name]
+	if !ok || !found {
+		return Errorf(CodeUnimplemented, "unknown method %s", req.URL.Path)
+	}
+
+	if err := authorize(req); err != nil {
+		return err
+	}
+
+	request, err := readMessage(req.Body)
+	if err != nil {
+		return err
+	}
+
+	controller := http.NewResponseController(res)
+	send := func(message []byte) error {
+		header := make([]byte, 5, 5+len(message))
+		binary.BigEndian.PutUint32(header[1:], uint32(len(message)))
+		if _, err := res.Write(append(header, message...)); err != nil {
+			return err
+		}
+
+		return controller.Flush()
+	}
+
+	if method.Streaming != nil {
+		return method.Streaming(req.Context(), request, send)
+	}
+
+	response, err := method.Unary(req.Context(), request)
+	if err != nil {
+		return err
+	}
+
+	return send(response)
+}
+
+// readMessage reads the one length prefixed message of a unary or server streaming call
+func readMessage(body io.Reader) ([]byte, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(body, header); err != nil {
+		return nil, Errorf(CodeInvalidArgument, "failed to read request: %v", err)
+	} else if header[0] != 0 {
+		return nil, Errorf(CodeUnimplemented, "compressed requests aren't supported")
+	}
+
+	length := binary.BigEndian.Uint32(header[1:])
+	if length > maxRequestSize {
+		return nil, Errorf(CodeResourceExhausted, "request of %d bytes is too large", length)
+	}
+
+	message := make([]byte, length)
+	if _, err := io.ReadFull(body, message); err != nil {
+		return nil, Errorf(CodeInvalidArgument, "failed to read request: %v", err)
+	}
+
+	return message, nil
+}
+
+// encodeMessage percent-encodes message for the Grpc-Message trailer
+func encodeMessage(message string) string {
+	var b strings.Builder
+	for i := 0; i < len(message); i++ {
+		if c := message[i]; c >= ' ' && c <= '~' && c != '%' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+
+	return b.String()
+}
+
+// ListenAndServe serves handler on addr over TLS with certFile and keyFile. Without them it
+// serves HTTP/2 without TLS (h2c), which is only allowed on a loopback address as calls carry
+// credentials.
+func ListenAndServe(addr, certFile, keyFile string, handler http.Handler) error {
+	if certFile != "" || keyFile != "" {
+		server := &http.Server{
+			Addr:    addr,
+			Handler: handler,
+		}
+
+		return server.ListenAndServeTLS(certFile, keyFile)
+	}
+
+	if !isLoopback(addr) {
+		return fmt.Errorf("refusing to serve gRPC without TLS on %s, which isn't a loopback address", addr)
+	}
+
+	server := &http.Server{
+		Addr:    addr,
+		Handler: h2c.NewHandler(handler, &http2.Server{}),
+	}
+
+	return server.ListenAndServe()
+}
+
+// isLoopback returns if the host of addr only has loopback addresses, an empty one listens on
+// every interface
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	} else if host == "localhost" {
+		return true
+	}
+
+	ip, err := netip.ParseAddr(host)
+	return err == nil && ip.IsLoopback()
+}
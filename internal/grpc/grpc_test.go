@@ -0,0 +1,232 @@
+package grpc
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	grpcgo "google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// rawCodec lets grpc-go send and receive messages encoded by the test
+type rawCodec struct{}
+
+func (rawCodec) Marshal(v any) ([]byte, error) {
+	return *v.(*[]byte), nil
+}
+
+func (rawCodec) Unmarshal(data []byte, v any) error {
+	*v.(*[]byte) = append([]byte(nil), data...)
+	return nil
+}
+
+func (rawCodec) Name() string {
+	return "proto"
+}
+
+const testService = "test.v1.Test"
+
+// testHandler has Echo, which greets the name in field 1, Count, which sends field 1 of
+// every number up to the one in field 1, and Fail, which fails with NotFound. Calls need the
+// token `secret`.
+func testHandler() http.Handler {
+	return Handler(testService, map[string]Method{
+		"Echo": {Unary: func(_ context.Context, request []byte) ([]byte, error) {
+			fields, err := Decode(request)
+			if err != nil {
+				return nil, Errorf(CodeInvalidArgument, "%v", err)
+			}
+
+			return AppendString(nil, 1, "hello "+fields.String(1)), nil
+		}},
+		"Count": {Streaming: func(_ context.Context, request []byte, send func([]byte) error) error {
+			fields, err := Decode(request)
+			if err != nil {
+				return err
+			}
+
+			for i := uint64(1); i <= fields.Uint64(1); i++ {
+				if err = send(AppendUint64(nil, 1, i)); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		}},
+		"Fail": {Unary: func(context.Context, []byte) ([]byte, error) {
+			return nil, Errorf(CodeNotFound, "stream `ünknown` 100%% not found")
+		}},
+	}, func(req *http.Request) error {
+		if req.Header.Get("Authorization") != "Bearer secret" {
+			return Errorf(CodeUnauthenticated, "invalid token")
+		}
+
+		return nil
+	})
+}
+
+// newTLSClient serves handler over TLS and returns a grpc-go client of it
+func newTLSClient(t *testing.T, handler http.Handler) *grpcgo.ClientConn {
+	server := httptest.NewUnstartedServer(handler)
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+
+	conn, err := grpcgo.NewClient(server.Listener.Addr().String(), grpcgo.WithTransportCredentials(credentials.NewClientTLSFromCert(roots, "example.com")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	return conn
+}
+
+// authorized returns the context of a call with the token of testHandler
+func authorized(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+	return metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer secret")
+}
+
+func invoke(ctx context.Context, conn *grpcgo.ClientConn, method string, request []byte) ([]byte, error) {
+	var response []byte
+	err := conn.Invoke(ctx, "/"+testService+"/"+method, &request, &response, grpcgo.ForceCodec(rawCodec{}))
+	return response, err
+}
+
+func TestUnary(t *testing.T) {
+	conn := newTLSClient(t, testHandler())
+
+	response, err := invoke(authorized(t), conn, "Echo", protowire.AppendString(protowire.AppendTag(nil, 1, protowire.BytesType), "grpc-go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	number, typ, n := protowire.ConsumeTag(response)
+	greeting, m := protowire.ConsumeString(response[n:])
+	if number != 1 || typ != protowire.BytesType || m < 0 || greeting != "hello grpc-go" || n+m != len(response) {
+		t.Fatalf("unexpected response %x", response)
+	}
+}
+
+func TestServerStreaming(t *testing.T) {
+	conn := newTLSClient(t, testHandler())
+
+	stream, err := conn.NewStream(authorized(t), &grpcgo.StreamDesc{ServerStreams: true}, "/"+testService+"/Count", grpcgo.ForceCodec(rawCodec{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request := protowire.AppendVarint(protowire.AppendTag(nil, 1, protowire.VarintType), 3)
+	if err = stream.SendMsg(&request); err != nil {
+		t.Fatal(err)
+	} else if err = stream.CloseSend(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := uint64(1); ; i++ {
+		var message []byte
+		err = stream.RecvMsg(&message)
+		if errors.Is(err, io.EOF) {
+			if i != 4 {
+				t.Fatalf("stream ended after %d messages", i-1)
+			}
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+
+		_, _, n := protowire.ConsumeTag(message)
+		if v, _ := protowire.ConsumeVarint(message[n:]); v != i {
+			t.Fatalf("message %d has %d", i, v)
+		}
+	}
+}
+
+func TestErrors(t *testing.T) {
+	conn := newTLSClient(t, testHandler())
+
+	for _, c := range []struct {
+		ctx     context.Context
+		method  string
+		request []byte
+		code    codes.Code
+		message string
+	}{
+		{authorized(t), "Fail", nil, codes.NotFound, "stream `ünknown` 100% not found"},
+		{authorized(t), "Missing", nil, codes.Unimplemented, "unknown method /test.v1.Test/Missing"},
+		{authorized(t), "Echo", []byte{0x0a, 0x05, 'a'}, codes.InvalidArgument, "malformed protobuf message"},
+		{context.Background(), "Echo", nil, codes.Unauthenticated, "invalid token"},
+		{metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer wrong"), "Echo", nil, codes.Unauthenticated, "invalid token"},
+	} {
+		_, err := invoke(c.ctx, conn, c.method, c.request)
+		if s := status.Convert(err); s.Code() != c.code || s.Message() != c.message {
+			t.Errorf("%s returned %v, want %v %q", c.method, err, c.code, c.message)
+		}
+	}
+}
+
+func TestRequestTooLarge(t *testing.T) {
+	conn := newTLSClient(t, testHandler())
+
+	_, err := invoke(authorized(t), conn, "Echo", make([]byte, maxRequestSize+1))
+	if code := status.Code(err); code != codes.ResourceExhausted {
+		t.Fatalf("large request returned %v", err)
+	}
+}
+
+func TestH2C(t *testing.T) {
+	server := httptest.NewServer(h2c.NewHandler(testHandler(), &http2.Server{}))
+	t.Cleanup(server.Close)
+
+	conn, err := grpcgo.NewClient(server.Listener.Addr().String(), grpcgo.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, err = invoke(authorized(t), conn, "Echo", nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestListenAndServeNeedsTLS(t *testing.T) {
+	for _, addr := range []string{":0", "0.0.0.0:0", "[::]:0", "192.0.2.1:0", "example.com:0"} {
+		err := ListenAndServe(addr, "", "", testHandler())
+		if err == nil || !strings.Contains(err.Error(), "without TLS") {
+			t.Errorf("%s was served without TLS: %v", addr, err)
+		}
+	}
+
+	for addr, loopback := range map[string]bool{
+		"127.0.0.1:9090": true,
+		"127.1.2.3:9090": true,
+		"[::1]:9090":     true,
+		"localhost:9090": true,
+		":9090":          false,
+		"[::]:9090":      false,
+		"10.0.0.1:9090":  false,
+		"127.0.0.1":      false,
+	} {
+		if isLoopback(addr) != loopback {
+			t.Errorf("isLoopback(%q) != %v", addr, loopback)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package grpc
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// Wire types of protobuf fields
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+var errMalformedMessage = errors.New("malformed protobuf message")
+
+// Fields of a decoded protobuf message by number. Only the last value of a field is kept, which
+// is what proto3 does for fields that aren't repeated.
+type Fields map[int]field
+
+type field struct {
+	value uint64
+	bytes []byte
+}
+
+// Decode returns the fields of the protobuf message b
+func Decode(b []byte) (Fields, error) {
+	fields := Fields{}
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, errMalformedMessage
+		}
+		b = b[n:]
+
+		var f field
+		switch tag & 7 {
+		case wireVarint:
+			if f.value, n = binary.Uvarint(b); n <= 0 {
+				return nil, errMalformedMessage
+			}
+			b = b[n:]
+		case wireFixed64:
+			if len(b) < 8 {
+				return nil, errMalformedMessage
+			}
+			f.value, b = binary.LittleEndian.Uint64(b), b[8:]
+		case wireFixed32:
+			if len(b) < 4 {
+				return nil, errMalformedMessage
+			}
+			f.value, b = uint64(binary.LittleEndian.Uint32(b)), b[4:]
+		case wireBytes:
+			length, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < length {
+				return nil, errMalformedMessage
+			}
+			f.bytes, b = b[n:n+int(length)], b[n+int(length):]
+		default:
+			return nil, errMalformedMessage
+		}
+
+		fields[int(tag>>3)] = f
+	}
+
+	return fields, nil
+}
+
+func (f Fields) String(number int) string {
+	return string(f[number].bytes)
+}
+
+func (f Fields) Uint64(number int) uint64 {
+	return f[number].value
+}
+
+func (f Fields) Bool(number int) bool {
+	return f[number].value != 0
+}
+
+// The Append functions append a field to a message, unless it has the default value which
+// proto3 leaves out
+
+func AppendString(b []byte, number int, s string) []byte {
+	if s == "" {
+		return b
+	}
+
+	return AppendMessage(b, number, []byte(s))
+}
+
+// AppendMessage appends the encoded message m as field number, also when it is empty like an
+// element of a repeated field has to be
+func AppendMessage(b []byte, number int, m []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(number)<<3|wireBytes)
+	b = binary.AppendUvarint(b, uint64(len(m)))
+	return append(b, m...)
+}
+
+func AppendUint64(b []byte, number int, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+
+	b = binary.AppendUvarint(b, uint64(number)<<3|wireVarint)
+	return binary.AppendUvarint(b, v)
+}
+
+// AppendInt64 appends v as int64, which has negative values as ten byte varints
+func AppendInt64(b []byte, number int, v int64) []byte {
+	return AppendUint64(b, number, uint64(v))
+}
+
+func AppendBool(b []byte, number int, v bool) []byte {
+	if !v {
+		return b
+	}
+
+	return AppendUint64(b, number, 1)
+}
+
+func AppendDouble(b []byte, number int, v float64) []byte {
+	if v == 0 {
+		return b
+	}
+
+	b = binary.AppendUvarint(b, uint64(number)<<3|wireFixed64)
+	return binary.LittleEndian.AppendUint64(b, math.Float64bits(v))
+}
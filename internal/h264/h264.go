@@ -0,0 +1,209 @@
+// Package h264 splits H264 access units into NALUs and reads the parameter sets of publishers,
+// which come from the network and can't be trusted.
+package h264
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/glimesh/broadcast-box/internal/bits"
+)
+
+const (
+	// Largest frame of the highest level is 139264 macroblocks, neither side of it can be
+	// longer than sqrt(8 * 139264), see ITU-T H.264 section A.3.1
+	maxSideInMBs = 1055
+
+	maxRefFramesInPicOrderCntCycle = 255
+)
+
+var errSPSTooShort = errors.New("SPS is too short")
+
+// SplitAnnexB returns the NALUs of an Annex B access unit without start codes. NALUs without
+// data, between two start codes, are skipped.
+func SplitAnnexB(accessUnit []byte) (nalus [][]byte) {
+	start := -1
+	for i := 0; i+2 < len(accessUnit); i++ {
+		if accessUnit[i] != 0 || accessUnit[i+1] != 0 || accessUnit[i+2] != 1 {
+			continue
+		}
+
+		if start >= 0 {
+			end := i
+			for end > start && accessUnit[end-1] == 0 {
+				end--
+			}
+			if end > start {
+				nalus = append(nalus, accessUnit[start:end])
+			}
+		}
+
+		i += 2
+		start = i + 1
+	}
+
+	if start >= 0 && start < len(accessUnit) {
+		nalus = append(nalus, accessUnit[start:])
+	}
+
+	return nalus
+}
+
+// readUE reads an Exp-Golomb coded field of at most max
+func readUE(r *bits.Reader, name string, max uint) (uint, error) {
+	v := r.ReadUE()
+	if err := r.Err(); err != nil {
+		return 0, fmt.Errorf("%s: %w", name, err)
+	} else if v > max {
+		return 0, fmt.Errorf("%s %d is larger than %d", name, v, max)
+	}
+
+	return v, nil
+}
+
+// SPSDimensions reads the cropped picture size of an SPS NALU, see ITU-T H.264 section 7.3.2.1.1
+func SPSDimensions(sps []byte) (width, height int, err error) {
+	// Remove emulation prevention bytes
+	rbsp := make([]byte, 0, len(sps))
+	for i := 0; i < len(sps); i++ {
+		if i >= 2 && sps[i] == 3 && sps[i-1] == 0 && sps[i-2] == 0 {
+			continue
+		}
+		rbsp = append(rbsp, sps[i])
+	}
+
+	if len(rbsp) < 4 {
+		return 0, 0, errSPSTooShort
+	}
+
+	r := bits.NewReader(rbsp[4:])
+	if _, err = readUE(r, "seq_parameter_set_id", 31); err != nil {
+		return 0, 0, err
+	}
+
+	chromaFormatIDC := uint(1)
+	switch rbsp[1] {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		if chromaFormatIDC, err = readUE(r, "chroma_format_idc", 3); err != nil {
+			return 0, 0, err
+		} else if chromaFormatIDC == 3 {
+			r.ReadBit() // separate_colour_plane_flag
+		}
+
+		if _, err = readUE(r, "bit_depth_luma_minus8", 6); err != nil {
+			return 0, 0, err
+		} else if _, err = readUE(r, "bit_depth_chroma_minus8", 6); err != nil {
+			return 0, 0, err
+		}
+		r.ReadBit() // qpprime_y_zero_transform_bypass_flag
+
+		if r.ReadBit() == 1 {
+			scalingLists := 8
+			if chromaFormatIDC == 3 {
+				scalingLists = 12
+			}
+
+			for i := 0; i < scalingLists && r.Err() == nil; i++ {
+				if r.ReadBit() == 0 {
+					continue
+				}
+
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+
+				lastScale, nextScale := 8, 8
+				for j := 0; j < size; j++ {
+					if nextScale != 0 {
+						nextScale = (lastScale + r.ReadSE() + 256) % 256
+					}
+					if nextScale != 0 {
+						lastScale = nextScale
+					}
+				}
+			}
+		}
+	}
+
+	if _, err = readUE(r, "log2_max_frame_num_minus4", 12); err != nil {
+		return 0, 0, err
+	}
+
+	picOrderCntType, err := readUE(r, "pic_order_cnt_type", 2)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	switch picOrderCntType {
+	case 0:
+		if _, err = readUE(r, "log2_max_pic_order_cnt_lsb_minus4", 12); err != nil {
+			return 0, 0, err
+		}
+	case 1:
+		r.ReadBit() // delta_pic_order_always_zero_flag
+		r.ReadSE()  // offset_for_non_ref_pic
+		r.ReadSE()  // offset_for_top_to_bottom_field
+
+		refFrames, err := readUE(r, "num_ref_frames_in_pic_order_cnt_cycle", maxRefFramesInPicOrderCntCycle)
+		if err != nil {
+			return 0, 0, err
+		}
+		for ; refFrames > 0; refFrames-- {
+			r.ReadSE() // offset_for_ref_frame
+		}
+	}
+
+	if _, err = readUE(r, "max_num_ref_frames", 16); err != nil {
+		return 0, 0, err
+	}
+	r.ReadBit() // gaps_in_frame_num_value_allowed_flag
+
+	widthInMBs, err := readUE(r, "pic_width_in_mbs_minus1", maxSideInMBs-1)
+	if err != nil {
+		return 0, 0, err
+	}
+	heightInMapUnits, err := readUE(r, "pic_height_in_map_units_minus1", maxSideInMBs-1)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	frameMBsOnly := int(r.ReadBit())
+	if frameMBsOnly == 0 {
+		r.ReadBit() // mb_adaptive_frame_field_flag
+	}
+	r.ReadBit() // direct_8x8_inference_flag
+
+	width = (int(widthInMBs) + 1) * 16
+	height = (2 - frameMBsOnly) * (int(heightInMapUnits) + 1) * 16
+
+	if r.ReadBit() == 1 {
+		crop := [4]int{}
+		for i, name := range []string{"frame_crop_left_offset", "frame_crop_right_offset", "frame_crop_top_offset", "frame_crop_bottom_offset"} {
+			v, err := readUE(r, name, maxSideInMBs*16)
+			if err != nil {
+				return 0, 0, err
+			}
+			crop[i] = int(v)
+		}
+
+		cropUnitX, cropUnitY := 1, 2-frameMBsOnly
+		switch chromaFormatIDC {
+		case 1:
+			cropUnitX, cropUnitY = 2, 2*(2-frameMBsOnly)
+		case 2:
+			cropUnitX = 2
+		}
+
+		width -= (crop[0] + crop[1]) * cropUnitX
+		height -= (crop[2] + crop[3]) * cropUnitY
+	}
+
+	if err = r.Err(); err != nil {
+		return 0, 0, err
+	} else if width <= 0 || height <= 0 {
+		return 0, 0, fmt.Errorf("SPS crops the picture to %dx%d", width, height)
+	}
+
+	return width, height, nil
+}
@@ -0,0 +1,114 @@
+package h264
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestSplitAnnexB(t *testing.T) {
+	for _, test := range []struct {
+		name        string
+		accessUnit  []byte
+		expectNALUs [][]byte
+	}{
+		{"4 byte start codes", []byte{0, 0, 0, 1, 0x67, 0x42, 0, 0, 0, 1, 0x68, 0xce}, [][]byte{{0x67, 0x42}, {0x68, 0xce}}},
+		{"3 byte start codes", []byte{0, 0, 1, 0x65, 0x88, 0, 0, 1, 0x41, 0x9a}, [][]byte{{0x65, 0x88}, {0x41, 0x9a}}},
+		{"empty NALU between start codes", []byte{0, 0, 1, 0, 0, 1, 0x65, 0x88}, [][]byte{{0x65, 0x88}}},
+		{"start code at the end", []byte{0, 0, 1, 0x65, 0x88, 0, 0, 1}, [][]byte{{0x65, 0x88}}},
+		{"no start code", []byte{0x65, 0x88}, nil},
+		{"empty", nil, nil},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			nalus := SplitAnnexB(test.accessUnit)
+			if len(nalus) != len(test.expectNALUs) {
+				t.Fatalf("got %d NALUs instead of %d: %x", len(nalus), len(test.expectNALUs), nalus)
+			}
+			for i := range nalus {
+				if !bytes.Equal(nalus[i], test.expectNALUs[i]) {
+					t.Fatalf("NALU %d is %x instead of %x", i, nalus[i], test.expectNALUs[i])
+				}
+			}
+		})
+	}
+}
+
+func TestSPSDimensions(t *testing.T) {
+	for _, test := range []struct {
+		name                      string
+		sps                       []byte
+		expectWidth, expectHeight int
+	}{
+		{"baseline 720p", []byte{0x67, 0x42, 0x00, 0x1f, 0xf4, 0x02, 0x80, 0x2d, 0xc8}, 1280, 720},
+		{"high 1080p cropped", []byte{0x67, 0x64, 0x00, 0x1f, 0xac, 0xb2, 0x80, 0xf0, 0x04, 0x4f, 0xca, 0x80}, 1920, 1080},
+		{"main pic_order_cnt_type 1", []byte{0x67, 0x4d, 0x00, 0x1f, 0xd1, 0x91, 0xa3, 0xb0, 0x28, 0x0b, 0xfe, 0x54}, 640, 360},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			width, height, err := SPSDimensions(test.sps)
+			if err != nil {
+				t.Fatal(err)
+			} else if width != test.expectWidth || height != test.expectHeight {
+				t.Fatalf("got %dx%d instead of %dx%d", width, height, test.expectWidth, test.expectHeight)
+			}
+		})
+	}
+}
+
+func TestSPSDimensionsInvalid(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		sps  []byte
+	}{
+		{"too short", []byte{0x67, 0x42, 0x00}},
+		{"truncated", []byte{0x67, 0x42, 0x00, 0x1f, 0xf4}},
+		// Ends inside pic_order_cnt_type 1, whose cycle length used to be read as 2^32-1
+		{"truncated pic_order_cnt cycle", []byte{0x67, 0x42, 0x00, 0x1f, 0xd7}},
+		{"pic_order_cnt cycle too long", []byte{0x67, 0x42, 0x00, 0x1f, 0xd3, 0x00, 0x80, 0x80}},
+		{"Exp-Golomb code too long", []byte{0x67, 0x42, 0x00, 0x1f, 0x00, 0x00, 0x00, 0x00, 0x01, 0xff}},
+		{"cropped to nothing", []byte{0x67, 0x42, 0x00, 0x1f, 0xf4, 0x02, 0x80, 0x2d, 0xe0, 0x19, 0x10, 0x0c, 0x8e, 0x80}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			done := make(chan error, 1)
+			go func() {
+				_, _, err := SPSDimensions(test.sps)
+				done <- err
+			}()
+
+			select {
+			case err := <-done:
+				if err == nil {
+					t.Fatal("invalid SPS was parsed")
+				}
+			case <-time.After(time.Second):
+				t.Fatal("parsing the SPS didn't finish")
+			}
+		})
+	}
+}
+
+func FuzzSPSDimensions(f *testing.F) {
+	f.Add([]byte{0x67, 0x42, 0x00, 0x1f, 0xf4, 0x02, 0x80, 0x2d, 0xc8})
+	f.Add([]byte{0x67, 0x64, 0x00, 0x1f, 0xac, 0xb2, 0x80, 0xf0, 0x04, 0x4f, 0xca, 0x80})
+	f.Add([]byte{0x67, 0x4d, 0x00, 0x1f, 0xd1, 0x91, 0xa3, 0xb0, 0x28, 0x0b, 0xfe, 0x54})
+	f.Add([]byte{0x67, 0x42, 0x00, 0x1f, 0xd7})
+
+	f.Fuzz(func(t *testing.T, sps []byte) {
+		width, height, err := SPSDimensions(sps)
+		if err == nil && (width <= 0 || height <= 0 || width > maxSideInMBs*16 || height > 2*maxSideInMBs*16) {
+			t.Fatalf("SPS has the size %dx%d", width, height)
+		}
+	})
+}
+
+func FuzzSplitAnnexB(f *testing.F) {
+	f.Add([]byte{0, 0, 0, 1, 0x67, 0x42, 0, 0, 0, 1, 0x68, 0xce})
+	f.Add([]byte{0, 0, 1, 0, 0, 1, 0x65})
+
+	f.Fuzz(func(t *testing.T, accessUnit []byte) {
+		for _, nalu := range SplitAnnexB(accessUnit) {
+			if len(nalu) == 0 {
+				t.Fatal("empty NALU")
+			}
+		}
+	})
+}
@@ -0,0 +1,202 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/glimesh/broadcast-box/internal/logging"
+)
+
+var logger = logging.Logger("jwt")
+
+const (
+	jwksTimeout = 10 * time.Second
+
+	// How long fetched keys are used before they are fetched again
+	jwksMaxAge = 5 * time.Minute
+
+	// Tokens with an unknown kid refetch the keys at most this often, so rotated keys are picked
+	// up right away without every bad token causing a request
+	jwksMinRefetchInterval = 30 * time.Second
+)
+
+type (
+	// jwks are the keys served at a JSON Web Key Set URL, like an identity provider's
+	jwks struct {
+		url    string
+		client *http.Client
+
+		lock      sync.Mutex
+		byKid     map[string]crypto.PublicKey
+		fetchedAt time.Time
+	}
+
+	jsonWebKey struct {
+		Kty string `json:"kty"`
+		Kid string `json:"kid"`
+		Use string `json:"use"`
+
+		// RSA
+		N string `json:"n"`
+		E string `json:"e"`
+
+		// EC
+		Crv string `json:"crv"`
+		X   string `json:"x"`
+		Y   string `json:"y"`
+	}
+)
+
+func newJWKS(rawURL string) (*jwks, error) {
+	if u, err := url.Parse(rawURL); err != nil {
+		return nil, err
+	} else if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("JWKS URL %q must be an http or https URL", rawURL)
+	}
+
+	return &jwks{url: rawURL, client: &http.Client{Timeout: jwksTimeout}}, nil
+}
+
+// keys returns the key with kid, or every key if kid is empty
+func (j *jwks) keys(kid string) ([]crypto.PublicKey, error) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	_, known := j.byKid[kid]
+	sinceFetch := time.Since(j.fetchedAt)
+	if j.byKid == nil || sinceFetch > jwksMaxAge || (kid != "" && !known && sinceFetch > jwksMinRefetchInterval) {
+		byKid, err := j.fetch()
+		if err != nil && j.byKid == nil {
+			return nil, err
+		} else if err != nil {
+			// Keep using the previous keys while the URL is unavailable
+			logger.Warn("Failed to fetch JWKS, using previous keys", "err", err)
+		} else {
+			j.byKid = byKid
+		}
+		j.fetchedAt = time.Now()
+	}
+
+	if kid != "" {
+		if key, ok := j.byKid[kid]; ok {
+			return []crypto.PublicKey{key}, nil
+		}
+		return nil, fmt.Errorf("%w: unknown key %q", ErrInvalidToken, kid)
+	}
+
+	keys := make([]crypto.PublicKey, 0, len(j.byKid))
+	for _, key := range j.byKid {
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+func (j *jwks) fetch() (map[string]crypto.PublicKey, error) {
+	resp, err := j.client.Get(j.url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("JWKS %s failed with %s", j.url, resp.Status)
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, err
+	}
+
+	byKid := map[string]crypto.PublicKey{}
+	for i, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		key, err := k.publicKey()
+		if err != nil {
+			logger.Warn("Skipping key of JWKS", "kid", k.Kid, "err", err)
+			continue
+		}
+
+		kid := k.Kid
+		if kid == "" {
+			kid = fmt.Sprintf("#%d", i)
+		}
+		byKid[kid] = key
+	}
+
+	return byKid, nil
+}
+
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		} else if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, errors.New("RSA exponent is too large")
+		}
+
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point isn't on the curve")
+		}
+
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+func decodeBigInt(value string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+
+	return new(big.Int).SetBytes(data), nil
+}
@@ -0,0 +1,242 @@
+// Package jwt verifies the JSON Web Tokens publishers and viewers authenticate with. Tokens are
+// signed with a shared HMAC secret (HS256, HS384, HS512) or a key of a JWKS (RS256, RS384,
+// RS512, ES256, ES384, ES512).
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	_ "crypto/sha256" // Registers SHA-256 for crypto.Hash
+	_ "crypto/sha512" // Registers SHA-384 and SHA-512 for crypto.Hash
+)
+
+const (
+	RolePublish = "publish"
+	RoleView    = "view"
+
+	// Allowed clock difference between the issuer and Broadcast Box for exp and nbf
+	leeway = 30 * time.Second
+)
+
+var (
+	ErrInvalidToken = errors.New("invalid token")
+	ErrExpired      = errors.New("token is expired")
+)
+
+type (
+	// Claims of a token that are checked, other claims are ignored
+	Claims struct {
+		// Stream keys the token may publish or view, `*` allows any
+		Streams []string `json:"streams"`
+
+		// RolePublish or RoleView
+		Role string `json:"role"`
+
+		ExpiresAt int64 `json:"exp,omitempty"`
+		NotBefore int64 `json:"nbf,omitempty"`
+	}
+
+	header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+
+	// Verifier checks the signature and lifetime of tokens
+	Verifier struct {
+		secret []byte
+		jwks   *jwks
+	}
+)
+
+// NewVerifier returns a Verifier for tokens signed with secret, or a key of the JWKS served at
+// jwksURL. Either may be empty.
+func NewVerifier(secret, jwksURL string) (*Verifier, error) {
+	if secret == "" && jwksURL == "" {
+		return nil, errors.New("a secret or JWKS URL is required")
+	}
+
+	v := &Verifier{secret: []byte(secret)}
+	if jwksURL != "" {
+		var err error
+		if v.jwks, err = newJWKS(jwksURL); err != nil {
+			return nil, err
+		}
+	}
+
+	return v, nil
+}
+
+// IsJWT returns if token is formatted like a JWT, so it isn't mistaken for a stream key
+func IsJWT(token string) bool {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return false
+	}
+
+	var h header
+	data, err := base64.RawURLEncoding.DecodeString(parts[0])
+	return err == nil && json.Unmarshal(data, &h) == nil && h.Alg != ""
+}
+
+// Verify returns the claims of token if it is signed with one of the keys and isn't expired
+func (v *Verifier) Verify(token string) (*Claims, error) {
+	claims := &Claims{}
+	if err := v.Decode(token, claims); err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+// Decode unmarshals the claims of token into claims if it is signed with one of the keys and
+// isn't expired, like for the ID tokens of an OpenID Connect provider
+func (v *Verifier) Decode(token string, claims any) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return ErrInvalidToken
+	}
+
+	var h header
+	if err := decodeSegment(parts[0], &h); err != nil {
+		return err
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return ErrInvalidToken
+	}
+
+	if err = v.verifySignature(h, parts[0]+"."+parts[1], signature); err != nil {
+		return err
+	}
+
+	var lifetime struct {
+		ExpiresAt int64 `json:"exp"`
+		NotBefore int64 `json:"nbf"`
+	}
+	if err = decodeSegment(parts[1], &lifetime); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	if lifetime.ExpiresAt != 0 && now.After(time.Unix(lifetime.ExpiresAt, 0).Add(leeway)) {
+		return ErrExpired
+	} else if lifetime.NotBefore != 0 && now.Before(time.Unix(lifetime.NotBefore, 0).Add(-leeway)) {
+		return fmt.Errorf("%w: not valid yet", ErrInvalidToken)
+	}
+
+	return decodeSegment(parts[1], claims)
+}
+
+// Allows returns if the claims permit role on streamKey
+func (c *Claims) Allows(role, streamKey string) bool {
+	if c.Role != role {
+		return false
+	}
+
+	for _, s := range c.Streams {
+		if s == "*" || s == streamKey {
+			return true
+		}
+	}
+
+	return false
+}
+
+func decodeSegment(segment string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return ErrInvalidToken
+	}
+
+	if err = json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidToken, err)
+	}
+
+	return nil
+}
+
+func (v *Verifier) verifySignature(h header, signed string, signature []byte) error {
+	hash, err := algHash(h.Alg)
+	if err != nil {
+		return err
+	}
+
+	// The HMAC secret is only used for HS algorithms, so a public key can't be used as one
+	if strings.HasPrefix(h.Alg, "HS") {
+		if len(v.secret) == 0 {
+			return fmt.Errorf("%w: %s isn't accepted", ErrInvalidToken, h.Alg)
+		}
+
+		mac := hmac.New(hash.New, v.secret)
+		mac.Write([]byte(signed))
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return fmt.Errorf("%w: signature doesn't match", ErrInvalidToken)
+		}
+
+		return nil
+	}
+
+	if v.jwks == nil {
+		return fmt.Errorf("%w: %s isn't accepted", ErrInvalidToken, h.Alg)
+	}
+
+	keys, err := v.jwks.keys(h.Kid)
+	if err != nil {
+		return err
+	}
+
+	digester := hash.New()
+	digester.Write([]byte(signed))
+	digest := digester.Sum(nil)
+
+	for _, key := range keys {
+		if verifyWithKey(h.Alg, key, hash, digest, signature) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w: signature doesn't match", ErrInvalidToken)
+}
+
+func algHash(alg string) (crypto.Hash, error) {
+	switch alg {
+	case "HS256", "RS256", "ES256":
+		return crypto.SHA256, nil
+	case "HS384", "RS384", "ES384":
+		return crypto.SHA384, nil
+	case "HS512", "RS512", "ES512":
+		return crypto.SHA512, nil
+	default:
+		return 0, fmt.Errorf("%w: unsupported algorithm %q", ErrInvalidToken, alg)
+	}
+}
+
+func verifyWithKey(alg string, key crypto.PublicKey, hash crypto.Hash, digest, signature []byte) bool {
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		return strings.HasPrefix(alg, "RS") && rsa.VerifyPKCS1v15(key, hash, digest, signature) == nil
+	case *ecdsa.PublicKey:
+		// The signature is r and s as big-endian integers of the curve's size
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if !strings.HasPrefix(alg, "ES") || len(signature) != 2*size {
+			return false
+		}
+
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		return ecdsa.Verify(key, digest, r, s)
+	default:
+		return false
+	}
+}
@@ -0,0 +1,273 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testSecret = "0123456789abcdef0123456789abcdef"
+
+func encodeSegment(t *testing.T, v any) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// newToken returns a token of header and claims with the signature sign returns
+func newToken(t *testing.T, header, claims map[string]any, sign func(signed string) []byte) string {
+	signed := encodeSegment(t, header) + "." + encodeSegment(t, claims)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sign(signed))
+}
+
+func hs256(secret []byte) func(string) []byte {
+	return func(signed string) []byte {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(signed))
+		return mac.Sum(nil)
+	}
+}
+
+func rs256(key *rsa.PrivateKey) func(string) []byte {
+	return func(signed string) []byte {
+		digest := sha256.Sum256([]byte(signed))
+		signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		if err != nil {
+			panic(err)
+		}
+		return signature
+	}
+}
+
+func es256(key *ecdsa.PrivateKey) func(string) []byte {
+	return func(signed string) []byte {
+		digest := sha256.Sum256([]byte(signed))
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		if err != nil {
+			panic(err)
+		}
+		return append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+}
+
+func validClaims() map[string]any {
+	return map[string]any{"streams": []string{"live"}, "role": RolePublish, "exp": time.Now().Add(time.Hour).Unix()}
+}
+
+// serveJWKS serves the public keys of rsaKey as `rsa` and ecKey as `ec`
+func serveJWKS(t *testing.T, rsaKey *rsa.PrivateKey, ecKey *ecdsa.PrivateKey) string {
+	encode := func(i *big.Int) string {
+		return base64.RawURLEncoding.EncodeToString(i.Bytes())
+	}
+
+	set, err := json.Marshal(map[string]any{"keys": []map[string]string{
+		{"kty": "RSA", "kid": "rsa", "use": "sig", "n": encode(rsaKey.N), "e": encode(big.NewInt(int64(rsaKey.E)))},
+		{"kty": "EC", "kid": "ec", "crv": "P-256", "x": encode(ecKey.X), "y": encode(ecKey.Y)},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, _ *http.Request) {
+		_, _ = res.Write(set)
+	}))
+	t.Cleanup(server.Close)
+
+	return server.URL
+}
+
+func TestHMAC(t *testing.T) {
+	v, err := NewVerifier(testSecret, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims, err := v.Verify(newToken(t, map[string]any{"alg": "HS256", "typ": "JWT"}, validClaims(), hs256([]byte(testSecret))))
+	if err != nil {
+		t.Fatal(err)
+	} else if !claims.Allows(RolePublish, "live") || claims.Allows(RoleView, "live") || claims.Allows(RolePublish, "other") {
+		t.Fatalf("unexpected claims %+v", claims)
+	}
+
+	if _, err = v.Verify(newToken(t, map[string]any{"alg": "HS256"}, validClaims(), hs256([]byte("wrong secret")))); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("token of another secret returned %v", err)
+	}
+}
+
+func TestAlgNone(t *testing.T) {
+	v, err := NewVerifier(testSecret, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, alg := range []string{"none", "None", "NONE", ""} {
+		unsigned := func(string) []byte { return nil }
+		if _, err = v.Verify(newToken(t, map[string]any{"alg": alg}, validClaims(), unsigned)); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("unsigned token with alg %q returned %v", alg, err)
+		}
+
+		// The HMAC of the secret as signature doesn't make alg none acceptable either
+		if _, err = v.Verify(newToken(t, map[string]any{"alg": alg}, validClaims(), hs256([]byte(testSecret)))); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("token with alg %q and a signature returned %v", alg, err)
+		}
+	}
+}
+
+func TestKeyTypeConfusion(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jwksURL := serveJWKS(t, rsaKey, ecKey)
+	jwksOnly, err := NewVerifier("", jwksURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	both, err := NewVerifier(testSecret, jwksURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, v := range []*Verifier{jwksOnly, both} {
+		if _, err = v.Verify(newToken(t, map[string]any{"alg": "RS256", "kid": "rsa"}, validClaims(), rs256(rsaKey))); err != nil {
+			t.Fatalf("RS256 token returned %v", err)
+		}
+		if _, err = v.Verify(newToken(t, map[string]any{"alg": "ES256", "kid": "ec"}, validClaims(), es256(ecKey))); err != nil {
+			t.Fatalf("ES256 token returned %v", err)
+		}
+	}
+
+	publicKeyDER, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKeyPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicKeyDER})
+
+	for name, c := range map[string]struct {
+		header map[string]any
+		sign   func(string) []byte
+	}{
+		// The public key used as the HMAC secret, which a verifier that doesn't tie keys to
+		// algorithms accepts
+		"HS256 with the RSA key PEM": {map[string]any{"alg": "HS256", "kid": "rsa"}, hs256(publicKeyPEM)},
+		"HS256 with the RSA key DER": {map[string]any{"alg": "HS256", "kid": "rsa"}, hs256(publicKeyDER)},
+		"HS256 with the modulus":     {map[string]any{"alg": "HS256", "kid": "rsa"}, hs256(rsaKey.N.Bytes())},
+		"RS256 with the HMAC secret": {map[string]any{"alg": "RS256", "kid": "rsa"}, hs256([]byte(testSecret))},
+		"ES256 of the RSA key":       {map[string]any{"alg": "ES256", "kid": "rsa"}, rs256(rsaKey)},
+		"RS256 of the EC key":        {map[string]any{"alg": "RS256", "kid": "ec"}, es256(ecKey)},
+		"ES256 signed with RSA":      {map[string]any{"alg": "ES256", "kid": "ec"}, rs256(rsaKey)},
+		"PS256 of the RSA key":       {map[string]any{"alg": "PS256", "kid": "rsa"}, rs256(rsaKey)},
+		"unknown kid":                {map[string]any{"alg": "RS256", "kid": "missing"}, rs256(rsaKey)},
+	} {
+		if _, err = jwksOnly.Verify(newToken(t, c.header, validClaims(), c.sign)); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("%s was accepted without a secret: %v", name, err)
+		}
+		if _, err = both.Verify(newToken(t, c.header, validClaims(), c.sign)); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("%s was accepted with a secret: %v", name, err)
+		}
+	}
+}
+
+func TestLifetime(t *testing.T) {
+	v, err := NewVerifier(testSecret, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	for name, c := range map[string]struct {
+		claims map[string]any
+		err    error
+	}{
+		"no lifetime":               {map[string]any{"role": RoleView}, nil},
+		"expired":                   {map[string]any{"exp": now.Add(-time.Hour).Unix()}, ErrExpired},
+		"expired beyond the leeway": {map[string]any{"exp": now.Add(-leeway - 5*time.Second).Unix()}, ErrExpired},
+		"expired within the leeway": {map[string]any{"exp": now.Add(-leeway + 5*time.Second).Unix()}, nil},
+		"not valid yet":             {map[string]any{"nbf": now.Add(time.Hour).Unix()}, ErrInvalidToken},
+		"nbf beyond the leeway":     {map[string]any{"nbf": now.Add(leeway + 5*time.Second).Unix()}, ErrInvalidToken},
+		"nbf within the leeway":     {map[string]any{"nbf": now.Add(leeway - 5*time.Second).Unix()}, nil},
+		"valid":                     {map[string]any{"nbf": now.Add(-time.Minute).Unix(), "exp": now.Add(time.Minute).Unix()}, nil},
+		"exp isn't a number":        {map[string]any{"exp": "tomorrow"}, ErrInvalidToken},
+	} {
+		_, err = v.Verify(newToken(t, map[string]any{"alg": "HS256"}, c.claims, hs256([]byte(testSecret))))
+		if (c.err == nil && err != nil) || !errors.Is(err, c.err) {
+			t.Errorf("%s returned %v, want %v", name, err, c.err)
+		}
+	}
+}
+
+func TestTampered(t *testing.T) {
+	v, err := NewVerifier(testSecret, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token := newToken(t, map[string]any{"alg": "HS256"}, validClaims(), hs256([]byte(testSecret)))
+	if _, err = v.Verify(token); err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(token, ".")
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	flipped := append([]byte(nil), signature...)
+	flipped[len(flipped)-1] ^= 1
+
+	otherClaims := validClaims()
+	otherClaims["streams"] = []string{"*"}
+
+	for name, tampered := range map[string]string{
+		"flipped signature bit": parts[0] + "." + parts[1] + "." + base64.RawURLEncoding.EncodeToString(flipped),
+		"truncated signature":   parts[0] + "." + parts[1] + "." + base64.RawURLEncoding.EncodeToString(signature[:16]),
+		"empty signature":       parts[0] + "." + parts[1] + ".",
+		"other claims":          parts[0] + "." + encodeSegment(t, otherClaims) + "." + parts[2],
+		"other header":          encodeSegment(t, map[string]any{"alg": "HS512"}) + "." + parts[1] + "." + parts[2],
+		"padded signature":      token + "=",
+		"missing signature":     parts[0] + "." + parts[1],
+		"extra segment":         token + ".x",
+		"invalid base64":        parts[0] + ".!!!." + parts[2],
+	} {
+		if _, err = v.Verify(tampered); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("%s returned %v", name, err)
+		}
+	}
+}
+
+func TestIsJWT(t *testing.T) {
+	for token, isJWT := range map[string]bool{
+		newToken(t, map[string]any{"alg": "HS256"}, validClaims(), hs256([]byte(testSecret))): true,
+		"live":            false,
+		"a.b.c":           false,
+		"eyJ9.e30.":       false,
+		"eyJhbGciOiJ9.x.": false,
+	} {
+		if IsJWT(token) != isJWT {
+			t.Errorf("IsJWT(%q) != %v", token, isJWT)
+		}
+	}
+}
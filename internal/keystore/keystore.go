@@ -0,0 +1,322 @@
+// Package keystore keeps the stream keys publishers may use in a SQLite database. A stream key
+// can instead be published with a generated key of which only a bcrypt hash is stored, so a
+// copy of the database doesn't allow publishing.
+package keystore
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	_ "modernc.org/sqlite" // Registers the `sqlite` driver
+)
+
+const schema = `CREATE TABLE IF NOT EXISTS stream_keys (
+	key         TEXT PRIMARY KEY,
+	description TEXT NOT NULL DEFAULT '',
+	metadata    TEXT NOT NULL DEFAULT '{}',
+	disabled    INTEGER NOT NULL DEFAULT 0,
+	created_at  INTEGER NOT NULL
+)`
+
+// Columns added after the first release, databases created before get them on Open
+var migrations = []string{
+	`ALTER TABLE stream_keys ADD COLUMN hash_id TEXT`,
+	`ALTER TABLE stream_keys ADD COLUMN hash TEXT`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS stream_keys_hash_id ON stream_keys (hash_id)`,
+}
+
+const (
+	// Generated keys are `bbk_<hash ID>_<secret>`. The hash ID finds the row, so only one
+	// bcrypt comparison is made per attempt
+	generatedKeyPrefix = "bbk"
+	hashIDLength       = 8
+	secretLength       = 24
+
+	keyColumns = `key, description, metadata, disabled, created_at, hash IS NOT NULL`
+)
+
+var (
+	ErrKeyNotFound = errors.New("stream key not found")
+	ErrKeyExists   = errors.New("stream key already exists")
+)
+
+// unknownHash returns the hash secrets of unknown hash IDs are compared with
+var unknownHash = sync.OnceValue(func() []byte {
+	hash, err := bcrypt.GenerateFromPassword(make([]byte, 2*secretLength), bcrypt.DefaultCost)
+	if err != nil {
+		panic(err)
+	}
+
+	return hash
+})
+
+type (
+	// Key is a stream key and what it is for
+	Key struct {
+		Key         string            `json:"key"`
+		Description string            `json:"description"`
+		Metadata    map[string]string `json:"metadata"`
+		Disabled    bool              `json:"disabled"`
+		CreatedAt   time.Time         `json:"createdAt"`
+
+		// Only published with the key generated by GenerateKey, the stream key alone is rejected
+		Hashed bool `json:"hashed"`
+	}
+
+	// Update changes the fields of a Key that are set
+	Update struct {
+		Description *string            `json:"description"`
+		Metadata    *map[string]string `json:"metadata"`
+		Disabled    *bool              `json:"disabled"`
+	}
+
+	Store struct {
+		db *sql.DB
+	}
+)
+
+// Open opens the database at path, it is created if it doesn't exist
+func Open(path string) (*Store, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+
+	// SQLite allows one writer, so connections would only wait on each other
+	db.SetMaxOpenConns(1)
+
+	if _, err = db.Exec(schema); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	for _, migration := range migrations {
+		if _, err = db.Exec(migration); err != nil && !strings.Contains(err.Error(), "duplicate column name") {
+			db.Close()
+			return nil, err
+		}
+	}
+
+	return &Store{db: db}, nil
+}
+
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// Check returns an error if the stream keys can't be read, like when the database file was
+// removed or is locked
+func (s *Store) Check() error {
+	var count int
+	return s.db.QueryRow(`SELECT COUNT(*) FROM (SELECT 1 FROM stream_keys LIMIT 1)`).Scan(&count)
+}
+
+// Authenticate returns the stream key that key publishes and if it may. key is either a stream
+// key that isn't hashed or a key from GenerateKey.
+func (s *Store) Authenticate(key string) (string, bool, error) {
+	if hashID, secret, ok := parseGeneratedKey(key); ok {
+		var (
+			streamKey string
+			hash      string
+			disabled  bool
+		)
+		err := s.db.QueryRow(`SELECT key, hash, disabled FROM stream_keys WHERE hash_id = ?`, hashID).Scan(&streamKey, &hash, &disabled)
+		if errors.Is(err, sql.ErrNoRows) {
+			// Unknown hash IDs take as long as known ones, so they can't be told apart
+			_ = bcrypt.CompareHashAndPassword(unknownHash(), []byte(secret))
+		} else if err != nil {
+			return "", false, err
+		} else {
+			if bcrypt.CompareHashAndPassword([]byte(hash), []byte(secret)) != nil {
+				return "", false, nil
+			}
+
+			return streamKey, !disabled, nil
+		}
+	}
+
+	var (
+		disabled bool
+		hashed   bool
+	)
+	err := s.db.QueryRow(`SELECT disabled, hash IS NOT NULL FROM stream_keys WHERE key = ?`, key).Scan(&disabled, &hashed)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, err
+	}
+
+	return key, !disabled && !hashed, nil
+}
+
+// GenerateKey returns a new key that publishes streamKey, which is created if it doesn't
+// exist. Only its hash is stored, it replaces any key generated before.
+func (s *Store) GenerateKey(streamKey, description string) (string, error) {
+	hashID, secret := make([]byte, hashIDLength), make([]byte, secretLength)
+	if _, err := rand.Read(hashID); err != nil {
+		return "", err
+	} else if _, err = rand.Read(secret); err != nil {
+		return "", err
+	}
+
+	key := generatedKeyPrefix + "_" + hex.EncodeToString(hashID) + "_" + hex.EncodeToString(secret)
+	hash, err := bcrypt.GenerateFromPassword([]byte(hex.EncodeToString(secret)), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err = s.Get(streamKey); errors.Is(err, ErrKeyNotFound) {
+		if _, err = s.Create(Key{Key: streamKey, Description: description}); err != nil {
+			return "", err
+		}
+	} else if err != nil {
+		return "", err
+	}
+
+	if _, err = s.db.Exec(`UPDATE stream_keys SET hash_id = ?, hash = ? WHERE key = ?`, hex.EncodeToString(hashID), string(hash), streamKey); err != nil {
+		return "", err
+	}
+
+	return key, nil
+}
+
+// parseGeneratedKey returns the hash ID and secret of a key from GenerateKey
+func parseGeneratedKey(key string) (string, string, bool) {
+	parts := strings.Split(key, "_")
+	if len(parts) != 3 || parts[0] != generatedKeyPrefix || len(parts[1]) != 2*hashIDLength || len(parts[2]) != 2*secretLength {
+		return "", "", false
+	}
+
+	return parts[1], parts[2], true
+}
+
+func (s *Store) List() ([]Key, error) {
+	rows, err := s.db.Query(`SELECT ` + keyColumns + ` FROM stream_keys ORDER BY created_at, key`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []Key{}
+	for rows.Next() {
+		k, err := scanKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, *k)
+	}
+
+	return keys, rows.Err()
+}
+
+func (s *Store) Get(key string) (*Key, error) {
+	k, err := scanKey(s.db.QueryRow(`SELECT `+keyColumns+` FROM stream_keys WHERE key = ?`, key))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrKeyNotFound
+	}
+
+	return k, err
+}
+
+// Create adds k, a random key is generated if k.Key is empty
+func (s *Store) Create(k Key) (*Key, error) {
+	if k.Key == "" {
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		k.Key = hex.EncodeToString(b)
+	}
+	if k.Metadata == nil {
+		k.Metadata = map[string]string{}
+	}
+	k.CreatedAt = time.Now().UTC().Truncate(time.Second)
+
+	metadata, err := json.Marshal(k.Metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = s.db.Exec(`INSERT INTO stream_keys (key, description, metadata, disabled, created_at) VALUES (?, ?, ?, ?, ?)`,
+		k.Key, k.Description, string(metadata), k.Disabled, k.CreatedAt.Unix())
+	if err != nil && strings.Contains(err.Error(), "UNIQUE constraint failed") {
+		return nil, ErrKeyExists
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &k, nil
+}
+
+// Update applies u to key and returns the result
+func (s *Store) Update(key string, u Update) (*Key, error) {
+	k, err := s.Get(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Description != nil {
+		k.Description = *u.Description
+	}
+	if u.Metadata != nil {
+		k.Metadata = *u.Metadata
+	}
+	if u.Disabled != nil {
+		k.Disabled = *u.Disabled
+	}
+
+	metadata, err := json.Marshal(k.Metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = s.db.Exec(`UPDATE stream_keys SET description = ?, metadata = ?, disabled = ? WHERE key = ?`,
+		k.Description, string(metadata), k.Disabled, key); err != nil {
+		return nil, err
+	}
+
+	return k, nil
+}
+
+func (s *Store) Delete(key string) error {
+	result, err := s.db.Exec(`DELETE FROM stream_keys WHERE key = ?`, key)
+	if err != nil {
+		return err
+	}
+
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrKeyNotFound
+	}
+
+	return nil
+}
+
+func scanKey(row interface{ Scan(...any) error }) (*Key, error) {
+	var (
+		k         Key
+		metadata  string
+		createdAt int64
+	)
+	if err := row.Scan(&k.Key, &k.Description, &metadata, &k.Disabled, &createdAt, &k.Hashed); err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal([]byte(metadata), &k.Metadata); err != nil {
+		return nil, err
+	}
+	if k.Metadata == nil {
+		k.Metadata = map[string]string{}
+	}
+	k.CreatedAt = time.Unix(createdAt, 0).UTC()
+
+	return &k, nil
+}
@@ -0,0 +1,244 @@
+package keystore
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func openTestStore(t *testing.T) (*Store, string) {
+	path := filepath.Join(t.TempDir(), "keys.db")
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = s.Close() })
+
+	return s, path
+}
+
+func TestKeys(t *testing.T) {
+	s, _ := openTestStore(t)
+
+	created, err := s.Create(Key{Key: "live", Description: "Main stream", Metadata: map[string]string{"owner": "ops"}})
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err = s.Create(Key{Key: "live"}); !errors.Is(err, ErrKeyExists) {
+		t.Fatalf("duplicate key returned %v", err)
+	}
+
+	random, err := s.Create(Key{})
+	if err != nil {
+		t.Fatal(err)
+	} else if len(random.Key) != 32 {
+		t.Fatalf("random key %q", random.Key)
+	}
+
+	got, err := s.Get("live")
+	if err != nil {
+		t.Fatal(err)
+	} else if got.Description != "Main stream" || got.Metadata["owner"] != "ops" || !got.CreatedAt.Equal(created.CreatedAt) || got.Hashed {
+		t.Fatalf("Get returned %+v", got)
+	}
+
+	disabled := true
+	if got, err = s.Update("live", Update{Disabled: &disabled}); err != nil || !got.Disabled || got.Description != "Main stream" {
+		t.Fatalf("Update returned %+v, %v", got, err)
+	}
+
+	if keys, err := s.List(); err != nil || len(keys) != 2 {
+		t.Fatalf("List returned %+v, %v", keys, err)
+	}
+
+	if err = s.Delete("live"); err != nil {
+		t.Fatal(err)
+	} else if err = s.Delete("live"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("deleting a missing key returned %v", err)
+	} else if _, err = s.Get("live"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("Get of a deleted key returned %v", err)
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	s, _ := openTestStore(t)
+	if _, err := s.Create(Key{Key: "live"}); err != nil {
+		t.Fatal(err)
+	} else if _, err = s.Create(Key{Key: "off", Disabled: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	for key, allowed := range map[string]bool{
+		"live":        true,
+		"off":         false,
+		"LIVE":        false,
+		"live ":       false,
+		"liv":         false,
+		"":            false,
+		"missing":     false,
+		"' OR 1=1 --": false,
+	} {
+		streamKey, ok, err := s.Authenticate(key)
+		if err != nil {
+			t.Fatal(err)
+		} else if ok != allowed || (ok && streamKey != key) {
+			t.Errorf("Authenticate(%q) returned %q, %v", key, streamKey, ok)
+		}
+	}
+}
+
+func TestMigration(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.db")
+
+	// A database of the first release, without the hash columns
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err = db.Exec(schema); err != nil {
+		t.Fatal(err)
+	} else if _, err = db.Exec(`INSERT INTO stream_keys (key, created_at) VALUES ('old', 0)`); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	for i := 0; i < 2; i++ {
+		s, err := Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, ok, err := s.Authenticate("old"); err != nil || !ok {
+			t.Fatalf("key of the old database returned %v, %v", ok, err)
+		}
+		s.Close()
+	}
+}
+
+func TestGeneratedKey(t *testing.T) {
+	s, path := openTestStore(t)
+
+	key, err := s.GenerateKey("live", "Encoder")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hashID, secret, ok := parseGeneratedKey(key)
+	if !ok {
+		t.Fatalf("generated key %q can't be parsed", key)
+	}
+
+	if streamKey, ok, err := s.Authenticate(key); err != nil || !ok || streamKey != "live" {
+		t.Fatalf("generated key returned %q, %v, %v", streamKey, ok, err)
+	}
+	if k, err := s.Get("live"); err != nil || !k.Hashed || k.Description != "Encoder" {
+		t.Fatalf("stream key of the generated key is %+v, %v", k, err)
+	}
+
+	otherHashID := strings.Repeat("0", len(hashID))
+	flippedSecret := secret[:len(secret)-1] + "0"
+	if strings.HasSuffix(secret, "0") {
+		flippedSecret = secret[:len(secret)-1] + "1"
+	}
+	for name, wrong := range map[string]string{
+		"stream key":      "live",
+		"other secret":    generatedKeyPrefix + "_" + hashID + "_" + flippedSecret,
+		"other hash ID":   generatedKeyPrefix + "_" + otherHashID + "_" + secret,
+		"uppercase":       strings.ToUpper(key),
+		"truncated":       key[:len(key)-1],
+		"hash ID only":    generatedKeyPrefix + "_" + hashID,
+		"other prefix":    "bbx_" + hashID + "_" + secret,
+		"secret as a key": secret,
+	} {
+		if streamKey, ok, err := s.Authenticate(wrong); err != nil || ok {
+			t.Errorf("%s returned %q, %v, %v", name, streamKey, ok, err)
+		}
+	}
+
+	disabled := true
+	if _, err = s.Update("live", Update{Disabled: &disabled}); err != nil {
+		t.Fatal(err)
+	} else if _, ok, err := s.Authenticate(key); err != nil || ok {
+		t.Fatalf("key of a disabled stream key returned %v, %v", ok, err)
+	}
+
+	// Only the hash is stored, the database doesn't have the secret
+	var storedHashID, hash string
+	if err = s.db.QueryRow(`SELECT hash_id, hash FROM stream_keys WHERE key = 'live'`).Scan(&storedHashID, &hash); err != nil {
+		t.Fatal(err)
+	} else if storedHashID != hashID || strings.Contains(hash, secret) {
+		t.Fatalf("stored %q and %q for %q", storedHashID, hash, key)
+	} else if cost, err := bcrypt.Cost([]byte(hash)); err != nil || cost < bcrypt.DefaultCost {
+		t.Fatalf("hash %q has the cost %d, %v", hash, cost, err)
+	}
+
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{path, path + "-wal", path + "-journal"} {
+		data, err := os.ReadFile(file)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			t.Fatal(err)
+		}
+
+		if bytes.Contains(data, []byte(secret)) || bytes.Contains(data, []byte(key)) {
+			t.Fatalf("%s contains the secret", file)
+		}
+	}
+}
+
+func TestGenerateKeyReplaces(t *testing.T) {
+	s, _ := openTestStore(t)
+
+	first, err := s.GenerateKey("live", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := s.GenerateKey("live", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok, err := s.Authenticate(first); err != nil || ok {
+		t.Fatalf("replaced key returned %v, %v", ok, err)
+	} else if _, ok, err = s.Authenticate(second); err != nil || !ok {
+		t.Fatalf("new key returned %v, %v", ok, err)
+	}
+}
+
+// An unknown hash ID is compared with a hash too, so it takes about as long as a wrong secret
+func TestUnknownHashIDTakesAsLong(t *testing.T) {
+	s, _ := openTestStore(t)
+
+	key, err := s.GenerateKey("live", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashID, secret, _ := parseGeneratedKey(key)
+	unknown := generatedKeyPrefix + "_" + strings.Repeat("0", len(hashID)) + "_" + secret
+	wrongSecret := generatedKeyPrefix + "_" + hashID + "_" + strings.Repeat("0", len(secret))
+
+	measure := func(key string) time.Duration {
+		fastest := time.Duration(1 << 62)
+		for i := 0; i < 3; i++ {
+			start := time.Now()
+			if _, ok, err := s.Authenticate(key); err != nil || ok {
+				t.Fatalf("%q returned %v, %v", key, ok, err)
+			}
+			fastest = min(fastest, time.Since(start))
+		}
+		return fastest
+	}
+
+	measure(unknown)
+	if unknownTime, wrongTime := measure(unknown), measure(wrongSecret); unknownTime < wrongTime/4 {
+		t.Fatalf("unknown hash ID took %v, a wrong secret %v", unknownTime, wrongTime)
+	}
+}
@@ -0,0 +1,183 @@
+package logging
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Suffix of rotated files, which sorts in the order they were rotated
+const rotatedSuffixFormat = "20060102-150405.000"
+
+type (
+	rotationConfig struct {
+		maxBytes   int64
+		interval   time.Duration
+		maxBackups int
+	}
+
+	// rotatingFile appends to a file that is renamed to `<path>.<time>` once it is larger than
+	// maxBytes or older than interval, keeping maxBackups of the renamed files
+	rotatingFile struct {
+		path   string
+		config rotationConfig
+
+		lock   sync.Mutex
+		file   *os.File
+		size   int64
+		opened time.Time
+	}
+)
+
+// OpenFile opens path to append logs to, rotated with LOG_FILE_MAX_BYTES,
+// LOG_FILE_ROTATE_INTERVAL and LOG_FILE_MAX_BACKUPS like LOG_FILE
+func OpenFile(path string) (io.Writer, error) {
+	config, err := rotationConfigFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	f := &rotatingFile{path: path, config: config}
+	if err = f.open(); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func rotationConfigFromEnv() (c rotationConfig, err error) {
+	if val := os.Getenv("LOG_FILE_MAX_BYTES"); val != "" {
+		if c.maxBytes, err = parseByteSize(val); err != nil {
+			return c, fmt.Errorf("LOG_FILE_MAX_BYTES: %w", err)
+		}
+	}
+
+	if val := os.Getenv("LOG_FILE_ROTATE_INTERVAL"); val != "" {
+		if c.interval, err = time.ParseDuration(val); err != nil {
+			return c, fmt.Errorf("LOG_FILE_ROTATE_INTERVAL: %w", err)
+		} else if c.interval < 0 {
+			return c, fmt.Errorf("LOG_FILE_ROTATE_INTERVAL must not be negative, got %s", val)
+		}
+	}
+
+	if val := os.Getenv("LOG_FILE_MAX_BACKUPS"); val != "" {
+		if c.maxBackups, err = strconv.Atoi(val); err != nil {
+			return c, fmt.Errorf("LOG_FILE_MAX_BACKUPS: %w", err)
+		} else if c.maxBackups < 0 {
+			return c, fmt.Errorf("LOG_FILE_MAX_BACKUPS must not be negative, got %d", c.maxBackups)
+		}
+	}
+
+	return c, nil
+}
+
+// parseByteSize parses a size like `100M`, `K`, `M`, `G` and `T` are powers of 1024
+func parseByteSize(val string) (int64, error) {
+	multiplier := int64(1)
+	if i := strings.IndexAny(val, "KMGT"); i != -1 && i == len(val)-1 {
+		multiplier = 1 << (10 * (strings.Index("KMGT", val[i:]) + 1))
+		val = val[:i]
+	}
+
+	size, err := strconv.ParseInt(val, 10, 64)
+	if err != nil {
+		return 0, err
+	} else if size < 0 {
+		return 0, fmt.Errorf("size must not be negative, got %d", size)
+	}
+
+	return size * multiplier, nil
+}
+
+// open opens the file at path, which counts as opened when it was last modified if it exists
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	f.file, f.size, f.opened = file, info.Size(), time.Now()
+	if info.Size() > 0 {
+		f.opened = info.ModTime()
+	}
+
+	return nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.size > 0 && f.needsRotation(int64(len(p))) {
+		if err := f.rotate(); err != nil {
+			// Keep appending to the current file rather than losing logs
+			fmt.Fprintf(os.Stderr, "Failed to rotate %s: %s\n", f.path, err)
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *rotatingFile) needsRotation(size int64) bool {
+	return (f.config.maxBytes > 0 && f.size+size > f.config.maxBytes) ||
+		(f.config.interval > 0 && time.Since(f.opened) >= f.config.interval)
+}
+
+func (f *rotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+
+	rotatedPath := f.path + "." + time.Now().Format(rotatedSuffixFormat)
+	renameErr := os.Rename(f.path, rotatedPath)
+	if err := f.open(); err != nil {
+		return err
+	} else if renameErr != nil {
+		return renameErr
+	}
+
+	return f.pruneBackups()
+}
+
+// pruneBackups deletes the oldest rotated files beyond maxBackups
+func (f *rotatingFile) pruneBackups() error {
+	if f.config.maxBackups == 0 {
+		return nil
+	}
+
+	backups, err := filepath.Glob(f.path + ".*")
+	if err != nil {
+		return err
+	}
+
+	rotated := backups[:0]
+	for _, backup := range backups {
+		if _, err := time.Parse(rotatedSuffixFormat, strings.TrimPrefix(backup, f.path+".")); err == nil {
+			rotated = append(rotated, backup)
+		}
+	}
+	sort.Strings(rotated)
+
+	for len(rotated) > f.config.maxBackups {
+		if err := os.Remove(rotated[0]); err != nil {
+			return err
+		}
+		rotated = rotated[1:]
+	}
+
+	return nil
+}
@@ -0,0 +1,168 @@
+// Package logging configures log/slog with LOG_FORMAT, LOG_LEVEL and LOG_LEVELS. Every
+// component logs with its own Logger, which LOG_LEVELS can give another level than the rest.
+// Loggers can be created before Configure, they use the configuration of the time they log.
+// Logs go to stderr, or to the rotated LOG_FILE, and to syslog as well with LOG_SYSLOG.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"sync/atomic"
+)
+
+type (
+	config struct {
+		handler         slog.Handler
+		level           slog.Level
+		componentLevels map[string]slog.Level
+	}
+
+	// componentHandler passes the records of a component that are enabled to the handler of the
+	// current config
+	componentHandler struct {
+		component string
+
+		// WithAttrs and WithGroup calls, applied to the handler of the current config
+		ops      []func(slog.Handler) slog.Handler
+		resolved atomic.Pointer[resolvedHandler]
+	}
+
+	resolvedHandler struct {
+		config  *config
+		handler slog.Handler
+	}
+)
+
+var current atomic.Pointer[config]
+
+func init() {
+	current.Store(&config{handler: newHandler(os.Stderr, false), level: slog.LevelInfo})
+}
+
+// Configure logs with the format and levels of the environment. Output of the log package goes
+// through it as well, at the info level.
+func Configure() error {
+	c := &config{componentLevels: map[string]slog.Level{}}
+
+	var out io.Writer = os.Stderr
+	if path := os.Getenv("LOG_FILE"); path != "" {
+		file, err := OpenFile(path)
+		if err != nil {
+			return fmt.Errorf("LOG_FILE: %w", err)
+		}
+		out = file
+	}
+
+	switch format := os.Getenv("LOG_FORMAT"); format {
+	case "", "text":
+		c.handler = newHandler(out, false)
+	case "json":
+		c.handler = newHandler(out, true)
+	default:
+		return fmt.Errorf("LOG_FORMAT must be `text` or `json`, got `%s`", format)
+	}
+
+	if target := os.Getenv("LOG_SYSLOG"); target != "" {
+		syslog, err := newSyslogHandler(target)
+		if err != nil {
+			return fmt.Errorf("LOG_SYSLOG: %w", err)
+		}
+		c.handler = multiHandler{c.handler, syslog}
+	}
+
+	if val := os.Getenv("LOG_LEVEL"); val != "" {
+		if err := c.level.UnmarshalText([]byte(val)); err != nil {
+			return fmt.Errorf("LOG_LEVEL: %w", err)
+		}
+	}
+
+	if val := os.Getenv("LOG_LEVELS"); val != "" {
+		for _, entry := range strings.Split(val, "|") {
+			component, levelText, ok := strings.Cut(entry, "=")
+			if !ok {
+				return fmt.Errorf("LOG_LEVELS entries must be formatted as `component=level`, got `%s`", entry)
+			}
+
+			var level slog.Level
+			if err := level.UnmarshalText([]byte(levelText)); err != nil {
+				return fmt.Errorf("LOG_LEVELS: %w", err)
+			}
+			c.componentLevels[component] = level
+		}
+	}
+
+	current.Store(c)
+	slog.SetDefault(slog.New(&componentHandler{}))
+	return nil
+}
+
+// Levels are filtered by componentHandler, so the handler itself passes everything
+func newHandler(out io.Writer, json bool) slog.Handler {
+	opts := &slog.HandlerOptions{Level: slog.LevelDebug}
+	if json {
+		return slog.NewJSONHandler(out, opts)
+	}
+
+	return slog.NewTextHandler(out, opts)
+}
+
+// Logger returns the Logger of component, like `webrtc` or `rtmp`. Its records have the
+// component as an attribute.
+func Logger(component string) *slog.Logger {
+	return slog.New(&componentHandler{component: component}).With("component", component)
+}
+
+// Fatal logs msg as an error and exits
+func Fatal(logger *slog.Logger, msg string, args ...any) {
+	logger.Error(msg, args...)
+	os.Exit(1)
+}
+
+func (c *config) levelOf(component string) slog.Level {
+	if level, ok := c.componentLevels[component]; ok {
+		return level
+	}
+
+	return c.level
+}
+
+func (h *componentHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= current.Load().levelOf(h.component)
+}
+
+func (h *componentHandler) Handle(ctx context.Context, r slog.Record) error {
+	return h.handler().Handle(ctx, r)
+}
+
+// handler returns the handler of the current config with the attributes and groups of h
+func (h *componentHandler) handler() slog.Handler {
+	c := current.Load()
+	if resolved := h.resolved.Load(); resolved != nil && resolved.config == c {
+		return resolved.handler
+	}
+
+	handler := c.handler
+	for _, op := range h.ops {
+		handler = op(handler)
+	}
+	h.resolved.Store(&resolvedHandler{config: c, handler: handler})
+
+	return handler
+}
+
+func (h *componentHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.with(func(next slog.Handler) slog.Handler { return next.WithAttrs(attrs) })
+}
+
+func (h *componentHandler) WithGroup(name string) slog.Handler {
+	return h.with(func(next slog.Handler) slog.Handler { return next.WithGroup(name) })
+}
+
+func (h *componentHandler) with(op func(slog.Handler) slog.Handler) *componentHandler {
+	return &componentHandler{component: h.component, ops: append(slices.Clip(h.ops), op)}
+}
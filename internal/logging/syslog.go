@@ -0,0 +1,205 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	syslogFacilityDaemon = 3
+	syslogTag            = "broadcast-box"
+	syslogDialTimeout    = 5 * time.Second
+)
+
+// Sockets of the local syslog daemon, which journald listens on as well
+var localSyslogPaths = []string{"/dev/log", "/var/run/syslog", "/var/run/log"}
+
+type (
+	// syslogConn sends each log line to a syslog daemon as a message with the severity of
+	// the record that is being handled
+	syslogConn struct {
+		network, addr string
+		local         bool
+		hostname      string
+
+		lock     sync.Mutex
+		conn     net.Conn
+		severity int
+	}
+
+	// syslogHandler formats records with a text handler that writes to conn
+	syslogHandler struct {
+		conn    *syslogConn
+		handler slog.Handler
+	}
+
+	// multiHandler passes records to each of its handlers
+	multiHandler []slog.Handler
+)
+
+// newSyslogHandler returns a handler that logs to the local syslog daemon for `local`, or to
+// a URL like `udp://logs.example.com:514`
+func newSyslogHandler(target string) (*syslogHandler, error) {
+	c := &syslogConn{local: target == "local"}
+	if !c.local {
+		u, err := url.Parse(target)
+		if err != nil {
+			return nil, err
+		} else if u.Scheme != "udp" && u.Scheme != "tcp" || u.Host == "" {
+			return nil, fmt.Errorf("must be `local` or a `udp://` or `tcp://` address, got `%s`", target)
+		}
+
+		c.network, c.addr = u.Scheme, u.Host
+		c.hostname, _ = os.Hostname()
+	}
+
+	if err := c.dial(); err != nil {
+		return nil, err
+	}
+
+	return &syslogHandler{
+		conn: c,
+		handler: slog.NewTextHandler(c, &slog.HandlerOptions{
+			Level: slog.LevelDebug,
+
+			// The syslog header has the time already
+			ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+				if len(groups) == 0 && a.Key == slog.TimeKey {
+					return slog.Attr{}
+				}
+				return a
+			},
+		}),
+	}, nil
+}
+
+func (c *syslogConn) dial() (err error) {
+	if c.conn != nil {
+		_ = c.conn.Close()
+		c.conn = nil
+	}
+
+	if !c.local {
+		c.conn, err = net.DialTimeout(c.network, c.addr, syslogDialTimeout)
+		return err
+	}
+
+	for _, path := range localSyslogPaths {
+		for _, network := range []string{"unixgram", "unix"} {
+			if c.conn, err = net.DialTimeout(network, path, syslogDialTimeout); err == nil {
+				return nil
+			}
+		}
+	}
+
+	return fmt.Errorf("no local syslog daemon found: %w", err)
+}
+
+// Write sends line as one message, in the format of the local daemon or RFC 3164 with a
+// hostname to remote ones
+func (c *syslogConn) Write(line []byte) (int, error) {
+	priority := syslogFacilityDaemon*8 + c.severity
+	msg := strings.TrimSuffix(string(line), "\n")
+
+	// Terminated by a newline, which separates messages over TCP and unix stream sockets
+	var formatted string
+	if c.local {
+		formatted = fmt.Sprintf("<%d>%s %s[%d]: %s\n", priority, time.Now().Format(time.Stamp), syslogTag, os.Getpid(), msg)
+	} else {
+		formatted = fmt.Sprintf("<%d>%s %s %s[%d]: %s\n", priority, time.Now().Format(time.RFC3339), c.hostname, syslogTag, os.Getpid(), msg)
+	}
+
+	// Reconnect once, like after the daemon was restarted
+	for attempt := 0; ; attempt++ {
+		if c.conn != nil {
+			if _, err := c.conn.Write([]byte(formatted)); err == nil || attempt > 0 {
+				return len(line), err
+			}
+		}
+
+		if err := c.dial(); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// syslogSeverity maps slog levels to the syslog severities error, warning, info and debug
+func syslogSeverity(level slog.Level) int {
+	switch {
+	case level >= slog.LevelError:
+		return 3
+	case level >= slog.LevelWarn:
+		return 4
+	case level >= slog.LevelInfo:
+		return 6
+	default:
+		return 7
+	}
+}
+
+func (h *syslogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.handler.Enabled(ctx, level)
+}
+
+func (h *syslogHandler) Handle(ctx context.Context, r slog.Record) error {
+	h.conn.lock.Lock()
+	defer h.conn.lock.Unlock()
+
+	h.conn.severity = syslogSeverity(r.Level)
+	return h.handler.Handle(ctx, r)
+}
+
+func (h *syslogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &syslogHandler{conn: h.conn, handler: h.handler.WithAttrs(attrs)}
+}
+
+func (h *syslogHandler) WithGroup(name string) slog.Handler {
+	return &syslogHandler{conn: h.conn, handler: h.handler.WithGroup(name)}
+}
+
+func (m multiHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, h := range m {
+		if h.Enabled(ctx, level) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Handle passes r to every handler, even if one of them failed
+func (m multiHandler) Handle(ctx context.Context, r slog.Record) error {
+	var firstErr error
+	for _, h := range m {
+		if err := h.Handle(ctx, r.Clone()); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+func (m multiHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	handlers := make(multiHandler, len(m))
+	for i, h := range m {
+		handlers[i] = h.WithAttrs(attrs)
+	}
+
+	return handlers
+}
+
+func (m multiHandler) WithGroup(name string) slog.Handler {
+	handlers := make(multiHandler, len(m))
+	for i, h := range m {
+		handlers[i] = h.WithGroup(name)
+	}
+
+	return handlers
+}
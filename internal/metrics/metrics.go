@@ -0,0 +1,172 @@
+// Package metrics writes metrics in the Prometheus text exposition format. Values are
+// collected when they are scraped, only histograms keep state between scrapes.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ContentType is the Content-Type of the text exposition format
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// DefaultBuckets are the upper bounds in seconds of histograms of request latencies
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type (
+	// Set is the samples of one scrape. Samples of a metric are written together in the order
+	// the metric was first added, whatever order they are added in.
+	Set struct {
+		order    []string
+		families map[string]*family
+	}
+
+	family struct {
+		kind, help string
+		samples    []string
+	}
+
+	// Histogram counts observations in buckets, per value of one label
+	Histogram struct {
+		buckets []float64
+
+		lock   sync.Mutex
+		series map[string]*histogramSeries
+	}
+
+	histogramSeries struct {
+		counts []uint64
+		count  uint64
+		sum    float64
+	}
+)
+
+// Counter adds a sample of a counter, labels are pairs of label names and values
+func (s *Set) Counter(name, help string, value float64, labels ...string) {
+	s.add(name, name, "counter", help, value, labels)
+}
+
+// Gauge adds a sample of a gauge, labels are pairs of label names and values
+func (s *Set) Gauge(name, help string, value float64, labels ...string) {
+	s.add(name, name, "gauge", help, value, labels)
+}
+
+func (s *Set) add(familyName, sampleName, kind, help string, value float64, labels []string) {
+	if s.families == nil {
+		s.families = map[string]*family{}
+	}
+
+	f, ok := s.families[familyName]
+	if !ok {
+		f = &family{kind: kind, help: help}
+		s.families[familyName] = f
+		s.order = append(s.order, familyName)
+	}
+
+	f.samples = append(f.samples, sampleName+formatLabels(labels)+" "+formatValue(value))
+}
+
+// WriteTo writes the samples in the text exposition format
+func (s *Set) WriteTo(w io.Writer) (int64, error) {
+	var b strings.Builder
+	for _, name := range s.order {
+		f := s.families[name]
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", name, escapeHelp(f.help), name, f.kind)
+		for _, sample := range f.samples {
+			b.WriteString(sample)
+			b.WriteByte('\n')
+		}
+	}
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+// NewHistogram returns a Histogram with buckets as the upper bounds, in increasing order
+func NewHistogram(buckets []float64) *Histogram {
+	return &Histogram{buckets: buckets, series: map[string]*histogramSeries{}}
+}
+
+// Observe counts value for labelValue
+func (h *Histogram) Observe(labelValue string, value float64) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	series, ok := h.series[labelValue]
+	if !ok {
+		series = &histogramSeries{counts: make([]uint64, len(h.buckets))}
+		h.series[labelValue] = series
+	}
+
+	for i, upperBound := range h.buckets {
+		if value <= upperBound {
+			series.counts[i]++
+		}
+	}
+	series.count++
+	series.sum += value
+}
+
+// Collect adds the histogram to set as name, with the observed values of labelName
+func (h *Histogram) Collect(set *Set, name, help, labelName string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	labelValues := make([]string, 0, len(h.series))
+	for labelValue := range h.series {
+		labelValues = append(labelValues, labelValue)
+	}
+	sort.Strings(labelValues)
+
+	for _, labelValue := range labelValues {
+		series := h.series[labelValue]
+		for i, upperBound := range h.buckets {
+			set.add(name, name+"_bucket", "histogram", help, float64(series.counts[i]), []string{labelName, labelValue, "le", formatValue(upperBound)})
+		}
+		set.add(name, name+"_bucket", "histogram", help, float64(series.count), []string{labelName, labelValue, "le", "+Inf"})
+		set.add(name, name+"_sum", "histogram", help, series.sum, []string{labelName, labelValue})
+		set.add(name, name+"_count", "histogram", help, float64(series.count), []string{labelName, labelValue})
+	}
+}
+
+func formatLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	var b strings.Builder
+	b.WriteByte('{')
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(labels[i] + `="` + escapeLabelValue(labels[i+1]) + `"`)
+	}
+	b.WriteByte('}')
+
+	return b.String()
+}
+
+func formatValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	}
+
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func escapeHelp(help string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help)
+}
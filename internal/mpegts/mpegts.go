@@ -0,0 +1,324 @@
+// Package mpegts demuxes H264 and Opus out of an MPEG-TS stream, like the one sent by
+// SRT and UDP encoders, and muxes them into one for SRT outputs.
+package mpegts
+
+import (
+	"time"
+
+	"github.com/glimesh/broadcast-box/internal/opus"
+)
+
+const (
+	packetSize = 188
+	syncByte   = 0x47
+
+	pidPAT = 0x0000
+
+	streamTypeH264    = 0x1B
+	streamTypePrivate = 0x06
+
+	descriptorRegistration = 0x05
+
+	// PTS and DTS are 33 bit values at 90kHz
+	ptsClockRate = 90000
+)
+
+// Demuxer reads MPEG-TS packets and calls OnH264 or OnOpus for every complete access unit.
+// Elementary streams of other codecs are skipped.
+type Demuxer struct {
+	OnH264 func(accessUnit []byte, pts time.Duration) error
+	OnOpus func(packet []byte, pts time.Duration) error
+
+	// Set when the PMT lists a stream that can't be forwarded, like AAC audio
+	OnUnsupportedStream func(streamType uint8)
+
+	buffered []byte
+
+	pmtPID          uint16
+	streams         map[uint16]*elementaryStream
+	unsupportedPIDs map[uint16]bool
+}
+
+type elementaryStream struct {
+	isOpus  bool
+	payload []byte
+	started bool
+}
+
+// Write accepts any number of bytes of an MPEG-TS stream
+func (d *Demuxer) Write(b []byte) error {
+	d.buffered = append(d.buffered, b...)
+
+	for len(d.buffered) >= packetSize {
+		if d.buffered[0] != syncByte {
+			// Resynchronize on the next sync byte after a corrupt or partial packet
+			next := 1
+			for next < len(d.buffered) && d.buffered[next] != syncByte {
+				next++
+			}
+			d.buffered = d.buffered[next:]
+			continue
+		}
+
+		err := d.readPacket(d.buffered[:packetSize])
+		d.buffered = d.buffered[packetSize:]
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(d.buffered) == 0 {
+		d.buffered = nil
+	}
+
+	return nil
+}
+
+func (d *Demuxer) readPacket(pkt []byte) error {
+	payloadUnitStart := pkt[1]&0x40 != 0
+	pid := uint16(pkt[1]&0x1F)<<8 | uint16(pkt[2])
+	adaptationFieldControl := (pkt[3] >> 4) & 0x03
+
+	payload := pkt[4:]
+	if adaptationFieldControl&0x02 != 0 {
+		if len(payload) == 0 || int(payload[0]) >= len(payload) {
+			return nil
+		}
+		payload = payload[1+int(payload[0]):]
+	}
+
+	if adaptationFieldControl&0x01 == 0 {
+		return nil
+	}
+
+	switch {
+	case pid == pidPAT:
+		d.readPAT(payload, payloadUnitStart)
+	case pid == d.pmtPID && d.pmtPID != 0:
+		d.readPMT(payload, payloadUnitStart)
+	default:
+		if stream, ok := d.streams[pid]; ok {
+			return d.readPES(stream, payload, payloadUnitStart)
+		}
+	}
+
+	return nil
+}
+
+// readSection returns the section of a PSI packet, the PAT and PMT are expected to fit in one packet
+func readSection(payload []byte, payloadUnitStart bool) []byte {
+	if !payloadUnitStart || len(payload) == 0 || int(payload[0])+1 > len(payload) {
+		return nil
+	}
+	payload = payload[1+int(payload[0]):]
+
+	if len(payload) < 3 {
+		return nil
+	}
+
+	sectionLength := int(payload[1]&0x0F)<<8 | int(payload[2])
+	if 3+sectionLength > len(payload) || sectionLength < 9 {
+		return nil
+	}
+
+	// Skip the header up to last_section_number and drop the CRC
+	return payload[8 : 3+sectionLength-4]
+}
+
+func (d *Demuxer) readPAT(payload []byte, payloadUnitStart bool) {
+	section := readSection(payload, payloadUnitStart)
+	for ; len(section) >= 4; section = section[4:] {
+		programNumber := uint16(section[0])<<8 | uint16(section[1])
+		if programNumber != 0 {
+			d.pmtPID = uint16(section[2]&0x1F)<<8 | uint16(section[3])
+			return
+		}
+	}
+}
+
+func (d *Demuxer) readPMT(payload []byte, payloadUnitStart bool) {
+	section := readSection(payload, payloadUnitStart)
+	if len(section) < 4 {
+		return
+	}
+
+	programInfoLength := int(section[2]&0x0F)<<8 | int(section[3])
+	if 4+programInfoLength > len(section) {
+		return
+	}
+	section = section[4+programInfoLength:]
+
+	streams := map[uint16]*elementaryStream{}
+	for len(section) >= 5 {
+		streamType := section[0]
+		pid := uint16(section[1]&0x1F)<<8 | uint16(section[2])
+		esInfoLength := int(section[3]&0x0F)<<8 | int(section[4])
+		if 5+esInfoLength > len(section) {
+			return
+		}
+		descriptors := section[5 : 5+esInfoLength]
+		section = section[5+esInfoLength:]
+
+		switch {
+		case streamType == streamTypeH264:
+			streams[pid] = &elementaryStream{}
+		case streamType == streamTypePrivate && hasOpusRegistration(descriptors):
+			streams[pid] = &elementaryStream{isOpus: true}
+		case !d.unsupportedPIDs[pid]:
+			// The PMT is repeated, only report each unsupported stream once
+			if d.unsupportedPIDs == nil {
+				d.unsupportedPIDs = map[uint16]bool{}
+			}
+			d.unsupportedPIDs[pid] = true
+
+			if d.OnUnsupportedStream != nil {
+				d.OnUnsupportedStream(streamType)
+			}
+		}
+	}
+
+	// Keep partially received PES packets of streams that are still there
+	for pid, stream := range d.streams {
+		if newStream, ok := streams[pid]; ok && newStream.isOpus == stream.isOpus {
+			streams[pid] = stream
+		}
+	}
+	d.streams = streams
+}
+
+func hasOpusRegistration(descriptors []byte) bool {
+	for len(descriptors) >= 2 {
+		tag, length := descriptors[0], int(descriptors[1])
+		if 2+length > len(descriptors) {
+			return false
+		}
+
+		if tag == descriptorRegistration && length >= 4 && string(descriptors[2:6]) == "Opus" {
+			return true
+		}
+		descriptors = descriptors[2+length:]
+	}
+
+	return false
+}
+
+func (d *Demuxer) readPES(stream *elementaryStream, payload []byte, payloadUnitStart bool) error {
+	if payloadUnitStart {
+		if stream.started {
+			if err := d.flushPES(stream); err != nil {
+				return err
+			}
+		}
+
+		stream.started = true
+		stream.payload = stream.payload[:0]
+	} else if !stream.started {
+		return nil
+	}
+
+	stream.payload = append(stream.payload, payload...)
+
+	// PES packets with a length (usually audio) can be sent without waiting for the next one
+	if len(stream.payload) >= 6 {
+		if pesLength := int(stream.payload[4])<<8 | int(stream.payload[5]); pesLength != 0 && len(stream.payload) >= 6+pesLength {
+			stream.started = false
+			stream.payload = stream.payload[:6+pesLength]
+			return d.flushPES(stream)
+		}
+	}
+
+	return nil
+}
+
+// flushPES sends the access unit of a complete PES packet, corrupt ones are dropped
+func (d *Demuxer) flushPES(stream *elementaryStream) error {
+	pes := stream.payload
+	if len(pes) < 9 || pes[0] != 0 || pes[1] != 0 || pes[2] != 1 {
+		return nil
+	}
+
+	ptsDTSFlags := pes[7] >> 6
+	headerLength := int(pes[8])
+	if 9+headerLength > len(pes) || (ptsDTSFlags&0x02 != 0 && headerLength < 5) {
+		return nil
+	}
+
+	var pts time.Duration
+	if ptsDTSFlags&0x02 != 0 {
+		pts = readTimestamp(pes[9:14])
+	}
+
+	data := pes[9+headerLength:]
+	if stream.isOpus {
+		return d.readOpus(data, pts)
+	}
+
+	if d.OnH264 != nil && len(data) > 0 {
+		return d.OnH264(append([]byte{}, data...), pts)
+	}
+
+	return nil
+}
+
+func readTimestamp(b []byte) time.Duration {
+	ticks := int64(b[0]>>1&0x07)<<30 | int64(b[1])<<22 | int64(b[2]>>1)<<15 | int64(b[3])<<7 | int64(b[4]>>1)
+	return time.Duration(ticks) * time.Second / ptsClockRate
+}
+
+// readOpus splits a PES payload into Opus packets, each follows an opus_control_header
+// as defined in ETSI TS 102 366 Annex A. Corrupt PES packets are dropped like in flushPES.
+func (d *Demuxer) readOpus(data []byte, pts time.Duration) error {
+	for len(data) >= 2 {
+		if data[0] != 0x7F || data[1]&0xE0 != 0xE0 {
+			return nil
+		}
+
+		startTrim, endTrim, controlExtension := data[1]&0x10 != 0, data[1]&0x08 != 0, data[1]&0x04 != 0
+		data = data[2:]
+
+		size := 0
+		for len(data) > 0 {
+			b := data[0]
+			data = data[1:]
+			size += int(b)
+			if b != 0xFF {
+				break
+			}
+		}
+
+		skip := 0
+		if startTrim {
+			skip += 2
+		}
+		if endTrim {
+			skip += 2
+		}
+		if skip > len(data) {
+			return nil
+		}
+		data = data[skip:]
+
+		if controlExtension {
+			if len(data) == 0 || 1+int(data[0]) > len(data) {
+				return nil
+			}
+			data = data[1+int(data[0]):]
+		}
+
+		if size > len(data) {
+			return nil
+		}
+
+		packet := append([]byte{}, data[:size]...)
+		data = data[size:]
+
+		if d.OnOpus != nil && len(packet) > 0 {
+			if err := d.OnOpus(packet, pts); err != nil {
+				return err
+			}
+		}
+		pts += opus.PacketDuration(packet)
+	}
+
+	return nil
+}
@@ -0,0 +1,228 @@
+package mpegts
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Packets as ffmpeg sends them, padded with 0xFF like the stuffing of PSI packets
+var (
+	ffmpegPAT = "474000100000b00d0001c100000001f0002ab104b2"
+	ffmpegPMT = "475000100002b0170001c10000e100f0001be100f0000fe101f0002f44b99b"
+
+	// A keyframe with PCR, PTS 1.4s and DTS
+	ffmpegVideoStart = "474100300750" + "00007b0c7e00" + "000001e0000080c00a310007d861110007a9c1" + "0000000109f0000000016588"
+	ffmpegVideoNext  = "474100310000000001e0000080800521000bb8c1" + "0000000109f0000000014101"
+)
+
+func packet(t testing.TB, hexPacket string) []byte {
+	b, err := hex.DecodeString(hexPacket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return append(b, bytes.Repeat([]byte{0xFF}, packetSize-len(b))...)
+}
+
+type demuxed struct {
+	data []byte
+	pts  time.Duration
+}
+
+func newTestDemuxer() (*Demuxer, *[]demuxed, *[]demuxed, *[]uint8) {
+	h264, opus, unsupported := []demuxed{}, []demuxed{}, []uint8{}
+	return &Demuxer{
+		OnH264: func(accessUnit []byte, pts time.Duration) error {
+			h264 = append(h264, demuxed{accessUnit, pts})
+			return nil
+		},
+		OnOpus: func(packet []byte, pts time.Duration) error {
+			opus = append(opus, demuxed{packet, pts})
+			return nil
+		},
+		OnUnsupportedStream: func(streamType uint8) {
+			unsupported = append(unsupported, streamType)
+		},
+	}, &h264, &opus, &unsupported
+}
+
+func TestDemuxFFmpeg(t *testing.T) {
+	d, h264, _, unsupported := newTestDemuxer()
+
+	stream := [][]byte{packet(t, ffmpegPAT), packet(t, ffmpegPMT), packet(t, ffmpegVideoStart), packet(t, ffmpegPAT), packet(t, ffmpegPMT), packet(t, ffmpegVideoNext)}
+	for _, p := range stream {
+		if err := d.Write(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if d.pmtPID != 0x1000 {
+		t.Fatalf("PMT PID is %#x", d.pmtPID)
+	}
+	if len(*unsupported) != 1 || (*unsupported)[0] != 0x0F {
+		t.Fatalf("unsupported streams %v, AAC is only reported once", *unsupported)
+	}
+
+	// The first access unit ends with the next PES packet, with the stuffing of its packet
+	if len(*h264) != 1 {
+		t.Fatalf("demuxed %d access units", len(*h264))
+	}
+	au := (*h264)[0]
+	if au.pts != 1400*time.Millisecond {
+		t.Fatalf("PTS is %s", au.pts)
+	}
+	if !bytes.HasPrefix(au.data, []byte{0, 0, 0, 1, 0x09, 0xF0, 0, 0, 0, 1, 0x65, 0x88}) || len(au.data) != packetSize-4-8-19 {
+		t.Fatalf("demuxed % x", au.data)
+	}
+}
+
+func TestDemuxResynchronizes(t *testing.T) {
+	d, h264, _, _ := newTestDemuxer()
+
+	stream := append([]byte{0x00, 0x12, 0x34}, packet(t, ffmpegPAT)...)
+	stream = append(stream, packet(t, ffmpegPMT)[:100]...)
+	stream = append(stream, packet(t, ffmpegPMT)...)
+	stream = append(stream, packet(t, ffmpegVideoStart)...)
+	stream = append(stream, packet(t, ffmpegVideoNext)...)
+
+	// In chunks that split packets anywhere
+	for len(stream) > 0 {
+		n := min(len(stream), 61)
+		if err := d.Write(stream[:n]); err != nil {
+			t.Fatal(err)
+		}
+		stream = stream[n:]
+	}
+
+	if len(*h264) != 1 {
+		t.Fatalf("demuxed %d access units", len(*h264))
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	buffer := &bytes.Buffer{}
+	m := NewMuxer(buffer)
+
+	keyframe := []byte{0, 0, 0, 1, 0x67, 0x42, 0, 0x1F, 0, 0, 0, 1, 0x68, 0xCE, 0, 0, 0, 1, 0x65}
+	keyframe = append(keyframe, bytes.Repeat([]byte{0xAB}, 1000)...)
+	opusPackets := [][]byte{{0xFC, 0x01, 0x02}, append([]byte{0xFC}, bytes.Repeat([]byte{0xCD}, 600)...)}
+
+	if err := m.WriteH264(keyframe, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	for i, p := range opusPackets {
+		if err := m.WriteOpus(p, time.Second+time.Duration(i)*20*time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.WriteH264([]byte{0, 0, 0, 1, 0x41, 0x9A}, time.Second+33*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	if buffer.Len()%packetSize != 0 {
+		t.Fatalf("muxed %d bytes", buffer.Len())
+	}
+
+	d, h264, opus, unsupported := newTestDemuxer()
+	if err := d.Write(buffer.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(*unsupported) != 0 {
+		t.Fatalf("unsupported streams %v", *unsupported)
+	}
+	if len(*h264) != 1 || !bytes.Equal((*h264)[0].data, append(append([]byte{}, accessUnitDelimiter...), keyframe...)) || (*h264)[0].pts != time.Second+muxDelay {
+		t.Fatalf("demuxed H264 %v", *h264)
+	}
+	if len(*opus) != len(opusPackets) {
+		t.Fatalf("demuxed %d Opus packets", len(*opus))
+	}
+	for i, p := range *opus {
+		if !bytes.Equal(p.data, opusPackets[i]) || p.pts != time.Second+muxDelay+time.Duration(i)*20*time.Millisecond {
+			t.Fatalf("demuxed Opus packet %d at %s", i, p.pts)
+		}
+	}
+}
+
+func TestReadOpus(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		data    string
+		packets []string
+	}{
+		{"one packet", "7fe003fc0102", []string{"fc0102"}},
+		{"two packets", "7fe001fc7fe002fc01", []string{"fc", "fc01"}},
+		{"trims", "7ff80100000000fc", []string{"fc"}},
+		{"control extension", "7fe401020aabfc", []string{"fc"}},
+		{"size of 255", "7fe0ff00" + strings.Repeat("fc", 255), []string{strings.Repeat("fc", 255)}},
+		{"size of 256", "7fe0ff01" + strings.Repeat("fc", 256), []string{strings.Repeat("fc", 256)}},
+		{"not a control header", "7f0003fc0102", nil},
+		{"truncated packet", "7fe003fc01", nil},
+		{"truncated trims", "7ff0", nil},
+		{"truncated control extension", "7fe40105", nil},
+		{"corrupt second packet", "7fe001fc00", []string{"fc"}},
+		{"empty packet", "7fe000", nil},
+	} {
+		data, err := hex.DecodeString(c.data)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		d, _, opus, _ := newTestDemuxer()
+		if err = d.readOpus(data, 0); err != nil {
+			t.Fatal(err)
+		}
+
+		packets := []string{}
+		for _, p := range *opus {
+			packets = append(packets, hex.EncodeToString(p.data))
+		}
+		if strings.Join(packets, ",") != strings.Join(c.packets, ",") {
+			t.Errorf("%s demuxed %v instead of %v", c.name, packets, c.packets)
+		}
+	}
+}
+
+func FuzzDemuxer(f *testing.F) {
+	buffer := &bytes.Buffer{}
+	m := NewMuxer(buffer)
+	if err := m.WriteH264([]byte{0, 0, 0, 1, 0x65, 0x88}, time.Second); err != nil {
+		f.Fatal(err)
+	}
+	if err := m.WriteOpus([]byte{0xFC, 0x01}, time.Second); err != nil {
+		f.Fatal(err)
+	}
+	f.Add(buffer.Bytes())
+
+	stream := []byte{}
+	for _, p := range []string{ffmpegPAT, ffmpegPMT, ffmpegVideoStart, ffmpegVideoNext} {
+		stream = append(stream, packet(f, p)...)
+	}
+	f.Add(stream)
+
+	f.Fuzz(func(t *testing.T, stream []byte) {
+		d := &Demuxer{
+			OnH264: func(accessUnit []byte, _ time.Duration) error {
+				if len(accessUnit) == 0 {
+					t.Fatal("empty access unit")
+				}
+				return nil
+			},
+			OnOpus: func(packet []byte, _ time.Duration) error {
+				if len(packet) == 0 {
+					t.Fatal("empty Opus packet")
+				}
+				return nil
+			},
+		}
+
+		if err := d.Write(stream); err != nil {
+			t.Fatal(err)
+		}
+		if len(d.buffered) >= packetSize {
+			t.Fatalf("%d bytes are left", len(d.buffered))
+		}
+	})
+}
@@ -0,0 +1,233 @@
+package mpegts
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+const (
+	pidPMT   = 0x1000
+	pidVideo = 0x0100
+	pidOpus  = 0x0101
+
+	tableIDPAT        = 0x00
+	tableIDPMT        = 0x02
+	transportStreamID = 1
+	programNumber     = 1
+
+	streamIDVideo    = 0xE0
+	streamIDPrivate1 = 0xBD
+
+	// Bounded PES packets have a 16 bit length, which includes the 8 bytes after it
+	maxPESPayloadLength = 0xFFFF - 8
+
+	descriptorExtension  = 0x7F
+	extensionOpus        = 0x80
+	opusChannelConfigTwo = 0x02
+
+	naluTypeBitmask = 0x1F
+	naluTypeIDR     = 5
+	naluTypeAUD     = 9
+
+	// Added to every PTS so the PCR, which is the PTS of the video, stays ahead of decoding
+	muxDelay = 700 * time.Millisecond
+)
+
+var accessUnitDelimiter = []byte{0, 0, 0, 1, naluTypeAUD, 0xF0}
+
+// Muxer writes H264 and Opus to w as an MPEG-TS stream with one program. The PAT and PMT are
+// repeated before every keyframe so receivers can join at any of them.
+type Muxer struct {
+	w io.Writer
+
+	continuityCounters map[uint16]byte
+	wrotePSI           bool
+}
+
+func NewMuxer(w io.Writer) *Muxer {
+	return &Muxer{w: w, continuityCounters: map[uint16]byte{}}
+}
+
+// WriteH264 writes an access unit in Annex B format
+func (m *Muxer) WriteH264(accessUnit []byte, pts time.Duration) error {
+	b := []byte{}
+	if keyframe(accessUnit) || !m.wrotePSI {
+		b = m.appendPSI(b)
+	}
+
+	data := accessUnit
+	if !startsWithAUD(accessUnit) {
+		data = append(append([]byte{}, accessUnitDelimiter...), accessUnit...)
+	}
+
+	// Video PES packets are unbounded, so an access unit of any size fits in one
+	b = m.appendPES(b, pidVideo, streamIDVideo, pts, data, true, false)
+	_, err := m.w.Write(b)
+	return err
+}
+
+// WriteOpus writes one Opus packet, prefixed with the opus_control_header of ETSI TS 102 366 Annex A
+func (m *Muxer) WriteOpus(packet []byte, pts time.Duration) error {
+	b := []byte{}
+	if !m.wrotePSI {
+		b = m.appendPSI(b)
+	}
+
+	data := []byte{0x7F, 0xE0}
+	for size := len(packet); ; size -= 0xFF {
+		if size < 0xFF {
+			data = append(data, byte(size))
+			break
+		}
+		data = append(data, 0xFF)
+	}
+	data = append(data, packet...)
+
+	if len(data) > maxPESPayloadLength {
+		return nil
+	}
+
+	b = m.appendPES(b, pidOpus, streamIDPrivate1, pts, data, false, true)
+	_, err := m.w.Write(b)
+	return err
+}
+
+func keyframe(accessUnit []byte) bool {
+	for i := 0; i+3 < len(accessUnit); i++ {
+		if accessUnit[i] == 0 && accessUnit[i+1] == 0 && accessUnit[i+2] == 1 && accessUnit[i+3]&naluTypeBitmask == naluTypeIDR {
+			return true
+		}
+	}
+	return false
+}
+
+func startsWithAUD(accessUnit []byte) bool {
+	for i := 0; i+3 < len(accessUnit) && i < 4; i++ {
+		if accessUnit[i] == 0 && accessUnit[i+1] == 0 && accessUnit[i+2] == 1 {
+			return accessUnit[i+3]&naluTypeBitmask == naluTypeAUD
+		}
+	}
+	return false
+}
+
+func (m *Muxer) appendPSI(b []byte) []byte {
+	m.wrotePSI = true
+
+	pat := binary.BigEndian.AppendUint16(nil, programNumber)
+	pat = binary.BigEndian.AppendUint16(pat, 0xE000|pidPMT)
+	b = m.appendSection(b, pidPAT, tableIDPAT, transportStreamID, pat)
+
+	opusDescriptors := []byte{descriptorRegistration, 4, 'O', 'p', 'u', 's', descriptorExtension, 2, extensionOpus, opusChannelConfigTwo}
+	pmt := binary.BigEndian.AppendUint16(nil, 0xE000|pidVideo)
+	pmt = binary.BigEndian.AppendUint16(pmt, 0xF000)
+	pmt = append(pmt, streamTypeH264)
+	pmt = binary.BigEndian.AppendUint16(pmt, 0xE000|pidVideo)
+	pmt = binary.BigEndian.AppendUint16(pmt, 0xF000)
+	pmt = append(pmt, streamTypePrivate)
+	pmt = binary.BigEndian.AppendUint16(pmt, 0xE000|pidOpus)
+	pmt = binary.BigEndian.AppendUint16(pmt, 0xF000|uint16(len(opusDescriptors)))
+	pmt = append(pmt, opusDescriptors...)
+	return m.appendSection(b, pidPMT, tableIDPMT, programNumber, pmt)
+}
+
+// appendSection appends a PSI section that fits in one packet
+func (m *Muxer) appendSection(b []byte, pid uint16, tableID byte, tableIDExtension uint16, body []byte) []byte {
+	sectionLength := 5 + len(body) + 4
+	section := []byte{0, tableID, 0xB0 | byte(sectionLength>>8), byte(sectionLength)}
+	section = binary.BigEndian.AppendUint16(section, tableIDExtension)
+	section = append(section, 0xC1, 0, 0)
+	section = append(section, body...)
+	section = binary.BigEndian.AppendUint32(section, crc32MPEG2(section[1:]))
+
+	return m.appendPackets(b, pid, section, -1)
+}
+
+func (m *Muxer) appendPES(b []byte, pid uint16, streamID byte, pts time.Duration, data []byte, withPCR, bounded bool) []byte {
+	ticks := int64(pts+muxDelay) * ptsClockRate / int64(time.Second)
+
+	pes := []byte{0, 0, 1, streamID, 0, 0, 0x80, 0x80, 5}
+	pes = appendTimestamp(pes, 0x20, ticks)
+	if bounded {
+		binary.BigEndian.PutUint16(pes[4:], uint16(len(pes)-6+len(data)))
+	}
+	pes = append(pes, data...)
+
+	pcr := int64(-1)
+	if withPCR {
+		pcr = ticks - int64(muxDelay)*ptsClockRate/int64(time.Second)
+	}
+	return m.appendPackets(b, pid, pes, pcr)
+}
+
+func appendTimestamp(b []byte, marker byte, ticks int64) []byte {
+	return append(b,
+		marker|byte(ticks>>29)&0x0E|0x01,
+		byte(ticks>>22),
+		byte(ticks>>14)&0xFE|0x01,
+		byte(ticks>>7),
+		byte(ticks<<1)&0xFE|0x01,
+	)
+}
+
+// appendPackets splits payload into packets of pid, the first packet carries pcr unless it is negative
+func (m *Muxer) appendPackets(b []byte, pid uint16, payload []byte, pcr int64) []byte {
+	for first := true; len(payload) > 0; first = false {
+		header := []byte{syncByte, byte(pid>>8) & 0x1F, byte(pid), 0x10 | m.continuityCounters[pid]}
+		m.continuityCounters[pid] = (m.continuityCounters[pid] + 1) & 0x0F
+
+		var adaptationField []byte
+		if first {
+			header[1] |= 0x40
+			if pcr >= 0 {
+				adaptationField = []byte{0x10, byte(pcr >> 25), byte(pcr >> 17), byte(pcr >> 9), byte(pcr >> 1), byte(pcr<<7) | 0x7E, 0}
+			}
+		}
+
+		space := packetSize - len(header)
+		if adaptationField != nil {
+			space -= 1 + len(adaptationField)
+		}
+
+		// The last packet is filled with stuffing bytes in the adaptation field
+		if stuffing := space - len(payload); stuffing > 0 {
+			if adaptationField == nil {
+				// Its length byte takes the first byte of stuffing
+				adaptationField = []byte{}
+				if stuffing--; stuffing > 0 {
+					adaptationField = append(adaptationField, 0)
+					stuffing--
+				}
+			}
+			adaptationField = append(adaptationField, bytes.Repeat([]byte{0xFF}, stuffing)...)
+			space = len(payload)
+		}
+
+		b = append(b, header...)
+		if adaptationField != nil {
+			b[len(b)-1] |= 0x20
+			b = append(b, byte(len(adaptationField)))
+			b = append(b, adaptationField...)
+		}
+		b = append(b, payload[:space]...)
+		payload = payload[space:]
+	}
+
+	return b
+}
+
+func crc32MPEG2(b []byte) uint32 {
+	crc := uint32(0xFFFFFFFF)
+	for _, v := range b {
+		crc ^= uint32(v) << 24
+		for i := 0; i < 8; i++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04C11DB7
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
@@ -18,7 +18,8 @@ import (
 	internalwebrtc "github.com/glimesh/broadcast-box/internal/webrtc"
 )
 
-func Run(whepHandler func(res http.ResponseWriter, req *http.Request)) error {
+// Run connects to the WHEP endpoint of handler like a viewer would
+func Run(handler http.Handler) error {
 	m := &webrtc.MediaEngine{}
 	if err := internalwebrtc.PopulateMediaEngine(m); err != nil {
 		return err
@@ -57,11 +58,11 @@ func Run(whepHandler func(res http.ResponseWriter, req *http.Request)) error {
 		}
 	})
 
-	req := httptest.NewRequest("POST", "/api/whip", strings.NewReader(offer.SDP))
+	req := httptest.NewRequest("POST", "/api/whep", strings.NewReader(offer.SDP))
 	req.Header["Authorization"] = []string{"Bearer networktest"}
 	recorder := httptest.NewRecorder()
 
-	whepHandler(recorder, req)
+	handler.ServeHTTP(recorder, req)
 	res := recorder.Result()
 
 	if res.StatusCode != 201 {
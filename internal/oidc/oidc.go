@@ -0,0 +1,193 @@
+// Package oidc signs operators in with the authorization code flow of an OpenID Connect
+// provider, like Google, Keycloak or Authentik.
+package oidc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/glimesh/broadcast-box/internal/jwt"
+)
+
+const httpTimeout = 10 * time.Second
+
+// Options of a Provider
+type Options struct {
+	// Issuer URL, `/.well-known/openid-configuration` is appended for discovery
+	Issuer string
+
+	ClientID     string
+	ClientSecret string
+
+	// URL of the callback the provider redirects to, it must be registered with the provider
+	RedirectURL string
+}
+
+type (
+	// Provider is a discovered OpenID Connect provider
+	Provider struct {
+		opts Options
+
+		authorizationEndpoint string
+		tokenEndpoint         string
+		verifier              *jwt.Verifier
+		client                *http.Client
+	}
+
+	// Identity is who signed in
+	Identity struct {
+		Subject       string `json:"sub"`
+		Email         string `json:"email"`
+		EmailVerified bool   `json:"email_verified"`
+	}
+
+	idTokenClaims struct {
+		Identity
+
+		Issuer   string   `json:"iss"`
+		Audience audience `json:"aud"`
+		Nonce    string   `json:"nonce"`
+	}
+
+	// audience is `aud`, a string or an array of them
+	audience []string
+)
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+
+	return json.Unmarshal(data, (*[]string)(a))
+}
+
+// New discovers the endpoints and keys of the provider at opts.Issuer
+func New(opts Options) (*Provider, error) {
+	if opts.Issuer == "" || opts.ClientID == "" || opts.RedirectURL == "" {
+		return nil, errors.New("issuer, client ID and redirect URL are required")
+	}
+
+	p := &Provider{opts: opts, client: &http.Client{Timeout: httpTimeout}}
+
+	resp, err := p.client.Get(strings.TrimSuffix(opts.Issuer, "/") + "/.well-known/openid-configuration")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("discovery of %s failed with %s", opts.Issuer, resp.Status)
+	}
+
+	var discovery struct {
+		Issuer                string `json:"issuer"`
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		JWKSURI               string `json:"jwks_uri"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&discovery); err != nil {
+		return nil, err
+	} else if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.JWKSURI == "" {
+		return nil, fmt.Errorf("discovery of %s is missing endpoints", opts.Issuer)
+	}
+
+	// ID tokens carry the issuer as discovered, which may differ from the configured one by a
+	// trailing slash
+	p.opts.Issuer = discovery.Issuer
+	p.authorizationEndpoint = discovery.AuthorizationEndpoint
+	p.tokenEndpoint = discovery.TokenEndpoint
+	if p.verifier, err = jwt.NewVerifier("", discovery.JWKSURI); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// AuthCodeURL returns the URL of the provider's login page. state and nonce are random values
+// the callback is checked against.
+func (p *Provider) AuthCodeURL(state, nonce string) string {
+	query := url.Values{
+		"response_type": {"code"},
+		"client_id":     {p.opts.ClientID},
+		"redirect_uri":  {p.opts.RedirectURL},
+		"scope":         {"openid email"},
+		"state":         {state},
+		"nonce":         {nonce},
+	}
+
+	separator := "?"
+	if strings.Contains(p.authorizationEndpoint, "?") {
+		separator = "&"
+	}
+
+	return p.authorizationEndpoint + separator + query.Encode()
+}
+
+// Exchange redeems the code the provider redirected back with and returns who signed in
+func (p *Provider) Exchange(ctx context.Context, code, nonce string) (*Identity, error) {
+	form := url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {p.opts.RedirectURL},
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.tokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(p.opts.ClientID), url.QueryEscape(p.opts.ClientSecret))
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token request failed with %s", resp.Status)
+	}
+
+	var token struct {
+		IDToken string `json:"id_token"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return nil, err
+	} else if token.IDToken == "" {
+		return nil, errors.New("token response has no ID token")
+	}
+
+	var claims idTokenClaims
+	if err = p.verifier.Decode(token.IDToken, &claims); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case claims.Issuer != p.opts.Issuer:
+		return nil, fmt.Errorf("ID token is issued by %q", claims.Issuer)
+	case !claims.Audience.contains(p.opts.ClientID):
+		return nil, errors.New("ID token isn't issued to this client")
+	case claims.Nonce != nonce:
+		return nil, errors.New("ID token nonce doesn't match")
+	}
+
+	return &claims.Identity, nil
+}
+
+func (a audience) contains(clientID string) bool {
+	for _, aud := range a {
+		if aud == clientID {
+			return true
+		}
+	}
+
+	return false
+}
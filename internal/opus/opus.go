@@ -0,0 +1,37 @@
+// Package opus reads the durations of Opus packets from their TOC byte, for muxing packets that
+// come from the network and can't be trusted.
+package opus
+
+import "time"
+
+// PacketDuration returns the duration of an Opus packet from its TOC byte, see RFC 6716 section
+// 3.1. Packets too short to have a duration have none.
+func PacketDuration(packet []byte) time.Duration {
+	if len(packet) == 0 {
+		return 0
+	}
+
+	config := packet[0] >> 3
+	var frameDuration time.Duration
+	switch {
+	case config < 12:
+		frameDuration = []time.Duration{10, 20, 40, 60}[config%4] * time.Millisecond
+	case config < 16:
+		frameDuration = []time.Duration{10, 20}[config%2] * time.Millisecond
+	default:
+		frameDuration = []time.Duration{2500, 5000, 10000, 20000}[config%4] * time.Microsecond
+	}
+
+	frames := 1
+	switch packet[0] & 0x03 {
+	case 1, 2:
+		frames = 2
+	case 3:
+		if len(packet) < 2 {
+			return 0
+		}
+		frames = int(packet[1] & 0x3F)
+	}
+
+	return frameDuration * time.Duration(frames)
+}
@@ -0,0 +1,51 @@
+package opus
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPacketDuration(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		packet   []byte
+		duration time.Duration
+	}{
+		// config << 3 | stereo << 2 | code
+		{"SILK NB 10ms", []byte{0 << 3}, 10 * time.Millisecond},
+		{"SILK NB 20ms", []byte{1 << 3}, 20 * time.Millisecond},
+		{"SILK NB 40ms", []byte{2 << 3}, 40 * time.Millisecond},
+		{"SILK NB 60ms", []byte{3 << 3}, 60 * time.Millisecond},
+		{"SILK WB 60ms", []byte{11 << 3}, 60 * time.Millisecond},
+		{"Hybrid SWB 10ms", []byte{12 << 3}, 10 * time.Millisecond},
+		{"Hybrid FB 20ms", []byte{15 << 3}, 20 * time.Millisecond},
+		{"CELT NB 2.5ms", []byte{16 << 3}, 2500 * time.Microsecond},
+		{"CELT FB 5ms", []byte{29 << 3}, 5 * time.Millisecond},
+		{"CELT FB 10ms", []byte{30 << 3}, 10 * time.Millisecond},
+		{"CELT FB 20ms stereo", []byte{31<<3 | 1<<2, 0xff}, 20 * time.Millisecond},
+		{"two equal frames", []byte{31<<3 | 1}, 40 * time.Millisecond},
+		{"two different frames", []byte{31<<3 | 2, 1, 0}, 40 * time.Millisecond},
+		{"arbitrary frames", []byte{31<<3 | 3, 3}, 60 * time.Millisecond},
+		{"arbitrary frames with VBR and padding", []byte{31<<3 | 3, 0xc0 | 3}, 60 * time.Millisecond},
+		{"most arbitrary frames", []byte{16<<3 | 3, 48}, 120 * time.Millisecond},
+		{"no arbitrary frames", []byte{31<<3 | 3, 0}, 0},
+		{"arbitrary frames without count", []byte{31<<3 | 3}, 0},
+		{"empty", []byte{}, 0},
+		{"nil", nil, 0},
+	} {
+		if duration := PacketDuration(c.packet); duration != c.duration {
+			t.Errorf("%s lasts %s instead of %s", c.name, duration, c.duration)
+		}
+	}
+}
+
+func FuzzPacketDuration(f *testing.F) {
+	f.Add([]byte{0xfc, 0xff})
+	f.Add([]byte{0x03})
+
+	f.Fuzz(func(t *testing.T, packet []byte) {
+		if duration := PacketDuration(packet); duration < 0 || duration > 63*60*time.Millisecond {
+			t.Fatalf("packet lasts %s", duration)
+		}
+	})
+}
@@ -0,0 +1,428 @@
+package recorder
+
+import (
+	"encoding/binary"
+	"math"
+	"os"
+	"time"
+)
+
+// EBML IDs of the Matroska elements that are written
+const (
+	ebmlIDHeader             = 0x1A45DFA3
+	ebmlIDVersion            = 0x4286
+	ebmlIDReadVersion        = 0x42F7
+	ebmlIDMaxIDLength        = 0x42F2
+	ebmlIDMaxSizeLength      = 0x42F3
+	ebmlIDDocType            = 0x4282
+	ebmlIDDocTypeVersion     = 0x4287
+	ebmlIDDocTypeReadVersion = 0x4285
+	ebmlIDVoid               = 0xEC
+
+	ebmlIDSegment      = 0x18538067
+	ebmlIDSeekHead     = 0x114D9B74
+	ebmlIDSeek         = 0x4DBB
+	ebmlIDSeekID       = 0x53AB
+	ebmlIDSeekPosition = 0x53AC
+
+	ebmlIDInfo          = 0x1549A966
+	ebmlIDTimecodeScale = 0x2AD7B1
+	ebmlIDMuxingApp     = 0x4D80
+	ebmlIDWritingApp    = 0x5741
+	ebmlIDDuration      = 0x4489
+
+	ebmlIDTracks            = 0x1654AE6B
+	ebmlIDTrackEntry        = 0xAE
+	ebmlIDTrackNumber       = 0xD7
+	ebmlIDTrackUID          = 0x73C5
+	ebmlIDTrackType         = 0x83
+	ebmlIDFlagLacing        = 0x9C
+	ebmlIDCodecID           = 0x86
+	ebmlIDCodecPrivate      = 0x63A2
+	ebmlIDSeekPreRoll       = 0x56BB
+	ebmlIDVideo             = 0xE0
+	ebmlIDPixelWidth        = 0xB0
+	ebmlIDPixelHeight       = 0xBA
+	ebmlIDAudio             = 0xE1
+	ebmlIDSamplingFrequency = 0xB5
+	ebmlIDChannels          = 0x9F
+
+	ebmlIDCluster     = 0x1F43B675
+	ebmlIDTimecode    = 0xE7
+	ebmlIDSimpleBlock = 0xA3
+
+	ebmlIDCues              = 0x1C53BB6B
+	ebmlIDCuePoint          = 0xBB
+	ebmlIDCueTime           = 0xB3
+	ebmlIDCueTrackPositions = 0xB7
+	ebmlIDCueTrack          = 0xF7
+	ebmlIDCueClusterPos     = 0xF1
+)
+
+const (
+	videoTrackNumber = 1
+	audioTrackNumber = 2
+
+	trackTypeVideo = 1
+	trackTypeAudio = 2
+
+	// Block timecodes are in milliseconds
+	timecodeScale = time.Millisecond
+
+	// Space at the start of the segment that the SeekHead is written to once the file is finalized
+	seekHeadSize = 96
+
+	// Clusters of audio only files are started this often, so little is lost if the file isn't finalized
+	audioClusterDuration = 5 * time.Second
+
+	// Opus decoders need this much audio before a seek point to converge
+	opusSeekPreRoll = 80 * time.Millisecond
+
+	// Size of a Segment that is still being written
+	unknownSize = 1<<56 - 1
+)
+
+// videoTrack describes the video of a file, taken from the keyframe it starts with
+type videoTrack struct {
+	codec         Codec
+	width, height int
+	codecPrivate  []byte
+}
+
+type cue struct {
+	time, position uint64
+}
+
+// matroskaFile writes one WebM file of VP8 or VP9 and Opus. Clusters are written once they are complete, so
+// a file that isn't finalized, like after a crash, is still playable up to its last cluster.
+// Finalizing adds the duration, cues and the SeekHead.
+type matroskaFile struct {
+	file   *os.File
+	offset int64
+
+	// Offsets of the Segment size, the start of its data and the Duration value
+	segmentSizeOffset int64
+	segmentStart      int64
+	durationOffset    int64
+	infoPosition      uint64
+	tracksPosition    uint64
+
+	video    *videoTrack
+	hasAudio bool
+
+	// pts of time 0 of the file
+	start time.Duration
+
+	cluster      []byte
+	clusterTime  int64
+	clusterStart time.Duration
+	clusterOpen  bool
+
+	cues     []cue
+	lastTime int64
+}
+
+func createMatroskaFile(path string, video *videoTrack, hasAudio bool, start time.Duration) (*matroskaFile, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &matroskaFile{file: file, video: video, hasAudio: hasAudio, start: start}
+	if err = m.writeHeader(); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+
+	return m, nil
+}
+
+func (m *matroskaFile) writeHeader() error {
+	header := element(ebmlIDHeader,
+		uintElement(ebmlIDVersion, 1),
+		uintElement(ebmlIDReadVersion, 1),
+		uintElement(ebmlIDMaxIDLength, 4),
+		uintElement(ebmlIDMaxSizeLength, 8),
+		stringElement(ebmlIDDocType, "webm"),
+		uintElement(ebmlIDDocTypeVersion, 4),
+		uintElement(ebmlIDDocTypeReadVersion, 2),
+	)
+
+	header = append(header, encodeID(ebmlIDSegment)...)
+	m.segmentSizeOffset = int64(len(header))
+	header = append(header, encodeFixedSize(unknownSize)...)
+	m.segmentStart = int64(len(header))
+
+	header = append(header, void(seekHeadSize)...)
+
+	m.infoPosition = uint64(int64(len(header)) - m.segmentStart)
+	header = append(header, element(ebmlIDInfo,
+		uintElement(ebmlIDTimecodeScale, uint64(timecodeScale)),
+		stringElement(ebmlIDMuxingApp, "broadcast-box"),
+		stringElement(ebmlIDWritingApp, "broadcast-box"),
+		// Last, so its value is the last 8 bytes of Info
+		floatElement(ebmlIDDuration, 0),
+	)...)
+	m.durationOffset = int64(len(header)) - 8
+
+	m.tracksPosition = uint64(int64(len(header)) - m.segmentStart)
+	header = append(header, m.tracks()...)
+
+	return m.write(header)
+}
+
+func (m *matroskaFile) tracks() []byte {
+	var entries [][]byte
+	if m.video != nil {
+		children := [][]byte{
+			uintElement(ebmlIDTrackNumber, videoTrackNumber),
+			uintElement(ebmlIDTrackUID, videoTrackNumber),
+			uintElement(ebmlIDTrackType, trackTypeVideo),
+			uintElement(ebmlIDFlagLacing, 0),
+			stringElement(ebmlIDCodecID, m.video.codec.matroskaCodecID()),
+		}
+		if len(m.video.codecPrivate) != 0 {
+			children = append(children, element(ebmlIDCodecPrivate, m.video.codecPrivate))
+		}
+		children = append(children, element(ebmlIDVideo,
+			uintElement(ebmlIDPixelWidth, uint64(m.video.width)),
+			uintElement(ebmlIDPixelHeight, uint64(m.video.height)),
+		))
+
+		entries = append(entries, element(ebmlIDTrackEntry, children...))
+	}
+
+	if m.hasAudio {
+		entries = append(entries, element(ebmlIDTrackEntry,
+			uintElement(ebmlIDTrackNumber, audioTrackNumber),
+			uintElement(ebmlIDTrackUID, audioTrackNumber),
+			uintElement(ebmlIDTrackType, trackTypeAudio),
+			uintElement(ebmlIDFlagLacing, 0),
+			stringElement(ebmlIDCodecID, "A_OPUS"),
+			element(ebmlIDCodecPrivate, opusHead()),
+			uintElement(ebmlIDSeekPreRoll, uint64(opusSeekPreRoll)),
+			element(ebmlIDAudio,
+				floatElement(ebmlIDSamplingFrequency, 48000),
+				uintElement(ebmlIDChannels, 2),
+			),
+		))
+	}
+
+	return element(ebmlIDTracks, entries...)
+}
+
+// opusHead is the ID header of RFC 7845 for stereo Opus without mapping
+func opusHead() []byte {
+	head := append([]byte("OpusHead"), 1, 2)
+	head = binary.LittleEndian.AppendUint16(head, 0)
+	head = binary.LittleEndian.AppendUint32(head, 48000)
+	head = binary.LittleEndian.AppendUint16(head, 0)
+	return append(head, 0)
+}
+
+// writeBlock adds a frame of trackNumber to the file. Video keyframes start a new cluster, so
+// every cluster of a file with video can be seeked to.
+func (m *matroskaFile) writeBlock(trackNumber int, frame []byte, pts time.Duration, keyframe bool) error {
+	if pts < m.start {
+		pts = m.start
+	}
+	timecode := int64((pts - m.start) / timecodeScale)
+
+	startsCluster := !m.clusterOpen ||
+		timecode-m.clusterTime > math.MaxInt16 || timecode-m.clusterTime < math.MinInt16 ||
+		(trackNumber == videoTrackNumber && keyframe) ||
+		(m.video == nil && pts-m.clusterStart >= audioClusterDuration)
+	if startsCluster {
+		if err := m.flushCluster(); err != nil {
+			return err
+		}
+
+		m.clusterOpen, m.clusterTime, m.clusterStart = true, timecode, pts
+		if m.video == nil || keyframe {
+			m.cues = append(m.cues, cue{time: uint64(timecode), position: uint64(m.offset - m.segmentStart)})
+		}
+	}
+
+	flags := byte(0)
+	if keyframe || trackNumber == audioTrackNumber {
+		flags = 0x80
+	}
+
+	block := append(encodeSize(uint64(trackNumber)), 0, 0, flags)
+	binary.BigEndian.PutUint16(block[1:], uint16(int16(timecode-m.clusterTime)))
+	m.cluster = append(m.cluster, element(ebmlIDSimpleBlock, block, frame)...)
+
+	if timecode > m.lastTime {
+		m.lastTime = timecode
+	}
+
+	return nil
+}
+
+func (m *matroskaFile) flushCluster() error {
+	if !m.clusterOpen {
+		return nil
+	}
+
+	cluster := element(ebmlIDCluster, uintElement(ebmlIDTimecode, uint64(m.clusterTime)), m.cluster)
+	m.cluster, m.clusterOpen = nil, false
+	return m.write(cluster)
+}
+
+// close writes the last cluster and the cues, then fills in the SeekHead, the duration and the
+// size of the segment
+func (m *matroskaFile) close() error {
+	err := m.finalize()
+	if closeErr := m.file.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+func (m *matroskaFile) files() []string {
+	return []string{m.file.Name()}
+}
+
+func (m *matroskaFile) finalize() error {
+	if err := m.flushCluster(); err != nil {
+		return err
+	}
+
+	cuesPosition := uint64(m.offset - m.segmentStart)
+	var cuePoints [][]byte
+	for _, c := range m.cues {
+		trackNumber := uint64(videoTrackNumber)
+		if m.video == nil {
+			trackNumber = audioTrackNumber
+		}
+
+		cuePoints = append(cuePoints, element(ebmlIDCuePoint,
+			uintElement(ebmlIDCueTime, c.time),
+			element(ebmlIDCueTrackPositions,
+				uintElement(ebmlIDCueTrack, trackNumber),
+				uintElement(ebmlIDCueClusterPos, c.position),
+			),
+		))
+	}
+	if len(cuePoints) != 0 {
+		if err := m.write(element(ebmlIDCues, cuePoints...)); err != nil {
+			return err
+		}
+	}
+
+	seeks := [][]byte{seek(ebmlIDInfo, m.infoPosition), seek(ebmlIDTracks, m.tracksPosition)}
+	if len(cuePoints) != 0 {
+		seeks = append(seeks, seek(ebmlIDCues, cuesPosition))
+	}
+	seekHead := element(ebmlIDSeekHead, seeks...)
+	seekHead = append(seekHead, void(seekHeadSize-len(seekHead))...)
+
+	duration := make([]byte, 8)
+	binary.BigEndian.PutUint64(duration, math.Float64bits(float64(m.lastTime)))
+
+	for _, patch := range []struct {
+		offset int64
+		data   []byte
+	}{
+		{m.segmentStart, seekHead},
+		{m.durationOffset, duration},
+		{m.segmentSizeOffset, encodeFixedSize(uint64(m.offset - m.segmentStart))},
+	} {
+		if _, err := m.file.WriteAt(patch.data, patch.offset); err != nil {
+			return err
+		}
+	}
+
+	return m.file.Sync()
+}
+
+func (m *matroskaFile) write(data []byte) error {
+	n, err := m.file.Write(data)
+	m.offset += int64(n)
+	return err
+}
+
+func seek(id uint32, position uint64) []byte {
+	return element(ebmlIDSeek,
+		element(ebmlIDSeekID, encodeID(id)),
+		element(ebmlIDSeekPosition, binary.BigEndian.AppendUint64(nil, position)),
+	)
+}
+
+// element returns an EBML element of id with the concatenated data
+func element(id uint32, data ...[]byte) []byte {
+	size := 0
+	for _, d := range data {
+		size += len(d)
+	}
+
+	out := append(encodeID(id), encodeSize(uint64(size))...)
+	for _, d := range data {
+		out = append(out, d...)
+	}
+
+	return out
+}
+
+// uintElement returns an unsigned integer element without leading zero bytes
+func uintElement(id uint32, v uint64) []byte {
+	data := []byte{byte(v)}
+	for v >>= 8; v != 0; v >>= 8 {
+		data = append([]byte{byte(v)}, data...)
+	}
+
+	return element(id, data)
+}
+
+func floatElement(id uint32, v float64) []byte {
+	return element(id, binary.BigEndian.AppendUint64(nil, math.Float64bits(v)))
+}
+
+func stringElement(id uint32, s string) []byte {
+	return element(id, []byte(s))
+}
+
+// void returns a Void element that is size bytes long in total
+func void(size int) []byte {
+	return element(ebmlIDVoid, make([]byte, size-2))
+}
+
+// encodeID returns the bytes of an EBML ID, which include their length marker
+func encodeID(id uint32) []byte {
+	switch {
+	case id > 0xFFFFFF:
+		return []byte{byte(id >> 24), byte(id >> 16), byte(id >> 8), byte(id)}
+	case id > 0xFFFF:
+		return []byte{byte(id >> 16), byte(id >> 8), byte(id)}
+	case id > 0xFF:
+		return []byte{byte(id >> 8), byte(id)}
+	default:
+		return []byte{byte(id)}
+	}
+}
+
+// encodeSize returns size as the shortest EBML variable size integer
+func encodeSize(size uint64) []byte {
+	length := 1
+	// All ones is reserved for unknown sizes
+	for size >= 1<<(7*length)-1 {
+		length++
+	}
+
+	out := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		out[i] = byte(size)
+		size >>= 8
+	}
+	out[0] |= 0x80 >> (length - 1)
+
+	return out
+}
+
+// encodeFixedSize returns size as an 8 byte EBML variable size integer, so it can be rewritten in place
+func encodeFixedSize(size uint64) []byte {
+	out := binary.BigEndian.AppendUint64(nil, size)
+	out[0] = 0x01
+	return out
+}
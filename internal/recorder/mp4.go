@@ -0,0 +1,417 @@
+package recorder
+
+import (
+	"encoding/binary"
+	"os"
+	"time"
+)
+
+const (
+	// Timescale of the movie, its duration is in milliseconds
+	movieTimescale = 1000
+
+	videoTimescale = 90000
+	audioTimescale = 48000
+
+	// Duration of the last sample of a track, that has no next sample to take it from
+	defaultVideoSampleDuration = videoTimescale / 30
+	defaultAudioSampleDuration = audioTimescale / 50
+
+	sampleFlagsKeyframe    = 0x02000000
+	sampleFlagsNonKeyframe = 0x01010000
+
+	// Fragments are written at every keyframe and at least this often
+	maxFragmentDuration = 2 * time.Second
+)
+
+var unityMatrix = []uint32{0x00010000, 0, 0, 0, 0x00010000, 0, 0, 0, 0x40000000}
+
+type mp4Sample struct {
+	// In units of the track timescale, duration is 0 until the next sample of the track arrives
+	dts      int64
+	duration uint32
+
+	data     []byte
+	keyframe bool
+}
+
+type mp4Track struct {
+	timescale int64
+	samples   []mp4Sample
+
+	// dts after the last sample that was written
+	end int64
+}
+
+// complete returns how many samples at the start of samples have their duration
+func (t *mp4Track) complete() int {
+	n := len(t.samples)
+	if n != 0 && t.samples[n-1].duration == 0 {
+		n--
+	}
+	return n
+}
+
+type mp4Keyframe struct {
+	time       uint64
+	moofOffset uint64
+}
+
+// mp4File writes one fragmented MP4 file of H264 and Opus. Fragments carry the samples of both
+// tracks since the last one, so a file that isn't finalized is still playable up to its last
+// fragment. Finalizing adds the duration and an index of the keyframes for seeking.
+type mp4File struct {
+	file   *os.File
+	offset int64
+
+	// Offsets of the duration values of mvhd and mehd
+	mvhdDurationOffset int64
+	mehdDurationOffset int64
+
+	video    *videoTrack
+	hasAudio bool
+
+	// pts of time 0 of the file
+	start time.Duration
+
+	videoTrack, audioTrack mp4Track
+	sequenceNumber         uint32
+	fragmentStart          time.Duration
+
+	keyframes []mp4Keyframe
+}
+
+func createMP4File(path string, video *videoTrack, hasAudio bool, start time.Duration) (*mp4File, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &mp4File{
+		file:          file,
+		video:         video,
+		hasAudio:      hasAudio,
+		start:         start,
+		videoTrack:    mp4Track{timescale: videoTimescale},
+		audioTrack:    mp4Track{timescale: audioTimescale},
+		fragmentStart: start,
+	}
+	if err = m.writeHeader(); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+
+	return m, nil
+}
+
+func (m *mp4File) writeHeader() error {
+	ftyp := box("ftyp", []byte("isom"), uint32s(0x200), []byte("isomiso5iso6avc1mp41"))
+
+	traks := [][]byte{videoTrak(m.video)}
+	trexs := [][]byte{trex(videoTrackNumber)}
+	if m.hasAudio {
+		traks = append(traks, audioTrak())
+		trexs = append(trexs, trex(audioTrackNumber))
+	}
+
+	mvhd := fullBox("mvhd", 0, 0,
+		uint32s(0, 0, movieTimescale, 0, 0x00010000),
+		uint16s(0x0100, 0),
+		make([]byte, 8),
+		uint32s(unityMatrix...),
+		make([]byte, 24),
+		uint32s(audioTrackNumber+1),
+	)
+	// mehd holds the duration of all fragments, its value is the last 4 bytes of it
+	mvex := box("mvex", append([][]byte{fullBox("mehd", 0, 0, uint32s(0))}, trexs...)...)
+
+	moov := append([][]byte{mvhd}, traks...)
+	moov = append(moov, mvex)
+	header := append(ftyp, box("moov", moov...)...)
+
+	// Creation time, modification time and timescale are before the duration
+	m.mvhdDurationOffset = int64(len(ftyp)) + 8 + 12 + 12
+	m.mehdDurationOffset = int64(len(header)-len(mvex)) + 8 + 12
+
+	return m.write(header)
+}
+
+// writeBlock adds a frame of trackNumber to the file, video is an Annex B access unit.
+// Timestamps are converted to the timescale of the track from pts, so rounding doesn't
+// accumulate, and kept increasing.
+func (m *mp4File) writeBlock(trackNumber int, frame []byte, pts time.Duration, keyframe bool) error {
+	if pts < m.start {
+		pts = m.start
+	}
+
+	// Samples are held until their fragment is written, audio is copied as callers reuse it
+	track, data := &m.audioTrack, append([]byte(nil), frame...)
+	if trackNumber == videoTrackNumber {
+		track, data = &m.videoTrack, avccSample(frame)
+	}
+
+	dts := int64((pts-m.start)/time.Microsecond) * track.timescale / int64(time.Second/time.Microsecond)
+	if n := len(track.samples); n != 0 {
+		previous := &track.samples[n-1]
+		if dts <= previous.dts {
+			dts = previous.dts + 1
+		}
+		previous.duration = uint32(dts - previous.dts)
+	} else if dts < track.end {
+		dts = track.end
+	}
+
+	if (trackNumber == videoTrackNumber && keyframe) || pts-m.fragmentStart >= maxFragmentDuration {
+		if err := m.writeFragment(); err != nil {
+			return err
+		}
+		m.fragmentStart = pts
+	}
+
+	track.samples = append(track.samples, mp4Sample{dts: dts, data: data, keyframe: keyframe || trackNumber == audioTrackNumber})
+	return nil
+}
+
+// writeFragment writes the samples that have their duration as a moof and mdat, samples of video
+// first and then audio
+func (m *mp4File) writeFragment() error {
+	videoCount, audioCount := m.videoTrack.complete(), m.audioTrack.complete()
+	if videoCount == 0 && audioCount == 0 {
+		return nil
+	}
+
+	videoSamples, audioSamples := m.videoTrack.samples[:videoCount], m.audioTrack.samples[:audioCount]
+	m.sequenceNumber++
+	if videoCount != 0 && videoSamples[0].keyframe {
+		m.keyframes = append(m.keyframes, mp4Keyframe{time: uint64(videoSamples[0].dts), moofOffset: uint64(m.offset)})
+	}
+
+	build := func(dataOffset uint32) []byte {
+		children := [][]byte{fullBox("mfhd", 0, 0, uint32s(m.sequenceNumber))}
+		for _, t := range []struct {
+			id      uint32
+			samples []mp4Sample
+		}{{videoTrackNumber, videoSamples}, {audioTrackNumber, audioSamples}} {
+			if len(t.samples) == 0 {
+				continue
+			}
+
+			children = append(children, traf(t.id, t.samples, dataOffset))
+			for _, s := range t.samples {
+				dataOffset += uint32(len(s.data))
+			}
+		}
+
+		return box("moof", children...)
+	}
+
+	// The offsets are relative to the start of the moof, whose size doesn't depend on them
+	moof := build(0)
+	moof = build(uint32(len(moof)) + 8)
+
+	mdat := [][]byte{}
+	for _, samples := range [][]mp4Sample{videoSamples, audioSamples} {
+		for _, s := range samples {
+			mdat = append(mdat, s.data)
+		}
+	}
+
+	for _, t := range []*mp4Track{&m.videoTrack, &m.audioTrack} {
+		if count := t.complete(); count != 0 {
+			last := t.samples[count-1]
+			t.end = last.dts + int64(last.duration)
+			t.samples = append([]mp4Sample(nil), t.samples[count:]...)
+		}
+	}
+
+	return m.write(append(moof, box("mdat", mdat...)...))
+}
+
+func traf(trackID uint32, samples []mp4Sample, dataOffset uint32) []byte {
+	trun := uint32s(uint32(len(samples)), dataOffset)
+	for _, s := range samples {
+		flags := uint32(sampleFlagsNonKeyframe)
+		if s.keyframe {
+			flags = sampleFlagsKeyframe
+		}
+
+		trun = binary.BigEndian.AppendUint32(trun, s.duration)
+		trun = binary.BigEndian.AppendUint32(trun, uint32(len(s.data)))
+		trun = binary.BigEndian.AppendUint32(trun, flags)
+	}
+
+	return box("traf",
+		fullBox("tfhd", 0, 0x020000, uint32s(trackID)), // default-base-is-moof
+		fullBox("tfdt", 1, 0, binary.BigEndian.AppendUint64(nil, uint64(samples[0].dts))),
+		fullBox("trun", 0, 0x000701, trun), // data offset, sample duration, size and flags
+	)
+}
+
+// close writes the remaining samples and the keyframe index, then fills in the duration
+func (m *mp4File) close() error {
+	err := m.finalize()
+	if closeErr := m.file.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+func (m *mp4File) files() []string {
+	return []string{m.file.Name()}
+}
+
+func (m *mp4File) finalize() error {
+	for _, t := range []struct {
+		track           *mp4Track
+		defaultDuration uint32
+	}{{&m.videoTrack, defaultVideoSampleDuration}, {&m.audioTrack, defaultAudioSampleDuration}} {
+		n := len(t.track.samples)
+		if n == 0 {
+			continue
+		}
+
+		t.track.samples[n-1].duration = t.defaultDuration
+		if n > 1 {
+			t.track.samples[n-1].duration = t.track.samples[n-2].duration
+		}
+	}
+	if err := m.writeFragment(); err != nil {
+		return err
+	}
+
+	if len(m.keyframes) != 0 {
+		entries := uint32s(videoTrackNumber, 0, uint32(len(m.keyframes)))
+		for _, k := range m.keyframes {
+			entries = binary.BigEndian.AppendUint64(entries, k.time)
+			entries = binary.BigEndian.AppendUint64(entries, k.moofOffset)
+			entries = append(entries, 1, 1, 1) // traf, trun and sample number
+		}
+
+		tfra := fullBox("tfra", 1, 0, entries)
+		mfraSize := uint32(8 + len(tfra) + 16)
+		if err := m.write(box("mfra", tfra, fullBox("mfro", 0, 0, uint32s(mfraSize)))); err != nil {
+			return err
+		}
+	}
+
+	duration := max(m.videoTrack.end*movieTimescale/videoTimescale, m.audioTrack.end*movieTimescale/audioTimescale)
+	durationValue := uint32s(uint32(duration))
+	for _, offset := range []int64{m.mvhdDurationOffset, m.mehdDurationOffset} {
+		if _, err := m.file.WriteAt(durationValue, offset); err != nil {
+			return err
+		}
+	}
+
+	return m.file.Sync()
+}
+
+func (m *mp4File) write(data []byte) error {
+	n, err := m.file.Write(data)
+	m.offset += int64(n)
+	return err
+}
+
+func trex(trackID uint32) []byte {
+	return fullBox("trex", 0, 0, uint32s(trackID, 1, 0, 0, 0))
+}
+
+func tkhd(trackID uint32, volume uint16, width, height int) []byte {
+	return fullBox("tkhd", 0, 3,
+		uint32s(0, 0, trackID, 0, 0),
+		make([]byte, 8),
+		uint16s(0, 0, volume, 0),
+		uint32s(unityMatrix...),
+		uint32s(uint32(width)<<16, uint32(height)<<16),
+	)
+}
+
+func mdia(timescale uint32, handlerType, handlerName string, mediaHeader, sampleEntry []byte) []byte {
+	return box("mdia",
+		fullBox("mdhd", 0, 0, uint32s(0, 0, timescale, 0), uint16s(0x55C4, 0)), // Language `und`
+		fullBox("hdlr", 0, 0, uint32s(0), []byte(handlerType), make([]byte, 12), []byte(handlerName+"\x00")),
+		box("minf",
+			mediaHeader,
+			box("dinf", fullBox("dref", 0, 0, uint32s(1), fullBox("url ", 0, 1))),
+			box("stbl",
+				fullBox("stsd", 0, 0, uint32s(1), sampleEntry),
+				fullBox("stts", 0, 0, uint32s(0)),
+				fullBox("stsc", 0, 0, uint32s(0)),
+				fullBox("stsz", 0, 0, uint32s(0, 0)),
+				fullBox("stco", 0, 0, uint32s(0)),
+			),
+		),
+	)
+}
+
+// videoTrak declares an H264 track, codecPrivate of video is its avcC
+func videoTrak(video *videoTrack) []byte {
+	avc1 := box("avc1",
+		make([]byte, 6), uint16s(1),
+		make([]byte, 16),
+		uint16s(uint16(video.width), uint16(video.height)),
+		uint32s(0x00480000, 0x00480000, 0),
+		uint16s(1),
+		make([]byte, 32),
+		uint16s(0x0018, 0xFFFF),
+		box("avcC", video.codecPrivate),
+	)
+
+	return box("trak",
+		tkhd(videoTrackNumber, 0, video.width, video.height),
+		mdia(videoTimescale, "vide", "VideoHandler", fullBox("vmhd", 0, 1, make([]byte, 8)), avc1),
+	)
+}
+
+func audioTrak() []byte {
+	opus := box("Opus",
+		make([]byte, 6), uint16s(1),
+		make([]byte, 8),
+		uint16s(2, 16, 0, 0),
+		uint32s(audioTimescale<<16),
+		// Version, channels, pre-skip, input sample rate, gain and mapping family of RFC 7845
+		box("dOps", []byte{0, 2}, uint16s(0), uint32s(audioTimescale), uint16s(0), []byte{0}),
+	)
+
+	return box("trak",
+		tkhd(audioTrackNumber, 0x0100, 0, 0),
+		mdia(audioTimescale, "soun", "SoundHandler", fullBox("smhd", 0, 0, uint16s(0, 0)), opus),
+	)
+}
+
+func box(boxType string, children ...[]byte) []byte {
+	size := 8
+	for _, child := range children {
+		size += len(child)
+	}
+
+	b := make([]byte, 0, size)
+	b = binary.BigEndian.AppendUint32(b, uint32(size))
+	b = append(b, boxType...)
+	for _, child := range children {
+		b = append(b, child...)
+	}
+
+	return b
+}
+
+func fullBox(boxType string, version byte, flags uint32, children ...[]byte) []byte {
+	header := binary.BigEndian.AppendUint32(nil, uint32(version)<<24|flags)
+	return box(boxType, append([][]byte{header}, children...)...)
+}
+
+func uint16s(values ...uint16) []byte {
+	b := []byte{}
+	for _, v := range values {
+		b = binary.BigEndian.AppendUint16(b, v)
+	}
+	return b
+}
+
+func uint32s(values ...uint32) []byte {
+	b := []byte{}
+	for _, v := range values {
+		b = binary.BigEndian.AppendUint32(b, v)
+	}
+	return b
+}
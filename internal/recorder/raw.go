@@ -0,0 +1,216 @@
+package recorder
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/glimesh/broadcast-box/internal/opus"
+)
+
+const (
+	// Timestamps of IVF frames are in units of the RTP clock of video
+	ivfTimebase = 90000
+
+	oggHeaderTypeBeginningOfStream = 0x02
+	oggHeaderTypeEndOfStream       = 0x04
+
+	// Granule positions of Ogg Opus are in 48 kHz samples, see RFC 7845 section 4
+	oggGranuleRate = 48000
+)
+
+// rawFiles writes video to IVF and audio to Ogg, next to each other with the same name. Frames
+// are written as they arrive with only their timestamps converted, for debugging codecs and
+// archiving with little overhead.
+type rawFiles struct {
+	ivf       *os.File
+	ivfFrames uint32
+
+	ogg            *os.File
+	oggPageNumber  uint32
+	oggGranule     uint64
+	oggPendingPage []byte
+
+	// pts of time 0 of the files
+	start time.Duration
+}
+
+// createRawFiles creates the IVF of video and the Ogg of audio, path is named after the first of
+// them and the other gets its extension replaced
+func createRawFiles(path string, video *videoTrack, hasAudio bool, start time.Duration) (*rawFiles, error) {
+	base := strings.TrimSuffix(path, filepath.Ext(path))
+	r := &rawFiles{start: start}
+
+	var err error
+	if video != nil {
+		if r.ivf, err = os.OpenFile(base+".ivf", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644); err != nil {
+			return nil, err
+		}
+		if _, err = r.ivf.Write(ivfHeader(video)); err != nil {
+			return nil, errors.Join(err, r.ivf.Close())
+		}
+	}
+
+	if hasAudio {
+		if r.ogg, err = os.OpenFile(base+".ogg", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644); err == nil {
+			err = r.writeOggHeaders()
+		}
+		if err != nil {
+			if r.ivf != nil {
+				err = errors.Join(err, r.ivf.Close(), os.Remove(r.ivf.Name()))
+			}
+			if r.ogg != nil {
+				err = errors.Join(err, r.ogg.Close())
+			}
+			return nil, err
+		}
+	}
+
+	return r, nil
+}
+
+// ivfHeader is the file header of an IVF with the codec and size of video
+func ivfHeader(video *videoTrack) []byte {
+	fourCC := map[Codec]string{CodecVP8: "VP80", CodecVP9: "VP90", CodecH264: "H264"}[video.codec]
+
+	header := append([]byte("DKIF"), 0, 0, 32, 0)
+	header = append(header, fourCC...)
+	header = binary.LittleEndian.AppendUint16(header, uint16(video.width))
+	header = binary.LittleEndian.AppendUint16(header, uint16(video.height))
+	header = binary.LittleEndian.AppendUint32(header, ivfTimebase)
+	header = binary.LittleEndian.AppendUint32(header, 1)
+	header = binary.LittleEndian.AppendUint32(header, 0) // Frame count, filled in by close
+	return binary.LittleEndian.AppendUint32(header, 0)
+}
+
+func (r *rawFiles) writeBlock(trackNumber int, frame []byte, pts time.Duration, keyframe bool) error {
+	if pts < r.start {
+		pts = r.start
+	}
+
+	if trackNumber == videoTrackNumber {
+		timestamp := uint64((pts-r.start)/time.Microsecond) * ivfTimebase / uint64(time.Second/time.Microsecond)
+
+		header := binary.LittleEndian.AppendUint32(nil, uint32(len(frame)))
+		header = binary.LittleEndian.AppendUint64(header, timestamp)
+		r.ivfFrames++
+		_, err := r.ivf.Write(append(header, frame...))
+		return err
+	}
+
+	if len(frame) == 0 {
+		return nil
+	}
+
+	// The granule position of a page is where its last packet ends, audio that starts after the
+	// video keeps its offset
+	duration := uint64(opus.PacketDuration(frame) * oggGranuleRate / time.Second)
+	granule := uint64((pts-r.start)/time.Microsecond)*oggGranuleRate/uint64(time.Second/time.Microsecond) + duration
+	r.oggGranule = max(granule, r.oggGranule+duration)
+
+	// The last page is held back, so it can be marked as the end of the stream
+	if err := r.flushOggPage(0); err != nil {
+		return err
+	}
+	r.oggPendingPage = r.oggPage(0, r.oggGranule, frame)
+	return nil
+}
+
+// writeOggHeaders writes the ID and comment header pages of RFC 7845
+func (r *rawFiles) writeOggHeaders() error {
+	tags := append([]byte("OpusTags"), binary.LittleEndian.AppendUint32(nil, uint32(len("broadcast-box")))...)
+	tags = append(tags, "broadcast-box"...)
+	tags = binary.LittleEndian.AppendUint32(tags, 0)
+
+	_, err := r.ogg.Write(append(r.oggPage(oggHeaderTypeBeginningOfStream, 0, opusHead()), r.oggPage(0, 0, tags)...))
+	return err
+}
+
+func (r *rawFiles) flushOggPage(headerType byte) error {
+	if r.oggPendingPage == nil {
+		return nil
+	}
+
+	page := r.oggPendingPage
+	r.oggPendingPage = nil
+	if headerType != 0 {
+		page[5] |= headerType
+		binary.LittleEndian.PutUint32(page[22:], 0)
+		binary.LittleEndian.PutUint32(page[22:], oggCRC(page))
+	}
+
+	_, err := r.ogg.Write(page)
+	return err
+}
+
+// oggPage returns a page with one packet, see RFC 3533 section 6
+func (r *rawFiles) oggPage(headerType byte, granule uint64, packet []byte) []byte {
+	segments := []byte{}
+	for n := len(packet); ; n -= 255 {
+		if n < 255 {
+			segments = append(segments, byte(n))
+			break
+		}
+		segments = append(segments, 255)
+	}
+
+	page := append([]byte("OggS"), 0, headerType)
+	page = binary.LittleEndian.AppendUint64(page, granule)
+	page = binary.LittleEndian.AppendUint32(page, 1) // Serial number, there is only one stream
+	page = binary.LittleEndian.AppendUint32(page, r.oggPageNumber)
+	page = binary.LittleEndian.AppendUint32(page, 0) // CRC, filled in below
+	page = append(page, byte(len(segments)))
+	page = append(page, segments...)
+	page = append(page, packet...)
+	r.oggPageNumber++
+
+	binary.LittleEndian.PutUint32(page[22:], oggCRC(page))
+	return page
+}
+
+// oggCRC is the CRC-32 of an Ogg page with a zero CRC field
+func oggCRC(b []byte) uint32 {
+	crc := uint32(0)
+	for _, v := range b {
+		crc ^= uint32(v) << 24
+		for i := 0; i < 8; i++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04C11DB7
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// close writes the last Ogg page as the end of the stream and fills in the IVF frame count
+func (r *rawFiles) close() error {
+	var err error
+	if r.ivf != nil {
+		count := binary.LittleEndian.AppendUint32(nil, r.ivfFrames)
+		if _, writeErr := r.ivf.WriteAt(count, 24); writeErr != nil {
+			err = writeErr
+		}
+		err = errors.Join(err, r.ivf.Sync(), r.ivf.Close())
+	}
+
+	if r.ogg != nil {
+		err = errors.Join(err, r.flushOggPage(oggHeaderTypeEndOfStream), r.ogg.Sync(), r.ogg.Close())
+	}
+
+	return err
+}
+
+func (r *rawFiles) files() []string {
+	files := []string{}
+	for _, f := range []*os.File{r.ivf, r.ogg} {
+		if f != nil {
+			files = append(files, f.Name())
+		}
+	}
+	return files
+}
@@ -0,0 +1,327 @@
+// Package recorder writes the media of a stream to files, VP8, VP9 and Opus as WebM and H264
+// with Opus as fragmented MP4. Files start at a keyframe and are finalized with their duration
+// and seek index when they are rotated or the recording is closed.
+package recorder
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// Audio is recorded on its own if no video arrived this long after it
+	audioOnlyTimeout = 3 * time.Second
+
+	// The first file waits this long after its keyframe for audio, so it has an audio track if
+	// the publisher sends audio after video
+	audioWaitTimeout = time.Second
+)
+
+// Format is how media is written to files
+type Format int
+
+const (
+	// VP8 and VP9 as WebM, H264 as MP4, both with Opus
+	FormatContainer Format = iota
+
+	// Video as IVF and audio as Ogg next to it, see rawFiles
+	FormatRaw
+)
+
+// container is a file that is being recorded to, see matroskaFile and mp4File
+type container interface {
+	writeBlock(trackNumber int, frame []byte, pts time.Duration, keyframe bool) error
+	close() error
+
+	// Paths of the files that are written
+	files() []string
+}
+
+type audioPacket struct {
+	data []byte
+	pts  time.Duration
+}
+
+type videoFrame struct {
+	codec    Codec
+	data     []byte
+	pts      time.Duration
+	keyframe bool
+}
+
+// Options of a Recorder
+type Options struct {
+	// A new file is started at the first keyframe after this, 0 records everything to one file
+	RotateInterval time.Duration
+
+	Format Format
+
+	// Called when a file was started and when it was finalized, with the Recorder locked so
+	// they must not block
+	OnStarted   func(File)
+	OnFinalized func(File)
+}
+
+// File is a file of a recording, or the files of FormatRaw
+type File struct {
+	Paths []string
+
+	// Time from the first to the last frame of the file, set once it is finalized
+	Duration time.Duration
+
+	// Set when the file was finalized because the next one was started
+	Rotated bool
+}
+
+// Recorder writes the media of one publisher to files in a directory, named after the stream
+// key and when each file was started. Timestamps are from one clock shared by audio and video.
+type Recorder struct {
+	lock sync.Mutex
+
+	dir, name string
+	opts      Options
+
+	// nil until the first keyframe, or audio if there is no video
+	file container
+	path string
+
+	// What the current file holds, video is nil for audio only files
+	fileVideo    *videoTrack
+	fileHasAudio bool
+	fileStart    time.Duration
+	fileEnd      time.Duration
+
+	videoSeen bool
+	audioSeen bool
+
+	// Media that arrived before the first file started
+	pendingAudio []audioPacket
+	pendingVideo []videoFrame
+
+	closed bool
+}
+
+// New starts recording name to dir, dir is created if needed
+func New(dir, name string, opts Options) (*Recorder, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	return &Recorder{dir: dir, name: name, opts: opts}, nil
+}
+
+// WriteVideo records a frame presented at pts, see IsKeyframe for its format. Frames before
+// the first keyframe are dropped.
+func (r *Recorder) WriteVideo(codec Codec, frame []byte, pts time.Duration) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.closed {
+		return nil
+	}
+	r.videoSeen = true
+
+	track, keyframe := newVideoTrack(codec, frame)
+
+	if r.file == nil && !r.audioSeen && (keyframe || len(r.pendingVideo) != 0) {
+		r.pendingVideo = append(r.pendingVideo, videoFrame{codec, append([]byte(nil), frame...), pts, keyframe})
+		if pts-r.pendingVideo[0].pts < audioWaitTimeout {
+			return nil
+		}
+		return r.writePendingVideo()
+	}
+
+	// A file without this video, like one that was started for audio only, is replaced at the
+	// next keyframe
+	matches := r.file != nil && r.fileVideo != nil && r.fileVideo.codec == codec
+	if keyframe && (!matches || r.rotationDue(pts)) {
+		if err := r.startFile(track, pts); err != nil {
+			return err
+		}
+		matches = true
+	}
+
+	if !matches {
+		return nil
+	}
+
+	return r.writeBlock(videoTrackNumber, frame, pts, keyframe)
+}
+
+// WriteOpus records a stereo Opus packet presented at pts
+func (r *Recorder) WriteOpus(packet []byte, pts time.Duration) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.closed {
+		return nil
+	}
+	r.audioSeen = true
+
+	if len(r.pendingVideo) != 0 {
+		if err := r.writePendingVideo(); err != nil {
+			return err
+		}
+	}
+
+	if r.file == nil {
+		r.pendingAudio = append(r.pendingAudio, audioPacket{append([]byte(nil), packet...), pts})
+
+		if r.videoSeen || pts-r.pendingAudio[0].pts < audioOnlyTimeout {
+			// Only the audio the first video keyframe can start with is kept
+			for len(r.pendingAudio) != 0 && pts-r.pendingAudio[0].pts > audioOnlyTimeout {
+				r.pendingAudio = r.pendingAudio[1:]
+			}
+			return nil
+		}
+
+		return r.startFile(nil, r.pendingAudio[0].pts)
+	}
+
+	if r.fileVideo == nil && r.rotationDue(pts) {
+		if err := r.startFile(nil, pts); err != nil {
+			return err
+		}
+	}
+
+	if !r.fileHasAudio {
+		return nil
+	}
+
+	return r.writeBlock(audioTrackNumber, packet, pts, true)
+}
+
+func (r *Recorder) writeBlock(trackNumber int, frame []byte, pts time.Duration, keyframe bool) error {
+	r.fileEnd = max(r.fileEnd, pts)
+	return r.file.writeBlock(trackNumber, frame, pts, keyframe)
+}
+
+// Close finalizes the current file, it is playable with its duration and cues afterwards.
+// Later writes are dropped.
+func (r *Recorder) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+
+	var err error
+	if len(r.pendingVideo) != 0 {
+		err = r.writePendingVideo()
+	}
+
+	return errors.Join(err, r.closeFile(false))
+}
+
+// writePendingVideo starts the first file with the video that waited for audio
+func (r *Recorder) writePendingVideo() error {
+	pendingVideo := r.pendingVideo
+	r.pendingVideo = nil
+
+	track, _ := newVideoTrack(pendingVideo[0].codec, pendingVideo[0].data)
+	if err := r.startFile(track, pendingVideo[0].pts); err != nil {
+		return err
+	}
+
+	for _, f := range pendingVideo {
+		if f.codec != track.codec {
+			continue
+		}
+
+		if err := r.writeBlock(videoTrackNumber, f.data, f.pts, f.keyframe); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *Recorder) rotationDue(pts time.Duration) bool {
+	return r.file != nil && r.opts.RotateInterval > 0 && pts-r.fileStart >= r.opts.RotateInterval
+}
+
+// startFile finalizes the current file and starts one at pts, with video if track is set.
+// Audio that was waiting for the first file is written to it.
+func (r *Recorder) startFile(track *videoTrack, pts time.Duration) error {
+	if err := r.closeFile(true); err != nil {
+		return err
+	}
+
+	extension, create := ".webm", func(path string) (container, error) {
+		return createMatroskaFile(path, track, r.audioSeen, pts)
+	}
+	switch {
+	case r.opts.Format == FormatRaw:
+		extension, create = ".ogg", func(path string) (container, error) {
+			return createRawFiles(path, track, r.audioSeen, pts)
+		}
+		if track != nil {
+			extension = ".ivf"
+		}
+	case track != nil && track.codec == CodecH264:
+		extension, create = ".mp4", func(path string) (container, error) {
+			return createMP4File(path, track, r.audioSeen, pts)
+		}
+	}
+
+	name := r.name + "-" + time.Now().UTC().Format("20060102-150405")
+	path := filepath.Join(r.dir, name+extension)
+
+	// Files started within the same second get a counter
+	var err error
+	for i := 2; ; i++ {
+		r.file, err = create(path)
+		if !errors.Is(err, os.ErrExist) {
+			break
+		}
+		path = filepath.Join(r.dir, fmt.Sprintf("%s-%d%s", name, i, extension))
+	}
+	if err != nil {
+		// Not a nil container, as create returns a nil file of its type
+		r.file = nil
+		return err
+	}
+	r.path, r.fileVideo, r.fileHasAudio, r.fileStart, r.fileEnd = path, track, r.audioSeen, pts, pts
+	if r.opts.OnStarted != nil {
+		r.opts.OnStarted(File{Paths: r.file.files()})
+	}
+
+	pendingAudio := r.pendingAudio
+	r.pendingAudio = nil
+	for _, packet := range pendingAudio {
+		if packet.pts < pts {
+			continue
+		}
+
+		if err = r.writeBlock(audioTrackNumber, packet.data, packet.pts, true); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// closeFile finalizes the current file, rotated is set if the next one is started after it
+func (r *Recorder) closeFile(rotated bool) error {
+	if r.file == nil {
+		return nil
+	}
+
+	file := File{Paths: r.file.files(), Duration: r.fileEnd - r.fileStart, Rotated: rotated}
+	err := r.file.close()
+	r.file = nil
+	if err != nil {
+		return fmt.Errorf("failed to finalize %s: %w", r.path, err)
+	}
+
+	if r.opts.OnFinalized != nil {
+		r.opts.OnFinalized(file)
+	}
+	return nil
+}
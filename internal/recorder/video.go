@@ -0,0 +1,164 @@
+package recorder
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/glimesh/broadcast-box/internal/bits"
+	"github.com/glimesh/broadcast-box/internal/h264"
+)
+
+const (
+	naluTypeBitmask = 0x1F
+	naluTypeIDR     = 5
+	naluTypeSPS     = 7
+	naluTypePPS     = 8
+	naluTypeAUD     = 9
+)
+
+// Codec is a video codec that can be recorded
+type Codec int
+
+const (
+	CodecVP8 Codec = iota + 1
+	CodecVP9
+
+	// Recorded to MP4, as WebM only allows VP8, VP9 and AV1
+	CodecH264
+)
+
+func (c Codec) matroskaCodecID() string {
+	switch c {
+	case CodecVP8:
+		return "V_VP8"
+	default:
+		return "V_VP9"
+	}
+}
+
+// IsKeyframe returns if frame can be decoded without the frames before it. H264 is an Annex B
+// access unit, VP8 and VP9 frames are as sent over RTP without their payload descriptors.
+func IsKeyframe(codec Codec, frame []byte) bool {
+	_, ok := newVideoTrack(codec, frame)
+	return ok
+}
+
+// newVideoTrack returns the track a file starting with frame has, ok is false if frame isn't
+// a keyframe the size can be read from
+func newVideoTrack(codec Codec, frame []byte) (track *videoTrack, ok bool) {
+	track = &videoTrack{codec: codec}
+
+	switch codec {
+	case CodecVP8:
+		track.width, track.height, ok = vp8Dimensions(frame)
+	case CodecVP9:
+		track.width, track.height, ok = vp9Dimensions(frame)
+	case CodecH264:
+		var sps, pps []byte
+		var idr bool
+		for _, nalu := range h264.SplitAnnexB(frame) {
+			switch nalu[0] & naluTypeBitmask {
+			case naluTypeSPS:
+				sps = nalu
+			case naluTypePPS:
+				pps = nalu
+			case naluTypeIDR:
+				idr = true
+			}
+		}
+
+		if !idr || len(sps) < 4 || len(pps) == 0 {
+			return nil, false
+		}
+
+		var err error
+		if track.width, track.height, err = h264.SPSDimensions(sps); err != nil {
+			return nil, false
+		}
+		track.codecPrivate = avcDecoderConfiguration(sps, pps)
+		ok = true
+	}
+
+	if !ok {
+		return nil, false
+	}
+	return track, true
+}
+
+// avccSample converts an Annex B access unit to length prefixed NALUs, as stored in MP4
+func avccSample(accessUnit []byte) []byte {
+	// Parameter sets are only carried in the avcC
+	data := []byte{}
+	for _, nalu := range h264.SplitAnnexB(accessUnit) {
+		switch nalu[0] & naluTypeBitmask {
+		case naluTypeSPS, naluTypePPS, naluTypeAUD:
+			continue
+		}
+
+		data = binary.BigEndian.AppendUint32(data, uint32(len(nalu)))
+		data = append(data, nalu...)
+	}
+
+	return data
+}
+
+// vp8Dimensions reads the size of a VP8 keyframe, see RFC 6386 section 9.1
+func vp8Dimensions(frame []byte) (width, height int, ok bool) {
+	if len(frame) < 10 || frame[0]&0x01 != 0 || !bytes.Equal(frame[3:6], []byte{0x9D, 0x01, 0x2A}) {
+		return 0, 0, false
+	}
+
+	width = int(binary.LittleEndian.Uint16(frame[6:]) & 0x3FFF)
+	height = int(binary.LittleEndian.Uint16(frame[8:]) & 0x3FFF)
+	return width, height, width > 0 && height > 0
+}
+
+// vp9Dimensions reads the size of a VP9 keyframe from its uncompressed header, see section 6.2
+// of the VP9 bitstream specification
+func vp9Dimensions(frame []byte) (width, height int, ok bool) {
+	r := bits.NewReader(frame)
+	if len(frame) < 10 || r.ReadBits(2) != 2 {
+		return 0, 0, false
+	}
+
+	profile := r.ReadBit()
+	profile |= r.ReadBit() << 1
+	if profile == 3 {
+		r.ReadBit()
+	}
+
+	// show_existing_frame, then frame_type which is 0 for keyframes
+	if r.ReadBit() == 1 || r.ReadBit() != 0 {
+		return 0, 0, false
+	}
+	r.ReadBit() // show_frame
+	r.ReadBit() // error_resilient_mode
+
+	if r.ReadBits(24) != 0x498342 {
+		return 0, 0, false
+	}
+
+	if profile >= 2 {
+		r.ReadBit() // ten_or_twelve_bit
+	}
+	const colorSpaceRGB = 7
+	if r.ReadBits(3) != colorSpaceRGB {
+		r.ReadBit() // color_range
+		if profile == 1 || profile == 3 {
+			r.ReadBits(3) // subsampling_x, subsampling_y and reserved_zero
+		}
+	} else if profile == 1 || profile == 3 {
+		r.ReadBit()
+	}
+
+	width, height = int(r.ReadBits(16))+1, int(r.ReadBits(16))+1
+	return width, height, r.Err() == nil
+}
+
+// avcDecoderConfiguration returns the CodecPrivate of H264, an avcC box without its header
+func avcDecoderConfiguration(sps, pps []byte) []byte {
+	avcC := []byte{1, sps[1], sps[2], sps[3], 0xFF, 0xE1}
+	avcC = append(binary.BigEndian.AppendUint16(avcC, uint16(len(sps))), sps...)
+	avcC = append(avcC, 1)
+	return append(binary.BigEndian.AppendUint16(avcC, uint16(len(pps))), pps...)
+}
@@ -0,0 +1,50 @@
+package recorder
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIsKeyframeH264(t *testing.T) {
+	pps := []byte{0, 0, 0, 1, 0x68, 0xce, 0x38, 0x80}
+	idr := []byte{0, 0, 0, 1, 0x65, 0x88, 0x84}
+
+	for _, test := range []struct {
+		name       string
+		accessUnit []byte
+		expect     bool
+	}{
+		{"keyframe", append(append([]byte{0, 0, 0, 1, 0x67, 0x42, 0x00, 0x1f, 0xf4, 0x02, 0x80, 0x2d, 0xc8}, pps...), idr...), true},
+		{"without SPS", append(append([]byte{}, pps...), idr...), false},
+		// Used to loop for billions of iterations
+		{"truncated SPS", append(append([]byte{0, 0, 0, 1, 0x67, 0x42, 0x00, 0x1f, 0xd7}, pps...), idr...), false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			done := make(chan bool, 1)
+			go func() {
+				done <- IsKeyframe(CodecH264, test.accessUnit)
+			}()
+
+			select {
+			case keyframe := <-done:
+				if keyframe != test.expect {
+					t.Fatalf("IsKeyframe returned %t", keyframe)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("IsKeyframe didn't return")
+			}
+		})
+	}
+}
+
+func TestVP9Dimensions(t *testing.T) {
+	// Profile 0 keyframe of 640x360
+	frame := []byte{0x82, 0x49, 0x83, 0x42, 0x00, 0x27, 0xf0, 0x16, 0x70, 0x00}
+	if width, height, ok := vp9Dimensions(frame); !ok || width != 640 || height != 360 {
+		t.Fatalf("got %dx%d, ok %t", width, height, ok)
+	}
+
+	if _, _, ok := vp9Dimensions(frame[:9]); ok {
+		t.Fatal("truncated frame was read")
+	}
+}
@@ -0,0 +1,526 @@
+// Package rist accepts publishers sending MPEG-TS over RIST (simple profile, TR-06-1) and
+// forwards their H264 and Opus to an Ingest, so the stream can be watched over WHEP.
+package rist
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/glimesh/broadcast-box/internal/logging"
+	"github.com/glimesh/broadcast-box/internal/mpegts"
+)
+
+var logger = logging.Logger("rist")
+
+const (
+	rtpHeaderSize  = 12
+	rtcpHeaderSize = 8
+
+	rtcpTypeRR    = 201
+	rtcpTypeSDES  = 202
+	rtcpTypeBYE   = 203
+	rtcpTypeRTPFB = 205
+
+	rtcpFormatNACK = 1
+	sdesItemCNAME  = 1
+
+	maxPacketSize    = 1500
+	recoveryLatency  = time.Second
+	nackInterval     = 20 * time.Millisecond
+	nackRetryTimeout = 100 * time.Millisecond
+	reportInterval   = time.Second
+	peerIdleTimeout  = 5 * time.Second
+	publishRetry     = 5 * time.Second
+
+	// Packets further ahead of the next expected one are dropped
+	reorderWindow = 4096
+
+	// Most lost packets reported in one NACK
+	maxNACKLosses = 512
+)
+
+// Ingest receives the media of one publisher
+type Ingest interface {
+	WriteH264(accessUnit []byte, pts time.Duration) error
+	WriteOpus(packet []byte, pts time.Duration) error
+	Close()
+	Done() <-chan struct{}
+}
+
+// PublishFunc starts an Ingest for streamKey, returning an error rejects the publisher
+type PublishFunc func(streamKey string) (Ingest, error)
+
+type listener struct {
+	rtpConn, rtcpConn net.PacketConn
+	publish           PublishFunc
+	ssrc              uint32
+
+	sessionsLock sync.Mutex
+	sessions     map[uint32]*session
+
+	// Publishers that were rejected or stopped aren't published again until then
+	retryAfter map[uint32]time.Time
+}
+
+// ListenAndServe accepts RIST publishers on the UDP address addr until reading from it fails.
+// RTP is received on the even port of addr and RTCP on the port after it. The CNAME of the
+// publisher is used as stream key.
+func ListenAndServe(addr string, publish PublishFunc) error {
+	host, portString, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+
+	port, err := strconv.Atoi(portString)
+	if err != nil {
+		return err
+	} else if port%2 != 0 {
+		return fmt.Errorf("RIST port %d must be even, RTCP is received on the port after it", port)
+	}
+
+	rtpConn, err := net.ListenPacket("udp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		return err
+	}
+
+	rtcpConn, err := net.ListenPacket("udp", net.JoinHostPort(host, strconv.Itoa(port+1)))
+	if err != nil {
+		rtpConn.Close() //nolint
+		return err
+	}
+
+	return Serve(rtpConn, rtcpConn, publish)
+}
+
+func Serve(rtpConn, rtcpConn net.PacketConn, publish PublishFunc) error {
+	l := &listener{
+		rtpConn:    rtpConn,
+		rtcpConn:   rtcpConn,
+		publish:    publish,
+		sessions:   map[uint32]*session{},
+		retryAfter: map[uint32]time.Time{},
+	}
+
+	ssrc := make([]byte, 4)
+	if _, err := rand.Read(ssrc); err != nil {
+		return err
+	}
+	l.ssrc = binary.BigEndian.Uint32(ssrc) &^ 1
+
+	rtcpErr := make(chan error, 1)
+	go func() {
+		rtcpErr <- l.read(rtcpConn, l.handleRTCP)
+		rtpConn.Close() //nolint
+	}()
+
+	err := l.read(rtpConn, l.handleRTP)
+	rtcpConn.Close() //nolint
+	if rtcpErr := <-rtcpErr; !errors.Is(rtcpErr, net.ErrClosed) {
+		return rtcpErr
+	}
+
+	return err
+}
+
+func (l *listener) read(packetConn net.PacketConn, handle func([]byte, net.Addr)) error {
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, addr, err := packetConn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+
+		handle(buf[:n], addr)
+	}
+}
+
+// senderSSRC drops the bit RIST sets in the SSRC of retransmitted packets
+func senderSSRC(ssrc uint32) uint32 {
+	return ssrc &^ 1
+}
+
+func (l *listener) handleRTP(pkt []byte, addr net.Addr) {
+	ssrc, sequence, payload, ok := parseRTP(pkt)
+	if !ok {
+		return
+	}
+
+	l.sessionsLock.Lock()
+	s, ok := l.sessions[senderSSRC(ssrc)]
+	l.sessionsLock.Unlock()
+
+	// Media is dropped until the publisher identified itself with its CNAME over RTCP
+	if ok {
+		s.handleRTP(sequence, payload)
+	}
+}
+
+// parseRTP returns the SSRC, sequence number and payload of an RTP packet, without its CSRCs,
+// header extension and padding
+func parseRTP(pkt []byte) (ssrc uint32, sequence uint16, payload []byte, ok bool) {
+	if len(pkt) < rtpHeaderSize || pkt[0]>>6 != 2 {
+		return 0, 0, nil, false
+	}
+
+	payloadOffset := rtpHeaderSize + int(pkt[0]&0x0F)*4
+	if pkt[0]&0x10 != 0 {
+		if payloadOffset+4 > len(pkt) {
+			return 0, 0, nil, false
+		}
+		payloadOffset += 4 + int(binary.BigEndian.Uint16(pkt[payloadOffset+2:]))*4
+	}
+
+	payloadEnd := len(pkt)
+	if pkt[0]&0x20 != 0 {
+		payloadEnd -= int(pkt[len(pkt)-1])
+	}
+
+	if payloadOffset > payloadEnd {
+		return 0, 0, nil, false
+	}
+
+	return binary.BigEndian.Uint32(pkt[8:]), binary.BigEndian.Uint16(pkt[2:]), pkt[payloadOffset:payloadEnd], true
+}
+
+func (l *listener) handleRTCP(compound []byte, addr net.Addr) {
+	for len(compound) >= rtcpHeaderSize && compound[0]>>6 == 2 {
+		count, packetType := int(compound[0]&0x1F), compound[1]
+		length := (int(binary.BigEndian.Uint16(compound[2:])) + 1) * 4
+		if length < rtcpHeaderSize || length > len(compound) {
+			return
+		}
+		pkt := compound[:length]
+		compound = compound[length:]
+
+		ssrc := senderSSRC(binary.BigEndian.Uint32(pkt[4:]))
+		switch packetType {
+		case rtcpTypeSDES:
+			for chunks := pkt[4:]; count > 0 && len(chunks) >= 4; count-- {
+				var cname string
+				ssrc, cname, chunks = readSDESChunk(chunks)
+				l.handleCNAME(senderSSRC(ssrc), cname, addr)
+			}
+		case rtcpTypeBYE:
+			if s := l.session(ssrc); s != nil {
+				go s.close()
+			}
+		default:
+			if s := l.session(ssrc); s != nil {
+				s.touch(addr)
+			}
+		}
+	}
+}
+
+// readSDESChunk returns the CNAME of the first chunk in chunks, and the chunks after it
+func readSDESChunk(chunks []byte) (ssrc uint32, cname string, rest []byte) {
+	ssrc = binary.BigEndian.Uint32(chunks)
+	items := chunks[4:]
+	for len(items) > 0 && items[0] != 0 {
+		if len(items) < 2 || 2+int(items[1]) > len(items) {
+			return ssrc, cname, nil
+		}
+
+		if items[0] == sdesItemCNAME {
+			cname = string(items[2 : 2+int(items[1])])
+		}
+		items = items[2+int(items[1]):]
+	}
+
+	// Chunks end with a null item padded to 32 bits
+	consumed := len(chunks) - len(items) + 1
+	consumed = (consumed + 3) &^ 3
+	if consumed > len(chunks) {
+		return ssrc, cname, nil
+	}
+
+	return ssrc, cname, chunks[consumed:]
+}
+
+func (l *listener) session(ssrc uint32) *session {
+	l.sessionsLock.Lock()
+	defer l.sessionsLock.Unlock()
+
+	return l.sessions[ssrc]
+}
+
+func (l *listener) handleCNAME(ssrc uint32, streamKey string, addr net.Addr) {
+	l.sessionsLock.Lock()
+	defer l.sessionsLock.Unlock()
+
+	if s, ok := l.sessions[ssrc]; ok {
+		s.touch(addr)
+		return
+	} else if streamKey == "" || time.Now().Before(l.retryAfter[ssrc]) {
+		return
+	}
+	delete(l.retryAfter, ssrc)
+
+	ingest, err := l.publish(streamKey)
+	if err != nil {
+		logger.Warn("Rejected RIST publisher", "addr", addr, "streamKey", streamKey, "err", err)
+		l.retryAfter[ssrc] = time.Now().Add(publishRetry)
+		return
+	}
+
+	s := &session{
+		listener:     l,
+		ssrc:         ssrc,
+		streamKey:    streamKey,
+		ingest:       ingest,
+		rtcpAddr:     addr,
+		lastReceived: time.Now(),
+		pending:      map[uint16]pendingPacket{},
+		nacked:       map[uint16]time.Time{},
+		closed:       make(chan struct{}),
+	}
+	s.demuxer = mpegts.Demuxer{
+		OnH264: ingest.WriteH264,
+		OnOpus: ingest.WriteOpus,
+		OnUnsupportedStream: func(streamType uint8) {
+			logger.Warn("Ignoring stream type, only H264 and Opus are forwarded", "streamType", fmt.Sprintf("0x%02x", streamType), "streamKey", streamKey)
+		},
+	}
+	l.sessions[ssrc] = s
+
+	logger.Info("RIST publisher started stream", "addr", addr, "streamKey", streamKey)
+	go s.run()
+}
+
+// writeRTCP sends a receiver report and our CNAME to addr, followed by extra
+func (l *listener) writeRTCP(addr net.Addr, extra []byte) {
+	pkt := []byte{0x80, rtcpTypeRR, 0, 1}
+	pkt = binary.BigEndian.AppendUint32(pkt, l.ssrc)
+
+	cname := "broadcast-box"
+	sdesLength := (4 + 2 + len(cname) + 1 + 3) &^ 3
+	sdes := []byte{0x81, rtcpTypeSDES}
+	sdes = binary.BigEndian.AppendUint16(sdes, uint16(sdesLength/4))
+	sdes = binary.BigEndian.AppendUint32(sdes, l.ssrc)
+	sdes = append(sdes, sdesItemCNAME, byte(len(cname)))
+	sdes = append(sdes, cname...)
+	sdes = append(sdes, make([]byte, 4+sdesLength-len(sdes))...)
+
+	if _, err := l.rtcpConn.WriteTo(append(append(pkt, sdes...), extra...), addr); err != nil {
+		logger.Warn("Failed to write RTCP", "addr", addr, "err", err)
+	}
+}
+
+type pendingPacket struct {
+	payload  []byte
+	received time.Time
+}
+
+// session receives the media of one publisher, delivering it in order and asking for
+// retransmissions of lost packets until they are older than recoveryLatency
+type session struct {
+	listener  *listener
+	ssrc      uint32
+	streamKey string
+	ingest    Ingest
+	demuxer   mpegts.Demuxer
+
+	lock         sync.Mutex
+	rtcpAddr     net.Addr
+	lastReceived time.Time
+
+	// Next sequence number to deliver, and received packets after it
+	started  bool
+	expected uint16
+	pending  map[uint16]pendingPacket
+
+	// When a lost packet was last asked for
+	nacked map[uint16]time.Time
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// sequenceDiff returns a - b for 16 bit RTP sequence numbers
+func sequenceDiff(a, b uint16) int16 {
+	return int16(a - b)
+}
+
+func (s *session) run() {
+	nackTicker := time.NewTicker(nackInterval)
+	reportTicker := time.NewTicker(reportInterval)
+	defer func() {
+		nackTicker.Stop()
+		reportTicker.Stop()
+	}()
+
+	for {
+		select {
+		case <-s.closed:
+			return
+		case <-s.ingest.Done():
+			s.close()
+		case <-nackTicker.C:
+			s.lock.Lock()
+			s.deliver()
+			s.sendNACK()
+			idle := time.Since(s.lastReceived) > peerIdleTimeout
+			s.lock.Unlock()
+
+			if idle {
+				logger.Info("RIST publisher timed out", "addr", s.rtcpAddr, "streamKey", s.streamKey)
+				s.close()
+			}
+		case <-reportTicker.C:
+			s.lock.Lock()
+			s.listener.writeRTCP(s.rtcpAddr, nil)
+			s.lock.Unlock()
+		}
+	}
+}
+
+func (s *session) close() {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+
+		// RIST has no way to stop the publisher, don't publish what it keeps sending right away
+		s.listener.sessionsLock.Lock()
+		delete(s.listener.sessions, s.ssrc)
+		s.listener.retryAfter[s.ssrc] = time.Now().Add(publishRetry)
+		s.listener.sessionsLock.Unlock()
+
+		s.ingest.Close()
+	})
+}
+
+// touch records RTCP of the publisher, which is where NACKs and reports are sent
+func (s *session) touch(addr net.Addr) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.rtcpAddr = addr
+	s.lastReceived = time.Now()
+}
+
+func (s *session) handleRTP(sequence uint16, payload []byte) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.lastReceived = time.Now()
+
+	if !s.started {
+		s.started, s.expected = true, sequence
+	}
+
+	if diff := sequenceDiff(sequence, s.expected); diff < 0 || diff > reorderWindow {
+		return
+	}
+
+	if _, ok := s.pending[sequence]; !ok {
+		s.pending[sequence] = pendingPacket{payload: append([]byte{}, payload...), received: time.Now()}
+	}
+	s.deliver()
+}
+
+// deliver sends packets in order to the demuxer, skipping lost ones once newer packets have waited recoveryLatency
+func (s *session) deliver() {
+	for len(s.pending) > 0 {
+		pkt, ok := s.pending[s.expected]
+		if !ok {
+			oldest := s.oldestPending()
+			if time.Since(s.pending[oldest].received) < recoveryLatency {
+				return
+			}
+
+			s.skipTo(oldest)
+			continue
+		}
+
+		delete(s.pending, s.expected)
+		delete(s.nacked, s.expected)
+		s.expected++
+
+		if err := s.demuxer.Write(pkt.payload); err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				logger.Warn("Failed to demux RIST stream", "streamKey", s.streamKey, "err", err)
+			}
+			go s.close()
+			return
+		}
+	}
+}
+
+func (s *session) oldestPending() uint16 {
+	oldest, first := uint16(0), true
+	for sequence := range s.pending {
+		if first || sequenceDiff(sequence, oldest) < 0 {
+			oldest, first = sequence, false
+		}
+	}
+
+	return oldest
+}
+
+func (s *session) skipTo(sequence uint16) {
+	for p := range s.pending {
+		if sequenceDiff(p, sequence) < 0 {
+			delete(s.pending, p)
+		}
+	}
+	for n := range s.nacked {
+		if sequenceDiff(n, sequence) < 0 {
+			delete(s.nacked, n)
+		}
+	}
+	s.expected = sequence
+}
+
+// sendNACK asks for every missing packet between expected and the newest received one with
+// a generic NACK (RFC 4585), each is asked for again if it didn't arrive after nackRetryTimeout
+func (s *session) sendNACK() {
+	if len(s.pending) == 0 {
+		return
+	}
+
+	received := make([]uint16, 0, len(s.pending))
+	for sequence := range s.pending {
+		received = append(received, sequence)
+	}
+	sort.Slice(received, func(i, j int) bool { return sequenceDiff(received[i], received[j]) < 0 })
+
+	lost := []uint16{}
+	next := s.expected
+	for _, sequence := range received {
+		for ; next != sequence && len(lost) < maxNACKLosses; next++ {
+			if time.Since(s.nacked[next]) >= nackRetryTimeout {
+				lost = append(lost, next)
+				s.nacked[next] = time.Now()
+			}
+		}
+		next = sequence + 1
+	}
+
+	if len(lost) == 0 {
+		return
+	}
+
+	// Each entry is a lost packet and a bitmask of the 16 after it
+	fci := []byte{}
+	for i := 0; i < len(lost); {
+		pid, bitmask := lost[i], uint16(0)
+		for i++; i < len(lost) && lost[i]-pid <= 16; i++ {
+			bitmask |= 1 << (lost[i] - pid - 1)
+		}
+
+		fci = binary.BigEndian.AppendUint16(fci, pid)
+		fci = binary.BigEndian.AppendUint16(fci, bitmask)
+	}
+
+	nack := []byte{0x80 | rtcpFormatNACK, rtcpTypeRTPFB}
+	nack = binary.BigEndian.AppendUint16(nack, uint16(2+len(fci)/4))
+	nack = binary.BigEndian.AppendUint32(nack, s.listener.ssrc)
+	nack = binary.BigEndian.AppendUint32(nack, s.ssrc)
+	s.listener.writeRTCP(s.rtcpAddr, append(nack, fci...))
+}
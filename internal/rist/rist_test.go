@@ -0,0 +1,322 @@
+package rist
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Packets as librist sends them in the simple profile: MPEG-TS over RTP with the payload type
+// 33, and compound RTCP of an empty receiver report and the CNAME
+const (
+	libristRTP  = "80217a6f" + "0001d4c0" + "5eb2c4f8"
+	libristRTCP = "80c90001" + "5eb2c4f8" +
+		"81ca0003" + "5eb2c4f8" + "01046c697665" + "0000"
+)
+
+type testIngest struct {
+	done chan struct{}
+}
+
+func (i *testIngest) WriteH264([]byte, time.Duration) error { return nil }
+func (i *testIngest) WriteOpus([]byte, time.Duration) error { return nil }
+func (i *testIngest) Close()                                { close(i.done) }
+func (i *testIngest) Done() <-chan struct{}                 { return i.done }
+
+// serveTest runs a listener on loopback and returns the address of its RTCP port and the
+// stream keys it publishes
+func serveTest(t *testing.T) (net.Addr, chan string) {
+	rtpConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rtcpConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	published := make(chan string, 1)
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		Serve(rtpConn, rtcpConn, func(streamKey string) (Ingest, error) { //nolint
+			published <- streamKey
+			return &testIngest{done: make(chan struct{})}, nil
+		})
+	}()
+	t.Cleanup(func() {
+		rtcpConn.Close()
+		<-served
+	})
+
+	return rtcpConn.LocalAddr(), published
+}
+
+func TestRTCPShorterThanHeader(t *testing.T) {
+	rtcpAddr, published := serveTest(t)
+
+	conn, err := net.Dial("udp", rtcpAddr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Receiver report whose length field says it is only 4 bytes long
+	if _, err = conn.Write([]byte{0x80, 0xc9, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The listener still handles the SDES of a publisher after it
+	sdes := []byte{0x81, rtcpTypeSDES, 0x00, 0x03, 0x00, 0x00, 0x00, 0x02, sdesItemCNAME, 4, 'l', 'i', 'v', 'e', 0x00, 0x00}
+	if _, err = conn.Write(sdes); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case streamKey := <-published:
+		if streamKey != "live" {
+			t.Fatalf("published `%s` instead of `live`", streamKey)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("SDES after the short RTCP packet wasn't handled")
+	}
+}
+
+func decodeHex(t testing.TB, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestParseRTP(t *testing.T) {
+	ts := bytes.Repeat([]byte{0x47, 0x1F, 0xFF, 0x10}, 47)
+
+	for _, c := range []struct {
+		name    string
+		pkt     string
+		payload []byte
+	}{
+		{"librist", libristRTP + hex.EncodeToString(ts), ts},
+		{"CSRC", "82217a6f0001d4c05eb2c4f8" + "0000000100000002" + "47", []byte{0x47}},
+		{"header extension", "90217a6f0001d4c05eb2c4f8" + "bede0001" + "12345678" + "47", []byte{0x47}},
+		{"padding", "a0217a6f0001d4c05eb2c4f8" + "47" + "000003", []byte{0x47}},
+		{"only padding", "a0217a6f0001d4c05eb2c4f8" + "000003", []byte{}},
+		{"empty", libristRTP, []byte{}},
+		{"short", libristRTP[:22], nil},
+		{"version 1", "40217a6f0001d4c05eb2c4f847", nil},
+		{"truncated CSRC", "8f217a6f0001d4c05eb2c4f8" + "00000001", nil},
+		{"truncated header extension", "90217a6f0001d4c05eb2c4f8" + "bede", nil},
+		{"header extension too long", "90217a6f0001d4c05eb2c4f8" + "bede0002" + "12345678", nil},
+		{"padding too long", "a0217a6f0001d4c05eb2c4f8" + "4705", nil},
+		{"padding longer than the packet", "a0217a6f0001d4c05eb2c4f8" + "ff", nil},
+	} {
+		ssrc, sequence, payload, ok := parseRTP(decodeHex(t, c.pkt))
+		if ok != (c.payload != nil) || !bytes.Equal(payload, c.payload) {
+			t.Errorf("%s parsed as % x, %v", c.name, payload, ok)
+		} else if ok && (ssrc != 0x5eb2c4f8 || sequence != 0x7a6f) {
+			t.Errorf("%s parsed with the SSRC %x and sequence number %d", c.name, ssrc, sequence)
+		}
+	}
+}
+
+func TestReadSDESChunk(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		chunks string
+		cname  string
+		rest   string
+	}{
+		{"librist", "5eb2c4f8" + "01046c697665" + "0000", "live", ""},
+		{"two chunks", "5eb2c4f8" + "01046c697665" + "0000" + "5eb2c4fa" + "0101610000000000", "live", "5eb2c4fa0101610000000000"},
+		{"other items", "5eb2c4f8" + "0203626f78" + "01046c697665" + "00", "live", ""},
+		{"padded to a word", "5eb2c4f8" + "0105616263646500", "abcde", ""},
+		{"no items", "5eb2c4f8" + "00000000", "", ""},
+		{"empty CNAME", "5eb2c4f8" + "0100" + "0000", "", ""},
+		{"without items", "5eb2c4f8", "", ""},
+		{"without the null item", "5eb2c4f8" + "01046c697665", "live", ""},
+		{"truncated item", "5eb2c4f8" + "01056c697665", "", ""},
+		{"truncated item header", "5eb2c4f8" + "01", "", ""},
+	} {
+		ssrc, cname, rest := readSDESChunk(decodeHex(t, c.chunks))
+		if ssrc != 0x5eb2c4f8 || cname != c.cname || hex.EncodeToString(rest) != c.rest {
+			t.Errorf("%s read as %x, %q and % x", c.name, ssrc, cname, rest)
+		}
+	}
+}
+
+// newTestListener returns a listener that rejects every publisher, and the stream keys
+// it was asked to publish
+func newTestListener(t testing.TB) (*listener, *[]string) {
+	rtcpConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = rtcpConn.Close() })
+
+	published := []string{}
+	return &listener{
+		rtcpConn: rtcpConn,
+		publish: func(streamKey string) (Ingest, error) {
+			published = append(published, streamKey)
+			return nil, errors.New("rejected")
+		},
+		sessions:   map[uint32]*session{},
+		retryAfter: map[uint32]time.Time{},
+	}, &published
+}
+
+func TestHandleRTCP(t *testing.T) {
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9}
+
+	for _, c := range []struct {
+		name      string
+		compound  string
+		published string
+	}{
+		{"librist", libristRTCP, "live"},
+		{"retransmission SSRC", "81ca0003" + "5eb2c4f9" + "01046c697665" + "0000", "live"},
+		{"two chunks", "82ca0004" + "5eb2c4f8" + "01016100" + "5eb2c4fa" + "01016200", "a,b"},
+		{"more chunks than sent", "85ca0003" + "5eb2c4f8" + "01046c697665" + "0000", "live"},
+		{"after a BYE", "81cb0001" + "5eb2c4f8" + libristRTCP, "live"},
+		{"after an unknown packet", "80cc0002" + "5eb2c4f8" + "6e616d65" + libristRTCP, "live"},
+		{"length too long", "80c90009" + "5eb2c4f8" + libristRTCP[16:], ""},
+		{"length too short", "80c90000" + "5eb2c4f8" + libristRTCP[16:], ""},
+		{"version 1", "40c90001" + "5eb2c4f8" + libristRTCP[16:], ""},
+		{"short", "80c9", ""},
+		{"without a CNAME", "81ca0002" + "5eb2c4f8" + "00000000", ""},
+	} {
+		l, published := newTestListener(t)
+		l.handleRTCP(decodeHex(t, c.compound), addr)
+
+		if strings.Join(*published, ",") != c.published {
+			t.Errorf("%s published %v", c.name, *published)
+		}
+	}
+
+	// Rejected publishers are only published again after a while
+	l, published := newTestListener(t)
+	l.handleRTCP(decodeHex(t, libristRTCP), addr)
+	l.handleRTCP(decodeHex(t, libristRTCP), addr)
+	if len(*published) != 1 {
+		t.Fatalf("published %v", *published)
+	}
+}
+
+func TestSessionReorders(t *testing.T) {
+	l, _ := newTestListener(t)
+	s := &session{
+		listener:     l,
+		rtcpAddr:     &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9},
+		lastReceived: time.Now(),
+		pending:      map[uint16]pendingPacket{},
+		nacked:       map[uint16]time.Time{},
+		closed:       make(chan struct{}),
+	}
+
+	// Sequence numbers wrap around
+	for _, sequence := range []uint16{0xFFFF, 1, 0, 0} {
+		s.handleRTP(sequence, nil)
+	}
+	if s.expected != 2 || len(s.pending) != 0 {
+		t.Fatalf("expecting %d with %d pending", s.expected, len(s.pending))
+	}
+
+	// Old and far away packets are dropped
+	s.handleRTP(0xFFFF, nil)
+	s.handleRTP(2+reorderWindow+1, nil)
+	if len(s.pending) != 0 {
+		t.Fatalf("%d packets pending", len(s.pending))
+	}
+
+	// Lost packets are asked for once until nackRetryTimeout
+	s.handleRTP(5, nil)
+	s.sendNACK()
+	s.sendNACK()
+	if len(s.nacked) != 3 {
+		t.Fatalf("asked for %d packets", len(s.nacked))
+	}
+
+	for _, sequence := range []uint16{2, 3, 4} {
+		s.handleRTP(sequence, nil)
+	}
+	if s.expected != 6 || len(s.pending) != 0 || len(s.nacked) != 0 {
+		t.Fatalf("expecting %d with %d pending and %d asked for", s.expected, len(s.pending), len(s.nacked))
+	}
+}
+
+func FuzzParseRTP(f *testing.F) {
+	f.Add(decodeHex(f, libristRTP+"47"))
+	f.Add(decodeHex(f, "90217a6f0001d4c05eb2c4f8"+"bede0001"+"12345678"+"47"))
+	f.Add(decodeHex(f, "a0217a6f0001d4c05eb2c4f8"+"47"+"000003"))
+
+	f.Fuzz(func(t *testing.T, pkt []byte) {
+		if _, _, payload, ok := parseRTP(pkt); ok && len(payload) > len(pkt)-rtpHeaderSize {
+			t.Fatalf("payload of %d bytes in a packet of %d", len(payload), len(pkt))
+		}
+	})
+}
+
+func FuzzReadSDESChunk(f *testing.F) {
+	f.Add(decodeHex(f, "5eb2c4f8"+"01046c697665"+"0000"))
+	f.Add(decodeHex(f, "5eb2c4f8"+"0203626f78"+"01046c697665"+"00"))
+
+	f.Fuzz(func(t *testing.T, chunks []byte) {
+		if len(chunks) < 4 {
+			return
+		}
+
+		if _, cname, rest := readSDESChunk(chunks); len(rest) >= len(chunks) || !bytes.HasSuffix(chunks, rest) || len(cname) > 255 {
+			t.Fatalf("read %q and %d of %d bytes are left", cname, len(rest), len(chunks))
+		}
+	})
+}
+
+func FuzzHandleRTCP(f *testing.F) {
+	f.Add(decodeHex(f, libristRTCP))
+	f.Add(decodeHex(f, "82ca0004"+"5eb2c4f8"+"01016100"+"5eb2c4fa"+"01016200"))
+	f.Add(decodeHex(f, "81cb0001"+"5eb2c4f8"+libristRTCP))
+
+	f.Fuzz(func(t *testing.T, compound []byte) {
+		l, published := newTestListener(t)
+		l.handleRTCP(compound, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9})
+
+		for _, streamKey := range *published {
+			if streamKey == "" {
+				t.Fatal("published an empty stream key")
+			}
+		}
+	})
+}
+
+// FuzzSession sends RTP packets of the same SSRC, each prefixed with a sequence number
+func FuzzSession(f *testing.F) {
+	f.Add(binary.BigEndian.AppendUint16(nil, 1), []byte{0x47})
+	f.Add(binary.BigEndian.AppendUint16(nil, 0xFFFF), []byte{})
+
+	f.Fuzz(func(t *testing.T, sequences []byte, payload []byte) {
+		l, _ := newTestListener(t)
+		s := &session{
+			listener:     l,
+			rtcpAddr:     &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9},
+			lastReceived: time.Now(),
+			pending:      map[uint16]pendingPacket{},
+			nacked:       map[uint16]time.Time{},
+			closed:       make(chan struct{}),
+		}
+
+		for ; len(sequences) >= 2; sequences = sequences[2:] {
+			s.handleRTP(binary.BigEndian.Uint16(sequences), payload)
+			s.sendNACK()
+		}
+		if len(s.pending) > reorderWindow+1 {
+			t.Fatalf("%d packets pending", len(s.pending))
+		}
+	})
+}
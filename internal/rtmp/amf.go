@@ -0,0 +1,200 @@
+package rtmp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+const (
+	amf0Number      = 0x00
+	amf0Boolean     = 0x01
+	amf0String      = 0x02
+	amf0Object      = 0x03
+	amf0Null        = 0x05
+	amf0Undefined   = 0x06
+	amf0ECMAArray   = 0x08
+	amf0ObjectEnd   = 0x09
+	amf0StrictArray = 0x0A
+	amf0Date        = 0x0B
+	amf0LongString  = 0x0C
+)
+
+// amfObject is an AMF0 object, ECMA arrays are decoded to the same type
+type amfObject map[string]any
+
+type amfUndefined struct{}
+
+var errAMFObjectEnd = errors.New("AMF0 object end")
+
+// decodeAMF0 decodes every value in b, like the name, transaction ID and arguments of a command
+func decodeAMF0(b []byte) ([]any, error) {
+	r := bytes.NewReader(b)
+
+	values := []any{}
+	for r.Len() > 0 {
+		v, err := decodeAMF0Value(r)
+		if err != nil {
+			return nil, err
+		}
+
+		values = append(values, v)
+	}
+
+	return values, nil
+}
+
+func decodeAMF0Value(r *bytes.Reader) (any, error) {
+	marker, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	switch marker {
+	case amf0Number:
+		var n uint64
+		if err = binary.Read(r, binary.BigEndian, &n); err != nil {
+			return nil, err
+		}
+
+		return math.Float64frombits(n), nil
+	case amf0Boolean:
+		b, err := r.ReadByte()
+		return b != 0, err
+	case amf0String:
+		return decodeAMF0String(r, 2)
+	case amf0LongString:
+		return decodeAMF0String(r, 4)
+	case amf0Object:
+		return decodeAMF0Object(r)
+	case amf0ECMAArray:
+		if _, err = r.Seek(4, io.SeekCurrent); err != nil {
+			return nil, err
+		}
+
+		return decodeAMF0Object(r)
+	case amf0StrictArray:
+		var count uint32
+		if err = binary.Read(r, binary.BigEndian, &count); err != nil {
+			return nil, err
+		}
+
+		values := []any{}
+		for ; count > 0; count-- {
+			v, err := decodeAMF0Value(r)
+			if err != nil {
+				return nil, err
+			}
+
+			values = append(values, v)
+		}
+
+		return values, nil
+	case amf0Date:
+		var date struct {
+			Milliseconds float64
+			Timezone     int16
+		}
+		if err = binary.Read(r, binary.BigEndian, &date); err != nil {
+			return nil, err
+		}
+
+		return date.Milliseconds, nil
+	case amf0Null:
+		return nil, nil
+	case amf0Undefined:
+		return amfUndefined{}, nil
+	case amf0ObjectEnd:
+		return nil, errAMFObjectEnd
+	}
+
+	return nil, fmt.Errorf("unsupported AMF0 marker 0x%02x", marker)
+}
+
+func decodeAMF0String(r *bytes.Reader, lengthSize int) (string, error) {
+	length := uint32(0)
+	for ; lengthSize > 0; lengthSize-- {
+		b, err := r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+
+		length = length<<8 | uint32(b)
+	}
+
+	if int64(length) > int64(r.Len()) {
+		return "", io.ErrUnexpectedEOF
+	}
+
+	s := make([]byte, length)
+	_, err := io.ReadFull(r, s)
+	return string(s), err
+}
+
+func decodeAMF0Object(r *bytes.Reader) (amfObject, error) {
+	obj := amfObject{}
+	for {
+		key, err := decodeAMF0String(r, 2)
+		if err != nil {
+			return nil, err
+		}
+
+		v, err := decodeAMF0Value(r)
+		if errors.Is(err, errAMFObjectEnd) && key == "" {
+			return obj, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		obj[key] = v
+	}
+}
+
+// encodeAMF0 encodes values of type float64, int, bool, string, amfObject, nil and amfUndefined
+func encodeAMF0(values ...any) []byte {
+	b := &bytes.Buffer{}
+	for _, v := range values {
+		encodeAMF0Value(b, v)
+	}
+
+	return b.Bytes()
+}
+
+func encodeAMF0Value(b *bytes.Buffer, v any) {
+	switch v := v.(type) {
+	case float64:
+		b.WriteByte(amf0Number)
+		_ = binary.Write(b, binary.BigEndian, math.Float64bits(v))
+	case int:
+		encodeAMF0Value(b, float64(v))
+	case bool:
+		b.WriteByte(amf0Boolean)
+		if v {
+			b.WriteByte(1)
+		} else {
+			b.WriteByte(0)
+		}
+	case string:
+		b.WriteByte(amf0String)
+		encodeAMF0String(b, v)
+	case amfObject:
+		b.WriteByte(amf0Object)
+		for key, value := range v {
+			encodeAMF0String(b, key)
+			encodeAMF0Value(b, value)
+		}
+		b.Write([]byte{0, 0, amf0ObjectEnd})
+	case amfUndefined:
+		b.WriteByte(amf0Undefined)
+	default:
+		b.WriteByte(amf0Null)
+	}
+}
+
+func encodeAMF0String(b *bytes.Buffer, s string) {
+	_ = binary.Write(b, binary.BigEndian, uint16(len(s)))
+	b.WriteString(s)
+}
@@ -0,0 +1,224 @@
+package rtmp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const (
+	defaultChunkSize = 128
+
+	// Largest message accepted from a publisher, bounds memory used per connection
+	maxMessageLength = 16 * 1024 * 1024
+
+	extendedTimestamp = 0xFFFFFF
+)
+
+type message struct {
+	typeID    uint8
+	streamID  uint32
+	timestamp uint32
+	payload   []byte
+}
+
+// chunkStream is the state of one chunk stream ID, later chunks only carry what changed
+type chunkStream struct {
+	timestamp, timestampDelta uint32
+	hasExtendedTimestamp      bool
+	length                    uint32
+	typeID                    uint8
+	streamID                  uint32
+	payload                   []byte
+}
+
+type chunkReader struct {
+	r            *bufio.Reader
+	chunkSize    uint32
+	chunkStreams map[uint32]*chunkStream
+
+	// Bytes read so far, used to send acknowledgements
+	bytesRead uint32
+}
+
+func newChunkReader(r *bufio.Reader) *chunkReader {
+	return &chunkReader{r: r, chunkSize: defaultChunkSize, chunkStreams: map[uint32]*chunkStream{}}
+}
+
+func (c *chunkReader) read(b []byte) error {
+	n, err := io.ReadFull(c.r, b)
+	c.bytesRead += uint32(n)
+	return err
+}
+
+func (c *chunkReader) readUint(size int) (uint32, error) {
+	b := make([]byte, 4)
+	if err := c.read(b[4-size:]); err != nil {
+		return 0, err
+	}
+
+	return binary.BigEndian.Uint32(b), nil
+}
+
+// readMessage reads chunks until a message is complete
+func (c *chunkReader) readMessage() (*message, error) {
+	for {
+		basicHeader, err := c.readUint(1)
+		if err != nil {
+			return nil, err
+		}
+
+		format := basicHeader >> 6
+		csid := basicHeader & 0x3F
+		switch csid {
+		case 0:
+			id, err := c.readUint(1)
+			if err != nil {
+				return nil, err
+			}
+			csid = 64 + id
+		case 1:
+			id, err := c.readUint(2)
+			if err != nil {
+				return nil, err
+			}
+			csid = 64 + (id&0xFF)<<8 + id>>8
+		}
+
+		cs, ok := c.chunkStreams[csid]
+		if !ok {
+			if format != 0 {
+				return nil, fmt.Errorf("chunk stream %d started with chunk format %d", csid, format)
+			}
+
+			cs = &chunkStream{}
+			c.chunkStreams[csid] = cs
+		}
+
+		if err = c.readMessageHeader(cs, format); err != nil {
+			return nil, err
+		}
+
+		if cs.length > maxMessageLength {
+			return nil, fmt.Errorf("message of %d bytes exceeds limit", cs.length)
+		}
+
+		size := cs.length - uint32(len(cs.payload))
+		if size > c.chunkSize {
+			size = c.chunkSize
+		}
+
+		chunk := make([]byte, size)
+		if err = c.read(chunk); err != nil {
+			return nil, err
+		}
+		cs.payload = append(cs.payload, chunk...)
+
+		if uint32(len(cs.payload)) == cs.length {
+			m := &message{typeID: cs.typeID, streamID: cs.streamID, timestamp: cs.timestamp, payload: cs.payload}
+			cs.payload = nil
+			return m, nil
+		}
+	}
+}
+
+func (c *chunkReader) readMessageHeader(cs *chunkStream, format uint32) error {
+	newMessage := len(cs.payload) == 0
+
+	if format == 3 {
+		if cs.hasExtendedTimestamp {
+			if _, err := c.readUint(4); err != nil {
+				return err
+			}
+		}
+
+		if newMessage {
+			cs.timestamp += cs.timestampDelta
+		}
+
+		return nil
+	}
+
+	timestamp, err := c.readUint(3)
+	if err != nil {
+		return err
+	}
+
+	if format <= 1 {
+		if cs.length, err = c.readUint(3); err != nil {
+			return err
+		}
+
+		typeID, err := c.readUint(1)
+		if err != nil {
+			return err
+		}
+		cs.typeID = uint8(typeID)
+	}
+
+	if format == 0 {
+		b := make([]byte, 4)
+		if err = c.read(b); err != nil {
+			return err
+		}
+		cs.streamID = binary.LittleEndian.Uint32(b)
+	}
+
+	if cs.hasExtendedTimestamp = timestamp == extendedTimestamp; cs.hasExtendedTimestamp {
+		if timestamp, err = c.readUint(4); err != nil {
+			return err
+		}
+	}
+
+	// Chunks of a message can't change its header, drop what was buffered if they do
+	cs.payload = nil
+
+	if format == 0 {
+		cs.timestamp = timestamp
+		cs.timestampDelta = 0
+	} else {
+		cs.timestamp += timestamp
+		cs.timestampDelta = timestamp
+	}
+
+	return nil
+}
+
+// writeMessage sends m as chunks of chunkSize on chunk stream csid
+func writeMessage(w io.Writer, csid uint8, m *message, chunkSize int) error {
+	timestamp := m.timestamp
+	if timestamp >= extendedTimestamp {
+		timestamp = extendedTimestamp
+	}
+
+	header := make([]byte, 12)
+	header[0] = csid
+	header[1], header[2], header[3] = byte(timestamp>>16), byte(timestamp>>8), byte(timestamp)
+	header[4], header[5], header[6] = byte(len(m.payload)>>16), byte(len(m.payload)>>8), byte(len(m.payload))
+	header[7] = m.typeID
+	binary.LittleEndian.PutUint32(header[8:], m.streamID)
+
+	// Every chunk of a message with an extended timestamp repeats it
+	extended := []byte{}
+	if timestamp == extendedTimestamp {
+		extended = binary.BigEndian.AppendUint32(nil, m.timestamp)
+	}
+
+	out := append(header, extended...)
+	for payload := m.payload; len(payload) > 0; {
+		size := len(payload)
+		if size > chunkSize {
+			size = chunkSize
+		}
+
+		out = append(out, payload[:size]...)
+		if payload = payload[size:]; len(payload) > 0 {
+			out = append(out, 0xC0|csid)
+			out = append(out, extended...)
+		}
+	}
+
+	_, err := w.Write(out)
+	return err
+}
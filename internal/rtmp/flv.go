@@ -0,0 +1,244 @@
+package rtmp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/glimesh/broadcast-box/internal/h264"
+)
+
+const (
+	flvCodecAVC = 7
+
+	flvFrameTypeKeyframe = 1
+	flvFrameTypeInter    = 2
+
+	// Enhanced RTMP v2 audio, the sound format that is followed by a FourCC
+	flvSoundFormatExHeader = 9
+	flvSoundFormatAAC      = 10
+
+	audioPacketSequenceStart = 0
+	audioPacketCodedFrames   = 1
+
+	avcPacketSequenceHeader = 0
+	avcPacketNALU           = 1
+
+	naluTypeBitmask = 0x1F
+	naluTypeIDR     = 5
+	naluTypeSPS     = 7
+	naluTypePPS     = 8
+	naluTypeAUD     = 9
+)
+
+var annexBStartCode = []byte{0x00, 0x00, 0x00, 0x01}
+
+// unsupportedAudio is the error a publisher sending audio is disconnected with, viewers need
+// Opus and AAC isn't transcoded to it
+func unsupportedAudio(soundFormat byte) error {
+	if soundFormat == flvSoundFormatAAC {
+		return errors.New("AAC audio can't be published over RTMP, WebRTC viewers need Opus and it isn't transcoded, publish without audio")
+	}
+
+	return fmt.Errorf("unsupported RTMP sound format %d, only H264 video without audio can be published", soundFormat)
+}
+
+// videoDepacketizer turns FLV video tags into H264 access units in Annex B format
+type videoDepacketizer struct {
+	// From the AVCDecoderConfigurationRecord, sent before the first frame
+	naluLengthSize int
+	sps, pps       [][]byte
+}
+
+// depacketize returns the access unit carried by a video message, nil if it had none
+func (v *videoDepacketizer) depacketize(m *message) ([]byte, time.Duration, error) {
+	if len(m.payload) < 5 {
+		return nil, 0, nil
+	}
+
+	frameType, codecID := m.payload[0]>>4, m.payload[0]&0x0F
+	// Enhanced RTMP (HEVC, AV1...) sets the top bit of the frame type
+	if frameType&0x08 != 0 || codecID != flvCodecAVC {
+		return nil, 0, fmt.Errorf("unsupported RTMP video codec %d, only H264 can be published", codecID)
+	}
+
+	compositionTime := int32(binary.BigEndian.Uint32(m.payload[1:5])<<8) >> 8
+	pts := time.Duration(int64(m.timestamp)+int64(compositionTime)) * time.Millisecond
+	data := m.payload[5:]
+
+	switch m.payload[1] {
+	case avcPacketSequenceHeader:
+		return nil, 0, v.parseDecoderConfiguration(data)
+	case avcPacketNALU:
+		if v.naluLengthSize == 0 {
+			return nil, 0, nil
+		}
+	default:
+		return nil, 0, nil
+	}
+
+	accessUnit := []byte{}
+	hasParameterSets := false
+	for len(data) > 0 {
+		if len(data) < v.naluLengthSize {
+			return nil, 0, errors.New("truncated NALU length")
+		}
+
+		naluLength := 0
+		for _, b := range data[:v.naluLengthSize] {
+			naluLength = naluLength<<8 | int(b)
+		}
+		data = data[v.naluLengthSize:]
+
+		if naluLength > len(data) {
+			return nil, 0, errors.New("truncated NALU")
+		} else if naluLength == 0 {
+			continue
+		}
+
+		if naluType := data[0] & naluTypeBitmask; naluType == naluTypeSPS || naluType == naluTypePPS {
+			hasParameterSets = true
+		}
+
+		accessUnit = append(accessUnit, annexBStartCode...)
+		accessUnit = append(accessUnit, data[:naluLength]...)
+		data = data[naluLength:]
+	}
+
+	// Encoders only send SPS/PPS in the sequence header, viewers need them before every keyframe
+	if frameType == flvFrameTypeKeyframe && !hasParameterSets {
+		parameterSets := []byte{}
+		for _, nalu := range append(append([][]byte{}, v.sps...), v.pps...) {
+			parameterSets = append(parameterSets, annexBStartCode...)
+			parameterSets = append(parameterSets, nalu...)
+		}
+
+		accessUnit = append(parameterSets, accessUnit...)
+	}
+
+	return accessUnit, pts, nil
+}
+
+func (v *videoDepacketizer) parseDecoderConfiguration(data []byte) error {
+	errTruncated := errors.New("truncated AVCDecoderConfigurationRecord")
+	if len(data) < 6 {
+		return errTruncated
+	}
+
+	v.naluLengthSize = int(data[4]&0x03) + 1
+	v.sps, v.pps = nil, nil
+
+	offset := 5
+	readParameterSets := func(countMask byte) ([][]byte, error) {
+		if offset >= len(data) {
+			return nil, errTruncated
+		}
+
+		count := int(data[offset] & countMask)
+		offset++
+
+		parameterSets := [][]byte{}
+		for ; count > 0; count-- {
+			if offset+2 > len(data) {
+				return nil, errTruncated
+			}
+
+			length := int(binary.BigEndian.Uint16(data[offset:]))
+			offset += 2
+			if offset+length > len(data) {
+				return nil, errTruncated
+			}
+
+			parameterSets = append(parameterSets, append([]byte{}, data[offset:offset+length]...))
+			offset += length
+		}
+
+		return parameterSets, nil
+	}
+
+	var err error
+	if v.sps, err = readParameterSets(0x1F); err != nil {
+		return err
+	}
+
+	v.pps, err = readParameterSets(0xFF)
+	return err
+}
+
+// videoPacketizer turns H264 access units in Annex B format into FLV video tags
+type videoPacketizer struct {
+	sps, pps []byte
+}
+
+// packetize returns the video tag of accessUnit, preceded by a sequence header when the
+// parameter sets changed. Nothing is returned before the first keyframe with parameter sets.
+func (v *videoPacketizer) packetize(accessUnit []byte) (sequenceHeader, tag []byte) {
+	nalus := h264.SplitAnnexB(accessUnit)
+
+	keyframe, parameterSetsChanged := false, false
+	data := []byte{}
+	for _, nalu := range nalus {
+		switch nalu[0] & naluTypeBitmask {
+		case naluTypeSPS:
+			if !bytes.Equal(nalu, v.sps) && len(nalu) >= 4 {
+				v.sps, parameterSetsChanged = append([]byte{}, nalu...), true
+			}
+			continue
+		case naluTypePPS:
+			if !bytes.Equal(nalu, v.pps) {
+				v.pps, parameterSetsChanged = append([]byte{}, nalu...), true
+			}
+			continue
+		case naluTypeAUD:
+			continue
+		case naluTypeIDR:
+			keyframe = true
+		}
+
+		data = binary.BigEndian.AppendUint32(data, uint32(len(nalu)))
+		data = append(data, nalu...)
+	}
+
+	if v.sps == nil || v.pps == nil || len(data) == 0 {
+		return nil, nil
+	}
+
+	if parameterSetsChanged {
+		if !keyframe {
+			return nil, nil
+		}
+
+		sequenceHeader = []byte{flvFrameTypeKeyframe<<4 | flvCodecAVC, avcPacketSequenceHeader, 0, 0, 0}
+		sequenceHeader = append(sequenceHeader, 1, v.sps[1], v.sps[2], v.sps[3], 0xFF, 0xE1)
+		sequenceHeader = binary.BigEndian.AppendUint16(sequenceHeader, uint16(len(v.sps)))
+		sequenceHeader = append(sequenceHeader, v.sps...)
+		sequenceHeader = append(sequenceHeader, 1)
+		sequenceHeader = binary.BigEndian.AppendUint16(sequenceHeader, uint16(len(v.pps)))
+		sequenceHeader = append(sequenceHeader, v.pps...)
+	}
+
+	frameType := byte(flvFrameTypeInter)
+	if keyframe {
+		frameType = flvFrameTypeKeyframe
+	}
+
+	// Without B-frames the composition time is always 0
+	tag = append([]byte{frameType<<4 | flvCodecAVC, avcPacketNALU, 0, 0, 0}, data...)
+	return sequenceHeader, tag
+}
+
+// opusSequenceStart is the Enhanced RTMP audio tag with the OpusHead of a stereo stream, see RFC 7845 section 5.1
+func opusSequenceStart() []byte {
+	tag := []byte{flvSoundFormatExHeader<<4 | audioPacketSequenceStart, 'O', 'p', 'u', 's'}
+	tag = append(tag, "OpusHead"...)
+	tag = append(tag, 1, 2)
+	tag = binary.LittleEndian.AppendUint16(tag, 3840)
+	tag = binary.LittleEndian.AppendUint32(tag, 48000)
+	return append(tag, 0, 0, 0)
+}
+
+func opusTag(packet []byte) []byte {
+	return append([]byte{flvSoundFormatExHeader<<4 | audioPacketCodedFrames, 'O', 'p', 'u', 's'}, packet...)
+}
@@ -0,0 +1,520 @@
+package rtmp
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/glimesh/broadcast-box/internal/h264"
+)
+
+const (
+	pushQueueSize = 512
+	pushRetry     = 5 * time.Second
+	dialTimeout   = 10 * time.Second
+	writeTimeout  = 10 * time.Second
+
+	userControlPingRequest  = 6
+	userControlPingResponse = 7
+
+	audioChunkStream = 4
+	videoChunkStream = 6
+)
+
+type pushFrame struct {
+	video bool
+	data  []byte
+	pts   time.Duration
+}
+
+// Pusher publishes H264, and optionally Opus, to an RTMP server like Twitch or YouTube,
+// reconnecting whenever the connection drops. Media is queued so a slow server doesn't
+// hold up the writer, when the queue is full video is dropped until the next keyframe.
+type Pusher struct {
+	url  *url.URL
+	opus bool
+
+	queue chan pushFrame
+
+	// Set when a video frame was dropped, only written with writeLock held
+	writeLock      sync.Mutex
+	skipToKeyframe bool
+
+	connectedLock sync.Mutex
+	connected     bool
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// NewPusher starts publishing to a URL like `rtmp://live.twitch.tv/app/<stream key>`, the
+// last path element is the stream key. rtmps URLs connect over TLS. Opus is only sent when
+// opus is set, as Enhanced RTMP audio which many servers don't accept.
+func NewPusher(rawURL string, opus bool) (*Pusher, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	} else if u.Scheme != "rtmp" && u.Scheme != "rtmps" {
+		return nil, fmt.Errorf("unsupported scheme `%s`, expected rtmp or rtmps", u.Scheme)
+	} else if u.Hostname() == "" || strings.Count(strings.Trim(u.Path, "/"), "/") < 1 {
+		return nil, errors.New("RTMP URL must be like rtmp://host/app/<stream key>")
+	}
+
+	p := &Pusher{
+		url:    u,
+		opus:   opus,
+		queue:  make(chan pushFrame, pushQueueSize),
+		closed: make(chan struct{}),
+	}
+	go p.run()
+
+	return p, nil
+}
+
+// WriteH264 queues an access unit in Annex B format
+func (p *Pusher) WriteH264(accessUnit []byte, pts time.Duration) error {
+	p.writeLock.Lock()
+	defer p.writeLock.Unlock()
+
+	if p.skipToKeyframe {
+		if !hasIDR(accessUnit) {
+			return nil
+		}
+		p.skipToKeyframe = false
+	}
+
+	select {
+	case p.queue <- pushFrame{video: true, data: accessUnit, pts: pts}:
+	default:
+		p.skipToKeyframe = true
+	}
+
+	return nil
+}
+
+// WriteOpus queues a copy of an Opus packet, it is dropped unless the Pusher sends Opus
+func (p *Pusher) WriteOpus(packet []byte, pts time.Duration) error {
+	if !p.opus {
+		return nil
+	}
+
+	select {
+	case p.queue <- pushFrame{data: append([]byte{}, packet...), pts: pts}:
+	default:
+	}
+
+	return nil
+}
+
+// Connected reports if the Pusher is currently publishing
+func (p *Pusher) Connected() bool {
+	p.connectedLock.Lock()
+	defer p.connectedLock.Unlock()
+
+	return p.connected
+}
+
+func (p *Pusher) setConnected(connected bool) {
+	p.connectedLock.Lock()
+	defer p.connectedLock.Unlock()
+
+	p.connected = connected
+}
+
+func (p *Pusher) Close() {
+	p.closeOnce.Do(func() {
+		close(p.closed)
+	})
+}
+
+func hasIDR(accessUnit []byte) bool {
+	for _, nalu := range h264.SplitAnnexB(accessUnit) {
+		if nalu[0]&naluTypeBitmask == naluTypeIDR {
+			return true
+		}
+	}
+	return false
+}
+
+// host is the address of the server, it doesn't contain the stream key so it can be logged
+func (p *Pusher) host() string {
+	host := p.url.Host
+	if p.url.Port() == "" {
+		port := "1935"
+		if p.url.Scheme == "rtmps" {
+			port = "443"
+		}
+		host = net.JoinHostPort(p.url.Hostname(), port)
+	}
+
+	return host
+}
+
+func (p *Pusher) run() {
+	for {
+		err := p.publish()
+		p.setConnected(false)
+
+		select {
+		case <-p.closed:
+			return
+		default:
+		}
+
+		logger.Warn("RTMP push failed, retrying", "host", p.host(), "retryIn", pushRetry, "err", err)
+		select {
+		case <-p.closed:
+			return
+		case <-time.After(pushRetry):
+		}
+	}
+}
+
+// pushConn is one connection of a Pusher
+type pushConn struct {
+	netConn net.Conn
+	chunks  *chunkReader
+
+	writeLock sync.Mutex
+
+	// Results of commands and the onStatus of publish, by transaction ID
+	results chan []any
+}
+
+func (p *Pusher) publish() error {
+	var (
+		netConn net.Conn
+		err     error
+	)
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	if p.url.Scheme == "rtmps" {
+		netConn, err = tls.DialWithDialer(dialer, "tcp", p.host(), &tls.Config{ServerName: p.url.Hostname()})
+	} else {
+		netConn, err = dialer.Dial("tcp", p.host())
+	}
+	if err != nil {
+		return err
+	}
+
+	c := &pushConn{netConn: netConn, results: make(chan []any, 8)}
+	defer netConn.Close()
+
+	// Unblock reads and writes once the Pusher is closed
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-p.closed:
+			netConn.Close() //nolint
+		case <-done:
+		}
+	}()
+
+	bufReader := bufio.NewReader(netConn)
+	if err = c.handshake(bufReader); err != nil {
+		return fmt.Errorf("handshake failed: %w", err)
+	}
+
+	c.chunks = newChunkReader(bufReader)
+	readErr := make(chan error, 1)
+	go func() {
+		readErr <- c.readLoop()
+	}()
+
+	path := strings.Trim(p.url.Path, "/")
+	app := path[:strings.LastIndex(path, "/")]
+	streamKey := path[strings.LastIndex(path, "/")+1:]
+	if p.url.RawQuery != "" {
+		streamKey += "?" + p.url.RawQuery
+	}
+	tcURL := p.url.Scheme + "://" + p.url.Host + "/" + app
+
+	if err = c.writeControl(typeSetChunkSize, outChunkSize); err != nil {
+		return err
+	}
+
+	if _, err = c.call(readErr, 1, 0, "connect", amfObject{
+		"app":      app,
+		"type":     "nonprivate",
+		"flashVer": "FMLE/3.0 (compatible; Broadcast Box)",
+		"tcUrl":    tcURL,
+	}); err != nil {
+		return fmt.Errorf("connect failed: %w", err)
+	}
+
+	// Not every server answers these, so they aren't waited for
+	if err = c.writeCommand(0, "releaseStream", 2, nil, streamKey); err != nil {
+		return err
+	}
+	if err = c.writeCommand(0, "FCPublish", 3, nil, streamKey); err != nil {
+		return err
+	}
+
+	result, err := c.call(readErr, 4, 0, "createStream", nil)
+	if err != nil {
+		return fmt.Errorf("createStream failed: %w", err)
+	}
+	streamID, _ := result[3].(float64)
+
+	if _, err = c.call(readErr, 5, uint32(streamID), "publish", nil, streamKey, "live"); err != nil {
+		return fmt.Errorf("publish failed: %w", err)
+	}
+
+	logger.Info("RTMP push started", "host", p.host())
+	p.setConnected(true)
+
+	// Don't send what was queued while connecting, it is late already
+	for len(p.queue) > 0 {
+		<-p.queue
+	}
+
+	return p.sendMedia(c, uint32(streamID), readErr)
+}
+
+func (p *Pusher) sendMedia(c *pushConn, streamID uint32, readErr chan error) error {
+	metadata := amfObject{"videocodecid": flvCodecAVC, "encoder": "Broadcast Box"}
+	if err := c.writeMessage(commandChunkStream, &message{
+		typeID:   typeAMF0Data,
+		streamID: streamID,
+		payload:  encodeAMF0("@setDataFrame", "onMetaData", metadata),
+	}); err != nil {
+		return err
+	}
+
+	var (
+		video      videoPacketizer
+		started    bool
+		base       time.Duration
+		sentHeader bool
+	)
+	for {
+		var frame pushFrame
+		select {
+		case <-p.closed:
+			return nil
+		case err := <-readErr:
+			return err
+		case frame = <-p.queue:
+		}
+
+		// Timestamps start at the first keyframe, audio before it is dropped
+		if !frame.video && !started {
+			continue
+		}
+
+		var messages []*message
+		if frame.video {
+			sequenceHeader, tag := video.packetize(frame.data)
+			if tag == nil {
+				continue
+			}
+
+			if !started {
+				started, base = true, frame.pts
+			}
+
+			timestamp := uint32((frame.pts - base) / time.Millisecond)
+			if sequenceHeader != nil {
+				messages = append(messages, &message{typeID: typeVideo, streamID: streamID, timestamp: timestamp, payload: sequenceHeader})
+			}
+			messages = append(messages, &message{typeID: typeVideo, streamID: streamID, timestamp: timestamp, payload: tag})
+		} else {
+			if frame.pts < base {
+				continue
+			}
+
+			timestamp := uint32((frame.pts - base) / time.Millisecond)
+			if !sentHeader {
+				sentHeader = true
+				messages = append(messages, &message{typeID: typeAudio, streamID: streamID, timestamp: timestamp, payload: opusSequenceStart()})
+			}
+			messages = append(messages, &message{typeID: typeAudio, streamID: streamID, timestamp: timestamp, payload: opusTag(frame.data)})
+		}
+
+		for _, m := range messages {
+			csid := uint8(videoChunkStream)
+			if m.typeID == typeAudio {
+				csid = audioChunkStream
+			}
+
+			if err := c.writeMessage(csid, m); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// handshake performs the simple RTMP handshake as the client
+func (c *pushConn) handshake(r *bufio.Reader) error {
+	if err := c.netConn.SetDeadline(time.Now().Add(dialTimeout)); err != nil {
+		return err
+	}
+	defer c.netConn.SetDeadline(time.Time{}) //nolint
+
+	c0c1 := make([]byte, 1+handshakeSize)
+	c0c1[0] = 3
+	if _, err := rand.Read(c0c1[9:]); err != nil {
+		return err
+	}
+
+	if _, err := c.netConn.Write(c0c1); err != nil {
+		return err
+	}
+
+	s0s1 := make([]byte, 1+handshakeSize)
+	if _, err := io.ReadFull(r, s0s1); err != nil {
+		return err
+	} else if s0s1[0] != 3 {
+		return fmt.Errorf("unsupported RTMP version %d", s0s1[0])
+	}
+
+	if _, err := io.ReadFull(r, make([]byte, handshakeSize)); err != nil {
+		return err
+	}
+
+	// C2 echoes S1
+	_, err := c.netConn.Write(s0s1[1:])
+	return err
+}
+
+// readLoop handles the messages of the server until the connection fails or the server
+// ends the stream. Command results are passed to call.
+func (c *pushConn) readLoop() error {
+	var windowAckSize, lastAck uint32
+	for {
+		m, err := c.chunks.readMessage()
+		if err != nil {
+			return err
+		}
+
+		switch m.typeID {
+		case typeSetChunkSize:
+			if len(m.payload) < 4 {
+				return errors.New("short Set Chunk Size message")
+			}
+
+			chunkSize := binary.BigEndian.Uint32(m.payload) & 0x7FFFFFFF
+			if chunkSize == 0 || chunkSize > maxMessageLength {
+				return fmt.Errorf("invalid chunk size %d", chunkSize)
+			}
+			c.chunks.chunkSize = chunkSize
+		case typeWindowAckSize:
+			if len(m.payload) >= 4 {
+				windowAckSize = binary.BigEndian.Uint32(m.payload)
+			}
+		case typeUserControl:
+			if len(m.payload) >= 6 && binary.BigEndian.Uint16(m.payload) == userControlPingRequest {
+				pong := append(binary.BigEndian.AppendUint16(nil, userControlPingResponse), m.payload[2:6]...)
+				if err = c.writeMessage(controlChunkStream, &message{typeID: typeUserControl, payload: pong}); err != nil {
+					return err
+				}
+			}
+		case typeAMF0Command, typeAMF3Command:
+			payload := m.payload
+			if m.typeID == typeAMF3Command && len(payload) > 0 {
+				payload = payload[1:]
+			}
+
+			values, err := decodeAMF0(payload)
+			if err != nil {
+				return err
+			}
+
+			if len(values) >= 1 && values[0] == "onStatus" && len(values) >= 4 {
+				info, _ := values[3].(amfObject)
+				if level, _ := info["level"].(string); level == "error" {
+					code, _ := info["code"].(string)
+					description, _ := info["description"].(string)
+					return fmt.Errorf("%s: %s", code, description)
+				}
+			}
+
+			select {
+			case c.results <- values:
+			default:
+			}
+		}
+
+		if windowAckSize != 0 && c.chunks.bytesRead-lastAck >= windowAckSize {
+			lastAck = c.chunks.bytesRead
+			if err = c.writeControl(typeAck, lastAck); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// call sends a command and waits for its `_result`, or the onStatus of publish
+func (c *pushConn) call(readErr chan error, transactionID float64, streamID uint32, name string, args ...any) ([]any, error) {
+	if err := c.writeCommand(streamID, name, transactionID, args...); err != nil {
+		return nil, err
+	}
+
+	timeout := time.After(dialTimeout)
+	for {
+		select {
+		case values := <-c.results:
+			if len(values) < 2 {
+				continue
+			}
+
+			switch id, _ := values[1].(float64); {
+			case values[0] == "_error" && id == transactionID:
+				return nil, errors.New("server returned _error")
+			case values[0] == "_result" && id == transactionID && len(values) >= 4:
+				return values, nil
+			case values[0] == "onStatus" && name == "publish":
+				return values, nil
+			}
+		case err := <-readErr:
+			// Put it back for sendMedia, which also waits on it
+			readErr <- err
+			return nil, err
+		case <-timeout:
+			return nil, errors.New("timed out waiting for the server")
+		}
+	}
+}
+
+func (c *pushConn) writeMessage(csid uint8, m *message) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	if err := c.netConn.SetWriteDeadline(time.Now().Add(writeTimeout)); err != nil {
+		return err
+	}
+
+	return writeMessage(c.netConn, csid, m, outChunkSize)
+}
+
+func (c *pushConn) writeControl(typeID uint8, value uint32) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	payload := binary.BigEndian.AppendUint32(nil, value)
+
+	// Set Chunk Size applies to every message after it, it is sent with the previous size
+	chunkSize := outChunkSize
+	if typeID == typeSetChunkSize {
+		chunkSize = defaultChunkSize
+	}
+
+	return writeMessage(c.netConn, controlChunkStream, &message{typeID: typeID, payload: payload}, chunkSize)
+}
+
+func (c *pushConn) writeCommand(streamID uint32, name string, transactionID float64, args ...any) error {
+	return c.writeMessage(commandChunkStream, &message{
+		typeID:   typeAMF0Command,
+		streamID: streamID,
+		payload:  encodeAMF0(append([]any{name, transactionID}, args...)...),
+	})
+}
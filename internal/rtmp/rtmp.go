@@ -0,0 +1,333 @@
+// Package rtmp accepts publishers from encoders that only speak RTMP and forwards their
+// video to an Ingest, so the stream can be watched over WHEP. A Pusher restreams the other
+// way, to RTMP servers like Twitch or YouTube.
+package rtmp
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/glimesh/broadcast-box/internal/logging"
+)
+
+var logger = logging.Logger("rtmp")
+
+const (
+	handshakeSize = 1536
+
+	outChunkSize       = 4096
+	windowAckSize      = 2500000
+	handshakeTimeout   = 10 * time.Second
+	readTimeout        = 30 * time.Second
+	controlChunkStream = 2
+	commandChunkStream = 3
+
+	typeSetChunkSize     = 1
+	typeAbort            = 2
+	typeAck              = 3
+	typeUserControl      = 4
+	typeWindowAckSize    = 5
+	typeSetPeerBandwidth = 6
+	typeAudio            = 8
+	typeVideo            = 9
+	typeAMF3Command      = 17
+	typeAMF0Data         = 18
+	typeAMF0Command      = 20
+
+	// Stream ID returned by createStream, publishers only use one
+	publishStreamID = 1
+)
+
+// Ingest receives the media of one publisher
+type Ingest interface {
+	WriteH264(accessUnit []byte, pts time.Duration) error
+	Close()
+	Done() <-chan struct{}
+}
+
+// PublishFunc starts an Ingest for streamKey, returning an error rejects the publisher
+type PublishFunc func(streamKey string) (Ingest, error)
+
+// ListenAndServe accepts RTMP publishers on addr until the listener fails
+func ListenAndServe(addr string, publish PublishFunc) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	return Serve(listener, publish)
+}
+
+func Serve(listener net.Listener, publish PublishFunc) error {
+	for {
+		c, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+
+		go func() {
+			defer c.Close()
+
+			conn := &conn{netConn: c, publish: publish}
+			if err := conn.serve(); err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				logger.Info("RTMP connection closed", "addr", c.RemoteAddr(), "err", err)
+			}
+		}()
+	}
+}
+
+type conn struct {
+	netConn net.Conn
+	publish PublishFunc
+	chunks  *chunkReader
+
+	ingest    Ingest
+	streamKey string
+	video     videoDepacketizer
+
+	// Acknowledgement window requested by the publisher
+	peerWindowAckSize, lastAck uint32
+}
+
+func (c *conn) serve() error {
+	bufReader := bufio.NewReader(c.netConn)
+	if err := c.handshake(bufReader); err != nil {
+		return fmt.Errorf("handshake failed: %w", err)
+	}
+
+	defer func() {
+		if c.ingest != nil {
+			c.ingest.Close()
+		}
+	}()
+
+	c.chunks = newChunkReader(bufReader)
+	for {
+		if err := c.netConn.SetReadDeadline(time.Now().Add(readTimeout)); err != nil {
+			return err
+		}
+
+		m, err := c.chunks.readMessage()
+		if err != nil {
+			return err
+		}
+
+		if err = c.handleMessage(m); err != nil {
+			return err
+		}
+
+		if c.peerWindowAckSize != 0 && c.chunks.bytesRead-c.lastAck >= c.peerWindowAckSize {
+			c.lastAck = c.chunks.bytesRead
+			if err = c.writeControl(typeAck, c.lastAck); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// handshake performs the simple (digest-less) RTMP handshake, accepted by common encoders
+func (c *conn) handshake(r *bufio.Reader) error {
+	if err := c.netConn.SetDeadline(time.Now().Add(handshakeTimeout)); err != nil {
+		return err
+	}
+	defer c.netConn.SetDeadline(time.Time{}) //nolint
+
+	c0c1 := make([]byte, 1+handshakeSize)
+	if _, err := io.ReadFull(r, c0c1); err != nil {
+		return err
+	}
+
+	if c0c1[0] != 3 {
+		return fmt.Errorf("unsupported RTMP version %d", c0c1[0])
+	}
+
+	s0s1s2 := make([]byte, 1+handshakeSize*2)
+	s0s1s2[0] = 3
+	if _, err := rand.Read(s0s1s2[9 : 1+handshakeSize]); err != nil {
+		return err
+	}
+	copy(s0s1s2[1+handshakeSize:], c0c1[1:])
+
+	if _, err := c.netConn.Write(s0s1s2); err != nil {
+		return err
+	}
+
+	_, err := io.ReadFull(r, make([]byte, handshakeSize))
+	return err
+}
+
+func (c *conn) handleMessage(m *message) error {
+	switch m.typeID {
+	case typeSetChunkSize:
+		if len(m.payload) < 4 {
+			return errors.New("short Set Chunk Size message")
+		}
+
+		chunkSize := binary.BigEndian.Uint32(m.payload) & 0x7FFFFFFF
+		if chunkSize == 0 || chunkSize > maxMessageLength {
+			return fmt.Errorf("invalid chunk size %d", chunkSize)
+		}
+		c.chunks.chunkSize = chunkSize
+	case typeAbort:
+		if len(m.payload) >= 4 {
+			if cs, ok := c.chunks.chunkStreams[binary.BigEndian.Uint32(m.payload)]; ok {
+				cs.payload = nil
+			}
+		}
+	case typeWindowAckSize:
+		if len(m.payload) >= 4 {
+			c.peerWindowAckSize = binary.BigEndian.Uint32(m.payload)
+		}
+	case typeAMF0Command, typeAMF3Command:
+		payload := m.payload
+		if m.typeID == typeAMF3Command && len(payload) > 0 {
+			payload = payload[1:]
+		}
+
+		values, err := decodeAMF0(payload)
+		if err != nil {
+			return err
+		}
+
+		return c.handleCommand(values)
+	case typeVideo:
+		if c.ingest == nil {
+			return nil
+		}
+
+		accessUnit, pts, err := c.video.depacketize(m)
+		if err != nil {
+			return err
+		} else if accessUnit == nil {
+			return nil
+		}
+
+		return c.ingest.WriteH264(accessUnit, pts)
+	case typeAudio:
+		if c.ingest == nil || len(m.payload) == 0 {
+			return nil
+		}
+
+		// Audio isn't forwarded, rejecting it tells the publisher instead of viewers getting a silent stream
+		err := unsupportedAudio(m.payload[0] >> 4)
+		if writeErr := c.writeCommand(publishStreamID, "onStatus", 0, nil,
+			amfObject{"level": "error", "code": "NetStream.Failed", "description": err.Error()},
+		); writeErr != nil {
+			return writeErr
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+func (c *conn) handleCommand(values []any) error {
+	if len(values) < 2 {
+		return nil
+	}
+
+	name, _ := values[0].(string)
+	transactionID, _ := values[1].(float64)
+
+	switch name {
+	case "connect":
+		if err := c.writeControl(typeWindowAckSize, windowAckSize); err != nil {
+			return err
+		}
+
+		// Dynamic limit type
+		peerBandwidth := binary.BigEndian.AppendUint32(nil, windowAckSize)
+		if err := c.writeMessage(controlChunkStream, &message{typeID: typeSetPeerBandwidth, payload: append(peerBandwidth, 2)}); err != nil {
+			return err
+		}
+
+		if err := c.writeControl(typeSetChunkSize, outChunkSize); err != nil {
+			return err
+		}
+
+		return c.writeCommand(0, "_result", transactionID,
+			amfObject{"fmsVer": "FMS/3,0,1,123", "capabilities": 31},
+			amfObject{"level": "status", "code": "NetConnection.Connect.Success", "description": "Connection succeeded.", "objectEncoding": 0},
+		)
+	case "createStream":
+		return c.writeCommand(0, "_result", transactionID, nil, publishStreamID)
+	case "publish":
+		streamKey := ""
+		if len(values) >= 4 {
+			streamKey, _ = values[3].(string)
+		}
+
+		// Some encoders append the stream key with a query string, like `key?token=...`
+		streamKey, _, _ = strings.Cut(streamKey, "?")
+
+		return c.startPublish(transactionID, streamKey)
+	case "FCUnpublish", "deleteStream", "closeStream":
+		return io.EOF
+	}
+
+	return nil
+}
+
+func (c *conn) startPublish(transactionID float64, streamKey string) error {
+	if c.ingest != nil {
+		return errors.New("publish sent twice")
+	}
+
+	ingest, err := c.publish(streamKey)
+	if err != nil {
+		if writeErr := c.writeCommand(publishStreamID, "onStatus", transactionID, nil,
+			amfObject{"level": "error", "code": "NetStream.Publish.BadName", "description": err.Error()},
+		); writeErr != nil {
+			return writeErr
+		}
+
+		return fmt.Errorf("publish of `%s` rejected: %w", streamKey, err)
+	}
+
+	c.ingest = ingest
+	c.streamKey = streamKey
+	logger.Info("RTMP publisher started stream", "addr", c.netConn.RemoteAddr(), "streamKey", streamKey)
+
+	// Unblock the read loop when the server ends the stream
+	go func() {
+		<-ingest.Done()
+		c.netConn.Close() //nolint
+	}()
+
+	return c.writeCommand(publishStreamID, "onStatus", transactionID, nil,
+		amfObject{"level": "status", "code": "NetStream.Publish.Start", "description": "Publishing " + streamKey},
+	)
+}
+
+func (c *conn) writeMessage(csid uint8, m *message) error {
+	return writeMessage(c.netConn, csid, m, outChunkSize)
+}
+
+func (c *conn) writeControl(typeID uint8, value uint32) error {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, value)
+
+	// Set Chunk Size applies to every message after it, it is sent with the previous size
+	chunkSize := outChunkSize
+	if typeID == typeSetChunkSize {
+		chunkSize = defaultChunkSize
+	}
+
+	return writeMessage(c.netConn, controlChunkStream, &message{typeID: typeID, payload: payload}, chunkSize)
+}
+
+func (c *conn) writeCommand(streamID uint32, name string, transactionID float64, args ...any) error {
+	return c.writeMessage(commandChunkStream, &message{
+		typeID:   typeAMF0Command,
+		streamID: streamID,
+		payload:  encodeAMF0(append([]any{name, transactionID}, args...)...),
+	})
+}
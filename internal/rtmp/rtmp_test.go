@@ -0,0 +1,77 @@
+package rtmp
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testIngest struct {
+	done chan struct{}
+}
+
+func (i *testIngest) WriteH264([]byte, time.Duration) error { return nil }
+func (i *testIngest) Close()                                { close(i.done) }
+func (i *testIngest) Done() <-chan struct{}                 { return i.done }
+
+func TestAACRejected(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	ingest := &testIngest{done: make(chan struct{})}
+	go Serve(listener, func(string) (Ingest, error) { return ingest, nil }) //nolint
+
+	netConn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { netConn.Close() })
+
+	c := &pushConn{netConn: netConn, results: make(chan []any, 8)}
+	bufReader := bufio.NewReader(netConn)
+	if err = c.handshake(bufReader); err != nil {
+		t.Fatal(err)
+	}
+
+	c.chunks = newChunkReader(bufReader)
+	readErr := make(chan error, 1)
+	go func() {
+		readErr <- c.readLoop()
+	}()
+
+	if _, err = c.call(readErr, 1, 0, "connect", amfObject{"app": "live"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.call(readErr, 2, 0, "createStream", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.call(readErr, 3, publishStreamID, "publish", nil, "aac", "live"); err != nil {
+		t.Fatal(err)
+	}
+
+	// AAC sequence header, 44.1 kHz stereo
+	aac := []byte{flvSoundFormatAAC<<4 | 0x0F, 0x00, 0x12, 0x10}
+	if err = c.writeMessage(audioChunkStream, &message{typeID: typeAudio, streamID: publishStreamID, payload: aac}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err = <-readErr:
+		if err == nil || !strings.Contains(err.Error(), "NetStream.Failed") || !strings.Contains(err.Error(), "AAC") {
+			t.Fatalf("publisher of AAC got %v instead of NetStream.Failed", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("publisher of AAC wasn't rejected")
+	}
+
+	select {
+	case <-ingest.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("ingest of the rejected publisher wasn't closed")
+	}
+}
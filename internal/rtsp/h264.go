@@ -0,0 +1,108 @@
+package rtsp
+
+const (
+	naluTypeBitmask = 0x1F
+
+	naluTypeIDR  = 5
+	naluTypeSPS  = 7
+	naluTypePPS  = 8
+	naluTypeSTAP = 24
+	naluTypeFUA  = 28
+)
+
+var annexBStartCode = []byte{0x00, 0x00, 0x00, 0x01}
+
+// h264Depacketizer builds access units from RFC 6184 payloads. Cameras often only send the
+// SPS and PPS in the SDP, so they are added in front of IDRs without them.
+type h264Depacketizer struct {
+	parameterSets [][]byte
+
+	nalus     [][]byte
+	fragment  []byte
+	timestamp uint32
+}
+
+// depacketize returns an access unit in Annex B format and its timestamp once complete
+func (h *h264Depacketizer) depacketize(payload []byte, timestamp uint32, marker bool) (accessUnit []byte, accessUnitTimestamp uint32) {
+	// Some sources don't set the marker bit, a new timestamp also ends the last access unit
+	if len(h.nalus) != 0 && timestamp != h.timestamp {
+		accessUnit, accessUnitTimestamp = h.flush(), h.timestamp
+	}
+	h.timestamp = timestamp
+
+	if len(payload) != 0 {
+		switch payload[0] & naluTypeBitmask {
+		case naluTypeSTAP:
+			for aggregated := payload[1:]; len(aggregated) > 2; {
+				size := int(aggregated[0])<<8 | int(aggregated[1])
+				if 2+size > len(aggregated) {
+					break
+				}
+
+				if size != 0 {
+					h.nalus = append(h.nalus, aggregated[2:2+size])
+				}
+				aggregated = aggregated[2+size:]
+			}
+		case naluTypeFUA:
+			if len(payload) < 2 {
+				break
+			}
+
+			start, end := payload[1]&0x80 != 0, payload[1]&0x40 != 0
+			if start {
+				h.fragment = []byte{payload[0]&0xE0 | payload[1]&naluTypeBitmask}
+			} else if h.fragment == nil {
+				// The start of this NALU was lost
+				break
+			}
+
+			h.fragment = append(h.fragment, payload[2:]...)
+			if end {
+				h.nalus = append(h.nalus, h.fragment)
+				h.fragment = nil
+			}
+		default:
+			h.nalus = append(h.nalus, payload)
+		}
+	}
+
+	if marker && len(h.nalus) != 0 {
+		// A complete access unit would replace the one flushed above, there can only be one
+		if accessUnit == nil {
+			accessUnit, accessUnitTimestamp = h.flush(), timestamp
+		}
+	}
+
+	return accessUnit, accessUnitTimestamp
+}
+
+func (h *h264Depacketizer) flush() []byte {
+	hasIDR, hasParameterSets := false, false
+	for _, nalu := range h.nalus {
+		if len(nalu) == 0 {
+			continue
+		}
+
+		switch nalu[0] & naluTypeBitmask {
+		case naluTypeIDR:
+			hasIDR = true
+		case naluTypeSPS, naluTypePPS:
+			hasParameterSets = true
+		}
+	}
+
+	nalus := h.nalus
+	if hasIDR && !hasParameterSets {
+		nalus = append(append([][]byte{}, h.parameterSets...), nalus...)
+	}
+
+	accessUnit := []byte{}
+	for _, nalu := range nalus {
+		accessUnit = append(accessUnit, annexBStartCode...)
+		accessUnit = append(accessUnit, nalu...)
+	}
+	h.nalus = nil
+
+	return accessUnit
+}
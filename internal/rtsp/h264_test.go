@@ -0,0 +1,61 @@
+package rtsp
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestH264Depacketizer(t *testing.T) {
+	sps, pps, idr := []byte{0x67, 0x42, 0x00, 0x1f}, []byte{0x68, 0xce}, []byte{0x65, 0x88, 0x84}
+	annexB := func(nalus ...[]byte) []byte {
+		accessUnit := []byte{}
+		for _, nalu := range nalus {
+			accessUnit = append(append(accessUnit, annexBStartCode...), nalu...)
+		}
+		return accessUnit
+	}
+
+	for _, test := range []struct {
+		name     string
+		payloads [][]byte
+		expect   []byte
+	}{
+		{"single NALU", [][]byte{{0x41, 0x9a}}, annexB([]byte{0x41, 0x9a})},
+		{"STAP-A", [][]byte{{0x18, 0x00, 0x04, 0x67, 0x42, 0x00, 0x1f, 0x00, 0x02, 0x68, 0xce}, idr}, annexB(sps, pps, idr)},
+		{"STAP-A with zero-size NALU", [][]byte{{0x18, 0x00, 0x00, 0x00, 0x02, 0x41, 0x9a}}, annexB([]byte{0x41, 0x9a})},
+		{"STAP-A of only zero-size NALUs", [][]byte{{0x18, 0x00, 0x00, 0x00, 0x00}}, nil},
+		{"truncated STAP-A", [][]byte{{0x18, 0x00, 0x09, 0x41}}, nil},
+		{"STAP-A without size", [][]byte{{0x18, 0x00}}, nil},
+		{"FU-A", [][]byte{{0x7c, 0x85, 0x88}, {0x7c, 0x05, 0x84}, {0x7c, 0x45, 0x21}}, annexB(sps, pps, []byte{0x65, 0x88, 0x84, 0x21})},
+		{"FU-A without header", [][]byte{{0x7c}}, nil},
+		{"FU-A without data", [][]byte{{0x7c, 0xc5}}, annexB(sps, pps, []byte{0x65})},
+		{"FU-A without start", [][]byte{{0x7c, 0x45, 0x21}}, nil},
+		{"IDR gets parameter sets", [][]byte{idr}, annexB(sps, pps, idr)},
+		{"empty payload", [][]byte{{}}, nil},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			h := &h264Depacketizer{parameterSets: [][]byte{sps, pps}}
+			var accessUnit []byte
+			for i, payload := range test.payloads {
+				accessUnit, _ = h.depacketize(payload, 3000, i == len(test.payloads)-1)
+			}
+
+			if !bytes.Equal(accessUnit, test.expect) {
+				t.Fatalf("got access unit %x instead of %x", accessUnit, test.expect)
+			}
+		})
+	}
+}
+
+func FuzzH264Depacketizer(f *testing.F) {
+	f.Add([]byte{0x18, 0x00, 0x04, 0x67, 0x42, 0x00, 0x1f, 0x00, 0x02, 0x68, 0xce}, []byte{0x65, 0x88})
+	f.Add([]byte{0x18, 0x00, 0x00, 0x00, 0x00}, []byte{0x7c, 0x85, 0x88})
+	f.Add([]byte{0x7c, 0x85, 0x88}, []byte{0x7c, 0x45, 0x21})
+
+	f.Fuzz(func(t *testing.T, first, second []byte) {
+		h := &h264Depacketizer{parameterSets: [][]byte{{0x67, 0x42}, {0x68, 0xce}}}
+		h.depacketize(first, 0, false)
+		h.depacketize(second, 0, true)
+		h.depacketize(first, 3000, true)
+	})
+}
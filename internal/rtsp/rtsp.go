@@ -0,0 +1,426 @@
+// Package rtsp plays H264 (and Opus) from RTSP sources like IP cameras and writes it to
+// an Ingest, so the camera can be watched over WHEP. It also serves streams to RTSP
+// clients like VLC and NVRs.
+package rtsp
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/sdp/v3"
+)
+
+const (
+	defaultPort      = "554"
+	dialTimeout      = 10 * time.Second
+	readTimeout      = 30 * time.Second
+	keepaliveTimeout = 60 * time.Second
+	userAgent        = "Broadcast Box"
+
+	// Responses are SDPs and errors, larger bodies aren't read into memory
+	maxResponseBodySize = 1 << 20
+)
+
+// Ingest receives the media of one source
+type Ingest interface {
+	WriteH264(accessUnit []byte, pts time.Duration) error
+	WriteOpus(packet []byte, pts time.Duration) error
+	Close()
+	Done() <-chan struct{}
+}
+
+// PublishFunc starts the Ingest media is written to, it is called once the source is playing
+type PublishFunc func() (Ingest, error)
+
+type track struct {
+	isOpus    bool
+	control   string
+	clockRate int
+
+	h264 h264Depacketizer
+
+	firstTimestamp    uint32
+	firstTimestampSet bool
+}
+
+type client struct {
+	conn   net.Conn
+	reader *bufio.Reader
+
+	writeLock sync.Mutex
+	cseq      int
+	session   string
+	auth      *authenticator
+}
+
+type response struct {
+	statusCode int
+	header     textproto.MIMEHeader
+	body       []byte
+}
+
+// Pull plays rawURL over RTSP with RTP interleaved on the TCP connection. It returns once
+// the connection fails or the Ingest is closed.
+func Pull(rawURL string, publish PublishFunc) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	} else if u.Scheme != "rtsp" {
+		return fmt.Errorf("unsupported URL scheme `%s`", u.Scheme)
+	}
+
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), defaultPort)
+	}
+
+	conn, err := net.DialTimeout("tcp", host, dialTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	c := &client{conn: conn, reader: bufio.NewReader(conn), auth: &authenticator{user: u.User}}
+
+	// Credentials are sent via the Authorization header, not the request URL
+	requestURL := *u
+	requestURL.User = nil
+
+	res, err := c.request("DESCRIBE", requestURL.String(), textproto.MIMEHeader{"Accept": {"application/sdp"}})
+	if err != nil {
+		return err
+	}
+
+	baseURL := &requestURL
+	if contentBase := res.header.Get("Content-Base"); contentBase != "" {
+		if baseURL, err = url.Parse(contentBase); err != nil {
+			return err
+		}
+	}
+
+	tracks, err := parseTracks(res.body, baseURL)
+	if err != nil {
+		return err
+	}
+
+	for i, t := range tracks {
+		transport := fmt.Sprintf("RTP/AVP/TCP;unicast;interleaved=%d-%d", i*2, i*2+1)
+		if _, err = c.request("SETUP", t.control, textproto.MIMEHeader{"Transport": {transport}}); err != nil {
+			return err
+		}
+	}
+
+	if _, err = c.request("PLAY", baseURL.String(), textproto.MIMEHeader{"Range": {"npt=0.000-"}}); err != nil {
+		return err
+	}
+
+	ingest, err := publish()
+	if err != nil {
+		return err
+	}
+	defer ingest.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	go c.keepalive(baseURL.String(), ingest, done)
+
+	return c.readInterleaved(tracks, ingest)
+}
+
+// keepalive refreshes the session until done, and closes the connection when the Ingest is closed
+func (c *client) keepalive(requestURL string, ingest Ingest, done chan struct{}) {
+	ticker := time.NewTicker(keepaliveTimeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ingest.Done():
+			c.conn.Close() //nolint
+			return
+		case <-ticker.C:
+			// The response is skipped by readInterleaved
+			if err := c.writeRequest("GET_PARAMETER", requestURL, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (c *client) writeRequest(method, requestURL string, header textproto.MIMEHeader) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	c.cseq++
+	req := &strings.Builder{}
+	fmt.Fprintf(req, "%s %s RTSP/1.0\r\nCSeq: %d\r\nUser-Agent: %s\r\n", method, requestURL, c.cseq, userAgent)
+	if c.session != "" {
+		fmt.Fprintf(req, "Session: %s\r\n", c.session)
+	}
+	if authorization := c.auth.authorization(method, requestURL); authorization != "" {
+		fmt.Fprintf(req, "Authorization: %s\r\n", authorization)
+	}
+	for key, values := range header {
+		for _, value := range values {
+			fmt.Fprintf(req, "%s: %s\r\n", key, value)
+		}
+	}
+	req.WriteString("\r\n")
+
+	if err := c.conn.SetWriteDeadline(time.Now().Add(readTimeout)); err != nil {
+		return err
+	}
+
+	_, err := io.WriteString(c.conn, req.String())
+	return err
+}
+
+// request sends a request before PLAY and reads its response, retrying once with credentials
+func (c *client) request(method, requestURL string, header textproto.MIMEHeader) (*response, error) {
+	for attempt := 0; ; attempt++ {
+		if err := c.writeRequest(method, requestURL, header); err != nil {
+			return nil, err
+		}
+
+		res, err := c.readResponse()
+		if err != nil {
+			return nil, err
+		}
+
+		if res.statusCode == 401 && attempt == 0 && c.auth.challenge(res.header.Values("WWW-Authenticate")) {
+			continue
+		} else if res.statusCode != 200 {
+			return nil, fmt.Errorf("%s responded with status %d", method, res.statusCode)
+		}
+
+		if session := res.header.Get("Session"); session != "" {
+			c.session, _, _ = strings.Cut(session, ";")
+		}
+
+		return res, nil
+	}
+}
+
+func (c *client) readResponse() (*response, error) {
+	if err := c.conn.SetReadDeadline(time.Now().Add(readTimeout)); err != nil {
+		return nil, err
+	}
+
+	reader := textproto.NewReader(c.reader)
+	statusLine, err := reader.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+
+	parts := strings.SplitN(statusLine, " ", 3)
+	if len(parts) < 2 || !strings.HasPrefix(parts[0], "RTSP/") {
+		return nil, fmt.Errorf("malformed status line `%s`", statusLine)
+	}
+
+	statusCode, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return nil, err
+	}
+
+	header, err := reader.ReadMIMEHeader()
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+
+	res := &response{statusCode: statusCode, header: header}
+	if contentLength, _ := strconv.Atoi(header.Get("Content-Length")); contentLength > maxResponseBodySize {
+		return nil, fmt.Errorf("response body of %d bytes is too large", contentLength)
+	} else if contentLength > 0 {
+		res.body = make([]byte, contentLength)
+		if _, err = io.ReadFull(c.reader, res.body); err != nil {
+			return nil, err
+		}
+	}
+
+	return res, nil
+}
+
+// readInterleaved reads RTP packets framed as `$<channel><length>` and skips RTCP and RTSP responses
+func (c *client) readInterleaved(tracks []*track, ingest Ingest) error {
+	header := make([]byte, 4)
+	for {
+		if err := c.conn.SetReadDeadline(time.Now().Add(readTimeout)); err != nil {
+			return err
+		}
+
+		magic, err := c.reader.Peek(1)
+		if err != nil {
+			return err
+		}
+
+		if magic[0] != '$' {
+			if _, err = c.readResponse(); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if _, err = io.ReadFull(c.reader, header); err != nil {
+			return err
+		}
+
+		pkt := make([]byte, int(header[2])<<8|int(header[3]))
+		if _, err = io.ReadFull(c.reader, pkt); err != nil {
+			return err
+		}
+
+		channel := int(header[1])
+		if channel%2 != 0 || channel/2 >= len(tracks) {
+			continue
+		}
+
+		if err = tracks[channel/2].writeRTP(pkt, ingest); err != nil {
+			return err
+		}
+	}
+}
+
+// parseTracks returns the H264 and Opus tracks of an SDP, other media is skipped
+func parseTracks(body []byte, baseURL *url.URL) ([]*track, error) {
+	description := sdp.SessionDescription{}
+	if err := description.Unmarshal(body); err != nil {
+		return nil, err
+	}
+
+	tracks := []*track{}
+	for _, media := range description.MediaDescriptions {
+		if len(media.MediaName.Formats) == 0 {
+			continue
+		}
+
+		t := &track{}
+		payloadType := media.MediaName.Formats[0]
+		for _, attribute := range media.Attributes {
+			switch attribute.Key {
+			case "rtpmap":
+				if pt, encoding, ok := strings.Cut(attribute.Value, " "); ok && pt == payloadType {
+					name, clockRate, _ := strings.Cut(encoding, "/")
+					clockRate, _, _ = strings.Cut(clockRate, "/")
+					t.clockRate, _ = strconv.Atoi(clockRate)
+
+					switch strings.ToUpper(name) {
+					case "H264":
+					case "OPUS":
+						t.isOpus = true
+					default:
+						t.clockRate = 0
+					}
+				}
+			case "fmtp":
+				if pt, parameters, ok := strings.Cut(attribute.Value, " "); ok && pt == payloadType {
+					t.h264.parameterSets = parseParameterSets(parameters)
+				}
+			case "control":
+				control, err := url.Parse(attribute.Value)
+				if err != nil {
+					return nil, err
+				}
+
+				if control.IsAbs() {
+					t.control = attribute.Value
+				} else {
+					base := *baseURL
+					if !strings.HasSuffix(base.Path, "/") {
+						base.Path += "/"
+					}
+					t.control = base.ResolveReference(control).String()
+				}
+			}
+		}
+
+		if t.clockRate <= 0 {
+			continue
+		}
+
+		if t.control == "" {
+			t.control = baseURL.String()
+		}
+		tracks = append(tracks, t)
+	}
+
+	if len(tracks) == 0 {
+		return nil, errors.New("source has no H264 or Opus track")
+	}
+
+	return tracks, nil
+}
+
+// parseParameterSets decodes the SPS and PPS of a `sprop-parameter-sets` fmtp parameter
+func parseParameterSets(parameters string) (parameterSets [][]byte) {
+	for _, parameter := range strings.Split(parameters, ";") {
+		key, value, _ := strings.Cut(strings.TrimSpace(parameter), "=")
+		if key != "sprop-parameter-sets" {
+			continue
+		}
+
+		for _, encoded := range strings.Split(value, ",") {
+			if decoded, err := base64.StdEncoding.DecodeString(encoded); err == nil && len(decoded) > 0 {
+				parameterSets = append(parameterSets, decoded)
+			}
+		}
+	}
+
+	return parameterSets
+}
+
+func (t *track) writeRTP(pkt []byte, ingest Ingest) error {
+	if len(pkt) < 12 || pkt[0]>>6 != 2 {
+		return nil
+	}
+
+	marker := pkt[1]&0x80 != 0
+	timestamp := uint32(pkt[4])<<24 | uint32(pkt[5])<<16 | uint32(pkt[6])<<8 | uint32(pkt[7])
+
+	payloadOffset := 12 + int(pkt[0]&0x0F)*4
+	if pkt[0]&0x10 != 0 {
+		if payloadOffset+4 > len(pkt) {
+			return nil
+		}
+		payloadOffset += 4 + (int(pkt[payloadOffset+2])<<8|int(pkt[payloadOffset+3]))*4
+	}
+
+	payloadEnd := len(pkt)
+	if pkt[0]&0x20 != 0 {
+		payloadEnd -= int(pkt[len(pkt)-1])
+	}
+
+	if payloadOffset > payloadEnd {
+		return nil
+	}
+	payload := pkt[payloadOffset:payloadEnd]
+
+	if !t.firstTimestampSet {
+		t.firstTimestamp, t.firstTimestampSet = timestamp, true
+	}
+
+	if t.isOpus {
+		return ingest.WriteOpus(append([]byte{}, payload...), t.pts(timestamp))
+	}
+
+	accessUnit, accessUnitTimestamp := t.h264.depacketize(payload, timestamp, marker)
+	if accessUnit == nil {
+		return nil
+	}
+
+	return ingest.WriteH264(accessUnit, t.pts(accessUnitTimestamp))
+}
+
+func (t *track) pts(timestamp uint32) time.Duration {
+	return time.Duration(timestamp-t.firstTimestamp) * time.Second / time.Duration(t.clockRate)
+}
@@ -0,0 +1,290 @@
+package rtsp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// DESCRIBE of a Hikvision camera, with an H264 and a PCMA track
+const hikvisionSDP = "v=0\r\n" +
+	"o=- 1109162014219182 1109162014219182 IN IP4 0.0.0.0\r\n" +
+	"s=Media Presentation\r\n" +
+	"e=NONE\r\n" +
+	"b=AS:5050\r\n" +
+	"t=0 0\r\n" +
+	"a=control:rtsp://192.168.1.64:554/Streaming/Channels/101/\r\n" +
+	"m=video 0 RTP/AVP 96\r\n" +
+	"c=IN IP4 0.0.0.0\r\n" +
+	"b=AS:5000\r\n" +
+	"a=recvonly\r\n" +
+	"a=x-dimensions:1920,1080\r\n" +
+	"a=control:rtsp://192.168.1.64:554/Streaming/Channels/101/trackID=1\r\n" +
+	"a=rtpmap:96 H264/90000\r\n" +
+	"a=fmtp:96 profile-level-id=420029; packetization-mode=1; sprop-parameter-sets=Z00AKpY1QPAET8s3AQEBAgAAAwACAAADAGQB,aO48gA==\r\n" +
+	"m=audio 0 RTP/AVP 8\r\n" +
+	"c=IN IP4 0.0.0.0\r\n" +
+	"b=AS:50\r\n" +
+	"a=recvonly\r\n" +
+	"a=control:rtsp://192.168.1.64:554/Streaming/Channels/101/trackID=2\r\n" +
+	"a=rtpmap:8 PCMA/8000\r\n" +
+	"a=appversion:1.0\r\n"
+
+var (
+	hikvisionDescribe = "RTSP/1.0 200 OK\r\n" +
+		"CSeq: 2\r\n" +
+		"Content-Type: application/sdp\r\n" +
+		"Content-Base: rtsp://192.168.1.64:554/Streaming/Channels/101/\r\n" +
+		fmt.Sprintf("Content-Length: %d\r\n", len(hikvisionSDP)) +
+		"\r\n" + hikvisionSDP
+	hikvisionUnauthorized = "RTSP/1.0 401 Unauthorized\r\n" +
+		"CSeq: 1\r\n" +
+		"WWW-Authenticate: Digest realm=\"IP Camera(C6013)\", nonce=\"3b1a8c3e5f0d4c2a9e7b6d5c4b3a2918\", stale=\"FALSE\"\r\n" +
+		"WWW-Authenticate: Basic realm=\"IP Camera(C6013)\"\r\n" +
+		"Date:  Tue, Oct 15 2024 10:00:00 GMT\r\n" +
+		"\r\n"
+	hikvisionGetParameter = "RTSP/1.0 200 OK\r\nCSeq: 7\r\nSession: 1273222592;timeout=60\r\nDate:  Tue, Oct 15 2024 10:00:30 GMT\r\n\r\n"
+)
+
+// testConn is a connection that only reads what a test sent
+type testConn struct {
+	net.Conn
+}
+
+func (testConn) SetReadDeadline(time.Time) error { return nil }
+
+func newTestClient(received string) *client {
+	return &client{conn: testConn{}, reader: bufio.NewReader(strings.NewReader(received)), auth: &authenticator{}}
+}
+
+type testIngest struct {
+	accessUnits [][]byte
+	opus        [][]byte
+	pts         []time.Duration
+}
+
+func (i *testIngest) WriteH264(accessUnit []byte, pts time.Duration) error {
+	i.accessUnits = append(i.accessUnits, accessUnit)
+	i.pts = append(i.pts, pts)
+	return nil
+}
+
+func (i *testIngest) WriteOpus(packet []byte, pts time.Duration) error {
+	i.opus = append(i.opus, packet)
+	i.pts = append(i.pts, pts)
+	return nil
+}
+
+func (i *testIngest) Close()                {}
+func (i *testIngest) Done() <-chan struct{} { return nil }
+
+func TestReadResponse(t *testing.T) {
+	c := newTestClient(hikvisionUnauthorized + hikvisionDescribe + hikvisionGetParameter)
+
+	res, err := c.readResponse()
+	if err != nil {
+		t.Fatal(err)
+	} else if res.statusCode != 401 || len(res.header.Values("WWW-Authenticate")) != 2 || res.body != nil {
+		t.Fatalf("read %+v", res)
+	}
+
+	if res, err = c.readResponse(); err != nil {
+		t.Fatal(err)
+	} else if res.statusCode != 200 || string(res.body) != hikvisionSDP || res.header.Get("Content-Base") != "rtsp://192.168.1.64:554/Streaming/Channels/101/" {
+		t.Fatalf("read %+v", res)
+	}
+
+	if res, err = c.readResponse(); err != nil {
+		t.Fatal(err)
+	} else if res.statusCode != 200 || res.header.Get("Session") != "1273222592;timeout=60" {
+		t.Fatalf("read %+v", res)
+	}
+
+	if _, err = c.readResponse(); !errors.Is(err, io.EOF) {
+		t.Fatalf("read after the last response: %v", err)
+	}
+}
+
+func TestReadResponseInvalid(t *testing.T) {
+	for name, received := range map[string]string{
+		"HTTP":                  "HTTP/1.1 200 OK\r\n\r\n",
+		"no status code":        "RTSP/1.0\r\n\r\n",
+		"status code isn't one": "RTSP/1.0 OK 200\r\n\r\n",
+		"truncated body":        "RTSP/1.0 200 OK\r\nContent-Length: 10\r\n\r\nv=0\r\n",
+		"body too large":        fmt.Sprintf("RTSP/1.0 200 OK\r\nContent-Length: %d\r\n\r\n", maxResponseBodySize+1),
+		"malformed header":      "RTSP/1.0 200 OK\r\nCSeq 1\r\n\r\n",
+		"empty":                 "",
+	} {
+		if res, err := newTestClient(received).readResponse(); err == nil {
+			t.Errorf("%s read as %+v", name, res)
+		}
+	}
+
+	// Without a Content-Length the body is the next response
+	res, err := newTestClient("RTSP/1.0 200 OK\r\nContent-Length: -5\r\n\r\n").readResponse()
+	if err != nil || res.body != nil {
+		t.Fatalf("read %+v, %v", res, err)
+	}
+}
+
+func interleaved(channel byte, pkt []byte) string {
+	return string(binary.BigEndian.AppendUint16([]byte{'$', channel}, uint16(len(pkt)))) + string(pkt)
+}
+
+func rtpPacket(marker bool, timestamp uint32, payload ...byte) []byte {
+	pkt := []byte{0x80, 96, 0, 1}
+	if marker {
+		pkt[1] |= 0x80
+	}
+	pkt = binary.BigEndian.AppendUint32(pkt, timestamp)
+	pkt = binary.BigEndian.AppendUint32(pkt, 0x12345678)
+	return append(pkt, payload...)
+}
+
+func TestReadInterleaved(t *testing.T) {
+	tracks := []*track{{clockRate: 90000}, {clockRate: 48000, isOpus: true}}
+
+	c := newTestClient(
+		interleaved(0, rtpPacket(true, 90000, 0x41, 0x9a)) +
+			// RTCP, the response to a keepalive and channels without a track are skipped
+			interleaved(1, []byte{0x80, 0xc8, 0x00, 0x06}) +
+			hikvisionGetParameter +
+			interleaved(4, rtpPacket(true, 0, 0x41)) +
+			interleaved(2, rtpPacket(true, 960, 0xfc, 0x01)) +
+			interleaved(0, rtpPacket(false, 93000, 0x7c, 0x81, 0x9a)) +
+			interleaved(0, rtpPacket(true, 93000, 0x7c, 0x41, 0x01)) +
+			// Packets that aren't RTP, or shorter than their header, are dropped
+			interleaved(0, []byte{0x80, 0x60}) +
+			interleaved(0, []byte{}),
+	)
+
+	ingest := &testIngest{}
+	if err := c.readInterleaved(tracks, ingest); !errors.Is(err, io.EOF) {
+		t.Fatalf("read until %v", err)
+	}
+
+	if len(ingest.accessUnits) != 2 || !bytes.Equal(ingest.accessUnits[0], append(annexBStartCode, 0x41, 0x9a)) ||
+		!bytes.Equal(ingest.accessUnits[1], append(annexBStartCode, 0x61, 0x9a, 0x01)) {
+		t.Fatalf("read access units % x", ingest.accessUnits)
+	}
+	if len(ingest.opus) != 1 || !bytes.Equal(ingest.opus[0], []byte{0xfc, 0x01}) {
+		t.Fatalf("read Opus % x", ingest.opus)
+	}
+	if ingest.pts[0] != 0 || ingest.pts[1] != 0 || ingest.pts[2] != 3000*time.Second/90000 {
+		t.Fatalf("read PTS %v", ingest.pts)
+	}
+
+	// A truncated packet and a broken response end reading
+	for name, received := range map[string]string{
+		"truncated packet": interleaved(0, rtpPacket(true, 0, 0x41))[:10],
+		"garbage":          "garbage\r\n\r\n",
+	} {
+		if err := newTestClient(received).readInterleaved(tracks, ingest); err == nil || errors.Is(err, io.EOF) && name == "garbage" {
+			t.Errorf("%s read until %v", name, err)
+		}
+	}
+}
+
+func TestParseTracks(t *testing.T) {
+	baseURL, err := url.Parse("rtsp://192.168.1.64:554/Streaming/Channels/101/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tracks, err := parseTracks([]byte(hikvisionSDP), baseURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tracks) != 1 || tracks[0].isOpus || tracks[0].clockRate != 90000 || tracks[0].control != "rtsp://192.168.1.64:554/Streaming/Channels/101/trackID=1" {
+		t.Fatalf("parsed %+v", tracks)
+	}
+	if len(tracks[0].h264.parameterSets) != 2 || tracks[0].h264.parameterSets[0][0] != 0x67 || tracks[0].h264.parameterSets[1][0] != 0x68 {
+		t.Fatalf("parsed parameter sets % x", tracks[0].h264.parameterSets)
+	}
+
+	// Relative and missing controls
+	opusSDP := "v=0\r\no=- 0 0 IN IP4 0.0.0.0\r\ns=-\r\nt=0 0\r\n" +
+		"m=audio 0 RTP/AVP 111\r\na=rtpmap:111 opus/48000/2\r\na=control:trackID=2\r\n" +
+		"m=video 0 RTP/AVP 96\r\na=rtpmap:96 H264/90000\r\n"
+	baseURL, _ = url.Parse("rtsp://camera/live")
+	if tracks, err = parseTracks([]byte(opusSDP), baseURL); err != nil {
+		t.Fatal(err)
+	} else if len(tracks) != 2 || !tracks[0].isOpus || tracks[0].clockRate != 48000 || tracks[0].control != "rtsp://camera/live/trackID=2" || tracks[1].control != "rtsp://camera/live" {
+		t.Fatalf("parsed %+v %+v", tracks[0], tracks[1])
+	}
+
+	for name, invalid := range map[string]string{
+		"only PCMA":           "v=0\r\no=- 0 0 IN IP4 0.0.0.0\r\ns=-\r\nt=0 0\r\nm=audio 0 RTP/AVP 8\r\na=rtpmap:8 PCMA/8000\r\n",
+		"not SDP":             "garbage",
+		"negative clock rate": "v=0\r\no=- 0 0 IN IP4 0.0.0.0\r\ns=-\r\nt=0 0\r\nm=video 0 RTP/AVP 96\r\na=rtpmap:96 H264/-90000\r\n",
+	} {
+		if _, err = parseTracks([]byte(invalid), baseURL); err == nil {
+			t.Errorf("parsed tracks of %s", name)
+		}
+	}
+}
+
+func FuzzReadResponse(f *testing.F) {
+	f.Add(hikvisionDescribe)
+	f.Add(hikvisionUnauthorized)
+	f.Add(hikvisionGetParameter)
+
+	f.Fuzz(func(t *testing.T, received string) {
+		if res, err := newTestClient(received).readResponse(); err == nil && len(res.body) > maxResponseBodySize {
+			t.Fatalf("read a body of %d bytes", len(res.body))
+		}
+	})
+}
+
+func FuzzReadInterleaved(f *testing.F) {
+	f.Add(interleaved(0, rtpPacket(true, 90000, 0x41, 0x9a)) + hikvisionGetParameter + interleaved(1, []byte{0x80, 0xc8, 0x00, 0x06}))
+	f.Add(interleaved(0, rtpPacket(false, 0, 0x7c, 0x85, 0x88)) + interleaved(2, rtpPacket(true, 960, 0xfc)))
+	f.Add(interleaved(0, append([]byte{0xb1, 0xe0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xbe, 0xde, 0, 0}, 0x18, 0, 2, 0x41, 0x9a, 1)))
+
+	f.Fuzz(func(t *testing.T, received string) {
+		tracks := []*track{{clockRate: 90000}, {clockRate: 48000, isOpus: true}}
+		if err := newTestClient(received).readInterleaved(tracks, &testIngest{}); err == nil {
+			t.Fatal("read past the end")
+		}
+	})
+}
+
+func FuzzParseTracks(f *testing.F) {
+	f.Add([]byte(hikvisionSDP))
+
+	baseURL, err := url.Parse("rtsp://192.168.1.64:554/Streaming/Channels/101/")
+	if err != nil {
+		f.Fatal(err)
+	}
+
+	f.Fuzz(func(t *testing.T, body []byte) {
+		tracks, err := parseTracks(body, baseURL)
+		for _, track := range tracks {
+			if track.clockRate <= 0 && err == nil {
+				t.Fatalf("track with the clock rate %d", track.clockRate)
+			}
+		}
+	})
+}
+
+func FuzzReadRequest(f *testing.F) {
+	f.Add("OPTIONS rtsp://127.0.0.1:8554/live RTSP/1.0\r\nCSeq: 1\r\nUser-Agent: LibVLC/3.0.20\r\n\r\n")
+	f.Add("SETUP rtsp://127.0.0.1:8554/live/trackID=0 RTSP/1.0\r\nCSeq: 4\r\nTransport: RTP/AVP/TCP;unicast;interleaved=0-1\r\n\r\n")
+	f.Add("SET_PARAMETER rtsp://127.0.0.1:8554/live RTSP/1.0\r\nCSeq: 5\r\nContent-Length: 4\r\n\r\nx: y")
+
+	f.Fuzz(func(t *testing.T, received string) {
+		c := &serverConn{reader: bufio.NewReader(strings.NewReader(received))}
+		if req, err := c.readRequest(); err == nil && req.url == nil {
+			t.Fatalf("read %+v", req)
+		}
+	})
+}
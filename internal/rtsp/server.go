@@ -0,0 +1,389 @@
+package rtsp
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/glimesh/broadcast-box/internal/logging"
+)
+
+var logger = logging.Logger("rtsp")
+
+const (
+	// Packets queued for a client before they are dropped, so a slow client can't hold up the stream
+	playerQueueSize = 1024
+
+	firstPayloadType = 96
+)
+
+// Media is one track of a Player, described in the answer to DESCRIBE
+type Media struct {
+	Audio bool
+
+	// rtpmap of the track, like `H264/90000` or `opus/48000/2`
+	Encoding string
+	Fmtp     string
+}
+
+// Player sends the RTP of a stream to one client
+type Player interface {
+	Media() []Media
+
+	// Play calls write with every RTP packet of the stream and the index of its Media, until
+	// the Player is closed. packet is only valid during the call.
+	Play(write func(media int, packet []byte))
+	Close()
+	Done() <-chan struct{}
+}
+
+// PlayerFunc returns a Player for streamKey to the client at addr, returning an error responds
+// with 404
+type PlayerFunc func(streamKey string, addr net.Addr) (Player, error)
+
+type serverConn struct {
+	netConn   net.Conn
+	reader    *bufio.Reader
+	newPlayer PlayerFunc
+
+	player    Player
+	session   string
+	channels  map[int]int
+	writeLock sync.Mutex
+
+	queue chan []byte
+}
+
+type request struct {
+	method string
+	url    *url.URL
+	header textproto.MIMEHeader
+}
+
+// ListenAndServe serves every stream returned by newPlayer to RTSP clients on addr, like
+// `rtsp://host:8554/<stream key>`. RTP is sent interleaved on the TCP connection.
+func ListenAndServe(addr string, newPlayer PlayerFunc) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	return Serve(listener, newPlayer)
+}
+
+func Serve(listener net.Listener, newPlayer PlayerFunc) error {
+	for {
+		netConn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+
+		go func() {
+			c := &serverConn{netConn: netConn, reader: bufio.NewReader(netConn), newPlayer: newPlayer, channels: map[int]int{}}
+			if err := c.serve(); err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				logger.Info("RTSP client disconnected", "addr", netConn.RemoteAddr(), "err", err)
+			}
+		}()
+	}
+}
+
+func (c *serverConn) serve() error {
+	defer c.netConn.Close()
+	defer func() {
+		if c.player != nil {
+			c.player.Close()
+		}
+	}()
+
+	for {
+		// Clients send RTCP or GET_PARAMETER while playing, so a silent client is gone
+		if err := c.netConn.SetReadDeadline(time.Now().Add(keepaliveTimeout)); err != nil {
+			return err
+		}
+
+		magic, err := c.reader.Peek(1)
+		if err != nil {
+			return err
+		}
+
+		// RTCP from the client is skipped
+		if magic[0] == '$' {
+			header := make([]byte, 4)
+			if _, err = io.ReadFull(c.reader, header); err != nil {
+				return err
+			}
+			if _, err = c.reader.Discard(int(header[2])<<8 | int(header[3])); err != nil {
+				return err
+			}
+			continue
+		}
+
+		req, err := c.readRequest()
+		if err != nil {
+			return err
+		}
+
+		if done, err := c.handleRequest(req); err != nil || done {
+			return err
+		}
+	}
+}
+
+func (c *serverConn) readRequest() (*request, error) {
+	reader := textproto.NewReader(c.reader)
+	requestLine, err := reader.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+
+	parts := strings.Split(requestLine, " ")
+	if len(parts) != 3 || !strings.HasPrefix(parts[2], "RTSP/") {
+		return nil, fmt.Errorf("malformed request line `%s`", requestLine)
+	}
+
+	requestURL, err := url.Parse(parts[1])
+	if err != nil {
+		return nil, err
+	}
+
+	header, err := reader.ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+
+	if contentLength, _ := strconv.Atoi(header.Get("Content-Length")); contentLength > 0 {
+		if _, err = c.reader.Discard(contentLength); err != nil {
+			return nil, err
+		}
+	}
+
+	return &request{method: parts[0], url: requestURL, header: header}, nil
+}
+
+// handleRequest responds to one request, done is set once the client tore down the session
+func (c *serverConn) handleRequest(req *request) (done bool, err error) {
+	header := textproto.MIMEHeader{}
+	if c.session != "" {
+		header.Set("Session", c.session+";timeout="+strconv.Itoa(int(keepaliveTimeout/time.Second)))
+	}
+
+	switch req.method {
+	case "OPTIONS":
+		header.Set("Public", "OPTIONS, DESCRIBE, SETUP, PLAY, GET_PARAMETER, TEARDOWN")
+		return false, c.writeResponse(req, 200, header, "")
+	case "DESCRIBE":
+		player, statusCode := c.getPlayer(req.url)
+		if player == nil {
+			return false, c.writeResponse(req, statusCode, header, "")
+		}
+
+		header.Set("Content-Type", "application/sdp")
+		header.Set("Content-Base", strings.TrimSuffix(req.url.String(), "/")+"/")
+		return false, c.writeResponse(req, 200, header, describe(player.Media()))
+	case "SETUP":
+		return false, c.setup(req, header)
+	case "PLAY":
+		if c.player == nil || len(c.channels) == 0 {
+			return false, c.writeResponse(req, 455, header, "")
+		}
+
+		header.Set("Range", "npt=0.000-")
+		if err = c.writeResponse(req, 200, header, ""); err != nil {
+			return false, err
+		}
+
+		c.play()
+		return false, nil
+	case "GET_PARAMETER", "SET_PARAMETER":
+		return false, c.writeResponse(req, 200, header, "")
+	case "TEARDOWN":
+		return true, c.writeResponse(req, 200, header, "")
+	default:
+		return false, c.writeResponse(req, 501, header, "")
+	}
+}
+
+// getPlayer returns the Player of the stream key at the end of the path of requestURL
+func (c *serverConn) getPlayer(requestURL *url.URL) (Player, int) {
+	if c.player != nil {
+		return c.player, 200
+	}
+
+	path := strings.Trim(requestURL.Path, "/")
+	if control := strings.LastIndex(path, "/trackID="); control != -1 {
+		path = path[:control]
+	}
+
+	player, err := c.newPlayer(path[strings.LastIndex(path, "/")+1:], c.netConn.RemoteAddr())
+	if err != nil {
+		return nil, 404
+	}
+	c.player = player
+
+	return player, 200
+}
+
+func (c *serverConn) setup(req *request, header textproto.MIMEHeader) error {
+	player, statusCode := c.getPlayer(req.url)
+	if player == nil {
+		return c.writeResponse(req, statusCode, header, "")
+	}
+
+	media := 0
+	if _, control, ok := strings.Cut(req.url.Path, "/trackID="); ok {
+		var err error
+		if media, err = strconv.Atoi(control); err != nil || media < 0 || media >= len(player.Media()) {
+			return c.writeResponse(req, 404, header, "")
+		}
+	}
+
+	// Only RTP over the RTSP connection is supported, clients like VLC retry with it after a 461
+	transport := req.header.Get("Transport")
+	if !strings.Contains(transport, "RTP/AVP/TCP") {
+		return c.writeResponse(req, 461, header, "")
+	}
+
+	channel := media * 2
+	for _, parameter := range strings.Split(transport, ";") {
+		if strings.HasPrefix(parameter, "interleaved=") {
+			first, _, _ := strings.Cut(strings.TrimPrefix(parameter, "interleaved="), "-")
+			if n, err := strconv.Atoi(first); err == nil && n >= 0 && n < 255 {
+				channel = n
+			}
+		}
+	}
+	c.channels[media] = channel
+
+	if c.session == "" {
+		id := make([]byte, 8)
+		if _, err := rand.Read(id); err != nil {
+			return err
+		}
+		c.session = hex.EncodeToString(id)
+		header.Set("Session", c.session+";timeout="+strconv.Itoa(int(keepaliveTimeout/time.Second)))
+	}
+
+	header.Set("Transport", fmt.Sprintf("RTP/AVP/TCP;unicast;interleaved=%d-%d", channel, channel+1))
+	return c.writeResponse(req, 200, header, "")
+}
+
+// play starts sending the RTP of the tracks that were set up
+func (c *serverConn) play() {
+	if c.queue != nil {
+		return
+	}
+	c.queue = make(chan []byte, playerQueueSize)
+
+	channels := map[int]int{}
+	for media, channel := range c.channels {
+		channels[media] = channel
+	}
+
+	go func() {
+		for {
+			select {
+			case <-c.player.Done():
+				c.netConn.Close() //nolint
+				return
+			case frame := <-c.queue:
+				if err := c.write(frame); err != nil {
+					c.netConn.Close() //nolint
+					return
+				}
+			}
+		}
+	}()
+
+	c.player.Play(func(media int, packet []byte) {
+		channel, ok := channels[media]
+		if !ok || len(packet) < 12 || len(packet) > 0xFFFF {
+			return
+		}
+
+		// Framed as `$<channel><length>`, with the payload type of the SDP
+		frame := make([]byte, 4+len(packet))
+		frame[0], frame[1], frame[2], frame[3] = '$', byte(channel), byte(len(packet)>>8), byte(len(packet))
+		copy(frame[4:], packet)
+		frame[5] = frame[5]&0x80 | byte(firstPayloadType+media)
+
+		select {
+		case c.queue <- frame:
+		default:
+		}
+	})
+}
+
+func (c *serverConn) write(b []byte) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	if err := c.netConn.SetWriteDeadline(time.Now().Add(readTimeout)); err != nil {
+		return err
+	}
+
+	_, err := c.netConn.Write(b)
+	return err
+}
+
+func (c *serverConn) writeResponse(req *request, statusCode int, header textproto.MIMEHeader, body string) error {
+	res := &strings.Builder{}
+	fmt.Fprintf(res, "RTSP/1.0 %d %s\r\nCSeq: %s\r\nServer: %s\r\n", statusCode, statusText(statusCode), req.header.Get("CSeq"), userAgent)
+	for key, values := range header {
+		for _, value := range values {
+			fmt.Fprintf(res, "%s: %s\r\n", key, value)
+		}
+	}
+	if body != "" {
+		fmt.Fprintf(res, "Content-Length: %d\r\n", len(body))
+	}
+	res.WriteString("\r\n")
+	res.WriteString(body)
+
+	return c.write([]byte(res.String()))
+}
+
+func statusText(statusCode int) string {
+	switch statusCode {
+	case 200:
+		return "OK"
+	case 404:
+		return "Not Found"
+	case 455:
+		return "Method Not Valid in This State"
+	case 461:
+		return "Unsupported Transport"
+	default:
+		return "Not Implemented"
+	}
+}
+
+// describe returns the SDP of media, track i is controlled by `trackID=i`
+func describe(media []Media) string {
+	sdp := &strings.Builder{}
+	sdp.WriteString("v=0\r\no=- 0 0 IN IP4 0.0.0.0\r\ns=" + userAgent + "\r\nc=IN IP4 0.0.0.0\r\nt=0 0\r\na=control:*\r\n")
+	for i, m := range media {
+		kind := "video"
+		if m.Audio {
+			kind = "audio"
+		}
+
+		payloadType := firstPayloadType + i
+		fmt.Fprintf(sdp, "m=%s 0 RTP/AVP %d\r\na=rtpmap:%d %s\r\n", kind, payloadType, payloadType, m.Encoding)
+		if m.Fmtp != "" {
+			fmt.Fprintf(sdp, "a=fmtp:%d %s\r\n", payloadType, m.Fmtp)
+		}
+		fmt.Fprintf(sdp, "a=control:trackID=%d\r\n", i)
+	}
+
+	return sdp.String()
+}
@@ -0,0 +1,291 @@
+// Package s3 uploads files to S3 compatible object storage, like AWS S3, MinIO or Google Cloud
+// Storage with HMAC keys. Requests are signed with AWS Signature Version 4.
+package s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Files up to this size are put with one request, larger ones as a multipart upload of parts
+	// this size. S3 allows at most 10000 parts, so files up to 625 GiB can be uploaded.
+	partSize = 64 << 20
+
+	// Used when Options.Region isn't set, GCS accepts any region
+	regionDefault = "us-east-1"
+
+	amzDateFormat = "20060102T150405Z"
+)
+
+// Options of a Client
+type Options struct {
+	// URL of the bucket objects are put in, like `https://<bucket>.s3.<region>.amazonaws.com`,
+	// `https://storage.googleapis.com/<bucket>` or `http://localhost:9000/<bucket>`
+	URL string
+
+	Region          string
+	AccessKeyID     string
+	SecretAccessKey string
+}
+
+// Client puts objects in one bucket
+type Client struct {
+	url        *url.URL
+	region     string
+	accessKey  string
+	secretKey  string
+	httpClient *http.Client
+}
+
+func New(opts Options) (*Client, error) {
+	bucketURL, err := url.Parse(opts.URL)
+	if err != nil {
+		return nil, err
+	} else if (bucketURL.Scheme != "http" && bucketURL.Scheme != "https") || bucketURL.Host == "" {
+		return nil, fmt.Errorf("bucket URL %q must be an http or https URL", opts.URL)
+	}
+	bucketURL.Path = strings.TrimSuffix(bucketURL.Path, "/")
+
+	c := &Client{
+		url:        bucketURL,
+		region:     opts.Region,
+		accessKey:  opts.AccessKeyID,
+		secretKey:  opts.SecretAccessKey,
+		httpClient: &http.Client{},
+	}
+	if c.region == "" {
+		c.region = regionDefault
+	}
+
+	return c, nil
+}
+
+// PutFile uploads the file at path as the object key
+func (c *Client) PutFile(ctx context.Context, key, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	if info.Size() <= partSize {
+		_, _, err = c.do(ctx, http.MethodPut, key, nil, io.NewSectionReader(file, 0, info.Size()))
+		return err
+	}
+
+	return c.putMultipart(ctx, key, file, info.Size())
+}
+
+func (c *Client) putMultipart(ctx context.Context, key string, file *os.File, size int64) error {
+	_, body, err := c.do(ctx, http.MethodPost, key, url.Values{"uploads": {""}}, nil)
+	if err != nil {
+		return err
+	}
+
+	initiated := struct {
+		UploadID string `xml:"UploadId"`
+	}{}
+	if err = xml.Unmarshal(body, &initiated); err != nil {
+		return err
+	} else if initiated.UploadID == "" {
+		return errors.New("multipart upload was initiated without an upload ID")
+	}
+
+	if err = c.putParts(ctx, key, initiated.UploadID, file, size); err != nil {
+		// The parts that were uploaded are billed until the upload is aborted
+		_, _, abortErr := c.do(context.Background(), http.MethodDelete, key, url.Values{"uploadId": {initiated.UploadID}}, nil)
+		return errors.Join(err, abortErr)
+	}
+
+	return nil
+}
+
+func (c *Client) putParts(ctx context.Context, key, uploadID string, file *os.File, size int64) error {
+	type part struct {
+		PartNumber int
+		ETag       string
+	}
+	complete := struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []part   `xml:"Part"`
+	}{}
+
+	for offset := int64(0); offset < size; offset += partSize {
+		partNumber := len(complete.Parts) + 1
+		query := url.Values{"partNumber": {strconv.Itoa(partNumber)}, "uploadId": {uploadID}}
+
+		header, _, err := c.do(ctx, http.MethodPut, key, query, io.NewSectionReader(file, offset, min(partSize, size-offset)))
+		if err != nil {
+			return err
+		}
+		complete.Parts = append(complete.Parts, part{partNumber, header.Get("ETag")})
+	}
+
+	completeBody, err := xml.Marshal(complete)
+	if err != nil {
+		return err
+	}
+
+	_, body, err := c.do(ctx, http.MethodPost, key, url.Values{"uploadId": {uploadID}}, io.NewSectionReader(bytes.NewReader(completeBody), 0, int64(len(completeBody))))
+	if err != nil {
+		return err
+	}
+
+	// Completing can fail after the response status was sent
+	if bytes.Contains(body, []byte("<Error>")) {
+		return fmt.Errorf("failed to complete upload of %s: %s", key, body)
+	}
+	return nil
+}
+
+// do sends a signed request for the object key and returns the header and body of a successful
+// response, body is read twice to hash and send it
+func (c *Client) do(ctx context.Context, method, key string, query url.Values, body *io.SectionReader) (http.Header, []byte, error) {
+	payloadHash := sha256.New()
+	if body != nil {
+		if _, err := io.Copy(payloadHash, body); err != nil {
+			return nil, nil, err
+		}
+		if _, err := body.Seek(0, io.SeekStart); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	objectURL := *c.url
+	objectURL.Path += "/" + key
+	objectURL.RawPath = uriEncode(objectURL.Path, false)
+	objectURL.RawQuery = canonicalQuery(query)
+
+	req, err := http.NewRequestWithContext(ctx, method, objectURL.String(), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if body != nil {
+		req.Body, req.ContentLength = io.NopCloser(body), body.Size()
+	}
+
+	c.sign(req, hex.EncodeToString(payloadHash.Sum(nil)), time.Now())
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	} else if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, nil, fmt.Errorf("%s %s failed with %s: %s", method, key, resp.Status, bytes.TrimSpace(respBody))
+	}
+
+	return resp.Header, respBody, nil
+}
+
+// sign adds the Signature Version 4 Authorization header, see
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+func (c *Client) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format(amzDateFormat)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	canonicalHeaders := ""
+	for _, name := range names {
+		canonicalHeaders += name + ":" + headers[name] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		uriEncode(req.URL.Path, false),
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := amzDate[:8] + "/" + c.region + "/s3/aws4_request"
+	canonicalRequestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalRequestHash[:])
+
+	signingKey := []byte("AWS4" + c.secretKey)
+	for _, v := range []string{amzDate[:8], c.region, "s3", "aws4_request"} {
+		signingKey = hmacSHA256(signingKey, v)
+	}
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.accessKey, scope, signedHeaders, hex.EncodeToString(hmacSHA256(signingKey, stringToSign)),
+	))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// canonicalQuery encodes query sorted by name, as it is signed
+func canonicalQuery(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	params := []string{}
+	for _, name := range names {
+		for _, value := range query[name] {
+			params = append(params, uriEncode(name, true)+"="+uriEncode(value, true))
+		}
+	}
+	return strings.Join(params, "&")
+}
+
+// uriEncode percent-encodes everything but the unreserved characters of RFC 3986, and slashes
+// unless encodeSlash is set
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '.', c == '_', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,168 @@
+package segmenter
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	manifestFile      = "manifest.mpd"
+	videoInitFile     = "video-init.mp4"
+	audioInitFile     = "audio-init.mp4"
+	videoSegmentStart = "video-"
+	audioSegmentStart = "audio-"
+
+	manifestContentType = "application/dash+xml"
+)
+
+// ServeDASH serves the manifest, init segments and segments by the last element of the path.
+// Video and audio are separate representations, with segments named by their start time.
+func (m *Segmenter) ServeDASH(res http.ResponseWriter, req *http.Request) {
+	m.serve(res, func() (string, [][]byte, int, error) { return m.lookupDASH(req) })
+}
+
+func (m *Segmenter) hasCompleteSegment() bool {
+	return len(m.segments) != 0 && m.segments[0].complete
+}
+
+func dashDuration(d time.Duration) string {
+	return fmt.Sprintf("PT%.3fS", d.Seconds())
+}
+
+// bandwidth estimates the bits per second of a track from its complete segments
+func (m *Segmenter) bandwidth(bytes func(*segment) int) int64 {
+	total, duration := 0, time.Duration(0)
+	for _, s := range m.segments {
+		if s.complete {
+			total += bytes(s)
+			duration += s.duration
+		}
+	}
+
+	if duration <= 0 {
+		return 0
+	}
+	return int64(float64(total*8) / duration.Seconds())
+}
+
+func (m *Segmenter) manifest() []byte {
+	now := time.Now().UTC()
+	depth := time.Duration(0)
+	for _, s := range m.segments {
+		if s.complete {
+			depth += s.duration
+		}
+	}
+
+	b := &bytes.Buffer{}
+	b.WriteString(`<?xml version="1.0" encoding="UTF-8"?>` + "\n")
+	b.WriteString(`<MPD xmlns="urn:mpeg:dash:schema:mpd:2011" profiles="urn:mpeg:dash:profile:isoff-live:2011"`)
+	if m.closed {
+		fmt.Fprintf(b, ` type="static" mediaPresentationDuration="%s"`, dashDuration(depth))
+	} else {
+		fmt.Fprintf(b, ` type="dynamic" availabilityStartTime="%s" publishTime="%s" minimumUpdatePeriod="%s" timeShiftBufferDepth="%s" suggestedPresentationDelay="%s"`,
+			m.start.UTC().Format(time.RFC3339Nano), now.Format(time.RFC3339Nano),
+			dashDuration(time.Duration(m.targetDuration)*time.Second), dashDuration(depth),
+			dashDuration(3*time.Duration(m.targetDuration)*time.Second))
+	}
+	fmt.Fprintf(b, ` minBufferTime="%s">`+"\n", dashDuration(2*time.Duration(m.targetDuration)*time.Second))
+	b.WriteString(`<Period id="0" start="PT0S">` + "\n")
+
+	fmt.Fprintf(b, `<AdaptationSet contentType="video" mimeType="video/mp4" segmentAlignment="true" startWithSAP="1">`+"\n")
+	fmt.Fprintf(b, `<Representation id="video" codecs="avc1.%02x%02x%02x" width="%d" height="%d" bandwidth="%d">`+"\n",
+		m.sps[1], m.sps[2], m.sps[3], m.width, m.height, m.bandwidth(func(s *segment) int { return s.videoBytes }))
+	m.segmentTemplate(b, videoTimescale, videoSegmentStart, videoInitFile, func(s *segment) (int64, int64) { return s.videoStart, s.videoDuration })
+	b.WriteString("</Representation>\n</AdaptationSet>\n")
+
+	if m.hasAudio {
+		b.WriteString(`<AdaptationSet contentType="audio" mimeType="audio/mp4" segmentAlignment="true" startWithSAP="1">` + "\n")
+		fmt.Fprintf(b, `<Representation id="audio" codecs="opus" audioSamplingRate="%d" bandwidth="%d">`+"\n",
+			audioTimescale, m.bandwidth(func(s *segment) int { return s.audioBytes }))
+		m.segmentTemplate(b, audioTimescale, audioSegmentStart, audioInitFile, func(s *segment) (int64, int64) { return s.audioStart, s.audioDuration })
+		b.WriteString("</Representation>\n</AdaptationSet>\n")
+	}
+
+	b.WriteString("</Period>\n")
+	if !m.closed {
+		fmt.Fprintf(b, `<UTCTiming schemeIdUri="urn:mpeg:dash:utc:direct:2014" value="%s"/>`+"\n", now.Format(time.RFC3339Nano))
+	}
+	b.WriteString("</MPD>\n")
+
+	return b.Bytes()
+}
+
+func (m *Segmenter) segmentTemplate(b *bytes.Buffer, timescale int, prefix, initialization string, timing func(*segment) (start, duration int64)) {
+	fmt.Fprintf(b, `<SegmentTemplate timescale="%d" initialization="%s" media="%s$Time$.m4s">`+"\n<SegmentTimeline>\n", timescale, initialization, prefix)
+	for _, s := range m.segments {
+		if start, duration := timing(s); s.complete && duration > 0 {
+			fmt.Fprintf(b, `<S t="%d" d="%d"/>`+"\n", start, duration)
+		}
+	}
+	b.WriteString("</SegmentTimeline>\n</SegmentTemplate>\n")
+}
+
+func (m *Segmenter) lookupDASH(req *http.Request) (contentType string, data [][]byte, status int, err error) {
+	file := path.Base(req.URL.Path)
+
+	switch file {
+	case manifestFile:
+		if !m.waitFor(req.Context(), m.blockTimeout(), m.hasCompleteSegment) && !m.hasCompleteSegment() {
+			return "", nil, http.StatusNotFound, errors.New("stream has no H264 video segment yet")
+		}
+
+		return manifestContentType, [][]byte{m.manifest()}, 0, nil
+	case videoInitFile:
+		if m.videoInit == nil {
+			return "", nil, http.StatusNotFound, errNotFound
+		}
+
+		return mp4ContentType, [][]byte{m.videoInit}, 0, nil
+	case audioInitFile:
+		if m.audioInit == nil {
+			return "", nil, http.StatusNotFound, errNotFound
+		}
+
+		return mp4ContentType, [][]byte{m.audioInit}, 0, nil
+	}
+
+	if !strings.HasSuffix(file, ".m4s") {
+		return "", nil, http.StatusNotFound, errNotFound
+	}
+	name := strings.TrimSuffix(file, ".m4s")
+
+	isVideo := strings.HasPrefix(name, videoSegmentStart)
+	if !isVideo && !strings.HasPrefix(name, audioSegmentStart) {
+		return "", nil, http.StatusNotFound, errNotFound
+	}
+
+	start, err := strconv.ParseInt(name[len(videoSegmentStart):], 10, 64)
+	if err != nil {
+		return "", nil, http.StatusNotFound, errNotFound
+	}
+
+	for _, s := range m.segments {
+		if !s.complete {
+			continue
+		}
+
+		if isVideo && s.videoStart == start {
+			for _, p := range s.parts {
+				data = append(data, p.video)
+			}
+			return mp4ContentType, data, 0, nil
+		} else if !isVideo && s.audioDuration > 0 && s.audioStart == start {
+			for _, p := range s.parts {
+				data = append(data, p.audio)
+			}
+			return mp4ContentType, data, 0, nil
+		}
+	}
+
+	return "", nil, http.StatusNotFound, errNotFound
+}
@@ -0,0 +1,30 @@
+package segmenter
+
+import (
+	"encoding/binary"
+)
+
+const (
+	naluTypeBitmask = 0x1F
+	naluTypeIDR     = 5
+	naluTypeSPS     = 7
+	naluTypePPS     = 8
+	naluTypeAUD     = 9
+)
+
+// avccSample converts the NALUs of an access unit to a length prefixed MP4 sample. Parameter
+// sets are only carried in the init segment.
+func avccSample(nalus [][]byte) []byte {
+	sample := []byte{}
+	for _, nalu := range nalus {
+		switch nalu[0] & naluTypeBitmask {
+		case naluTypeSPS, naluTypePPS, naluTypeAUD:
+			continue
+		}
+
+		sample = binary.BigEndian.AppendUint32(sample, uint32(len(nalu)))
+		sample = append(sample, nalu...)
+	}
+
+	return sample
+}
@@ -0,0 +1,168 @@
+package segmenter
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Parts are only listed for the last few segments
+	partSegmentCount = 3
+
+	playlistFile = "index.m3u8"
+	initFile     = "init.mp4"
+
+	playlistContentType = "application/vnd.apple.mpegurl"
+)
+
+// ServeHLS serves the playlist, init segment, segments and parts by the last element of the path
+func (m *Segmenter) ServeHLS(res http.ResponseWriter, req *http.Request) {
+	m.serve(res, func() (string, [][]byte, int, error) { return m.lookupHLS(req) })
+}
+
+// playlist lists the segments, players start startOffset seconds from the start of it or from
+// live if it is negative, at live if it is 0
+func (m *Segmenter) playlist(startOffset float64) []byte {
+	b := &bytes.Buffer{}
+	fmt.Fprintf(b, "#EXTM3U\n#EXT-X-VERSION:9\n#EXT-X-TARGETDURATION:%d\n", m.targetDuration)
+	if startOffset != 0 {
+		fmt.Fprintf(b, "#EXT-X-START:TIME-OFFSET=%.3f\n", startOffset)
+	}
+	fmt.Fprintf(b, "#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=%.3f\n", (3 * partTarget).Seconds())
+	fmt.Fprintf(b, "#EXT-X-PART-INF:PART-TARGET=%.3f\n", partTarget.Seconds())
+	if len(m.segments) != 0 {
+		fmt.Fprintf(b, "#EXT-X-MEDIA-SEQUENCE:%d\n", m.segments[0].msn)
+	}
+	fmt.Fprintf(b, "#EXT-X-MAP:URI=\"%s\"\n", initFile)
+
+	for i, s := range m.segments {
+		if i >= len(m.segments)-partSegmentCount {
+			for j, p := range s.parts {
+				fmt.Fprintf(b, "#EXT-X-PART:DURATION=%.5f,URI=\"part%d.%d.m4s\"", p.duration.Seconds(), s.msn, j)
+				if p.independent {
+					b.WriteString(",INDEPENDENT=YES")
+				}
+				b.WriteString("\n")
+			}
+		}
+
+		if s.complete {
+			fmt.Fprintf(b, "#EXTINF:%.5f,\nseg%d.m4s\n", s.duration.Seconds(), s.msn)
+		}
+	}
+
+	if m.closed {
+		b.WriteString("#EXT-X-ENDLIST\n")
+	} else if len(m.segments) != 0 {
+		current := m.segments[len(m.segments)-1]
+		fmt.Fprintf(b, "#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"part%d.%d.m4s\"\n", current.msn, len(current.parts))
+	}
+
+	return b.Bytes()
+}
+
+func (m *Segmenter) lookupHLS(req *http.Request) (contentType string, data [][]byte, status int, err error) {
+	file := path.Base(req.URL.Path)
+
+	switch file {
+	case playlistFile:
+		query := req.URL.Query()
+
+		// Viewers join the DVR window behind live with `?start=-<seconds>`
+		startOffset := 0.0
+		if query.Get("start") != "" {
+			if startOffset, err = strconv.ParseFloat(query.Get("start"), 64); err != nil {
+				return "", nil, http.StatusBadRequest, err
+			}
+		}
+
+		ready := func() bool { return m.hasPart(0, 0) }
+		if query.Get("_HLS_msn") != "" {
+			msn, err := strconv.ParseUint(query.Get("_HLS_msn"), 10, 64)
+			if err != nil {
+				return "", nil, http.StatusBadRequest, err
+			}
+
+			partIndex, _ := strconv.Atoi(query.Get("_HLS_part"))
+			ready = func() bool { return m.hasPart(msn, partIndex) }
+		}
+
+		if !m.waitFor(req.Context(), m.blockTimeout(), ready) && m.init == nil {
+			return "", nil, http.StatusNotFound, errors.New("stream has no H264 video to package yet")
+		}
+
+		return playlistContentType, [][]byte{m.playlist(startOffset)}, 0, nil
+	case initFile:
+		if m.init == nil {
+			return "", nil, http.StatusNotFound, errNotFound
+		}
+
+		return mp4ContentType, [][]byte{m.init}, 0, nil
+	}
+
+	msn, partIndex, isPart, ok := parseMediaFile(file)
+	if !ok {
+		return "", nil, http.StatusNotFound, errNotFound
+	}
+
+	if !isPart {
+		s := m.segment(msn)
+		if s == nil || !s.complete {
+			return "", nil, http.StatusNotFound, errNotFound
+		}
+
+		for _, p := range s.parts {
+			data = append(data, p.video, p.audio)
+		}
+		return mp4ContentType, data, 0, nil
+	}
+
+	// Only the part in the preload hint is waited for
+	if len(m.segments) != 0 {
+		if current := m.segments[len(m.segments)-1]; msn == current.msn && partIndex == len(current.parts) {
+			m.waitFor(req.Context(), m.blockTimeout(), func() bool { return m.hasPart(msn, partIndex) })
+		}
+	}
+
+	s := m.segment(msn)
+	if s == nil || partIndex >= len(s.parts) {
+		return "", nil, http.StatusNotFound, errNotFound
+	}
+
+	p := s.parts[partIndex]
+	return mp4ContentType, [][]byte{p.video, p.audio}, 0, nil
+}
+
+// parseMediaFile parses segment names like `seg4.m4s` and part names like `part4.2.m4s`
+func parseMediaFile(file string) (msn uint64, partIndex int, isPart bool, ok bool) {
+	if !strings.HasSuffix(file, ".m4s") {
+		return 0, 0, false, false
+	}
+	name := strings.TrimSuffix(file, ".m4s")
+
+	var err error
+	switch {
+	case strings.HasPrefix(name, "seg"):
+		msn, err = strconv.ParseUint(strings.TrimPrefix(name, "seg"), 10, 64)
+		return msn, 0, false, err == nil
+	case strings.HasPrefix(name, "part"):
+		msnString, partString, found := strings.Cut(strings.TrimPrefix(name, "part"), ".")
+		if !found {
+			return 0, 0, false, false
+		}
+
+		if msn, err = strconv.ParseUint(msnString, 10, 64); err != nil {
+			return 0, 0, false, false
+		}
+
+		partIndex, err = strconv.Atoi(partString)
+		return msn, partIndex, true, err == nil && partIndex >= 0
+	}
+
+	return 0, 0, false, false
+}
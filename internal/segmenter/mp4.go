@@ -0,0 +1,207 @@
+package segmenter
+
+import (
+	"encoding/binary"
+)
+
+const (
+	videoTrackID = 1
+	audioTrackID = 2
+
+	videoTimescale = 90000
+	audioTimescale = 48000
+
+	sampleFlagsKeyframe    = 0x02000000
+	sampleFlagsNonKeyframe = 0x01010000
+)
+
+var unityMatrix = []uint32{0x00010000, 0, 0, 0, 0x00010000, 0, 0, 0, 0x40000000}
+
+type sample struct {
+	// In units of the track timescale
+	dts      int64
+	duration uint32
+
+	data     []byte
+	keyframe bool
+}
+
+func box(boxType string, children ...[]byte) []byte {
+	size := 8
+	for _, child := range children {
+		size += len(child)
+	}
+
+	b := make([]byte, 0, size)
+	b = binary.BigEndian.AppendUint32(b, uint32(size))
+	b = append(b, boxType...)
+	for _, child := range children {
+		b = append(b, child...)
+	}
+
+	return b
+}
+
+func fullBox(boxType string, version byte, flags uint32, children ...[]byte) []byte {
+	header := binary.BigEndian.AppendUint32(nil, uint32(version)<<24|flags)
+	return box(boxType, append([][]byte{header}, children...)...)
+}
+
+func uint16s(values ...uint16) []byte {
+	b := []byte{}
+	for _, v := range values {
+		b = binary.BigEndian.AppendUint16(b, v)
+	}
+	return b
+}
+
+func uint32s(values ...uint32) []byte {
+	b := []byte{}
+	for _, v := range values {
+		b = binary.BigEndian.AppendUint32(b, v)
+	}
+	return b
+}
+
+type trak struct {
+	id  uint32
+	box []byte
+}
+
+// initSegment declares tracks, built by videoTrak and audioTrak
+func initSegment(tracks ...trak) []byte {
+	traks, trexs := [][]byte{}, [][]byte{}
+	for _, t := range tracks {
+		traks = append(traks, t.box)
+		trexs = append(trexs, trex(t.id))
+	}
+
+	mvhd := fullBox("mvhd", 0, 0,
+		uint32s(0, 0, 1000, 0, 0x00010000),
+		uint16s(0x0100, 0),
+		make([]byte, 8),
+		uint32s(unityMatrix...),
+		make([]byte, 24),
+		uint32s(audioTrackID+1),
+	)
+
+	moov := append([][]byte{mvhd}, traks...)
+	moov = append(moov, box("mvex", trexs...))
+
+	return append(
+		box("ftyp", []byte("iso5"), uint32s(0x200), []byte("iso5iso6mp41")),
+		box("moov", moov...)...,
+	)
+}
+
+func trex(trackID uint32) []byte {
+	return fullBox("trex", 0, 0, uint32s(trackID, 1, 0, 0, 0))
+}
+
+func tkhd(trackID uint32, volume uint16, width, height int) []byte {
+	return fullBox("tkhd", 0, 3,
+		uint32s(0, 0, trackID, 0, 0),
+		make([]byte, 8),
+		uint16s(0, 0, volume, 0),
+		uint32s(unityMatrix...),
+		uint32s(uint32(width)<<16, uint32(height)<<16),
+	)
+}
+
+func mdia(timescale uint32, handlerType, handlerName string, mediaHeader, sampleEntry []byte) []byte {
+	return box("mdia",
+		fullBox("mdhd", 0, 0, uint32s(0, 0, timescale, 0), uint16s(0x55C4, 0)), // Language `und`
+		fullBox("hdlr", 0, 0, uint32s(0), []byte(handlerType), make([]byte, 12), []byte(handlerName+"\x00")),
+		box("minf",
+			mediaHeader,
+			box("dinf", fullBox("dref", 0, 0, uint32s(1), fullBox("url ", 0, 1))),
+			box("stbl",
+				fullBox("stsd", 0, 0, uint32s(1), sampleEntry),
+				fullBox("stts", 0, 0, uint32s(0)),
+				fullBox("stsc", 0, 0, uint32s(0)),
+				fullBox("stsz", 0, 0, uint32s(0, 0)),
+				fullBox("stco", 0, 0, uint32s(0)),
+			),
+		),
+	)
+}
+
+func videoTrak(sps, pps []byte, width, height int) trak {
+	avcC := []byte{1, sps[1], sps[2], sps[3], 0xFF, 0xE1}
+	avcC = append(binary.BigEndian.AppendUint16(avcC, uint16(len(sps))), sps...)
+	avcC = append(avcC, 1)
+	avcC = append(binary.BigEndian.AppendUint16(avcC, uint16(len(pps))), pps...)
+
+	avc1 := box("avc1",
+		make([]byte, 6), uint16s(1),
+		make([]byte, 16),
+		uint16s(uint16(width), uint16(height)),
+		uint32s(0x00480000, 0x00480000, 0),
+		uint16s(1),
+		make([]byte, 32),
+		uint16s(0x0018, 0xFFFF),
+		box("avcC", avcC),
+	)
+
+	return trak{videoTrackID, box("trak",
+		tkhd(videoTrackID, 0, width, height),
+		mdia(videoTimescale, "vide", "VideoHandler", fullBox("vmhd", 0, 1, make([]byte, 8)), avc1),
+	)}
+}
+
+func audioTrak() trak {
+	opus := box("Opus",
+		make([]byte, 6), uint16s(1),
+		make([]byte, 8),
+		uint16s(2, 16, 0, 0),
+		uint32s(audioTimescale<<16),
+		// Version, channels, pre-skip, input sample rate, gain and mapping family of RFC 7845
+		box("dOps", []byte{0, 2}, uint16s(0), uint32s(audioTimescale), uint16s(0), []byte{0}),
+	)
+
+	return trak{audioTrackID, box("trak",
+		tkhd(audioTrackID, 0x0100, 0, 0),
+		mdia(audioTimescale, "soun", "SoundHandler", fullBox("smhd", 0, 0, uint16s(0, 0)), opus),
+	)}
+}
+
+// fragment is a moof and mdat carrying samples of one track, nil if there are none
+func fragment(sequenceNumber, trackID uint32, samples []sample) []byte {
+	if len(samples) == 0 {
+		return nil
+	}
+
+	build := func(dataOffset uint32) []byte {
+		trun := uint32s(uint32(len(samples)), dataOffset)
+		for _, s := range samples {
+			flags := uint32(sampleFlagsNonKeyframe)
+			if s.keyframe {
+				flags = sampleFlagsKeyframe
+			}
+
+			trun = binary.BigEndian.AppendUint32(trun, s.duration)
+			trun = binary.BigEndian.AppendUint32(trun, uint32(len(s.data)))
+			trun = binary.BigEndian.AppendUint32(trun, flags)
+		}
+
+		return box("moof",
+			fullBox("mfhd", 0, 0, uint32s(sequenceNumber)),
+			box("traf",
+				fullBox("tfhd", 0, 0x020000, uint32s(trackID)), // default-base-is-moof
+				fullBox("tfdt", 1, 0, binary.BigEndian.AppendUint64(nil, uint64(samples[0].dts))),
+				fullBox("trun", 0, 0x000701, trun), // data offset, sample duration, size and flags
+			),
+		)
+	}
+
+	// The offset is relative to the start of the moof, whose size doesn't depend on it
+	moof := build(0)
+	moof = build(uint32(len(moof)) + 8)
+
+	mdat := [][]byte{}
+	for _, s := range samples {
+		mdat = append(mdat, s.data)
+	}
+
+	return append(moof, box("mdat", mdat...)...)
+}
@@ -0,0 +1,352 @@
+// Package segmenter packages H264 and Opus into fMP4 segments, served as Low-Latency HLS
+// and MPEG-DASH for viewers on platforms where WebRTC is unreliable.
+package segmenter
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/glimesh/broadcast-box/internal/h264"
+)
+
+const (
+	partTarget         = 200 * time.Millisecond
+	minSegmentDuration = time.Second
+
+	// Complete segments kept at least, HLS only lists the parts of the last few
+	segmentCount = 7
+
+	mp4ContentType = "video/mp4"
+)
+
+var errNotFound = errors.New("not found")
+
+// part is a fragment of each track, HLS serves them together and DASH one track at a time
+type part struct {
+	video, audio []byte
+	duration     time.Duration
+	independent  bool
+}
+
+type segment struct {
+	msn      uint64
+	parts    []*part
+	duration time.Duration
+	complete bool
+
+	// Decode time and duration of each track in its timescale, audio is unset with a duration of 0
+	videoStart, videoDuration int64
+	audioStart, audioDuration int64
+
+	videoBytes, audioBytes int
+}
+
+// Segmenter packages the media of one publisher. Segments start at keyframes and are split
+// into parts of up to partTarget. B-frames aren't supported, so decode order is presentation order.
+type Segmenter struct {
+	lock sync.Mutex
+
+	// Wall clock time of pts 0
+	start time.Time
+
+	// Closed and replaced whenever a part is added or the Segmenter is closed
+	changed chan struct{}
+	closed  bool
+
+	audioSeen, hasAudio  bool
+	sps, pps             []byte
+	width, height        int
+	init                 []byte
+	videoInit, audioInit []byte
+
+	segments       []*segment
+	targetDuration int
+	fragmentNumber uint32
+
+	// Complete segments are kept for this long behind live, so viewers can rewind
+	dvrWindow time.Duration
+
+	// Samples of the part being built, the last of each track waits for the next to know its duration
+	videoSamples, audioSamples []sample
+	lastVideo, lastAudio       *sample
+	partDuration               int64
+}
+
+// New returns a Segmenter for media whose pts are relative to start, that keeps dvrWindow of
+// segments behind live. The last segmentCount are kept if it is shorter.
+func New(start time.Time, dvrWindow time.Duration) *Segmenter {
+	return &Segmenter{
+		start:          start,
+		changed:        make(chan struct{}),
+		targetDuration: int(minSegmentDuration / time.Second),
+		dvrWindow:      dvrWindow,
+	}
+}
+
+func toTimescale(pts time.Duration, timescale int64) int64 {
+	if pts < 0 {
+		return 0
+	}
+	return int64(pts) * timescale / int64(time.Second)
+}
+
+// WriteH264 adds an access unit in Annex B format. Video before the first keyframe with
+// parameter sets is dropped.
+func (m *Segmenter) WriteH264(pts time.Duration, accessUnit []byte) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.closed {
+		return
+	}
+
+	nalus := h264.SplitAnnexB(accessUnit)
+	keyframe := false
+	for _, nalu := range nalus {
+		if len(nalu) == 0 {
+			continue
+		}
+
+		switch nalu[0] & naluTypeBitmask {
+		case naluTypeIDR:
+			keyframe = true
+		case naluTypeSPS:
+			// Only an SPS whose picture size can be read is used, it is sent to players
+			if width, height, err := h264.SPSDimensions(nalu); m.sps == nil && err == nil {
+				m.sps = append([]byte{}, nalu...)
+				m.width, m.height = width, height
+			}
+		case naluTypePPS:
+			if m.pps == nil {
+				m.pps = append([]byte{}, nalu...)
+			}
+		}
+	}
+
+	if m.init == nil {
+		if !keyframe || m.sps == nil || m.pps == nil {
+			return
+		}
+
+		// Opus that arrives after the first keyframe can't be added to the init segment anymore
+		m.hasAudio = m.audioSeen
+		video := videoTrak(m.sps, m.pps, m.width, m.height)
+		m.videoInit = initSegment(video)
+		if m.hasAudio {
+			audio := audioTrak()
+			m.audioInit = initSegment(audio)
+			m.init = initSegment(video, audio)
+		} else {
+			m.init = m.videoInit
+		}
+
+		m.segments = []*segment{{}}
+	}
+
+	next := &sample{dts: toTimescale(pts, videoTimescale), data: avccSample(nalus), keyframe: keyframe}
+	if last := m.lastVideo; last != nil {
+		last.duration = 1
+		if next.dts > last.dts {
+			last.duration = uint32(next.dts - last.dts)
+		}
+
+		m.videoSamples = append(m.videoSamples, *last)
+		m.partDuration += int64(last.duration)
+
+		current := m.segments[len(m.segments)-1]
+		segmentDuration := current.duration + time.Duration(m.partDuration)*time.Second/videoTimescale
+		if keyframe && segmentDuration >= minSegmentDuration {
+			m.flushPart()
+			m.completeSegment()
+		} else if time.Duration(m.partDuration+int64(last.duration))*time.Second/videoTimescale > partTarget {
+			m.flushPart()
+		}
+	}
+	m.lastVideo = next
+}
+
+// WriteOpus adds an Opus packet. Audio is only packaged if it started before the first keyframe.
+func (m *Segmenter) WriteOpus(pts time.Duration, packet []byte) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.audioSeen = true
+	if m.closed || !m.hasAudio {
+		return
+	}
+
+	next := &sample{dts: toTimescale(pts, audioTimescale), data: append([]byte{}, packet...), keyframe: true}
+	if last := m.lastAudio; last != nil {
+		last.duration = 1
+		if next.dts > last.dts {
+			last.duration = uint32(next.dts - last.dts)
+		}
+
+		m.audioSamples = append(m.audioSamples, *last)
+	}
+	m.lastAudio = next
+}
+
+// Close ends the stream, what was segmented can still be played until the Segmenter is dropped
+func (m *Segmenter) Close() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.closed {
+		return
+	}
+
+	if m.init != nil {
+		m.flushPart()
+		m.completeSegment()
+
+		// Drop the segment that would have followed
+		if last := m.segments[len(m.segments)-1]; !last.complete {
+			m.segments = m.segments[:len(m.segments)-1]
+		}
+	}
+
+	m.closed = true
+	m.notify()
+}
+
+func (m *Segmenter) notify() {
+	close(m.changed)
+	m.changed = make(chan struct{})
+}
+
+func (m *Segmenter) flushPart() {
+	if len(m.videoSamples) == 0 {
+		return
+	}
+
+	current := m.segments[len(m.segments)-1]
+	if len(current.parts) == 0 {
+		current.videoStart = m.videoSamples[0].dts
+	}
+	if current.audioDuration == 0 && len(m.audioSamples) != 0 {
+		current.audioStart = m.audioSamples[0].dts
+	}
+
+	p := &part{
+		video:       fragment(m.fragmentNumber+1, videoTrackID, m.videoSamples),
+		audio:       fragment(m.fragmentNumber+2, audioTrackID, m.audioSamples),
+		duration:    time.Duration(m.partDuration) * time.Second / videoTimescale,
+		independent: m.videoSamples[0].keyframe,
+	}
+	m.fragmentNumber += 2
+
+	current.parts = append(current.parts, p)
+	current.duration += p.duration
+	current.videoDuration += m.partDuration
+	current.videoBytes += len(p.video)
+	current.audioBytes += len(p.audio)
+	for _, s := range m.audioSamples {
+		current.audioDuration += int64(s.duration)
+	}
+
+	m.videoSamples, m.audioSamples, m.partDuration = nil, nil, 0
+	m.notify()
+}
+
+func (m *Segmenter) completeSegment() {
+	current := m.segments[len(m.segments)-1]
+	if len(current.parts) == 0 {
+		return
+	}
+	current.complete = true
+
+	if seconds := int(math.Ceil(current.duration.Seconds())); seconds > m.targetDuration {
+		m.targetDuration = seconds
+	}
+
+	m.segments = append(m.segments, &segment{msn: current.msn + 1})
+
+	// The oldest segment is dropped while the others still cover the DVR window
+	window := time.Duration(0)
+	for _, s := range m.segments[1:] {
+		window += s.duration
+	}
+	for len(m.segments) > segmentCount+1 && window >= m.dvrWindow {
+		m.segments = m.segments[1:]
+		window -= m.segments[0].duration
+	}
+}
+
+func (m *Segmenter) segment(msn uint64) *segment {
+	for _, s := range m.segments {
+		if s.msn == msn {
+			return s
+		}
+	}
+	return nil
+}
+
+// hasPart reports if part partIndex of segment msn (or any later one) has been written
+func (m *Segmenter) hasPart(msn uint64, partIndex int) bool {
+	if len(m.segments) == 0 {
+		return false
+	}
+
+	current := m.segments[len(m.segments)-1]
+	return msn < current.msn || (msn == current.msn && partIndex < len(current.parts))
+}
+
+// waitFor blocks until ready returns true, the Segmenter is closed or timeout passed. The lock must be held.
+func (m *Segmenter) waitFor(ctx context.Context, timeout time.Duration, ready func() bool) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for !ready() {
+		if m.closed {
+			return false
+		}
+
+		changed := m.changed
+		m.lock.Unlock()
+		select {
+		case <-changed:
+			m.lock.Lock()
+		case <-timer.C:
+			m.lock.Lock()
+			return ready()
+		case <-ctx.Done():
+			m.lock.Lock()
+			return false
+		}
+	}
+
+	return true
+}
+
+// blockTimeout is how long requests for media that isn't available yet are held
+func (m *Segmenter) blockTimeout() time.Duration {
+	return 3 * time.Duration(m.targetDuration) * time.Second
+}
+
+// serve writes the result of a lookup, which runs with the lock held so it isn't held while writing
+func (m *Segmenter) serve(res http.ResponseWriter, lookup func() (contentType string, data [][]byte, status int, err error)) {
+	m.lock.Lock()
+	contentType, data, status, err := lookup()
+	m.lock.Unlock()
+
+	if err != nil {
+		http.Error(res, err.Error(), status)
+		return
+	}
+
+	res.Header().Set("Content-Type", contentType)
+	if contentType != mp4ContentType {
+		res.Header().Set("Cache-Control", "no-cache")
+	}
+
+	for _, d := range data {
+		if _, err = res.Write(d); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package segmenter
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWriteH264InvalidSPS(t *testing.T) {
+	m := New(time.Now(), 0)
+	pps := []byte{0, 0, 0, 1, 0x68, 0xce, 0x38, 0x80}
+	idr := []byte{0, 0, 0, 1, 0x65, 0x88, 0x84}
+
+	// Used to loop for billions of iterations, on the read path of the publisher
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		m.WriteH264(0, append(append([]byte{0, 0, 0, 1, 0x67, 0x42, 0x00, 0x1f, 0xd7}, pps...), idr...))
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("WriteH264 didn't return")
+	}
+
+	if m.sps != nil || m.init != nil {
+		t.Fatal("SPS whose size can't be read was used")
+	}
+
+	m.WriteH264(time.Second/30, append(append([]byte{0, 0, 0, 1, 0x67, 0x42, 0x00, 0x1f, 0xf4, 0x02, 0x80, 0x2d, 0xc8}, pps...), idr...))
+	if m.init == nil {
+		t.Fatal("SPS after the invalid one wasn't used")
+	} else if m.width != 1280 || m.height != 720 {
+		t.Fatalf("video is %dx%d instead of 1280x720", m.width, m.height)
+	}
+}
+
+func FuzzWriteH264(f *testing.F) {
+	f.Add([]byte{0, 0, 0, 1, 0x67, 0x42, 0x00, 0x1f, 0xf4, 0x02, 0x80, 0x2d, 0xc8, 0, 0, 0, 1, 0x68, 0xce, 0x38, 0x80, 0, 0, 0, 1, 0x65, 0x88, 0x84})
+	f.Add([]byte{0, 0, 1, 0, 0, 1, 0x65})
+
+	f.Fuzz(func(t *testing.T, accessUnit []byte) {
+		m := New(time.Now(), 0)
+		m.WriteH264(0, accessUnit)
+		m.WriteH264(time.Second, accessUnit)
+		m.Close()
+	})
+}
@@ -0,0 +1,199 @@
+package srt
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	handshakeCIFSize = 48
+
+	handshakeTypeInduction  = 1
+	handshakeTypeConclusion = 0xFFFFFFFF
+
+	// Sent by HSv5 listeners in the extension field of the induction response
+	handshakeMagic = 0x4A17
+
+	extensionHSReq    = 1
+	extensionHSRsp    = 2
+	extensionKMReq    = 3
+	extensionStreamID = 5
+
+	extensionFlagHSReq  = 0x1
+	extensionFlagConfig = 0x4
+
+	srtVersion = 0x00010500
+
+	// TSBPDSND | TSBPDRCV | TLPKTDROP | PERIODICNAK | REXMITFLG
+	srtFlags = 0x01 | 0x02 | 0x08 | 0x10 | 0x20
+
+	// Rejection reasons are sent as handshake type 1000 + reason
+	rejectPeer        = 1000 + 2
+	rejectUnsecure    = 1000 + 11
+	rejectXForbidden  = 1000 + 1403
+	rejectXBadRequest = 1000 + 1400
+)
+
+type handshake struct {
+	version            uint32
+	encryption         uint16
+	extensionField     uint16
+	initialSequence    uint32
+	mtu                uint32
+	flowWindow         uint32
+	handshakeType      uint32
+	socketID           uint32
+	cookie             uint32
+	peerIP             [16]byte
+	hasKMReq           bool
+	streamID           string
+	receiverTSBPDDelay uint16
+	senderTSBPDDelay   uint16
+
+	// Conclusions of callers carry HSREQ and the stream ID, those of listeners HSRSP
+	caller bool
+}
+
+func parseHandshake(cif []byte) (*handshake, error) {
+	if len(cif) < handshakeCIFSize {
+		return nil, errors.New("short handshake")
+	}
+
+	h := &handshake{
+		version:         binary.BigEndian.Uint32(cif[0:]),
+		encryption:      binary.BigEndian.Uint16(cif[4:]),
+		extensionField:  binary.BigEndian.Uint16(cif[6:]),
+		initialSequence: binary.BigEndian.Uint32(cif[8:]),
+		mtu:             binary.BigEndian.Uint32(cif[12:]),
+		flowWindow:      binary.BigEndian.Uint32(cif[16:]),
+		handshakeType:   binary.BigEndian.Uint32(cif[20:]),
+		socketID:        binary.BigEndian.Uint32(cif[24:]),
+		cookie:          binary.BigEndian.Uint32(cif[28:]),
+	}
+	copy(h.peerIP[:], cif[32:48])
+
+	for extensions := cif[handshakeCIFSize:]; len(extensions) >= 4; {
+		extensionType := binary.BigEndian.Uint16(extensions[0:])
+		extensionLength := int(binary.BigEndian.Uint16(extensions[2:])) * 4
+		if 4+extensionLength > len(extensions) {
+			return nil, errors.New("truncated handshake extension")
+		}
+		content := extensions[4 : 4+extensionLength]
+		extensions = extensions[4+extensionLength:]
+
+		switch extensionType {
+		case extensionHSReq:
+			if len(content) >= 12 {
+				h.receiverTSBPDDelay = binary.BigEndian.Uint16(content[8:])
+				h.senderTSBPDDelay = binary.BigEndian.Uint16(content[10:])
+			}
+		case extensionKMReq:
+			h.hasKMReq = true
+		case extensionStreamID:
+			// Every 32 bit word of the stream ID is sent in little endian
+			streamID := make([]byte, len(content))
+			for i := 0; i+4 <= len(content); i += 4 {
+				streamID[i], streamID[i+1], streamID[i+2], streamID[i+3] = content[i+3], content[i+2], content[i+1], content[i]
+			}
+			h.streamID = strings.TrimRight(string(streamID), "\x00")
+		}
+	}
+
+	return h, nil
+}
+
+func (h *handshake) marshal() []byte {
+	cif := make([]byte, handshakeCIFSize)
+	binary.BigEndian.PutUint32(cif[0:], h.version)
+	binary.BigEndian.PutUint16(cif[4:], h.encryption)
+	binary.BigEndian.PutUint16(cif[6:], h.extensionField)
+	binary.BigEndian.PutUint32(cif[8:], h.initialSequence)
+	binary.BigEndian.PutUint32(cif[12:], h.mtu)
+	binary.BigEndian.PutUint32(cif[16:], h.flowWindow)
+	binary.BigEndian.PutUint32(cif[20:], h.handshakeType)
+	binary.BigEndian.PutUint32(cif[24:], h.socketID)
+	binary.BigEndian.PutUint32(cif[28:], h.cookie)
+	copy(cif[32:], h.peerIP[:])
+
+	if h.extensionField&extensionFlagHSReq != 0 && h.version == 5 && h.handshakeType == handshakeTypeConclusion {
+		extensionType := uint16(extensionHSRsp)
+		if h.caller {
+			extensionType = extensionHSReq
+		}
+
+		cif = binary.BigEndian.AppendUint16(cif, extensionType)
+		cif = binary.BigEndian.AppendUint16(cif, 3)
+		cif = binary.BigEndian.AppendUint32(cif, srtVersion)
+		cif = binary.BigEndian.AppendUint32(cif, srtFlags)
+		cif = binary.BigEndian.AppendUint16(cif, h.receiverTSBPDDelay)
+		cif = binary.BigEndian.AppendUint16(cif, h.senderTSBPDDelay)
+	}
+
+	if h.caller && h.streamID != "" && h.handshakeType == handshakeTypeConclusion {
+		// Padded to whole words, which are sent in little endian
+		streamID := []byte(h.streamID)
+		for len(streamID)%4 != 0 {
+			streamID = append(streamID, 0)
+		}
+
+		cif = binary.BigEndian.AppendUint16(cif, extensionStreamID)
+		cif = binary.BigEndian.AppendUint16(cif, uint16(len(streamID)/4))
+		for i := 0; i < len(streamID); i += 4 {
+			cif = append(cif, streamID[i+3], streamID[i+2], streamID[i+1], streamID[i])
+		}
+	}
+
+	return cif
+}
+
+// synCookie is the cookie a listener sends addr, it changes every minute
+func synCookie(key []byte, addr net.Addr, minute int64) uint32 {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(addr.String() + "|" + strconv.FormatInt(minute, 10)))
+	return binary.BigEndian.Uint32(mac.Sum(nil))
+}
+
+// peerIPField encodes addr like libsrt, IPv4 addresses are sent as a little endian word
+func peerIPField(addr net.Addr) (field [16]byte) {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return
+	}
+
+	if ip4 := udpAddr.IP.To4(); ip4 != nil {
+		field[0], field[1], field[2], field[3] = ip4[3], ip4[2], ip4[1], ip4[0]
+		return
+	}
+
+	copy(field[:], udpAddr.IP.To16())
+	return
+}
+
+// parseStreamID returns the stream key of a stream ID, either the stream key itself or
+// the `r` key of the access control syntax like `#!::r=streamKey,m=publish`
+func parseStreamID(streamID string) (string, error) {
+	if !strings.HasPrefix(streamID, "#!::") {
+		return streamID, nil
+	}
+	values := strings.TrimPrefix(streamID, "#!::")
+
+	streamKey := ""
+	for _, keyValue := range strings.Split(values, ",") {
+		key, value, _ := strings.Cut(keyValue, "=")
+		switch key {
+		case "r":
+			streamKey = value
+		case "m":
+			if value != "publish" {
+				return "", errors.New("only publishing is supported over SRT")
+			}
+		}
+	}
+
+	return streamKey, nil
+}
@@ -0,0 +1,628 @@
+package srt
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// Seven MPEG-TS packets, like libsrt sends in live mode
+	outputPayloadSize = 7 * 188
+
+	controlTypeACKACK = 0x0006
+
+	handshakeRetry    = 250 * time.Millisecond
+	handshakeTimeout  = 3 * time.Second
+	reconnectInterval = 5 * time.Second
+
+	// Data packet flags: a solo message (PP=11) and the retransmitted bit
+	messageSolo        = 0xC0000000
+	messageRetransmit  = 0x04000000
+	messageNumberMask  = 0x03FFFFFF
+	rejectReasonOffset = 1000
+)
+
+// Output sends MPEG-TS in SRT live mode (unencrypted) to peers. In caller mode it connects to
+// a listener and reconnects whenever the connection drops, in listener mode any number of
+// callers can connect. What is written while no peer is connected is dropped.
+type Output struct {
+	address  string
+	streamID string
+	latency  time.Duration
+	listen   bool
+
+	lock       sync.Mutex
+	senders    map[uint32]*sender
+	packetConn net.PacketConn
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// NewOutput starts an Output for a URL like `srt://host:port?streamid=key` or
+// `srt://:port?mode=listener`. `latency` is in milliseconds.
+func NewOutput(rawURL string) (*Output, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	} else if u.Scheme != "srt" {
+		return nil, fmt.Errorf("unsupported scheme `%s`, expected srt", u.Scheme)
+	}
+
+	query := u.Query()
+	o := &Output{
+		address:  u.Host,
+		streamID: query.Get("streamid"),
+		latency:  defaultLatency,
+		senders:  map[uint32]*sender{},
+		closed:   make(chan struct{}),
+	}
+
+	switch query.Get("mode") {
+	case "", "caller":
+	case "listener":
+		o.listen = true
+	default:
+		return nil, fmt.Errorf("unsupported mode `%s`, expected caller or listener", query.Get("mode"))
+	}
+
+	if query.Get("passphrase") != "" {
+		return nil, errors.New("encryption is not supported")
+	}
+
+	if val := query.Get("latency"); val != "" {
+		latency, err := strconv.Atoi(val)
+		if err != nil || latency < 0 {
+			return nil, fmt.Errorf("invalid latency `%s`", val)
+		}
+		o.latency = time.Duration(latency) * time.Millisecond
+	}
+
+	if o.listen {
+		if o.packetConn, err = net.ListenPacket("udp", o.address); err != nil {
+			return nil, err
+		}
+		go o.serve()
+	} else {
+		if _, err = net.ResolveUDPAddr("udp", o.address); err != nil {
+			return nil, err
+		}
+		go o.call()
+	}
+
+	return o, nil
+}
+
+// Write sends ts, which must be whole MPEG-TS packets, to every connected peer
+func (o *Output) Write(ts []byte) (int, error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	for offset := 0; offset < len(ts); offset += outputPayloadSize {
+		end := offset + outputPayloadSize
+		if end > len(ts) {
+			end = len(ts)
+		}
+
+		for _, s := range o.senders {
+			s.write(ts[offset:end])
+		}
+	}
+
+	return len(ts), nil
+}
+
+// Close disconnects every peer and stops accepting or reconnecting
+func (o *Output) Close() {
+	o.closeOnce.Do(func() {
+		close(o.closed)
+
+		o.lock.Lock()
+		for _, s := range o.senders {
+			s.shutdown()
+		}
+		packetConn := o.packetConn
+		o.lock.Unlock()
+
+		if packetConn != nil {
+			packetConn.Close()
+		}
+	})
+}
+
+func (o *Output) isClosed() bool {
+	select {
+	case <-o.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (o *Output) addSender(s *sender) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.senders[s.socketID] = s
+}
+
+func (o *Output) removeSender(s *sender) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	delete(o.senders, s.socketID)
+}
+
+func (o *Output) getSender(socketID uint32) *sender {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return o.senders[socketID]
+}
+
+// call connects to the listener until the Output is closed
+func (o *Output) call() {
+	for !o.isClosed() {
+		if err := o.callOnce(); err != nil && !o.isClosed() {
+			logger.Warn("SRT output failed", "addr", o.address, "err", err)
+		}
+
+		select {
+		case <-o.closed:
+		case <-time.After(reconnectInterval):
+		}
+	}
+}
+
+func (o *Output) callOnce() error {
+	peerAddr, err := net.ResolveUDPAddr("udp", o.address)
+	if err != nil {
+		return err
+	}
+
+	packetConn, err := net.ListenPacket("udp", "")
+	if err != nil {
+		return err
+	}
+	defer packetConn.Close()
+
+	o.lock.Lock()
+	o.packetConn = packetConn
+	o.lock.Unlock()
+	if o.isClosed() {
+		return nil
+	}
+
+	s, err := dial(packetConn, peerAddr, o.streamID, o.latency)
+	if err != nil {
+		return err
+	}
+
+	o.addSender(s)
+	defer o.removeSender(s)
+	logger.Info("SRT output connected", "addr", o.address)
+
+	go s.run()
+	buf := make([]byte, maxPacketSize)
+	for {
+		// Wake up regularly to notice when the sender timed out
+		if err = packetConn.SetReadDeadline(time.Now().Add(keepalivePeriod)); err != nil {
+			s.close()
+			return err
+		}
+
+		n, addr, err := packetConn.ReadFrom(buf)
+		var netErr net.Error
+		if err != nil && !(errors.As(err, &netErr) && netErr.Timeout()) {
+			s.close()
+			return nil
+		} else if err == nil && addr.String() == peerAddr.String() && n >= headerSize && binary.BigEndian.Uint32(buf[12:]) == s.socketID {
+			s.handlePacket(buf[:n])
+		}
+
+		select {
+		case <-s.closed:
+			logger.Info("SRT output disconnected", "addr", o.address)
+			return nil
+		default:
+		}
+	}
+}
+
+// dial runs the caller side of the handshake, see section 4.3.1.1 of the SRT draft
+func dial(packetConn net.PacketConn, peerAddr net.Addr, streamID string, latency time.Duration) (*sender, error) {
+	random := make([]byte, 8)
+	if _, err := rand.Read(random); err != nil {
+		return nil, err
+	}
+
+	request := &handshake{
+		version:         4,
+		extensionField:  2,
+		initialSequence: binary.BigEndian.Uint32(random[0:]) & sequenceMask,
+		mtu:             maxPacketSize,
+		flowWindow:      flowWindow,
+		handshakeType:   handshakeTypeInduction,
+		socketID:        binary.BigEndian.Uint32(random[4:])&sequenceMask | 1,
+		peerIP:          peerIPField(peerAddr),
+	}
+
+	induction, err := exchangeHandshake(packetConn, peerAddr, request)
+	if err != nil {
+		return nil, err
+	} else if induction.version != 5 || induction.extensionField != handshakeMagic {
+		return nil, errors.New("only SRT 1.3 and newer listeners are supported")
+	}
+
+	request.version = 5
+	request.extensionField = extensionFlagHSReq
+	if streamID != "" {
+		request.extensionField |= extensionFlagConfig
+	}
+	request.handshakeType = handshakeTypeConclusion
+	request.cookie = induction.cookie
+	request.caller = true
+	request.streamID = streamID
+	request.receiverTSBPDDelay = uint16(latency / time.Millisecond)
+	request.senderTSBPDDelay = uint16(latency / time.Millisecond)
+
+	conclusion, err := exchangeHandshake(packetConn, peerAddr, request)
+	if err != nil {
+		return nil, err
+	} else if isRejection(conclusion.handshakeType) {
+		return nil, fmt.Errorf("rejected by listener with reason %d", conclusion.handshakeType-rejectReasonOffset)
+	} else if conclusion.handshakeType != handshakeTypeConclusion {
+		return nil, errors.New("unexpected handshake response")
+	}
+
+	if peerLatency := time.Duration(conclusion.receiverTSBPDDelay) * time.Millisecond; peerLatency > latency {
+		latency = peerLatency
+	}
+
+	return newSender(packetConn, peerAddr, request.socketID, conclusion.socketID, request.initialSequence, latency), nil
+}
+
+// isRejection reports if a handshake type is a rejection reason
+func isRejection(handshakeType uint32) bool {
+	return handshakeType >= rejectReasonOffset && handshakeType != handshakeTypeConclusion
+}
+
+// exchangeHandshake sends request until a response of the same type or a rejection arrives
+func exchangeHandshake(packetConn net.PacketConn, peerAddr net.Addr, request *handshake) (*handshake, error) {
+	defer packetConn.SetReadDeadline(time.Time{})
+
+	pkt := controlPacket(0, controlTypeHandshake, 0, 0, request.marshal())
+	buf := make([]byte, maxPacketSize)
+	for deadline := time.Now().Add(handshakeTimeout); time.Now().Before(deadline); {
+		if _, err := packetConn.WriteTo(pkt, peerAddr); err != nil {
+			return nil, err
+		}
+
+		if err := packetConn.SetReadDeadline(time.Now().Add(handshakeRetry)); err != nil {
+			return nil, err
+		}
+
+		for {
+			n, addr, err := packetConn.ReadFrom(buf)
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				break
+			} else if err != nil {
+				return nil, err
+			}
+
+			if addr.String() != peerAddr.String() || n < headerSize || binary.BigEndian.Uint16(buf[0:]) != 0x8000|controlTypeHandshake ||
+				binary.BigEndian.Uint32(buf[12:]) != request.socketID {
+				continue
+			}
+
+			response, err := parseHandshake(buf[headerSize:n])
+			if err != nil {
+				return nil, err
+			}
+
+			if response.handshakeType == request.handshakeType || isRejection(response.handshakeType) {
+				return response, nil
+			}
+		}
+	}
+
+	return nil, errors.New("handshake timed out")
+}
+
+// serve accepts callers until the Output is closed
+func (o *Output) serve() {
+	cookieKey := make([]byte, 32)
+	if _, err := rand.Read(cookieKey); err != nil {
+		logger.Error("Failed to generate SYN cookie key", "err", err)
+		return
+	}
+
+	// Senders by the address and socket ID of the caller, to answer repeated conclusions
+	callers := map[string]*sender{}
+
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, addr, err := o.packetConn.ReadFrom(buf)
+		if err != nil {
+			if !o.isClosed() {
+				logger.Warn("SRT output failed", "addr", o.address, "err", err)
+			}
+			return
+		}
+
+		if n < headerSize {
+			continue
+		}
+
+		if destinationSocketID := binary.BigEndian.Uint32(buf[12:]); destinationSocketID != 0 {
+			if s := o.getSender(destinationSocketID); s != nil && s.peerAddr.String() == addr.String() {
+				s.handlePacket(buf[:n])
+			}
+			continue
+		} else if binary.BigEndian.Uint16(buf[0:]) != 0x8000|controlTypeHandshake {
+			continue
+		}
+
+		for peerKey, s := range callers {
+			select {
+			case <-s.closed:
+				delete(callers, peerKey)
+			default:
+			}
+		}
+
+		o.acceptHandshake(buf[headerSize:n], addr, cookieKey, callers)
+	}
+}
+
+func (o *Output) acceptHandshake(cif []byte, addr net.Addr, cookieKey []byte, callers map[string]*sender) {
+	h, err := parseHandshake(cif)
+	if err != nil {
+		return
+	}
+
+	minute := time.Now().Unix() / 60
+	response := &handshake{
+		version:         5,
+		initialSequence: h.initialSequence,
+		mtu:             maxPacketSize,
+		flowWindow:      flowWindow,
+		handshakeType:   h.handshakeType,
+		cookie:          synCookie(cookieKey, addr, minute),
+		peerIP:          peerIPField(addr),
+	}
+	writeResponse := func() {
+		if _, err := o.packetConn.WriteTo(controlPacket(h.socketID, controlTypeHandshake, 0, 0, response.marshal()), addr); err != nil {
+			logger.Warn("Failed to write SRT handshake", "addr", addr, "err", err)
+		}
+	}
+
+	switch h.handshakeType {
+	case handshakeTypeInduction:
+		response.extensionField = handshakeMagic
+		writeResponse()
+		return
+	case handshakeTypeConclusion:
+	default:
+		return
+	}
+
+	if h.cookie != response.cookie && h.cookie != synCookie(cookieKey, addr, minute-1) {
+		return
+	}
+	response.cookie = h.cookie
+
+	if h.version != 5 || h.extensionField&extensionFlagHSReq == 0 {
+		response.handshakeType = rejectXBadRequest
+		writeResponse()
+		return
+	} else if h.encryption != 0 || h.hasKMReq {
+		response.handshakeType = rejectUnsecure
+		writeResponse()
+		return
+	}
+
+	latency := o.latency
+	if receiverLatency := time.Duration(h.receiverTSBPDDelay) * time.Millisecond; receiverLatency > latency {
+		latency = receiverLatency
+	}
+	response.extensionField = extensionFlagHSReq
+	response.receiverTSBPDDelay = uint16(latency / time.Millisecond)
+	response.senderTSBPDDelay = uint16(latency / time.Millisecond)
+
+	peerKey := addr.String() + "|" + strconv.FormatUint(uint64(h.socketID), 10)
+	s, ok := callers[peerKey]
+	if !ok {
+		socketID := make([]byte, 4)
+		if _, err := rand.Read(socketID); err != nil {
+			return
+		}
+
+		s = newSender(o.packetConn, addr, binary.BigEndian.Uint32(socketID)&sequenceMask|1, h.socketID, h.initialSequence, latency)
+		callers[peerKey] = s
+		o.addSender(s)
+		logger.Info("SRT output accepted caller", "addr", o.address, "caller", addr)
+
+		go func() {
+			s.run()
+			o.removeSender(s)
+			logger.Info("SRT output disconnected caller", "addr", o.address, "caller", addr)
+		}()
+	}
+
+	response.socketID = s.socketID
+	writeResponse()
+}
+
+type sentPacket struct {
+	sequence uint32
+	pkt      []byte
+	sent     time.Time
+}
+
+// sender sends to one peer, keeping sent packets for retransmission until they are acknowledged
+// or older than latency, after which the receiver would drop them anyway
+type sender struct {
+	packetConn   net.PacketConn
+	peerAddr     net.Addr
+	socketID     uint32
+	peerSocketID uint32
+	latency      time.Duration
+	start        time.Time
+
+	lock          sync.Mutex
+	nextSequence  uint32
+	messageNumber uint32
+	sent          []sentPacket
+	lastReceived  time.Time
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newSender(packetConn net.PacketConn, peerAddr net.Addr, socketID, peerSocketID, initialSequence uint32, latency time.Duration) *sender {
+	return &sender{
+		packetConn:    packetConn,
+		peerAddr:      peerAddr,
+		socketID:      socketID,
+		peerSocketID:  peerSocketID,
+		latency:       latency,
+		start:         time.Now(),
+		nextSequence:  initialSequence,
+		messageNumber: 1,
+		lastReceived:  time.Now(),
+		closed:        make(chan struct{}),
+	}
+}
+
+func (s *sender) timestamp() uint32 {
+	return uint32(time.Since(s.start) / time.Microsecond)
+}
+
+func (s *sender) writePacket(pkt []byte) {
+	if _, err := s.packetConn.WriteTo(pkt, s.peerAddr); err != nil && !errors.Is(err, net.ErrClosed) {
+		logger.Warn("Failed to write SRT packet", "addr", s.peerAddr, "err", err)
+	}
+}
+
+func (s *sender) writeControl(controlType uint16, typeSpecific uint32, cif []byte) {
+	s.writePacket(controlPacket(s.peerSocketID, controlType, typeSpecific, s.timestamp(), cif))
+}
+
+func (s *sender) write(payload []byte) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	pkt := make([]byte, headerSize, headerSize+len(payload))
+	binary.BigEndian.PutUint32(pkt[0:], s.nextSequence)
+	binary.BigEndian.PutUint32(pkt[4:], messageSolo|s.messageNumber)
+	binary.BigEndian.PutUint32(pkt[8:], s.timestamp())
+	binary.BigEndian.PutUint32(pkt[12:], s.peerSocketID)
+	pkt = append(pkt, payload...)
+
+	now := time.Now()
+	for len(s.sent) > 0 && now.Sub(s.sent[0].sent) > s.latency {
+		s.sent = s.sent[1:]
+	}
+	s.sent = append(s.sent, sentPacket{sequence: s.nextSequence, pkt: pkt, sent: now})
+
+	s.nextSequence = (s.nextSequence + 1) & sequenceMask
+	s.messageNumber = (s.messageNumber + 1) & messageNumberMask
+	if s.messageNumber == 0 {
+		s.messageNumber = 1
+	}
+
+	s.writePacket(pkt)
+}
+
+func (s *sender) handlePacket(pkt []byte) {
+	if pkt[0]&0x80 == 0 {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.lastReceived = time.Now()
+	cif := pkt[headerSize:]
+
+	switch binary.BigEndian.Uint16(pkt[0:]) & 0x7FFF {
+	case controlTypeACK:
+		if len(cif) < 4 {
+			return
+		}
+
+		acknowledged := binary.BigEndian.Uint32(cif[0:]) & sequenceMask
+		for len(s.sent) > 0 && sequenceDiff(s.sent[0].sequence, acknowledged) < 0 {
+			s.sent = s.sent[1:]
+		}
+
+		// Light ACKs only carry the sequence number and aren't acknowledged
+		if len(cif) > 4 {
+			s.writeControl(controlTypeACKACK, binary.BigEndian.Uint32(pkt[4:]), nil)
+		}
+	case controlTypeNAK:
+		for len(cif) >= 4 {
+			first := binary.BigEndian.Uint32(cif[0:])
+			last := first & sequenceMask
+			cif = cif[4:]
+			if first&0x80000000 != 0 && len(cif) >= 4 {
+				last = binary.BigEndian.Uint32(cif[0:]) & sequenceMask
+				cif = cif[4:]
+			}
+
+			s.retransmit(first&sequenceMask, last)
+		}
+	case controlTypeShutdown:
+		go s.close()
+	}
+}
+
+// retransmit resends the sent packets from first to last that are still buffered
+func (s *sender) retransmit(first, last uint32) {
+	for _, p := range s.sent {
+		if sequenceDiff(p.sequence, first) >= 0 && sequenceDiff(p.sequence, last) <= 0 {
+			binary.BigEndian.PutUint32(p.pkt[4:], binary.BigEndian.Uint32(p.pkt[4:])|messageRetransmit)
+			s.writePacket(p.pkt)
+		}
+	}
+}
+
+// run sends keepalives until the peer stops responding or the sender is closed
+func (s *sender) run() {
+	keepaliveTicker := time.NewTicker(keepalivePeriod)
+	defer keepaliveTicker.Stop()
+
+	for {
+		select {
+		case <-s.closed:
+			return
+		case <-keepaliveTicker.C:
+			s.lock.Lock()
+			idle := time.Since(s.lastReceived) > peerIdleTimeout
+			s.lock.Unlock()
+
+			if idle {
+				s.close()
+				return
+			}
+			s.writeControl(controlTypeKeepalive, 0, make([]byte, 4))
+		}
+	}
+}
+
+func (s *sender) shutdown() {
+	s.writeControl(controlTypeShutdown, 0, make([]byte, 4))
+	s.close()
+}
+
+func (s *sender) close() {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+	})
+}
@@ -0,0 +1,499 @@
+// Package srt accepts publishers sending MPEG-TS over SRT (live mode, unencrypted) and
+// forwards their H264 and Opus to an Ingest, so the stream can be watched over WHEP.
+package srt
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/glimesh/broadcast-box/internal/logging"
+	"github.com/glimesh/broadcast-box/internal/mpegts"
+)
+
+var logger = logging.Logger("srt")
+
+const (
+	headerSize = 16
+
+	controlTypeHandshake = 0x0000
+	controlTypeKeepalive = 0x0001
+	controlTypeACK       = 0x0002
+	controlTypeNAK       = 0x0003
+	controlTypeShutdown  = 0x0005
+	controlTypeDropReq   = 0x0007
+
+	maxPacketSize   = 1500
+	flowWindow      = 8192
+	defaultLatency  = 120 * time.Millisecond
+	ackInterval     = 10 * time.Millisecond
+	nakInterval     = 20 * time.Millisecond
+	keepalivePeriod = time.Second
+	peerIdleTimeout = 5 * time.Second
+
+	// Most lost packets reported in one NAK
+	maxNAKLosses = 512
+
+	sequenceMask = 0x7FFFFFFF
+)
+
+// Ingest receives the media of one publisher
+type Ingest interface {
+	WriteH264(accessUnit []byte, pts time.Duration) error
+	WriteOpus(packet []byte, pts time.Duration) error
+	Close()
+	Done() <-chan struct{}
+}
+
+// PublishFunc starts an Ingest for streamKey, returning an error rejects the publisher
+type PublishFunc func(streamKey string) (Ingest, error)
+
+type listener struct {
+	packetConn net.PacketConn
+	publish    PublishFunc
+	cookieKey  []byte
+
+	connsLock sync.Mutex
+	conns     map[uint32]*conn
+
+	// Conns by the address and socket ID of the caller, to answer repeated conclusions
+	connsByPeer map[string]*conn
+}
+
+// ListenAndServe accepts SRT publishers on the UDP address addr until reading from it fails.
+// The stream ID is used as stream key.
+func ListenAndServe(addr string, publish PublishFunc) error {
+	packetConn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+
+	return Serve(packetConn, publish)
+}
+
+func Serve(packetConn net.PacketConn, publish PublishFunc) error {
+	l := &listener{
+		packetConn:  packetConn,
+		publish:     publish,
+		cookieKey:   make([]byte, 32),
+		conns:       map[uint32]*conn{},
+		connsByPeer: map[string]*conn{},
+	}
+
+	if _, err := rand.Read(l.cookieKey); err != nil {
+		return err
+	}
+
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, addr, err := packetConn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+
+		if n < headerSize {
+			continue
+		}
+		l.handlePacket(buf[:n], addr)
+	}
+}
+
+func (l *listener) handlePacket(pkt []byte, addr net.Addr) {
+	destinationSocketID := binary.BigEndian.Uint32(pkt[12:])
+	isControl := pkt[0]&0x80 != 0
+
+	if destinationSocketID == 0 {
+		if isControl && binary.BigEndian.Uint16(pkt[0:])&0x7FFF == controlTypeHandshake {
+			l.handleHandshake(pkt, addr)
+		}
+
+		return
+	}
+
+	l.connsLock.Lock()
+	c, ok := l.conns[destinationSocketID]
+	l.connsLock.Unlock()
+
+	if ok && c.peerAddr.String() == addr.String() {
+		c.handlePacket(pkt, isControl)
+	}
+}
+
+func (l *listener) cookie(addr net.Addr, minute int64) uint32 {
+	return synCookie(l.cookieKey, addr, minute)
+}
+
+func (l *listener) handleHandshake(pkt []byte, addr net.Addr) {
+	h, err := parseHandshake(pkt[headerSize:])
+	if err != nil {
+		return
+	}
+
+	minute := time.Now().Unix() / 60
+	response := &handshake{
+		version:         5,
+		initialSequence: h.initialSequence,
+		mtu:             h.mtu,
+		flowWindow:      flowWindow,
+		handshakeType:   h.handshakeType,
+		cookie:          l.cookie(addr, minute),
+		peerIP:          peerIPField(addr),
+	}
+	if response.mtu > maxPacketSize || response.mtu == 0 {
+		response.mtu = maxPacketSize
+	}
+
+	switch h.handshakeType {
+	case handshakeTypeInduction:
+		response.extensionField = handshakeMagic
+		l.writeControl(addr, h.socketID, controlTypeHandshake, 0, 0, response.marshal())
+		return
+	case handshakeTypeConclusion:
+	default:
+		return
+	}
+
+	if h.cookie != response.cookie && h.cookie != l.cookie(addr, minute-1) {
+		return
+	}
+	response.cookie = h.cookie
+
+	peerKey := addr.String() + "|" + strconv.FormatUint(uint64(h.socketID), 10)
+	l.connsLock.Lock()
+	existing, ok := l.connsByPeer[peerKey]
+	l.connsLock.Unlock()
+	if ok {
+		l.writeControl(addr, h.socketID, controlTypeHandshake, 0, 0, existing.conclusion)
+		return
+	}
+
+	reject := func(reason uint32, err error) {
+		logger.Warn("Rejected SRT publisher", "addr", addr, "err", err)
+		response.handshakeType = reason
+		l.writeControl(addr, h.socketID, controlTypeHandshake, 0, 0, response.marshal())
+	}
+
+	if h.version != 5 || h.extensionField&extensionFlagHSReq == 0 {
+		reject(rejectXBadRequest, errors.New("only SRT 1.3 and newer callers are supported"))
+		return
+	} else if h.encryption != 0 || h.hasKMReq {
+		reject(rejectUnsecure, errors.New("encryption is not supported"))
+		return
+	}
+
+	streamKey, err := parseStreamID(h.streamID)
+	if err != nil {
+		reject(rejectXBadRequest, err)
+		return
+	}
+
+	ingest, err := l.publish(streamKey)
+	if err != nil {
+		reject(rejectXForbidden, fmt.Errorf("publish of `%s` rejected: %w", streamKey, err))
+		return
+	}
+
+	latency := defaultLatency
+	if senderLatency := time.Duration(h.senderTSBPDDelay) * time.Millisecond; senderLatency > latency {
+		latency = senderLatency
+	}
+
+	c := &conn{
+		listener:     l,
+		ingest:       ingest,
+		streamKey:    streamKey,
+		peerAddr:     addr,
+		peerSocketID: h.socketID,
+		peerKey:      peerKey,
+		latency:      latency,
+		start:        time.Now(),
+		lastReceived: time.Now(),
+		expected:     h.initialSequence & sequenceMask,
+		pending:      map[uint32]pendingPacket{},
+		closed:       make(chan struct{}),
+	}
+	c.demuxer = mpegts.Demuxer{
+		OnH264: ingest.WriteH264,
+		OnOpus: ingest.WriteOpus,
+		OnUnsupportedStream: func(streamType uint8) {
+			logger.Warn("Ignoring stream type, only H264 and Opus are forwarded", "streamType", fmt.Sprintf("0x%02x", streamType), "streamKey", streamKey)
+		},
+	}
+
+	l.connsLock.Lock()
+	socketID := make([]byte, 4)
+	for {
+		if _, err = rand.Read(socketID); err != nil {
+			l.connsLock.Unlock()
+			ingest.Close()
+			return
+		}
+
+		if c.socketID = binary.BigEndian.Uint32(socketID) & sequenceMask; c.socketID != 0 && l.conns[c.socketID] == nil {
+			break
+		}
+	}
+	l.conns[c.socketID] = c
+	l.connsByPeer[peerKey] = c
+	l.connsLock.Unlock()
+
+	response.socketID = c.socketID
+	response.extensionField = extensionFlagHSReq
+	response.receiverTSBPDDelay = uint16(latency / time.Millisecond)
+	response.senderTSBPDDelay = h.receiverTSBPDDelay
+	c.conclusion = response.marshal()
+	l.writeControl(addr, h.socketID, controlTypeHandshake, 0, 0, c.conclusion)
+
+	logger.Info("SRT publisher started stream", "addr", addr, "streamKey", streamKey)
+	go c.run()
+}
+
+func controlPacket(destinationSocketID uint32, controlType uint16, typeSpecific, timestamp uint32, cif []byte) []byte {
+	pkt := make([]byte, headerSize, headerSize+len(cif))
+	binary.BigEndian.PutUint16(pkt[0:], 0x8000|controlType)
+	binary.BigEndian.PutUint32(pkt[4:], typeSpecific)
+	binary.BigEndian.PutUint32(pkt[8:], timestamp)
+	binary.BigEndian.PutUint32(pkt[12:], destinationSocketID)
+
+	return append(pkt, cif...)
+}
+
+func (l *listener) writeControl(addr net.Addr, destinationSocketID uint32, controlType uint16, typeSpecific, timestamp uint32, cif []byte) {
+	if _, err := l.packetConn.WriteTo(controlPacket(destinationSocketID, controlType, typeSpecific, timestamp, cif), addr); err != nil {
+		logger.Warn("Failed to write SRT control packet", "addr", addr, "err", err)
+	}
+}
+
+type pendingPacket struct {
+	payload  []byte
+	received time.Time
+}
+
+// conn receives the data of one publisher, delivering it in order and asking for
+// retransmissions of lost packets until they are older than latency
+type conn struct {
+	listener     *listener
+	ingest       Ingest
+	streamKey    string
+	demuxer      mpegts.Demuxer
+	socketID     uint32
+	peerAddr     net.Addr
+	peerSocketID uint32
+	peerKey      string
+	conclusion   []byte
+	latency      time.Duration
+	start        time.Time
+
+	lock         sync.Mutex
+	lastReceived time.Time
+	ackNumber    uint32
+	lastACKed    uint32
+
+	// Next sequence number to deliver, and received packets after it
+	expected uint32
+	pending  map[uint32]pendingPacket
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// sequenceDiff returns a - b for 31 bit sequence numbers
+func sequenceDiff(a, b uint32) int32 {
+	return int32((a-b)<<1) >> 1
+}
+
+func (c *conn) timestamp() uint32 {
+	return uint32(time.Since(c.start) / time.Microsecond)
+}
+
+func (c *conn) writeControl(controlType uint16, typeSpecific uint32, cif []byte) {
+	c.listener.writeControl(c.peerAddr, c.peerSocketID, controlType, typeSpecific, c.timestamp(), cif)
+}
+
+func (c *conn) run() {
+	ackTicker := time.NewTicker(ackInterval)
+	nakTicker := time.NewTicker(nakInterval)
+	keepaliveTicker := time.NewTicker(keepalivePeriod)
+	defer func() {
+		ackTicker.Stop()
+		nakTicker.Stop()
+		keepaliveTicker.Stop()
+	}()
+
+	for {
+		select {
+		case <-c.closed:
+			return
+		case <-c.ingest.Done():
+			c.writeControl(controlTypeShutdown, 0, make([]byte, 4))
+			c.close()
+		case <-ackTicker.C:
+			c.lock.Lock()
+			c.deliver()
+			c.sendACK()
+			idle := time.Since(c.lastReceived) > peerIdleTimeout
+			c.lock.Unlock()
+
+			if idle {
+				logger.Info("SRT publisher timed out", "addr", c.peerAddr, "streamKey", c.streamKey)
+				c.close()
+			}
+		case <-nakTicker.C:
+			c.lock.Lock()
+			c.sendNAK()
+			c.lock.Unlock()
+		case <-keepaliveTicker.C:
+			c.writeControl(controlTypeKeepalive, 0, make([]byte, 4))
+		}
+	}
+}
+
+func (c *conn) close() {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+
+		c.listener.connsLock.Lock()
+		delete(c.listener.conns, c.socketID)
+		delete(c.listener.connsByPeer, c.peerKey)
+		c.listener.connsLock.Unlock()
+
+		c.ingest.Close()
+	})
+}
+
+func (c *conn) handlePacket(pkt []byte, isControl bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.lastReceived = time.Now()
+
+	if isControl {
+		switch binary.BigEndian.Uint16(pkt[0:]) & 0x7FFF {
+		case controlTypeShutdown:
+			go c.close()
+		case controlTypeDropReq:
+			// The publisher gave up on retransmitting these, stop waiting for them
+			if len(pkt) >= headerSize+8 {
+				if last := binary.BigEndian.Uint32(pkt[headerSize+4:]) & sequenceMask; sequenceDiff(last, c.expected) >= 0 {
+					c.skipTo((last + 1) & sequenceMask)
+					c.deliver()
+				}
+			}
+		}
+
+		return
+	}
+
+	sequence := binary.BigEndian.Uint32(pkt[0:]) & sequenceMask
+	if sequenceDiff(sequence, c.expected) < 0 || sequenceDiff(sequence, c.expected) > flowWindow {
+		return
+	}
+
+	if _, ok := c.pending[sequence]; !ok {
+		c.pending[sequence] = pendingPacket{payload: append([]byte{}, pkt[headerSize:]...), received: time.Now()}
+	}
+	c.deliver()
+}
+
+// deliver sends packets in order to the demuxer, skipping lost ones once newer packets have waited latency
+func (c *conn) deliver() {
+	for len(c.pending) > 0 {
+		pkt, ok := c.pending[c.expected]
+		if !ok {
+			oldest := c.oldestPending()
+			if time.Since(c.pending[oldest].received) < c.latency {
+				return
+			}
+
+			c.skipTo(oldest)
+			continue
+		}
+
+		delete(c.pending, c.expected)
+		c.expected = (c.expected + 1) & sequenceMask
+
+		if err := c.demuxer.Write(pkt.payload); err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				logger.Warn("Failed to demux SRT stream", "streamKey", c.streamKey, "err", err)
+			}
+			go c.close()
+			return
+		}
+	}
+}
+
+func (c *conn) oldestPending() uint32 {
+	oldest, first := uint32(0), true
+	for sequence := range c.pending {
+		if first || sequenceDiff(sequence, oldest) < 0 {
+			oldest, first = sequence, false
+		}
+	}
+
+	return oldest
+}
+
+func (c *conn) skipTo(sequence uint32) {
+	for s := range c.pending {
+		if sequenceDiff(s, sequence) < 0 {
+			delete(c.pending, s)
+		}
+	}
+	c.expected = sequence
+}
+
+// sendACK acknowledges every packet before expected
+func (c *conn) sendACK() {
+	if c.expected == c.lastACKed {
+		return
+	}
+	c.lastACKed = c.expected
+	c.ackNumber++
+
+	cif := make([]byte, 28)
+	binary.BigEndian.PutUint32(cif[0:], c.expected)
+	binary.BigEndian.PutUint32(cif[4:], 100000) // RTT in microseconds, not measured
+	binary.BigEndian.PutUint32(cif[8:], 50000)
+	binary.BigEndian.PutUint32(cif[12:], uint32(flowWindow-len(c.pending)))
+	c.writeControl(controlTypeACK, c.ackNumber, cif)
+}
+
+// sendNAK reports every missing packet between expected and the newest received one
+func (c *conn) sendNAK() {
+	if len(c.pending) == 0 {
+		return
+	}
+
+	received := make([]uint32, 0, len(c.pending))
+	for sequence := range c.pending {
+		received = append(received, sequence)
+	}
+	sort.Slice(received, func(i, j int) bool { return sequenceDiff(received[i], received[j]) < 0 })
+
+	cif := []byte{}
+	losses := 0
+	next := c.expected
+	for _, sequence := range received {
+		if sequence != next && losses < maxNAKLosses {
+			last := (sequence - 1) & sequenceMask
+			if last == next {
+				cif = binary.BigEndian.AppendUint32(cif, next)
+			} else {
+				cif = binary.BigEndian.AppendUint32(cif, next|0x80000000)
+				cif = binary.BigEndian.AppendUint32(cif, last)
+			}
+			losses += int(sequenceDiff(sequence, next))
+		}
+		next = (sequence + 1) & sequenceMask
+	}
+
+	if len(cif) != 0 {
+		c.writeControl(controlTypeNAK, 0, cif)
+	}
+}
@@ -0,0 +1,338 @@
+package srt
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Handshakes of an srt-live-transmit 1.5 caller publishing to `#!::r=live,m=publish` with a
+// latency of 120ms
+const (
+	libsrtInduction = "00000004" + "00000002" + "3a8e3c4f" + "000005dc" + "00002000" + "00000001" + "1c2b3a4d" + "00000000" +
+		"0100007f000000000000000000000000"
+	libsrtConclusion = "00000005" + "00000005" + "3a8e3c4f" + "000005dc" + "00002000" + "ffffffff" + "1c2b3a4d" + "deadbeef" +
+		"0100007f000000000000000000000000" +
+		"0001" + "0003" + "00010501" + "000000bf" + "00780078" +
+		"0005" + "0005" + "3a3a2123696c3d726d2c65766275703d6873696c"
+	libsrtKMReq = "0003" + "0001" + "12202900"
+)
+
+func decodeHex(t testing.TB, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestParseHandshake(t *testing.T) {
+	induction, err := parseHandshake(decodeHex(t, libsrtInduction))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if induction.version != 4 || induction.handshakeType != handshakeTypeInduction || induction.socketID != 0x1c2b3a4d ||
+		induction.initialSequence != 0x3a8e3c4f || induction.mtu != 1500 || induction.flowWindow != 8192 || induction.streamID != "" {
+		t.Fatalf("parsed induction %+v", induction)
+	}
+
+	conclusion, err := parseHandshake(decodeHex(t, libsrtConclusion))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conclusion.version != 5 || conclusion.handshakeType != handshakeTypeConclusion || conclusion.extensionField&extensionFlagHSReq == 0 ||
+		conclusion.cookie != 0xdeadbeef || conclusion.receiverTSBPDDelay != 120 || conclusion.senderTSBPDDelay != 120 || conclusion.hasKMReq {
+		t.Fatalf("parsed conclusion %+v", conclusion)
+	}
+	if conclusion.streamID != "#!::r=live,m=publish" {
+		t.Fatalf("parsed stream ID %q", conclusion.streamID)
+	}
+
+	encrypted, err := parseHandshake(decodeHex(t, libsrtConclusion+libsrtKMReq))
+	if err != nil || !encrypted.hasKMReq {
+		t.Fatalf("parsed KMREQ %+v, %v", encrypted, err)
+	}
+
+	for name, invalid := range map[string]string{
+		"empty":               "",
+		"short":               libsrtInduction[:94],
+		"truncated extension": libsrtConclusion[:len(libsrtConclusion)-8],
+		"extension too long":  libsrtConclusion + "0005ffff",
+		"truncated KMREQ":     libsrtConclusion + "00030002" + "12202900",
+	} {
+		if _, err = parseHandshake(decodeHex(t, invalid)); err == nil {
+			t.Errorf("parsed %s handshake", name)
+		}
+	}
+
+	// Extensions too short for their content and trailing bytes are ignored
+	for name, valid := range map[string]string{
+		"short HSREQ":    libsrtInduction + "00010001" + "00010501",
+		"trailing bytes": libsrtConclusion + "0000",
+		"unknown":        libsrtInduction + "00070001" + "00000000",
+	} {
+		if _, err = parseHandshake(decodeHex(t, valid)); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
+
+func TestHandshakeRoundTrip(t *testing.T) {
+	for _, streamID := range []string{"live", "live1", "#!::r=live,m=publish", strings.Repeat("k", 512)} {
+		request := &handshake{
+			version:            5,
+			extensionField:     extensionFlagHSReq,
+			initialSequence:    42,
+			mtu:                1500,
+			flowWindow:         flowWindow,
+			handshakeType:      handshakeTypeConclusion,
+			socketID:           7,
+			cookie:             9,
+			streamID:           streamID,
+			receiverTSBPDDelay: 200,
+			senderTSBPDDelay:   300,
+			caller:             true,
+		}
+
+		parsed, err := parseHandshake(request.marshal())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		parsed.caller = true
+		if *parsed != *request {
+			t.Fatalf("parsed %+v instead of %+v", parsed, request)
+		}
+	}
+}
+
+func TestParseStreamID(t *testing.T) {
+	for streamID, streamKey := range map[string]string{
+		"live":                     "live",
+		"":                         "",
+		"#!::r=live,m=publish":     "live",
+		"#!::m=publish,r=live":     "live",
+		"#!::r=live":               "live",
+		"#!::u=user,r=live,s=1234": "live",
+		"#!::r=a=b":                "a=b",
+		"#!:r=live":                "#!:r=live",
+		"#!::":                     "",
+	} {
+		if got, err := parseStreamID(streamID); err != nil || got != streamKey {
+			t.Errorf("%q has the stream key %q, %v instead of %q", streamID, got, err, streamKey)
+		}
+	}
+
+	for _, streamID := range []string{"#!::r=live,m=request", "#!::m=bidirectional,r=live"} {
+		if _, err := parseStreamID(streamID); err == nil {
+			t.Errorf("%q was accepted", streamID)
+		}
+	}
+}
+
+func TestPeerIPField(t *testing.T) {
+	field := peerIPField(&net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 9000})
+	if hex.EncodeToString(field[:]) != "0100007f000000000000000000000000" {
+		t.Fatalf("encoded IPv4 as %x", field)
+	}
+
+	field = peerIPField(&net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 9000})
+	if hex.EncodeToString(field[:]) != "20010db8000000000000000000000001" {
+		t.Fatalf("encoded IPv6 as %x", field)
+	}
+}
+
+func TestSequenceDiff(t *testing.T) {
+	for _, c := range []struct {
+		a, b uint32
+		diff int32
+	}{
+		{5, 3, 2},
+		{3, 5, -2},
+		{0, sequenceMask, 1},
+		{sequenceMask, 0, -1},
+		{1 << 30, 0, -(1 << 30)},
+		{(1 << 30) - 1, 0, (1 << 30) - 1},
+	} {
+		if diff := sequenceDiff(c.a, c.b); diff != c.diff {
+			t.Errorf("%d - %d is %d instead of %d", c.a, c.b, diff, c.diff)
+		}
+	}
+}
+
+type testIngest struct {
+	accessUnits int
+	done        chan struct{}
+}
+
+func (i *testIngest) WriteH264([]byte, time.Duration) error {
+	i.accessUnits++
+	return nil
+}
+
+func (i *testIngest) WriteOpus([]byte, time.Duration) error { return nil }
+func (i *testIngest) Close()                                {}
+func (i *testIngest) Done() <-chan struct{}                 { return i.done }
+
+func newTestListener(t testing.TB) *listener {
+	packetConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = packetConn.Close() })
+
+	return &listener{
+		packetConn:  packetConn,
+		publish:     func(string) (Ingest, error) { return nil, errors.New("rejected") },
+		cookieKey:   make([]byte, 32),
+		conns:       map[uint32]*conn{},
+		connsByPeer: map[string]*conn{},
+	}
+}
+
+func newTestConn(l *listener) *conn {
+	ingest := &testIngest{done: make(chan struct{})}
+	c := &conn{
+		listener:     l,
+		ingest:       ingest,
+		peerAddr:     &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9},
+		latency:      time.Hour,
+		start:        time.Now(),
+		lastReceived: time.Now(),
+		expected:     sequenceMask,
+		pending:      map[uint32]pendingPacket{},
+		closed:       make(chan struct{}),
+	}
+	c.demuxer.OnH264 = ingest.WriteH264
+	return c
+}
+
+func dataPacket(sequence uint32, payload []byte) []byte {
+	pkt := make([]byte, headerSize, headerSize+len(payload))
+	binary.BigEndian.PutUint32(pkt[0:], sequence&sequenceMask)
+	binary.BigEndian.PutUint32(pkt[4:], messageSolo)
+	return append(pkt, payload...)
+}
+
+func TestConnReorders(t *testing.T) {
+	c := newTestConn(newTestListener(t))
+
+	// Sequence numbers wrap around
+	packets := [][]byte{dataPacket(sequenceMask, []byte{1}), dataPacket(0, []byte{2}), dataPacket(1, []byte{3})}
+	for _, i := range []int{2, 0, 0, 1} {
+		c.handlePacket(packets[i], false)
+	}
+	if c.expected != 2 || len(c.pending) != 0 {
+		t.Fatalf("expecting %d with %d pending", c.expected, len(c.pending))
+	}
+
+	// Old and far away packets are dropped
+	c.handlePacket(dataPacket(0, nil), false)
+	c.handlePacket(dataPacket(2+flowWindow+1, nil), false)
+	if len(c.pending) != 0 {
+		t.Fatalf("%d packets pending", len(c.pending))
+	}
+
+	// Until the publisher drops them, missing packets are waited for and reported
+	c.handlePacket(dataPacket(5, nil), false)
+	if c.expected != 2 || len(c.pending) != 1 {
+		t.Fatalf("expecting %d with %d pending", c.expected, len(c.pending))
+	}
+
+	dropReq := controlPacket(0, controlTypeDropReq, 0, 0, binary.BigEndian.AppendUint32(binary.BigEndian.AppendUint32(nil, 2), 4))
+	c.handlePacket(dropReq, true)
+	if c.expected != 6 || len(c.pending) != 0 {
+		t.Fatalf("expecting %d with %d pending after DROPREQ", c.expected, len(c.pending))
+	}
+
+	// Truncated DROPREQs are ignored
+	c.handlePacket(controlPacket(0, controlTypeDropReq, 0, 0, []byte{0, 0, 0, 9}), true)
+	if c.expected != 6 {
+		t.Fatalf("expecting %d after a truncated DROPREQ", c.expected)
+	}
+}
+
+func FuzzParseHandshake(f *testing.F) {
+	f.Add(decodeHex(f, libsrtInduction))
+	f.Add(decodeHex(f, libsrtConclusion))
+	f.Add(decodeHex(f, libsrtConclusion+libsrtKMReq))
+
+	f.Fuzz(func(t *testing.T, cif []byte) {
+		h, err := parseHandshake(cif)
+		if err != nil {
+			return
+		}
+
+		// What a caller sends is parsed the same again
+		h.caller = true
+		h.streamID = strings.TrimRight(h.streamID, "\x00")
+		parsed, err := parseHandshake(h.marshal())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parsed.streamID != h.streamID && h.handshakeType == handshakeTypeConclusion {
+			t.Fatalf("stream ID %q was parsed as %q", h.streamID, parsed.streamID)
+		}
+	})
+}
+
+// FuzzListener sends packets from one address, which are handshakes to the listener and data
+// and control packets of a publisher after it
+func FuzzListener(f *testing.F) {
+	f.Add(append(controlPacket(0, controlTypeHandshake, 0, 0, nil), decodeHex(f, libsrtInduction)...))
+	f.Add(append(controlPacket(0, controlTypeHandshake, 0, 0, nil), decodeHex(f, libsrtConclusion)...))
+	f.Add(controlPacket(1, controlTypeDropReq, 0, 0, []byte{0, 0, 0, 1, 0, 0, 0, 5}))
+	f.Add(controlPacket(1, controlTypeShutdown, 0, 0, nil))
+	f.Add(dataPacket(sequenceMask, []byte{0x47, 0x40, 0x00, 0x10}))
+
+	f.Fuzz(func(t *testing.T, pkt []byte) {
+		if len(pkt) < headerSize {
+			return
+		}
+
+		l := newTestListener(t)
+		c := newTestConn(l)
+		c.socketID = 1
+		l.conns[c.socketID] = c
+
+		l.handlePacket(pkt, c.peerAddr)
+		if c.expected > sequenceMask {
+			t.Fatalf("expecting %d", c.expected)
+		}
+	})
+}
+
+// FuzzSender sends the ACKs and NAKs of a receiver to a sender of three packets
+func FuzzSender(f *testing.F) {
+	f.Add(controlPacket(1, controlTypeACK, 1, 0, binary.BigEndian.AppendUint32(nil, 1)))
+	f.Add(controlPacket(1, controlTypeACK, 1, 0, make([]byte, 28)))
+	f.Add(controlPacket(1, controlTypeNAK, 0, 0, []byte{0x80, 0, 0, 0, 0, 0, 0, 2}))
+	f.Add(controlPacket(1, controlTypeNAK, 0, 0, []byte{0x80, 0, 0, 0}))
+	f.Add(controlPacket(1, controlTypeShutdown, 0, 0, nil))
+
+	f.Fuzz(func(t *testing.T, pkt []byte) {
+		if len(pkt) < headerSize {
+			return
+		}
+
+		packetConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer packetConn.Close()
+
+		s := newSender(packetConn, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9}, 1, 2, 0, time.Hour)
+		for i := 0; i < 3; i++ {
+			s.write([]byte{byte(i)})
+		}
+
+		s.handlePacket(pkt)
+		if len(s.sent) > 3 {
+			t.Fatalf("%d packets are kept", len(s.sent))
+		}
+	})
+}
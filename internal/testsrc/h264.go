@@ -0,0 +1,275 @@
+package testsrc
+
+import (
+	"bytes"
+)
+
+const (
+	naluTypeSlice    = 1
+	naluTypeSliceIDR = 5
+	naluTypeSPS      = 7
+	naluTypePPS      = 8
+
+	sliceTypeP = 5
+	sliceTypeI = 7
+
+	mbTypeIPCM = 25
+
+	// I macroblock types follow the 5 P macroblock types in P slices
+	mbTypeIPCMInPSlice = 5 + mbTypeIPCM
+
+	// frame_num is coded in 4 bits
+	maxFrameNum = 16
+)
+
+// encoder writes pictures as H264 Baseline made of I_PCM macroblocks. P frames code the
+// macroblocks that changed, the others are skipped and keep the samples of the previous frame.
+type encoder struct {
+	widthInMBs, heightInMBs int
+	cropBottom              int
+
+	sps, pps []byte
+
+	frameNum int
+	idrPicID int
+}
+
+func newEncoder(width, height int) *encoder {
+	e := &encoder{widthInMBs: (width + 15) / 16, heightInMBs: (height + 15) / 16}
+	e.cropBottom = e.heightInMBs*16 - height
+
+	e.sps = e.writeSPS()
+	e.pps = writePPS()
+	return e
+}
+
+func (e *encoder) writeSPS() []byte {
+	w := &bitWriter{}
+	w.writeBits(66, 8)   // profile_idc, Baseline
+	w.writeBits(0xC0, 8) // constraint_set0_flag and constraint_set1_flag
+	w.writeBits(30, 8)   // level_idc, 3.0
+	w.writeUE(0)         // seq_parameter_set_id
+	w.writeUE(0)         // log2_max_frame_num_minus4
+	w.writeUE(2)         // pic_order_cnt_type, output order is decoding order
+	w.writeUE(1)         // max_num_ref_frames
+	w.writeBits(0, 1)    // gaps_in_frame_num_value_allowed_flag
+	w.writeUE(e.widthInMBs - 1)
+	w.writeUE(e.heightInMBs - 1)
+	w.writeBits(1, 1) // frame_mbs_only_flag
+	w.writeBits(1, 1) // direct_8x8_inference_flag
+	if e.cropBottom != 0 {
+		w.writeBits(1, 1) // frame_cropping_flag
+		w.writeUE(0)
+		w.writeUE(0)
+		w.writeUE(0)
+		w.writeUE(e.cropBottom / 2) // in units of two lines for 4:2:0
+	} else {
+		w.writeBits(0, 1)
+	}
+	w.writeBits(0, 1) // vui_parameters_present_flag
+
+	return nalu(naluTypeSPS, 3, w.trailingBits())
+}
+
+func writePPS() []byte {
+	w := &bitWriter{}
+	w.writeUE(0)      // pic_parameter_set_id
+	w.writeUE(0)      // seq_parameter_set_id
+	w.writeBits(0, 1) // entropy_coding_mode_flag, CAVLC
+	w.writeBits(0, 1) // bottom_field_pic_order_in_frame_present_flag
+	w.writeUE(0)      // num_slice_groups_minus1
+	w.writeUE(0)      // num_ref_idx_l0_default_active_minus1
+	w.writeUE(0)      // num_ref_idx_l1_default_active_minus1
+	w.writeBits(0, 1) // weighted_pred_flag
+	w.writeBits(0, 2) // weighted_bipred_idc
+	w.writeSE(0)      // pic_init_qp_minus26
+	w.writeSE(0)      // pic_init_qs_minus26
+	w.writeSE(0)      // chroma_qp_index_offset
+	w.writeBits(1, 1) // deblocking_filter_control_present_flag
+	w.writeBits(0, 1) // constrained_intra_pred_flag
+	w.writeBits(0, 1) // redundant_pic_cnt_present_flag
+
+	return nalu(naluTypePPS, 3, w.trailingBits())
+}
+
+// keyframe returns an access unit in Annex B format with the parameter sets and an IDR of p
+func (e *encoder) keyframe(p *picture) []byte {
+	e.frameNum = 0
+	e.idrPicID = (e.idrPicID + 1) % 2
+
+	w := &bitWriter{}
+	w.writeUE(0) // first_mb_in_slice
+	w.writeUE(sliceTypeI)
+	w.writeUE(0) // pic_parameter_set_id
+	w.writeBits(0, 4)
+	w.writeUE(e.idrPicID)
+	w.writeBits(0, 1) // no_output_of_prior_pics_flag
+	w.writeBits(0, 1) // long_term_reference_flag
+	w.writeSE(0)      // slice_qp_delta
+	w.writeUE(1)      // disable_deblocking_filter_idc
+
+	for mb := 0; mb < e.widthInMBs*e.heightInMBs; mb++ {
+		w.writeUE(mbTypeIPCM)
+		e.writePCM(w, p, mb)
+	}
+
+	var accessUnit []byte
+	accessUnit = append(accessUnit, e.sps...)
+	accessUnit = append(accessUnit, e.pps...)
+	return append(accessUnit, nalu(naluTypeSliceIDR, 3, w.trailingBits())...)
+}
+
+// frame returns an access unit in Annex B format with a P frame of the changes from previous to p
+func (e *encoder) frame(p, previous *picture) []byte {
+	e.frameNum = (e.frameNum + 1) % maxFrameNum
+
+	w := &bitWriter{}
+	w.writeUE(0) // first_mb_in_slice
+	w.writeUE(sliceTypeP)
+	w.writeUE(0) // pic_parameter_set_id
+	w.writeBits(uint64(e.frameNum), 4)
+	w.writeBits(0, 1) // num_ref_idx_active_override_flag
+	w.writeBits(0, 1) // ref_pic_list_modification_flag_l0
+	w.writeBits(0, 1) // adaptive_ref_pic_marking_mode_flag
+	w.writeSE(0)      // slice_qp_delta
+	w.writeUE(1)      // disable_deblocking_filter_idc
+
+	// Skipped macroblocks are predicted from the same place in the previous frame, as the
+	// motion vectors of their neighbors are all zero
+	skipRun := 0
+	for mb := 0; mb < e.widthInMBs*e.heightInMBs; mb++ {
+		if !e.changed(p, previous, mb) {
+			skipRun++
+			continue
+		}
+
+		w.writeUE(skipRun)
+		skipRun = 0
+		w.writeUE(mbTypeIPCMInPSlice)
+		e.writePCM(w, p, mb)
+	}
+	if skipRun != 0 {
+		w.writeUE(skipRun)
+	}
+
+	return nalu(naluTypeSlice, 2, w.trailingBits())
+}
+
+// writePCM writes the samples of macroblock mb of p, the luma block followed by both chroma blocks
+func (e *encoder) writePCM(w *bitWriter, p *picture, mb int) {
+	w.align()
+
+	x, y := mb%e.widthInMBs*16, mb/e.widthInMBs*16
+	for row := 0; row < 16; row++ {
+		w.writeBytes(p.y[(y+row)*p.width+x : (y+row)*p.width+x+16])
+	}
+
+	for _, plane := range [][]byte{p.cb, p.cr} {
+		for row := 0; row < 8; row++ {
+			offset := (y/2+row)*p.width/2 + x/2
+			w.writeBytes(plane[offset : offset+8])
+		}
+	}
+}
+
+// changed returns if macroblock mb differs between p and previous
+func (e *encoder) changed(p, previous *picture, mb int) bool {
+	x, y := mb%e.widthInMBs*16, mb/e.widthInMBs*16
+	for row := 0; row < 16; row++ {
+		offset := (y+row)*p.width + x
+		if !bytes.Equal(p.y[offset:offset+16], previous.y[offset:offset+16]) {
+			return true
+		}
+	}
+
+	for row := 0; row < 8; row++ {
+		offset := (y/2+row)*p.width/2 + x/2
+		if !bytes.Equal(p.cb[offset:offset+8], previous.cb[offset:offset+8]) ||
+			!bytes.Equal(p.cr[offset:offset+8], previous.cr[offset:offset+8]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// nalu returns rbsp as a NAL unit with a start code and emulation prevention bytes
+func nalu(naluType, refIdc byte, rbsp []byte) []byte {
+	out := []byte{0, 0, 0, 1, refIdc<<5 | naluType}
+
+	zeros := 0
+	for _, b := range rbsp {
+		if zeros == 2 && b <= 3 {
+			out = append(out, 3)
+			zeros = 0
+		}
+
+		out = append(out, b)
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+
+	return out
+}
+
+// bitWriter writes the fields of an RBSP, most significant bit first
+type bitWriter struct {
+	buf   []byte
+	cur   byte
+	nbits int
+}
+
+func (w *bitWriter) writeBits(v uint64, n int) {
+	for i := n - 1; i >= 0; i-- {
+		w.cur = w.cur<<1 | byte(v>>i&1)
+		w.nbits++
+		if w.nbits == 8 {
+			w.buf = append(w.buf, w.cur)
+			w.cur, w.nbits = 0, 0
+		}
+	}
+}
+
+// writeUE writes v as an unsigned Exp-Golomb code
+func (w *bitWriter) writeUE(v int) {
+	value := uint64(v) + 1
+
+	length := 0
+	for value>>length > 1 {
+		length++
+	}
+
+	w.writeBits(0, length)
+	w.writeBits(value, length+1)
+}
+
+// writeSE writes v as a signed Exp-Golomb code
+func (w *bitWriter) writeSE(v int) {
+	if v > 0 {
+		w.writeUE(2*v - 1)
+	} else {
+		w.writeUE(-2 * v)
+	}
+}
+
+// align pads with zero bits to the next byte
+func (w *bitWriter) align() {
+	if w.nbits != 0 {
+		w.writeBits(0, 8-w.nbits)
+	}
+}
+
+// writeBytes writes b, the writer must be byte aligned
+func (w *bitWriter) writeBytes(b []byte) {
+	w.buf = append(w.buf, b...)
+}
+
+// trailingBits returns the RBSP with its stop bit and alignment
+func (w *bitWriter) trailingBits() []byte {
+	w.writeBits(1, 1)
+	w.align()
+	return w.buf
+}
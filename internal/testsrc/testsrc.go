@@ -0,0 +1,154 @@
+// Package testsrc publishes a generated test pattern, color bars with a moving box and silent
+// audio, so players and load tests can be run without an encoder.
+//
+// Video is H264 made of I_PCM macroblocks, which hold raw samples and need no encoder. Only
+// the macroblocks that changed since the previous frame are sent, with a keyframe every second.
+package testsrc
+
+import (
+	"time"
+)
+
+const (
+	width     = 320
+	height    = 180
+	frameRate = 30
+
+	// A keyframe is sent every second, as an Ingest can't ask for one
+	keyframeInterval = frameRate
+
+	boxSize = 16
+	boxTop  = 144
+
+	opusFrameDuration = 20 * time.Millisecond
+)
+
+// Opus packet of 20ms of silence in CELT fullband mono
+var opusSilence = []byte{0xF8, 0xFF, 0xFE}
+
+// Ingest receives the test pattern
+type Ingest interface {
+	WriteH264(accessUnit []byte, pts time.Duration) error
+	WriteOpus(packet []byte, pts time.Duration) error
+	Close()
+	Done() <-chan struct{}
+}
+
+// PublishFunc starts the Ingest the test pattern is written to
+type PublishFunc func() (Ingest, error)
+
+// Play writes the test pattern to the Ingest of publish in real time, until it is closed
+func Play(publish PublishFunc) error {
+	ingest, err := publish()
+	if err != nil {
+		return err
+	}
+	defer ingest.Close()
+
+	encoder := newEncoder(width, height)
+	current, previous := newPicture(encoder), newPicture(encoder)
+
+	start := time.Now()
+	for frame, audio := 0, 0; ; {
+		videoPTS := time.Duration(frame) * time.Second / frameRate
+		audioPTS := time.Duration(audio) * opusFrameDuration
+
+		pts := videoPTS
+		if audioPTS < videoPTS {
+			pts = audioPTS
+		}
+
+		select {
+		case <-ingest.Done():
+			return nil
+		case <-time.After(time.Until(start.Add(pts))):
+		}
+
+		if audioPTS < videoPTS {
+			if err = ingest.WriteOpus(opusSilence, audioPTS); err != nil {
+				return err
+			}
+			audio++
+			continue
+		}
+
+		current.draw(frame)
+
+		var accessUnit []byte
+		if frame%keyframeInterval == 0 {
+			accessUnit = encoder.keyframe(current)
+		} else {
+			accessUnit = encoder.frame(current, previous)
+		}
+
+		if err = ingest.WriteH264(accessUnit, videoPTS); err != nil {
+			return err
+		}
+
+		current, previous = previous, current
+		frame++
+	}
+}
+
+// picture is one 4:2:0 frame, padded to whole macroblocks
+type picture struct {
+	width  int
+	y      []byte
+	cb, cr []byte
+}
+
+func newPicture(e *encoder) *picture {
+	w, h := e.widthInMBs*16, e.heightInMBs*16
+	return &picture{width: w, y: make([]byte, w*h), cb: make([]byte, w*h/4), cr: make([]byte, w*h/4)}
+}
+
+// Color bars at 75%, like SMPTE bars
+var bars = [][3]float64{
+	{0.75, 0.75, 0.75},
+	{0.75, 0.75, 0},
+	{0, 0.75, 0.75},
+	{0, 0.75, 0},
+	{0.75, 0, 0.75},
+	{0.75, 0, 0},
+	{0, 0, 0.75},
+}
+
+// draw renders the bars and the box at its position in frame
+func (p *picture) draw(frame int) {
+	// The box bounces between both edges
+	travel := width - boxSize
+	boxLeft := frame * 4 % (2 * travel)
+	if boxLeft > travel {
+		boxLeft = 2*travel - boxLeft
+	}
+
+	rows := len(p.y) / p.width
+	for y := 0; y < rows; y++ {
+		for x := 0; x < p.width; x++ {
+			var rgb [3]float64
+			switch {
+			case y < boxTop:
+				rgb = bars[x*len(bars)/width%len(bars)]
+			case y < boxTop+boxSize && x >= boxLeft && x < boxLeft+boxSize:
+				rgb = [3]float64{1, 1, 1}
+			default:
+				rgb = [3]float64{0.1, 0.1, 0.1}
+			}
+
+			luma, cb, cr := yCbCr(rgb)
+			p.y[y*p.width+x] = luma
+			if x%2 == 0 && y%2 == 0 {
+				p.cb[y/2*p.width/2+x/2] = cb
+				p.cr[y/2*p.width/2+x/2] = cr
+			}
+		}
+	}
+}
+
+// yCbCr converts RGB in 0-1 to limited range BT.601
+func yCbCr(rgb [3]float64) (y, cb, cr byte) {
+	r, g, b := rgb[0], rgb[1], rgb[2]
+	return byte(16 + 65.481*r + 128.553*g + 24.966*b + 0.5),
+		byte(128 - 37.797*r - 74.203*g + 112*b + 0.5),
+		byte(128 + 112*r - 93.786*g - 18.214*b + 0.5)
+}
@@ -0,0 +1,207 @@
+// Package tracing exports spans to an OpenTelemetry collector with OTLP over HTTP, encoded as
+// JSON. It is configured with the standard OTEL_EXPORTER_OTLP_* variables and does nothing
+// without them, spans are then nil and their methods no-ops.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/glimesh/broadcast-box/internal/logging"
+)
+
+var logger = logging.Logger("tracing")
+
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+
+	statusCodeError = 2
+
+	// Ended spans that wait to be exported, more are dropped
+	queueSize = 2048
+
+	// Spans are exported once this many ended, or this long after the first of them
+	batchSize     = 512
+	batchInterval = 5 * time.Second
+
+	exportTimeout = 10 * time.Second
+)
+
+type (
+	// Span is an operation of a trace, from Start until End
+	Span struct {
+		traceID      [16]byte
+		spanID       [8]byte
+		parentSpanID [8]byte
+		name         string
+		kind         int
+		start        time.Time
+
+		lock       sync.Mutex
+		attributes map[string]string
+		err        error
+		ended      bool
+	}
+
+	contextKey struct{}
+)
+
+var (
+	exporter *otlpExporter
+	dropped  atomic.Uint64
+)
+
+// Configure starts exporting spans to OTEL_EXPORTER_OTLP_TRACES_ENDPOINT, or to `/v1/traces`
+// of OTEL_EXPORTER_OTLP_ENDPOINT
+func Configure() error {
+	endpoint := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	if base := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); endpoint == "" && base != "" {
+		endpoint = strings.TrimSuffix(base, "/") + "/v1/traces"
+	}
+	if endpoint == "" {
+		return nil
+	}
+
+	if u, err := url.Parse(endpoint); err != nil {
+		return err
+	} else if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("OTLP endpoint %q must be an http or https URL", endpoint)
+	}
+
+	headers, err := parseHeaders(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"))
+	if err != nil {
+		return err
+	}
+
+	serviceName := os.Getenv("OTEL_SERVICE_NAME")
+	if serviceName == "" {
+		serviceName = "broadcast-box"
+	}
+
+	exporter = newOTLPExporter(endpoint, headers, serviceName)
+	go exporter.run()
+	return nil
+}
+
+// parseHeaders parses `key1=value1,key2=value2` with URL encoded values
+func parseHeaders(raw string) (http.Header, error) {
+	headers := http.Header{}
+	for _, pair := range strings.Split(raw, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("OTEL_EXPORTER_OTLP_HEADERS: %q is not key=value", pair)
+		}
+
+		value, err := url.QueryUnescape(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("OTEL_EXPORTER_OTLP_HEADERS: %w", err)
+		}
+		headers.Add(strings.TrimSpace(key), value)
+	}
+
+	return headers, nil
+}
+
+// Start starts a span that is a child of the span in ctx, or of a new trace
+func Start(ctx context.Context, name string) (context.Context, *Span) {
+	if exporter == nil {
+		return ctx, nil
+	}
+
+	span := newSpan(name, spanKindInternal)
+	if parent, ok := ctx.Value(contextKey{}).(*Span); ok && parent != nil {
+		span.traceID, span.parentSpanID = parent.traceID, parent.spanID
+	}
+
+	return context.WithValue(ctx, contextKey{}, span), span
+}
+
+// StartServer starts a span for the HTTP request req, in the trace of its `traceparent` header
+// if it has a valid one
+func StartServer(req *http.Request, name string) (context.Context, *Span) {
+	if exporter == nil {
+		return req.Context(), nil
+	}
+
+	span := newSpan(name, spanKindServer)
+	if traceID, parentSpanID, ok := parseTraceparent(req.Header.Get("traceparent")); ok {
+		span.traceID, span.parentSpanID = traceID, parentSpanID
+	}
+	span.SetAttribute("http.request.method", req.Method)
+	span.SetAttribute("url.path", req.URL.Path)
+
+	return context.WithValue(req.Context(), contextKey{}, span), span
+}
+
+func newSpan(name string, kind int) *Span {
+	span := &Span{name: name, kind: kind, start: time.Now(), attributes: map[string]string{}}
+	_, _ = rand.Read(span.traceID[:])
+	_, _ = rand.Read(span.spanID[:])
+
+	return span
+}
+
+// parseTraceparent parses a W3C Trace Context header, `00-<trace ID>-<parent ID>-<flags>`
+func parseTraceparent(header string) (traceID [16]byte, parentSpanID [8]byte, ok bool) {
+	parts := strings.Split(header, "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return traceID, parentSpanID, false
+	}
+
+	if _, err := hex.Decode(traceID[:], []byte(parts[1])); err != nil || traceID == [16]byte{} {
+		return traceID, parentSpanID, false
+	} else if _, err := hex.Decode(parentSpanID[:], []byte(parts[2])); err != nil || parentSpanID == [8]byte{} {
+		return traceID, parentSpanID, false
+	}
+
+	return traceID, parentSpanID, true
+}
+
+func (s *Span) SetAttribute(key, value string) {
+	if s == nil {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.attributes[key] = value
+}
+
+// End ends the span and queues it for export, with err as its error status if it is set. Only
+// the first call has an effect.
+func (s *Span) End(err error) {
+	if s == nil {
+		return
+	}
+
+	s.lock.Lock()
+	if s.ended {
+		s.lock.Unlock()
+		return
+	}
+	s.ended, s.err = true, err
+	span := otlpSpanFromSpan(s, time.Now())
+	s.lock.Unlock()
+
+	select {
+	case exporter.spans <- span:
+	default:
+		if count := dropped.Add(1); count%100 == 1 {
+			logger.Warn("OTLP exporter is falling behind, spans dropped", "dropped", count)
+		}
+	}
+}
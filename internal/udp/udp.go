@@ -0,0 +1,156 @@
+// Package udp accepts MPEG-TS sent over unicast or multicast UDP, like by hardware encoders,
+// and forwards its H264 and Opus to an Ingest, so the stream can be watched over WHEP.
+package udp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/glimesh/broadcast-box/internal/logging"
+	"github.com/glimesh/broadcast-box/internal/mpegts"
+)
+
+var logger = logging.Logger("udp")
+
+const (
+	maxPacketSize   = 65535
+	peerIdleTimeout = 5 * time.Second
+	publishRetry    = 5 * time.Second
+
+	rtpHeaderSize = 12
+	tsSyncByte    = 0x47
+)
+
+// Ingest receives the media of one publisher
+type Ingest interface {
+	WriteH264(accessUnit []byte, pts time.Duration) error
+	WriteOpus(packet []byte, pts time.Duration) error
+	Close()
+	Done() <-chan struct{}
+}
+
+// PublishFunc starts an Ingest for streamKey, returning an error drops the received media
+type PublishFunc func(streamKey string) (Ingest, error)
+
+// ListenAndServe publishes the MPEG-TS received on the UDP address addr under streamKey until
+// reading from it fails. Multicast addresses are joined on the default interface.
+func ListenAndServe(addr, streamKey string, publish PublishFunc) error {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return err
+	}
+
+	var conn *net.UDPConn
+	if udpAddr.IP != nil && udpAddr.IP.IsMulticast() {
+		conn, err = net.ListenMulticastUDP("udp", nil, udpAddr)
+	} else {
+		conn, err = net.ListenUDP("udp", udpAddr)
+	}
+	if err != nil {
+		return err
+	}
+
+	return Serve(conn, streamKey, publish)
+}
+
+// Serve publishes once the first datagram arrives and stops when none arrived for a while,
+// so the encoder can be restarted without restarting Broadcast Box
+func Serve(packetConn net.PacketConn, streamKey string, publish PublishFunc) error {
+	var (
+		ingest     Ingest
+		demuxer    mpegts.Demuxer
+		retryAfter time.Time
+	)
+
+	stop := func() {
+		ingest.Close()
+		ingest = nil
+		retryAfter = time.Now().Add(publishRetry)
+	}
+
+	buf := make([]byte, maxPacketSize)
+	for {
+		if err := packetConn.SetReadDeadline(time.Now().Add(peerIdleTimeout)); err != nil {
+			return err
+		}
+
+		n, addr, err := packetConn.ReadFrom(buf)
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			if ingest != nil {
+				logger.Info("UDP publisher timed out", "streamKey", streamKey)
+				stop()
+			}
+			continue
+		} else if err != nil {
+			if ingest != nil {
+				ingest.Close()
+			}
+			return err
+		}
+
+		if ingest != nil {
+			select {
+			case <-ingest.Done():
+				stop()
+			default:
+			}
+		}
+
+		if ingest == nil {
+			if time.Now().Before(retryAfter) {
+				continue
+			}
+
+			if ingest, err = publish(streamKey); err != nil {
+				logger.Warn("Rejected UDP publisher", "addr", addr, "streamKey", streamKey, "err", err)
+				retryAfter = time.Now().Add(publishRetry)
+				continue
+			}
+
+			logger.Info("UDP publisher started stream", "addr", addr, "streamKey", streamKey)
+			demuxer = mpegts.Demuxer{
+				OnH264: ingest.WriteH264,
+				OnOpus: ingest.WriteOpus,
+				OnUnsupportedStream: func(streamType uint8) {
+					logger.Warn("Ignoring stream type, only H264 and Opus are forwarded", "streamType", fmt.Sprintf("0x%02x", streamType), "streamKey", streamKey)
+				},
+			}
+		}
+
+		if err = demuxer.Write(stripRTP(buf[:n])); err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				logger.Warn("Failed to demux UDP stream", "streamKey", streamKey, "err", err)
+			}
+			stop()
+		}
+	}
+}
+
+// stripRTP returns the MPEG-TS of datagrams sent as RTP (RFC 2250), others are returned as is
+func stripRTP(datagram []byte) []byte {
+	if len(datagram) < rtpHeaderSize || datagram[0] == tsSyncByte || datagram[0]>>6 != 2 {
+		return datagram
+	}
+
+	payloadOffset := rtpHeaderSize + int(datagram[0]&0x0F)*4
+	if datagram[0]&0x10 != 0 {
+		if payloadOffset+4 > len(datagram) {
+			return nil
+		}
+		payloadOffset += 4 + (int(datagram[payloadOffset+2])<<8|int(datagram[payloadOffset+3]))*4
+	}
+
+	payloadEnd := len(datagram)
+	if datagram[0]&0x20 != 0 {
+		payloadEnd -= int(datagram[len(datagram)-1])
+	}
+
+	if payloadOffset > payloadEnd {
+		return nil
+	}
+
+	return datagram[payloadOffset:payloadEnd]
+}
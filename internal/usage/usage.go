@@ -0,0 +1,112 @@
+// Package usage keeps the bytes received and sent and the publish time of every stream key in a
+// SQLite database, added up by day in UTC, for billing and capacity planning.
+package usage
+
+import (
+	"database/sql"
+	"time"
+
+	_ "modernc.org/sqlite" // Registers the `sqlite` driver
+)
+
+const schema = `CREATE TABLE IF NOT EXISTS usage (
+	stream_key      TEXT NOT NULL,
+	date            TEXT NOT NULL,
+	bytes_in        INTEGER NOT NULL DEFAULT 0,
+	bytes_out       INTEGER NOT NULL DEFAULT 0,
+	publish_seconds REAL NOT NULL DEFAULT 0,
+	PRIMARY KEY (stream_key, date)
+)`
+
+// DateLayout is the format of the dates of Records and Query
+const DateLayout = "2006-01-02"
+
+type (
+	// Record is the usage of a stream key on Date, or over the queried dates if Date is empty
+	Record struct {
+		StreamKey      string  `json:"streamKey"`
+		Date           string  `json:"date,omitempty"`
+		BytesIn        uint64  `json:"bytesIn"`
+		BytesOut       uint64  `json:"bytesOut"`
+		PublishMinutes float64 `json:"publishMinutes"`
+	}
+
+	Store struct {
+		db *sql.DB
+	}
+)
+
+// Open opens the database at path, it is created if it doesn't exist
+func Open(path string) (*Store, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+
+	// SQLite allows one writer, so connections would only wait on each other
+	db.SetMaxOpenConns(1)
+
+	if _, err = db.Exec(schema); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &Store{db: db}, nil
+}
+
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// Check returns an error if the usage can't be read, like when the database file was removed or
+// is locked
+func (s *Store) Check() error {
+	var count int
+	return s.db.QueryRow(`SELECT COUNT(*) FROM (SELECT 1 FROM usage LIMIT 1)`).Scan(&count)
+}
+
+// Add adds to the usage of streamKey on the day of at
+func (s *Store) Add(streamKey string, at time.Time, bytesIn, bytesOut uint64, publishSeconds float64) error {
+	_, err := s.db.Exec(`INSERT INTO usage (stream_key, date, bytes_in, bytes_out, publish_seconds) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (stream_key, date) DO UPDATE SET
+			bytes_in = bytes_in + excluded.bytes_in,
+			bytes_out = bytes_out + excluded.bytes_out,
+			publish_seconds = publish_seconds + excluded.publish_seconds`,
+		streamKey, at.UTC().Format(DateLayout), int64(bytesIn), int64(bytesOut), publishSeconds)
+	return err
+}
+
+// Query returns the usage from and to the dates in DateLayout, both included, of streamKey or
+// every stream key if it is empty. Every day is a Record if daily is set, otherwise a stream
+// key has one Record for all of them.
+func (s *Store) Query(from, to, streamKey string, daily bool) ([]Record, error) {
+	columns, grouping := `stream_key, date, bytes_in, bytes_out, publish_seconds`, `ORDER BY stream_key, date`
+	if !daily {
+		columns = `stream_key, '', SUM(bytes_in), SUM(bytes_out), SUM(publish_seconds)`
+		grouping = `GROUP BY stream_key ORDER BY stream_key`
+	}
+
+	rows, err := s.db.Query(`SELECT `+columns+` FROM usage WHERE date >= ? AND date <= ? AND (? = '' OR stream_key = ?) `+grouping,
+		from, to, streamKey, streamKey)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := []Record{}
+	for rows.Next() {
+		var (
+			r                 Record
+			bytesIn, bytesOut int64
+			publishSeconds    float64
+		)
+		if err = rows.Scan(&r.StreamKey, &r.Date, &bytesIn, &bytesOut, &publishSeconds); err != nil {
+			return nil, err
+		}
+
+		r.BytesIn, r.BytesOut, r.PublishMinutes = uint64(bytesIn), uint64(bytesOut), publishSeconds/60
+		records = append(records, r)
+	}
+
+	return records, rows.Err()
+}
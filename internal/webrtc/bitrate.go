@@ -0,0 +1,48 @@
+package webrtc
+
+import (
+	"sync"
+	"time"
+)
+
+// bitrateMeter measures the bitrate of a track over the last full second
+type bitrateMeter struct {
+	lock sync.Mutex
+
+	// Unix time of the second being counted, and the bytes of it and the one before
+	second                 int64
+	bytes, lastSecondBytes uint64
+}
+
+func (m *bitrateMeter) add(size int) {
+	now := time.Now().Unix()
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if now != m.second {
+		m.lastSecondBytes = 0
+		if now == m.second+1 {
+			m.lastSecondBytes = m.bytes
+		}
+		m.second, m.bytes = now, 0
+	}
+	m.bytes += uint64(size)
+}
+
+// bitsPerSecond returns the bitrate of the last full second, 0 if nothing was received in it
+func (m *bitrateMeter) bitsPerSecond() uint64 {
+	now := time.Now().Unix()
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	switch now {
+	case m.second:
+		return m.lastSecondBytes * 8
+	case m.second + 1:
+		return m.bytes * 8
+	}
+
+	return 0
+}
@@ -0,0 +1,280 @@
+package webrtc
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/glimesh/broadcast-box/internal/capture"
+	"github.com/pion/interceptor"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	captureDirectoryDefault = "captures"
+
+	captureDurationDefault = time.Minute
+	captureMaxDuration     = 10 * time.Minute
+
+	// Port of every address in pcap captures, RTP and RTCP are muxed
+	capturePort = 5004
+)
+
+var (
+	// ErrCaptureRunning is returned when starting a capture of a stream that is already captured
+	ErrCaptureRunning = errors.New("stream is already being captured")
+
+	// ErrNoCapture is returned when stopping a capture of a stream that isn't captured
+	ErrNoCapture = errors.New("stream isn't being captured")
+
+	// Address of Broadcast Box in pcap captures, publishers are in 10.1.0.0/16 and viewers in
+	// 10.2.0.0/16
+	captureServerAddr = netip.AddrPortFrom(netip.AddrFrom4([4]byte{10, 0, 0, 1}), capturePort)
+)
+
+// packetCapture writes the packets of the PeerConnections of a stream until it is stopped
+type packetCapture struct {
+	lock   sync.Mutex
+	writer *capture.Writer
+	path   string
+	timer  *time.Timer
+	failed bool
+
+	// Addresses of the PeerConnections in the order they were first seen
+	peers                       map[*captureInterceptor]netip.AddrPort
+	publishersSeen, viewersSeen uint16
+}
+
+func (c *packetCapture) write(i *captureInterceptor, inbound, isRTCP bool, data []byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.writer == nil || c.failed {
+		return
+	} else if c.writer.Format() == capture.FormatRTPDump && !(i.isWHIP && inbound) {
+		return
+	}
+
+	peer, ok := c.peers[i]
+	if !ok {
+		network, seen := byte(2), &c.viewersSeen
+		if i.isWHIP {
+			network, seen = 1, &c.publishersSeen
+		}
+		*seen++
+
+		peer = netip.AddrPortFrom(netip.AddrFrom4([4]byte{10, network, byte(*seen >> 8), byte(*seen)}), capturePort)
+		c.peers[i] = peer
+	}
+
+	p := capture.Packet{Time: time.Now(), Src: captureServerAddr, Dst: peer, RTCP: isRTCP, Data: data}
+	if inbound {
+		p.Src, p.Dst = peer, captureServerAddr
+	}
+
+	if err := c.writer.Write(p); err != nil {
+		logger.Warn("Failed to capture", "path", c.path, "err", err)
+		c.failed = true
+	}
+}
+
+func (c *packetCapture) close() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.writer == nil {
+		return
+	}
+	if err := c.writer.Close(); err != nil {
+		logger.Warn("Failed to close capture", "path", c.path, "err", err)
+	}
+	c.writer = nil
+}
+
+// captureInterceptor hands the RTP and RTCP of a PeerConnection to the capture of its stream
+type captureInterceptor struct {
+	interceptor.NoOp
+
+	s      *Server
+	isWHIP bool
+
+	// Set once the PeerConnection is created, see captureInterceptorFactory
+	streamKey atomic.Pointer[string]
+}
+
+func (i *captureInterceptor) capture(inbound, isRTCP bool, data []byte) {
+	if i.s.captureCount.Load() == 0 {
+		return
+	}
+
+	streamKey := i.streamKey.Load()
+	if streamKey == nil {
+		return
+	}
+
+	i.s.capturesLock.RLock()
+	c := i.s.captures[*streamKey]
+	i.s.capturesLock.RUnlock()
+
+	if c != nil {
+		c.write(i, inbound, isRTCP, data)
+	}
+}
+
+func (i *captureInterceptor) BindRemoteStream(_ *interceptor.StreamInfo, reader interceptor.RTPReader) interceptor.RTPReader {
+	return interceptor.RTPReaderFunc(func(b []byte, a interceptor.Attributes) (int, interceptor.Attributes, error) {
+		n, a, err := reader.Read(b, a)
+		if err == nil {
+			i.capture(true, false, b[:n])
+		}
+		return n, a, err
+	})
+}
+
+func (i *captureInterceptor) BindLocalStream(_ *interceptor.StreamInfo, writer interceptor.RTPWriter) interceptor.RTPWriter {
+	return interceptor.RTPWriterFunc(func(header *rtp.Header, payload []byte, a interceptor.Attributes) (int, error) {
+		if i.s.captureCount.Load() != 0 {
+			if b, err := (&rtp.Packet{Header: *header, Payload: payload}).Marshal(); err == nil {
+				i.capture(false, false, b)
+			}
+		}
+		return writer.Write(header, payload, a)
+	})
+}
+
+func (i *captureInterceptor) BindRTCPReader(reader interceptor.RTCPReader) interceptor.RTCPReader {
+	return interceptor.RTCPReaderFunc(func(b []byte, a interceptor.Attributes) (int, interceptor.Attributes, error) {
+		n, a, err := reader.Read(b, a)
+		if err == nil {
+			i.capture(true, true, b[:n])
+		}
+		return n, a, err
+	})
+}
+
+func (i *captureInterceptor) BindRTCPWriter(writer interceptor.RTCPWriter) interceptor.RTCPWriter {
+	return interceptor.RTCPWriterFunc(func(pkts []rtcp.Packet, a interceptor.Attributes) (int, error) {
+		if i.s.captureCount.Load() != 0 {
+			if b, err := rtcp.Marshal(pkts); err == nil {
+				i.capture(false, true, b)
+			}
+		}
+		return writer.Write(pkts, a)
+	})
+}
+
+// captureInterceptorFactory builds a captureInterceptor for every PeerConnection. pion doesn't
+// say which PeerConnection an interceptor is for, so PeerConnections are created one at a time
+// and take the interceptor that was built last, see Server.buildPeerConnection.
+type captureInterceptorFactory struct {
+	s *Server
+
+	lock  sync.Mutex
+	built *captureInterceptor
+}
+
+func (f *captureInterceptorFactory) NewInterceptor(_ string) (interceptor.Interceptor, error) {
+	f.built = &captureInterceptor{s: f.s}
+	return f.built, nil
+}
+
+// buildPeerConnection creates a PeerConnection whose packets are captured with the stream
+// streamKey, no stream if it is empty
+func (s *Server) buildPeerConnection(api *webrtc.API, cfg webrtc.Configuration, isWHIP bool, streamKey string) (*webrtc.PeerConnection, error) {
+	s.captureInterceptors.lock.Lock()
+	defer s.captureInterceptors.lock.Unlock()
+
+	peerConnection, err := api.NewPeerConnection(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if i := s.captureInterceptors.built; i != nil && streamKey != "" {
+		i.isWHIP = isWHIP
+		i.streamKey.Store(&streamKey)
+	}
+	s.captureInterceptors.built = nil
+
+	return peerConnection, nil
+}
+
+// StartCapture writes the RTP and RTCP of the PeerConnections of streamKey to a file in
+// CAPTURE_DIRECTORY for duration, and returns its path. pcap files have every packet, rtpdump
+// ones only those sent by the publisher.
+func StartCapture(streamKey string, format capture.Format, duration time.Duration) (string, error) {
+	return defaultServer.StartCapture(streamKey, format, duration)
+}
+
+func (s *Server) StartCapture(streamKey string, format capture.Format, duration time.Duration) (string, error) {
+	if duration == 0 {
+		duration = captureDurationDefault
+	} else if duration < 0 || duration > captureMaxDuration {
+		return "", fmt.Errorf("capture duration must be between 0 and %s, got %s", captureMaxDuration, duration)
+	}
+
+	if err := os.MkdirAll(s.captureDirectory, 0o755); err != nil {
+		return "", err
+	}
+
+	s.capturesLock.Lock()
+	defer s.capturesLock.Unlock()
+
+	if s.captures[streamKey] != nil {
+		return "", ErrCaptureRunning
+	}
+
+	path := filepath.Join(s.captureDirectory, fmt.Sprintf("%s-%s.%s", streamKey, time.Now().UTC().Format("20060102-150405"), format))
+	writer, err := capture.Create(path, format)
+	if err != nil {
+		return "", err
+	}
+
+	c := &packetCapture{writer: writer, path: path, peers: map[*captureInterceptor]netip.AddrPort{}}
+	c.timer = time.AfterFunc(duration, func() { s.stopCapture(streamKey, c) })
+
+	s.captures[streamKey] = c
+	s.captureCount.Add(1)
+
+	logger.Info("Capturing stream", "streamKey", streamKey, "path", path, "duration", duration)
+	return path, nil
+}
+
+// StopCapture finishes the capture of streamKey before its duration is over
+func StopCapture(streamKey string) error {
+	return defaultServer.StopCapture(streamKey)
+}
+
+func (s *Server) StopCapture(streamKey string) error {
+	s.capturesLock.RLock()
+	c := s.captures[streamKey]
+	s.capturesLock.RUnlock()
+
+	if c == nil {
+		return ErrNoCapture
+	}
+
+	s.stopCapture(streamKey, c)
+	return nil
+}
+
+func (s *Server) stopCapture(streamKey string, c *packetCapture) {
+	s.capturesLock.Lock()
+	if s.captures[streamKey] != c {
+		s.capturesLock.Unlock()
+		return
+	}
+	delete(s.captures, streamKey)
+	s.captureCount.Add(-1)
+	s.capturesLock.Unlock()
+
+	c.timer.Stop()
+	c.close()
+	logger.Info("Finished capture", "streamKey", streamKey, "path", c.path)
+}
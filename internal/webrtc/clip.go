@@ -0,0 +1,195 @@
+package webrtc
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/glimesh/broadcast-box/internal/recorder"
+)
+
+// ErrClipUnavailable is returned for clips of media that isn't buffered, see CLIP_BUFFER_DURATION
+var ErrClipUnavailable = errors.New("clip range isn't buffered")
+
+type clipFrame struct {
+	pts      time.Duration
+	data     []byte
+	keyframe bool
+}
+
+// clipBuffer keeps the H264 and Opus of a publisher for the last duration, starting at a keyframe
+type clipBuffer struct {
+	lock     sync.Mutex
+	duration time.Duration
+	video    []clipFrame
+	audio    []clipFrame
+}
+
+func newClipBuffer(duration time.Duration) *clipBuffer {
+	return &clipBuffer{duration: duration}
+}
+
+func (c *clipBuffer) WriteH264(pts time.Duration, accessUnit []byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	keyframe := recorder.IsKeyframe(recorder.CodecH264, accessUnit)
+	if len(c.video) == 0 && !keyframe {
+		return
+	}
+	c.video = append(c.video, clipFrame{pts, accessUnit, keyframe})
+
+	// The buffer starts at the last keyframe that is at least duration old
+	trim := 0
+	for i, f := range c.video {
+		if pts-f.pts < c.duration {
+			break
+		} else if f.keyframe {
+			trim = i
+		}
+	}
+	c.video = c.video[trim:]
+	c.trimAudio(c.video[0].pts)
+}
+
+func (c *clipBuffer) WriteOpus(pts time.Duration, packet []byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.audio = append(c.audio, clipFrame{pts, append([]byte(nil), packet...), true})
+	if len(c.video) != 0 {
+		c.trimAudio(c.video[0].pts)
+	} else {
+		c.trimAudio(pts - c.duration)
+	}
+}
+
+func (c *clipBuffer) trimAudio(start time.Duration) {
+	trim := 0
+	for trim < len(c.audio) && c.audio[trim].pts < start {
+		trim++
+	}
+	c.audio = c.audio[trim:]
+}
+
+// Close keeps what was buffered, clips can be cut until the stream is republished
+func (c *clipBuffer) Close() {}
+
+// frames returns the video from the last keyframe at or before start up to end, and the audio
+// from where that video starts
+func (c *clipBuffer) frames(start, end time.Duration) (video, audio []clipFrame) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	first := -1
+	for i, f := range c.video {
+		if f.pts > end {
+			break
+		} else if f.keyframe && (first == -1 || f.pts <= start) {
+			first = i
+		}
+	}
+
+	if first != -1 {
+		for _, f := range c.video[first:] {
+			if f.pts > end {
+				break
+			}
+			video = append(video, f)
+		}
+		start = video[0].pts
+	}
+
+	for _, f := range c.audio {
+		if f.pts > end {
+			break
+		} else if f.pts >= start {
+			audio = append(audio, f)
+		}
+	}
+
+	return video, audio
+}
+
+// Clip cuts the buffered media of streamKey from start to end into an MP4, or WebM for audio
+// only, and returns its path. The caller removes the file. Offsets are since the publisher
+// started, negative ones are relative to now. The clip starts at the keyframe before start.
+func Clip(streamKey string, start, end time.Duration) (string, error) {
+	return defaultServer.Clip(streamKey, start, end)
+}
+
+func (s *Server) Clip(streamKey string, start, end time.Duration) (string, error) {
+	s.streamMapLock.Lock()
+	stream, ok := s.streamMap[streamKey]
+	s.streamMapLock.Unlock()
+	if !ok {
+		return "", ErrStreamNotFound
+	}
+
+	tap := stream.tap.Load()
+	if tap == nil || tap.clipBuffer == nil {
+		return "", ErrClipUnavailable
+	}
+
+	now := time.Since(tap.start)
+	if start < 0 {
+		start += now
+	}
+	if end <= 0 {
+		end += now
+	}
+	if end <= start {
+		return "", errors.New("clip must end after it starts")
+	}
+
+	video, audio := tap.clipBuffer.frames(start, end)
+	if len(video) == 0 && len(audio) == 0 {
+		return "", ErrClipUnavailable
+	}
+
+	dir, err := os.MkdirTemp("", "broadcast-box-clip-")
+	if err != nil {
+		return "", err
+	}
+
+	path, err := writeClip(dir, streamKey+"-clip", recorder.CodecH264, video, audio)
+	if err != nil {
+		return "", errors.Join(err, os.RemoveAll(dir))
+	}
+	return path, nil
+}
+
+// writeClip records the frames in the order they are presented to a file named after name in dir
+func writeClip(dir, name string, codec recorder.Codec, video, audio []clipFrame) (string, error) {
+	paths := []string{}
+	r, err := recorder.New(dir, name, recorder.Options{
+		OnFinalized: func(file recorder.File) {
+			paths = append(paths, file.Paths...)
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	for len(video) != 0 || len(audio) != 0 {
+		if len(audio) == 0 || (len(video) != 0 && video[0].pts <= audio[0].pts) {
+			err = r.WriteVideo(codec, video[0].data, video[0].pts)
+			video = video[1:]
+		} else {
+			err = r.WriteOpus(audio[0].data, audio[0].pts)
+			audio = audio[1:]
+		}
+
+		if err != nil {
+			return "", errors.Join(err, r.Close())
+		}
+	}
+
+	if err = r.Close(); err != nil {
+		return "", err
+	} else if len(paths) == 0 {
+		return "", ErrClipUnavailable
+	}
+	return paths[0], nil
+}
@@ -0,0 +1,25 @@
+package webrtc
+
+import (
+	"fmt"
+
+	"github.com/google/uuid"
+)
+
+// CheckUDPMuxes returns an error if a socket of UDP_MUX_PORT was closed, like after it failed
+// to read. ICE can't connect over the port anymore then.
+func (s *Server) CheckUDPMuxes() error {
+	// Getting a connection fails once a socket is closed, the probe's is removed again on Close
+	probeUfrag := "readiness-" + uuid.New().String()
+	for _, udpMux := range s.udpMuxes {
+		for _, addr := range udpMux.GetListenAddresses() {
+			conn, err := udpMux.GetConn(probeUfrag, addr)
+			if err != nil {
+				return fmt.Errorf("UDP mux socket %s: %w", addr, err)
+			}
+			_ = conn.Close()
+		}
+	}
+
+	return nil
+}
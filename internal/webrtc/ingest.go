@@ -0,0 +1,281 @@
+package webrtc
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/glimesh/broadcast-box/internal/events"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+)
+
+const (
+	videoClockRate = 90000
+	opusClockRate  = 48000
+)
+
+var (
+	ErrIngestClosed = errors.New("ingest has been closed")
+
+	// ErrStreamPublished is returned by NewFallbackIngest while the stream has a publisher, and
+	// for another publisher with PUBLISHER_CONFLICT=first-wins
+	ErrStreamPublished = errors.New("stream already has a publisher")
+
+	errVideoCodecChanged = errors.New("video codec of an ingest can't change")
+)
+
+// Ingest publishes media to a stream from a source that isn't a WHIP PeerConnection,
+// like an RTMP encoder. Media is packetized into RTP and forwarded to WHEP sessions
+// the same way as packets from a WHIP publisher.
+type Ingest struct {
+	s         *Server
+	streamKey string
+	stream    *stream
+
+	done      chan struct{}
+	closeOnce sync.Once
+
+	// Set once the Ingest was replaced by another publisher, which Close leaves alone
+	replaced atomic.Bool
+
+	videoLock           sync.Mutex
+	videoForwarder      *videoForwarder
+	videoCodec          videoTrackCodec
+	videoPayloader      rtp.Payloader
+	videoSequenceNumber uint16
+	videoTimestampBase  uint32
+
+	audioLock           sync.Mutex
+	audioSequenceNumber uint16
+	audioTimestampBase  uint32
+}
+
+// NewIngest makes a new Ingest the publisher of streamKey
+func NewIngest(streamKey string) (*Ingest, error) {
+	return defaultServer.NewIngest(streamKey)
+}
+
+func (s *Server) NewIngest(streamKey string) (*Ingest, error) {
+	s.streamMapLock.Lock()
+	defer s.streamMapLock.Unlock()
+
+	return s.newIngest(streamKey)
+}
+
+// NewFallbackIngest makes a new Ingest the publisher of streamKey until another publisher
+// connects, which closes it. It fails with ErrStreamPublished while the stream has a publisher.
+func NewFallbackIngest(streamKey string) (*Ingest, error) {
+	return defaultServer.NewFallbackIngest(streamKey)
+}
+
+func (s *Server) NewFallbackIngest(streamKey string) (*Ingest, error) {
+	s.streamMapLock.Lock()
+	defer s.streamMapLock.Unlock()
+
+	if stream, ok := s.streamMap[streamKey]; ok && stream.hasWHIPClient.Load() {
+		return nil, ErrStreamPublished
+	}
+
+	i, err := s.newIngest(streamKey)
+	if err != nil {
+		return nil, err
+	}
+	i.stream.fallbackIngest = i
+
+	return i, nil
+}
+
+// newIngest is NewIngest, the caller must hold streamMapLock
+func (s *Server) newIngest(streamKey string) (*Ingest, error) {
+	// Close closes the streams after s.closed with streamMapLock held, so this can't add one
+	// it misses
+	select {
+	case <-s.closed:
+		return nil, ErrServerClosed
+	default:
+	}
+
+	if err := s.claimPublisher(streamKey, publisherIdentity{}); err != nil {
+		return nil, err
+	}
+
+	stream, err := s.getStream(streamKey, true)
+	if err != nil {
+		return nil, err
+	}
+
+	i := &Ingest{
+		s:                   s,
+		streamKey:           streamKey,
+		stream:              stream,
+		done:                make(chan struct{}),
+		videoSequenceNumber: uint16(rand.Uint32()),
+		videoTimestampBase:  rand.Uint32(),
+		audioSequenceNumber: uint16(rand.Uint32()),
+		audioTimestampBase:  rand.Uint32(),
+	}
+	stream.closePublisher = i.close
+	stream.replacePublisher = func() {
+		i.replaced.Store(true)
+		i.close()
+	}
+
+	if stream.firstPublishTime.IsZero() {
+		stream.firstPublishTime = time.Now()
+
+		if maxDuration := stream.config.maxDuration(); maxDuration > 0 {
+			go s.enforceMaxDuration(streamKey, stream, maxDuration)
+		}
+	}
+	s.startMediaTap(streamKey, stream)
+	s.startRelayOuts(streamKey, stream)
+
+	// Keyframes can't be requested from an Ingest, drop the requests so senders never block
+	go func() {
+		for {
+			select {
+			case <-i.done:
+				return
+			case <-stream.pliChan:
+			}
+		}
+	}()
+
+	s.emitEvent(events.TypePublishStart, streamKey, "", stream)
+	return i, nil
+}
+
+// Done is closed once the Ingest is closed, either by Close or by the server ending the stream
+func (i *Ingest) Done() <-chan struct{} {
+	return i.done
+}
+
+// Close ends the Ingest, the stream is deleted if it has no WHEP sessions
+func (i *Ingest) Close() {
+	i.close()
+	if !i.replaced.Load() {
+		i.s.peerConnectionDisconnected(i.streamKey, "")
+	}
+}
+
+func (i *Ingest) close() {
+	i.closeOnce.Do(func() { close(i.done) })
+}
+
+func (i *Ingest) isClosed() bool {
+	select {
+	case <-i.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// WriteH264 sends one H264 access unit in Annex B format, presented at pts
+func (i *Ingest) WriteH264(accessUnit []byte, pts time.Duration) error {
+	return i.writeVideo(videoTrackCodecH264, &codecs.H264Payloader{}, accessUnit, pts)
+}
+
+// WriteVP8 sends one VP8 frame, presented at pts
+func (i *Ingest) WriteVP8(frame []byte, pts time.Duration) error {
+	return i.writeVideo(videoTrackCodecVP8, &codecs.VP8Payloader{EnablePictureID: true}, frame, pts)
+}
+
+// WriteVP9 sends one VP9 frame, presented at pts
+func (i *Ingest) WriteVP9(frame []byte, pts time.Duration) error {
+	return i.writeVideo(videoTrackCodecVP9, &codecs.VP9Payloader{}, frame, pts)
+}
+
+// WriteAV1 sends one AV1 temporal unit of OBUs in low overhead format, presented at pts
+func (i *Ingest) WriteAV1(temporalUnit []byte, pts time.Duration) error {
+	return i.writeVideo(videoTrackCodecAV1, &codecs.AV1Payloader{}, temporalUnit, pts)
+}
+
+// writeVideo sends a frame of codec, the first frame sets the codec of the Ingest and
+// payloader is only used then
+func (i *Ingest) writeVideo(codec videoTrackCodec, payloader rtp.Payloader, frame []byte, pts time.Duration) error {
+	if i.isClosed() {
+		return ErrIngestClosed
+	} else if i.stream.config.AudioOnly {
+		return nil
+	}
+
+	i.videoLock.Lock()
+	defer i.videoLock.Unlock()
+
+	if i.videoForwarder == nil {
+		videoTrack, trackIndex, err := i.s.addTrack(i.stream, videoTrackLabelDefault, "", "", codec)
+		if err != nil {
+			return err
+		}
+
+		i.videoForwarder = newVideoForwarder(i.stream, videoTrack, trackIndex, codec)
+		i.videoCodec = codec
+		i.videoPayloader = payloader
+	} else if codec != i.videoCodec {
+		return errVideoCodecChanged
+	}
+
+	payloads := i.videoPayloader.Payload(uint16(i.s.rtpMTU-12), frame)
+	timestamp := i.videoTimestampBase + rtpTimestamp(pts, videoClockRate)
+	for j, payload := range payloads {
+		i.videoSequenceNumber++
+		i.videoForwarder.forward(&rtp.Packet{
+			Header: rtp.Header{
+				Version:        2,
+				Marker:         j == len(payloads)-1,
+				SequenceNumber: i.videoSequenceNumber,
+				Timestamp:      timestamp,
+			},
+			Payload: payload,
+		}, nil)
+	}
+
+	return nil
+}
+
+// WriteOpus sends one Opus packet, presented at pts
+func (i *Ingest) WriteOpus(packet []byte, pts time.Duration) error {
+	if i.isClosed() {
+		return ErrIngestClosed
+	}
+
+	i.audioLock.Lock()
+	defer i.audioLock.Unlock()
+
+	i.audioSequenceNumber++
+	i.stream.audioPacketsReceived.Add(1)
+
+	rtpPkt := &rtp.Packet{
+		Header: rtp.Header{
+			Version:        2,
+			Marker:         true,
+			SequenceNumber: i.audioSequenceNumber,
+			Timestamp:      i.audioTimestampBase + rtpTimestamp(pts, opusClockRate),
+		},
+		Payload: packet,
+	}
+	i.stream.audioBytesReceived.Add(uint64(rtpPkt.MarshalSize()))
+	i.stream.usageBytesIn.Add(uint64(rtpPkt.MarshalSize()))
+	i.stream.audioBitrate.add(rtpPkt.MarshalSize())
+	if i.stream.audioCodec.Load() == nil {
+		codec := audioTrackCodecOpus
+		i.stream.audioCodec.Store(&codec)
+	}
+	if tap := i.stream.tap.Load(); tap != nil {
+		tap.writeAudio(rtpPkt)
+	}
+	if packet, err := rtpPkt.Marshal(); err == nil {
+		i.stream.writeRTSPAudio(packet)
+	}
+
+	return i.stream.audioTrack.WriteRTP(rtpPkt, audioTrackCodecOpus)
+}
+
+// rtpTimestamp converts pts to units of clockRate
+func rtpTimestamp(pts time.Duration, clockRate int64) uint32 {
+	return uint32(int64(pts/time.Microsecond) * clockRate / 1000000)
+}
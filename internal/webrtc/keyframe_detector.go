@@ -10,6 +10,14 @@ const (
 	idrNALUType = 5
 	spsNALUType = 7
 	ppsNALUType = 8
+
+	// H265 NAL unit types from RFC 7798, IRAP pictures are 16 to 23
+	h265IRAPNALUTypeFirst = 16
+	h265IRAPNALUTypeLast  = 23
+	h265VPSNALUType       = 32
+	h265PPSNALUType       = 34
+	h265APNALUType        = 48
+	h265FUNALUType        = 49
 )
 
 func isKeyframe(pkt *rtp.Packet, codec videoTrackCodec, depacketizer rtp.Depacketizer) bool {
@@ -21,6 +29,34 @@ func isKeyframe(pkt *rtp.Packet, codec videoTrackCodec, depacketizer rtp.Depacke
 
 		firstNaluType := nalu[4] & naluTypeBitmask
 		return firstNaluType == idrNALUType || firstNaluType == spsNALUType || firstNaluType == ppsNALUType
+	} else if codec == videoTrackCodecH265 {
+		return isH265Keyframe(pkt.Payload)
 	}
 	return true
 }
+
+// isH265Keyframe returns if payload starts an IRAP picture or its parameter sets
+func isH265Keyframe(payload []byte) bool {
+	if len(payload) < 3 {
+		return false
+	}
+
+	naluType := payload[0] >> 1 & 0x3F
+	switch naluType {
+	case h265APNALUType:
+		// The first aggregated NAL unit follows its 2 byte size
+		if len(payload) < 5 {
+			return false
+		}
+		naluType = payload[4] >> 1 & 0x3F
+	case h265FUNALUType:
+		// Only the fragment that starts the NAL unit
+		if payload[2]&0x80 == 0 {
+			return false
+		}
+		naluType = payload[2] & 0x3F
+	}
+
+	return (naluType >= h265IRAPNALUTypeFirst && naluType <= h265IRAPNALUTypeLast) ||
+		(naluType >= h265VPSNALUType && naluType <= h265PPSNALUType)
+}
@@ -0,0 +1,222 @@
+package webrtc
+
+import (
+	"sync"
+	"time"
+
+	"github.com/glimesh/broadcast-box/internal/segmenter"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+)
+
+// mediaSink receives the media of a publisher as H264 access units and Opus packets
+type mediaSink interface {
+	WriteH264(pts time.Duration, accessUnit []byte)
+	WriteOpus(pts time.Duration, packet []byte)
+	Close()
+}
+
+// mediaTap depacketizes the RTP forwarded to WHEP sessions for the HLS and DASH segmenter,
+// the clip buffer, the SRT outputs, the restream targets, the recording and the thumbnail of
+// a publisher. The RTP is also
+// forwarded as is when the stream has an rtpForward address.
+type mediaTap struct {
+	// nil if HLS and DASH are disabled, it is also one of sinks
+	segmenter *segmenter.Segmenter
+	sinks     []mediaSink
+	start     time.Time
+
+	// Restream targets can be added while the stream is published, keyed by target ID
+	restreams     map[string]mediaSink
+	restreamsLock sync.Mutex
+
+	// nil if CLIP_BUFFER_DURATION isn't set, it is also one of sinks
+	clipBuffer *clipBuffer
+
+	// nil if THUMBNAIL_INTERVAL isn't set
+	thumbnail *thumbnail
+
+	// nil if the stream has no rtpForward
+	rtpForward *rtpForward
+
+	// nil while not recording, it can be started and stopped while the stream is published
+	recording     *recording
+	recordingLock sync.Mutex
+
+	videoLock           sync.Mutex
+	videoRID            string
+	videoClock          rtpClock
+	videoDepacketizer   codecs.H264Packet
+	accessUnit          []byte
+	accessUnitTimestamp uint32
+	unsupportedWarned   bool
+
+	audioLock  sync.Mutex
+	audioClock rtpClock
+}
+
+// rtpClock converts the RTP timestamps of a track to time since the tap started. Tracks
+// have unrelated timestamp offsets, so they are aligned by when their first packet arrived.
+type rtpClock struct {
+	started bool
+	base    time.Duration
+	last    uint32
+	elapsed int64
+}
+
+func (c *rtpClock) pts(start time.Time, timestamp uint32, clockRate int64) time.Duration {
+	if !c.started {
+		c.started, c.base, c.last = true, time.Since(start), timestamp
+	}
+
+	c.elapsed += int64(int32(timestamp - c.last))
+	c.last = timestamp
+
+	return c.base + time.Duration(c.elapsed)*time.Second/time.Duration(clockRate)
+}
+
+// startMediaTap replaces the tap of stream for a new publisher, it isn't started if nothing would use it
+func (s *Server) startMediaTap(streamKey string, stream *stream) {
+	// Closed first, so listener mode outputs can listen on their port again
+	stopMediaTap(stream)
+
+	tap := &mediaTap{start: time.Now(), restreams: s.newRestreams(streamKey)}
+	if !s.hlsDisabled || !s.dashDisabled {
+		tap.segmenter = segmenter.New(tap.start, stream.config.dvrWindow())
+		tap.sinks = append(tap.sinks, tap.segmenter)
+	}
+	if s.clipBufferDuration > 0 {
+		tap.clipBuffer = newClipBuffer(s.clipBufferDuration)
+		tap.sinks = append(tap.sinks, tap.clipBuffer)
+	}
+	if s.thumbnailInterval > 0 {
+		tap.thumbnail = newThumbnail(s.thumbnailInterval)
+	}
+	tap.sinks = append(tap.sinks, newSRTOutputs(streamKey, stream.config.SRTOutputs)...)
+	tap.rtpForward = newRTPForward(streamKey, stream.config)
+
+	if stream.config.Record {
+		recording, err := s.newRecording(streamKey, stream.config)
+		if err != nil {
+			logger.Error("Failed to start recording", "streamKey", streamKey, "err", err)
+		}
+		tap.recording = recording
+	}
+
+	if len(tap.sinks) == 0 && len(tap.restreams) == 0 && tap.rtpForward == nil && tap.recording == nil && tap.thumbnail == nil {
+		tap = nil
+	}
+	stream.tap.Store(tap)
+}
+
+// stopMediaTap ends the outputs of the publisher. The segmenter is closed too, but its playlist
+// and manifest are served until the stream is deleted or republished.
+func stopMediaTap(stream *stream) {
+	if tap := stream.tap.Load(); tap != nil {
+		tap.close()
+	}
+}
+
+func (t *mediaTap) close() {
+	t.eachSink(mediaSink.Close)
+
+	if t.rtpForward != nil {
+		t.rtpForward.close()
+	}
+
+	t.recordingLock.Lock()
+	defer t.recordingLock.Unlock()
+
+	if t.recording != nil {
+		t.recording.close()
+		t.recording = nil
+	}
+}
+
+func (t *mediaTap) getRecording() *recording {
+	t.recordingLock.Lock()
+	defer t.recordingLock.Unlock()
+
+	return t.recording
+}
+
+func (t *mediaTap) eachSink(f func(mediaSink)) {
+	for _, sink := range t.sinks {
+		f(sink)
+	}
+
+	t.restreamsLock.Lock()
+	defer t.restreamsLock.Unlock()
+
+	for _, sink := range t.restreams {
+		f(sink)
+	}
+}
+
+// writeVideo depacketizes the first H264 layer of the publisher, others are skipped. The
+// recording has its own depacketizer, as it also takes VP8 and VP9.
+func (t *mediaTap) writeVideo(rtpPkt *rtp.Packet, rid string, codec videoTrackCodec) {
+	if recording := t.getRecording(); recording != nil {
+		recording.writeVideo(t, rtpPkt, rid, codec)
+	}
+	if t.thumbnail != nil {
+		t.thumbnail.writeVideo(rtpPkt, rid, codec)
+	}
+
+	t.videoLock.Lock()
+	defer t.videoLock.Unlock()
+
+	if codec != videoTrackCodecH264 {
+		if !t.unsupportedWarned {
+			t.unsupportedWarned = true
+			logger.Warn("Video can't be served over HLS, DASH, SRT outputs or restreamed, only H264 is supported")
+		}
+		return
+	}
+
+	if t.videoRID == "" {
+		t.videoRID = rid
+	} else if rid != t.videoRID {
+		return
+	}
+
+	if len(t.accessUnit) != 0 && rtpPkt.Timestamp != t.accessUnitTimestamp {
+		t.flushAccessUnit()
+	}
+
+	if nalus, err := t.videoDepacketizer.Unmarshal(rtpPkt.Payload); err == nil {
+		t.accessUnit = append(t.accessUnit, nalus...)
+	}
+	t.accessUnitTimestamp = rtpPkt.Timestamp
+
+	if rtpPkt.Marker {
+		t.flushAccessUnit()
+	}
+}
+
+func (t *mediaTap) flushAccessUnit() {
+	if len(t.accessUnit) != 0 {
+		pts := t.videoClock.pts(t.start, t.accessUnitTimestamp, videoClockRate)
+		t.eachSink(func(sink mediaSink) {
+			sink.WriteH264(pts, t.accessUnit)
+		})
+	}
+	t.accessUnit = nil
+}
+
+func (t *mediaTap) writeAudio(rtpPkt *rtp.Packet) {
+	if t.rtpForward != nil {
+		t.rtpForward.writeAudio(rtpPkt)
+	}
+	if recording := t.getRecording(); recording != nil {
+		recording.writeAudio(t, rtpPkt)
+	}
+
+	t.audioLock.Lock()
+	defer t.audioLock.Unlock()
+
+	pts := t.audioClock.pts(t.start, rtpPkt.Timestamp, opusClockRate)
+	t.eachSink(func(sink mediaSink) {
+		sink.WriteOpus(pts, rtpPkt.Payload)
+	})
+}
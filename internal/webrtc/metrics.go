@@ -0,0 +1,47 @@
+package webrtc
+
+import (
+	"sort"
+
+	"github.com/glimesh/broadcast-box/internal/metrics"
+)
+
+// CollectMetrics adds the current state of the streams and their WHEP sessions to set.
+// Counters of a stream start again when it is published after it was removed.
+func (s *Server) CollectMetrics(set *metrics.Set) {
+	set.Counter("broadcast_box_ice_failures_total", "PeerConnections whose ICE connection failed", float64(s.whipICEFailures.Load()), "endpoint", "whip")
+	set.Counter("broadcast_box_ice_failures_total", "PeerConnections whose ICE connection failed", float64(s.whepICEFailures.Load()), "endpoint", "whep")
+
+	s.streamMapLock.Lock()
+	defer s.streamMapLock.Unlock()
+
+	streamKeys := make([]string, 0, len(s.streamMap))
+	published := 0
+	for streamKey, stream := range s.streamMap {
+		streamKeys = append(streamKeys, streamKey)
+		if stream.hasWHIPClient.Load() {
+			published++
+		}
+	}
+	sort.Strings(streamKeys)
+
+	set.Gauge("broadcast_box_streams", "Streams that have a publisher", float64(published))
+
+	for _, streamKey := range streamKeys {
+		stream := s.streamMap[streamKey]
+
+		stream.whepSessionsLock.RLock()
+		whepSessions := len(stream.whepSessions)
+		stream.whepSessionsLock.RUnlock()
+
+		set.Gauge("broadcast_box_whep_sessions", "WHEP sessions playing the stream", float64(whepSessions), "stream", streamKey)
+		set.Counter("broadcast_box_plis_sent_total", "PLIs sent to publishers of the stream", float64(stream.plisSent.Load()), "stream", streamKey)
+		set.Counter("broadcast_box_audio_packets_received_total", "Audio RTP packets received from publishers", float64(stream.audioPacketsReceived.Load()), "stream", streamKey)
+		set.Counter("broadcast_box_audio_bytes_received_total", "Audio RTP bytes received from publishers", float64(stream.audioBytesReceived.Load()), "stream", streamKey)
+
+		for _, videoTrack := range stream.videoTracks {
+			set.Counter("broadcast_box_video_packets_received_total", "Video RTP packets received from publishers", float64(videoTrack.packetsReceived.Load()), "stream", streamKey, "rid", videoTrack.rid)
+			set.Counter("broadcast_box_video_bytes_received_total", "Video RTP bytes received from publishers", float64(videoTrack.bytesReceived.Load()), "stream", streamKey, "rid", videoTrack.rid)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package webrtc
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v4"
+)
+
+type (
+	NegotiationResult struct {
+		Answer string            `json:"answer"`
+		Media  []NegotiatedMedia `json:"media"`
+	}
+
+	NegotiatedMedia struct {
+		Kind       string                `json:"kind"`
+		Mid        string                `json:"mid"`
+		Direction  string                `json:"direction"`
+		Codecs     []NegotiatedCodec     `json:"codecs"`
+		Extensions []NegotiatedExtension `json:"extensions"`
+	}
+
+	NegotiatedCodec struct {
+		PayloadType uint64 `json:"payloadType"`
+		Codec       string `json:"codec"`
+		Fmtp        string `json:"fmtp,omitempty"`
+	}
+
+	NegotiatedExtension struct {
+		ID  uint64 `json:"id"`
+		URI string `json:"uri"`
+	}
+)
+
+// Negotiate answers offer like WHIP or WHEP would, but with a PeerConnection that is
+// closed immediately. No session is created and no candidates are gathered.
+func Negotiate(offer string, isWHIP bool) (*NegotiationResult, error) {
+	return defaultServer.Negotiate(offer, isWHIP)
+}
+
+func (s *Server) Negotiate(offer string, isWHIP bool) (*NegotiationResult, error) {
+	api := s.apiWhep
+	if isWHIP {
+		api = s.apiWhip
+	}
+
+	peerConnection, err := s.buildPeerConnection(api, webrtc.Configuration{}, isWHIP, "")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if closeErr := peerConnection.Close(); closeErr != nil {
+			logger.Warn("Failed to close PeerConnection", "err", closeErr)
+		}
+	}()
+
+	if !isWHIP {
+		if _, err = peerConnection.AddTrack(newTrackMultiOpus("audio", "pion")); err != nil {
+			return nil, err
+		}
+
+		if _, err = peerConnection.AddTrack(&trackMultiCodec{id: "video", streamID: "pion"}); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = peerConnection.SetRemoteDescription(webrtc.SessionDescription{
+		SDP:  offer,
+		Type: webrtc.SDPTypeOffer,
+	}); err != nil {
+		return nil, err
+	}
+
+	answer, err := peerConnection.CreateAnswer(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	parsed := sdp.SessionDescription{}
+	if err = parsed.Unmarshal([]byte(answer.SDP)); err != nil {
+		return nil, err
+	}
+
+	result := &NegotiationResult{Answer: answer.SDP, Media: []NegotiatedMedia{}}
+	for _, mediaDescription := range parsed.MediaDescriptions {
+		result.Media = append(result.Media, summarizeMediaDescription(mediaDescription))
+	}
+
+	return result, nil
+}
+
+func summarizeMediaDescription(mediaDescription *sdp.MediaDescription) NegotiatedMedia {
+	media := NegotiatedMedia{
+		Kind:       mediaDescription.MediaName.Media,
+		Codecs:     []NegotiatedCodec{},
+		Extensions: []NegotiatedExtension{},
+	}
+
+	fmtpLines := map[uint64]string{}
+	for _, a := range mediaDescription.Attributes {
+		switch a.Key {
+		case sdp.AttrKeyMID:
+			media.Mid = a.Value
+		case sdp.DirectionSendRecv.String(), sdp.DirectionSendOnly.String(), sdp.DirectionRecvOnly.String(), sdp.DirectionInactive.String():
+			media.Direction = a.Key
+		case "rtpmap", "fmtp", sdp.AttrKeyExtMap:
+			split := strings.SplitN(a.Value, " ", 2)
+			if len(split) != 2 {
+				continue
+			}
+
+			id, err := strconv.ParseUint(split[0], 10, 64)
+			if err != nil {
+				continue
+			}
+
+			switch a.Key {
+			case "rtpmap":
+				media.Codecs = append(media.Codecs, NegotiatedCodec{PayloadType: id, Codec: split[1]})
+			case "fmtp":
+				fmtpLines[id] = split[1]
+			default:
+				media.Extensions = append(media.Extensions, NegotiatedExtension{ID: id, URI: split[1]})
+			}
+		}
+	}
+
+	for i := range media.Codecs {
+		media.Codecs[i].Fmtp = fmtpLines[media.Codecs[i].PayloadType]
+	}
+
+	return media
+}
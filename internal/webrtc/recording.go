@@ -0,0 +1,392 @@
+package webrtc
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/glimesh/broadcast-box/internal/events"
+	"github.com/glimesh/broadcast-box/internal/recorder"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+)
+
+// Used when RECORDING_DIRECTORY isn't set, relative to the working directory
+const recordingDirectoryDefault = "recordings"
+
+// Value of recordLayer that records every simulcast layer
+const recordLayerAll = "all"
+
+const (
+	// Used when RECORDING_UPLOAD_PREFIX isn't set
+	recordingUploadPrefixDefault = "{streamKey}/"
+
+	// A failed upload is retried this often, the file is kept on disk if the last attempt fails
+	recordingUploadAttempts   = 3
+	recordingUploadRetryDelay = 10 * time.Second
+)
+
+// recording depacketizes the video and the audio of a publisher for its recorders. A file is
+// started for every publisher, see recorder.New.
+type recording struct {
+	streamKey string
+
+	// recordLayer of the stream, the layer of the first recorder is picked by it
+	layer       string
+	newRecorder func(name string) (*recorder.Recorder, error)
+
+	// The first records to files named after the stream key. With recordLayer `all` every
+	// simulcast layer has one named after the stream key and its RID instead.
+	layersLock sync.Mutex
+	layers     []*recordingLayer
+
+	audioLock  sync.Mutex
+	audioClock rtpClock
+}
+
+type recordingLayer struct {
+	recorder *recorder.Recorder
+	rid      string
+	name     string
+
+	// Stops the recording after the first failed write, like when the disk is full
+	failedOnce sync.Once
+
+	videoLock         sync.Mutex
+	videoClock        rtpClock
+	videoAssembler    videoAssembler
+	unsupportedWarned bool
+}
+
+// videoAssembler depacketizes the frames of a video layer in any codec the recorder takes
+type videoAssembler struct {
+	codec             recorder.Codec
+	depacketizer      rtp.Depacketizer
+	frame             []byte
+	frameTimestamp    uint32
+	sequenceNumber    uint16
+	sequenceNumberSet bool
+
+	// Set when a packet was lost, frames are dropped until the next keyframe
+	waitingForKeyframe bool
+}
+
+func (s *Server) newRecording(streamKey string, config streamConfig) (*recording, error) {
+	opts := recorder.Options{
+		RotateInterval: s.recordingRotateInterval,
+		Format:         config.recordingFormat(),
+		OnStarted: func(file recorder.File) {
+			s.setRecordingsActive(file.Paths, true)
+			writeRecordingOwner(file.Paths, streamKey)
+			s.emitRecordingEvents(events.TypeRecordingStart, streamKey, config, file)
+		},
+		OnFinalized: func(file recorder.File) {
+			s.setRecordingsActive(file.Paths, false)
+
+			eventType := events.TypeRecordingComplete
+			if file.Rotated {
+				eventType = events.TypeRecordingRotate
+			}
+			s.emitRecordingEvents(eventType, streamKey, config, file)
+
+			if s.recordingUpload != nil {
+				go s.uploadRecording(streamKey, file.Paths)
+			}
+		},
+	}
+
+	r := &recording{
+		streamKey: streamKey,
+		layer:     config.RecordLayer,
+		newRecorder: func(name string) (*recorder.Recorder, error) {
+			return recorder.New(s.recordingDirectory, name, opts)
+		},
+	}
+
+	first, err := r.newRecorder(streamKey)
+	if err != nil {
+		return nil, err
+	}
+	r.layers = []*recordingLayer{{recorder: first, name: streamKey}}
+
+	return r, nil
+}
+
+// getLayer returns the recorder of rid, nil if it isn't recorded
+func (r *recording) getLayer(rid string) *recordingLayer {
+	r.layersLock.Lock()
+	defer r.layersLock.Unlock()
+
+	for _, l := range r.layers {
+		if l.rid == rid {
+			return l
+		}
+	}
+
+	if r.layer != recordLayerAll || rid == videoTrackLabelDefault {
+		if len(r.layers) == 0 || r.layers[0].rid != "" || (r.layer != "" && r.layer != recordLayerAll && r.layer != rid) {
+			return nil
+		}
+
+		r.layers[0].rid = rid
+		return r.layers[0]
+	}
+
+	// Every simulcast layer is named after its RID, so the recorder that was started for the
+	// stream key is replaced. It only has audio, if anything.
+	if len(r.layers) == 1 && r.layers[0].rid == "" {
+		r.layers[0].close()
+		r.layers = nil
+	}
+
+	name := r.streamKey + "-" + rid
+	layerRecorder, err := r.newRecorder(name)
+	if err != nil {
+		logger.Error("Failed to start recording", "name", name, "err", err)
+	}
+
+	// Kept when it failed, so it isn't retried for every packet
+	l := &recordingLayer{recorder: layerRecorder, rid: rid, name: name}
+	r.layers = append(r.layers, l)
+	return l
+}
+
+func (r *recording) writeVideo(t *mediaTap, rtpPkt *rtp.Packet, rid string, codec videoTrackCodec) {
+	if l := r.getLayer(rid); l != nil && l.recorder != nil {
+		l.writeVideo(t, rtpPkt, codec)
+	}
+}
+
+func (l *recordingLayer) writeVideo(t *mediaTap, rtpPkt *rtp.Packet, codec videoTrackCodec) {
+	l.videoLock.Lock()
+	defer l.videoLock.Unlock()
+
+	supported := l.videoAssembler.write(rtpPkt, codec, func(frame []byte, timestamp uint32) {
+		pts := l.videoClock.pts(t.start, timestamp, videoClockRate)
+		l.check(l.recorder.WriteVideo(l.videoAssembler.codec, frame, pts))
+	})
+	if !supported && !l.unsupportedWarned {
+		l.unsupportedWarned = true
+		logger.Warn("Video isn't recorded, only H264, VP8 and VP9 are supported", "name", l.name)
+	}
+}
+
+// write adds a packet and calls onFrame with each frame it completes, false if codec isn't
+// supported
+func (a *videoAssembler) write(rtpPkt *rtp.Packet, codec videoTrackCodec, onFrame func(frame []byte, timestamp uint32)) bool {
+	if a.depacketizer == nil {
+		switch codec {
+		case videoTrackCodecH264:
+			a.codec, a.depacketizer = recorder.CodecH264, &codecs.H264Packet{}
+		case videoTrackCodecVP8:
+			a.codec, a.depacketizer = recorder.CodecVP8, &codecs.VP8Packet{}
+		case videoTrackCodecVP9:
+			a.codec, a.depacketizer = recorder.CodecVP9, &codecs.VP9Packet{}
+		default:
+			return false
+		}
+	}
+
+	if a.sequenceNumberSet && rtpPkt.SequenceNumber != a.sequenceNumber+1 {
+		a.waitingForKeyframe = true
+		a.frame = nil
+	}
+	a.sequenceNumber, a.sequenceNumberSet = rtpPkt.SequenceNumber, true
+
+	if len(a.frame) != 0 && rtpPkt.Timestamp != a.frameTimestamp {
+		a.flushFrame(onFrame)
+	}
+
+	if payload, err := a.depacketizer.Unmarshal(rtpPkt.Payload); err == nil {
+		a.frame = append(a.frame, payload...)
+	}
+	a.frameTimestamp = rtpPkt.Timestamp
+
+	if rtpPkt.Marker {
+		a.flushFrame(onFrame)
+	}
+	return true
+}
+
+func (a *videoAssembler) flushFrame(onFrame func(frame []byte, timestamp uint32)) {
+	frame := a.frame
+	a.frame = nil
+
+	if len(frame) == 0 {
+		return
+	} else if a.waitingForKeyframe {
+		if !recorder.IsKeyframe(a.codec, frame) {
+			return
+		}
+		a.waitingForKeyframe = false
+	}
+
+	onFrame(frame, a.frameTimestamp)
+}
+
+// writeAudio records the audio to the file of every layer
+func (r *recording) writeAudio(t *mediaTap, rtpPkt *rtp.Packet) {
+	r.audioLock.Lock()
+	defer r.audioLock.Unlock()
+
+	pts := r.audioClock.pts(t.start, rtpPkt.Timestamp, opusClockRate)
+
+	r.layersLock.Lock()
+	defer r.layersLock.Unlock()
+
+	for _, l := range r.layers {
+		if l.recorder != nil {
+			l.check(l.recorder.WriteOpus(rtpPkt.Payload, pts))
+		}
+	}
+}
+
+func (l *recordingLayer) check(err error) {
+	if err == nil {
+		return
+	}
+
+	l.failedOnce.Do(func() {
+		logger.Error("Recording stopped", "name", l.name, "err", err)
+		if closeErr := l.recorder.Close(); closeErr != nil {
+			logger.Warn("Failed to close recording", "name", l.name, "err", closeErr)
+		}
+	})
+}
+
+func (r *recording) close() {
+	r.layersLock.Lock()
+	defer r.layersLock.Unlock()
+
+	for _, l := range r.layers {
+		l.close()
+	}
+}
+
+func (l *recordingLayer) close() {
+	if l.recorder == nil {
+		return
+	}
+
+	if err := l.recorder.Close(); err != nil {
+		logger.Error("Recording failed", "name", l.name, "err", err)
+	}
+}
+
+func (s *Server) setRecordingsActive(paths []string, active bool) {
+	s.activeRecordingsLock.Lock()
+	defer s.activeRecordingsLock.Unlock()
+
+	for _, path := range paths {
+		if active {
+			s.activeRecordings[path] = true
+		} else {
+			delete(s.activeRecordings, path)
+		}
+	}
+}
+
+// emitRecordingEvents emits an event of eventType for every path of file
+func (s *Server) emitRecordingEvents(eventType, streamKey string, config streamConfig, file recorder.File) {
+	for _, path := range file.Paths {
+		e := events.Event{Type: eventType, StreamKey: streamKey, Recording: &events.Recording{Path: path}}
+		if config.Title != "" {
+			e.Metadata = map[string]string{"title": config.Title}
+		}
+
+		if eventType != events.TypeRecordingStart {
+			e.Recording.Duration = file.Duration.Seconds()
+			if info, err := os.Stat(path); err == nil {
+				e.Recording.Size = info.Size()
+			}
+		}
+
+		s.events.Emit(e)
+	}
+}
+
+// uploadRecording puts the finished files of a recording in the RECORDING_UPLOAD_URL bucket,
+// named after RECORDING_UPLOAD_PREFIX and their file name. They are deleted once uploaded.
+func (s *Server) uploadRecording(streamKey string, paths []string) {
+	prefix := recordingUploadPrefix(s.recordingUploadPrefix, streamKey, time.Now().UTC())
+
+	for _, path := range paths {
+		key := prefix + filepath.Base(path)
+
+		var err error
+		for attempt := 1; attempt <= recordingUploadAttempts; attempt++ {
+			if err = s.recordingUpload.PutFile(context.Background(), key, path); err == nil {
+				break
+			}
+
+			logger.Warn("Failed to upload recording", "path", path, "attempt", attempt, "attempts", recordingUploadAttempts, "err", err)
+			if attempt != recordingUploadAttempts {
+				time.Sleep(recordingUploadRetryDelay)
+			}
+		}
+		if err != nil {
+			continue
+		}
+
+		logger.Info("Uploaded recording", "path", path, "key", key)
+		if !s.recordingUploadKeepLocal {
+			if err = removeRecording(path); err != nil {
+				logger.Warn("Failed to remove uploaded recording", "path", path, "err", err)
+			}
+		}
+	}
+}
+
+// recordingUploadPrefix fills in the placeholders of RECORDING_UPLOAD_PREFIX
+func recordingUploadPrefix(template, streamKey string, t time.Time) string {
+	return strings.NewReplacer(
+		"{streamKey}", streamKey,
+		"{year}", t.Format("2006"),
+		"{month}", t.Format("01"),
+		"{day}", t.Format("02"),
+		"{hour}", t.Format("15"),
+		"{timestamp}", t.Format("20060102-150405"),
+	).Replace(template)
+}
+
+// SetStreamRecording starts or stops recording the publisher of streamKey. The recording
+// ends with the publisher, the record setting of the stream starts one for every publisher.
+func SetStreamRecording(streamKey string, recording bool) error {
+	return defaultServer.SetStreamRecording(streamKey, recording)
+}
+
+func (s *Server) SetStreamRecording(streamKey string, recording bool) error {
+	s.streamMapLock.Lock()
+	defer s.streamMapLock.Unlock()
+
+	stream, ok := s.streamMap[streamKey]
+	if !ok || !stream.hasWHIPClient.Load() {
+		return ErrStreamNotFound
+	}
+
+	tap := stream.tap.Load()
+	if tap == nil {
+		tap = &mediaTap{start: time.Now(), restreams: map[string]mediaSink{}}
+		stream.tap.Store(tap)
+	}
+
+	tap.recordingLock.Lock()
+	defer tap.recordingLock.Unlock()
+
+	switch {
+	case recording && tap.recording == nil:
+		r, err := s.newRecording(streamKey, stream.config)
+		if err != nil {
+			return err
+		}
+		tap.recording = r
+	case !recording && tap.recording != nil:
+		tap.recording.close()
+		tap.recording = nil
+	}
+
+	return nil
+}
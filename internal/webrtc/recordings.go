@@ -0,0 +1,142 @@
+package webrtc
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrRecordingNotFound is returned for recordings that don't exist or are still being recorded
+var ErrRecordingNotFound = errors.New("recording not found")
+
+// Stored next to every recording file, the stream key it was recorded for. Files of recordLayer
+// `all` are named after the stream key and RID, which could be another stream key too.
+const recordingOwnerSuffix = ".owner"
+
+// RecordingFile is a finished recording file in RECORDING_DIRECTORY
+type RecordingFile struct {
+	Name      string    `json:"name"`
+	StartTime time.Time `json:"startTime"`
+	EndTime   time.Time `json:"endTime"`
+	Size      int64     `json:"size"`
+}
+
+// Recordings lists the finished recording files of streamKey and its layers, oldest first
+func Recordings(streamKey string) ([]RecordingFile, error) {
+	return defaultServer.Recordings(streamKey)
+}
+
+func (s *Server) Recordings(streamKey string) ([]RecordingFile, error) {
+	entries, err := os.ReadDir(s.recordingDirectory)
+	if os.IsNotExist(err) {
+		return []RecordingFile{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	recordings := []RecordingFile{}
+	for _, entry := range entries {
+		startTime, ok := s.finishedRecording(streamKey, entry.Name())
+		if !ok || !entry.Type().IsRegular() {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+
+		recordings = append(recordings, RecordingFile{
+			Name:      entry.Name(),
+			StartTime: startTime,
+			EndTime:   info.ModTime().UTC(),
+			Size:      info.Size(),
+		})
+	}
+
+	// Files started within the same second have a counter before the extension
+	sort.Slice(recordings, func(i, j int) bool {
+		a, b := recordings[i], recordings[j]
+		if !a.StartTime.Equal(b.StartTime) {
+			return a.StartTime.Before(b.StartTime)
+		} else if len(a.Name) != len(b.Name) {
+			return len(a.Name) < len(b.Name)
+		}
+		return a.Name < b.Name
+	})
+	return recordings, nil
+}
+
+// OpenRecording opens the finished recording file name of streamKey, see Recordings
+func OpenRecording(streamKey, name string) (*os.File, error) {
+	return defaultServer.OpenRecording(streamKey, name)
+}
+
+func (s *Server) OpenRecording(streamKey, name string) (*os.File, error) {
+	if _, ok := s.finishedRecording(streamKey, name); !ok {
+		return nil, ErrRecordingNotFound
+	}
+
+	file, err := os.Open(filepath.Join(s.recordingDirectory, name))
+	if os.IsNotExist(err) {
+		return nil, ErrRecordingNotFound
+	}
+	return file, err
+}
+
+// finishedRecording returns the start time of the recording file name if it is of streamKey and
+// isn't being recorded anymore
+func (s *Server) finishedRecording(streamKey, name string) (time.Time, bool) {
+	match := recordingFileName.FindStringSubmatch(name)
+	if match == nil || (match[1] != streamKey && !strings.HasPrefix(match[1], streamKey+"-")) {
+		return time.Time{}, false
+	} else if s.recordingOwner(name, match[1]) != streamKey {
+		return time.Time{}, false
+	}
+
+	startTime, err := time.Parse("20060102-150405", match[2])
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	s.activeRecordingsLock.Lock()
+	defer s.activeRecordingsLock.Unlock()
+
+	return startTime, !s.activeRecordings[filepath.Join(s.recordingDirectory, name)]
+}
+
+// recordingOwner returns the stream key the recording file name was recorded for. Files recorded
+// before it was stored are of nameStreamKey, the stream key in their name.
+func (s *Server) recordingOwner(name, nameStreamKey string) string {
+	owner, err := os.ReadFile(filepath.Join(s.recordingDirectory, name+recordingOwnerSuffix))
+	if os.IsNotExist(err) {
+		return nameStreamKey
+	} else if err != nil || (string(owner) != nameStreamKey && !strings.HasPrefix(nameStreamKey, string(owner)+"-")) {
+		return ""
+	}
+	return string(owner)
+}
+
+// writeRecordingOwner stores streamKey as the owner of the recording files at paths
+func writeRecordingOwner(paths []string, streamKey string) {
+	for _, path := range paths {
+		if err := os.WriteFile(path+recordingOwnerSuffix, []byte(streamKey), 0o644); err != nil {
+			logger.Warn("Failed to store the stream key of recording", "path", path, "err", err)
+		}
+	}
+}
+
+// removeRecording deletes the recording file at path and its owner
+func removeRecording(path string) error {
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+
+	if err := os.Remove(path + recordingOwnerSuffix); err != nil && !os.IsNotExist(err) {
+		logger.Warn("Failed to remove the stream key of recording", "path", path, "err", err)
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package webrtc
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestRecordingOwners(t *testing.T) {
+	s := newTestServer(t, Options{})
+
+	for name, owner := range map[string]string{
+		"a-20260101-000000.webm":   "a",
+		"a-h-20260101-000001.webm": "a",
+		"a-h-20260101-000002.webm": "a-h",
+		"a-20260101-000003.webm":   "a",
+		"b-20260101-000000.webm":   "",
+		"c-x-20260101-000000.webm": "other",
+	} {
+		path := filepath.Join(s.recordingDirectory, name)
+		if err := os.WriteFile(path, []byte("recording"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if owner != "" {
+			writeRecordingOwner([]string{path}, owner)
+		}
+	}
+	s.setRecordingsActive([]string{filepath.Join(s.recordingDirectory, "a-20260101-000003.webm")}, true)
+
+	for _, test := range []struct {
+		streamKey string
+		names     []string
+	}{
+		{"a", []string{"a-20260101-000000.webm", "a-h-20260101-000001.webm"}},
+		{"a-h", []string{"a-h-20260101-000002.webm"}},
+		{"b", []string{"b-20260101-000000.webm"}},
+		{"c", nil},
+		{"c-x", nil},
+	} {
+		recordings, err := s.Recordings(test.streamKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var names []string
+		for _, r := range recordings {
+			names = append(names, r.Name)
+		}
+		if !reflect.DeepEqual(names, test.names) {
+			t.Errorf("Recordings(%q) = %v, want %v", test.streamKey, names, test.names)
+		}
+	}
+
+	if _, err := s.OpenRecording("a-h", "a-h-20260101-000001.webm"); !errors.Is(err, ErrRecordingNotFound) {
+		t.Errorf("OpenRecording opened a layer of another stream key, err = %v", err)
+	}
+	file, err := s.OpenRecording("a", "a-h-20260101-000001.webm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = file.Close()
+
+	path := filepath.Join(s.recordingDirectory, "a-h-20260101-000001.webm")
+	if err := removeRecording(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path + recordingOwnerSuffix); !os.IsNotExist(err) {
+		t.Errorf("removeRecording kept the owner, err = %v", err)
+	}
+}
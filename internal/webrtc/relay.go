@@ -0,0 +1,212 @@
+package webrtc
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/glimesh/broadcast-box/internal/events"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	relayRetryInterval = 5 * time.Second
+	relayHTTPTimeout   = 10 * time.Second
+)
+
+// runRelay keeps streamKey relayed from upstreamURL, reconnecting when the upstream session ends
+func (s *Server) runRelay(upstreamURL, streamKey string) {
+	for {
+		disconnected := make(chan struct{})
+		if err := s.relay(upstreamURL, streamKey, disconnected); err != nil {
+			logger.Warn("Failed to relay stream", "streamKey", streamKey, "upstream", upstreamURL, "err", err)
+		} else {
+			select {
+			case <-disconnected:
+			case <-s.closed:
+				return
+			}
+		}
+
+		select {
+		case <-time.After(relayRetryInterval):
+		case <-s.closed:
+			return
+		}
+	}
+}
+
+// maybeRelayOnDemand starts pulling streamKey from the upstream of RELAY_ON_DEMAND when it is
+// played here without a publisher. The caller must hold streamMapLock.
+func (s *Server) maybeRelayOnDemand(streamKey string, stream *stream) {
+	if s.relayOnDemandURL == "" || stream.hasWHIPClient.Load() || s.relayStreamKeys[streamKey] || s.onDemandRelays[streamKey] {
+		return
+	}
+
+	s.onDemandRelays[streamKey] = true
+	go s.runOnDemandRelay(s.relayOnDemandURL, streamKey)
+}
+
+// runOnDemandRelay relays streamKey from upstreamURL until it has no WHEP sessions left
+func (s *Server) runOnDemandRelay(upstreamURL, streamKey string) {
+	defer func() {
+		s.streamMapLock.Lock()
+		delete(s.onDemandRelays, streamKey)
+		s.streamMapLock.Unlock()
+	}()
+
+	for s.hasWHEPSessions(streamKey) {
+		disconnected := make(chan struct{})
+		if err := s.relay(upstreamURL, streamKey, disconnected); err != nil {
+			logger.Warn("Failed to relay stream", "streamKey", streamKey, "upstream", upstreamURL, "err", err)
+			time.Sleep(relayRetryInterval)
+			continue
+		}
+
+		ticker := time.NewTicker(relayRetryInterval)
+		for ended := false; !ended; {
+			select {
+			case <-disconnected:
+				ended = true
+			case <-ticker.C:
+				if !s.hasWHEPSessions(streamKey) {
+					s.closeStream(streamKey, "no WHEP sessions left to relay to")
+					<-disconnected
+					ended = true
+				}
+			}
+		}
+		ticker.Stop()
+	}
+}
+
+func (s *Server) hasWHEPSessions(streamKey string) bool {
+	s.streamMapLock.Lock()
+	defer s.streamMapLock.Unlock()
+
+	stream, ok := s.streamMap[streamKey]
+	if !ok {
+		return false
+	}
+
+	stream.whepSessionsLock.RLock()
+	defer stream.whepSessionsLock.RUnlock()
+
+	return len(stream.whepSessions) != 0
+}
+
+// Relay plays streamKey from the WHEP endpoint at upstreamURL (like another Broadcast Box's
+// /api/whep) and publishes it here under the same key, so local WHEP sessions are served
+// without connecting to the origin. It returns once the upstream session is negotiated.
+func Relay(upstreamURL, streamKey string) error {
+	return defaultServer.Relay(upstreamURL, streamKey)
+}
+
+func (s *Server) Relay(upstreamURL, streamKey string) error {
+	return s.relay(upstreamURL, streamKey, nil)
+}
+
+// relay connects to upstreamURL as a WHEP client and closes disconnected (if not nil)
+// once that PeerConnection is gone
+func (s *Server) relay(upstreamURL, streamKey string, disconnected chan struct{}) error {
+	peerConnection, err := s.newPeerConnection(true, streamKey)
+	if err != nil {
+		return err
+	}
+
+	for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeAudio, webrtc.RTPCodecTypeVideo} {
+		if _, err = peerConnection.AddTransceiverFromKind(kind, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}); err != nil {
+			return closeWithError(peerConnection, err)
+		}
+	}
+
+	offer, err := peerConnection.CreateOffer(nil)
+	if err != nil {
+		return closeWithError(peerConnection, err)
+	}
+
+	gatherComplete := webrtc.GatheringCompletePromise(peerConnection)
+	if err = peerConnection.SetLocalDescription(offer); err != nil {
+		return closeWithError(peerConnection, err)
+	}
+	<-gatherComplete
+
+	answer, err := postOffer(upstreamURL, streamKey, peerConnection.LocalDescription().SDP)
+	if err != nil {
+		return closeWithError(peerConnection, err)
+	}
+
+	s.streamMapLock.Lock()
+	stream, replaced, err := s.attachPublisher(streamKey, publisherIdentity{}, peerConnection)
+	s.streamMapLock.Unlock()
+	if err != nil {
+		return closeWithError(peerConnection, err)
+	}
+
+	var disconnectedOnce sync.Once
+	peerConnection.OnICEConnectionStateChange(func(i webrtc.ICEConnectionState) {
+		if i == webrtc.ICEConnectionStateFailed || i == webrtc.ICEConnectionStateClosed {
+			if err := peerConnection.Close(); err != nil {
+				logger.Warn("Failed to close relay PeerConnection", "streamKey", streamKey, "err", err)
+			}
+			if !replaced.Load() {
+				s.peerConnectionDisconnected(streamKey, "")
+			}
+
+			if disconnected != nil {
+				disconnectedOnce.Do(func() { close(disconnected) })
+			}
+		}
+	})
+
+	if err = peerConnection.SetRemoteDescription(webrtc.SessionDescription{
+		SDP:  answer,
+		Type: webrtc.SDPTypeAnswer,
+	}); err != nil {
+		err = closeWithError(peerConnection, err)
+		s.peerConnectionDisconnected(streamKey, "")
+		return err
+	}
+
+	logger.Info("Relaying stream", "streamKey", streamKey, "upstream", upstreamURL)
+	s.emitEvent(events.TypePublishStart, streamKey, "", stream)
+	return nil
+}
+
+// postOffer sends a WHEP offer for streamKey and returns the answer
+func postOffer(upstreamURL, streamKey, offer string) (string, error) {
+	req, err := http.NewRequest("POST", upstreamURL, strings.NewReader(offer))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+streamKey)
+	req.Header.Set("Content-Type", "application/sdp")
+
+	res, err := (&http.Client{Timeout: relayHTTPTimeout}).Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return "", err
+	}
+
+	if res.StatusCode != http.StatusCreated && res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("upstream responded with HTTP StatusCode %d: %s", res.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	return string(body), nil
+}
+
+func closeWithError(peerConnection *webrtc.PeerConnection, err error) error {
+	if closeErr := peerConnection.Close(); closeErr != nil {
+		logger.Warn("Failed to close PeerConnection", "err", closeErr)
+	}
+
+	return err
+}
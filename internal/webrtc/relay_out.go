@@ -0,0 +1,171 @@
+package webrtc
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/glimesh/broadcast-box/internal/events"
+	"github.com/google/uuid"
+	"github.com/pion/webrtc/v4"
+)
+
+var errRelayOutStopped = errors.New("publisher is gone")
+
+// relayOut republishes the publisher of a stream to one of its whipOutputs. It is a WHEP session
+// of the stream that offers instead of answering, so the video is forwarded the same way.
+type relayOut struct {
+	targetURL string
+	streamKey string
+	stream    *stream
+
+	stopped  chan struct{}
+	stopOnce sync.Once
+}
+
+// startRelayOuts starts the whipOutputs of stream for a new publisher. The caller must hold streamMapLock.
+func (s *Server) startRelayOuts(streamKey string, stream *stream) {
+	stopRelayOuts(stream)
+
+	for _, targetURL := range stream.config.WHIPOutputs {
+		r := &relayOut{targetURL: targetURL, streamKey: streamKey, stream: stream, stopped: make(chan struct{})}
+		stream.relayOuts = append(stream.relayOuts, r)
+
+		go s.runRelayOut(r)
+	}
+}
+
+// stopRelayOuts disconnects the whipOutputs of the publisher. The caller must hold streamMapLock.
+func stopRelayOuts(stream *stream) {
+	for _, r := range stream.relayOuts {
+		r.stopOnce.Do(func() { close(r.stopped) })
+	}
+	stream.relayOuts = nil
+}
+
+// runRelayOut keeps the publisher relayed to targetURL, reconnecting until it is stopped
+func (s *Server) runRelayOut(r *relayOut) {
+	for {
+		disconnected, err := s.relayOut(r)
+		if errors.Is(err, errRelayOutStopped) {
+			return
+		} else if err != nil {
+			logger.Warn("Failed to relay stream", "streamKey", r.streamKey, "target", r.targetURL, "err", err)
+		} else {
+			select {
+			case <-disconnected:
+			case <-r.stopped:
+				return
+			}
+		}
+
+		select {
+		case <-r.stopped:
+			return
+		case <-time.After(relayRetryInterval):
+		}
+	}
+}
+
+// relayOut publishes to targetURL as a WHIP client, disconnected is closed once that PeerConnection is gone
+func (s *Server) relayOut(r *relayOut) (chan struct{}, error) {
+	peerConnection, err := s.newPeerConnection(false, r.streamKey)
+	if err != nil {
+		return nil, err
+	}
+
+	sendonly := webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionSendonly}
+	if _, err = peerConnection.AddTransceiverFromTrack(r.stream.audioTrack, sendonly); err != nil {
+		return nil, closeWithError(peerConnection, err)
+	}
+
+	videoTrack := &trackMultiCodec{id: "video", streamID: "pion"}
+	videoTransceiver, err := peerConnection.AddTransceiverFromTrack(videoTrack, sendonly)
+	if err != nil {
+		return nil, closeWithError(peerConnection, err)
+	}
+	receiverReport := &whepReceiverReport{}
+	go readWHEPRTCP(videoTransceiver.Sender(), r.stream, receiverReport)
+
+	offer, err := peerConnection.CreateOffer(nil)
+	if err != nil {
+		return nil, closeWithError(peerConnection, err)
+	}
+
+	gatherComplete := webrtc.GatheringCompletePromise(peerConnection)
+	if err = peerConnection.SetLocalDescription(offer); err != nil {
+		return nil, closeWithError(peerConnection, err)
+	}
+	<-gatherComplete
+
+	answer, err := postOffer(r.targetURL, r.streamKey, peerConnection.LocalDescription().SDP)
+	if err != nil {
+		return nil, closeWithError(peerConnection, err)
+	}
+
+	if err = peerConnection.SetRemoteDescription(webrtc.SessionDescription{
+		SDP:  answer,
+		Type: webrtc.SDPTypeAnswer,
+	}); err != nil {
+		return nil, closeWithError(peerConnection, err)
+	}
+
+	whepSessionId := uuid.New().String()
+	disconnected := make(chan struct{})
+	var disconnectedOnce sync.Once
+	peerConnection.OnICEConnectionStateChange(func(i webrtc.ICEConnectionState) {
+		if i == webrtc.ICEConnectionStateFailed || i == webrtc.ICEConnectionStateClosed {
+			if err := peerConnection.Close(); err != nil {
+				logger.Warn("Failed to close relay PeerConnection", "streamKey", r.streamKey, "err", err)
+			}
+			s.peerConnectionDisconnected(r.streamKey, whepSessionId)
+
+			disconnectedOnce.Do(func() { close(disconnected) })
+		}
+	})
+
+	session := &whepSession{peerConnection: peerConnection, videoTrack: videoTrack, timestamp: 50000, created: time.Now(), receiverReport: receiverReport}
+	session.currentLayer.Store("")
+	session.waitingForKeyframe.Store(true)
+	if !s.addRelayOutSession(r, whepSessionId, session) {
+		return nil, closeWithError(peerConnection, errRelayOutStopped)
+	}
+
+	// Closed with the other whipOutputs once the publisher is gone
+	go func() {
+		select {
+		case <-r.stopped:
+			if err := peerConnection.Close(); err != nil {
+				logger.Warn("Failed to close relay PeerConnection", "streamKey", r.streamKey, "err", err)
+			}
+		case <-disconnected:
+		}
+	}()
+
+	select {
+	case r.stream.pliChan <- true:
+	default:
+	}
+
+	logger.Info("Relaying stream", "streamKey", r.streamKey, "target", r.targetURL)
+	s.emitEvent(events.TypeViewerJoin, r.streamKey, whepSessionId, r.stream)
+	return disconnected, nil
+}
+
+// addRelayOutSession adds session to the WHEP sessions of the stream, unless the publisher is gone
+func (s *Server) addRelayOutSession(r *relayOut, whepSessionId string, session *whepSession) bool {
+	s.streamMapLock.Lock()
+	defer s.streamMapLock.Unlock()
+
+	select {
+	case <-r.stopped:
+		return false
+	default:
+	}
+
+	r.stream.whepSessionsLock.Lock()
+	r.stream.whepSessions[whepSessionId] = session
+	r.stream.whepSessionsLock.Unlock()
+
+	return true
+}
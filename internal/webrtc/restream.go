@@ -0,0 +1,179 @@
+package webrtc
+
+import (
+	"errors"
+	"time"
+
+	"github.com/glimesh/broadcast-box/internal/rtmp"
+	"github.com/google/uuid"
+)
+
+var ErrRestreamTargetNotFound = errors.New("restream target does not exist")
+
+// RestreamTarget is an RTMP server, like Twitch or YouTube, a stream is pushed to while it is published
+type RestreamTarget struct {
+	ID  string `json:"id"`
+	URL string `json:"url"`
+
+	// Send Opus audio as Enhanced RTMP, otherwise only video is pushed
+	Opus bool `json:"opus"`
+
+	// If the target is currently being published to
+	Connected bool `json:"connected"`
+}
+
+// restreamOutput adapts a Pusher to a mediaSink
+type restreamOutput struct {
+	pusher *rtmp.Pusher
+}
+
+// The Pusher drops what can't be sent, so writes don't fail
+func (o restreamOutput) WriteH264(pts time.Duration, accessUnit []byte) {
+	_ = o.pusher.WriteH264(accessUnit, pts)
+}
+
+func (o restreamOutput) WriteOpus(pts time.Duration, packet []byte) {
+	_ = o.pusher.WriteOpus(packet, pts)
+}
+
+func (o restreamOutput) Close() {
+	o.pusher.Close()
+}
+
+func newRestreamOutput(target RestreamTarget) (restreamOutput, error) {
+	pusher, err := rtmp.NewPusher(target.URL, target.Opus)
+	return restreamOutput{pusher: pusher}, err
+}
+
+// newRestreams starts pushing to the targets of streamKey for a new publisher
+func (s *Server) newRestreams(streamKey string) map[string]mediaSink {
+	s.restreamTargetsLock.Lock()
+	defer s.restreamTargetsLock.Unlock()
+
+	restreams := map[string]mediaSink{}
+	for _, target := range s.restreamTargets[streamKey] {
+		// Targets are validated when they are added
+		if output, err := newRestreamOutput(target); err == nil {
+			restreams[target.ID] = output
+		}
+	}
+
+	return restreams
+}
+
+// AddRestreamTarget pushes streamKey to the RTMP URL targetURL whenever it is published, starting
+// now if it is live. Targets are kept in memory, they are gone once the server restarts.
+func AddRestreamTarget(streamKey, targetURL string, opus bool) (RestreamTarget, error) {
+	return defaultServer.AddRestreamTarget(streamKey, targetURL, opus)
+}
+
+func (s *Server) AddRestreamTarget(streamKey, targetURL string, opus bool) (RestreamTarget, error) {
+	target := RestreamTarget{ID: uuid.New().String(), URL: targetURL, Opus: opus}
+
+	// Validates the URL before it is stored
+	output, err := newRestreamOutput(target)
+	if err != nil {
+		return RestreamTarget{}, err
+	}
+
+	s.streamMapLock.Lock()
+	defer s.streamMapLock.Unlock()
+
+	s.restreamTargetsLock.Lock()
+	s.restreamTargets[streamKey] = append(s.restreamTargets[streamKey], target)
+	s.restreamTargetsLock.Unlock()
+
+	stream, ok := s.streamMap[streamKey]
+	if !ok || !stream.hasWHIPClient.Load() {
+		output.Close()
+		return target, nil
+	}
+
+	tap := stream.tap.Load()
+	if tap == nil {
+		tap = &mediaTap{start: time.Now(), restreams: map[string]mediaSink{}}
+		stream.tap.Store(tap)
+	}
+
+	tap.restreamsLock.Lock()
+	tap.restreams[target.ID] = output
+	tap.restreamsLock.Unlock()
+
+	return target, nil
+}
+
+// RestreamTargets returns the targets streamKey is pushed to
+func RestreamTargets(streamKey string) []RestreamTarget {
+	return defaultServer.RestreamTargets(streamKey)
+}
+
+func (s *Server) RestreamTargets(streamKey string) []RestreamTarget {
+	s.streamMapLock.Lock()
+	defer s.streamMapLock.Unlock()
+
+	var tap *mediaTap
+	if stream, ok := s.streamMap[streamKey]; ok && stream.hasWHIPClient.Load() {
+		tap = stream.tap.Load()
+	}
+
+	s.restreamTargetsLock.Lock()
+	defer s.restreamTargetsLock.Unlock()
+
+	targets := []RestreamTarget{}
+	for _, target := range s.restreamTargets[streamKey] {
+		if tap != nil {
+			tap.restreamsLock.Lock()
+			if output, ok := tap.restreams[target.ID].(restreamOutput); ok {
+				target.Connected = output.pusher.Connected()
+			}
+			tap.restreamsLock.Unlock()
+		}
+
+		targets = append(targets, target)
+	}
+
+	return targets
+}
+
+// RemoveRestreamTarget stops pushing streamKey to the target with id
+func RemoveRestreamTarget(streamKey, id string) error {
+	return defaultServer.RemoveRestreamTarget(streamKey, id)
+}
+
+func (s *Server) RemoveRestreamTarget(streamKey, id string) error {
+	s.streamMapLock.Lock()
+	defer s.streamMapLock.Unlock()
+
+	s.restreamTargetsLock.Lock()
+	targets := s.restreamTargets[streamKey]
+	found := false
+	for i := range targets {
+		if targets[i].ID == id {
+			found = true
+			s.restreamTargets[streamKey] = append(targets[:i:i], targets[i+1:]...)
+			break
+		}
+	}
+
+	if len(s.restreamTargets[streamKey]) == 0 {
+		delete(s.restreamTargets, streamKey)
+	}
+	s.restreamTargetsLock.Unlock()
+
+	if !found {
+		return ErrRestreamTargetNotFound
+	}
+
+	if stream, ok := s.streamMap[streamKey]; ok {
+		if tap := stream.tap.Load(); tap != nil {
+			tap.restreamsLock.Lock()
+			if output, ok := tap.restreams[id]; ok {
+				output.Close()
+				delete(tap.restreams, id)
+			}
+			tap.restreamsLock.Unlock()
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,117 @@
+package webrtc
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// How often RECORDING_DIRECTORY is checked for recordings to prune
+	recordingRetentionInterval = time.Minute
+
+	// Files written to this recently are being recorded or were just finished, they are never
+	// pruned
+	recordingRetentionGrace = time.Minute
+)
+
+// Files written by recorder.Recorder, the groups are the stream key (or stream key and RID with
+// recordLayer `all`) and the UTC time the file was started
+var recordingFileName = regexp.MustCompile(`^(.+)-(\d{8}-\d{6})(-\d+)?\.(webm|mp4|ivf|ogg)$`)
+
+type recordingFile struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// runRecordingRetention prunes recordings older than RECORDING_MAX_AGE and the oldest ones of a
+// stream key above RECORDING_MAX_BYTES, forever
+func (s *Server) runRecordingRetention() {
+	ticker := time.NewTicker(recordingRetentionInterval)
+	defer ticker.Stop()
+
+	for {
+		s.pruneRecordings(time.Now())
+
+		select {
+		case <-ticker.C:
+		case <-s.closed:
+			return
+		}
+	}
+}
+
+func (s *Server) pruneRecordings(now time.Time) {
+	entries, err := os.ReadDir(s.recordingDirectory)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Warn("Failed to prune recordings", "err", err)
+		}
+		return
+	}
+
+	recordings := map[string][]recordingFile{}
+	for _, entry := range entries {
+		match := recordingFileName.FindStringSubmatch(entry.Name())
+		if match == nil || !entry.Type().IsRegular() {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		recordings[match[1]] = append(recordings[match[1]], recordingFile{
+			path:    filepath.Join(s.recordingDirectory, entry.Name()),
+			size:    info.Size(),
+			modTime: info.ModTime(),
+		})
+	}
+
+	for _, files := range recordings {
+		sort.Slice(files, func(i, j int) bool { return files[i].modTime.After(files[j].modTime) })
+
+		// The newest files are kept until they add up to the limit
+		total := int64(0)
+		for _, f := range files {
+			total += f.size
+
+			age := now.Sub(f.modTime)
+			if age < recordingRetentionGrace {
+				continue
+			} else if (s.recordingMaxAge == 0 || age <= s.recordingMaxAge) && (s.recordingMaxBytes == 0 || total <= s.recordingMaxBytes) {
+				continue
+			}
+
+			if err := removeRecording(f.path); err != nil && !os.IsNotExist(err) {
+				logger.Warn("Failed to prune recording", "path", f.path, "err", err)
+			} else if err == nil {
+				logger.Info("Pruned recording", "path", f.path)
+			}
+		}
+	}
+}
+
+// parseByteSize parses a number of bytes with an optional K, M, G or T suffix for powers of 1024
+func parseByteSize(val string) (int64, error) {
+	multiplier := int64(1)
+	if i := strings.IndexAny(val, "KMGT"); i != -1 && i == len(val)-1 {
+		multiplier = 1 << (10 * (strings.Index("KMGT", val[i:]) + 1))
+		val = val[:i]
+	}
+
+	size, err := strconv.ParseInt(val, 10, 64)
+	if err != nil {
+		return 0, err
+	} else if size < 0 {
+		return 0, fmt.Errorf("size must not be negative, got %d", size)
+	}
+
+	return size * multiplier, nil
+}
@@ -0,0 +1,168 @@
+package webrtc
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/pion/rtp"
+)
+
+const (
+	rtpForwardVideoPayloadType = 96
+	rtpForwardAudioPayloadType = 111
+)
+
+// rtpForward sends a copy of the RTP of a publisher to the rtpForward address of its stream,
+// so it can be processed by GStreamer or FFmpeg. Video is sent to the port, audio to the port
+// after its RTCP port, and an SDP file describing both is written once the video codec is known.
+type rtpForward struct {
+	conn                 *net.UDPConn
+	videoAddr, audioAddr *net.UDPAddr
+	sdpFile              string
+	streamKey            string
+
+	videoLock  sync.Mutex
+	videoRID   string
+	videoSSRC  uint32
+	sdpWritten bool
+
+	audioLock sync.Mutex
+	audioSSRC uint32
+}
+
+// newRTPForward starts forwarding the publisher of streamKey, nil if it isn't configured
+func newRTPForward(streamKey string, config streamConfig) *rtpForward {
+	if config.RTPForward == "" {
+		return nil
+	}
+
+	videoAddr, err := net.ResolveUDPAddr("udp", config.RTPForward)
+	if err != nil {
+		logger.Error("Failed to start RTP forward", "streamKey", streamKey, "err", err)
+		return nil
+	}
+
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		logger.Error("Failed to start RTP forward", "streamKey", streamKey, "err", err)
+		return nil
+	}
+
+	sdpFile := config.RTPForwardSDP
+	if sdpFile == "" {
+		sdpFile = filepath.Join(os.TempDir(), "broadcast-box-"+streamKey+".sdp")
+	}
+
+	return &rtpForward{
+		conn:      conn,
+		videoAddr: videoAddr,
+		audioAddr: &net.UDPAddr{IP: videoAddr.IP, Port: videoAddr.Port + 2, Zone: videoAddr.Zone},
+		sdpFile:   sdpFile,
+		streamKey: streamKey,
+		videoSSRC: rand.Uint32(),
+		audioSSRC: rand.Uint32(),
+	}
+}
+
+// writeVideo forwards the first video layer of the publisher, others are skipped
+func (f *rtpForward) writeVideo(rtpPkt *rtp.Packet, rid string, codec videoTrackCodec) {
+	f.videoLock.Lock()
+	defer f.videoLock.Unlock()
+
+	if f.videoRID == "" {
+		f.videoRID = rid
+	} else if rid != f.videoRID {
+		return
+	}
+
+	if !f.sdpWritten {
+		f.sdpWritten = true
+		f.writeSDP(codec)
+	}
+
+	f.write(f.videoAddr, rtpPkt, rtpForwardVideoPayloadType, f.videoSSRC)
+}
+
+func (f *rtpForward) writeAudio(rtpPkt *rtp.Packet) {
+	f.audioLock.Lock()
+	defer f.audioLock.Unlock()
+
+	f.write(f.audioAddr, rtpPkt, rtpForwardAudioPayloadType, f.audioSSRC)
+}
+
+// write sends rtpPkt with the payload type and SSRC of the SDP
+func (f *rtpForward) write(addr *net.UDPAddr, rtpPkt *rtp.Packet, payloadType uint8, ssrc uint32) {
+	header := rtpPkt.Header
+	header.PayloadType = payloadType
+	header.SSRC = ssrc
+	header.Extension = false
+	header.Extensions = nil
+
+	out, err := (&rtp.Packet{Header: header, Payload: rtpPkt.Payload}).Marshal()
+	if err != nil {
+		return
+	}
+
+	// Nobody listening isn't an error, the pipeline can be started later
+	_, _ = f.conn.WriteToUDP(out, addr)
+}
+
+// rtpEncoding returns the SDP rtpmap encoding and fmtp of codec, as forwarded from publishers
+func rtpEncoding(codec videoTrackCodec) (rtpmap, fmtp string) {
+	switch codec {
+	case videoTrackCodecH264:
+		return "H264/90000", "packetization-mode=1"
+	case videoTrackCodecVP8:
+		return "VP8/90000", ""
+	case videoTrackCodecVP9:
+		return "VP9/90000", ""
+	case videoTrackCodecAV1:
+		return "AV1/90000", ""
+	case videoTrackCodecH265:
+		return "H265/90000", ""
+	}
+
+	return "", ""
+}
+
+func (f *rtpForward) writeSDP(codec videoTrackCodec) {
+	rtpmap, fmtp := rtpEncoding(codec)
+
+	addrType := "IP4"
+	if f.videoAddr.IP.To4() == nil && f.videoAddr.IP != nil {
+		addrType = "IP6"
+	}
+
+	host := "127.0.0.1"
+	if f.videoAddr.IP != nil {
+		host = f.videoAddr.IP.String()
+	}
+
+	sdp := "v=0\r\n" +
+		"o=- 0 0 IN " + addrType + " " + host + "\r\n" +
+		"s=" + f.streamKey + "\r\n" +
+		"c=IN " + addrType + " " + host + "\r\n" +
+		"t=0 0\r\n" +
+		fmt.Sprintf("m=video %d RTP/AVP %d\r\n", f.videoAddr.Port, rtpForwardVideoPayloadType) +
+		fmt.Sprintf("a=rtpmap:%d %s\r\n", rtpForwardVideoPayloadType, rtpmap)
+	if fmtp != "" {
+		sdp += fmt.Sprintf("a=fmtp:%d %s\r\n", rtpForwardVideoPayloadType, fmtp)
+	}
+	sdp += fmt.Sprintf("m=audio %d RTP/AVP %d\r\n", f.audioAddr.Port, rtpForwardAudioPayloadType) +
+		fmt.Sprintf("a=rtpmap:%d opus/48000/2\r\n", rtpForwardAudioPayloadType)
+
+	if err := os.WriteFile(f.sdpFile, []byte(sdp), 0o644); err != nil {
+		logger.Error("Failed to write RTP forward SDP", "streamKey", f.streamKey, "err", err)
+		return
+	}
+
+	logger.Info("Forwarding RTP", "streamKey", f.streamKey, "addr", f.videoAddr, "sdpFile", f.sdpFile)
+}
+
+func (f *rtpForward) close() {
+	f.conn.Close()
+}
@@ -0,0 +1,172 @@
+package webrtc
+
+import (
+	"sync"
+
+	"github.com/glimesh/broadcast-box/internal/rtsp"
+	"github.com/pion/rtp"
+)
+
+const (
+	rtspMediaVideo = iota
+	rtspMediaAudio
+)
+
+// rtspPlayer sends the RTP of a publisher to one RTSP client, it ends with the publisher
+type rtspPlayer struct {
+	stream *stream
+	media  []rtsp.Media
+
+	lock               sync.Mutex
+	write              func(media int, packet []byte)
+	videoRID           string
+	waitingForKeyframe bool
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// RTSPPlayer returns a Player of the publisher of streamKey for the RTSP server
+func RTSPPlayer(streamKey string) (rtsp.Player, error) {
+	return defaultServer.RTSPPlayer(streamKey)
+}
+
+func (s *Server) RTSPPlayer(streamKey string) (rtsp.Player, error) {
+	s.streamMapLock.Lock()
+	defer s.streamMapLock.Unlock()
+
+	stream, ok := s.streamMap[streamKey]
+	if !ok || !stream.hasWHIPClient.Load() {
+		return nil, ErrStreamNotFound
+	}
+
+	// The video track may not have arrived yet, most publishers send H264
+	codec := videoTrackCodecH264
+	if len(stream.videoTracks) != 0 {
+		codec = stream.videoTracks[0].codec
+	}
+	encoding, fmtp := rtpEncoding(codec)
+
+	p := &rtspPlayer{
+		stream: stream,
+		media: []rtsp.Media{
+			rtspMediaVideo: {Encoding: encoding, Fmtp: fmtp},
+			rtspMediaAudio: {Audio: true, Encoding: "opus/48000/2"},
+		},
+		done: make(chan struct{}),
+	}
+
+	stream.rtspPlayersLock.Lock()
+	stream.rtspPlayers[p] = struct{}{}
+	stream.rtspPlayersLock.Unlock()
+
+	return p, nil
+}
+
+func (p *rtspPlayer) Media() []rtsp.Media {
+	return p.media
+}
+
+// Play starts sending with the next keyframe, which is requested from the publisher
+func (p *rtspPlayer) Play(write func(media int, packet []byte)) {
+	p.lock.Lock()
+	p.write = write
+	p.waitingForKeyframe = true
+	p.lock.Unlock()
+
+	select {
+	case p.stream.pliChan <- true:
+	default:
+	}
+}
+
+func (p *rtspPlayer) Close() {
+	p.closeOnce.Do(func() {
+		close(p.done)
+
+		p.stream.rtspPlayersLock.Lock()
+		delete(p.stream.rtspPlayers, p)
+		p.stream.rtspPlayersLock.Unlock()
+	})
+}
+
+func (p *rtspPlayer) Done() <-chan struct{} {
+	return p.done
+}
+
+// writeVideo sends the first video layer of the publisher, others are skipped
+func (p *rtspPlayer) writeVideo(packet []byte, rid string, isKeyframe bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.write == nil {
+		return
+	}
+
+	if p.videoRID == "" {
+		p.videoRID = rid
+	} else if rid != p.videoRID {
+		return
+	}
+
+	if p.waitingForKeyframe {
+		if !isKeyframe {
+			return
+		}
+		p.waitingForKeyframe = false
+	}
+
+	p.write(rtspMediaVideo, packet)
+}
+
+func (p *rtspPlayer) writeAudio(packet []byte) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.write != nil {
+		p.write(rtspMediaAudio, packet)
+	}
+}
+
+// writeRTSPVideo sends a packet of the publisher to the RTSP players of stream, before WHEP
+// sessions rewrite its sequence number and timestamp
+func (s *stream) writeRTSPVideo(rtpPkt *rtp.Packet, rid string, isKeyframe bool) {
+	s.rtspPlayersLock.RLock()
+	defer s.rtspPlayersLock.RUnlock()
+
+	if len(s.rtspPlayers) == 0 {
+		return
+	}
+
+	packet, err := rtpPkt.Marshal()
+	if err != nil {
+		return
+	}
+
+	for p := range s.rtspPlayers {
+		p.writeVideo(packet, rid, isKeyframe)
+	}
+}
+
+func (s *stream) writeRTSPAudio(packet []byte) {
+	s.rtspPlayersLock.RLock()
+	defer s.rtspPlayersLock.RUnlock()
+
+	for p := range s.rtspPlayers {
+		p.writeAudio(packet)
+	}
+}
+
+// closeRTSPPlayers ends the RTSP players of stream once its publisher is gone
+func closeRTSPPlayers(stream *stream) {
+	stream.rtspPlayersLock.RLock()
+	players := make([]*rtspPlayer, 0, len(stream.rtspPlayers))
+	for p := range stream.rtspPlayers {
+		players = append(players, p)
+	}
+	stream.rtspPlayersLock.RUnlock()
+
+	for _, p := range players {
+		p.Close()
+	}
+}
@@ -0,0 +1,46 @@
+package webrtc
+
+import "github.com/glimesh/broadcast-box/internal/segmenter"
+
+func (s *Server) streamSegmenter(streamKey string) (*segmenter.Segmenter, error) {
+	s.streamMapLock.Lock()
+	defer s.streamMapLock.Unlock()
+
+	stream, ok := s.streamMap[streamKey]
+	if !ok {
+		return nil, ErrStreamNotFound
+	}
+
+	tap := stream.tap.Load()
+	if tap == nil || tap.segmenter == nil {
+		return nil, ErrStreamNotFound
+	}
+
+	return tap.segmenter, nil
+}
+
+// HLS returns the segmenter serving streamKey over HLS
+func HLS(streamKey string) (*segmenter.Segmenter, error) {
+	return defaultServer.HLS(streamKey)
+}
+
+func (s *Server) HLS(streamKey string) (*segmenter.Segmenter, error) {
+	if s.hlsDisabled {
+		return nil, ErrStreamNotFound
+	}
+
+	return s.streamSegmenter(streamKey)
+}
+
+// DASH returns the segmenter serving streamKey over MPEG-DASH
+func DASH(streamKey string) (*segmenter.Segmenter, error) {
+	return defaultServer.DASH(streamKey)
+}
+
+func (s *Server) DASH(streamKey string) (*segmenter.Segmenter, error) {
+	if s.dashDisabled {
+		return nil, ErrStreamNotFound
+	}
+
+	return s.streamSegmenter(streamKey)
+}
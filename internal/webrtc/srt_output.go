@@ -0,0 +1,50 @@
+package webrtc
+
+import (
+	"sync"
+	"time"
+
+	"github.com/glimesh/broadcast-box/internal/mpegts"
+	"github.com/glimesh/broadcast-box/internal/srt"
+)
+
+// srtOutput muxes the media of a publisher into MPEG-TS for one of the srtOutputs of its stream
+type srtOutput struct {
+	lock   sync.Mutex
+	muxer  *mpegts.Muxer
+	output *srt.Output
+}
+
+// newSRTOutputs starts the configured outputs of streamKey, invalid ones are logged and skipped
+func newSRTOutputs(streamKey string, outputURLs []string) (sinks []mediaSink) {
+	for _, outputURL := range outputURLs {
+		output, err := srt.NewOutput(outputURL)
+		if err != nil {
+			logger.Error("Failed to start SRT output", "streamKey", streamKey, "err", err)
+			continue
+		}
+
+		sinks = append(sinks, &srtOutput{muxer: mpegts.NewMuxer(output), output: output})
+	}
+
+	return sinks
+}
+
+// The Output drops what can't be sent, so writes don't fail
+func (o *srtOutput) WriteH264(pts time.Duration, accessUnit []byte) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	_ = o.muxer.WriteH264(accessUnit, pts)
+}
+
+func (o *srtOutput) WriteOpus(pts time.Duration, packet []byte) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	_ = o.muxer.WriteOpus(packet, pts)
+}
+
+func (o *srtOutput) Close() {
+	o.output.Close()
+}
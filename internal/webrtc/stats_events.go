@@ -0,0 +1,50 @@
+package webrtc
+
+import (
+	"time"
+
+	"github.com/glimesh/broadcast-box/internal/events"
+)
+
+// emitStatsEvents emits a stream_stats event for every stream with a publisher each interval
+func (s *Server) emitStatsEvents(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.closed:
+			return
+		}
+
+		s.streamMapLock.Lock()
+		statsEvents := []events.Event{}
+		for streamKey, stream := range s.streamMap {
+			if !stream.hasWHIPClient.Load() {
+				continue
+			}
+
+			stats := &events.Stats{AudioBitrate: stream.audioBitrate.bitsPerSecond()}
+			for _, videoTrack := range stream.videoTracks {
+				stats.VideoBitrate += videoTrack.bitrate.bitsPerSecond()
+			}
+			if !stream.publisherConnectedTime.IsZero() {
+				stats.PublishedSeconds = time.Since(stream.publisherConnectedTime).Seconds()
+			}
+
+			stream.whepSessionsLock.RLock()
+			stats.Viewers = len(stream.whepSessions)
+			stream.whepSessionsLock.RUnlock()
+
+			e := newEvent(events.TypeStreamStats, streamKey, "", stream)
+			e.Stats = stats
+			statsEvents = append(statsEvents, e)
+		}
+		s.streamMapLock.Unlock()
+
+		for _, e := range statsEvents {
+			s.events.Emit(e)
+		}
+	}
+}
@@ -0,0 +1,268 @@
+package webrtc
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/glimesh/broadcast-box/internal/recorder"
+)
+
+// streamConfig is the per-stream policy that outlives media sessions. It is
+// stored in STREAM_CONFIG_FILE as a JSON object keyed by stream key.
+type streamConfig struct {
+	Title string `json:"title,omitempty"`
+
+	// Upper bound in bits per second signaled to the publisher via REMB
+	MaxBitrate uint64 `json:"maxBitrate,omitempty"`
+
+	// Overrides KEYFRAME_INTERVAL, like `2s`. `0s` disables it for this stream
+	KeyframeInterval string `json:"keyframeInterval,omitempty"`
+
+	// Overrides MAX_STREAM_DURATION, like `4h`. `0s` removes the limit for this stream
+	MaxDuration string `json:"maxDuration,omitempty"`
+
+	// Overrides DVR_WINDOW, like `30m`
+	DVRWindow string `json:"dvrWindow,omitempty"`
+
+	// RTSP URL, like of an IP camera, that is pulled and published under this stream key
+	RTSPSource string `json:"rtspSource,omitempty"`
+
+	// IVF, Ogg or WebM files that are played in real time and published under this stream key,
+	// like a video file and its audio file. See file.Play
+	FileSource     []string `json:"fileSource,omitempty"`
+	FileSourceLoop bool     `json:"fileSourceLoop,omitempty"`
+
+	// IVF, Ogg or WebM files that are played one after another on loop while the stream has no
+	// other publisher, like a 24/7 channel of recordings. See file.PlayPlaylist
+	Playlist []string `json:"playlist,omitempty"`
+
+	// Publish a generated test pattern under this stream key, see testsrc.Play
+	TestPattern bool `json:"testPattern,omitempty"`
+
+	// Bearer tokens viewers play this stream with instead of the stream key, replacing the ones
+	// of WHEP_TOKENS and WHEP_TOKEN_FILE
+	ViewerTokens []string `json:"viewerTokens,omitempty"`
+
+	// CIDRs or addresses publishers and viewers may connect from or are rejected from,
+	// replacing WHIP_ALLOW_CIDRS, WHIP_DENY_CIDRS, WHEP_ALLOW_CIDRS and WHEP_DENY_CIDRS
+	WHIPAllow []string `json:"whipAllow,omitempty"`
+	WHIPDeny  []string `json:"whipDeny,omitempty"`
+	WHEPAllow []string `json:"whepAllow,omitempty"`
+	WHEPDeny  []string `json:"whepDeny,omitempty"`
+
+	// ISO 3166-1 alpha-2 codes of the countries viewers may watch from or not, looked up in
+	// GEOIP_DATABASE
+	AllowCountries []string `json:"allowCountries,omitempty"`
+	BlockCountries []string `json:"blockCountries,omitempty"`
+
+	// Origins of the sites WHEP players may embed this stream on, like `https://example.com`
+	AllowedOrigins []string `json:"allowedOrigins,omitempty"`
+
+	// Reject video m-lines of publishers and viewers, for radio-style streams
+	AudioOnly bool `json:"audioOnly,omitempty"`
+
+	// Record every publisher to RECORDING_DIRECTORY, see recorder.New
+	Record bool `json:"record,omitempty"`
+
+	// Overrides RECORDING_FORMAT, `container` or `raw`
+	RecordFormat string `json:"recordFormat,omitempty"`
+
+	// RID of the simulcast layer that is recorded, `all` records every layer to its own files.
+	// The first layer that arrives by default
+	RecordLayer string `json:"recordLayer,omitempty"`
+
+	// SRT URLs the stream is sent to as MPEG-TS while it is published, see srt.NewOutput
+	SRTOutputs []string `json:"srtOutputs,omitempty"`
+
+	// WHIP endpoints, like another Broadcast Box's /api/whip, the stream is republished to
+	// with the same stream key while it is published
+	WHIPOutputs []string `json:"whipOutputs,omitempty"`
+
+	// UDP address, like `127.0.0.1:5004`, the RTP of the publisher is copied to. See rtpForward
+	RTPForward    string `json:"rtpForward,omitempty"`
+	RTPForwardSDP string `json:"rtpForwardSDP,omitempty"`
+}
+
+func (s *Server) loadStreamConfigs(streamConfigFile string) error {
+	s.streamConfigsLock.Lock()
+	defer s.streamConfigsLock.Unlock()
+
+	s.streamConfigs = map[string]streamConfig{}
+
+	if streamConfigFile == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(streamConfigFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, &s.streamConfigs)
+}
+
+func (s *Server) getStreamConfig(streamKey string) streamConfig {
+	s.streamConfigsLock.RLock()
+	defer s.streamConfigsLock.RUnlock()
+
+	return s.streamConfigs[streamKey]
+}
+
+// RTSPSources returns the rtspSource of every configured stream, keyed by stream key
+func (s *Server) RTSPSources() map[string]string {
+	s.streamConfigsLock.RLock()
+	defer s.streamConfigsLock.RUnlock()
+
+	sources := map[string]string{}
+	for streamKey, config := range s.streamConfigs {
+		if config.RTSPSource != "" {
+			sources[streamKey] = config.RTSPSource
+		}
+	}
+
+	return sources
+}
+
+// FileSource is the fileSource of a configured stream
+type FileSource struct {
+	Paths []string
+	Loop  bool
+}
+
+// FileSources returns the fileSource of every configured stream, keyed by stream key
+func (s *Server) FileSources() map[string]FileSource {
+	s.streamConfigsLock.RLock()
+	defer s.streamConfigsLock.RUnlock()
+
+	sources := map[string]FileSource{}
+	for streamKey, config := range s.streamConfigs {
+		if len(config.FileSource) != 0 {
+			sources[streamKey] = FileSource{Paths: config.FileSource, Loop: config.FileSourceLoop}
+		}
+	}
+
+	return sources
+}
+
+// Playlists returns the playlist of every configured stream, keyed by stream key
+func (s *Server) Playlists() map[string][]string {
+	s.streamConfigsLock.RLock()
+	defer s.streamConfigsLock.RUnlock()
+
+	playlists := map[string][]string{}
+	for streamKey, config := range s.streamConfigs {
+		if len(config.Playlist) != 0 {
+			playlists[streamKey] = config.Playlist
+		}
+	}
+
+	return playlists
+}
+
+// TestPatterns returns the stream keys that are configured with testPattern
+func (s *Server) TestPatterns() []string {
+	s.streamConfigsLock.RLock()
+	defer s.streamConfigsLock.RUnlock()
+
+	streamKeys := []string{}
+	for streamKey, config := range s.streamConfigs {
+		if config.TestPattern {
+			streamKeys = append(streamKeys, streamKey)
+		}
+	}
+
+	return streamKeys
+}
+
+// ViewerTokens returns the viewerTokens of every configured stream, keyed by stream key
+func (s *Server) ViewerTokens() map[string][]string {
+	s.streamConfigsLock.RLock()
+	defer s.streamConfigsLock.RUnlock()
+
+	tokens := map[string][]string{}
+	for streamKey, config := range s.streamConfigs {
+		if len(config.ViewerTokens) != 0 {
+			tokens[streamKey] = config.ViewerTokens
+		}
+	}
+
+	return tokens
+}
+
+// IPLists are the whipAllow, whipDeny, whepAllow and whepDeny of a configured stream
+type IPLists struct {
+	WHIPAllow, WHIPDeny, WHEPAllow, WHEPDeny []string
+}
+
+// StreamIPLists returns the IPLists of streamKey, which are empty if it isn't configured
+func (s *Server) StreamIPLists(streamKey string) IPLists {
+	config := s.getStreamConfig(streamKey)
+	return IPLists{WHIPAllow: config.WHIPAllow, WHIPDeny: config.WHIPDeny, WHEPAllow: config.WHEPAllow, WHEPDeny: config.WHEPDeny}
+}
+
+// StreamCountries returns the allowCountries and blockCountries of streamKey
+func (s *Server) StreamCountries(streamKey string) (allow, block []string) {
+	config := s.getStreamConfig(streamKey)
+	return config.AllowCountries, config.BlockCountries
+}
+
+// StreamAllowedOrigins returns the allowedOrigins of streamKey
+func (s *Server) StreamAllowedOrigins(streamKey string) []string {
+	return s.getStreamConfig(streamKey).AllowedOrigins
+}
+
+// Parses the per-stream value of a duration setting, falling back to the environment variable
+func parseStreamDuration(value, envKey string) time.Duration {
+	if value == "" {
+		value = os.Getenv(envKey)
+	}
+
+	if value == "" {
+		return 0
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		logger.Warn("Invalid duration in stream config", "key", envKey, "err", err)
+		return 0
+	}
+
+	return d
+}
+
+// keyframeInterval is how often a keyframe is requested from the publisher, 0 if never
+func (c streamConfig) keyframeInterval() time.Duration {
+	return parseStreamDuration(c.KeyframeInterval, "KEYFRAME_INTERVAL")
+}
+
+// maxDuration is how long the stream may be published for, 0 if unlimited
+func (c streamConfig) maxDuration() time.Duration {
+	return parseStreamDuration(c.MaxDuration, "MAX_STREAM_DURATION")
+}
+
+// dvrWindow is how far behind live HLS and DASH viewers can rewind, 0 for the last few segments
+func (c streamConfig) dvrWindow() time.Duration {
+	return parseStreamDuration(c.DVRWindow, "DVR_WINDOW")
+}
+
+// recordingFormat is how publishers are recorded, see recorder.Format
+func (c streamConfig) recordingFormat() recorder.Format {
+	value := c.RecordFormat
+	if value == "" {
+		value = os.Getenv("RECORDING_FORMAT")
+	}
+
+	switch value {
+	case "", "container":
+		return recorder.FormatContainer
+	case "raw":
+		return recorder.FormatRaw
+	default:
+		logger.Warn("Unknown recording format, recording to containers instead", "value", value)
+		return recorder.FormatContainer
+	}
+}
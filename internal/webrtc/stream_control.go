@@ -0,0 +1,130 @@
+package webrtc
+
+import (
+	"errors"
+	"time"
+)
+
+const manualKeyframeMinInterval = time.Second
+
+var (
+	ErrStreamNotFound         = errors.New("stream does not exist or has no publisher")
+	ErrKeyframeRequestLimited = errors.New("keyframe requested too recently")
+	ErrWHEPSessionNotFound    = errors.New("WHEP session does not exist")
+)
+
+// RequestKeyframe asks the publisher of streamKey to send a keyframe. Requests
+// are limited to one per manualKeyframeMinInterval so they can't be used to
+// hammer the publisher.
+func RequestKeyframe(streamKey string) error {
+	return defaultServer.RequestKeyframe(streamKey)
+}
+
+func (s *Server) RequestKeyframe(streamKey string) error {
+	s.streamMapLock.Lock()
+	defer s.streamMapLock.Unlock()
+
+	stream, ok := s.streamMap[streamKey]
+	if !ok || !stream.hasWHIPClient.Load() {
+		return ErrStreamNotFound
+	}
+
+	now := time.Now().UnixNano()
+	last := stream.lastManualKeyframeRequest.Load()
+	if now-last < int64(manualKeyframeMinInterval) || !stream.lastManualKeyframeRequest.CompareAndSwap(last, now) {
+		return ErrKeyframeRequestLimited
+	}
+
+	select {
+	case stream.pliChan <- true:
+	default:
+	}
+
+	return nil
+}
+
+// DisconnectWHEPSession closes the WHEP session of streamKey, the viewer may connect again
+func DisconnectWHEPSession(streamKey, whepSessionId string) error {
+	return defaultServer.DisconnectWHEPSession(streamKey, whepSessionId)
+}
+
+func (s *Server) DisconnectWHEPSession(streamKey, whepSessionId string) error {
+	s.streamMapLock.Lock()
+	var whepSession *whepSession
+	if stream, ok := s.streamMap[streamKey]; ok {
+		stream.whepSessionsLock.RLock()
+		whepSession = stream.whepSessions[whepSessionId]
+		stream.whepSessionsLock.RUnlock()
+	}
+	s.streamMapLock.Unlock()
+
+	if whepSession == nil {
+		return ErrWHEPSessionNotFound
+	}
+
+	logger.Info("Disconnecting WHEP session", "streamKey", streamKey, "whepSessionId", whepSessionId)
+	if err := whepSession.peerConnection.Close(); err != nil {
+		logger.Warn("Failed to close WHEP PeerConnection", "streamKey", streamKey, "whepSessionId", whepSessionId, "err", err)
+	}
+	s.peerConnectionDisconnected(streamKey, whepSessionId)
+
+	return nil
+}
+
+// DisconnectPublisher closes the publisher of streamKey. WHEP sessions stay connected and
+// play the next publisher, stream keys that mustn't be published again have to be disabled.
+func DisconnectPublisher(streamKey string) error {
+	return defaultServer.DisconnectPublisher(streamKey)
+}
+
+func (s *Server) DisconnectPublisher(streamKey string) error {
+	s.streamMapLock.Lock()
+	var closePublisher func()
+	if stream, ok := s.streamMap[streamKey]; ok && stream.hasWHIPClient.Load() {
+		closePublisher = stream.closePublisher
+	}
+	s.streamMapLock.Unlock()
+
+	if closePublisher == nil {
+		return ErrStreamNotFound
+	}
+
+	logger.Info("Disconnecting publisher", "streamKey", streamKey)
+	closePublisher()
+	s.peerConnectionDisconnected(streamKey, "")
+
+	return nil
+}
+
+// SetStreamPaused stops or resumes forwarding video of streamKey without disconnecting
+// anyone. On resume every WHEP session waits for the keyframe that is requested.
+func SetStreamPaused(streamKey string, paused bool) error {
+	return defaultServer.SetStreamPaused(streamKey, paused)
+}
+
+func (s *Server) SetStreamPaused(streamKey string, paused bool) error {
+	s.streamMapLock.Lock()
+	defer s.streamMapLock.Unlock()
+
+	stream, ok := s.streamMap[streamKey]
+	if !ok || !stream.hasWHIPClient.Load() {
+		return ErrStreamNotFound
+	}
+
+	if stream.paused.Swap(paused) == paused || paused {
+		return nil
+	}
+
+	stream.whepSessionsLock.RLock()
+	for _, whepSession := range stream.whepSessions {
+		whepSession.waitingForKeyframe.Store(true)
+	}
+	stream.whepSessionsLock.RUnlock()
+
+	select {
+	case stream.pliChan <- true:
+	default:
+	}
+
+	return nil
+}
@@ -0,0 +1,122 @@
+package webrtc
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"unicode/utf8"
+)
+
+const (
+	streamMetadataMaxTitle        = 200
+	streamMetadataMaxDescription  = 2000
+	streamMetadataMaxCategory     = 100
+	streamMetadataMaxThumbnailURL = 2048
+)
+
+var ErrInvalidStreamMetadata = errors.New("invalid stream metadata")
+
+type (
+	// StreamMetadata describes a stream for a directory of streams. It is set for a stream key,
+	// also before it is published, and kept until the server restarts.
+	StreamMetadata struct {
+		Title        string `json:"title,omitempty"`
+		Description  string `json:"description,omitempty"`
+		Category     string `json:"category,omitempty"`
+		ThumbnailURL string `json:"thumbnailUrl,omitempty"`
+	}
+
+	// StreamMetadataUpdate changes the fields of StreamMetadata that are set, an empty string
+	// removes one
+	StreamMetadataUpdate struct {
+		Title        *string `json:"title"`
+		Description  *string `json:"description"`
+		Category     *string `json:"category"`
+		ThumbnailURL *string `json:"thumbnailUrl"`
+	}
+)
+
+func (u StreamMetadataUpdate) validate() error {
+	for _, f := range []struct {
+		name  string
+		value *string
+		max   int
+	}{
+		{"title", u.Title, streamMetadataMaxTitle},
+		{"description", u.Description, streamMetadataMaxDescription},
+		{"category", u.Category, streamMetadataMaxCategory},
+		{"thumbnailUrl", u.ThumbnailURL, streamMetadataMaxThumbnailURL},
+	} {
+		if f.value != nil && utf8.RuneCountInString(*f.value) > f.max {
+			return fmt.Errorf("%w: %s is longer than %d characters", ErrInvalidStreamMetadata, f.name, f.max)
+		}
+	}
+
+	if u.ThumbnailURL != nil && *u.ThumbnailURL != "" {
+		if thumbnailURL, err := url.Parse(*u.ThumbnailURL); err != nil || (thumbnailURL.Scheme != "http" && thumbnailURL.Scheme != "https") || thumbnailURL.Host == "" {
+			return fmt.Errorf("%w: thumbnailUrl must be an http or https URL", ErrInvalidStreamMetadata)
+		}
+	}
+
+	return nil
+}
+
+func GetStreamMetadata(streamKey string) StreamMetadata {
+	return defaultServer.GetStreamMetadata(streamKey)
+}
+
+// GetStreamMetadata returns the metadata of streamKey, the title of its Stream Configuration
+// if none was set
+func (s *Server) GetStreamMetadata(streamKey string) StreamMetadata {
+	metadata := s.storedStreamMetadata(streamKey)
+	if metadata.Title == "" {
+		metadata.Title = s.getStreamConfig(streamKey).Title
+	}
+
+	return metadata
+}
+
+// storedStreamMetadata returns the metadata set for streamKey, without the title of its Stream
+// Configuration
+func (s *Server) storedStreamMetadata(streamKey string) StreamMetadata {
+	s.streamMetadataLock.RLock()
+	defer s.streamMetadataLock.RUnlock()
+
+	return s.streamMetadata[streamKey]
+}
+
+func UpdateStreamMetadata(streamKey string, u StreamMetadataUpdate) (StreamMetadata, error) {
+	return defaultServer.UpdateStreamMetadata(streamKey, u)
+}
+
+// UpdateStreamMetadata applies u to the metadata of streamKey and returns the result. The
+// error wraps ErrInvalidStreamMetadata if a field is too long or the thumbnail isn't a URL.
+func (s *Server) UpdateStreamMetadata(streamKey string, u StreamMetadataUpdate) (StreamMetadata, error) {
+	if err := u.validate(); err != nil {
+		return StreamMetadata{}, err
+	}
+
+	s.streamMetadataLock.Lock()
+	metadata := s.streamMetadata[streamKey]
+	if u.Title != nil {
+		metadata.Title = *u.Title
+	}
+	if u.Description != nil {
+		metadata.Description = *u.Description
+	}
+	if u.Category != nil {
+		metadata.Category = *u.Category
+	}
+	if u.ThumbnailURL != nil {
+		metadata.ThumbnailURL = *u.ThumbnailURL
+	}
+
+	if metadata == (StreamMetadata{}) {
+		delete(s.streamMetadata, streamKey)
+	} else {
+		s.streamMetadata[streamKey] = metadata
+	}
+	s.streamMetadataLock.Unlock()
+
+	return s.GetStreamMetadata(streamKey), nil
+}
@@ -0,0 +1,118 @@
+package webrtc
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/glimesh/broadcast-box/internal/recorder"
+	"github.com/pion/rtp"
+)
+
+// ErrNoThumbnail is returned while no keyframe of a stream was captured, see THUMBNAIL_INTERVAL
+var ErrNoThumbnail = errors.New("stream has no thumbnail")
+
+// Thumbnail is the latest captured keyframe of a stream, as a file with only that frame
+type Thumbnail struct {
+	Data        []byte
+	ContentType string
+	Captured    time.Time
+}
+
+// thumbnail keeps a keyframe of the first video layer of a publisher, at most one per interval
+type thumbnail struct {
+	lock     sync.Mutex
+	interval time.Duration
+
+	rid       string
+	assembler videoAssembler
+
+	keyframe []byte
+	codec    recorder.Codec
+	captured time.Time
+
+	// Built from keyframe when it is first requested
+	file *Thumbnail
+}
+
+func newThumbnail(interval time.Duration) *thumbnail {
+	return &thumbnail{interval: interval}
+}
+
+func (t *thumbnail) writeVideo(rtpPkt *rtp.Packet, rid string, codec videoTrackCodec) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.rid == "" {
+		t.rid = rid
+	} else if rid != t.rid {
+		return
+	}
+
+	t.assembler.write(rtpPkt, codec, func(frame []byte, _ uint32) {
+		if time.Since(t.captured) < t.interval || !recorder.IsKeyframe(t.assembler.codec, frame) {
+			return
+		}
+
+		t.keyframe, t.codec, t.captured, t.file = frame, t.assembler.codec, time.Now(), nil
+	})
+}
+
+// get returns the keyframe as an MP4 for H264 and WebM for VP8 and VP9
+func (t *thumbnail) get(streamKey string) (*Thumbnail, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.file != nil {
+		return t.file, nil
+	} else if t.keyframe == nil {
+		return nil, ErrNoThumbnail
+	}
+
+	dir, err := os.MkdirTemp("", "broadcast-box-thumbnail-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	path, err := writeClip(dir, streamKey, t.codec, []clipFrame{{0, t.keyframe, true}}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	contentType := "video/webm"
+	if filepath.Ext(path) == ".mp4" {
+		contentType = "video/mp4"
+	}
+
+	t.file = &Thumbnail{Data: data, ContentType: contentType, Captured: t.captured}
+	return t.file, nil
+}
+
+// GetThumbnail returns the latest keyframe of streamKey, see Thumbnail
+func GetThumbnail(streamKey string) (*Thumbnail, error) {
+	return defaultServer.GetThumbnail(streamKey)
+}
+
+func (s *Server) GetThumbnail(streamKey string) (*Thumbnail, error) {
+	s.streamMapLock.Lock()
+	stream, ok := s.streamMap[streamKey]
+	s.streamMapLock.Unlock()
+	if !ok {
+		return nil, ErrStreamNotFound
+	}
+
+	tap := stream.tap.Load()
+	if tap == nil || tap.thumbnail == nil {
+		return nil, ErrNoThumbnail
+	}
+
+	return tap.thumbnail.get(streamKey)
+}
@@ -0,0 +1,27 @@
+package webrtc
+
+import (
+	"fmt"
+
+	"github.com/glimesh/broadcast-box/internal/tracing"
+	"github.com/pion/webrtc/v4"
+)
+
+// endICESpan ends span once the ICE connection is established or has failed
+func endICESpan(span *tracing.Span, state webrtc.ICEConnectionState) {
+	switch state {
+	case webrtc.ICEConnectionStateConnected, webrtc.ICEConnectionStateCompleted:
+		span.End(nil)
+	case webrtc.ICEConnectionStateFailed, webrtc.ICEConnectionStateClosed:
+		span.End(fmt.Errorf("ICE connection %s", state))
+	}
+}
+
+// endSpans ends spans with err and returns it
+func endSpans(err error, spans ...*tracing.Span) error {
+	for _, span := range spans {
+		span.End(err)
+	}
+
+	return err
+}
@@ -9,7 +9,9 @@ type trackMultiCodec struct {
 	ssrc        webrtc.SSRC
 	writeStream webrtc.TrackLocalWriter
 
-	payloadTypeH264, payloadTypeVP8, payloadTypeVP9, payloadTypeAV1 uint8
+	payloadTypeH264, payloadTypeVP8, payloadTypeVP9, payloadTypeAV1, payloadTypeH265 uint8
+
+	videoOrientationExtensionID uint8
 
 	id, rid, streamID string
 }
@@ -18,6 +20,12 @@ func (t *trackMultiCodec) Bind(ctx webrtc.TrackLocalContext) (webrtc.RTPCodecPar
 	t.ssrc = ctx.SSRC()
 	t.writeStream = ctx.WriteStream()
 
+	for _, headerExtension := range ctx.HeaderExtensions() {
+		if headerExtension.URI == videoOrientationURI {
+			t.videoOrientationExtensionID = uint8(headerExtension.ID)
+		}
+	}
+
 	codecs := ctx.CodecParameters()
 	for i := range codecs {
 		switch getVideoTrackCodec(codecs[i].MimeType) {
@@ -29,6 +37,8 @@ func (t *trackMultiCodec) Bind(ctx webrtc.TrackLocalContext) (webrtc.RTPCodecPar
 			t.payloadTypeVP9 = uint8(codecs[i].PayloadType)
 		case videoTrackCodecAV1:
 			t.payloadTypeAV1 = uint8(codecs[i].PayloadType)
+		case videoTrackCodecH265:
+			t.payloadTypeH265 = uint8(codecs[i].PayloadType)
 		}
 	}
 
@@ -39,7 +49,7 @@ func (t *trackMultiCodec) Unbind(webrtc.TrackLocalContext) error {
 	return nil
 }
 
-func (t *trackMultiCodec) WriteRTP(p *rtp.Packet, codec videoTrackCodec) error {
+func (t *trackMultiCodec) WriteRTP(p *rtp.Packet, videoOrientation []byte, codec videoTrackCodec) error {
 	p.Header.SSRC = uint32(t.ssrc)
 
 	switch codec {
@@ -51,9 +61,18 @@ func (t *trackMultiCodec) WriteRTP(p *rtp.Packet, codec videoTrackCodec) error {
 		p.Header.PayloadType = t.payloadTypeVP9
 	case videoTrackCodecAV1:
 		p.Header.PayloadType = t.payloadTypeAV1
+	case videoTrackCodecH265:
+		p.Header.PayloadType = t.payloadTypeH265
+	}
+
+	header := p.Header
+	if videoOrientation != nil && t.videoOrientationExtensionID != 0 {
+		if err := header.SetExtension(t.videoOrientationExtensionID, videoOrientation); err != nil {
+			return err
+		}
 	}
 
-	_, err := t.writeStream.WriteRTP(&p.Header, p.Payload)
+	_, err := t.writeStream.WriteRTP(&header, p.Payload)
 	return err
 }
 
@@ -0,0 +1,160 @@
+package webrtc
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	audioTrackCodecOpus audioTrackCodec = iota
+	audioTrackCodecMultiopus51
+	audioTrackCodecMultiopus71
+
+	audioTrackCodecCount = 3
+
+	mimeTypeMultiopus = "audio/multiopus"
+)
+
+type audioTrackCodec int
+
+// getAudioTrackCodec returns the codec of an Opus or multiopus track, ok is false for other codecs
+func getAudioTrackCodec(codec webrtc.RTPCodecParameters) (audioTrackCodec, bool) {
+	switch {
+	case strings.EqualFold(codec.MimeType, webrtc.MimeTypeOpus):
+		return audioTrackCodecOpus, true
+	case strings.EqualFold(codec.MimeType, mimeTypeMultiopus) && codec.Channels == 6:
+		return audioTrackCodecMultiopus51, true
+	case strings.EqualFold(codec.MimeType, mimeTypeMultiopus) && codec.Channels == 8:
+		return audioTrackCodecMultiopus71, true
+	}
+
+	return 0, false
+}
+
+// mimeType returns the MIME type of the codec and its number of channels
+func (c audioTrackCodec) mimeType() (string, int) {
+	switch c {
+	case audioTrackCodecMultiopus51:
+		return mimeTypeMultiopus, 6
+	case audioTrackCodecMultiopus71:
+		return mimeTypeMultiopus, 8
+	}
+
+	return webrtc.MimeTypeOpus, 2
+}
+
+type audioTrackBinding struct {
+	id          string
+	ssrc        webrtc.SSRC
+	writeStream webrtc.TrackLocalWriter
+
+	// Zero for codecs the viewer didn't negotiate
+	payloadTypes [audioTrackCodecCount]uint8
+}
+
+// trackMultiOpus is the audio track of a stream shared by its WHEP sessions. Like
+// trackMultiCodec it is bound to every audio codec the viewer negotiated, so the publisher can
+// send stereo Opus or 5.1/7.1 multiopus. Viewers that can't play the codec of the publisher
+// get no audio.
+type trackMultiOpus struct {
+	lock     sync.RWMutex
+	bindings []audioTrackBinding
+
+	id, streamID string
+
+	// Bytes written to the viewers since the stream's usage was taken
+	usageBytesOut atomic.Uint64
+}
+
+func newTrackMultiOpus(id, streamID string) *trackMultiOpus {
+	return &trackMultiOpus{id: id, streamID: streamID}
+}
+
+func (t *trackMultiOpus) Bind(ctx webrtc.TrackLocalContext) (webrtc.RTPCodecParameters, error) {
+	binding := audioTrackBinding{id: ctx.ID(), ssrc: ctx.SSRC(), writeStream: ctx.WriteStream()}
+
+	var bound *webrtc.RTPCodecParameters
+	codecs := ctx.CodecParameters()
+	for i := range codecs {
+		codec, ok := getAudioTrackCodec(codecs[i])
+		if !ok || binding.payloadTypes[codec] != 0 {
+			continue
+		}
+
+		binding.payloadTypes[codec] = uint8(codecs[i].PayloadType)
+		if bound == nil || codec == audioTrackCodecOpus {
+			bound = &codecs[i]
+		}
+	}
+
+	if bound == nil {
+		return webrtc.RTPCodecParameters{}, webrtc.ErrUnsupportedCodec
+	}
+
+	t.lock.Lock()
+	t.bindings = append(t.bindings, binding)
+	t.lock.Unlock()
+
+	return *bound, nil
+}
+
+func (t *trackMultiOpus) Unbind(ctx webrtc.TrackLocalContext) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for i := range t.bindings {
+		if t.bindings[i].id == ctx.ID() {
+			t.bindings[i] = t.bindings[len(t.bindings)-1]
+			t.bindings = t.bindings[:len(t.bindings)-1]
+			return nil
+		}
+	}
+
+	return webrtc.ErrUnbindFailed
+}
+
+// WriteRTP sends a packet of codec to every viewer that negotiated it. Viewers that fail don't
+// stop the others, the first error is returned.
+func (t *trackMultiOpus) WriteRTP(p *rtp.Packet, codec audioTrackCodec) error {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	header := p.Header
+	var firstErr error
+	for _, b := range t.bindings {
+		if b.payloadTypes[codec] == 0 {
+			continue
+		}
+
+		header.SSRC = uint32(b.ssrc)
+		header.PayloadType = b.payloadTypes[codec]
+		if n, err := b.writeStream.WriteRTP(&header, p.Payload); err != nil && firstErr == nil {
+			firstErr = err
+		} else if err == nil {
+			t.usageBytesOut.Add(uint64(n))
+		}
+	}
+
+	return firstErr
+}
+
+// Write sends a marshaled packet of codec to every viewer that negotiated it
+func (t *trackMultiOpus) Write(b []byte, codec audioTrackCodec) error {
+	p := &rtp.Packet{}
+	if err := p.Unmarshal(b); err != nil {
+		return err
+	}
+
+	return t.WriteRTP(p, codec)
+}
+
+func (t *trackMultiOpus) ID() string       { return t.id }
+func (t *trackMultiOpus) RID() string      { return "" }
+func (t *trackMultiOpus) StreamID() string { return t.streamID }
+func (t *trackMultiOpus) Kind() webrtc.RTPCodecType {
+	return webrtc.RTPCodecTypeAudio
+}
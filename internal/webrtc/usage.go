@@ -0,0 +1,82 @@
+package webrtc
+
+import (
+	"time"
+)
+
+// Usage is what a stream received from publishers and sent to WHEP sessions
+type Usage struct {
+	BytesIn        uint64
+	BytesOut       uint64
+	PublishSeconds float64
+}
+
+func (u *Usage) add(other Usage) {
+	u.BytesIn += other.BytesIn
+	u.BytesOut += other.BytesOut
+	u.PublishSeconds += other.PublishSeconds
+}
+
+// unmeteredPublishTime returns how long the current publisher of stream published since
+// TakeUsage last counted it. The caller must hold streamMapLock.
+func unmeteredPublishTime(stream *stream, now time.Time) time.Duration {
+	if stream.publisherConnectedTime.IsZero() {
+		return 0
+	}
+
+	from := stream.publisherConnectedTime
+	if stream.usageTakenAt.After(from) {
+		from = stream.usageTakenAt
+	}
+
+	return now.Sub(from)
+}
+
+// meterStream moves the usage of stream since it was last metered to the usage TakeUsage
+// returns, so it isn't lost when the stream is removed. The caller must hold streamMapLock.
+func (s *Server) meterStream(streamKey string, stream *stream, now time.Time) {
+	usage := Usage{
+		BytesIn:        stream.usageBytesIn.Swap(0),
+		BytesOut:       stream.usageVideoBytesOut.Swap(0) + stream.audioTrack.usageBytesOut.Swap(0),
+		PublishSeconds: (stream.usagePublishTime + unmeteredPublishTime(stream, now)).Seconds(),
+	}
+	stream.usagePublishTime, stream.usageTakenAt = 0, now
+
+	if usage == (Usage{}) {
+		return
+	}
+
+	s.usageLock.Lock()
+	defer s.usageLock.Unlock()
+
+	if s.usage[streamKey] == nil {
+		s.usage[streamKey] = &Usage{}
+	}
+	s.usage[streamKey].add(usage)
+}
+
+func TakeUsage() map[string]Usage {
+	return defaultServer.TakeUsage()
+}
+
+// TakeUsage returns the usage of every stream key since the last call, including streams that
+// were removed since. Media sent over HLS, DASH, RTSP and the other outputs isn't counted.
+func (s *Server) TakeUsage() map[string]Usage {
+	s.streamMapLock.Lock()
+	now := time.Now()
+	for streamKey, stream := range s.streamMap {
+		s.meterStream(streamKey, stream, now)
+	}
+	s.streamMapLock.Unlock()
+
+	s.usageLock.Lock()
+	defer s.usageLock.Unlock()
+
+	usage := make(map[string]Usage, len(s.usage))
+	for streamKey, u := range s.usage {
+		usage[streamKey] = *u
+	}
+	s.usage = map[string]*Usage{}
+
+	return usage
+}
@@ -0,0 +1,188 @@
+package webrtc
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	viewerHistoryInterval = 10 * time.Second
+
+	// Two hours of samples
+	viewerHistoryLength = 720
+
+	// How long the history of a stream is kept after it ended
+	viewerHistoryRetention = 24 * time.Hour
+)
+
+// ErrNoViewerHistory is returned for a stream key that wasn't played or published within
+// viewerHistoryRetention
+var ErrNoViewerHistory = errors.New("no viewer history for stream")
+
+type (
+	// viewerHistory is the concurrent viewers of a stream from when it was created, sampled into
+	// a ring buffer. The peak is updated on every join, so it isn't missed between samples.
+	viewerHistory struct {
+		lock sync.Mutex
+
+		started, ended time.Time
+		current, peak  int
+		peakTime       time.Time
+
+		samples []ViewerSample
+		next    int
+	}
+
+	ViewerSample struct {
+		Time    time.Time `json:"time"`
+		Viewers int       `json:"viewers"`
+	}
+
+	ViewerHistory struct {
+		StreamKey string     `json:"streamKey"`
+		StartedAt time.Time  `json:"startedAt"`
+		EndedAt   *time.Time `json:"endedAt,omitempty"`
+		Current   int        `json:"current"`
+		Peak      int        `json:"peak"`
+		PeakAt    *time.Time `json:"peakAt,omitempty"`
+
+		// Seconds between the samples of History, oldest first
+		Interval float64        `json:"interval"`
+		History  []ViewerSample `json:"history"`
+	}
+)
+
+func (h *viewerHistory) setViewers(viewers int, sample bool) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	now := time.Now()
+	h.current = viewers
+	if viewers > h.peak {
+		h.peak, h.peakTime = viewers, now
+	}
+
+	if !sample {
+		return
+	}
+
+	if len(h.samples) < viewerHistoryLength {
+		h.samples = append(h.samples, ViewerSample{Time: now, Viewers: viewers})
+	} else {
+		h.samples[h.next] = ViewerSample{Time: now, Viewers: viewers}
+		h.next = (h.next + 1) % viewerHistoryLength
+	}
+}
+
+// startViewerHistory starts a new history for streamKey, replacing the one of a stream that
+// ended before
+func (s *Server) startViewerHistory(streamKey string) {
+	s.viewerHistoriesLock.Lock()
+	defer s.viewerHistoriesLock.Unlock()
+
+	s.viewerHistories[streamKey] = &viewerHistory{started: time.Now()}
+}
+
+func (s *Server) endViewerHistory(streamKey string) {
+	s.viewerHistoriesLock.Lock()
+	h := s.viewerHistories[streamKey]
+	s.viewerHistoriesLock.Unlock()
+
+	if h != nil {
+		h.setViewers(0, true)
+
+		h.lock.Lock()
+		h.ended = time.Now()
+		h.lock.Unlock()
+	}
+}
+
+// updateViewerHistory records that streamKey has viewers now
+func (s *Server) updateViewerHistory(streamKey string, viewers int) {
+	s.viewerHistoriesLock.Lock()
+	h := s.viewerHistories[streamKey]
+	s.viewerHistoriesLock.Unlock()
+
+	if h != nil {
+		h.setViewers(viewers, false)
+	}
+}
+
+// sampleViewerHistories samples the viewers of every stream each viewerHistoryInterval, and
+// drops the histories of streams that ended more than viewerHistoryRetention ago
+func (s *Server) sampleViewerHistories() {
+	ticker := time.NewTicker(viewerHistoryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.closed:
+			return
+		}
+
+		viewers := map[string]int{}
+		s.streamMapLock.Lock()
+		for streamKey, stream := range s.streamMap {
+			stream.whepSessionsLock.RLock()
+			viewers[streamKey] = len(stream.whepSessions)
+			stream.whepSessionsLock.RUnlock()
+		}
+		s.streamMapLock.Unlock()
+
+		s.viewerHistoriesLock.Lock()
+		for streamKey, h := range s.viewerHistories {
+			if count, ok := viewers[streamKey]; ok {
+				h.setViewers(count, true)
+				continue
+			}
+
+			h.lock.Lock()
+			expired := !h.ended.IsZero() && time.Since(h.ended) > viewerHistoryRetention
+			h.lock.Unlock()
+			if expired {
+				delete(s.viewerHistories, streamKey)
+			}
+		}
+		s.viewerHistoriesLock.Unlock()
+	}
+}
+
+func GetViewerHistory(streamKey string) (*ViewerHistory, error) {
+	return defaultServer.GetViewerHistory(streamKey)
+}
+
+// GetViewerHistory returns the current and peak viewers of streamKey and how many it had over
+// the last two hours. It is kept for a day after the stream ended, for reporting.
+func (s *Server) GetViewerHistory(streamKey string) (*ViewerHistory, error) {
+	s.viewerHistoriesLock.Lock()
+	h := s.viewerHistories[streamKey]
+	s.viewerHistoriesLock.Unlock()
+
+	if h == nil {
+		return nil, ErrNoViewerHistory
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	out := &ViewerHistory{
+		StreamKey: streamKey,
+		StartedAt: h.started,
+		Current:   h.current,
+		Peak:      h.peak,
+		Interval:  viewerHistoryInterval.Seconds(),
+		History:   append(append([]ViewerSample{}, h.samples[h.next:]...), h.samples[:h.next]...),
+	}
+	if !h.ended.IsZero() {
+		ended := h.ended
+		out.EndedAt = &ended
+	}
+	if !h.peakTime.IsZero() {
+		peakTime := h.peakTime
+		out.PeakAt = &peakTime
+	}
+
+	return out, nil
+}
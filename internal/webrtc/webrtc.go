@@ -3,9 +3,9 @@ package webrtc
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net"
 	"net/http"
 	"os"
@@ -15,19 +15,30 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/glimesh/broadcast-box/internal/events"
+	"github.com/glimesh/broadcast-box/internal/logging"
+	"github.com/glimesh/broadcast-box/internal/s3"
 	"github.com/pion/dtls/v3/pkg/crypto/elliptic"
 	"github.com/pion/ice/v3"
 	"github.com/pion/interceptor"
 	"github.com/pion/webrtc/v4"
 )
 
+var logger = logging.Logger("webrtc")
+
 const (
 	videoTrackLabelDefault = "default"
 
+	rtpMTUDefault = 1200
+
+	// Coordination of Video Orientation, signals rotation of mobile publishers
+	videoOrientationURI = "urn:3gpp:video-orientation"
+
 	videoTrackCodecH264 videoTrackCodec = iota + 1
 	videoTrackCodecVP8
 	videoTrackCodecVP9
 	videoTrackCodecAV1
+	videoTrackCodecH265
 )
 
 type (
@@ -36,35 +47,339 @@ type (
 		// If stream was created by a WHEP request hasWHIPClient == false
 		hasWHIPClient atomic.Bool
 
+		// Video is not forwarded to WHEP sessions while paused
+		paused atomic.Bool
+
 		firstSeenEpoch uint64
 
+		// When the first publisher connected, used to enforce MAX_STREAM_DURATION
+		firstPublishTime time.Time
+
+		// When the current publisher connected, zero if there is none
+		publisherConnectedTime time.Time
+
+		// Disconnects the current publisher, nil if there is none
+		closePublisher func()
+
+		// Disconnects the current publisher for another one, which it then leaves alone
+		replacePublisher func()
+
+		// Who the current publisher is, a publisher with another identity is refused by
+		// PUBLISHER_CONFLICT=first-wins
+		publisherIdentity publisherIdentity
+
+		// The current publisher if it is a fallback, replaced by the next publisher. See
+		// NewFallbackIngest
+		fallbackIngest *Ingest
+
+		config streamConfig
+
 		videoTracks []*videoTrack
 
-		audioTrack           *webrtc.TrackLocalStaticRTP
+		audioTrack           *trackMultiOpus
 		audioPacketsReceived atomic.Uint64
+		audioBytesReceived   atomic.Uint64
+		audioBitrate         bitrateMeter
+
+		// Codec of the current publisher's audio, nil until it sent some
+		audioCodec atomic.Pointer[audioTrackCodec]
 
 		pliChan chan any
 
+		lastManualKeyframeRequest atomic.Int64
+
+		// When a PLI was last sent to the publisher, used to enforce PLI_THROTTLE_WINDOW
+		lastPLISent atomic.Int64
+		plisSent    atomic.Uint64
+
+		// Depacketizes the media of the current or last publisher for HLS, DASH, SRT outputs and
+		// restreams, and forwards its RTP. nil if none are used
+		tap atomic.Pointer[mediaTap]
+
 		whipActiveContext       context.Context
 		whipActiveContextCancel func()
 
 		whepSessionsLock sync.RWMutex
 		whepSessions     map[string]*whepSession
+
+		rtspPlayersLock sync.RWMutex
+		rtspPlayers     map[*rtspPlayer]struct{}
+
+		// whipOutputs of the current publisher, guarded by streamMapLock
+		relayOuts []*relayOut
+
+		// Media received from publishers and sent to WHEP sessions since TakeUsage, the audio
+		// sent is counted by audioTrack. The publish time of publishers that left since and when
+		// TakeUsage last counted it are guarded by streamMapLock.
+		usageBytesIn, usageVideoBytesOut atomic.Uint64
+		usagePublishTime                 time.Duration
+		usageTakenAt                     time.Time
 	}
 
 	videoTrack struct {
 		rid              string
+		codec            videoTrackCodec
 		packetsReceived  atomic.Uint64
+		bytesReceived    atomic.Uint64
+		bitrate          bitrateMeter
 		lastKeyFrameSeen atomic.Value
+
+		// msid of the publisher's track, used to label the track sent to WHEP sessions
+		streamLabel, trackLabel string
 	}
 
 	videoTrackCodec int
+
+	// Server is a set of streams and the WebRTC APIs they are published and played with.
+	// Multiple Servers can run in one process.
+	Server struct {
+		streamMap     map[string]*stream
+		streamMapLock sync.Mutex
+
+		apiWhip, apiWhep *webrtc.API
+
+		// ICE servers and policy of the PeerConnections of each role, and what answers are
+		// appended. The rest of the ICEOptions are in the SettingEngines of the APIs
+		whipICE, whepICE ICEOptions
+		appendCandidate  string
+
+		// Where getPublicIP caches the IP of this host
+		publicIPCacheFile  string
+		publicIPSkipLookup bool
+
+		// Sockets of UDP_MUX_PORT, checked by CheckUDPMuxes, and of TCP_MUX_ADDRESS
+		udpMuxes []*ice.MultiUDPMuxDefault
+		tcpMuxes []ice.TCPMux
+
+		// Closed by Close to stop the background work of the Server
+		closed    chan struct{}
+		closeOnce sync.Once
+
+		// Largest RTP packet expected on the path to viewers
+		rtpMTU int
+
+		// PLIs to a publisher within this long of the previous one are dropped
+		pliThrottleWindow time.Duration
+
+		// Most streams and WHEP sessions of a stream that can exist at once, 0 is unlimited
+		maxStreams, maxViewersPerStream int
+
+		// PeerConnections of publishers and viewers whose ICE connection failed
+		whipICEFailures, whepICEFailures atomic.Uint64
+
+		// PublisherConflictFirstWins or PublisherConflictLastWins
+		publisherConflict string
+
+		hlsDisabled  bool
+		dashDisabled bool
+
+		// Where recordings are written and how often a new file is started, 0 never
+		recordingDirectory      string
+		recordingRotateInterval time.Duration
+
+		// How much of each stream is kept for clips, 0 if they are disabled
+		clipBufferDuration time.Duration
+
+		// How often a keyframe is kept as the thumbnail of a stream, 0 if they are disabled
+		thumbnailInterval time.Duration
+
+		// Paths of the recording files that are being written
+		activeRecordings     map[string]bool
+		activeRecordingsLock sync.Mutex
+
+		// Retention of recordings on disk, 0 keeps them
+		recordingMaxAge   time.Duration
+		recordingMaxBytes int64
+
+		// Where finished recordings are uploaded, nil if they aren't
+		recordingUpload          *s3.Client
+		recordingUploadPrefix    string
+		recordingUploadKeepLocal bool
+
+		streamConfigs     map[string]streamConfig
+		streamConfigsLock sync.RWMutex
+
+		// Upstream WHEP endpoint of RELAY_ON_DEMAND, empty if disabled. Stream keys that are relayed
+		// all the time and those currently pulled on demand are skipped, guarded by streamMapLock.
+		relayOnDemandURL string
+		relayStreamKeys  map[string]bool
+		onDemandRelays   map[string]bool
+
+		// Added with the restream API, keyed by stream key
+		restreamTargets     map[string][]RestreamTarget
+		restreamTargetsLock sync.Mutex
+
+		// Where packet captures are written and the running ones, keyed by stream key.
+		// captureCount is the number of captures so packets aren't looked up without any.
+		captureDirectory    string
+		captures            map[string]*packetCapture
+		capturesLock        sync.RWMutex
+		captureCount        atomic.Int32
+		captureInterceptors *captureInterceptorFactory
+
+		// Concurrent viewers of every stream, kept after it ended for reporting
+		viewerHistories     map[string]*viewerHistory
+		viewerHistoriesLock sync.Mutex
+
+		// Usage of streams not yet returned by TakeUsage, keyed by stream key
+		usage     map[string]*Usage
+		usageLock sync.Mutex
+
+		// Set with UpdateStreamMetadata, keyed by stream key
+		streamMetadata     map[string]StreamMetadata
+		streamMetadataLock sync.RWMutex
+
+		// Delivers the events of the streams to EventPublishers, closed by Close
+		events *events.Bus
+	}
+
+	Options struct {
+		// JSON file of per-stream settings, see STREAM_CONFIG_FILE
+		StreamConfigFile string
+
+		// Largest RTP packet expected on the path to viewers, see RTP_MTU
+		RTPMTU int
+
+		// Minimum time between PLIs sent to a publisher, see PLI_THROTTLE_WINDOW
+		PLIThrottleWindow time.Duration
+
+		// Most streams and viewers of each stream, see MAX_STREAMS and MAX_VIEWERS_PER_STREAM
+		MaxStreams, MaxViewersPerStream int
+
+		// What happens when a stream that is published gets another publisher, see PUBLISHER_CONFLICT
+		PublisherConflict string
+
+		// WHEP endpoint that RelayStreamKeys are played from and published here, see RELAY_UPSTREAM_URL
+		RelayUpstreamURL string
+		RelayStreamKeys  []string
+
+		// Pull every other stream key from RelayUpstreamURL while it is played, see RELAY_ON_DEMAND
+		RelayOnDemand bool
+
+		// Don't package streams for HLS, see DISABLE_HLS
+		DisableHLS bool
+
+		// Don't package streams for MPEG-DASH, see DISABLE_DASH
+		DisableDASH bool
+
+		// Negotiate H265 with publishers and viewers that support it, see ENABLE_H265
+		EnableH265 bool
+
+		// Directory recordings are written to, see RECORDING_DIRECTORY
+		RecordingDirectory string
+
+		// How often a new recording file is started, see RECORDING_ROTATE_INTERVAL
+		RecordingRotateInterval time.Duration
+
+		// Recordings older than this are pruned, see RECORDING_MAX_AGE
+		RecordingMaxAge time.Duration
+
+		// The oldest recordings of a stream key above this size are pruned, see RECORDING_MAX_BYTES
+		RecordingMaxBytes int64
+
+		// How much of each stream is kept for clips, see CLIP_BUFFER_DURATION
+		ClipBufferDuration time.Duration
+
+		// How often a keyframe of each stream is kept as its thumbnail, see THUMBNAIL_INTERVAL
+		ThumbnailInterval time.Duration
+
+		// Bucket finished recordings are uploaded to, nil keeps them on disk. See RECORDING_UPLOAD_URL
+		RecordingUpload *s3.Options
+
+		// Directory packet captures are written to, see CAPTURE_DIRECTORY
+		CaptureDirectory string
+
+		// Template of the object name prefix, see RECORDING_UPLOAD_PREFIX
+		RecordingUploadPrefix string
+
+		// Don't delete recordings after they were uploaded, see RECORDING_UPLOAD_KEEP_LOCAL
+		RecordingUploadKeepLocal bool
+
+		// How often a stream_stats event is emitted for every published stream, see EVENTS_STATS_INTERVAL
+		StatsEventInterval time.Duration
+
+		// Where the events of the streams are delivered, see EVENTS_WEBHOOK_URL. Publish isn't called
+		// concurrently, so a Publisher must only be given to one Server.
+		EventPublishers []events.Publisher
+
+		// ICE and DTLS settings of WHIP and WHEP PeerConnections, see the settings that can be
+		// appended `_WHIP` or `_WHEP`
+		WHIPICE, WHEPICE ICEOptions
+
+		// Where the IP found by ICEOptions.IncludePublicIP is cached, see PUBLIC_IP_CACHE_FILE.
+		// With PublicIPSkipLookup only it is used, see PUBLIC_IP_SKIP_LOOKUP
+		PublicIPCacheFile  string
+		PublicIPSkipLookup bool
+
+		// Candidate added to every answer, see APPEND_CANDIDATE
+		AppendCandidate string
+
+		// Settings used for WHIP and WHEP PeerConnections instead of the ones built from
+		// WHIPICE and WHEPICE
+		WHIPSettingEngine, WHEPSettingEngine *webrtc.SettingEngine
+	}
+
+	// ICEOptions are the ICE and DTLS settings of either WHIP or WHEP PeerConnections
+	ICEOptions struct {
+		// Addresses announced instead of those of the interfaces, see NAT_1_TO_1_IP
+		NAT1To1IPs []string
+
+		// Announce the public IP of this host too, see INCLUDE_PUBLIC_IP_IN_NAT_1_TO_1_IP
+		IncludePublicIP bool
+
+		// `host` or `srflx`, how NAT1To1IPs are announced. See NAT_ICE_CANDIDATE_TYPE
+		NATICECandidateType string
+
+		// Only interface gathered from, see INTERFACE_FILTER
+		InterfaceFilter string
+
+		// Announce loopback candidates, see INCLUDE_LOOPBACK_CANDIDATE
+		IncludeLoopbackCandidate bool
+
+		// UDP port shared by every PeerConnection, see UDP_MUX_PORT
+		UDPMuxPort int
+
+		// Ports of the UDP sockets of each PeerConnection, see ICE_UDP_PORT_MIN and ICE_UDP_PORT_MAX
+		UDPPortMin, UDPPortMax uint16
+
+		// TCP address shared by every PeerConnection and whether only it is used, see
+		// TCP_MUX_ADDRESS and TCP_MUX_FORCE
+		TCPMuxAddress string
+		TCPMuxForce   bool
+
+		// `active` or `passive`, the DTLS role answered with. See DTLS_SETUP_ROLE
+		DTLSSetupRole string
+
+		// host:port of STUN and TURN servers, see STUN_SERVERS and TURN_SERVERS
+		STUNServers, TURNServers []string
+		TURNUsername             string
+		TURNCredential           string
+
+		// Only gather relay candidates for these streams, all when empty. See TURN_STREAM_KEYS
+		TURNStreamKeys []string
+
+		// `relay` to only use TURN, see ICE_TRANSPORT_POLICY
+		ICETransportPolicy string
+	}
+)
+
+var (
+	// ErrTooManyStreams is returned for a new stream while MAX_STREAMS exist
+	ErrTooManyStreams = errors.New("too many streams")
+
+	// ErrTooManyViewers is returned by WHEP while a stream has MAX_VIEWERS_PER_STREAM sessions
+	ErrTooManyViewers = errors.New("stream has too many viewers")
+
+	// ErrServerClosed is returned for new publishers once Close was called
+	ErrServerClosed = errors.New("server is closed")
 )
 
 var (
-	streamMap        map[string]*stream
-	streamMapLock    sync.Mutex
-	apiWhip, apiWhep *webrtc.API
+	// Server used by the package level functions, set by Configure
+	defaultServer *Server
+
+	publicIP     string
+	publicIPLock sync.Mutex
 
 	// nolint
 	videoRTCPFeedback = []webrtc.RTCPFeedback{{"goog-remb", ""}, {"ccm", "fir"}, {"nack", ""}, {"nack", "pli"}}
@@ -81,18 +396,51 @@ func getVideoTrackCodec(in string) videoTrackCodec {
 		return videoTrackCodecVP9
 	case strings.Contains(downcased, strings.ToLower(webrtc.MimeTypeAV1)):
 		return videoTrackCodecAV1
+	case strings.Contains(downcased, strings.ToLower(webrtc.MimeTypeH265)):
+		return videoTrackCodecH265
 	}
 
 	return 0
 }
 
-func getStream(streamKey string, forWHIP bool) (*stream, error) {
-	foundStream, ok := streamMap[streamKey]
-	if !ok {
-		audioTrack, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus}, "audio", "pion")
-		if err != nil {
-			return nil, err
+// mimeType returns the MIME type of the codec, like `video/H264`
+func (c videoTrackCodec) mimeType() string {
+	switch c {
+	case videoTrackCodecH264:
+		return webrtc.MimeTypeH264
+	case videoTrackCodecVP8:
+		return webrtc.MimeTypeVP8
+	case videoTrackCodecVP9:
+		return webrtc.MimeTypeVP9
+	case videoTrackCodecAV1:
+		return webrtc.MimeTypeAV1
+	case videoTrackCodecH265:
+		return webrtc.MimeTypeH265
+	}
+
+	return ""
+}
+
+// getStream returns the stream for streamKey, creating it if needed. The caller must hold
+// streamMapLock until the stream is in use (a WHEP session added or hasWHIPClient set),
+// otherwise concurrent requests for a new key could each create a stream or
+// peerConnectionDisconnected could delete it in between.
+func (s *Server) getStream(streamKey string, forWHIP bool) (*stream, error) {
+	foundStream, ok := s.streamMap[streamKey]
+	if !ok && s.maxStreams > 0 && len(s.streamMap) >= s.maxStreams {
+		return nil, ErrTooManyStreams
+	} else if ok && !forWHIP && s.maxViewersPerStream > 0 {
+		foundStream.whepSessionsLock.RLock()
+		viewers := len(foundStream.whepSessions)
+		foundStream.whepSessionsLock.RUnlock()
+
+		if viewers >= s.maxViewersPerStream {
+			return nil, ErrTooManyViewers
 		}
+	}
+
+	if !ok {
+		audioTrack := newTrackMultiOpus("audio", "pion")
 
 		whipActiveContext, whipActiveContextCancel := context.WithCancel(context.Background())
 
@@ -100,25 +448,125 @@ func getStream(streamKey string, forWHIP bool) (*stream, error) {
 			audioTrack:              audioTrack,
 			pliChan:                 make(chan any, 50),
 			whepSessions:            map[string]*whepSession{},
+			rtspPlayers:             map[*rtspPlayer]struct{}{},
 			whipActiveContext:       whipActiveContext,
 			whipActiveContextCancel: whipActiveContextCancel,
 			firstSeenEpoch:          uint64(time.Now().Unix()),
+			config:                  s.getStreamConfig(streamKey),
+		}
+		s.streamMap[streamKey] = foundStream
+		s.startViewerHistory(streamKey)
+
+		if interval := foundStream.config.keyframeInterval(); interval > 0 {
+			go requestKeyframes(foundStream, interval)
 		}
-		streamMap[streamKey] = foundStream
 	}
 
 	if forWHIP {
+		if i := foundStream.fallbackIngest; i != nil {
+			logger.Info("Replacing fallback publisher", "streamKey", streamKey)
+			i.replaced.Store(true)
+			i.close()
+			s.detachPublisher(streamKey, foundStream)
+		}
 		foundStream.hasWHIPClient.Store(true)
+		foundStream.publisherConnectedTime = time.Now()
 	}
 
 	return foundStream, nil
 }
 
-func peerConnectionDisconnected(streamKey string, whepSessionId string) {
-	streamMapLock.Lock()
-	defer streamMapLock.Unlock()
+// Events returns the Bus the events of the streams are emitted on, more Publishers can be
+// registered with it
+func (s *Server) Events() *events.Bus {
+	return s.events
+}
+
+func (s *Server) emitEvent(eventType, streamKey, whepSessionId string, stream *stream) {
+	s.events.Emit(newEvent(eventType, streamKey, whepSessionId, stream))
+}
+
+func newEvent(eventType, streamKey, whepSessionId string, stream *stream) events.Event {
+	e := events.Event{Type: eventType, StreamKey: streamKey, WHEPSessionID: whepSessionId}
+	if stream.config.Title != "" {
+		e.Metadata = map[string]string{"title": stream.config.Title}
+	}
+
+	return e
+}
+
+// requestKeyframes asks the publisher for a keyframe every interval until the stream is deleted
+func requestKeyframes(stream *stream, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stream.whipActiveContext.Done():
+			return
+		case <-ticker.C:
+			if !stream.hasWHIPClient.Load() {
+				continue
+			}
+
+			select {
+			case stream.pliChan <- true:
+			default:
+			}
+		}
+	}
+}
+
+// closeStream disconnects the publisher and every WHEP session of streamKey, which deletes the stream
+func (s *Server) closeStream(streamKey, reason string) {
+	s.streamMapLock.Lock()
+	stream, ok := s.streamMap[streamKey]
+	if !ok {
+		s.streamMapLock.Unlock()
+		return
+	}
+
+	closePublisher := stream.closePublisher
+	whepPeerConnections := map[string]*webrtc.PeerConnection{}
+	stream.whepSessionsLock.RLock()
+	for id, whepSession := range stream.whepSessions {
+		whepPeerConnections[id] = whepSession.peerConnection
+	}
+	stream.whepSessionsLock.RUnlock()
+	s.streamMapLock.Unlock()
+
+	logger.Info("Closing stream", "streamKey", streamKey, "reason", reason)
+
+	for id, peerConnection := range whepPeerConnections {
+		if err := peerConnection.Close(); err != nil {
+			logger.Warn("Failed to close WHEP PeerConnection", "streamKey", streamKey, "whepSessionId", id, "err", err)
+		}
+		s.peerConnectionDisconnected(streamKey, id)
+	}
+
+	if closePublisher != nil {
+		closePublisher()
+		s.peerConnectionDisconnected(streamKey, "")
+	}
+}
+
+// enforceMaxDuration closes the stream once it has been published for maxDuration
+func (s *Server) enforceMaxDuration(streamKey string, stream *stream, maxDuration time.Duration) {
+	timer := time.NewTimer(time.Until(stream.firstPublishTime.Add(maxDuration)))
+	defer timer.Stop()
+
+	select {
+	case <-stream.whipActiveContext.Done():
+	case <-timer.C:
+		s.closeStream(streamKey, fmt.Sprintf("stream time limit of %s reached", maxDuration))
+	}
+}
+
+func (s *Server) peerConnectionDisconnected(streamKey string, whepSessionId string) {
+	s.streamMapLock.Lock()
+	defer s.streamMapLock.Unlock()
 
-	stream, ok := streamMap[streamKey]
+	stream, ok := s.streamMap[streamKey]
 	if !ok {
 		return
 	}
@@ -127,10 +575,15 @@ func peerConnectionDisconnected(streamKey string, whepSessionId string) {
 	defer stream.whepSessionsLock.Unlock()
 
 	if whepSessionId != "" {
-		delete(stream.whepSessions, whepSessionId)
+		if _, ok := stream.whepSessions[whepSessionId]; ok {
+			delete(stream.whepSessions, whepSessionId)
+			s.emitEvent(events.TypeViewerLeave, streamKey, whepSessionId, stream)
+			if len(stream.whepSessions) == 0 {
+				s.emitEvent(events.TypeNoViewers, streamKey, "", stream)
+			}
+		}
 	} else {
-		stream.hasWHIPClient.Store(false)
-		stream.videoTracks = nil
+		s.detachPublisher(streamKey, stream)
 	}
 
 	// Only delete stream if all WHEP Sessions are gone and have no WHIP Client
@@ -139,70 +592,222 @@ func peerConnectionDisconnected(streamKey string, whepSessionId string) {
 	}
 
 	stream.whipActiveContextCancel()
-	delete(streamMap, streamKey)
+	s.meterStream(streamKey, stream, time.Now())
+	delete(s.streamMap, streamKey)
+	s.endViewerHistory(streamKey)
+}
+
+// detachPublisher stops forwarding the media of the current publisher of stream. The caller must
+// hold streamMapLock.
+func (s *Server) detachPublisher(streamKey string, stream *stream) {
+	if stream.hasWHIPClient.Load() {
+		s.emitEvent(events.TypePublishStop, streamKey, "", stream)
+	}
+	stream.hasWHIPClient.Store(false)
+	stream.usagePublishTime += unmeteredPublishTime(stream, time.Now())
+	stream.publisherConnectedTime = time.Time{}
+	stream.audioCodec.Store(nil)
+	stream.closePublisher = nil
+	stream.replacePublisher = nil
+	stream.publisherIdentity = publisherIdentity{}
+	stream.fallbackIngest = nil
+	stream.videoTracks = nil
+	stopMediaTap(stream)
+	stopRelayOuts(stream)
+	closeRTSPPlayers(stream)
 }
 
-func addTrack(stream *stream, rid string) (*videoTrack, error) {
-	streamMapLock.Lock()
-	defer streamMapLock.Unlock()
+// addTrack returns the videoTrack for rid and its index in stream.videoTracks. A publisher
+// sending multiple tracks without a rid (camera and screenshare) has every track after the
+// first identified by its track label instead of videoTrackLabelDefault.
+func (s *Server) addTrack(stream *stream, rid, streamLabel, trackLabel string, codec videoTrackCodec) (*videoTrack, int, error) {
+	s.streamMapLock.Lock()
+	defer s.streamMapLock.Unlock()
+
+	if rid == videoTrackLabelDefault {
+		for i := range stream.videoTracks {
+			if stream.videoTracks[i].rid == videoTrackLabelDefault && stream.videoTracks[i].trackLabel != trackLabel {
+				rid = trackLabel
+				break
+			}
+		}
+	}
 
 	for i := range stream.videoTracks {
 		if rid == stream.videoTracks[i].rid {
-			return stream.videoTracks[i], nil
+			return stream.videoTracks[i], i, nil
 		}
 	}
 
-	t := &videoTrack{rid: rid}
+	t := &videoTrack{rid: rid, codec: codec, streamLabel: streamLabel, trackLabel: trackLabel}
 	t.lastKeyFrameSeen.Store(time.Time{})
 	stream.videoTracks = append(stream.videoTracks, t)
-	return t, nil
+	return t, len(stream.videoTracks) - 1, nil
+}
+
+// getPublicIP looks up the public IP of this host via ip-api.com. The result is written to
+// cacheFile if set, which is used instead when the lookup fails or with skipLookup.
+func getPublicIP(cacheFile string, skipLookup bool) (string, error) {
+	publicIPLock.Lock()
+	defer publicIPLock.Unlock()
+
+	if publicIP != "" {
+		return publicIP, nil
+	}
+
+	readCache := func() string {
+		if cacheFile == "" {
+			return ""
+		}
+
+		cached, err := os.ReadFile(cacheFile)
+		if err != nil {
+			logger.Warn("Failed to read PUBLIC_IP_CACHE_FILE", "err", err)
+			return ""
+		}
+
+		return strings.TrimSpace(string(cached))
+	}
+
+	if skipLookup {
+		if publicIP = readCache(); publicIP == "" {
+			return "", errors.New("PUBLIC_IP_SKIP_LOOKUP is set but PUBLIC_IP_CACHE_FILE has no cached IP")
+		}
+
+		return publicIP, nil
+	}
+
+	ip, err := lookupPublicIP()
+	if err != nil {
+		if publicIP = readCache(); publicIP == "" {
+			return "", fmt.Errorf("failed to lookup public IP: %w", err)
+		}
+
+		logger.Warn("Failed to lookup public IP, using cached IP", "ip", publicIP, "err", err)
+		return publicIP, nil
+	}
+
+	if cacheFile != "" {
+		if err = os.WriteFile(cacheFile, []byte(ip+"\n"), 0o600); err != nil {
+			logger.Warn("Failed to write PUBLIC_IP_CACHE_FILE", "err", err)
+		}
+	}
+
+	publicIP = ip
+	return publicIP, nil
 }
 
-func getPublicIP() string {
+func lookupPublicIP() (string, error) {
 	req, err := http.Get("http://ip-api.com/json/")
 	if err != nil {
-		log.Fatal(err)
+		return "", err
 	}
 	defer req.Body.Close()
 
 	body, err := io.ReadAll(req.Body)
 	if err != nil {
-		log.Fatal(err)
+		return "", err
 	}
 
 	ip := struct {
 		Query string
 	}{}
 	if err = json.Unmarshal(body, &ip); err != nil {
-		log.Fatal(err)
+		return "", err
 	}
 
 	if ip.Query == "" {
-		log.Fatal("Query entry was not populated")
+		return "", errors.New("Query entry was not populated")
+	}
+
+	return ip.Query, nil
+}
+
+// getRoleEnv returns the WHIP or WHEP specific value of an environment variable
+// (e.g. `STUN_SERVERS_WHIP`), falling back to the shared one (`STUN_SERVERS`)
+func getRoleEnv(isWHIP bool, key string) string {
+	roleKey := key + "_WHEP"
+	if isWHIP {
+		roleKey = key + "_WHIP"
 	}
 
-	return ip.Query
+	if val := os.Getenv(roleKey); val != "" {
+		return val
+	}
+
+	return os.Getenv(key)
 }
 
-func createSettingEngine(isWHIP bool, udpMuxCache map[int]*ice.MultiUDPMuxDefault, tcpMuxCache map[string]ice.TCPMux) (settingEngine webrtc.SettingEngine) {
+// iceOptionsFromEnv returns the ICEOptions of WHIP or WHEP, read from the environment
+func iceOptionsFromEnv(isWHIP bool) (ICEOptions, error) {
+	splitRoleEnv := func(key string) []string {
+		if val := getRoleEnv(isWHIP, key); val != "" {
+			return strings.Split(val, "|")
+		}
+		return nil
+	}
+
+	opts := ICEOptions{
+		NAT1To1IPs:               splitRoleEnv("NAT_1_TO_1_IP"),
+		IncludePublicIP:          getRoleEnv(isWHIP, "INCLUDE_PUBLIC_IP_IN_NAT_1_TO_1_IP") != "",
+		NATICECandidateType:      getRoleEnv(isWHIP, "NAT_ICE_CANDIDATE_TYPE"),
+		InterfaceFilter:          getRoleEnv(isWHIP, "INTERFACE_FILTER"),
+		IncludeLoopbackCandidate: getRoleEnv(isWHIP, "INCLUDE_LOOPBACK_CANDIDATE") != "",
+		TCPMuxAddress:            getRoleEnv(isWHIP, "TCP_MUX_ADDRESS"),
+		TCPMuxForce:              getRoleEnv(isWHIP, "TCP_MUX_FORCE") != "",
+		DTLSSetupRole:            getRoleEnv(isWHIP, "DTLS_SETUP_ROLE"),
+		STUNServers:              splitRoleEnv("STUN_SERVERS"),
+		TURNServers:              splitRoleEnv("TURN_SERVERS"),
+		TURNUsername:             getRoleEnv(isWHIP, "TURN_USERNAME"),
+		TURNCredential:           getRoleEnv(isWHIP, "TURN_CREDENTIAL"),
+		TURNStreamKeys:           splitRoleEnv("TURN_STREAM_KEYS"),
+		ICETransportPolicy:       getRoleEnv(isWHIP, "ICE_TRANSPORT_POLICY"),
+	}
+
+	if val := getRoleEnv(isWHIP, "UDP_MUX_PORT"); val != "" {
+		port, err := strconv.Atoi(val)
+		if err != nil {
+			return opts, fmt.Errorf("UDP_MUX_PORT: %w", err)
+		}
+		opts.UDPMuxPort = port
+	}
+
+	if getRoleEnv(isWHIP, "ICE_UDP_PORT_MIN") != "" || getRoleEnv(isWHIP, "ICE_UDP_PORT_MAX") != "" {
+		portMin, err := strconv.ParseUint(getRoleEnv(isWHIP, "ICE_UDP_PORT_MIN"), 10, 16)
+		if err != nil {
+			return opts, fmt.Errorf("ICE_UDP_PORT_MIN: %w", err)
+		}
+
+		portMax, err := strconv.ParseUint(getRoleEnv(isWHIP, "ICE_UDP_PORT_MAX"), 10, 16)
+		if err != nil {
+			return opts, fmt.Errorf("ICE_UDP_PORT_MAX: %w", err)
+		}
+
+		opts.UDPPortMin, opts.UDPPortMax = uint16(portMin), uint16(portMax)
+	}
+
+	return opts, nil
+}
+
+func (s *Server) createSettingEngine(opts ICEOptions, udpMuxCache map[int]*ice.MultiUDPMuxDefault, tcpMuxCache map[string]ice.TCPMux) (settingEngine webrtc.SettingEngine, err error) {
 	var (
 		NAT1To1IPs []string
-		udpMuxPort int
 		udpMuxOpts []ice.UDPMuxFromPortOption
-		err        error
 	)
 	networkTypes := []webrtc.NetworkType{webrtc.NetworkTypeUDP4, webrtc.NetworkTypeUDP6}
 
-	if os.Getenv("INCLUDE_PUBLIC_IP_IN_NAT_1_TO_1_IP") != "" {
-		NAT1To1IPs = append(NAT1To1IPs, getPublicIP())
+	if opts.IncludePublicIP {
+		ip, err := getPublicIP(s.publicIPCacheFile, s.publicIPSkipLookup)
+		if err != nil {
+			return settingEngine, err
+		}
+		NAT1To1IPs = append(NAT1To1IPs, ip)
 	}
 
-	if os.Getenv("NAT_1_TO_1_IP") != "" {
-		NAT1To1IPs = append(NAT1To1IPs, strings.Split(os.Getenv("NAT_1_TO_1_IP"), "|")...)
-	}
+	NAT1To1IPs = append(NAT1To1IPs, opts.NAT1To1IPs...)
 
 	natICECandidateType := webrtc.ICECandidateTypeHost
-	if os.Getenv("NAT_ICE_CANDIDATE_TYPE") == "srflx" {
+	if opts.NATICECandidateType == "srflx" {
 		natICECandidateType = webrtc.ICECandidateTypeSrflx
 	}
 
@@ -210,93 +815,136 @@ func createSettingEngine(isWHIP bool, udpMuxCache map[int]*ice.MultiUDPMuxDefaul
 		settingEngine.SetNAT1To1IPs(NAT1To1IPs, natICECandidateType)
 	}
 
-	if os.Getenv("INTERFACE_FILTER") != "" {
+	if opts.InterfaceFilter != "" {
 		interfaceFilter := func(i string) bool {
-			return i == os.Getenv("INTERFACE_FILTER")
+			return i == opts.InterfaceFilter
 		}
 
 		settingEngine.SetInterfaceFilter(interfaceFilter)
 		udpMuxOpts = append(udpMuxOpts, ice.UDPMuxFromPortWithInterfaceFilter(interfaceFilter))
 	}
 
-	if isWHIP && os.Getenv("UDP_MUX_PORT_WHIP") != "" {
-		if udpMuxPort, err = strconv.Atoi(os.Getenv("UDP_MUX_PORT_WHIP")); err != nil {
-			log.Fatal(err)
+	if opts.UDPPortMin != 0 || opts.UDPPortMax != 0 {
+		if opts.UDPPortMin == 0 || opts.UDPPortMin > opts.UDPPortMax {
+			return settingEngine, fmt.Errorf("ICE_UDP_PORT_MIN and ICE_UDP_PORT_MAX must describe a non-empty port range, got %d-%d", opts.UDPPortMin, opts.UDPPortMax)
 		}
-	} else if !isWHIP && os.Getenv("UDP_MUX_PORT_WHEP") != "" {
-		if udpMuxPort, err = strconv.Atoi(os.Getenv("UDP_MUX_PORT_WHEP")); err != nil {
-			log.Fatal(err)
-		}
-	} else if os.Getenv("UDP_MUX_PORT") != "" {
-		if udpMuxPort, err = strconv.Atoi(os.Getenv("UDP_MUX_PORT")); err != nil {
-			log.Fatal(err)
+
+		if err = settingEngine.SetEphemeralUDPPortRange(opts.UDPPortMin, opts.UDPPortMax); err != nil {
+			return settingEngine, fmt.Errorf("failed to set ICE UDP port range: %w", err)
 		}
 	}
 
-	if udpMuxPort != 0 {
-		udpMux, ok := udpMuxCache[udpMuxPort]
+	if opts.UDPMuxPort != 0 {
+		udpMux, ok := udpMuxCache[opts.UDPMuxPort]
 		if !ok {
-			if udpMux, err = ice.NewMultiUDPMuxFromPort(udpMuxPort, udpMuxOpts...); err != nil {
-				log.Fatal(err)
+			if udpMux, err = ice.NewMultiUDPMuxFromPort(opts.UDPMuxPort, udpMuxOpts...); err != nil {
+				return settingEngine, fmt.Errorf("failed to listen on UDP_MUX_PORT %d: %w", opts.UDPMuxPort, err)
 			}
-			udpMuxCache[udpMuxPort] = udpMux
+			udpMuxCache[opts.UDPMuxPort] = udpMux
 		}
 
 		settingEngine.SetICEUDPMux(udpMux)
 	}
 
-	if os.Getenv("TCP_MUX_ADDRESS") != "" {
-		tcpMux, ok := tcpMuxCache[os.Getenv("TCP_MUX_ADDRESS")]
+	if opts.TCPMuxAddress != "" {
+		tcpMux, ok := tcpMuxCache[opts.TCPMuxAddress]
 		if !ok {
-			tcpAddr, err := net.ResolveTCPAddr("tcp", os.Getenv("TCP_MUX_ADDRESS"))
+			tcpAddr, err := net.ResolveTCPAddr("tcp", opts.TCPMuxAddress)
 			if err != nil {
-				log.Fatal(err)
+				return settingEngine, fmt.Errorf("TCP_MUX_ADDRESS: %w", err)
 			}
 
 			tcpListener, err := net.ListenTCP("tcp", tcpAddr)
 			if err != nil {
-				log.Fatal(err)
+				return settingEngine, fmt.Errorf("failed to listen on TCP_MUX_ADDRESS %s: %w", tcpAddr, err)
 			}
 
 			tcpMux = webrtc.NewICETCPMux(nil, tcpListener, 8)
-			tcpMuxCache[os.Getenv("TCP_MUX_ADDRESS")] = tcpMux
+			tcpMuxCache[opts.TCPMuxAddress] = tcpMux
 		}
 		settingEngine.SetICETCPMux(tcpMux)
 
-		if os.Getenv("TCP_MUX_FORCE") != "" {
+		if opts.TCPMuxForce {
 			networkTypes = []webrtc.NetworkType{webrtc.NetworkTypeTCP4, webrtc.NetworkTypeTCP6}
 		} else {
 			networkTypes = append(networkTypes, webrtc.NetworkTypeTCP4, webrtc.NetworkTypeTCP6)
 		}
 	}
 
+	switch opts.DTLSSetupRole {
+	case "":
+	case "active":
+		if err = settingEngine.SetAnsweringDTLSRole(webrtc.DTLSRoleClient); err != nil {
+			return settingEngine, fmt.Errorf("failed to set DTLS role: %w", err)
+		}
+	case "passive":
+		if err = settingEngine.SetAnsweringDTLSRole(webrtc.DTLSRoleServer); err != nil {
+			return settingEngine, fmt.Errorf("failed to set DTLS role: %w", err)
+		}
+	default:
+		return settingEngine, fmt.Errorf("DTLS_SETUP_ROLE must be `active` or `passive`, got %q", opts.DTLSSetupRole)
+	}
+
 	settingEngine.SetDTLSEllipticCurves(elliptic.X25519, elliptic.P384, elliptic.P256)
 	settingEngine.SetNetworkTypes(networkTypes)
 	settingEngine.DisableSRTCPReplayProtection(true)
 	settingEngine.DisableSRTPReplayProtection(true)
-	settingEngine.SetIncludeLoopbackCandidate(os.Getenv("INCLUDE_LOOPBACK_CANDIDATE") != "")
+	settingEngine.SetIncludeLoopbackCandidate(opts.IncludeLoopbackCandidate)
 
-	return
+	return settingEngine, nil
 }
 
+// PopulateMediaEngine registers the codecs Broadcast Box negotiates by default
 func PopulateMediaEngine(m *webrtc.MediaEngine) error {
+	return populateMediaEngine(m, false)
+}
+
+type videoCodecDetails struct {
+	payloadType uint8
+	mimeType    string
+	sdpFmtpLine string
+}
+
+// H265 is only negotiated with ENABLE_H265, as few browsers can decode it. level-id is left
+// out so publishers and viewers of any level match.
+var h265CodecDetails = []videoCodecDetails{
+	{49, webrtc.MimeTypeH265, "profile-id=1;tier-flag=0;tx-mode=SRST"},
+	{51, webrtc.MimeTypeH265, "profile-id=2;tier-flag=0;tx-mode=SRST"},
+}
+
+func populateMediaEngine(m *webrtc.MediaEngine, enableH265 bool) error {
 	for _, codec := range []webrtc.RTPCodecParameters{
 		{
 			// nolint
 			RTPCodecCapability: webrtc.RTPCodecCapability{webrtc.MimeTypeOpus, 48000, 2, "minptime=10;useinbandfec=1", nil},
 			PayloadType:        111,
 		},
+		// 5.1 and 7.1 surround, with the channel mappings of libwebrtc
+		{
+			RTPCodecCapability: webrtc.RTPCodecCapability{
+				MimeType:    mimeTypeMultiopus,
+				ClockRate:   48000,
+				Channels:    6,
+				SDPFmtpLine: "channel_mapping=0,4,1,2,3,5;coupled_streams=2;minptime=10;num_streams=4;useinbandfec=1",
+			},
+			PayloadType: 112,
+		},
+		{
+			RTPCodecCapability: webrtc.RTPCodecCapability{
+				MimeType:    mimeTypeMultiopus,
+				ClockRate:   48000,
+				Channels:    8,
+				SDPFmtpLine: "channel_mapping=0,6,1,2,3,4,5,7;coupled_streams=3;minptime=10;num_streams=5;useinbandfec=1",
+			},
+			PayloadType: 113,
+		},
 	} {
 		if err := m.RegisterCodec(codec, webrtc.RTPCodecTypeAudio); err != nil {
 			return err
 		}
 	}
 
-	for _, codecDetails := range []struct {
-		payloadType uint8
-		mimeType    string
-		sdpFmtpLine string
-	}{
+	videoCodecs := []videoCodecDetails{
 		{102, webrtc.MimeTypeH264, "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42001f"},
 		{104, webrtc.MimeTypeH264, "level-asymmetry-allowed=1;packetization-mode=0;profile-level-id=42001f"},
 		{106, webrtc.MimeTypeH264, "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f"},
@@ -305,7 +953,12 @@ func PopulateMediaEngine(m *webrtc.MediaEngine) error {
 		{45, webrtc.MimeTypeAV1, ""},
 		{98, webrtc.MimeTypeVP9, "profile-id=0"},
 		{100, webrtc.MimeTypeVP9, "profile-id=2"},
-	} {
+	}
+	if enableH265 {
+		videoCodecs = append(videoCodecs, h265CodecDetails...)
+	}
+
+	for _, codecDetails := range videoCodecs {
 		if err := m.RegisterCodec(webrtc.RTPCodecParameters{
 			RTPCodecCapability: webrtc.RTPCodecCapability{
 				MimeType:     codecDetails.mimeType,
@@ -333,25 +986,74 @@ func PopulateMediaEngine(m *webrtc.MediaEngine) error {
 		}
 	}
 
-	return nil
+	return m.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: videoOrientationURI}, webrtc.RTPCodecTypeVideo)
+}
+
+// Relay candidates are only gathered for streams listed in TURNStreamKeys,
+// or for every stream if it is empty
+func useTURNForStream(opts ICEOptions, streamKey string) bool {
+	if len(opts.TURNStreamKeys) == 0 {
+		return true
+	}
+
+	for _, k := range opts.TURNStreamKeys {
+		if k == streamKey {
+			return true
+		}
+	}
+
+	return false
 }
 
-func newPeerConnection(api *webrtc.API) (*webrtc.PeerConnection, error) {
+func (s *Server) newPeerConnection(isWHIP bool, streamKey string) (*webrtc.PeerConnection, error) {
+	api, opts := s.apiWhep, s.whepICE
+	if isWHIP {
+		api, opts = s.apiWhip, s.whipICE
+	}
+
 	cfg := webrtc.Configuration{}
 
-	if stunServers := os.Getenv("STUN_SERVERS"); stunServers != "" {
-		for _, stunServer := range strings.Split(stunServers, "|") {
+	for _, stunServer := range opts.STUNServers {
+		cfg.ICEServers = append(cfg.ICEServers, webrtc.ICEServer{
+			URLs: []string{"stun:" + stunServer},
+		})
+	}
+
+	if useTURNForStream(opts, streamKey) {
+		for _, turnServer := range opts.TURNServers {
 			cfg.ICEServers = append(cfg.ICEServers, webrtc.ICEServer{
-				URLs: []string{"stun:" + stunServer},
+				URLs:       []string{"turn:" + turnServer},
+				Username:   opts.TURNUsername,
+				Credential: opts.TURNCredential,
 			})
 		}
 	}
 
-	return api.NewPeerConnection(cfg)
+	if opts.ICETransportPolicy == "relay" {
+		cfg.ICETransportPolicy = webrtc.ICETransportPolicyRelay
+	}
+
+	return s.buildPeerConnection(api, cfg, isWHIP, streamKey)
+}
+
+// stopVideoTransceivers answers every video m-line of the remote description as inactive,
+// so no video is sent or received
+func stopVideoTransceivers(peerConnection *webrtc.PeerConnection) error {
+	for _, transceiver := range peerConnection.GetTransceivers() {
+		if transceiver.Kind() != webrtc.RTPCodecTypeVideo {
+			continue
+		}
+
+		if err := transceiver.Stop(); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
-func appendAnswer(in string) string {
-	if extraCandidate := os.Getenv("APPEND_CANDIDATE"); extraCandidate != "" {
+func (s *Server) appendAnswer(in string) string {
+	if extraCandidate := s.appendCandidate; extraCandidate != "" {
 		index := strings.Index(in, "a=end-of-candidates")
 		in = in[:index] + extraCandidate + in[index:]
 	}
@@ -371,64 +1073,440 @@ func maybePrintOfferAnswer(sdp string, isOffer bool) string {
 	return sdp
 }
 
-func Configure() {
-	streamMap = map[string]*stream{}
+// OptionsFromEnv returns the Options of the standalone server, read from the environment
+func OptionsFromEnv() (Options, error) {
+	opts := Options{
+		StreamConfigFile: os.Getenv("STREAM_CONFIG_FILE"),
+		DisableHLS:       os.Getenv("DISABLE_HLS") != "",
+		DisableDASH:      os.Getenv("DISABLE_DASH") != "",
+		EnableH265:       os.Getenv("ENABLE_H265") != "",
+
+		RecordingDirectory: os.Getenv("RECORDING_DIRECTORY"),
+		CaptureDirectory:   os.Getenv("CAPTURE_DIRECTORY"),
+
+		PublicIPCacheFile:  os.Getenv("PUBLIC_IP_CACHE_FILE"),
+		PublicIPSkipLookup: os.Getenv("PUBLIC_IP_SKIP_LOOKUP") != "",
+		AppendCandidate:    os.Getenv("APPEND_CANDIDATE"),
+	}
+
+	var err error
+	if opts.WHIPICE, err = iceOptionsFromEnv(true); err != nil {
+		return opts, err
+	}
+	if opts.WHEPICE, err = iceOptionsFromEnv(false); err != nil {
+		return opts, err
+	}
+
+	if val := os.Getenv("RTP_MTU"); val != "" {
+		mtu, err := strconv.Atoi(val)
+		if err != nil {
+			return opts, fmt.Errorf("RTP_MTU: %w", err)
+		} else if mtu <= 0 {
+			return opts, fmt.Errorf("RTP_MTU must be positive, got %v", mtu)
+		}
+
+		opts.RTPMTU = mtu
+	}
+
+	if val := os.Getenv("PLI_THROTTLE_WINDOW"); val != "" {
+		window, err := time.ParseDuration(val)
+		if err != nil {
+			return opts, fmt.Errorf("PLI_THROTTLE_WINDOW: %w", err)
+		} else if window < 0 {
+			return opts, fmt.Errorf("PLI_THROTTLE_WINDOW must not be negative, got %v", window)
+		}
+
+		opts.PLIThrottleWindow = window
+	}
+
+	if val := os.Getenv("MAX_STREAMS"); val != "" {
+		maxStreams, err := strconv.Atoi(val)
+		if err != nil {
+			return opts, fmt.Errorf("MAX_STREAMS: %w", err)
+		} else if maxStreams < 0 {
+			return opts, fmt.Errorf("MAX_STREAMS must not be negative, got %v", maxStreams)
+		}
+
+		opts.MaxStreams = maxStreams
+	}
+
+	if val := os.Getenv("MAX_VIEWERS_PER_STREAM"); val != "" {
+		maxViewers, err := strconv.Atoi(val)
+		if err != nil {
+			return opts, fmt.Errorf("MAX_VIEWERS_PER_STREAM: %w", err)
+		} else if maxViewers < 0 {
+			return opts, fmt.Errorf("MAX_VIEWERS_PER_STREAM must not be negative, got %v", maxViewers)
+		}
+
+		opts.MaxViewersPerStream = maxViewers
+	}
+
+	switch opts.PublisherConflict = os.Getenv("PUBLISHER_CONFLICT"); opts.PublisherConflict {
+	case "", PublisherConflictFirstWins, PublisherConflictLastWins:
+	default:
+		return opts, fmt.Errorf("PUBLISHER_CONFLICT must be `%s` or `%s`, got %q", PublisherConflictFirstWins, PublisherConflictLastWins, opts.PublisherConflict)
+	}
+
+	if val := os.Getenv("RECORDING_ROTATE_INTERVAL"); val != "" {
+		interval, err := time.ParseDuration(val)
+		if err != nil {
+			return opts, fmt.Errorf("RECORDING_ROTATE_INTERVAL: %w", err)
+		} else if interval < 0 {
+			return opts, fmt.Errorf("RECORDING_ROTATE_INTERVAL must not be negative, got %v", interval)
+		}
+
+		opts.RecordingRotateInterval = interval
+	}
+
+	if val := os.Getenv("RECORDING_MAX_AGE"); val != "" {
+		maxAge, err := time.ParseDuration(val)
+		if err != nil {
+			return opts, fmt.Errorf("RECORDING_MAX_AGE: %w", err)
+		} else if maxAge < 0 {
+			return opts, fmt.Errorf("RECORDING_MAX_AGE must not be negative, got %v", maxAge)
+		}
+
+		opts.RecordingMaxAge = maxAge
+	}
+
+	if val := os.Getenv("RECORDING_MAX_BYTES"); val != "" {
+		maxBytes, err := parseByteSize(val)
+		if err != nil {
+			return opts, fmt.Errorf("RECORDING_MAX_BYTES: %w", err)
+		}
+
+		opts.RecordingMaxBytes = maxBytes
+	}
+
+	if val := os.Getenv("CLIP_BUFFER_DURATION"); val != "" {
+		duration, err := time.ParseDuration(val)
+		if err != nil {
+			return opts, fmt.Errorf("CLIP_BUFFER_DURATION: %w", err)
+		} else if duration < 0 {
+			return opts, fmt.Errorf("CLIP_BUFFER_DURATION must not be negative, got %v", duration)
+		}
+
+		opts.ClipBufferDuration = duration
+	}
+
+	if val := os.Getenv("THUMBNAIL_INTERVAL"); val != "" {
+		interval, err := time.ParseDuration(val)
+		if err != nil {
+			return opts, fmt.Errorf("THUMBNAIL_INTERVAL: %w", err)
+		} else if interval <= 0 {
+			return opts, fmt.Errorf("THUMBNAIL_INTERVAL must be positive, got %v", interval)
+		}
+
+		opts.ThumbnailInterval = interval
+	}
+
+	if val := os.Getenv("RECORDING_UPLOAD_URL"); val != "" {
+		opts.RecordingUpload = &s3.Options{
+			URL:             val,
+			Region:          os.Getenv("RECORDING_UPLOAD_REGION"),
+			AccessKeyID:     os.Getenv("RECORDING_UPLOAD_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("RECORDING_UPLOAD_SECRET_ACCESS_KEY"),
+		}
+		opts.RecordingUploadPrefix = os.Getenv("RECORDING_UPLOAD_PREFIX")
+		opts.RecordingUploadKeepLocal = os.Getenv("RECORDING_UPLOAD_KEEP_LOCAL") != ""
+	}
+
+	if val := os.Getenv("RELAY_UPSTREAM_URL"); val != "" {
+		opts.RelayUpstreamURL = val
+		opts.RelayStreamKeys = strings.Split(os.Getenv("RELAY_STREAM_KEYS"), "|")
+		opts.RelayOnDemand = os.Getenv("RELAY_ON_DEMAND") != ""
+	}
+
+	if val := os.Getenv("EVENTS_STATS_INTERVAL"); val != "" {
+		interval, err := time.ParseDuration(val)
+		if err != nil {
+			return opts, fmt.Errorf("EVENTS_STATS_INTERVAL: %w", err)
+		} else if interval <= 0 {
+			return opts, fmt.Errorf("EVENTS_STATS_INTERVAL must be positive, got %v", interval)
+		}
+
+		opts.StatsEventInterval = interval
+	}
+
+	return opts, nil
+}
+
+func NewServer(opts Options) (*Server, error) {
+	s := &Server{
+		streamMap:       map[string]*stream{},
+		restreamTargets: map[string][]RestreamTarget{},
+		relayStreamKeys: map[string]bool{},
+		onDemandRelays:  map[string]bool{},
+		rtpMTU:          opts.RTPMTU,
+
+		activeRecordings:   map[string]bool{},
+		clipBufferDuration: opts.ClipBufferDuration,
+		thumbnailInterval:  opts.ThumbnailInterval,
+
+		pliThrottleWindow: opts.PLIThrottleWindow,
+		hlsDisabled:       opts.DisableHLS,
+		dashDisabled:      opts.DisableDASH,
+
+		maxStreams:          opts.MaxStreams,
+		maxViewersPerStream: opts.MaxViewersPerStream,
+		publisherConflict:   opts.PublisherConflict,
+
+		recordingDirectory:      opts.RecordingDirectory,
+		recordingRotateInterval: opts.RecordingRotateInterval,
+
+		recordingMaxAge:   opts.RecordingMaxAge,
+		recordingMaxBytes: opts.RecordingMaxBytes,
+
+		recordingUploadPrefix:    opts.RecordingUploadPrefix,
+		recordingUploadKeepLocal: opts.RecordingUploadKeepLocal,
+
+		whipICE:            opts.WHIPICE,
+		whepICE:            opts.WHEPICE,
+		publicIPCacheFile:  opts.PublicIPCacheFile,
+		publicIPSkipLookup: opts.PublicIPSkipLookup,
+		appendCandidate:    opts.AppendCandidate,
+
+		captureDirectory: opts.CaptureDirectory,
+		captures:         map[string]*packetCapture{},
+		viewerHistories:  map[string]*viewerHistory{},
+		usage:            map[string]*Usage{},
+		streamMetadata:   map[string]StreamMetadata{},
+		closed:           make(chan struct{}),
+	}
+	s.captureInterceptors = &captureInterceptorFactory{s: s}
+
+	if s.publisherConflict == "" {
+		s.publisherConflict = PublisherConflictFirstWins
+	}
+	if s.rtpMTU == 0 {
+		s.rtpMTU = rtpMTUDefault
+	}
+	if s.recordingDirectory == "" {
+		s.recordingDirectory = recordingDirectoryDefault
+	}
+	if s.captureDirectory == "" {
+		s.captureDirectory = captureDirectoryDefault
+	}
+	if s.recordingUploadPrefix == "" {
+		s.recordingUploadPrefix = recordingUploadPrefixDefault
+	}
+
+	if opts.RecordingUpload != nil {
+		client, err := s3.New(*opts.RecordingUpload)
+		if err != nil {
+			return nil, err
+		}
+		s.recordingUpload = client
+	}
+
+	if err := s.loadStreamConfigs(opts.StreamConfigFile); err != nil {
+		return nil, err
+	}
 
 	mediaEngine := &webrtc.MediaEngine{}
-	if err := PopulateMediaEngine(mediaEngine); err != nil {
-		panic(err)
+	if err := populateMediaEngine(mediaEngine, opts.EnableH265); err != nil {
+		return nil, err
 	}
 
+	// Captures are the first interceptor, so they get packets as they are on the wire with the
+	// RTCP and retransmissions of the others
 	interceptorRegistry := &interceptor.Registry{}
+	interceptorRegistry.Add(s.captureInterceptors)
 	if err := webrtc.RegisterDefaultInterceptors(mediaEngine, interceptorRegistry); err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
 	udpMuxCache := map[int]*ice.MultiUDPMuxDefault{}
 	tcpMuxCache := map[string]ice.TCPMux{}
 
-	apiWhip = webrtc.NewAPI(
+	whipSettingEngine, whepSettingEngine := opts.WHIPSettingEngine, opts.WHEPSettingEngine
+	if whipSettingEngine == nil {
+		settingEngine, err := s.createSettingEngine(s.whipICE, udpMuxCache, tcpMuxCache)
+		if err != nil {
+			closeMuxes(udpMuxCache, tcpMuxCache)
+			return nil, err
+		}
+		whipSettingEngine = &settingEngine
+	}
+
+	if whepSettingEngine == nil {
+		settingEngine, err := s.createSettingEngine(s.whepICE, udpMuxCache, tcpMuxCache)
+		if err != nil {
+			closeMuxes(udpMuxCache, tcpMuxCache)
+			return nil, err
+		}
+		whepSettingEngine = &settingEngine
+	}
+
+	s.apiWhip = webrtc.NewAPI(
 		webrtc.WithMediaEngine(mediaEngine),
 		webrtc.WithInterceptorRegistry(interceptorRegistry),
-		webrtc.WithSettingEngine(createSettingEngine(true, udpMuxCache, tcpMuxCache)),
+		webrtc.WithSettingEngine(*whipSettingEngine),
 	)
 
-	apiWhep = webrtc.NewAPI(
+	s.apiWhep = webrtc.NewAPI(
 		webrtc.WithMediaEngine(mediaEngine),
 		webrtc.WithInterceptorRegistry(interceptorRegistry),
-		webrtc.WithSettingEngine(createSettingEngine(false, udpMuxCache, tcpMuxCache)),
+		webrtc.WithSettingEngine(*whepSettingEngine),
 	)
+	for _, udpMux := range udpMuxCache {
+		s.udpMuxes = append(s.udpMuxes, udpMux)
+	}
+	for _, tcpMux := range tcpMuxCache {
+		s.tcpMuxes = append(s.tcpMuxes, tcpMux)
+	}
+
+	s.events = events.NewBus(opts.EventPublishers...)
+
+	if s.recordingMaxAge > 0 || s.recordingMaxBytes > 0 {
+		go s.runRecordingRetention()
+	}
+
+	go s.sampleViewerHistories()
+
+	if opts.StatsEventInterval > 0 {
+		go s.emitStatsEvents(opts.StatsEventInterval)
+	}
+
+	if opts.RelayUpstreamURL != "" {
+		for _, streamKey := range opts.RelayStreamKeys {
+			if streamKey != "" {
+				s.relayStreamKeys[streamKey] = true
+				go s.runRelay(opts.RelayUpstreamURL, streamKey)
+			}
+		}
+
+		if opts.RelayOnDemand {
+			s.relayOnDemandURL = opts.RelayUpstreamURL
+		}
+	}
+
+	return s, nil
+}
+
+// closeMuxes closes the sockets createSettingEngine opened for a Server that failed to start
+func closeMuxes(udpMuxCache map[int]*ice.MultiUDPMuxDefault, tcpMuxCache map[string]ice.TCPMux) {
+	for _, udpMux := range udpMuxCache {
+		_ = udpMux.Close()
+	}
+	for _, tcpMux := range tcpMuxCache {
+		_ = tcpMux.Close()
+	}
+}
+
+// Close stops the background work of s, like relaying RELAY_STREAM_KEYS and pruning
+// recordings, closes every stream and the UDP_MUX_PORT and TCP_MUX_ADDRESS sockets it opened.
+// s can't be used afterwards.
+func (s *Server) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+	})
+
+	s.streamMapLock.Lock()
+	streamKeys := make([]string, 0, len(s.streamMap))
+	for streamKey := range s.streamMap {
+		streamKeys = append(streamKeys, streamKey)
+	}
+	s.streamMapLock.Unlock()
+
+	for _, streamKey := range streamKeys {
+		s.closeStream(streamKey, "server closed")
+	}
+	s.events.Close()
+
+	var errs []error
+	for _, udpMux := range s.udpMuxes {
+		errs = append(errs, udpMux.Close())
+	}
+	for _, tcpMux := range s.tcpMuxes {
+		errs = append(errs, tcpMux.Close())
+	}
+
+	return errors.Join(errs...)
+}
+
+// Configure creates the Server used by the package level functions from the environment
+func Configure() error {
+	opts, err := OptionsFromEnv()
+	if err != nil {
+		return err
+	}
+
+	s, err := NewServer(opts)
+	if err != nil {
+		return err
+	}
+
+	defaultServer = s
+	return nil
 }
 
+// StreamStatusVideo is a video track of the publisher, one per simulcast layer. Bitrates are
+// in bits per second over the last full second.
 type StreamStatusVideo struct {
 	RID              string    `json:"rid"`
+	StreamLabel      string    `json:"streamLabel"`
+	TrackLabel       string    `json:"trackLabel"`
+	Codec            string    `json:"codec"`
 	PacketsReceived  uint64    `json:"packetsReceived"`
+	BytesReceived    uint64    `json:"bytesReceived"`
+	Bitrate          uint64    `json:"bitrate"`
 	LastKeyFrameSeen time.Time `json:"lastKeyFrameSeen"`
 }
 
 type StreamStatus struct {
-	StreamKey            string              `json:"streamKey"`
-	FirstSeenEpoch       uint64              `json:"firstSeenEpoch"`
-	AudioPacketsReceived uint64              `json:"audioPacketsReceived"`
-	VideoStreams         []StreamStatusVideo `json:"videoStreams"`
-	WHEPSessions         []whepSessionStatus `json:"whepSessions"`
+	StreamKey      string `json:"streamKey"`
+	FirstSeenEpoch uint64 `json:"firstSeenEpoch"`
+	Paused         bool   `json:"paused"`
+	AudioOnly      bool   `json:"audioOnly"`
+	Recording      bool   `json:"recording"`
+
+	// StreamMetadata of the stream key, or the title of its Stream Configuration
+	Title        string `json:"title,omitempty"`
+	Description  string `json:"description,omitempty"`
+	Category     string `json:"category,omitempty"`
+	ThumbnailURL string `json:"thumbnailUrl,omitempty"`
+
+	// When the current publisher connected and how many seconds ago, unset without one
+	PublisherConnectedAt      *time.Time `json:"publisherConnectedAt,omitempty"`
+	PublisherConnectedSeconds float64    `json:"publisherConnectedSeconds,omitempty"`
+
+	AudioCodec           string `json:"audioCodec,omitempty"`
+	AudioChannels        int    `json:"audioChannels,omitempty"`
+	AudioPacketsReceived uint64 `json:"audioPacketsReceived"`
+	AudioBytesReceived   uint64 `json:"audioBytesReceived"`
+	AudioBitrate         uint64 `json:"audioBitrate"`
+
+	VideoStreams []StreamStatusVideo `json:"videoStreams"`
+	WHEPSessions []whepSessionStatus `json:"whepSessions"`
 }
 
 type whepSessionStatus struct {
-	ID             string `json:"id"`
-	CurrentLayer   string `json:"currentLayer"`
-	SequenceNumber uint16 `json:"sequenceNumber"`
-	Timestamp      uint32 `json:"timestamp"`
-	PacketsWritten uint64 `json:"packetsWritten"`
+	ID                 string    `json:"id"`
+	CurrentLayer       string    `json:"currentLayer"`
+	ConnectedAt        time.Time `json:"connectedAt"`
+	ICEConnectionState string    `json:"iceConnectionState"`
+	SequenceNumber     uint16    `json:"sequenceNumber"`
+	Timestamp          uint32    `json:"timestamp"`
+	PacketsWritten     uint64    `json:"packetsWritten"`
 }
 
 func GetStreamStatuses() []StreamStatus {
-	streamMapLock.Lock()
-	defer streamMapLock.Unlock()
+	return defaultServer.GetStreamStatuses()
+}
+
+func (s *Server) GetStreamStatuses() []StreamStatus {
+	s.streamMapLock.Lock()
+	defer s.streamMapLock.Unlock()
 
 	out := []StreamStatus{}
 
-	for streamKey, stream := range streamMap {
+	for streamKey, stream := range s.streamMap {
+		recording := false
+		if tap := stream.tap.Load(); tap != nil && stream.hasWHIPClient.Load() {
+			recording = tap.getRecording() != nil
+		}
+
 		whepSessions := []whepSessionStatus{}
 		stream.whepSessionsLock.Lock()
 		for id, whepSession := range stream.whepSessions {
@@ -438,11 +1516,13 @@ func GetStreamStatuses() []StreamStatus {
 			}
 
 			whepSessions = append(whepSessions, whepSessionStatus{
-				ID:             id,
-				CurrentLayer:   currentLayer,
-				SequenceNumber: whepSession.sequenceNumber,
-				Timestamp:      whepSession.timestamp,
-				PacketsWritten: whepSession.packetsWritten,
+				ID:                 id,
+				CurrentLayer:       currentLayer,
+				ConnectedAt:        whepSession.created,
+				ICEConnectionState: whepSession.peerConnection.ICEConnectionState().String(),
+				SequenceNumber:     whepSession.sequenceNumber,
+				Timestamp:          whepSession.timestamp,
+				PacketsWritten:     whepSession.packetsWritten,
 			})
 		}
 		stream.whepSessionsLock.Unlock()
@@ -456,18 +1536,46 @@ func GetStreamStatuses() []StreamStatus {
 
 			streamStatusVideo = append(streamStatusVideo, StreamStatusVideo{
 				RID:              videoTrack.rid,
+				StreamLabel:      videoTrack.streamLabel,
+				TrackLabel:       videoTrack.trackLabel,
+				Codec:            videoTrack.codec.mimeType(),
 				PacketsReceived:  videoTrack.packetsReceived.Load(),
+				BytesReceived:    videoTrack.bytesReceived.Load(),
+				Bitrate:          videoTrack.bitrate.bitsPerSecond(),
 				LastKeyFrameSeen: lastKeyFrameSeen,
 			})
 		}
 
-		out = append(out, StreamStatus{
+		metadata := s.storedStreamMetadata(streamKey)
+		if metadata.Title == "" {
+			metadata.Title = stream.config.Title
+		}
+
+		status := StreamStatus{
 			StreamKey:            streamKey,
+			Title:                metadata.Title,
+			Description:          metadata.Description,
+			Category:             metadata.Category,
+			ThumbnailURL:         metadata.ThumbnailURL,
 			FirstSeenEpoch:       stream.firstSeenEpoch,
+			Paused:               stream.paused.Load(),
+			AudioOnly:            stream.config.AudioOnly,
+			Recording:            recording,
 			AudioPacketsReceived: stream.audioPacketsReceived.Load(),
+			AudioBytesReceived:   stream.audioBytesReceived.Load(),
+			AudioBitrate:         stream.audioBitrate.bitsPerSecond(),
 			VideoStreams:         streamStatusVideo,
 			WHEPSessions:         whepSessions,
-		})
+		}
+		if connected := stream.publisherConnectedTime; !connected.IsZero() {
+			status.PublisherConnectedAt = &connected
+			status.PublisherConnectedSeconds = time.Since(connected).Seconds()
+		}
+		if audioCodec := stream.audioCodec.Load(); audioCodec != nil {
+			status.AudioCodec, status.AudioChannels = audioCodec.mimeType()
+		}
+
+		out = append(out, status)
 	}
 
 	return out
@@ -0,0 +1,447 @@
+package webrtc
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/glimesh/broadcast-box/internal/events"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
+)
+
+func newTestServer(t *testing.T, opts Options) *Server {
+	t.Helper()
+
+	opts.DisableHLS = true
+	opts.DisableDASH = true
+	opts.RecordingDirectory = t.TempDir()
+
+	s, err := NewServer(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = s.Close() })
+
+	return s
+}
+
+func newTestPeerConnection(t *testing.T) *webrtc.PeerConnection {
+	t.Helper()
+
+	mediaEngine := &webrtc.MediaEngine{}
+	if err := PopulateMediaEngine(mediaEngine); err != nil {
+		t.Fatal(err)
+	}
+
+	peerConnection, err := webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine)).NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = peerConnection.Close() })
+
+	return peerConnection
+}
+
+// newTestViewer returns a PeerConnection that receives audio and videoTracks video tracks
+func newTestViewer(t *testing.T, videoTracks int) *webrtc.PeerConnection {
+	t.Helper()
+
+	peerConnection := newTestPeerConnection(t)
+	recvonly := webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}
+	if _, err := peerConnection.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio, recvonly); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < videoTracks; i++ {
+		if _, err := peerConnection.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, recvonly); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return peerConnection
+}
+
+// negotiate sends the offer of peerConnection with its candidates and applies the answer
+func negotiate(t *testing.T, peerConnection *webrtc.PeerConnection, signal func(offer string) (string, error)) string {
+	t.Helper()
+
+	offer, err := peerConnection.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gatherComplete := webrtc.GatheringCompletePromise(peerConnection)
+	if err = peerConnection.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	<-gatherComplete
+
+	answer, err := signal(peerConnection.LocalDescription().SDP)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = peerConnection.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: answer}); err != nil {
+		t.Fatal(err)
+	}
+
+	return answer
+}
+
+// publishVideo publishes an H264 track for every `<stream id>/<track id>` msid of labels under
+// streamKey and returns once the Server received all of them
+func publishVideo(t *testing.T, s *Server, streamKey string, labels ...[2]string) *webrtc.PeerConnection {
+	t.Helper()
+
+	peerConnection := newTestPeerConnection(t)
+	tracks := []*webrtc.TrackLocalStaticSample{}
+	for _, label := range labels {
+		track, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000, SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f"}, label[1], label[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = peerConnection.AddTrack(track); err != nil {
+			t.Fatal(err)
+		}
+		tracks = append(tracks, track)
+	}
+
+	negotiate(t, peerConnection, func(offer string) (string, error) {
+		return s.WHIPWithCredential(context.Background(), offer, streamKey, "")
+	})
+
+	deadline := time.Now().Add(10 * time.Second)
+	for videoTrackCount(s, streamKey) < len(labels) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Server received %d of %d video tracks", videoTrackCount(s, streamKey), len(labels))
+		}
+
+		for _, track := range tracks {
+			if err := track.WriteSample(media.Sample{Data: []byte{0x00, 0x00, 0x00, 0x01, 0x65, 0x88, 0x84}, Duration: 40 * time.Millisecond}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		time.Sleep(40 * time.Millisecond)
+	}
+
+	return peerConnection
+}
+
+func videoTrackCount(s *Server, streamKey string) int {
+	s.streamMapLock.Lock()
+	defer s.streamMapLock.Unlock()
+
+	if stream, ok := s.streamMap[streamKey]; ok {
+		return len(stream.videoTracks)
+	}
+	return 0
+}
+
+func TestGetStreamConcurrent(t *testing.T) {
+	s := newTestServer(t, Options{MaxViewersPerStream: 1000})
+
+	const workers, iterations = 16, 50
+	start := make(chan struct{})
+	found := make(chan *stream, workers*iterations)
+	wg := sync.WaitGroup{}
+	for worker := 0; worker < workers; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			<-start
+
+			forWHIP := worker%2 == 0
+			for i := 0; i < iterations; i++ {
+				s.streamMapLock.Lock()
+				stream, err := s.getStream("race", forWHIP)
+				s.streamMapLock.Unlock()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				found <- stream
+
+				// Viewers come and go with only whepSessionsLock held
+				if !forWHIP {
+					whepSessionId := fmt.Sprintf("%d-%d", worker, i)
+					stream.whepSessionsLock.Lock()
+					stream.whepSessions[whepSessionId] = &whepSession{}
+					stream.whepSessionsLock.Unlock()
+
+					stream.whepSessionsLock.Lock()
+					delete(stream.whepSessions, whepSessionId)
+					stream.whepSessionsLock.Unlock()
+				}
+			}
+		}(worker)
+	}
+
+	close(start)
+	wg.Wait()
+	close(found)
+
+	first := <-found
+	for stream := range found {
+		if stream != first {
+			t.Fatal("concurrent requests for a new stream key created more than one stream")
+		}
+	}
+
+	s.streamMapLock.Lock()
+	defer s.streamMapLock.Unlock()
+	if len(s.streamMap) != 1 || s.streamMap["race"] != first {
+		t.Fatalf("stream map has %d streams", len(s.streamMap))
+	}
+}
+
+func TestICEUDPPortRange(t *testing.T) {
+	s := newTestServer(t, Options{WHEPICE: ICEOptions{UDPPortMin: 40100, UDPPortMax: 40110}})
+
+	answer := negotiate(t, newTestViewer(t, 1), func(offer string) (string, error) {
+		answer, _, err := s.WHEPContext(context.Background(), offer, "port-range")
+		return answer, err
+	})
+
+	candidates := 0
+	for _, line := range strings.Split(answer, "\r\n") {
+		if !strings.HasPrefix(line, "a=candidate:") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		port, err := strconv.Atoi(fields[5])
+		if err != nil {
+			t.Fatal(err)
+		} else if port < 40100 || port > 40110 {
+			t.Fatalf("candidate outside of UDPPortMin and UDPPortMax: %s", line)
+		}
+		candidates++
+	}
+
+	if candidates == 0 {
+		t.Fatalf("answer has no candidates:\n%s", answer)
+	}
+}
+
+func TestICEUDPPortRangeInvalid(t *testing.T) {
+	for _, portRange := range [][2]uint16{{40110, 40100}, {0, 40100}, {40100, 0}} {
+		if _, err := NewServer(Options{DisableHLS: true, DisableDASH: true, WHIPICE: ICEOptions{UDPPortMin: portRange[0], UDPPortMax: portRange[1]}}); err == nil {
+			t.Errorf("NewServer accepted the port range %d-%d", portRange[0], portRange[1])
+		}
+	}
+
+	for _, portRange := range [][2]string{{"40100", ""}, {"40100", "70000"}} {
+		t.Setenv("ICE_UDP_PORT_MIN", portRange[0])
+		t.Setenv("ICE_UDP_PORT_MAX", portRange[1])
+
+		if _, err := OptionsFromEnv(); err == nil {
+			t.Errorf("OptionsFromEnv accepted the port range %s-%s", portRange[0], portRange[1])
+		}
+	}
+}
+
+func TestDTLSSetupRole(t *testing.T) {
+	for role, setup := range map[string]string{"": "active", "active": "active", "passive": "passive"} {
+		s := newTestServer(t, Options{WHEPICE: ICEOptions{DTLSSetupRole: role}})
+
+		answer := negotiate(t, newTestViewer(t, 1), func(offer string) (string, error) {
+			answer, _, err := s.WHEPContext(context.Background(), offer, "setup-role")
+			return answer, err
+		})
+		if !strings.Contains(answer, "a=setup:"+setup+"\r\n") || strings.Contains(answer, "a=setup:actpass") {
+			t.Errorf("DTLSSetupRole %q answered without a=setup:%s:\n%s", role, setup, answer)
+		}
+	}
+
+	if _, err := NewServer(Options{DisableHLS: true, DisableDASH: true, WHIPICE: ICEOptions{DTLSSetupRole: "actpass"}}); err == nil {
+		t.Error("NewServer accepted the DTLSSetupRole actpass")
+	}
+}
+
+func TestICEOptionsFromEnv(t *testing.T) {
+	t.Setenv("NAT_1_TO_1_IP", "198.51.100.1")
+	t.Setenv("NAT_1_TO_1_IP_WHIP", "")
+	t.Setenv("NAT_1_TO_1_IP_WHEP", "203.0.113.7|203.0.113.8")
+	t.Setenv("ICE_UDP_PORT_MIN_WHEP", "40100")
+	t.Setenv("ICE_UDP_PORT_MAX_WHEP", "40110")
+
+	opts, err := OptionsFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(opts.WHIPICE, ICEOptions{NAT1To1IPs: []string{"198.51.100.1"}}) {
+		t.Errorf("WHIP without its own values got %+v instead of the shared ones", opts.WHIPICE)
+	}
+	if !reflect.DeepEqual(opts.WHEPICE, ICEOptions{NAT1To1IPs: []string{"203.0.113.7", "203.0.113.8"}, UDPPortMin: 40100, UDPPortMax: 40110}) {
+		t.Errorf("WHEP got %+v instead of its own values", opts.WHEPICE)
+	}
+
+	t.Setenv("NAT_1_TO_1_IP", "")
+	if val := getRoleEnv(true, "NAT_1_TO_1_IP"); val != "" {
+		t.Errorf("WHIP got %q without any value", val)
+	}
+}
+
+func TestRoleSpecificSettingEngines(t *testing.T) {
+	s := newTestServer(t, Options{
+		WHIPICE: ICEOptions{NAT1To1IPs: []string{"198.51.100.1"}},
+		WHEPICE: ICEOptions{NAT1To1IPs: []string{"203.0.113.7"}},
+	})
+
+	publisher := newTestPeerConnection(t)
+	if _, err := publisher.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionSendonly}); err != nil {
+		t.Fatal(err)
+	}
+	whipAnswer := negotiate(t, publisher, func(offer string) (string, error) {
+		return s.WHIPWithCredential(context.Background(), offer, "roles", "")
+	})
+
+	whepAnswer := negotiate(t, newTestViewer(t, 1), func(offer string) (string, error) {
+		answer, _, err := s.WHEPContext(context.Background(), offer, "roles")
+		return answer, err
+	})
+
+	if !strings.Contains(whipAnswer, " 198.51.100.1 ") || strings.Contains(whipAnswer, " 203.0.113.7 ") {
+		t.Errorf("WHIP answer doesn't only announce its NAT1To1IPs:\n%s", whipAnswer)
+	}
+	if !strings.Contains(whepAnswer, " 203.0.113.7 ") || strings.Contains(whepAnswer, " 198.51.100.1 ") {
+		t.Errorf("WHEP answer doesn't only announce its NAT1To1IPs:\n%s", whepAnswer)
+	}
+}
+
+func TestICEServersOfServersAreSeparate(t *testing.T) {
+	relayed := newTestServer(t, Options{WHIPICE: ICEOptions{
+		STUNServers:        []string{"stun.example.com:3478"},
+		TURNServers:        []string{"turn.example.com:3478"},
+		TURNUsername:       "user",
+		TURNCredential:     "pass",
+		TURNStreamKeys:     []string{"relayed"},
+		ICETransportPolicy: "relay",
+	}})
+	direct := newTestServer(t, Options{})
+
+	for _, c := range []struct {
+		s          *Server
+		streamKey  string
+		iceServers int
+		policy     webrtc.ICETransportPolicy
+	}{
+		{relayed, "relayed", 2, webrtc.ICETransportPolicyRelay},
+		{relayed, "other", 1, webrtc.ICETransportPolicyRelay},
+		{direct, "relayed", 0, webrtc.ICETransportPolicyAll},
+	} {
+		peerConnection, err := c.s.newPeerConnection(true, c.streamKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cfg := peerConnection.GetConfiguration()
+		if len(cfg.ICEServers) != c.iceServers || cfg.ICETransportPolicy != c.policy {
+			t.Errorf("%s got the ICE servers %+v and policy %s", c.streamKey, cfg.ICEServers, cfg.ICETransportPolicy)
+		}
+		_ = peerConnection.Close()
+	}
+}
+
+func TestMaxStreamDuration(t *testing.T) {
+	t.Setenv("MAX_STREAM_DURATION", "1s")
+	s := newTestServer(t, Options{})
+	publishVideo(t, s, "limited", [2]string{"desk", "camera"})
+
+	var whepSessionId string
+	negotiate(t, newTestViewer(t, 1), func(offer string) (answer string, err error) {
+		answer, whepSessionId, err = s.WHEPContext(context.Background(), offer, "limited")
+		return answer, err
+	})
+
+	s.streamMapLock.Lock()
+	stream := s.streamMap["limited"]
+	viewer := stream.whepSessions[whepSessionId].peerConnection
+	s.streamMapLock.Unlock()
+
+	select {
+	case <-stream.whipActiveContext.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream wasn't closed after MAX_STREAM_DURATION")
+	}
+
+	if state := viewer.ConnectionState(); state != webrtc.PeerConnectionStateClosed {
+		t.Errorf("WHEP session is %s", state)
+	}
+	if stream.hasWHIPClient.Load() {
+		t.Error("publisher is still attached")
+	}
+
+	s.streamMapLock.Lock()
+	defer s.streamMapLock.Unlock()
+	if _, ok := s.streamMap["limited"]; ok {
+		t.Error("stream wasn't deleted")
+	}
+}
+
+func TestVideoOrientationNegotiated(t *testing.T) {
+	s := newTestServer(t, Options{})
+	extmap := regexp.MustCompile(`a=extmap:\d+ ` + regexp.QuoteMeta(videoOrientationURI) + "\r\n")
+
+	publisher := newTestPeerConnection(t)
+	if _, err := publisher.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionSendonly}); err != nil {
+		t.Fatal(err)
+	}
+	whipAnswer := negotiate(t, publisher, func(offer string) (string, error) {
+		if !extmap.MatchString(offer) {
+			t.Fatalf("WHIP offer doesn't have %s:\n%s", videoOrientationURI, offer)
+		}
+		return s.WHIPWithCredential(context.Background(), offer, "rotated", "")
+	})
+	if !extmap.MatchString(whipAnswer) {
+		t.Errorf("WHIP answer doesn't have %s:\n%s", videoOrientationURI, whipAnswer)
+	}
+
+	whepAnswer := negotiate(t, newTestViewer(t, 1), func(offer string) (string, error) {
+		answer, _, err := s.WHEPContext(context.Background(), offer, "rotated")
+		return answer, err
+	})
+	if !extmap.MatchString(whepAnswer) {
+		t.Errorf("WHEP answer doesn't have %s:\n%s", videoOrientationURI, whepAnswer)
+	}
+}
+
+type testEventPublisher chan events.Event
+
+func (p testEventPublisher) Publish(e events.Event) error {
+	p <- e
+	return nil
+}
+
+func TestEventsOfServersAreSeparate(t *testing.T) {
+	published, other := make(testEventPublisher, 16), make(testEventPublisher, 16)
+	s := newTestServer(t, Options{EventPublishers: []events.Publisher{published}})
+	otherServer := newTestServer(t, Options{EventPublishers: []events.Publisher{other}})
+
+	publishVideo(t, s, "separate", [2]string{"desk", "camera"})
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Close delivers the events of the streams it closed before returning
+	types := []string{}
+	for len(published) > 0 {
+		types = append(types, (<-published).Type)
+	}
+	if strings.Join(types, ",") != events.TypePublishStart+","+events.TypePublishStop {
+		t.Fatalf("Server emitted %v", types)
+	}
+
+	if err := otherServer.Close(); err != nil {
+		t.Fatal(err)
+	} else if len(other) != 0 {
+		t.Fatalf("other Server got the event %+v", <-other)
+	}
+}
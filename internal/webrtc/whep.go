@@ -1,12 +1,17 @@
 package webrtc
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
-	"log"
+	"slices"
 	"sync/atomic"
+	"time"
 
+	"github.com/glimesh/broadcast-box/internal/events"
+	"github.com/glimesh/broadcast-box/internal/tracing"
 	"github.com/google/uuid"
 	"github.com/pion/rtcp"
 	"github.com/pion/rtp"
@@ -15,12 +20,34 @@ import (
 
 type (
 	whepSession struct {
+		peerConnection     *webrtc.PeerConnection
 		videoTrack         *trackMultiCodec
 		currentLayer       atomic.Value
 		waitingForKeyframe atomic.Bool
 		sequenceNumber     uint16
 		timestamp          uint32
 		packetsWritten     uint64
+		created            time.Time
+
+		// Loss the viewer reports for the video track
+		receiverReport *whepReceiverReport
+
+		// Additional video m-lines in the viewer's offer, fed in order from the
+		// publisher's additional video tracks (e.g. a screenshare next to a camera)
+		extraVideoTracks []*whepExtraVideoTrack
+	}
+
+	// whepReceiverReport is the latest RTCP Receiver Report of a WHEP session's video track
+	whepReceiverReport struct {
+		fractionLost  atomic.Uint32
+		packetsLost   atomic.Uint32
+		roundTripTime atomic.Int64
+	}
+
+	whepExtraVideoTrack struct {
+		videoTrack     *trackMultiCodec
+		sequenceNumber uint16
+		timestamp      uint32
 	}
 
 	simulcastLayerResponse struct {
@@ -29,17 +56,21 @@ type (
 )
 
 func WHEPLayers(whepSessionId string) ([]byte, error) {
-	streamMapLock.Lock()
-	defer streamMapLock.Unlock()
+	return defaultServer.WHEPLayers(whepSessionId)
+}
+
+func (s *Server) WHEPLayers(whepSessionId string) ([]byte, error) {
+	s.streamMapLock.Lock()
+	defer s.streamMapLock.Unlock()
 
 	layers := []simulcastLayerResponse{}
-	for streamKey := range streamMap {
-		streamMap[streamKey].whepSessionsLock.Lock()
-		defer streamMap[streamKey].whepSessionsLock.Unlock()
+	for streamKey := range s.streamMap {
+		s.streamMap[streamKey].whepSessionsLock.Lock()
+		defer s.streamMap[streamKey].whepSessionsLock.Unlock()
 
-		if _, ok := streamMap[streamKey].whepSessions[whepSessionId]; ok {
-			for i := range streamMap[streamKey].videoTracks {
-				layers = append(layers, simulcastLayerResponse{EncodingId: streamMap[streamKey].videoTracks[i].rid})
+		if _, ok := s.streamMap[streamKey].whepSessions[whepSessionId]; ok {
+			for i := range s.streamMap[streamKey].videoTracks {
+				layers = append(layers, simulcastLayerResponse{EncodingId: s.streamMap[streamKey].videoTracks[i].rid})
 			}
 
 			break
@@ -55,119 +86,302 @@ func WHEPLayers(whepSessionId string) ([]byte, error) {
 	return json.Marshal(resp)
 }
 
+func WHEPSessionExists(streamKey, whepSessionId string) bool {
+	return defaultServer.WHEPSessionExists(streamKey, whepSessionId)
+}
+
+// WHEPSessionExists returns if the WHEP session of streamKey is still connected
+func (s *Server) WHEPSessionExists(streamKey, whepSessionId string) bool {
+	s.streamMapLock.Lock()
+	defer s.streamMapLock.Unlock()
+
+	stream, ok := s.streamMap[streamKey]
+	if !ok {
+		return false
+	}
+
+	stream.whepSessionsLock.Lock()
+	defer stream.whepSessionsLock.Unlock()
+
+	_, ok = stream.whepSessions[whepSessionId]
+	return ok
+}
+
 func WHEPChangeLayer(whepSessionId, layer string) error {
-	streamMapLock.Lock()
-	defer streamMapLock.Unlock()
+	return defaultServer.WHEPChangeLayer(whepSessionId, layer)
+}
+
+func (s *Server) WHEPChangeLayer(whepSessionId, layer string) error {
+	s.streamMapLock.Lock()
+	defer s.streamMapLock.Unlock()
 
-	for streamKey := range streamMap {
-		streamMap[streamKey].whepSessionsLock.Lock()
-		defer streamMap[streamKey].whepSessionsLock.Unlock()
+	for streamKey := range s.streamMap {
+		s.streamMap[streamKey].whepSessionsLock.Lock()
+		defer s.streamMap[streamKey].whepSessionsLock.Unlock()
 
-		if _, ok := streamMap[streamKey].whepSessions[whepSessionId]; ok {
-			streamMap[streamKey].whepSessions[whepSessionId].currentLayer.Store(layer)
-			streamMap[streamKey].whepSessions[whepSessionId].waitingForKeyframe.Store(true)
-			streamMap[streamKey].pliChan <- true
+		if _, ok := s.streamMap[streamKey].whepSessions[whepSessionId]; ok {
+			layerExists := false
+			for _, videoTrack := range s.streamMap[streamKey].videoTracks {
+				layerExists = layerExists || videoTrack.rid == layer
+			}
+
+			// Stay on the current layer instead of switching to one the publisher isn't sending
+			if !layerExists {
+				return fmt.Errorf("layer `%s` is not being published", layer)
+			}
+
+			s.streamMap[streamKey].whepSessions[whepSessionId].currentLayer.Store(layer)
+			s.streamMap[streamKey].whepSessions[whepSessionId].waitingForKeyframe.Store(true)
+			s.streamMap[streamKey].pliChan <- true
+
+			e := newEvent(events.TypeLayerChange, streamKey, whepSessionId, s.streamMap[streamKey])
+			e.Layer = layer
+			s.events.Emit(e)
 		}
 	}
 
 	return nil
 }
 
+// WHEPRequestKeyframe holds video for a single WHEP session until the next keyframe
+// and asks the publisher for one. Other sessions on the stream keep playing.
+func WHEPRequestKeyframe(whepSessionId string) error {
+	return defaultServer.WHEPRequestKeyframe(whepSessionId)
+}
+
+func (s *Server) WHEPRequestKeyframe(whepSessionId string) error {
+	s.streamMapLock.Lock()
+	defer s.streamMapLock.Unlock()
+
+	for streamKey := range s.streamMap {
+		stream := s.streamMap[streamKey]
+
+		stream.whepSessionsLock.RLock()
+		session, ok := stream.whepSessions[whepSessionId]
+		stream.whepSessionsLock.RUnlock()
+
+		if !ok {
+			continue
+		}
+
+		session.waitingForKeyframe.Store(true)
+		select {
+		case stream.pliChan <- true:
+		default:
+		}
+
+		return nil
+	}
+
+	return ErrWHEPSessionNotFound
+}
+
 func WHEP(offer, streamKey string) (string, string, error) {
+	return defaultServer.WHEP(offer, streamKey)
+}
+
+func (s *Server) WHEP(offer, streamKey string) (string, string, error) {
+	return s.WHEPContext(context.Background(), offer, streamKey)
+}
+
+// WHEPContext is WHEP with the negotiation traced as part of the span in ctx
+func (s *Server) WHEPContext(ctx context.Context, offer, streamKey string) (string, string, error) {
 	maybePrintOfferAnswer(offer, true)
 
-	streamMapLock.Lock()
-	defer streamMapLock.Unlock()
-	stream, err := getStream(streamKey, false)
+	s.streamMapLock.Lock()
+	defer s.streamMapLock.Unlock()
+	stream, err := s.getStream(streamKey, false)
 	if err != nil {
 		return "", "", err
 	}
+	s.maybeRelayOnDemand(streamKey, stream)
+
+	// addTrack appends to videoTracks under streamMapLock, their labels don't change
+	publisherVideoTracks := slices.Clone(stream.videoTracks)
 
 	whepSessionId := uuid.New().String()
 
 	videoTrack := &trackMultiCodec{id: "video", streamID: "pion"}
 
-	peerConnection, err := newPeerConnection(apiWhep)
+	peerConnection, err := s.newPeerConnection(false, streamKey)
 	if err != nil {
 		return "", "", err
 	}
 
+	_, iceSpan := tracing.Start(ctx, "ICE establishment")
 	peerConnection.OnICEConnectionStateChange(func(i webrtc.ICEConnectionState) {
+		endICESpan(iceSpan, i)
+		if i == webrtc.ICEConnectionStateFailed {
+			s.whepICEFailures.Add(1)
+		}
 		if i == webrtc.ICEConnectionStateFailed || i == webrtc.ICEConnectionStateClosed {
 			if err := peerConnection.Close(); err != nil {
-				log.Println(err)
+				logger.Warn("Failed to close WHEP PeerConnection", "streamKey", streamKey, "whepSessionId", whepSessionId, "err", err)
 			}
 
-			peerConnectionDisconnected(streamKey, whepSessionId)
+			s.peerConnectionDisconnected(streamKey, whepSessionId)
 		}
 	})
 
+	_, negotiationSpan := tracing.Start(ctx, "SDP negotiation")
 	if _, err = peerConnection.AddTrack(stream.audioTrack); err != nil {
-		return "", "", err
+		return "", "", endSpans(err, negotiationSpan, iceSpan)
 	}
 
-	rtpSender, err := peerConnection.AddTrack(videoTrack)
-	if err != nil {
-		return "", "", err
-	}
-
-	go func() {
-		for {
-			rtcpPackets, _, rtcpErr := rtpSender.ReadRTCP()
-			if rtcpErr != nil {
-				return
-			}
-
-			for _, r := range rtcpPackets {
-				if _, isPLI := r.(*rtcp.PictureLossIndication); isPLI {
-					select {
-					case stream.pliChan <- true:
-					default:
-					}
-				}
-			}
+	receiverReport := &whepReceiverReport{}
+	if !stream.config.AudioOnly {
+		rtpSender, err := peerConnection.AddTrack(videoTrack)
+		if err != nil {
+			return "", "", endSpans(err, negotiationSpan, iceSpan)
 		}
-	}()
+
+		go readWHEPRTCP(rtpSender, stream, receiverReport)
+	}
 
 	if err := peerConnection.SetRemoteDescription(webrtc.SessionDescription{
 		SDP:  offer,
 		Type: webrtc.SDPTypeOffer,
 	}); err != nil {
-		return "", "", err
+		return "", "", endSpans(err, negotiationSpan, iceSpan)
+	}
+
+	extraVideoTracks := []*whepExtraVideoTrack{}
+	if stream.config.AudioOnly {
+		err = stopVideoTransceivers(peerConnection)
+	} else {
+		extraVideoTracks, err = addExtraVideoTracks(peerConnection, stream, publisherVideoTracks)
+	}
+	if err != nil {
+		return "", "", endSpans(err, negotiationSpan, iceSpan)
 	}
 
 	gatherComplete := webrtc.GatheringCompletePromise(peerConnection)
 	answer, err := peerConnection.CreateAnswer(nil)
 
 	if err != nil {
-		return "", "", err
+		return "", "", endSpans(err, negotiationSpan, iceSpan)
 	} else if err = peerConnection.SetLocalDescription(answer); err != nil {
-		return "", "", err
+		return "", "", endSpans(err, negotiationSpan, iceSpan)
 	}
+	negotiationSpan.End(nil)
 
+	_, gatheringSpan := tracing.Start(ctx, "ICE gathering")
 	<-gatherComplete
+	gatheringSpan.End(nil)
 
 	stream.whepSessionsLock.Lock()
 	defer stream.whepSessionsLock.Unlock()
 
 	stream.whepSessions[whepSessionId] = &whepSession{
-		videoTrack: videoTrack,
-		timestamp:  50000,
+		peerConnection:   peerConnection,
+		videoTrack:       videoTrack,
+		timestamp:        50000,
+		extraVideoTracks: extraVideoTracks,
+		created:          time.Now(),
+		receiverReport:   receiverReport,
 	}
 	stream.whepSessions[whepSessionId].currentLayer.Store("")
 	stream.whepSessions[whepSessionId].waitingForKeyframe.Store(false)
+	s.emitEvent(events.TypeViewerJoin, streamKey, whepSessionId, stream)
+	s.updateViewerHistory(streamKey, len(stream.whepSessions))
+	if len(stream.whepSessions) == 1 {
+		s.emitEvent(events.TypeFirstViewer, streamKey, "", stream)
+	}
+
+	return maybePrintOfferAnswer(s.appendAnswer(peerConnection.LocalDescription().SDP), false), whepSessionId, nil
+}
+
+// addExtraVideoTracks sends a track on every video m-line of the offer after the first. Tracks
+// carry the msid of the matching one of publisherVideoTracks when the publisher is already connected.
+func addExtraVideoTracks(peerConnection *webrtc.PeerConnection, stream *stream, publisherVideoTracks []*videoTrack) ([]*whepExtraVideoTrack, error) {
+	extraVideoTrackCount := 0
+	for _, transceiver := range peerConnection.GetTransceivers() {
+		if transceiver.Kind() == webrtc.RTPCodecTypeVideo && transceiver.Sender() == nil {
+			extraVideoTrackCount++
+		}
+	}
+
+	extraVideoTracks := []*whepExtraVideoTrack{}
+	for trackIndex := 1; trackIndex <= extraVideoTrackCount; trackIndex++ {
+		videoTrack := &trackMultiCodec{id: fmt.Sprintf("video%d", trackIndex), streamID: "pion"}
+		if trackIndex < len(publisherVideoTracks) && publisherVideoTracks[trackIndex].trackLabel != "" {
+			videoTrack.id = publisherVideoTracks[trackIndex].trackLabel
+			videoTrack.streamID = publisherVideoTracks[trackIndex].streamLabel
+		}
+
+		rtpSender, err := peerConnection.AddTrack(videoTrack)
+		if err != nil {
+			return nil, err
+		}
+		go readWHEPRTCP(rtpSender, stream, nil)
+
+		extraVideoTracks = append(extraVideoTracks, &whepExtraVideoTrack{videoTrack: videoTrack, timestamp: 50000})
+	}
+
+	return extraVideoTracks, nil
+}
+
+// readWHEPRTCP forwards PLIs from a WHEP session to the publisher, and keeps the loss of its
+// Receiver Reports in receiverReport if it isn't nil
+func readWHEPRTCP(rtpSender *webrtc.RTPSender, stream *stream, receiverReport *whepReceiverReport) {
+	for {
+		rtcpPackets, _, rtcpErr := rtpSender.ReadRTCP()
+		if rtcpErr != nil {
+			return
+		}
 
-	return maybePrintOfferAnswer(appendAnswer(peerConnection.LocalDescription().SDP), false), whepSessionId, nil
+		for _, r := range rtcpPackets {
+			switch r := r.(type) {
+			case *rtcp.PictureLossIndication:
+				select {
+				case stream.pliChan <- true:
+				default:
+				}
+			case *rtcp.ReceiverReport:
+				if receiverReport != nil && len(r.Reports) != 0 {
+					receiverReport.update(r.Reports[0])
+				}
+			}
+		}
+	}
 }
 
-func (w *whepSession) sendVideoPacket(rtpPkt *rtp.Packet, layer string, timeDiff int64, sequenceDiff int, codec videoTrackCodec, isKeyframe bool) {
+func (r *whepReceiverReport) update(report rtcp.ReceptionReport) {
+	r.fractionLost.Store(uint32(report.FractionLost))
+	r.packetsLost.Store(report.TotalLost)
+
+	// The round trip is the time since the Sender Report in LastSenderReport minus the
+	// Delay the viewer held it for, both in the middle 32 bits of NTP time
+	if report.LastSenderReport != 0 {
+		now := time.Now()
+		ntpNow := uint64(now.Unix()+2208988800)<<32 | uint64(now.Nanosecond())<<32/1e9
+		if rtt := uint32(ntpNow>>16) - report.LastSenderReport - report.Delay; rtt < 1<<31 {
+			r.roundTripTime.Store(int64(rtt) * int64(time.Second) >> 16)
+		}
+	}
+}
+
+// sendVideoPacket returns the bytes sent for rtpPkt, which are 0 when it isn't the layer of the
+// session
+func (w *whepSession) sendVideoPacket(rtpPkt *rtp.Packet, videoOrientation []byte, layer string, trackIndex int, timeDiff int64, sequenceDiff int, codec videoTrackCodec, isKeyframe bool) int {
+	bytesSent := 0
+	if trackIndex != 0 {
+		if trackIndex <= len(w.extraVideoTracks) {
+			bytesSent += w.extraVideoTracks[trackIndex-1].sendVideoPacket(rtpPkt, videoOrientation, timeDiff, sequenceDiff, codec)
+		}
+
+		if w.currentLayer.Load() != layer {
+			return bytesSent
+		}
+	}
+
 	if w.currentLayer.Load() == "" {
 		w.currentLayer.Store(layer)
 	} else if layer != w.currentLayer.Load() {
-		return
+		return bytesSent
 	} else if w.waitingForKeyframe.Load() {
 		if !isKeyframe {
-			return
+			return bytesSent
 		}
 
 		w.waitingForKeyframe.Store(false)
@@ -180,7 +394,23 @@ func (w *whepSession) sendVideoPacket(rtpPkt *rtp.Packet, layer string, timeDiff
 	rtpPkt.SequenceNumber = w.sequenceNumber
 	rtpPkt.Timestamp = w.timestamp
 
-	if err := w.videoTrack.WriteRTP(rtpPkt, codec); err != nil && !errors.Is(err, io.ErrClosedPipe) {
-		log.Println(err)
+	if err := w.videoTrack.WriteRTP(rtpPkt, videoOrientation, codec); err != nil && !errors.Is(err, io.ErrClosedPipe) {
+		logger.Warn("Failed to write video packet", "err", err)
 	}
+
+	return bytesSent + rtpPkt.MarshalSize()
+}
+
+func (w *whepExtraVideoTrack) sendVideoPacket(rtpPkt *rtp.Packet, videoOrientation []byte, timeDiff int64, sequenceDiff int, codec videoTrackCodec) int {
+	w.sequenceNumber = uint16(int(w.sequenceNumber) + sequenceDiff)
+	w.timestamp = uint32(int64(w.timestamp) + timeDiff)
+
+	rtpPkt.SequenceNumber = w.sequenceNumber
+	rtpPkt.Timestamp = w.timestamp
+
+	if err := w.videoTrack.WriteRTP(rtpPkt, videoOrientation, codec); err != nil && !errors.Is(err, io.ErrClosedPipe) {
+		logger.Warn("Failed to write video packet", "err", err)
+	}
+
+	return rtpPkt.MarshalSize()
 }
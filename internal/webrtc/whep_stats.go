@@ -0,0 +1,74 @@
+package webrtc
+
+import (
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// WHEPSessionStats is what a WHEP session is sending and how it is received, for debugging a
+// single viewer
+type WHEPSessionStats struct {
+	ID                 string    `json:"id"`
+	CurrentLayer       string    `json:"currentLayer"`
+	ConnectedAt        time.Time `json:"connectedAt"`
+	ConnectionState    string    `json:"connectionState"`
+	ICEConnectionState string    `json:"iceConnectionState"`
+
+	// From the latest Receiver Report of the video track. The round trip time is in seconds,
+	// FractionLost is of the packets since the report before and PacketsLost of all
+	RoundTripTime float64 `json:"roundTripTime"`
+	FractionLost  float64 `json:"fractionLost"`
+	PacketsLost   uint32  `json:"packetsLost"`
+
+	BytesSent        uint64 `json:"bytesSent"`
+	VideoPacketsSent uint64 `json:"videoPacketsSent"`
+}
+
+func GetWHEPSessionStats(streamKey string) ([]WHEPSessionStats, error) {
+	return defaultServer.GetWHEPSessionStats(streamKey)
+}
+
+// GetWHEPSessionStats returns the stats of every WHEP session of streamKey
+func (s *Server) GetWHEPSessionStats(streamKey string) ([]WHEPSessionStats, error) {
+	s.streamMapLock.Lock()
+	stream, ok := s.streamMap[streamKey]
+	if !ok {
+		s.streamMapLock.Unlock()
+		return nil, ErrStreamNotFound
+	}
+
+	out := []WHEPSessionStats{}
+	peerConnections := []*webrtc.PeerConnection{}
+	stream.whepSessionsLock.Lock()
+	for id, whepSession := range stream.whepSessions {
+		currentLayer, _ := whepSession.currentLayer.Load().(string)
+		stats := WHEPSessionStats{
+			ID:                 id,
+			CurrentLayer:       currentLayer,
+			ConnectedAt:        whepSession.created,
+			ConnectionState:    whepSession.peerConnection.ConnectionState().String(),
+			ICEConnectionState: whepSession.peerConnection.ICEConnectionState().String(),
+			VideoPacketsSent:   whepSession.packetsWritten,
+		}
+		if whepSession.receiverReport != nil {
+			stats.FractionLost = float64(whepSession.receiverReport.fractionLost.Load()) / 256
+			stats.PacketsLost = whepSession.receiverReport.packetsLost.Load()
+			stats.RoundTripTime = time.Duration(whepSession.receiverReport.roundTripTime.Load()).Seconds()
+		}
+
+		out = append(out, stats)
+		peerConnections = append(peerConnections, whepSession.peerConnection)
+	}
+	stream.whepSessionsLock.Unlock()
+	s.streamMapLock.Unlock()
+
+	// GetStats waits on the PeerConnection, so it isn't called with the locks held
+	for i, peerConnection := range peerConnections {
+		if transport, ok := peerConnection.GetStats()["iceTransport"].(webrtc.TransportStats); ok {
+			out[i].BytesSent = transport.BytesSent
+		}
+	}
+
+	return out, nil
+}
@@ -0,0 +1,109 @@
+package webrtc
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/pion/webrtc/v4"
+)
+
+func TestWHEPExtraVideoTracksCarryPublisherLabels(t *testing.T) {
+	s := newTestServer(t, Options{})
+	publishVideo(t, s, "two-tracks", [2]string{"desk", "camera"}, [2]string{"desk", "screen"})
+
+	answer := negotiate(t, newTestViewer(t, 2), func(offer string) (string, error) {
+		answer, _, err := s.WHEPContext(context.Background(), offer, "two-tracks")
+		return answer, err
+	})
+
+	s.streamMapLock.Lock()
+	second := s.streamMap["two-tracks"].videoTracks[1]
+	s.streamMapLock.Unlock()
+
+	if second.streamLabel != "desk" || (second.trackLabel != "camera" && second.trackLabel != "screen") {
+		t.Fatalf("second video track has msid %s %s", second.streamLabel, second.trackLabel)
+	}
+	if msid := "a=msid:desk " + second.trackLabel; !strings.Contains(answer, msid) {
+		t.Fatalf("answer doesn't contain %q:\n%s", msid, answer)
+	}
+}
+
+// mediaKinds returns the kinds of the m-lines of sdp in order
+func mediaKinds(sdp string) []string {
+	kinds := []string{}
+	for _, line := range strings.Split(sdp, "\r\n") {
+		if kind, ok := strings.CutPrefix(line, "m="); ok {
+			kinds = append(kinds, strings.Fields(kind)[0])
+		}
+	}
+
+	return kinds
+}
+
+func TestWHEPAnswerKeepsMLineOrder(t *testing.T) {
+	s := newTestServer(t, Options{})
+
+	for _, order := range [][]webrtc.RTPCodecType{
+		{webrtc.RTPCodecTypeAudio, webrtc.RTPCodecTypeVideo},
+		{webrtc.RTPCodecTypeVideo, webrtc.RTPCodecTypeAudio},
+		{webrtc.RTPCodecTypeVideo, webrtc.RTPCodecTypeAudio, webrtc.RTPCodecTypeVideo},
+	} {
+		viewer := newTestPeerConnection(t)
+		for _, kind := range order {
+			if _, err := viewer.AddTransceiverFromKind(kind, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		var offer string
+		answer := negotiate(t, viewer, func(o string) (string, error) {
+			offer = o
+			answer, _, err := s.WHEPContext(context.Background(), o, "m-line-order")
+			return answer, err
+		})
+
+		if offerKinds, answerKinds := mediaKinds(offer), mediaKinds(answer); !slices.Equal(offerKinds, answerKinds) {
+			t.Errorf("answer has the m-lines %v for an offer with %v", answerKinds, offerKinds)
+		}
+	}
+}
+
+func TestWHEPChangeLayer(t *testing.T) {
+	s := newTestServer(t, Options{})
+	publishVideo(t, s, "layers", [2]string{"desk", "camera"}, [2]string{"desk", "screen"})
+
+	var whepSessionId string
+	negotiate(t, newTestViewer(t, 1), func(offer string) (answer string, err error) {
+		answer, whepSessionId, err = s.WHEPContext(context.Background(), offer, "layers")
+		return answer, err
+	})
+
+	currentLayer := func() string {
+		s.streamMapLock.Lock()
+		defer s.streamMapLock.Unlock()
+
+		layer, _ := s.streamMap["layers"].whepSessions[whepSessionId].currentLayer.Load().(string)
+		return layer
+	}
+
+	// The second track of a publisher without simulcast is identified by its label
+	s.streamMapLock.Lock()
+	labelLayer := s.streamMap["layers"].videoTracks[1].rid
+	s.streamMapLock.Unlock()
+
+	for _, layer := range []string{videoTrackLabelDefault, labelLayer} {
+		if err := s.WHEPChangeLayer(whepSessionId, layer); err != nil {
+			t.Fatalf("switching to `%s` failed: %s", layer, err)
+		} else if current := currentLayer(); current != layer {
+			t.Fatalf("switched to `%s` instead of `%s`", current, layer)
+		}
+	}
+
+	if err := s.WHEPChangeLayer(whepSessionId, "h"); err == nil {
+		t.Fatal("switched to a layer that isn't published")
+	} else if current := currentLayer(); current != labelLayer {
+		t.Fatalf("viewer moved to `%s` instead of staying on `%s`", current, labelLayer)
+	}
+}
@@ -1,57 +1,134 @@
 package webrtc
 
 import (
+	"context"
 	"errors"
 	"io"
-	"log"
 	"math"
 	"strings"
+	"sync/atomic"
 	"time"
 
+	"github.com/glimesh/broadcast-box/internal/events"
+	"github.com/glimesh/broadcast-box/internal/tracing"
 	"github.com/pion/rtcp"
 	"github.com/pion/rtp"
 	"github.com/pion/rtp/codecs"
 	"github.com/pion/webrtc/v4"
 )
 
-func audioWriter(remoteTrack *webrtc.TrackRemote, stream *stream) {
+// Warns once per track about packets that will likely be fragmented on the way to viewers
+func warnOversizedPacket(remoteTrack *webrtc.TrackRemote, size, rtpMTU int, warned *bool) {
+	if size <= rtpMTU || *warned {
+		return
+	}
+
+	*warned = true
+	logger.Warn("Received RTP packet larger than RTP_MTU, it may be lost on the way to viewers", "size", size, "kind", remoteTrack.Kind().String(), "ssrc", remoteTrack.SSRC(), "rtpMTU", rtpMTU)
+}
+
+// allowPLI reports if a PLI can be sent to the publisher of stream, dropping ones
+// that arrive within pliThrottleWindow of the last so viewers can't cause a keyframe storm
+func (s *Server) allowPLI(stream *stream) bool {
+	if s.pliThrottleWindow <= 0 {
+		return true
+	}
+
+	now := time.Now().UnixNano()
+	last := stream.lastPLISent.Load()
+
+	return now-last >= int64(s.pliThrottleWindow) && stream.lastPLISent.CompareAndSwap(last, now)
+}
+
+func (s *Server) audioWriter(remoteTrack *webrtc.TrackRemote, stream *stream, codec audioTrackCodec) {
+	stream.audioCodec.Store(&codec)
+
 	rtpBuf := make([]byte, 1500)
+	rtpPkt := &rtp.Packet{}
+	oversizedPacketWarned := false
 	for {
 		rtpRead, _, err := remoteTrack.Read(rtpBuf)
 		switch {
 		case errors.Is(err, io.EOF):
 			return
 		case err != nil:
-			log.Println(err)
+			logger.Warn("Failed to read audio track", "err", err)
 			return
 		}
 
+		warnOversizedPacket(remoteTrack, rtpRead, s.rtpMTU, &oversizedPacketWarned)
+
 		stream.audioPacketsReceived.Add(1)
-		if _, writeErr := stream.audioTrack.Write(rtpBuf[:rtpRead]); writeErr != nil && !errors.Is(writeErr, io.ErrClosedPipe) {
-			log.Println(writeErr)
+		stream.audioBytesReceived.Add(uint64(rtpRead))
+		stream.usageBytesIn.Add(uint64(rtpRead))
+		stream.audioBitrate.add(rtpRead)
+
+		// Only stereo Opus is packaged and served over RTSP, surround is just sent to WHEP sessions
+		if codec == audioTrackCodecOpus {
+			if tap := stream.tap.Load(); tap != nil && rtpPkt.Unmarshal(rtpBuf[:rtpRead]) == nil {
+				tap.writeAudio(rtpPkt)
+			}
+			stream.writeRTSPAudio(rtpBuf[:rtpRead])
+		}
+
+		if writeErr := stream.audioTrack.Write(rtpBuf[:rtpRead], codec); writeErr != nil && !errors.Is(writeErr, io.ErrClosedPipe) {
+			logger.Warn("Failed to write audio packet", "err", writeErr)
 			return
 		}
 	}
 }
 
-func videoWriter(remoteTrack *webrtc.TrackRemote, stream *stream, peerConnection *webrtc.PeerConnection, s *stream) {
+func (s *Server) videoWriter(remoteTrack *webrtc.TrackRemote, rtpReceiver *webrtc.RTPReceiver, stream *stream, peerConnection *webrtc.PeerConnection) {
 	id := remoteTrack.RID()
 	if id == "" {
 		id = videoTrackLabelDefault
 	}
 
-	videoTrack, err := addTrack(s, id)
+	codec := getVideoTrackCodec(remoteTrack.Codec().RTPCodecCapability.MimeType)
+	videoTrack, trackIndex, err := s.addTrack(stream, id, remoteTrack.StreamID(), remoteTrack.ID(), codec)
 	if err != nil {
-		log.Println(err)
+		logger.Warn("Failed to add video track", "err", err)
 		return
 	}
 
+	// Simulcast layers are all sent on the first video track of a WHEP session
+	if remoteTrack.RID() != "" {
+		trackIndex = 0
+	}
+
+	if maxBitrate := stream.config.MaxBitrate; maxBitrate != 0 {
+		go func() {
+			ticker := time.NewTicker(time.Second)
+			defer ticker.Stop()
+
+			for {
+				select {
+				case <-stream.whipActiveContext.Done():
+					return
+				case <-ticker.C:
+					if sendErr := peerConnection.WriteRTCP([]rtcp.Packet{
+						&rtcp.ReceiverEstimatedMaximumBitrate{
+							Bitrate: float32(maxBitrate),
+							SSRCs:   []uint32{uint32(remoteTrack.SSRC())},
+						},
+					}); sendErr != nil {
+						return
+					}
+				}
+			}
+		}()
+	}
+
 	go func() {
 		for {
 			select {
 			case <-stream.whipActiveContext.Done():
 				return
 			case <-stream.pliChan:
+				if !s.allowPLI(stream) {
+					continue
+				}
+
 				if sendErr := peerConnection.WriteRTCP([]rtcp.Packet{
 					&rtcp.PictureLossIndication{
 						MediaSSRC: uint32(remoteTrack.SSRC()),
@@ -59,29 +136,23 @@ func videoWriter(remoteTrack *webrtc.TrackRemote, stream *stream, peerConnection
 				}); sendErr != nil {
 					return
 				}
+				stream.plisSent.Add(1)
 			}
 		}
 	}()
 
 	rtpBuf := make([]byte, 1500)
 	rtpPkt := &rtp.Packet{}
-	codec := getVideoTrackCodec(remoteTrack.Codec().RTPCodecCapability.MimeType)
+	forwarder := newVideoForwarder(stream, videoTrack, trackIndex, codec)
 
-	var depacketizer rtp.Depacketizer
-	switch codec {
-	case videoTrackCodecH264:
-		depacketizer = &codecs.H264Packet{}
-	case videoTrackCodecVP8:
-		depacketizer = &codecs.VP8Packet{}
-	case videoTrackCodecVP9:
-		depacketizer = &codecs.VP9Packet{}
+	videoOrientationExtensionID := uint8(0)
+	for _, headerExtension := range rtpReceiver.GetParameters().HeaderExtensions {
+		if headerExtension.URI == videoOrientationURI {
+			videoOrientationExtensionID = uint8(headerExtension.ID)
+		}
 	}
 
-	lastTimestamp := uint32(0)
-	lastTimestampSet := false
-
-	lastSequenceNumber := uint16(0)
-	lastSequenceNumberSet := false
+	oversizedPacketWarned := false
 
 	for {
 		rtpRead, _, err := remoteTrack.Read(rtpBuf)
@@ -89,105 +160,315 @@ func videoWriter(remoteTrack *webrtc.TrackRemote, stream *stream, peerConnection
 		case errors.Is(err, io.EOF):
 			return
 		case err != nil:
-			log.Println(err)
+			logger.Warn("Failed to read video track", "err", err)
 			return
 		}
 
+		warnOversizedPacket(remoteTrack, rtpRead, s.rtpMTU, &oversizedPacketWarned)
+
 		if err = rtpPkt.Unmarshal(rtpBuf[:rtpRead]); err != nil {
-			log.Println(err)
+			logger.Warn("Failed to unmarshal RTP packet", "err", err)
 			return
 		}
 
-		videoTrack.packetsReceived.Add(1)
-
-		// Keyframe detection has only been implemented for H264
-		isKeyframe := isKeyframe(rtpPkt, codec, depacketizer)
-		if isKeyframe && codec == videoTrackCodecH264 {
-			videoTrack.lastKeyFrameSeen.Store(time.Now())
+		var videoOrientation []byte
+		if videoOrientationExtensionID != 0 {
+			videoOrientation = rtpPkt.GetExtension(videoOrientationExtensionID)
 		}
 
 		rtpPkt.Extension = false
 		rtpPkt.Extensions = nil
 
-		timeDiff := int64(rtpPkt.Timestamp) - int64(lastTimestamp)
-		switch {
-		case !lastTimestampSet:
-			timeDiff = 0
-			lastTimestampSet = true
-		case timeDiff < -(math.MaxUint32 / 10):
-			timeDiff += (math.MaxUint32 + 1)
-		}
+		forwarder.forward(rtpPkt, videoOrientation)
+	}
+}
 
-		sequenceDiff := int(rtpPkt.SequenceNumber) - int(lastSequenceNumber)
-		switch {
-		case !lastSequenceNumberSet:
-			lastSequenceNumberSet = true
-			sequenceDiff = 0
-		case sequenceDiff < -(math.MaxUint16 / 10):
-			sequenceDiff += (math.MaxUint16 + 1)
+// videoForwarder sends the packets of one publisher video track to every WHEP session
+type videoForwarder struct {
+	stream       *stream
+	videoTrack   *videoTrack
+	trackIndex   int
+	codec        videoTrackCodec
+	depacketizer rtp.Depacketizer
+
+	lastTimestamp    uint32
+	lastTimestampSet bool
+
+	lastSequenceNumber    uint16
+	lastSequenceNumberSet bool
+}
+
+func newVideoForwarder(stream *stream, videoTrack *videoTrack, trackIndex int, codec videoTrackCodec) *videoForwarder {
+	f := &videoForwarder{stream: stream, videoTrack: videoTrack, trackIndex: trackIndex, codec: codec}
+
+	switch codec {
+	case videoTrackCodecH264:
+		f.depacketizer = &codecs.H264Packet{}
+	case videoTrackCodecVP8:
+		f.depacketizer = &codecs.VP8Packet{}
+	case videoTrackCodecVP9:
+		f.depacketizer = &codecs.VP9Packet{}
+	}
+
+	return f
+}
+
+func (f *videoForwarder) forward(rtpPkt *rtp.Packet, videoOrientation []byte) {
+	f.videoTrack.packetsReceived.Add(1)
+	f.videoTrack.bytesReceived.Add(uint64(rtpPkt.MarshalSize()))
+	f.stream.usageBytesIn.Add(uint64(rtpPkt.MarshalSize()))
+	f.videoTrack.bitrate.add(rtpPkt.MarshalSize())
+
+	// Keyframe detection has only been implemented for H264 and H265
+	isKeyframe := isKeyframe(rtpPkt, f.codec, f.depacketizer)
+	if isKeyframe && (f.codec == videoTrackCodecH264 || f.codec == videoTrackCodecH265) {
+		f.videoTrack.lastKeyFrameSeen.Store(time.Now())
+	}
+
+	timeDiff := int64(rtpPkt.Timestamp) - int64(f.lastTimestamp)
+	switch {
+	case !f.lastTimestampSet:
+		timeDiff = 0
+		f.lastTimestampSet = true
+	case timeDiff < -(math.MaxUint32 / 10):
+		timeDiff += (math.MaxUint32 + 1)
+	}
+
+	sequenceDiff := int(rtpPkt.SequenceNumber) - int(f.lastSequenceNumber)
+	switch {
+	case !f.lastSequenceNumberSet:
+		f.lastSequenceNumberSet = true
+		sequenceDiff = 0
+	case sequenceDiff < -(math.MaxUint16 / 10):
+		sequenceDiff += (math.MaxUint16 + 1)
+	}
+
+	f.lastTimestamp = rtpPkt.Timestamp
+	f.lastSequenceNumber = rtpPkt.SequenceNumber
+
+	// Forwarded before WHEP sessions rewrite the sequence number and timestamp
+	if tap := f.stream.tap.Load(); tap != nil && tap.rtpForward != nil {
+		tap.rtpForward.writeVideo(rtpPkt, f.videoTrack.rid, f.codec)
+	}
+	f.stream.writeRTSPVideo(rtpPkt, f.videoTrack.rid, isKeyframe)
+
+	if f.stream.paused.Load() {
+		return
+	}
+
+	f.stream.whepSessionsLock.RLock()
+	bytesSent := 0
+	for i := range f.stream.whepSessions {
+		bytesSent += f.stream.whepSessions[i].sendVideoPacket(rtpPkt, videoOrientation, f.videoTrack.rid, f.trackIndex, timeDiff, sequenceDiff, f.codec, isKeyframe)
+	}
+	f.stream.usageVideoBytesOut.Add(uint64(bytesSent))
+	f.stream.whepSessionsLock.RUnlock()
+
+	if tap := f.stream.tap.Load(); tap != nil {
+		tap.writeVideo(rtpPkt, f.videoTrack.rid, f.codec)
+	}
+}
+
+const (
+	// PublisherConflictFirstWins refuses another publisher of a stream that is published, unless
+	// it is the same publisher reconnecting
+	PublisherConflictFirstWins = "first-wins"
+
+	// PublisherConflictLastWins disconnects the current publisher for the new one
+	PublisherConflictLastWins = "last-wins"
+)
+
+// publisherIdentity is who a publisher is, by the credential it authenticated with or the DTLS
+// certificate of its offer
+type publisherIdentity struct {
+	credential  string
+	fingerprint string
+}
+
+func (p publisherIdentity) matches(other publisherIdentity) bool {
+	return (p.credential != "" && p.credential == other.credential) || (p.fingerprint != "" && p.fingerprint == other.fingerprint)
+}
+
+// offerFingerprint returns the first DTLS certificate fingerprint of offer
+func offerFingerprint(offer string) string {
+	for _, line := range strings.Split(offer, "\n") {
+		if fingerprint, ok := strings.CutPrefix(strings.TrimSpace(line), "a=fingerprint:"); ok {
+			return strings.ToLower(fingerprint)
 		}
+	}
+
+	return ""
+}
+
+// claimPublisher makes room for a publisher with identity on streamKey by disconnecting the
+// current publisher, unless PublisherConflictFirstWins keeps it. The caller must hold
+// streamMapLock.
+func (s *Server) claimPublisher(streamKey string, identity publisherIdentity) error {
+	stream, ok := s.streamMap[streamKey]
+	if !ok || !stream.hasWHIPClient.Load() || stream.fallbackIngest != nil {
+		return nil
+	}
 
-		lastTimestamp = rtpPkt.Timestamp
-		lastSequenceNumber = rtpPkt.SequenceNumber
+	if s.publisherConflict == PublisherConflictFirstWins && !stream.publisherIdentity.matches(identity) {
+		logger.Info("Refusing another publisher", "streamKey", streamKey)
+		return ErrStreamPublished
+	}
 
-		s.whepSessionsLock.RLock()
-		for i := range s.whepSessions {
-			s.whepSessions[i].sendVideoPacket(rtpPkt, id, timeDiff, sequenceDiff, codec, isKeyframe)
+	logger.Info("Replacing publisher", "streamKey", streamKey)
+	if stream.replacePublisher != nil {
+		stream.replacePublisher()
+	}
+	s.detachPublisher(streamKey, stream)
+	return nil
+}
+
+// attachPublisher makes peerConnection the publisher of streamKey, forwarding the tracks it
+// receives to WHEP sessions. replaced is set once another publisher took over, then the
+// stream isn't the peerConnection's to disconnect anymore. The caller must hold streamMapLock.
+func (s *Server) attachPublisher(streamKey string, identity publisherIdentity, peerConnection *webrtc.PeerConnection) (stream *stream, replaced *atomic.Bool, err error) {
+	if err = s.claimPublisher(streamKey, identity); err != nil {
+		return nil, nil, err
+	}
+
+	if stream, err = s.getStream(streamKey, true); err != nil {
+		return nil, nil, err
+	}
+
+	replaced = &atomic.Bool{}
+	stream.publisherIdentity = identity
+	stream.closePublisher = func() {
+		if err := peerConnection.Close(); err != nil {
+			logger.Warn("Failed to close replaced WHIP PeerConnection", "streamKey", streamKey, "err", err)
 		}
-		s.whepSessionsLock.RUnlock()
+	}
+	stream.replacePublisher = func() {
+		replaced.Store(true)
+		stream.closePublisher()
+	}
+
+	if stream.firstPublishTime.IsZero() {
+		stream.firstPublishTime = time.Now()
 
+		if maxDuration := stream.config.maxDuration(); maxDuration > 0 {
+			go s.enforceMaxDuration(streamKey, stream, maxDuration)
+		}
 	}
+	s.startMediaTap(streamKey, stream)
+	s.startRelayOuts(streamKey, stream)
+
+	peerConnection.OnTrack(func(remoteTrack *webrtc.TrackRemote, rtpReceiver *webrtc.RTPReceiver) {
+		codec := remoteTrack.Codec()
+
+		switch {
+		case strings.HasPrefix(codec.MimeType, "audio"):
+			audioCodec, ok := getAudioTrackCodec(codec)
+			if !ok {
+				logger.Info("Ignoring audio track with unsupported codec", "streamKey", streamKey, "mimeType", codec.MimeType, "payloadType", codec.PayloadType)
+				return
+			}
+
+			s.audioWriter(remoteTrack, stream, audioCodec)
+		case stream.config.AudioOnly:
+			logger.Info("Ignoring video track of audio only stream", "streamKey", streamKey)
+		case getVideoTrackCodec(codec.MimeType) == 0:
+			logger.Info("Ignoring video track with unsupported codec", "streamKey", streamKey, "mimeType", codec.MimeType, "payloadType", codec.PayloadType)
+		default:
+			s.videoWriter(remoteTrack, rtpReceiver, stream, peerConnection)
+		}
+	})
+
+	return stream, replaced, nil
 }
 
 func WHIP(offer, streamKey string) (string, error) {
+	return defaultServer.WHIP(offer, streamKey)
+}
+
+func (s *Server) WHIP(offer, streamKey string) (string, error) {
+	return s.WHIPWithCredential(context.Background(), offer, streamKey, "")
+}
+
+// WHIPWithCredential is WHIP for a publisher that authenticated with credential, like its
+// Bearer token. A publisher with the same credential or DTLS certificate is the same publisher
+// reconnecting, which PUBLISHER_CONFLICT=first-wins lets take over the stream. The negotiation
+// is traced as part of the span in ctx.
+func (s *Server) WHIPWithCredential(ctx context.Context, offer, streamKey, credential string) (string, error) {
 	maybePrintOfferAnswer(offer, true)
 
-	peerConnection, err := newPeerConnection(apiWhip)
+	peerConnection, err := s.newPeerConnection(true, streamKey)
 	if err != nil {
 		return "", err
 	}
 
-	streamMapLock.Lock()
-	defer streamMapLock.Unlock()
-	stream, err := getStream(streamKey, true)
-	if err != nil {
-		return "", err
+	// The offer is applied before the stream is claimed, so one that can't be doesn't disconnect
+	// the current publisher
+	_, negotiationSpan := tracing.Start(ctx, "SDP negotiation")
+	if err := peerConnection.SetRemoteDescription(webrtc.SessionDescription{
+		SDP:  string(offer),
+		Type: webrtc.SDPTypeOffer,
+	}); err != nil {
+		return "", closeWithError(peerConnection, endSpans(err, negotiationSpan))
 	}
 
-	peerConnection.OnTrack(func(remoteTrack *webrtc.TrackRemote, rtpReceiver *webrtc.RTPReceiver) {
-		if strings.HasPrefix(remoteTrack.Codec().RTPCodecCapability.MimeType, "audio") {
-			audioWriter(remoteTrack, stream)
-		} else {
-			videoWriter(remoteTrack, stream, peerConnection, stream)
+	// Once the stream is claimed a failed negotiation has to give it up again, after
+	// streamMapLock is released
+	var replaced *atomic.Bool
+	negotiated := false
+	defer func() {
+		if negotiated {
+			return
+		}
 
+		if replaced != nil && replaced.CompareAndSwap(false, true) {
+			s.peerConnectionDisconnected(streamKey, "")
 		}
-	})
+		closeWithError(peerConnection, nil) //nolint
+	}()
+
+	s.streamMapLock.Lock()
+	defer s.streamMapLock.Unlock()
+	identity := publisherIdentity{credential: credential, fingerprint: offerFingerprint(offer)}
+	stream, replaced, err := s.attachPublisher(streamKey, identity, peerConnection)
+	if err != nil {
+		return "", endSpans(err, negotiationSpan)
+	}
 
+	_, iceSpan := tracing.Start(ctx, "ICE establishment")
 	peerConnection.OnICEConnectionStateChange(func(i webrtc.ICEConnectionState) {
+		endICESpan(iceSpan, i)
+		if i == webrtc.ICEConnectionStateFailed {
+			s.whipICEFailures.Add(1)
+		}
 		if i == webrtc.ICEConnectionStateFailed || i == webrtc.ICEConnectionStateClosed {
 			if err := peerConnection.Close(); err != nil {
-				log.Println(err)
+				logger.Warn("Failed to close WHIP PeerConnection", "streamKey", streamKey, "err", err)
+			}
+			if !replaced.Load() {
+				s.peerConnectionDisconnected(streamKey, "")
 			}
-			peerConnectionDisconnected(streamKey, "")
 		}
 	})
 
-	if err := peerConnection.SetRemoteDescription(webrtc.SessionDescription{
-		SDP:  string(offer),
-		Type: webrtc.SDPTypeOffer,
-	}); err != nil {
-		return "", err
+	if stream.config.AudioOnly {
+		if err := stopVideoTransceivers(peerConnection); err != nil {
+			return "", endSpans(err, negotiationSpan, iceSpan)
+		}
 	}
 
 	gatherComplete := webrtc.GatheringCompletePromise(peerConnection)
 	answer, err := peerConnection.CreateAnswer(nil)
 
 	if err != nil {
-		return "", err
+		return "", endSpans(err, negotiationSpan, iceSpan)
 	} else if err = peerConnection.SetLocalDescription(answer); err != nil {
-		return "", err
+		return "", endSpans(err, negotiationSpan, iceSpan)
 	}
+	negotiationSpan.End(nil)
 
+	_, gatheringSpan := tracing.Start(ctx, "ICE gathering")
 	<-gatherComplete
-	return maybePrintOfferAnswer(appendAnswer(peerConnection.LocalDescription().SDP), false), nil
+	gatheringSpan.End(nil)
+	negotiated = true
+	s.emitEvent(events.TypePublishStart, streamKey, "", stream)
+	return maybePrintOfferAnswer(s.appendAnswer(peerConnection.LocalDescription().SDP), false), nil
 }
@@ -0,0 +1,91 @@
+package webrtc
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+func TestAllowPLI(t *testing.T) {
+	s := &Server{pliThrottleWindow: 300 * time.Millisecond}
+	stream := &stream{}
+
+	// Of the PLIs of many viewers at once only one is sent
+	allowed := atomic.Int32{}
+	wg := sync.WaitGroup{}
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if s.allowPLI(stream) {
+				allowed.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if allowed.Load() != 1 {
+		t.Fatalf("%d concurrent PLIs were allowed", allowed.Load())
+	}
+	if s.allowPLI(stream) {
+		t.Fatal("PLI within PLI_THROTTLE_WINDOW was allowed")
+	}
+
+	time.Sleep(s.pliThrottleWindow)
+	if !s.allowPLI(stream) {
+		t.Fatal("PLI after PLI_THROTTLE_WINDOW was dropped")
+	}
+
+	s.pliThrottleWindow = 0
+	for i := 0; i < 3; i++ {
+		if !s.allowPLI(stream) {
+			t.Fatal("PLI was dropped without PLI_THROTTLE_WINDOW")
+		}
+	}
+}
+
+func TestWHIPBadOfferKeepsPublisher(t *testing.T) {
+	for _, conflict := range []string{PublisherConflictFirstWins, PublisherConflictLastWins} {
+		t.Run(conflict, func(t *testing.T) {
+			s := newTestServer(t, Options{PublisherConflict: conflict})
+			publisher := publishVideo(t, s, "live", [2]string{"desk", "camera"})
+
+			if _, err := s.WHIPWithCredential(context.Background(), "v=0\r\nnot an offer", "live", ""); err == nil {
+				t.Fatal("bad offer was answered")
+			}
+
+			s.streamMapLock.Lock()
+			stream := s.streamMap["live"]
+			published := stream != nil && stream.hasWHIPClient.Load() && len(stream.videoTracks) == 1
+			s.streamMapLock.Unlock()
+
+			if !published {
+				t.Fatal("bad offer took the stream from its publisher")
+			} else if state := publisher.ConnectionState(); state != webrtc.PeerConnectionStateConnected {
+				t.Fatalf("publisher is %s after the bad offer", state)
+			}
+		})
+	}
+}
+
+func TestWHIPBadOfferDoesntClaimStream(t *testing.T) {
+	s := newTestServer(t, Options{PublisherConflict: PublisherConflictFirstWins})
+
+	if _, err := s.WHIPWithCredential(context.Background(), "v=0\r\nnot an offer", "unclaimed", ""); err == nil {
+		t.Fatal("bad offer was answered")
+	}
+
+	s.streamMapLock.Lock()
+	_, exists := s.streamMap["unclaimed"]
+	s.streamMapLock.Unlock()
+	if exists {
+		t.Fatal("bad offer created the stream")
+	}
+
+	// Fails the test if the stream is still claimed by the bad offer
+	publishVideo(t, s, "unclaimed", [2]string{"desk", "camera"})
+}
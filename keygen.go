@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/glimesh/broadcast-box/broadcastbox"
+	"github.com/glimesh/broadcast-box/internal/audit"
+	"github.com/glimesh/broadcast-box/internal/keystore"
+	"github.com/glimesh/broadcast-box/internal/logging"
+)
+
+// runKeygen is `broadcast-box keygen [-store path] [-description text] [stream key]`. It
+// prints a new publisher key for the stream key, a random one if it isn't given, and stores
+// its hash in the key store.
+func runKeygen(args []string) {
+	loadSubcommandEnv()
+
+	flags := flag.NewFlagSet("keygen", flag.ExitOnError)
+	storePath := flags.String("store", os.Getenv("KEY_STORE_PATH"), "SQLite key store, KEY_STORE_PATH by default")
+	description := flags.String("description", "", "Description of a stream key that is created")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: broadcast-box keygen [-store path] [-description text] [stream key]")
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+
+	if *storePath == "" || flags.NArg() > 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	streamKey, key, err := generatePublisherKey(*storePath, flags.Arg(0), *description)
+	if err != nil {
+		logging.Fatal(logger, "Failed to generate publisher key", "err", err)
+	}
+
+	if auditLogPath := os.Getenv("AUDIT_LOG_FILE"); auditLogPath != "" {
+		auditLog, err := audit.Open(auditLogPath)
+		if err != nil {
+			logging.Fatal(logger, "Failed to open AUDIT_LOG_FILE", "err", err)
+		}
+		defer auditLog.Close()
+
+		auditLog.Record(audit.Entry{Action: audit.ActionKeyGenerate, Actor: "cli", StreamKey: streamKey})
+	}
+
+	fmt.Printf("Stream key:    %s\nPublisher key: %s\n", streamKey, key)
+}
+
+// generatePublisherKey stores a new publisher key of streamKey, a random one if it is empty, in
+// the key store at storePath. It returns the stream key and the publisher key.
+func generatePublisherKey(storePath, streamKey, description string) (string, string, error) {
+	if streamKey == "" {
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			return "", "", err
+		}
+		streamKey = hex.EncodeToString(b)
+	} else if !broadcastbox.ValidateStreamKey(streamKey) {
+		return "", "", fmt.Errorf("invalid stream key %q", streamKey)
+	}
+
+	store, err := keystore.Open(storePath)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to open key store %s: %w", storePath, err)
+	}
+	defer store.Close()
+
+	key, err := store.GenerateKey(streamKey, description)
+	if err != nil {
+		return "", "", err
+	}
+
+	return streamKey, key, nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/glimesh/broadcast-box/internal/keystore"
+)
+
+func TestGeneratePublisherKey(t *testing.T) {
+	storePath := filepath.Join(t.TempDir(), "keys.db")
+
+	streamKey, key, err := generatePublisherKey(storePath, "", "Encoder")
+	if err != nil {
+		t.Fatal(err)
+	} else if len(streamKey) != 32 || !strings.HasPrefix(key, "bbk_") || strings.Contains(key, streamKey) {
+		t.Fatalf("generated %q and %q", streamKey, key)
+	}
+
+	named, namedKey, err := generatePublisherKey(storePath, "live", "")
+	if err != nil || named != "live" {
+		t.Fatalf("generated %q, %v", named, err)
+	}
+
+	if _, _, err = generatePublisherKey(storePath, "../live", ""); err == nil {
+		t.Fatal("invalid stream key was accepted")
+	}
+
+	store, err := keystore.Open(storePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	for publisherKey, want := range map[string]string{key: streamKey, namedKey: "live"} {
+		if got, ok, err := store.Authenticate(publisherKey); err != nil || !ok || got != want {
+			t.Errorf("publisher key of %s returned %q, %v, %v", want, got, ok, err)
+		}
+	}
+
+	// Stream keys with a publisher key can't be published with the stream key alone
+	if _, ok, err := store.Authenticate("live"); err != nil || ok {
+		t.Errorf("stream key returned %v, %v", ok, err)
+	}
+}
@@ -1,24 +1,25 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"os"
 	"path"
 	"path/filepath"
-	"regexp"
 	"strings"
 	"time"
 
 	"crypto/tls"
-	"log"
+	"net"
 	"net/http"
 
+	"github.com/glimesh/broadcast-box/broadcastbox"
+	"github.com/glimesh/broadcast-box/internal/events"
+	"github.com/glimesh/broadcast-box/internal/logging"
 	"github.com/glimesh/broadcast-box/internal/networktest"
-	"github.com/glimesh/broadcast-box/internal/webrtc"
+	"github.com/glimesh/broadcast-box/internal/tracing"
 	"github.com/joho/godotenv"
+	"github.com/quic-go/quic-go/http3"
 )
 
 const (
@@ -32,139 +33,42 @@ const (
 
 var noBuildDirectoryErr = errors.New("\033[0;31mBuild directory does not exist, run `npm install` and `npm run build` in the web directory.\033[0m")
 
-type (
-	whepLayerRequestJSON struct {
-		MediaId    string `json:"mediaId"`
-		EncodingId string `json:"encodingId"`
-	}
-)
-
-func logHTTPError(w http.ResponseWriter, err string, code int) {
-	log.Println(err)
-	http.Error(w, err, code)
-}
-
-func validateStreamKey(streamKey string) bool {
-	return regexp.MustCompile(`^[a-zA-Z0-9_\-\.~]+$`).MatchString(streamKey)
-}
-
-func extractBearerToken(authHeader string) (string, bool) {
-	const bearerPrefix = "Bearer "
-	if strings.HasPrefix(authHeader, bearerPrefix) {
-		return strings.TrimPrefix(authHeader, bearerPrefix), true
-	}
-	return "", false
-}
-
-func whipHandler(res http.ResponseWriter, r *http.Request) {
-	if r.Method == "DELETE" {
-		return
-	}
-
-	streamKeyHeader := r.Header.Get("Authorization")
-	if streamKeyHeader == "" {
-		logHTTPError(res, "Authorization was not set", http.StatusBadRequest)
-		return
-	}
-
-	streamKey, ok := extractBearerToken(streamKeyHeader)
-	if !ok || !validateStreamKey(streamKey) {
-		logHTTPError(res, "Invalid stream key format", http.StatusBadRequest)
-		return
-	}
+var logger = logging.Logger("main")
 
-	offer, err := io.ReadAll(r.Body)
-	if err != nil {
-		logHTTPError(res, err.Error(), http.StatusBadRequest)
-		return
+// Binds addr to HTTP_BIND_ADDR if set, keeping the port of addr
+func bindAddress(addr string) string {
+	bindAddr := os.Getenv("HTTP_BIND_ADDR")
+	if bindAddr == "" {
+		return addr
 	}
 
-	answer, err := webrtc.WHIP(string(offer), streamKey)
-	if err != nil {
-		logHTTPError(res, err.Error(), http.StatusBadRequest)
-		return
-	}
-
-	res.Header().Add("Location", "/api/whip")
-	res.Header().Add("Content-Type", "application/sdp")
-	res.WriteHeader(http.StatusCreated)
-	fmt.Fprint(res, answer)
-}
-
-func whepHandler(res http.ResponseWriter, req *http.Request) {
-	streamKeyHeader := req.Header.Get("Authorization")
-	if streamKeyHeader == "" {
-		logHTTPError(res, "Authorization was not set", http.StatusBadRequest)
-		return
-	}
-
-	streamKey, ok := extractBearerToken(streamKeyHeader)
-	if !ok || !validateStreamKey(streamKey) {
-		logHTTPError(res, "Invalid stream key format", http.StatusBadRequest)
-		return
-	}
-
-	offer, err := io.ReadAll(req.Body)
-	if err != nil {
-		logHTTPError(res, err.Error(), http.StatusBadRequest)
-		return
+	if net.ParseIP(bindAddr) == nil {
+		logging.Fatal(logger, "HTTP_BIND_ADDR is not a valid IP address", "value", bindAddr)
 	}
 
-	answer, whepSessionId, err := webrtc.WHEP(string(offer), streamKey)
-	if err != nil {
-		logHTTPError(res, err.Error(), http.StatusBadRequest)
-		return
+	if addr == "" {
+		addr = ":http"
 	}
 
-	apiPath := req.Host + strings.TrimSuffix(req.URL.RequestURI(), "whep")
-	res.Header().Add("Link", `<`+apiPath+"sse/"+whepSessionId+`>; rel="urn:ietf:params:whep:ext:core:server-sent-events"; events="layers"`)
-	res.Header().Add("Link", `<`+apiPath+"layer/"+whepSessionId+`>; rel="urn:ietf:params:whep:ext:core:layer"`)
-	res.Header().Add("Location", "/api/whep")
-	res.Header().Add("Content-Type", "application/sdp")
-	res.WriteHeader(http.StatusCreated)
-	fmt.Fprint(res, answer)
-}
-
-func whepServerSentEventsHandler(res http.ResponseWriter, req *http.Request) {
-	res.Header().Set("Content-Type", "text/event-stream")
-	res.Header().Set("Cache-Control", "no-cache")
-	res.Header().Set("Connection", "keep-alive")
-
-	vals := strings.Split(req.URL.RequestURI(), "/")
-	whepSessionId := vals[len(vals)-1]
-
-	layers, err := webrtc.WHEPLayers(whepSessionId)
+	_, port, err := net.SplitHostPort(addr)
 	if err != nil {
-		logHTTPError(res, err.Error(), http.StatusBadRequest)
-		return
+		logging.Fatal(logger, "Invalid address", "addr", addr, "err", err)
 	}
 
-	fmt.Fprint(res, "event: layers\n")
-	fmt.Fprintf(res, "data: %s\n", string(layers))
-	fmt.Fprint(res, "\n\n")
+	return net.JoinHostPort(bindAddr, port)
 }
 
-func whepLayerHandler(res http.ResponseWriter, req *http.Request) {
-	var r whepLayerRequestJSON
-	if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
-		logHTTPError(res, err.Error(), http.StatusBadRequest)
-		return
+// Loads the env file for subcommands, which work without it or the frontend
+func loadSubcommandEnv() {
+	envFile := envFileProd
+	if os.Getenv("APP_ENV") == "development" {
+		envFile = envFileDev
 	}
 
-	vals := strings.Split(req.URL.RequestURI(), "/")
-	whepSessionId := vals[len(vals)-1]
+	_ = godotenv.Load(envFile)
 
-	if err := webrtc.WHEPChangeLayer(whepSessionId, r.EncodingId); err != nil {
-		logHTTPError(res, err.Error(), http.StatusBadRequest)
-		return
-	}
-}
-
-func statusHandler(res http.ResponseWriter, req *http.Request) {
-	res.Header().Add("Content-Type", "application/json")
-
-	if err := json.NewEncoder(res).Encode(webrtc.GetStreamStatuses()); err != nil {
-		logHTTPError(res, err.Error(), http.StatusBadRequest)
+	if err := loadSecretFiles(); err != nil {
+		logging.Fatal(logger, "Failed to load secrets", "err", err)
 	}
 }
 
@@ -182,26 +86,32 @@ func indexHTMLWhenNotFound(fs http.FileSystem) http.Handler {
 	})
 }
 
-func corsHandler(next func(w http.ResponseWriter, r *http.Request)) http.HandlerFunc {
-	return func(res http.ResponseWriter, req *http.Request) {
-		res.Header().Set("Access-Control-Allow-Origin", "*")
-		res.Header().Set("Access-Control-Allow-Methods", "*")
-		res.Header().Set("Access-Control-Allow-Headers", "*")
-		res.Header().Set("Access-Control-Expose-Headers", "*")
+func main() {
+	if filepath.Base(os.Args[0]) == "bbctl" {
+		runCtl(os.Args[1:])
+		return
+	}
 
-		if req.Method != http.MethodOptions {
-			next(res, req)
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "ctl":
+			runCtl(os.Args[2:])
+			return
+		case "keygen":
+			runKeygen(os.Args[2:])
+			return
+		case "signurl":
+			runSignURL(os.Args[2:])
+			return
 		}
 	}
-}
 
-func main() {
 	loadConfigs := func() error {
 		if os.Getenv("APP_ENV") == "development" {
-			log.Println("Loading `" + envFileDev + "`")
+			logger.Info("Loading config", "file", envFileDev)
 			return godotenv.Load(envFileDev)
 		} else {
-			log.Println("Loading `" + envFileProd + "`")
+			logger.Info("Loading config", "file", envFileProd)
 			if err := godotenv.Load(envFileProd); err != nil {
 				return err
 			}
@@ -215,23 +125,130 @@ func main() {
 	}
 
 	if err := loadConfigs(); err != nil {
-		log.Println("Failed to find config in CWD, changing CWD to executable path")
+		logger.Info("Failed to find config in CWD, changing CWD to executable path")
 
 		exePath, err := os.Executable()
 		if err != nil {
-			log.Fatal(err)
+			logging.Fatal(logger, "Failed to find executable", "err", err)
 		}
 
 		if err = os.Chdir(filepath.Dir(exePath)); err != nil {
-			log.Fatal(err)
+			logging.Fatal(logger, "Failed to change CWD", "err", err)
 		}
 
 		if err = loadConfigs(); err != nil {
-			log.Fatal(err)
+			logging.Fatal(logger, "Failed to load config", "err", err)
+		}
+	}
+
+	if err := loadSecretFiles(); err != nil {
+		logging.Fatal(logger, "Failed to load secrets", "err", err)
+	}
+
+	if err := logging.Configure(); err != nil {
+		logging.Fatal(logger, "Failed to configure logging", "err", err)
+	}
+
+	eventPublishers, err := events.PublishersFromEnv()
+	if err != nil {
+		logging.Fatal(logger, "Failed to configure events", "err", err)
+	}
+
+	if err := tracing.Configure(); err != nil {
+		logging.Fatal(logger, "Failed to configure tracing", "err", err)
+	}
+
+	opts, err := optionsFromEnv()
+	if err != nil {
+		logging.Fatal(logger, "Invalid configuration", "err", err)
+	}
+	opts.EventPublishers = eventPublishers
+
+	broadcastBox, err := broadcastbox.NewServer(opts)
+	if err != nil {
+		logging.Fatal(logger, "Failed to start Broadcast Box", "err", err)
+	}
+
+	mux := http.NewServeMux()
+	if os.Getenv("DISABLE_FRONTEND") == "" {
+		mux.Handle("/", indexHTMLWhenNotFound(http.Dir("./web/build")))
+	}
+	broadcastBox.RegisterHandlers(mux)
+
+	if mtlsAddr := os.Getenv("WHIP_MTLS_ADDRESS"); mtlsAddr != "" {
+		if os.Getenv("SSL_CERT") == "" || os.Getenv("SSL_KEY") == "" || os.Getenv("WHIP_MTLS_CLIENT_CA") == "" {
+			logging.Fatal(logger, "WHIP_MTLS_ADDRESS requires SSL_CERT, SSL_KEY and WHIP_MTLS_CLIENT_CA")
+		}
+
+		go func() {
+			logger.Info("Running WHIP mutual TLS Server", "addr", mtlsAddr)
+			err := broadcastBox.ListenAndServeWHIPMutualTLS(bindAddress(mtlsAddr), os.Getenv("SSL_CERT"), os.Getenv("SSL_KEY"), os.Getenv("WHIP_MTLS_CLIENT_CA"))
+			logging.Fatal(logger, "WHIP mutual TLS Server failed", "err", err)
+		}()
+	}
+
+	pprofServer, err := newPprofServer()
+	if err != nil {
+		logging.Fatal(logger, "Failed to configure pprof", "err", err)
+	} else if pprofServer != nil {
+		go func() {
+			logger.Info("Running pprof Server", "addr", pprofServer.Addr)
+			logging.Fatal(logger, "pprof Server failed", "err", pprofServer.ListenAndServe())
+		}()
+	}
+
+	if rtmpAddr := os.Getenv("RTMP_ADDRESS"); rtmpAddr != "" {
+		go func() {
+			logger.Info("Running RTMP Server", "addr", rtmpAddr)
+			logging.Fatal(logger, "RTMP Server failed", "err", broadcastBox.ListenAndServeRTMP(rtmpAddr))
+		}()
+	}
+
+	if srtAddr := os.Getenv("SRT_ADDRESS"); srtAddr != "" {
+		go func() {
+			logger.Info("Running SRT Server", "addr", srtAddr)
+			logging.Fatal(logger, "SRT Server failed", "err", broadcastBox.ListenAndServeSRT(srtAddr))
+		}()
+	}
+
+	if ristAddr := os.Getenv("RIST_ADDRESS"); ristAddr != "" {
+		go func() {
+			logger.Info("Running RIST Server", "addr", ristAddr)
+			logging.Fatal(logger, "RIST Server failed", "err", broadcastBox.ListenAndServeRIST(ristAddr))
+		}()
+	}
+
+	if rtspAddr := os.Getenv("RTSP_ADDRESS"); rtspAddr != "" {
+		go func() {
+			logger.Info("Running RTSP Server", "addr", rtspAddr)
+			logging.Fatal(logger, "RTSP Server failed", "err", broadcastBox.ListenAndServeRTSP(rtspAddr))
+		}()
+	}
+
+	if grpcAddr := os.Getenv("GRPC_ADDRESS"); grpcAddr != "" {
+		if opts.AdminToken == "" {
+			logging.Fatal(logger, "GRPC_ADDRESS requires ADMIN_TOKEN")
 		}
+
+		go func() {
+			logger.Info("Running gRPC Server", "addr", grpcAddr)
+			logging.Fatal(logger, "gRPC Server failed", "err", broadcastBox.ListenAndServeGRPC(bindAddress(grpcAddr), opts.AdminToken, os.Getenv("SSL_CERT"), os.Getenv("SSL_KEY")))
+		}()
 	}
 
-	webrtc.Configure()
+	if udpIngest := os.Getenv("UDP_INGEST"); udpIngest != "" {
+		for _, entry := range strings.Split(udpIngest, "|") {
+			udpAddr, streamKey, ok := strings.Cut(entry, "=")
+			if !ok {
+				logging.Fatal(logger, "UDP_INGEST entries must be formatted as `address=streamKey`", "entry", entry)
+			}
+
+			go func() {
+				logger.Info("Running UDP Server", "addr", udpAddr, "streamKey", streamKey)
+				logging.Fatal(logger, "UDP Server failed", "streamKey", streamKey, "err", broadcastBox.ListenAndServeUDP(udpAddr, streamKey))
+			}()
+		}
+	}
 
 	if os.Getenv("NETWORK_TEST_ON_START") == "true" {
 		fmt.Println(networkTestIntroMessage) //nolint
@@ -239,7 +256,7 @@ func main() {
 		go func() {
 			time.Sleep(time.Second * 5)
 
-			if networkTestErr := networktest.Run(whepHandler); networkTestErr != nil {
+			if networkTestErr := networktest.Run(mux); networkTestErr != nil {
 				fmt.Printf(networkTestFailedMessage, networkTestErr.Error())
 				os.Exit(1)
 			} else {
@@ -253,42 +270,41 @@ func main() {
 		httpsRedirectPort = val
 	}
 
-	if os.Getenv("HTTPS_REDIRECT_PORT") != "" || os.Getenv("ENABLE_HTTP_REDIRECT") != "" {
+	tlsKey := os.Getenv("SSL_KEY")
+	tlsCert := os.Getenv("SSL_CERT")
+
+	acmeManager := newACMEManager()
+	if acmeManager != nil && (tlsKey != "" || tlsCert != "") {
+		logging.Fatal(logger, "ACME_DOMAINS can't be used with SSL_CERT and SSL_KEY")
+	}
+
+	// HTTP-01 challenges are answered on the redirect Server, so ACME always runs it
+	if os.Getenv("HTTPS_REDIRECT_PORT") != "" || os.Getenv("ENABLE_HTTP_REDIRECT") != "" || acmeManager != nil {
 		go func() {
+			var redirectHandler http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				http.Redirect(w, r, "https://"+r.Host+r.URL.String(), http.StatusMovedPermanently)
+			})
+			if acmeManager != nil {
+				redirectHandler = acmeManager.HTTPHandler(redirectHandler)
+			}
+
 			redirectServer := &http.Server{
-				Addr: ":" + httpsRedirectPort,
-				Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-					http.Redirect(w, r, "https://"+r.Host+r.URL.String(), http.StatusMovedPermanently)
-				}),
+				Addr:    bindAddress(":" + httpsRedirectPort),
+				Handler: redirectHandler,
 			}
 
-			log.Println("Running HTTP->HTTPS redirect Server at :" + httpsRedirectPort)
-			log.Fatal(redirectServer.ListenAndServe())
+			logger.Info("Running HTTP->HTTPS redirect Server", "addr", redirectServer.Addr)
+			logging.Fatal(logger, "HTTP->HTTPS redirect Server failed", "err", redirectServer.ListenAndServe())
 		}()
 
 	}
 
-	mux := http.NewServeMux()
-	if os.Getenv("DISABLE_FRONTEND") == "" {
-		mux.Handle("/", indexHTMLWhenNotFound(http.Dir("./web/build")))
-	}
-	mux.HandleFunc("/api/whip", corsHandler(whipHandler))
-	mux.HandleFunc("/api/whep", corsHandler(whepHandler))
-	mux.HandleFunc("/api/sse/", corsHandler(whepServerSentEventsHandler))
-	mux.HandleFunc("/api/layer/", corsHandler(whepLayerHandler))
-
-	if os.Getenv("DISABLE_STATUS") == "" {
-		mux.HandleFunc("/api/status", corsHandler(statusHandler))
-	}
-
+	handler := broadcastBox.AccessLogHandler(mux)
 	server := &http.Server{
-		Handler: mux,
-		Addr:    os.Getenv("HTTP_ADDRESS"),
+		Handler: handler,
+		Addr:    bindAddress(os.Getenv("HTTP_ADDRESS")),
 	}
 
-	tlsKey := os.Getenv("SSL_KEY")
-	tlsCert := os.Getenv("SSL_CERT")
-
 	if tlsKey != "" && tlsCert != "" {
 		server.TLSConfig = &tls.Config{
 			Certificates: []tls.Certificate{},
@@ -296,16 +312,48 @@ func main() {
 
 		cert, err := tls.LoadX509KeyPair(tlsCert, tlsKey)
 		if err != nil {
-			log.Fatal(err)
+			logging.Fatal(logger, "Failed to load SSL_CERT and SSL_KEY", "err", err)
 		}
 
 		server.TLSConfig.Certificates = append(server.TLSConfig.Certificates, cert)
+		broadcastBox.AddReadinessCheck("tls", certificateCheck(cert))
+	} else if acmeManager != nil {
+		// Also answers TLS-ALPN-01 challenges
+		server.TLSConfig = acmeManager.TLSConfig()
+		broadcastBox.AddReadinessCheck("tls", acmeCertificateCheck(acmeManager))
+	}
+
+	if server.TLSConfig != nil {
+		if http3Addr := os.Getenv("HTTP3_ADDRESS"); http3Addr != "" {
+			http3Server := &http3.Server{
+				Handler:   handler,
+				Addr:      bindAddress(http3Addr),
+				TLSConfig: server.TLSConfig,
+			}
 
-		log.Println("Running HTTPS Server at `" + os.Getenv("HTTP_ADDRESS") + "`")
-		log.Fatal(server.ListenAndServeTLS("", ""))
+			// Clients learn about HTTP/3 from the Alt-Svc header of HTTPS responses
+			server.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if err := http3Server.SetQUICHeaders(w.Header()); err != nil {
+					logger.Warn("Failed to set Alt-Svc header", "err", err)
+				}
+				handler.ServeHTTP(w, r)
+			})
+
+			go func() {
+				logger.Info("Running HTTP/3 Server", "addr", http3Server.Addr)
+				logging.Fatal(logger, "HTTP/3 Server failed", "err", http3Server.ListenAndServe())
+			}()
+		}
+
+		logger.Info("Running HTTPS Server", "addr", server.Addr)
+		logging.Fatal(logger, "HTTPS Server failed", "err", server.ListenAndServeTLS("", ""))
 	} else {
-		log.Println("Running HTTP Server at `" + os.Getenv("HTTP_ADDRESS") + "`")
-		log.Fatal(server.ListenAndServe())
+		if os.Getenv("HTTP3_ADDRESS") != "" {
+			logging.Fatal(logger, "HTTP3_ADDRESS requires SSL_CERT and SSL_KEY or ACME_DOMAINS")
+		}
+
+		logger.Info("Running HTTP Server", "addr", server.Addr)
+		logging.Fatal(logger, "HTTP Server failed", "err", server.ListenAndServe())
 	}
 
 }
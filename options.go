@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/glimesh/broadcast-box/broadcastbox"
+	"github.com/glimesh/broadcast-box/internal/webrtc"
+)
+
+// splitList splits a `|` separated list, an empty one has no entries
+func splitList(val string) []string {
+	if val == "" {
+		return nil
+	}
+
+	return strings.Split(val, "|")
+}
+
+// optionsFromEnv returns the Options of the Broadcast Box server, read from the environment
+func optionsFromEnv() (broadcastbox.Options, error) {
+	webrtcOpts, err := webrtc.OptionsFromEnv()
+	if err != nil {
+		return broadcastbox.Options{}, err
+	}
+
+	opts := broadcastbox.Options{
+		Options: webrtcOpts,
+
+		WHIPTokens:    splitList(os.Getenv("WHIP_TOKENS")),
+		WHEPTokens:    splitList(os.Getenv("WHEP_TOKENS")),
+		WHIPTokenFile: os.Getenv("WHIP_TOKEN_FILE"),
+		WHEPTokenFile: os.Getenv("WHEP_TOKEN_FILE"),
+
+		JWTSecret:  os.Getenv("JWT_SECRET"),
+		JWTJWKSURL: os.Getenv("JWT_JWKS_URL"),
+
+		AuthWebhookURL:    os.Getenv("AUTH_WEBHOOK_URL"),
+		AuthWebhookSecret: os.Getenv("AUTH_WEBHOOK_SECRET"),
+
+		OIDCIssuer:        os.Getenv("OIDC_ISSUER"),
+		OIDCClientID:      os.Getenv("OIDC_CLIENT_ID"),
+		OIDCClientSecret:  os.Getenv("OIDC_CLIENT_SECRET"),
+		OIDCRedirectURL:   os.Getenv("OIDC_REDIRECT_URL"),
+		OIDCAllowedEmails: splitList(os.Getenv("OIDC_ALLOWED_EMAILS")),
+
+		AdminToken:    os.Getenv("ADMIN_TOKEN"),
+		EnableMetrics: os.Getenv("ENABLE_METRICS") != "",
+		MetricsToken:  os.Getenv("METRICS_TOKEN"),
+
+		DisableStatus:        os.Getenv("DISABLE_STATUS") != "",
+		DisableRestream:      os.Getenv("DISABLE_RESTREAM") != "",
+		DisableRecordingsAPI: os.Getenv("DISABLE_RECORDINGS_API") != "",
+
+		SignalingRateLimitPerIP: os.Getenv("SIGNALING_RATE_LIMIT_PER_IP"),
+		SignalingRateLimit:      os.Getenv("SIGNALING_RATE_LIMIT"),
+
+		WHIPAllowCIDRs: splitList(os.Getenv("WHIP_ALLOW_CIDRS")),
+		WHIPDenyCIDRs:  splitList(os.Getenv("WHIP_DENY_CIDRS")),
+		WHEPAllowCIDRs: splitList(os.Getenv("WHEP_ALLOW_CIDRS")),
+		WHEPDenyCIDRs:  splitList(os.Getenv("WHEP_DENY_CIDRS")),
+		TrustedProxies: splitList(os.Getenv("TRUSTED_PROXIES")),
+
+		AuditLogFile:  os.Getenv("AUDIT_LOG_FILE"),
+		GeoIPDatabase: os.Getenv("GEOIP_DATABASE"),
+
+		AccessLog:             os.Getenv("ACCESS_LOG"),
+		AccessLogFile:         os.Getenv("ACCESS_LOG_FILE"),
+		AccessLogExcludePaths: splitList(os.Getenv("ACCESS_LOG_EXCLUDE_PATHS")),
+
+		WHEPURLSecret: os.Getenv("WHEP_URL_SECRET"),
+		KeyStorePath:  os.Getenv("KEY_STORE_PATH"),
+		UsageDBPath:   os.Getenv("USAGE_DB_PATH"),
+
+		WHIPRequireClientCert: os.Getenv("WHIP_REQUIRE_CLIENT_CERT") != "",
+		DebugLogSDP:           os.Getenv("DEBUG_LOG_SDP") != "",
+
+		WHIPCORS: corsOptionsFromEnv("WHIP"),
+		WHEPCORS: corsOptionsFromEnv("WHEP"),
+		APICORS:  corsOptionsFromEnv("API"),
+	}
+
+	if val := os.Getenv("MAX_SESSIONS_PER_CREDENTIAL"); val != "" {
+		if opts.MaxSessionsPerCredential, err = strconv.Atoi(val); err != nil {
+			return opts, fmt.Errorf("MAX_SESSIONS_PER_CREDENTIAL: %w", err)
+		}
+	}
+
+	if val := os.Getenv("BAN_AFTER_FAILURES"); val != "" {
+		if opts.BanAfterFailures, err = strconv.Atoi(val); err != nil {
+			return opts, fmt.Errorf("BAN_AFTER_FAILURES: %w", err)
+		}
+	}
+
+	if val := os.Getenv("BAN_FIND_TIME"); val != "" {
+		if opts.BanFindTime, err = time.ParseDuration(val); err != nil {
+			return opts, fmt.Errorf("BAN_FIND_TIME: %w", err)
+		}
+	}
+
+	if val := os.Getenv("BAN_DURATION"); val != "" {
+		if opts.BanDuration, err = time.ParseDuration(val); err != nil {
+			return opts, fmt.Errorf("BAN_DURATION: %w", err)
+		}
+	}
+
+	return opts, nil
+}
+
+// corsOptionsFromEnv reads the CORSOptions of group from the environment
+func corsOptionsFromEnv(group string) broadcastbox.CORSOptions {
+	getenv := func(name string) string {
+		if value := os.Getenv("CORS_" + group + "_" + name); value != "" {
+			return value
+		}
+		return os.Getenv("CORS_" + name)
+	}
+
+	return broadcastbox.CORSOptions{
+		AllowedOrigins:   splitList(getenv("ALLOWED_ORIGINS")),
+		AllowedMethods:   getenv("ALLOWED_METHODS"),
+		AllowedHeaders:   getenv("ALLOWED_HEADERS"),
+		AllowCredentials: getenv("ALLOW_CREDENTIALS") == "true",
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"runtime"
+	"strconv"
+)
+
+// Samples one in this many mutex contention events by default, enough to find contended locks
+// in the fanout to viewers without measurable overhead
+const pprofMutexProfileFractionDefault = 100
+
+// newPprofServer returns the server of the net/http/pprof endpoints on PPROF_ADDRESS, nil
+// without it. They are only served there, not next to WHIP and WHEP.
+func newPprofServer() (*http.Server, error) {
+	addr := os.Getenv("PPROF_ADDRESS")
+	if addr == "" {
+		return nil, nil
+	}
+
+	mutexProfileFraction := pprofMutexProfileFractionDefault
+	if val := os.Getenv("PPROF_MUTEX_PROFILE_FRACTION"); val != "" {
+		var err error
+		if mutexProfileFraction, err = strconv.Atoi(val); err != nil {
+			return nil, fmt.Errorf("PPROF_MUTEX_PROFILE_FRACTION: %w", err)
+		}
+	}
+	runtime.SetMutexProfileFraction(mutexProfileFraction)
+
+	if val := os.Getenv("PPROF_BLOCK_PROFILE_RATE"); val != "" {
+		blockProfileRate, err := strconv.Atoi(val)
+		if err != nil {
+			return nil, fmt.Errorf("PPROF_BLOCK_PROFILE_RATE: %w", err)
+		}
+		runtime.SetBlockProfileRate(blockProfileRate)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	return &http.Server{Addr: addr, Handler: mux}, nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// certificateCheck is the readiness check of SSL_CERT, which fails once it expired
+func certificateCheck(cert tls.Certificate) func() error {
+	return func() error {
+		if len(cert.Certificate) == 0 {
+			return errors.New("no certificate loaded")
+		}
+
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return err
+		}
+
+		return checkValidity(leaf)
+	}
+}
+
+// acmeCertificateCheck is the readiness check of the certificates ACME obtained for
+// ACME_DOMAINS. They are only obtained on the first connection, so a domain without one yet
+// doesn't fail it. One that expired does, as renewing it must have failed.
+func acmeCertificateCheck(manager *autocert.Manager) func() error {
+	return func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		for _, domain := range strings.Split(os.Getenv("ACME_DOMAINS"), "|") {
+			data, err := manager.Cache.Get(ctx, domain)
+			if errors.Is(err, autocert.ErrCacheMiss) {
+				continue
+			} else if err != nil {
+				return fmt.Errorf("%s: %w", domain, err)
+			}
+
+			// The private key comes first, then the chain starting with the leaf
+			for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+				if block.Type != "CERTIFICATE" {
+					continue
+				}
+
+				leaf, err := x509.ParseCertificate(block.Bytes)
+				if err != nil {
+					return fmt.Errorf("%s: %w", domain, err)
+				} else if err = checkValidity(leaf); err != nil {
+					return fmt.Errorf("%s: %w", domain, err)
+				}
+				break
+			}
+		}
+
+		return nil
+	}
+}
+
+func checkValidity(leaf *x509.Certificate) error {
+	if now := time.Now(); now.After(leaf.NotAfter) {
+		return fmt.Errorf("certificate expired at %s", leaf.NotAfter.Format(time.RFC3339))
+	} else if now.Before(leaf.NotBefore) {
+		return fmt.Errorf("certificate isn't valid before %s", leaf.NotBefore.Format(time.RFC3339))
+	}
+
+	return nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Settings that can be read from the file at `<name>_FILE` instead, like a Docker or Kubernetes
+// secret. WHIP_TOKENS and WHEP_TOKENS have WHIP_TOKEN_FILE and WHEP_TOKEN_FILE.
+var secretSettings = []string{
+	"ADMIN_TOKEN",
+	"AUTH_WEBHOOK_SECRET",
+	"EVENTS_MQTT_URL",
+	"EVENTS_NATS_URL",
+	"EVENTS_WEBHOOK_SECRET",
+	"JWT_SECRET",
+	"OIDC_CLIENT_SECRET",
+	"RECORDING_UPLOAD_ACCESS_KEY_ID",
+	"RECORDING_UPLOAD_SECRET_ACCESS_KEY",
+	"RECORDING_UPLOAD_URL",
+	"RELAY_STREAM_KEYS",
+	"RELAY_UPSTREAM_URL",
+	"UDP_INGEST",
+	"WHEP_URL_SECRET",
+}
+
+// Sets the secretSettings that have a `<name>_FILE` to the contents of the file, without the
+// trailing newline most editors and `echo` add
+func loadSecretFiles() error {
+	for _, name := range secretSettings {
+		path := os.Getenv(name + "_FILE")
+		if path == "" {
+			continue
+		} else if os.Getenv(name) != "" {
+			return fmt.Errorf("%s and %s_FILE are both set", name, name)
+		}
+
+		value, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("%s_FILE: %w", name, err)
+		}
+
+		if err = os.Setenv(name, strings.TrimRight(string(value), "\r\n")); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
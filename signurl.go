@@ -0,0 +1,44 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/glimesh/broadcast-box/broadcastbox"
+	"github.com/glimesh/broadcast-box/internal/logging"
+)
+
+// runSignURL is `broadcast-box signurl [-expires duration] [-ip address] [-base url] <stream key>`.
+// It prints a player and a WHEP URL signed with WHEP_URL_SECRET that play the stream key until
+// they expire.
+func runSignURL(args []string) {
+	loadSubcommandEnv()
+
+	flags := flag.NewFlagSet("signurl", flag.ExitOnError)
+	expires := flags.Duration("expires", time.Hour, "How long the URL can be used")
+	ip := flags.String("ip", "", "Only allow this client address")
+	base := flags.String("base", "http://localhost:8080", "URL of Broadcast Box")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: broadcast-box signurl [-expires duration] [-ip address] [-base url] <stream key>")
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+
+	secret := os.Getenv("WHEP_URL_SECRET")
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	} else if secret == "" {
+		logging.Fatal(logger, "WHEP_URL_SECRET isn't set")
+	} else if !broadcastbox.ValidateStreamKey(flags.Arg(0)) {
+		logging.Fatal(logger, "Invalid stream key", "streamKey", flags.Arg(0))
+	}
+
+	query := broadcastbox.SignWHEPQuery(secret, flags.Arg(0), time.Now().Add(*expires), *ip)
+	baseURL := strings.TrimSuffix(*base, "/")
+
+	fmt.Printf("Player: %s/%s?%s\nWHEP:   %s/api/whep?%s\n", baseURL, flags.Arg(0), query.Encode(), baseURL, query.Encode())
+}
@@ -69,7 +69,7 @@ function Player({ cinemaMode }) {
       offer["sdp"] = offer["sdp"].replace("useinbandfec=1", "useinbandfec=1;stereo=1")
       peerConnection.setLocalDescription(offer)
 
-      fetch(`${process.env.REACT_APP_API_PATH}/whep`, {
+      fetch(`${process.env.REACT_APP_API_PATH}/whep${location.search}`, {
         method: 'POST',
         body: offer.sdp,
         headers: {